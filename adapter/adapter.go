@@ -0,0 +1,115 @@
+// Package adapter contains the glue between a chat network and a prekey server.
+// A front end implements Transport, to receive requests from the network, and Request,
+// to give the envelopes received and send back the replies. The Runner hands every envelope
+// to the server, limits how many requests are handled at the same time, delivers the replies,
+// and reports errors back to the sender and to the log.
+package adapter
+
+import (
+	"errors"
+	"fmt"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// ErrClosed is returned by Receive when the transport has been closed
+var ErrClosed = errors.New("the transport has been closed")
+
+// ErrOverloaded is the reason given when a request is refused because too many are in progress
+var ErrOverloaded = errors.New("too many requests in progress")
+
+// Envelope is one message received from the network
+type Envelope struct {
+	// From is the from-address of the sender. The transport is responsible for only
+	// giving addresses that it trusts - for example, after authenticating the sender
+	From string
+	// Message is the message in its original form, excluding surrounding whitespace
+	Message string
+}
+
+// Request is one exchange with a sender: the envelopes received together, and the replies to them
+type Request interface {
+	// Envelopes returns the envelopes in the request. It's called from the goroutine handling
+	// the request, so it can block while reading from the network. A request without envelopes
+	// gets an empty reply
+	Envelopes() ([]*Envelope, error)
+	// Reply sends back the replies to the envelopes, in the same order. Each message in a reply
+	// has to reach the sender as a separate network packet or message
+	Reply(replies [][]string) error
+	// Fail reports an error to the sender, instead of replying
+	Fail(e *Error)
+	// Close is called when the runner is done with the request
+	Close() error
+}
+
+// Transport receives requests from the network
+type Transport interface {
+	// Receive waits for the next request. It returns ErrClosed when the transport has been closed
+	Receive() (Request, error)
+	// Close stops receiving requests
+	Close() error
+}
+
+// Restricter can be implemented by requests from senders that are only allowed to do some things.
+// The envelopes of the request will be handed to the server returned by Restrict, instead of
+// the server of the runner.
+type Restricter interface {
+	Restrict(s pks.Server) pks.Server
+}
+
+// ErrorKind tells at what point a request failed, so transports can report it in their own way
+type ErrorKind int
+
+const (
+	// Unauthorized means the sender couldn't be verified
+	Unauthorized ErrorKind = iota
+	// ReadFailed means the request couldn't be read from the network
+	ReadFailed
+	// HandleFailed means the request was malformed, or the server couldn't handle it
+	HandleFailed
+	// WriteFailed means the replies couldn't be sent back
+	WriteFailed
+	// Overloaded means too many requests were in progress to handle this one
+	Overloaded
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case Unauthorized:
+		return "verifying client"
+	case ReadFailed:
+		return "reading data"
+	case HandleFailed:
+		return "handling data"
+	case WriteFailed:
+		return "writing data"
+	case Overloaded:
+		return "accepting request"
+	}
+	return "unknown"
+}
+
+// Error is an error that happened while handling a request
+type Error struct {
+	Kind ErrorKind
+	// From is the from-address of the envelope that failed, if the failure was caused by one
+	From string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+// NewError returns an error of the given kind. Transports can return these from Envelopes,
+// to tell how reading the request failed - other errors are treated as ReadFailed
+func NewError(kind ErrorKind, e error) *Error {
+	return &Error{Kind: kind, Err: e}
+}
+
+func errorOf(kind ErrorKind, e error) *Error {
+	if ae, ok := e.(*Error); ok {
+		return ae
+	}
+	return NewError(kind, e)
+}
@@ -0,0 +1,140 @@
+package adapter
+
+import (
+	"sync/atomic"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// Runner hands the requests from a transport to a prekey server
+type Runner struct {
+	// Server handles the envelopes
+	Server pks.Server
+	// MaxConcurrent is the maximum number of requests handled at the same time. Requests
+	// beyond that fail with Overloaded. Zero means no limit
+	MaxConcurrent int
+	// Logf is called with a message for every error, if it's set
+	Logf func(format string, args ...interface{})
+
+	active int32
+}
+
+// waitInterval is how often Wait checks whether the requests in progress have finished
+var waitInterval = time.Duration(10) * time.Millisecond
+
+// Run receives requests from the transport and handles each of them in its own goroutine,
+// until the transport is closed
+func (r *Runner) Run(t Transport) error {
+	for {
+		req, e := t.Receive()
+		if e == ErrClosed {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		r.Dispatch(req)
+	}
+}
+
+// Dispatch handles the request in its own goroutine
+func (r *Runner) Dispatch(req Request) {
+	if !r.begin() {
+		r.refuse(req)
+		return
+	}
+	go func() {
+		defer r.end()
+		r.handle(req)
+	}()
+}
+
+// Serve handles the request, returning when it's done
+func (r *Runner) Serve(req Request) {
+	if !r.begin() {
+		r.refuse(req)
+		return
+	}
+	defer r.end()
+	r.handle(req)
+}
+
+// Active returns the number of requests in progress
+func (r *Runner) Active() int {
+	return int(atomic.LoadInt32(&r.active))
+}
+
+// Wait waits for the requests in progress to finish, up to the timeout.
+// It returns false if some of them were still in progress when the timeout was reached
+func (r *Runner) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for r.Active() > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(waitInterval)
+	}
+	return true
+}
+
+func (r *Runner) begin() bool {
+	n := atomic.AddInt32(&r.active, 1)
+	if r.MaxConcurrent > 0 && int(n) > r.MaxConcurrent {
+		atomic.AddInt32(&r.active, -1)
+		return false
+	}
+	return true
+}
+
+func (r *Runner) end() {
+	atomic.AddInt32(&r.active, -1)
+}
+
+func (r *Runner) refuse(req Request) {
+	defer req.Close()
+	r.fail(req, NewError(Overloaded, ErrOverloaded))
+}
+
+func (r *Runner) logError(e *Error) {
+	if r.Logf != nil {
+		r.Logf("Encountered error when %v: %v\n", e.Kind, e.Err)
+	}
+}
+
+func (r *Runner) fail(req Request, e *Error) {
+	r.logError(e)
+	req.Fail(e)
+}
+
+func (r *Runner) serverFor(req Request) pks.Server {
+	if rr, ok := req.(Restricter); ok {
+		return rr.Restrict(r.Server)
+	}
+	return r.Server
+}
+
+func (r *Runner) handle(req Request) {
+	defer req.Close()
+
+	envs, e := req.Envelopes()
+	if e != nil {
+		r.fail(req, errorOf(ReadFailed, e))
+		return
+	}
+
+	s := r.serverFor(req)
+	replies := make([][]string, 0, len(envs))
+	for _, env := range envs {
+		res, e := s.Handle(env.From, env.Message)
+		if e != nil {
+			r.fail(req, &Error{Kind: HandleFailed, From: env.From, Err: e})
+			return
+		}
+		replies = append(replies, res)
+	}
+
+	if e := req.Reply(replies); e != nil {
+		r.logError(&Error{Kind: WriteFailed, Err: e})
+	}
+}
@@ -0,0 +1,253 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type AdapterSuite struct{}
+
+var _ = Suite(&AdapterSuite{})
+
+type mockServer struct {
+	sync.Mutex
+	received []string
+	fail     map[string]error
+}
+
+func (ms *mockServer) Handle(from, message string) ([]string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.received = append(ms.received, from+":"+message)
+	if e := ms.fail[message]; e != nil {
+		return nil, e
+	}
+	return []string{message + "-1", message + "-2"}, nil
+}
+
+type mockRequest struct {
+	envelopes   []*Envelope
+	readError   error
+	writeError  error
+	block       chan bool
+	replies     [][]string
+	failed      *Error
+	closed      bool
+	restrictTo  pks.Server
+	replyCalled bool
+}
+
+func (mr *mockRequest) Envelopes() ([]*Envelope, error) {
+	if mr.block != nil {
+		<-mr.block
+	}
+	return mr.envelopes, mr.readError
+}
+
+func (mr *mockRequest) Reply(replies [][]string) error {
+	mr.replyCalled = true
+	mr.replies = replies
+	return mr.writeError
+}
+
+func (mr *mockRequest) Fail(e *Error) {
+	mr.failed = e
+}
+
+func (mr *mockRequest) Close() error {
+	mr.closed = true
+	return nil
+}
+
+type restrictedRequest struct {
+	mockRequest
+}
+
+func (rr *restrictedRequest) Restrict(s pks.Server) pks.Server {
+	return rr.restrictTo
+}
+
+type mockTransport struct {
+	requests chan Request
+	err      error
+}
+
+func (mt *mockTransport) Receive() (Request, error) {
+	r, ok := <-mt.requests
+	if !ok {
+		if mt.err != nil {
+			return nil, mt.err
+		}
+		return nil, ErrClosed
+	}
+	return r, nil
+}
+
+func (mt *mockTransport) Close() error {
+	close(mt.requests)
+	return nil
+}
+
+type logCapture struct {
+	sync.Mutex
+	lines []string
+}
+
+func (lc *logCapture) logf(format string, args ...interface{}) {
+	lc.Lock()
+	defer lc.Unlock()
+	lc.lines = append(lc.lines, fmt.Sprintf(format, args...))
+}
+
+func (s *AdapterSuite) Test_Runner_Serve_handsEnvelopesToTheServerAndRepliesInOrder(c *C) {
+	ms := &mockServer{}
+	r := &Runner{Server: ms}
+	req := &mockRequest{envelopes: []*Envelope{
+		&Envelope{From: "sita@example.org", Message: "one"},
+		&Envelope{From: "rama@example.org", Message: "two"},
+	}}
+
+	r.Serve(req)
+	c.Assert(ms.received, DeepEquals, []string{"sita@example.org:one", "rama@example.org:two"})
+	c.Assert(req.replies, DeepEquals, [][]string{[]string{"one-1", "one-2"}, []string{"two-1", "two-2"}})
+	c.Assert(req.failed, IsNil)
+	c.Assert(req.closed, Equals, true)
+	c.Assert(r.Active(), Equals, 0)
+}
+
+func (s *AdapterSuite) Test_Runner_Serve_repliesWithNothingToRequestsWithoutEnvelopes(c *C) {
+	r := &Runner{Server: &mockServer{}}
+	req := &mockRequest{}
+
+	r.Serve(req)
+	c.Assert(req.replyCalled, Equals, true)
+	c.Assert(req.replies, HasLen, 0)
+	c.Assert(req.failed, IsNil)
+	c.Assert(req.closed, Equals, true)
+}
+
+func (s *AdapterSuite) Test_Runner_Serve_reportsReadErrors(c *C) {
+	lc := &logCapture{}
+	r := &Runner{Server: &mockServer{}, Logf: lc.logf}
+
+	req := &mockRequest{readError: errors.New("connection reset")}
+	r.Serve(req)
+	c.Assert(req.failed.Kind, Equals, ReadFailed)
+	c.Assert(req.failed, ErrorMatches, "reading data: connection reset")
+	c.Assert(req.closed, Equals, true)
+
+	req = &mockRequest{readError: NewError(Unauthorized, errors.New("no certificate"))}
+	r.Serve(req)
+	c.Assert(req.failed.Kind, Equals, Unauthorized)
+
+	c.Assert(lc.lines, DeepEquals, []string{
+		"Encountered error when reading data: connection reset\n",
+		"Encountered error when verifying client: no certificate\n",
+	})
+}
+
+func (s *AdapterSuite) Test_Runner_Serve_stopsAtTheFirstServerError(c *C) {
+	lc := &logCapture{}
+	ms := &mockServer{fail: map[string]error{"one": errors.New("invalid message format")}}
+	r := &Runner{Server: ms, Logf: lc.logf}
+	req := &mockRequest{envelopes: []*Envelope{
+		&Envelope{From: "sita@example.org", Message: "one"},
+		&Envelope{From: "rama@example.org", Message: "two"},
+	}}
+
+	r.Serve(req)
+	c.Assert(ms.received, DeepEquals, []string{"sita@example.org:one"})
+	c.Assert(req.replyCalled, Equals, false)
+	c.Assert(req.failed.Kind, Equals, HandleFailed)
+	c.Assert(req.failed.From, Equals, "sita@example.org")
+	c.Assert(lc.lines, DeepEquals, []string{"Encountered error when handling data: invalid message format\n"})
+}
+
+func (s *AdapterSuite) Test_Runner_Serve_logsWriteErrors(c *C) {
+	lc := &logCapture{}
+	r := &Runner{Server: &mockServer{}, Logf: lc.logf}
+	req := &mockRequest{
+		envelopes:  []*Envelope{&Envelope{From: "sita@example.org", Message: "one"}},
+		writeError: errors.New("broken pipe"),
+	}
+
+	r.Serve(req)
+	c.Assert(req.failed, IsNil)
+	c.Assert(req.closed, Equals, true)
+	c.Assert(lc.lines, DeepEquals, []string{"Encountered error when writing data: broken pipe\n"})
+}
+
+func (s *AdapterSuite) Test_Runner_Serve_usesTheRestrictedServer(c *C) {
+	ms1 := &mockServer{}
+	ms2 := &mockServer{}
+	r := &Runner{Server: ms1}
+	req := &restrictedRequest{mockRequest{
+		envelopes:  []*Envelope{&Envelope{From: "sita@example.org", Message: "one"}},
+		restrictTo: ms2,
+	}}
+
+	r.Serve(req)
+	c.Assert(ms1.received, HasLen, 0)
+	c.Assert(ms2.received, DeepEquals, []string{"sita@example.org:one"})
+}
+
+func (s *AdapterSuite) Test_Runner_Dispatch_refusesRequestsBeyondTheLimit(c *C) {
+	lc := &logCapture{}
+	r := &Runner{Server: &mockServer{}, MaxConcurrent: 1, Logf: lc.logf}
+	req1 := &mockRequest{block: make(chan bool)}
+	req2 := &mockRequest{}
+
+	r.Dispatch(req1)
+	r.Dispatch(req2)
+	c.Assert(r.Active(), Equals, 1)
+	c.Assert(req2.failed.Kind, Equals, Overloaded)
+	c.Assert(req2.failed.Err, Equals, ErrOverloaded)
+	c.Assert(req2.closed, Equals, true)
+
+	close(req1.block)
+	c.Assert(r.Wait(time.Duration(5)*time.Second), Equals, true)
+	c.Assert(req1.closed, Equals, true)
+	c.Assert(lc.lines, DeepEquals, []string{"Encountered error when accepting request: too many requests in progress\n"})
+}
+
+func (s *AdapterSuite) Test_Runner_Wait_givesUpAfterTheTimeout(c *C) {
+	r := &Runner{Server: &mockServer{}}
+	req := &mockRequest{block: make(chan bool)}
+	r.Dispatch(req)
+	defer close(req.block)
+
+	c.Assert(r.Wait(time.Duration(20)*time.Millisecond), Equals, false)
+	c.Assert(r.Active(), Equals, 1)
+}
+
+func (s *AdapterSuite) Test_Runner_Run_handlesRequestsUntilTheTransportIsClosed(c *C) {
+	ms := &mockServer{}
+	r := &Runner{Server: ms}
+	mt := &mockTransport{requests: make(chan Request, 2)}
+	req1 := &mockRequest{envelopes: []*Envelope{&Envelope{From: "sita@example.org", Message: "one"}}}
+	req2 := &mockRequest{envelopes: []*Envelope{&Envelope{From: "rama@example.org", Message: "two"}}}
+	mt.requests <- req1
+	mt.requests <- req2
+	mt.Close()
+
+	c.Assert(r.Run(mt), IsNil)
+	c.Assert(r.Wait(time.Duration(5)*time.Second), Equals, true)
+	c.Assert(req1.replies, DeepEquals, [][]string{[]string{"one-1", "one-2"}})
+	c.Assert(req2.replies, DeepEquals, [][]string{[]string{"two-1", "two-2"}})
+}
+
+func (s *AdapterSuite) Test_Runner_Run_returnsErrorsFromTheTransport(c *C) {
+	r := &Runner{Server: &mockServer{}}
+	mt := &mockTransport{requests: make(chan Request), err: errors.New("listener failed")}
+	mt.Close()
+
+	c.Assert(r.Run(mt), ErrorMatches, "listener failed")
+}
@@ -0,0 +1,331 @@
+package prekeyserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/gotrx"
+)
+
+// Admin inspects and manages what a storage keeps, for operators. Identities are given either as
+// the identity itself, or as "hash:" followed by the SHA-256 hash of the identity in hex - storages
+// that only keep the hash, like the directory storage, list the identities that way.
+// Every change is written as one line of JSON to the audit log, and changes can't be made without one.
+type Admin struct {
+	// Operator is written to the audit log as the one making the changes
+	Operator string
+
+	st        adminStorage
+	audit     io.Writer
+	auditLock sync.Mutex
+}
+
+// StoredIdentity is an identity the storage keeps data for. Identity is empty if the storage only keeps the hash
+type StoredIdentity struct {
+	Identity string `json:"identity,omitempty"`
+	Hash     string `json:"hash"`
+}
+
+// StoredCounts counts stored items
+type StoredCounts struct {
+	ClientProfiles int `json:"clientProfiles"`
+	PrekeyProfiles int `json:"prekeyProfiles"`
+	PrekeyMessages int `json:"prekeyMessages"`
+}
+
+// InstanceTagInfo describes what is stored for one instance tag of an identity
+type InstanceTagInfo struct {
+	InstanceTag          uint32     `json:"instanceTag"`
+	PrekeyMessages       int        `json:"prekeyMessages"`
+	ClientProfileExpires *time.Time `json:"clientProfileExpires,omitempty"`
+	ClientProfileExpired bool       `json:"clientProfileExpired,omitempty"`
+	PrekeyProfileExpires *time.Time `json:"prekeyProfileExpires,omitempty"`
+	PrekeyProfileExpired bool       `json:"prekeyProfileExpired,omitempty"`
+}
+
+// IdentityInfo describes what is stored for an identity
+type IdentityInfo struct {
+	StoredIdentity
+	InstanceTags []*InstanceTagInfo `json:"instanceTags"`
+}
+
+// Totals summarizes everything in a storage. Expired profiles are counted until the storage is cleaned up
+type Totals struct {
+	Identities   int `json:"identities"`
+	InstanceTags int `json:"instanceTags"`
+	StoredCounts
+	ExpiredClientProfiles int `json:"expiredClientProfiles"`
+	ExpiredPrekeyProfiles int `json:"expiredPrekeyProfiles"`
+}
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time        time.Time     `json:"time"`
+	Operator    string        `json:"operator,omitempty"`
+	Action      string        `json:"action"`
+	Identity    string        `json:"identity,omitempty"`
+	Hash        string        `json:"hash,omitempty"`
+	InstanceTag uint32        `json:"instanceTag,omitempty"`
+	Removed     *StoredCounts `json:"removed,omitempty"`
+	Imported    *StoredCounts `json:"imported,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+const (
+	auditPurgeIdentity    = "purge-identity"
+	auditPurgeInstanceTag = "purge-instance-tag"
+	auditImport           = "import"
+	auditMigrate          = "migrate"
+)
+
+// identityHashPrefix marks an identity given by its hash
+const identityHashPrefix = "hash:"
+
+// allInstanceTags is given to purge to remove all instance tags. It can't be a real instance tag, since those are at least 0x100
+const allInstanceTags = uint32(0)
+
+// ErrNoAuditLog is returned when trying to make changes without an audit log
+var ErrNoAuditLog = errors.New("changes can't be made without an audit log")
+
+// ErrUnknownIdentity is returned when nothing is stored for an identity
+var ErrUnknownIdentity = errors.New("nothing is stored for the identity")
+
+var errNoAdministration = errors.New("the storage doesn't support administration")
+
+// adminStorage is implemented by the storages an Admin can manage
+type adminStorage interface {
+	listIdentities() ([]*StoredIdentity, error)
+	// instanceTagsFor returns nothing if nothing is stored for the identity
+	instanceTagsFor(*StoredIdentity) ([]*storedInstanceTag, error)
+	// purge removes everything stored for the instance tag, or for all of them if allInstanceTags is given
+	purge(*StoredIdentity, uint32) (*StoredCounts, error)
+	// exportItems calls the function for every stored item, stopping at the first error it returns
+	exportItems(func(*storedItem) error) error
+	// importItem stores the item, also if only the hash of the identity is known
+	importItem(*storedItem) error
+	// itemsFor returns everything stored for the identity
+	itemsFor(*StoredIdentity) ([]*storedItem, error)
+}
+
+// storedInstanceTag is what a storage keeps for one instance tag
+type storedInstanceTag struct {
+	tag            uint32
+	cp             *gotrx.ClientProfile
+	pp             *prekeyProfile
+	prekeyMessages int
+}
+
+type storedInstanceTags map[uint32]*storedInstanceTag
+
+func (s storedInstanceTags) get(itag uint32) *storedInstanceTag {
+	st, ok := s[itag]
+	if !ok {
+		st = &storedInstanceTag{tag: itag}
+		s[itag] = st
+	}
+	return st
+}
+
+func (s storedInstanceTags) sorted() []*storedInstanceTag {
+	result := []*storedInstanceTag{}
+	for _, st := range s {
+		result = append(result, st)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].tag < result[j].tag })
+	return result
+}
+
+func (sc *StoredCounts) add(st *storedInstanceTag) {
+	if st.cp != nil {
+		sc.ClientProfiles++
+	}
+	if st.pp != nil {
+		sc.PrekeyProfiles++
+	}
+	sc.PrekeyMessages += st.prekeyMessages
+}
+
+func (st *storedInstanceTag) info() *InstanceTagInfo {
+	i := &InstanceTagInfo{InstanceTag: st.tag, PrekeyMessages: st.prekeyMessages}
+	if st.cp != nil {
+		exp := st.cp.Expiration
+		i.ClientProfileExpires = &exp
+		i.ClientProfileExpired = st.cp.HasExpired()
+	}
+	if st.pp != nil {
+		exp := st.pp.expiration
+		i.PrekeyProfileExpires = &exp
+		i.PrekeyProfileExpired = st.pp.hasExpired()
+	}
+	return i
+}
+
+func newAdmin(st storage, audit io.Writer) (*Admin, error) {
+	as, ok := st.(adminStorage)
+	if !ok {
+		return nil, errNoAdministration
+	}
+	return &Admin{st: as, audit: audit}, nil
+}
+
+// NewAdmin returns an admin for the storage, writing changes to the audit log. Since every in-memory
+// storage is separate, use the Admin method of the server for them instead
+func NewAdmin(st Storage, audit io.Writer) (*Admin, error) {
+	return newAdmin(st.createStorage(), audit)
+}
+
+// Admin returns an admin for the storage of the server, writing changes to the audit log
+func (g *GenericServer) Admin(audit io.Writer) (*Admin, error) {
+	return newAdmin(g.storageImpl, audit)
+}
+
+// resolveIdentity parses an identity, given by itself or by its hash
+func resolveIdentity(identity string) (*StoredIdentity, error) {
+	if strings.HasPrefix(identity, identityHashPrefix) {
+		h := strings.ToUpper(strings.TrimPrefix(identity, identityHashPrefix))
+		if !isIdentityHash(h) {
+			return nil, fmt.Errorf("%q is not a SHA-256 hash in hex", h)
+		}
+		return &StoredIdentity{Hash: h}, nil
+	}
+	if identity == "" {
+		return nil, errors.New("no identity given")
+	}
+	return &StoredIdentity{Identity: identity, Hash: identityHash(identity)}, nil
+}
+
+// Identities returns the identities with stored data, sorted by identity and hash
+func (a *Admin) Identities() ([]*StoredIdentity, error) {
+	ids, e := a.st.listIdentities()
+	if e != nil {
+		return nil, e
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Identity != ids[j].Identity {
+			return ids[i].Identity < ids[j].Identity
+		}
+		return ids[i].Hash < ids[j].Hash
+	})
+	return ids, nil
+}
+
+// Show returns what is stored for every instance tag of the identity
+func (a *Admin) Show(identity string) (*IdentityInfo, error) {
+	id, e := resolveIdentity(identity)
+	if e != nil {
+		return nil, e
+	}
+	tags, e := a.st.instanceTagsFor(id)
+	if e != nil {
+		return nil, e
+	}
+	if len(tags) == 0 {
+		return nil, ErrUnknownIdentity
+	}
+	info := &IdentityInfo{StoredIdentity: *id, InstanceTags: []*InstanceTagInfo{}}
+	for _, st := range tags {
+		info.InstanceTags = append(info.InstanceTags, st.info())
+	}
+	return info, nil
+}
+
+// Totals counts everything in the storage
+func (a *Admin) Totals() (*Totals, error) {
+	ids, e := a.st.listIdentities()
+	if e != nil {
+		return nil, e
+	}
+	t := &Totals{}
+	for _, id := range ids {
+		tags, e := a.st.instanceTagsFor(id)
+		if e != nil {
+			return nil, e
+		}
+		if len(tags) > 0 {
+			t.Identities++
+		}
+		for _, st := range tags {
+			t.InstanceTags++
+			t.add(st)
+			if st.cp != nil && st.cp.HasExpired() {
+				t.ExpiredClientProfiles++
+			}
+			if st.pp != nil && st.pp.hasExpired() {
+				t.ExpiredPrekeyProfiles++
+			}
+		}
+	}
+	return t, nil
+}
+
+// PurgeIdentity removes everything stored for the identity, returning what was removed
+func (a *Admin) PurgeIdentity(identity string) (*StoredCounts, error) {
+	return a.purge(auditPurgeIdentity, identity, allInstanceTags)
+}
+
+// PurgeInstanceTag removes everything stored for one instance tag of the identity, returning what was removed
+func (a *Admin) PurgeInstanceTag(identity string, itag uint32) (*StoredCounts, error) {
+	if itag < minimumInstanceTag {
+		return nil, fmt.Errorf("0x%08X is not a valid instance tag", itag)
+	}
+	return a.purge(auditPurgeInstanceTag, identity, itag)
+}
+
+func (a *Admin) purge(action, identity string, itag uint32) (*StoredCounts, error) {
+	if a.audit == nil {
+		return nil, ErrNoAuditLog
+	}
+	id, e := resolveIdentity(identity)
+	if e != nil {
+		return nil, e
+	}
+
+	removed, e := a.st.purge(id, itag)
+	entry := &AuditEntry{
+		Time:        time.Now().UTC(),
+		Operator:    a.Operator,
+		Action:      action,
+		Identity:    id.Identity,
+		Hash:        id.Hash,
+		InstanceTag: itag,
+		Removed:     removed,
+	}
+	if e != nil {
+		entry.Error = e.Error()
+	}
+	if ae := a.writeAudit(entry); ae != nil {
+		return nil, fmt.Errorf("the purge was done, but couldn't be written to the audit log: %v", ae)
+	}
+	return removed, e
+}
+
+func (a *Admin) writeAudit(entry *AuditEntry) error {
+	d, e := json.Marshal(entry)
+	if e != nil {
+		return e
+	}
+	a.auditLock.Lock()
+	defer a.auditLock.Unlock()
+	_, e = a.audit.Write(append(d, '\n'))
+	return e
+}
+
+// ReadAuditLog reads the entries of an audit log
+func ReadAuditLog(r io.Reader) ([]*AuditEntry, error) {
+	result := []*AuditEntry{}
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		entry := &AuditEntry{}
+		if e := dec.Decode(entry); e != nil {
+			return nil, fmt.Errorf("the audit log is corrupted after %d entries: %v", len(result), e)
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
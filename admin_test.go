@@ -0,0 +1,176 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// createAdminTestServer returns a server with sita having published two instance tags and rama one
+func createAdminTestServer(c *C, desc string) (*GenericServer, *Client, *Client) {
+	f := CreateFactory(nil)
+	st, e := f.LoadStorageType(desc)
+	c.Assert(e, IsNil)
+	server := f.NewServer("prekeys.example.org", f.CreateKeypair(), 0, st, time.Minute, time.Minute, nil).(*GenericServer)
+
+	sita := createTestClient("sita@example.org", server)
+	sita2 := createTestClient("sita@example.org", server)
+	rama := createTestClient("rama@example.org", server)
+	p := &Publication{
+		ClientProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyMessages:      3,
+	}
+	c.Assert(sita.Publish(p), IsNil)
+	c.Assert(sita2.Publish(&Publication{PrekeyMessages: 2}), IsNil)
+	c.Assert(rama.Publish(p), IsNil)
+	return server, sita, sita2
+}
+
+func (s *GenericServerSuite) Test_Admin_showsWhatIsStored(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	for _, desc := range []string{"in-memory", "dir:" + c.MkDir(), kv.descriptor(), shardedDescriptor(c, "in-memory", "dir:"+c.MkDir()), "cached:;dir:" + c.MkDir()} {
+		server, sita, sita2 := createAdminTestServer(c, desc)
+		a, e := server.Admin(nil)
+		c.Assert(e, IsNil)
+
+		ids, e := a.Identities()
+		c.Assert(e, IsNil)
+		c.Assert(ids, HasLen, 2)
+
+		info, e := a.Show("sita@example.org")
+		c.Assert(e, IsNil)
+		c.Assert(info.Hash, Equals, identityHash("sita@example.org"))
+		c.Assert(info.InstanceTags, HasLen, 2)
+		byTag := map[uint32]*InstanceTagInfo{}
+		for _, it := range info.InstanceTags {
+			byTag[it.InstanceTag] = it
+		}
+		one := byTag[sita.Keys.InstanceTag]
+		c.Assert(one.PrekeyMessages, Equals, 3)
+		c.Assert(one.ClientProfileExpires, NotNil)
+		c.Assert(one.ClientProfileExpired, Equals, false)
+		c.Assert(one.PrekeyProfileExpires, NotNil)
+		two := byTag[sita2.Keys.InstanceTag]
+		c.Assert(two.PrekeyMessages, Equals, 2)
+		c.Assert(two.ClientProfileExpires, IsNil)
+
+		byHash, e := a.Show("hash:" + identityHash("sita@example.org"))
+		c.Assert(e, IsNil)
+		c.Assert(byHash.InstanceTags, DeepEquals, info.InstanceTags)
+
+		_, e = a.Show("lakshmana@example.org")
+		c.Assert(e, Equals, ErrUnknownIdentity)
+		_, e = a.Show("hash:1234")
+		c.Assert(e, ErrorMatches, `"1234" is not a SHA-256 hash in hex`)
+
+		t, e := a.Totals()
+		c.Assert(e, IsNil)
+		c.Assert(*t, DeepEquals, Totals{
+			Identities:   2,
+			InstanceTags: 3,
+			StoredCounts: StoredCounts{ClientProfiles: 2, PrekeyProfiles: 2, PrekeyMessages: 8},
+		})
+	}
+}
+
+func (s *GenericServerSuite) Test_Admin_listsOnlyHashesForTheDirectoryStorage(c *C) {
+	server, _, _ := createAdminTestServer(c, "dir:"+c.MkDir())
+	a, _ := server.Admin(nil)
+	ids, e := a.Identities()
+	c.Assert(e, IsNil)
+	expected := []*StoredIdentity{{Hash: identityHash("rama@example.org")}, {Hash: identityHash("sita@example.org")}}
+	if expected[0].Hash > expected[1].Hash {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	c.Assert(ids, DeepEquals, expected)
+}
+
+func (s *GenericServerSuite) Test_Admin_purgesAndWritesTheAuditLog(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	for _, desc := range []string{"in-memory", "dir:" + c.MkDir(), kv.descriptor(), shardedDescriptor(c, "in-memory", "dir:"+c.MkDir()), "cached:;dir:" + c.MkDir()} {
+		server, sita, sita2 := createAdminTestServer(c, desc)
+		var audit bytes.Buffer
+		a, _ := server.Admin(&audit)
+		a.Operator = "hanuman"
+
+		removed, e := a.PurgeInstanceTag("sita@example.org", sita2.Keys.InstanceTag)
+		c.Assert(e, IsNil)
+		c.Assert(*removed, DeepEquals, StoredCounts{PrekeyMessages: 2})
+		info, _ := a.Show("sita@example.org")
+		c.Assert(info.InstanceTags, HasLen, 1)
+		c.Assert(info.InstanceTags[0].InstanceTag, Equals, sita.Keys.InstanceTag)
+
+		removed, e = a.PurgeIdentity("hash:" + identityHash("sita@example.org"))
+		c.Assert(e, IsNil)
+		c.Assert(*removed, DeepEquals, StoredCounts{ClientProfiles: 1, PrekeyProfiles: 1, PrekeyMessages: 3})
+		_, e = a.Show("sita@example.org")
+		c.Assert(e, Equals, ErrUnknownIdentity)
+		num, _ := sita.StorageStatus()
+		c.Assert(num, Equals, uint32(0))
+		ids, _ := a.Identities()
+		c.Assert(ids, HasLen, 1)
+
+		removed, e = a.PurgeIdentity("lakshmana@example.org")
+		c.Assert(e, IsNil)
+		c.Assert(*removed, DeepEquals, StoredCounts{})
+
+		entries, e := ReadAuditLog(&audit)
+		c.Assert(e, IsNil)
+		c.Assert(entries, HasLen, 3)
+		c.Assert(entries[0].Action, Equals, "purge-instance-tag")
+		c.Assert(entries[0].Operator, Equals, "hanuman")
+		c.Assert(entries[0].Identity, Equals, "sita@example.org")
+		c.Assert(entries[0].InstanceTag, Equals, sita2.Keys.InstanceTag)
+		c.Assert(*entries[0].Removed, DeepEquals, StoredCounts{PrekeyMessages: 2})
+		c.Assert(entries[1].Action, Equals, "purge-identity")
+		c.Assert(entries[1].Identity, Equals, "")
+		c.Assert(entries[1].Hash, Equals, identityHash("sita@example.org"))
+		c.Assert(entries[1].InstanceTag, Equals, uint32(0))
+		c.Assert(entries[2].Identity, Equals, "lakshmana@example.org")
+	}
+}
+
+func (s *GenericServerSuite) Test_Admin_refusesChangesWithoutAnAuditLog(c *C) {
+	server, _, _ := createAdminTestServer(c, "in-memory")
+	a, _ := server.Admin(nil)
+	_, e := a.PurgeIdentity("sita@example.org")
+	c.Assert(e, Equals, ErrNoAuditLog)
+	_, e = a.PurgeInstanceTag("sita@example.org", 0x12)
+	c.Assert(e, ErrorMatches, "0x00000012 is not a valid instance tag")
+	info, _ := a.Show("sita@example.org")
+	c.Assert(info.InstanceTags, HasLen, 2)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (s *GenericServerSuite) Test_Admin_reportsAuditLogFailures(c *C) {
+	server, _, _ := createAdminTestServer(c, "in-memory")
+	a, _ := server.Admin(failingWriter{})
+	_, e := a.PurgeIdentity("rama@example.org")
+	c.Assert(e, ErrorMatches, "the purge was done, but couldn't be written to the audit log: disk full")
+}
+
+func (s *GenericServerSuite) Test_ReadAuditLog_failsOnCorruptedLogs(c *C) {
+	_, e := ReadAuditLog(bytes.NewBufferString("{\"action\":\"purge-identity\"}\n{\"action\":"))
+	c.Assert(e, ErrorMatches, "the audit log is corrupted after 1 entries: .*")
+}
+
+func (s *GenericServerSuite) Test_NewAdmin_worksOnTheDirectoryStorage(c *C) {
+	dir := c.MkDir()
+	createAdminTestServer(c, "dir:"+dir)
+	st, _ := CreateFactory(nil).LoadStorageType("dir:" + dir)
+	a, e := NewAdmin(st, nil)
+	c.Assert(e, IsNil)
+	t, e := a.Totals()
+	c.Assert(e, IsNil)
+	c.Assert(t.Identities, Equals, 2)
+}
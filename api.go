@@ -19,6 +19,13 @@ type Factory interface {
 	NewServer(identity string, keys Keypair, fragLen int, st Storage, sessionTimeout, fragmentTimeout time.Duration, r Restrictor) Server
 }
 
+// PolicyFactory is implemented by factories that can create servers consulting a policy for
+// all kinds of messages. The factory returned by CreateFactory implements it
+type PolicyFactory interface {
+	Factory
+	NewServerWithPolicy(identity string, keys Keypair, fragLen int, st Storage, sessionTimeout, fragmentTimeout time.Duration, p Policy) Server
+}
+
 // Keypair represents the minimum key functionality a server implementation will need
 type Keypair interface {
 	Fingerprint() gotrx.Fingerprint
@@ -54,8 +61,20 @@ func (f *realFactory) RandReader() io.Reader {
 }
 
 func (*realFactory) LoadStorageType(name string) (Storage, error) {
-	if isInMemoryStorageDescriptor(name) {
+	return loadStorageType(name)
+}
+
+func loadStorageType(name string) (Storage, error) {
+	if isCachedStorageDescriptor(name) {
+		return createCachedStorageFactoryFrom(name)
+	} else if isShardedStorageDescriptor(name) {
+		return createShardedStorageFactoryFrom(name)
+	} else if isInMemoryStorageDescriptor(name) {
 		return &inMemoryStorageFactory{}, nil
+	} else if isSnapshotStorageDescriptor(name) {
+		return createSnapshotStorageFactoryFrom(name)
+	} else if isRedisStorageDescriptor(name) {
+		return createRedisStorageFactoryFrom(name)
 	} else if isFileStorageDescriptor(name) {
 		return createFileStorageFactoryFrom(name)
 	}
@@ -97,15 +116,17 @@ func (kis *keypairInStorage) intoKeypair() (*gotrx.Keypair, error) {
 	return res, nil
 }
 
-func (f *realFactory) StoreKeysInto(kpp Keypair, w io.Writer) error {
-	kp := kpp.(*gotrx.Keypair)
-	enc := json.NewEncoder(w)
-	kis := &keypairInStorage{
+func keypairIntoStorage(kp *gotrx.Keypair) *keypairInStorage {
+	return &keypairInStorage{
 		Symmetric: encodeMessage(kp.Sym[:]),
 		Private:   encodeMessage(gotrx.SerializeScalar(kp.Priv.K())),
 		Public:    encodeMessage(gotrx.SerializePoint(kp.Pub.K())),
 	}
-	return enc.Encode(kis)
+}
+
+func (f *realFactory) StoreKeysInto(kpp Keypair, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(keypairIntoStorage(kpp.(*gotrx.Keypair)))
 }
 
 func (*realFactory) LoadKeypairFrom(r io.Reader) (Keypair, error) {
@@ -141,3 +162,11 @@ func (*realFactory) NewServer(identity string, keys Keypair, fragLen int, st Sto
 	gs.messageHandler = &otrngMessageHandler{s: gs}
 	return gs
 }
+
+// NewServerWithPolicy works like NewServer, but the given policy will be consulted
+// for all kinds of messages, instead of only for DAKE messages.
+func (f *realFactory) NewServerWithPolicy(identity string, keys Keypair, fragLen int, st Storage, sessionTimeout, fragmentTimeout time.Duration, p Policy) Server {
+	gs := f.NewServer(identity, keys, fragLen, st, sessionTimeout, fragmentTimeout, nil).(*GenericServer)
+	gs.policy = p
+	return gs
+}
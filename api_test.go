@@ -291,3 +291,19 @@ func (s *GenericServerSuite) Test_realFactory_StoreKeysInto_willReturnAnyErrorEn
 
 	c.Assert(e, ErrorMatches, "something bad")
 }
+
+func (s *GenericServerSuite) Test_realFactory_NewServerWithPolicy_setsThePolicy(c *C) {
+	f := &realFactory{r: gotrx.FixtureRand()}
+	kp := f.CreateKeypair()
+	p, _ := NewRulePolicy(&PolicyDescription{Default: "deny"})
+	res := f.NewServerWithPolicy("foobar", kp, 42, &inMemoryStorageFactory{}, time.Duration(25), time.Duration(77), p)
+	gs := res.(*GenericServer)
+	c.Assert(gs.identity, Equals, "foobar")
+	c.Assert(gs.policy, Equals, p)
+	c.Assert(gs.rest("bla"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_CreateFactory_returnsAPolicyFactory(c *C) {
+	_, ok := CreateFactory(nil).(PolicyFactory)
+	c.Assert(ok, Equals, true)
+}
@@ -0,0 +1,367 @@
+package prekeyserver
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/gotrx"
+)
+
+// Design:
+// - a cache can be put in front of a storage, with a descriptor like
+//   cached:entries=10000,ttl=1m;dir:/var/lib/otrng
+//   The options come first, and everything after the first semicolon is the descriptor of the storage
+//   to cache, which can be any storage except another cached one
+// - for every identity, the cache keeps the client and prekey profiles and the number of prekey messages
+//   of every instance tag, as the storage reads them for the administration. The storage status is then
+//   answered from memory, and a retrieval only takes the prekey messages out of the storage, if the
+//   storage can do that without reading the profiles - like the directory storage
+// - at most entries identities are kept, dropping the ones used least recently
+// - storing, purging or importing anything for an identity drops its entry, and an entry read from the
+//   storage while that happened isn't kept. Cleanup drops the entries with profiles that have expired,
+//   since cleanup removes those from the storage - and they are never used after expiring anyway
+// - an entry is used for at most ttl after being read, so changes made by other processes, like other
+//   servers sharing the storage or prekey-admin, are seen after that at the latest
+// - the hits, misses and dropped entries are counted, and reported by StorageStats
+
+const (
+	cachedStoragePrefix    = "cached:"
+	cachedStorageSeparator = ";"
+	defaultCacheEntries    = 10000
+	defaultCacheTTL        = time.Minute
+	minimumCacheTTL        = time.Second
+)
+
+func isCachedStorageDescriptor(desc string) bool {
+	return strings.HasPrefix(desc, cachedStoragePrefix)
+}
+
+// prekeyMessageRetriever is implemented by storages that can hand out prekey messages without reading the profiles
+type prekeyMessageRetriever interface {
+	// retrievePrekeyMessagesFor removes one prekey message for every instance tag that has one, and returns them
+	retrievePrekeyMessagesFor(string, []uint32) map[uint32]*prekeyMessage
+}
+
+// cachedStorageFactory creates the storage once, so every server using it shares the cache
+type cachedStorageFactory struct {
+	st *cachedStorage
+}
+
+func createCachedStorageFactoryFrom(desc string) (Storage, error) {
+	parts := strings.SplitN(strings.TrimPrefix(desc, cachedStoragePrefix), cachedStorageSeparator, 2)
+	opts, e := parseStorageOptions(parts[0], "entries", "ttl")
+	if e != nil {
+		return nil, e
+	}
+	entries := defaultCacheEntries
+	if v, ok := opts["entries"]; ok {
+		if entries, e = strconv.Atoi(v); e != nil || entries < 1 {
+			return nil, fmt.Errorf("invalid number of cache entries %q", v)
+		}
+	}
+	ttl := defaultCacheTTL
+	if v, ok := opts["ttl"]; ok {
+		if ttl, e = time.ParseDuration(v); e != nil || ttl < minimumCacheTTL {
+			return nil, fmt.Errorf("invalid cache ttl %q, it has to be at least %v", v, minimumCacheTTL)
+		}
+	}
+	if len(parts) < 2 || parts[1] == "" {
+		return nil, errors.New("the storage to cache has to follow the options, like cached:entries=10000;dir:/PATH")
+	}
+	if isCachedStorageDescriptor(parts[1]) {
+		return nil, errors.New("a cached storage can't be cached again")
+	}
+	f, e := loadStorageType(parts[1])
+	if e != nil {
+		return nil, e
+	}
+	st := f.createStorage()
+	if _, ok := st.(adminStorage); !ok {
+		return nil, errors.New("the storage can't be cached")
+	}
+	return &cachedStorageFactory{st: createCachedStorage(st, entries, ttl)}, nil
+}
+
+func (csf *cachedStorageFactory) createStorage() storage {
+	return csf.st
+}
+
+// cacheEntry is what the cache keeps for one identity
+type cacheEntry struct {
+	hash   string
+	tags   storedInstanceTags
+	loaded time.Time
+	// expires is when the first of the profiles expires, or zero if there are none
+	expires time.Time
+}
+
+func (ce *cacheEntry) expired() bool {
+	return !ce.expires.IsZero() && !time.Now().Before(ce.expires)
+}
+
+func (ce *cacheEntry) expiresAt(t time.Time) {
+	if ce.expires.IsZero() || t.Before(ce.expires) {
+		ce.expires = t
+	}
+}
+
+type cachedStorage struct {
+	st         storage
+	admin      adminStorage
+	maxEntries int
+	ttl        time.Duration
+
+	// entries has the elements of lru by identity hash, and lru has the entries used most recently first
+	entries map[string]*list.Element
+	lru     *list.List
+	// generation changes every time an entry is dropped for a change, so entries read before aren't kept
+	generation uint64
+
+	hits          uint64
+	misses        uint64
+	evictions     uint64
+	invalidations uint64
+	sync.Mutex
+}
+
+func createCachedStorage(st storage, maxEntries int, ttl time.Duration) *cachedStorage {
+	return &cachedStorage{
+		st:         st,
+		admin:      st.(adminStorage),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// remove expects the lock to be held
+func (s *cachedStorage) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*cacheEntry).hash)
+}
+
+// lookup returns the entry for the identity hash, if it's cached and can still be used. It expects the lock to be held
+func (s *cachedStorage) lookup(hash string) *cacheEntry {
+	el, ok := s.entries[hash]
+	if !ok {
+		return nil
+	}
+	ce := el.Value.(*cacheEntry)
+	if time.Since(ce.loaded) > s.ttl || ce.expired() {
+		s.remove(el)
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return ce
+}
+
+// add expects the lock to be held
+func (s *cachedStorage) add(ce *cacheEntry) {
+	if el, ok := s.entries[ce.hash]; ok {
+		s.remove(el)
+	}
+	s.entries[ce.hash] = s.lru.PushFront(ce)
+	for s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+		s.evictions++
+	}
+}
+
+// invalidateLocked expects the lock to be held
+func (s *cachedStorage) invalidateLocked(hash string) {
+	s.generation++
+	if el, ok := s.entries[hash]; ok {
+		s.remove(el)
+		s.invalidations++
+	}
+}
+
+func (s *cachedStorage) invalidate(hash string) {
+	s.Lock()
+	defer s.Unlock()
+	s.invalidateLocked(hash)
+}
+
+// entryFor returns the cached entry for the identity, reading it from the storage if it isn't cached
+func (s *cachedStorage) entryFor(from string) (*cacheEntry, error) {
+	hash := identityHash(from)
+	s.Lock()
+	if ce := s.lookup(hash); ce != nil {
+		s.hits++
+		s.Unlock()
+		return ce, nil
+	}
+	s.misses++
+	generation := s.generation
+	s.Unlock()
+
+	tags, e := s.admin.instanceTagsFor(&StoredIdentity{Identity: from, Hash: hash})
+	if e != nil {
+		return nil, e
+	}
+	ce := &cacheEntry{hash: hash, tags: storedInstanceTags{}, loaded: time.Now()}
+	for _, st := range tags {
+		ce.tags[st.tag] = st
+		if st.cp != nil {
+			ce.expiresAt(st.cp.Expiration)
+		}
+		if st.pp != nil {
+			ce.expiresAt(st.pp.expiration)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.generation == generation {
+		s.add(ce)
+	}
+	return ce, nil
+}
+
+func (s *cachedStorage) storeClientProfile(from string, cp *gotrx.ClientProfile) error {
+	defer s.invalidate(identityHash(from))
+	return s.st.storeClientProfile(from, cp)
+}
+
+func (s *cachedStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	defer s.invalidate(identityHash(from))
+	return s.st.storePrekeyProfile(from, pp)
+}
+
+func (s *cachedStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	defer s.invalidate(identityHash(from))
+	return s.st.storePrekeyMessages(from, pms)
+}
+
+func (s *cachedStorage) numberStored(from string, tag uint32) uint32 {
+	ce, e := s.entryFor(from)
+	if e != nil {
+		return 0
+	}
+	s.Lock()
+	defer s.Unlock()
+	if st, ok := ce.tags[tag]; ok {
+		return uint32(st.prekeyMessages)
+	}
+	return 0
+}
+
+// retrieveFor uses the cached profiles for the instance tags that have prekey messages left. If a
+// prekey message can't be found where the entry says there is one, the entry is dropped
+func (s *cachedStorage) retrieveFor(from string) []*prekeyEnsemble {
+	r, ok := s.st.(prekeyMessageRetriever)
+	if !ok {
+		defer s.invalidate(identityHash(from))
+		return s.st.retrieveFor(from)
+	}
+	ce, e := s.entryFor(from)
+	if e != nil {
+		return nil
+	}
+
+	s.Lock()
+	itags := []uint32{}
+	for itag, st := range ce.tags {
+		if st.cp != nil && st.pp != nil && st.prekeyMessages > 0 {
+			itags = append(itags, itag)
+		}
+	}
+	s.Unlock()
+	if len(itags) == 0 {
+		return nil
+	}
+	sort.Slice(itags, func(i, j int) bool { return itags[i] < itags[j] })
+	pms := r.retrievePrekeyMessagesFor(from, itags)
+
+	s.Lock()
+	defer s.Unlock()
+	result := []*prekeyEnsemble{}
+	for _, itag := range itags {
+		st := ce.tags[itag]
+		pm, ok := pms[itag]
+		if !ok {
+			s.invalidateLocked(ce.hash)
+			continue
+		}
+		if st.prekeyMessages > 0 {
+			st.prekeyMessages--
+		}
+		result = append(result, &prekeyEnsemble{cp: st.cp, pp: st.pp, pm: pm})
+	}
+	return result
+}
+
+func (s *cachedStorage) cleanup() {
+	s.st.cleanup()
+	s.Lock()
+	defer s.Unlock()
+	for _, el := range s.entries {
+		if el.Value.(*cacheEntry).expired() {
+			s.remove(el)
+			s.invalidations++
+		}
+	}
+}
+
+func (s *cachedStorage) probe() error {
+	return s.st.probe()
+}
+
+func (s *cachedStorage) close() error {
+	if cs, ok := s.st.(closableStorage); ok {
+		return cs.close()
+	}
+	return nil
+}
+
+// stats adds the statistics of the cache to the ones of the storage, if it keeps any
+func (s *cachedStorage) stats() *StorageStats {
+	result := &StorageStats{}
+	if ss, ok := s.st.(statsStorage); ok {
+		result = ss.stats()
+	}
+	s.Lock()
+	defer s.Unlock()
+	result.Cache = &CacheStats{
+		Entries:       s.lru.Len(),
+		MaxEntries:    s.maxEntries,
+		Hits:          s.hits,
+		Misses:        s.misses,
+		Evictions:     s.evictions,
+		Invalidations: s.invalidations,
+	}
+	return result
+}
+
+func (s *cachedStorage) listIdentities() ([]*StoredIdentity, error) {
+	return s.admin.listIdentities()
+}
+
+func (s *cachedStorage) instanceTagsFor(id *StoredIdentity) ([]*storedInstanceTag, error) {
+	return s.admin.instanceTagsFor(id)
+}
+
+func (s *cachedStorage) purge(id *StoredIdentity, itag uint32) (*StoredCounts, error) {
+	defer s.invalidate(id.Hash)
+	return s.admin.purge(id, itag)
+}
+
+func (s *cachedStorage) exportItems(f func(*storedItem) error) error {
+	return s.admin.exportItems(f)
+}
+
+func (s *cachedStorage) importItem(it *storedItem) error {
+	defer s.invalidate(it.id.Hash)
+	return s.admin.importItem(it)
+}
+
+func (s *cachedStorage) itemsFor(id *StoredIdentity) ([]*storedItem, error) {
+	return s.admin.itemsFor(id)
+}
@@ -0,0 +1,158 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func cachedStorageFor(c *C, desc string) *cachedStorage {
+	st, e := CreateFactory(nil).LoadStorageType(desc)
+	c.Assert(e, IsNil)
+	return st.createStorage().(*cachedStorage)
+}
+
+func (s *cachedStorage) cacheStats() CacheStats {
+	return *s.stats().Cache
+}
+
+func (s *GenericServerSuite) Test_LoadStorageType_checksTheCacheOptions(c *C) {
+	f := CreateFactory(nil)
+	dir := c.MkDir()
+
+	st, e := f.LoadStorageType("cached:;dir:" + dir)
+	c.Assert(e, IsNil)
+	cs := st.createStorage().(*cachedStorage)
+	c.Assert(st.createStorage(), Equals, cs)
+	c.Assert(cs.maxEntries, Equals, 10000)
+	c.Assert(cs.ttl, Equals, time.Minute)
+	c.Assert(cs.st, DeepEquals, createFileStorageFrom(dir))
+
+	cs = cachedStorageFor(c, "cached:entries=20,ttl=5s;"+shardedDescriptor(c, "in-memory", "dir:"+dir))
+	c.Assert(cs.maxEntries, Equals, 20)
+	c.Assert(cs.ttl, Equals, 5*time.Second)
+	c.Assert(cs.st.(*shardedStorage).shards, HasLen, 2)
+
+	_, e = f.LoadStorageType("cached:entries=0;in-memory")
+	c.Assert(e, ErrorMatches, `invalid number of cache entries "0"`)
+	_, e = f.LoadStorageType("cached:ttl=10ms;in-memory")
+	c.Assert(e, ErrorMatches, `invalid cache ttl "10ms", it has to be at least 1s`)
+	_, e = f.LoadStorageType("cached:size=10;in-memory")
+	c.Assert(e, ErrorMatches, `unknown storage option "size"`)
+	_, e = f.LoadStorageType("cached:entries=10")
+	c.Assert(e, ErrorMatches, "the storage to cache has to follow the options, like cached:entries=10000;dir:/PATH")
+	_, e = f.LoadStorageType("cached:;cached:;in-memory")
+	c.Assert(e, ErrorMatches, "a cached storage can't be cached again")
+	_, e = f.LoadStorageType("cached:;dir:" + path.Join(dir, "missing"))
+	c.Assert(e, ErrorMatches, "directory doesn't exist")
+}
+
+func (s *GenericServerSuite) Test_cachedStorage_servesTheProfilesAndCountsFromMemory(c *C) {
+	dir := c.MkDir()
+	server, sita, sita2 := createAdminTestServer(c, "cached:;dir:"+dir)
+	cs := server.storageImpl.(*cachedStorage)
+	before := cs.cacheStats()
+
+	num, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(num, Equals, uint32(3))
+	num, _ = sita2.StorageStatus()
+	c.Assert(num, Equals, uint32(2))
+	after := cs.cacheStats()
+	c.Assert(after.Misses-before.Misses, Equals, uint64(1))
+	c.Assert(after.Hits-before.Hits, Equals, uint64(1))
+
+	// the profiles aren't read again, so the retrieval works even after they are gone from the directory
+	userDir, _ := createFileStorageFrom(dir).getDirFor("sita@example.org")
+	c.Assert(os.Remove(path.Join(userDir, formatUint32(sita.Keys.InstanceTag), "cp.bin")), IsNil)
+	c.Assert(os.Remove(path.Join(userDir, formatUint32(sita.Keys.InstanceTag), "pp.bin")), IsNil)
+	rama := createTestClient("rama@example.org", server)
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+	num, _ = sita.StorageStatus()
+	c.Assert(num, Equals, uint32(2))
+	num, _ = sita2.StorageStatus()
+	c.Assert(num, Equals, uint32(2))
+	c.Assert(cs.cacheStats().Hits-after.Hits, Equals, uint64(3))
+	c.Assert(cs.cacheStats().Entries, Equals, 1)
+}
+
+func (s *GenericServerSuite) Test_cachedStorage_dropsTheEntryWhenSomethingIsStored(c *C) {
+	server, sita, _ := createAdminTestServer(c, "cached:;dir:"+c.MkDir())
+	cs := server.storageImpl.(*cachedStorage)
+	num, _ := sita.StorageStatus()
+	c.Assert(num, Equals, uint32(3))
+	c.Assert(cs.cacheStats().Entries, Equals, 1)
+
+	c.Assert(sita.Publish(&Publication{PrekeyMessages: 4}), IsNil)
+	c.Assert(cs.cacheStats().Entries, Equals, 0)
+	c.Assert(cs.cacheStats().Invalidations, Equals, uint64(1))
+	num, _ = sita.StorageStatus()
+	c.Assert(num, Equals, uint32(7))
+
+	var audit bytes.Buffer
+	a, e := server.Admin(&audit)
+	c.Assert(e, IsNil)
+	_, e = a.PurgeInstanceTag("sita@example.org", sita.Keys.InstanceTag)
+	c.Assert(e, IsNil)
+	num, _ = sita.StorageStatus()
+	c.Assert(num, Equals, uint32(0))
+}
+
+func (s *GenericServerSuite) Test_cachedStorage_keepsTheIdentitiesUsedMostRecently(c *C) {
+	cs := cachedStorageFor(c, "cached:entries=2;in-memory")
+	for _, from := range []string{"sita@example.org", "rama@example.org", "sita@example.org", "lakshmana@example.org"} {
+		cs.numberStored(from, 0x1245ABCD)
+	}
+	st := cs.cacheStats()
+	c.Assert(st.Entries, Equals, 2)
+	c.Assert(st.MaxEntries, Equals, 2)
+	c.Assert(st.Evictions, Equals, uint64(1))
+	c.Assert(cs.lookup(identityHash("rama@example.org")), IsNil)
+	c.Assert(cs.lookup(identityHash("sita@example.org")), NotNil)
+}
+
+func (s *GenericServerSuite) Test_cachedStorage_dropsEntriesThatAreNoLongerRight(c *C) {
+	dir := c.MkDir()
+	server, sita, _ := createAdminTestServer(c, "cached:;dir:"+dir)
+	cs := server.storageImpl.(*cachedStorage)
+	num, _ := sita.StorageStatus()
+	c.Assert(num, Equals, uint32(3))
+
+	// another process took the prekey messages, so the cached count is wrong until the retrieval finds out
+	userDir, _ := createFileStorageFrom(dir).getDirFor("sita@example.org")
+	c.Assert(os.RemoveAll(path.Join(userDir, formatUint32(sita.Keys.InstanceTag), "pm")), IsNil)
+	num, _ = sita.StorageStatus()
+	c.Assert(num, Equals, uint32(3))
+	rama := createTestClient("rama@example.org", server)
+	ens, _ := rama.Retrieve("sita@example.org")
+	c.Assert(ens, HasLen, 0)
+	c.Assert(cs.cacheStats().Invalidations, Equals, uint64(1))
+	num, _ = sita.StorageStatus()
+	c.Assert(num, Equals, uint32(0))
+}
+
+func (s *GenericServerSuite) Test_cachedStorage_dropsExpiredEntries(c *C) {
+	cs := createCachedStorage(createInMemoryStorage(), 10, 50*time.Millisecond)
+	sita := createTestClient("sita@example.org", nil)
+	c.Assert(cs.storeClientProfile("sita@example.org", sita.clientProfile(time.Now().Add(time.Hour))), IsNil)
+	c.Assert(cs.storeClientProfile("rama@example.org", sita.clientProfile(time.Now().Add(20*time.Millisecond))), IsNil)
+	cs.numberStored("sita@example.org", sita.Keys.InstanceTag)
+	cs.numberStored("rama@example.org", sita.Keys.InstanceTag)
+	c.Assert(cs.cacheStats().Entries, Equals, 2)
+
+	time.Sleep(30 * time.Millisecond)
+	cs.cleanup()
+	c.Assert(cs.cacheStats().Entries, Equals, 1)
+	c.Assert(cs.cacheStats().Invalidations, Equals, uint64(1))
+
+	// after the ttl, the entry is read from the storage again
+	time.Sleep(30 * time.Millisecond)
+	cs.numberStored("sita@example.org", sita.Keys.InstanceTag)
+	c.Assert(cs.cacheStats().Hits, Equals, uint64(0))
+	c.Assert(cs.cacheStats().Misses, Equals, uint64(3))
+}
@@ -0,0 +1,410 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/otrv4/ed448"
+	"github.com/otrv4/gotrx"
+)
+
+// Client implements the client side of the prekey protocol, for testing and operating prekey servers.
+// It builds the same messages a real OTRv4 client would, and sends them to Server - which can be a
+// server in the same process, or anything that forwards the messages over the network and returns
+// the replies. Every publication and storage status request runs a complete DAKE first.
+type Client struct {
+	// From is the from-address the server will see the messages coming from
+	From   string
+	Keys   *ClientKeys
+	Server Server
+	// ServerFingerprint is the fingerprint the server has to have. If it is nil, it is set to the
+	// fingerprint of the first server the client runs a DAKE with, and later DAKEs have to be with the same server
+	ServerFingerprint *gotrx.Fingerprint
+	// ServerIdentity is the identity the server gave in the last DAKE
+	ServerIdentity string
+	// FragmentLength is the length messages to the server are fragmented to - 0 means no fragmenting
+	FragmentLength int
+	// Rand is the source of randomness. If nil, crypto/rand will be used
+	Rand io.Reader
+
+	fragments *gotrx.Fragmentor
+}
+
+// ClientKeys are the long term keys and instance tag of a client
+type ClientKeys struct {
+	InstanceTag uint32
+	LongTerm    *gotrx.Keypair
+	Forging     *gotrx.Keypair
+}
+
+// Publication describes what a client publishes. Profiles are only published if their expiry is given
+type Publication struct {
+	ClientProfileExpiry time.Time
+	PrekeyProfileExpiry time.Time
+	PrekeyMessages      int
+}
+
+// defaultClientProfileExpiry is how long client profiles used only for the DAKE are valid
+const defaultClientProfileExpiry = time.Duration(14*24) * time.Hour
+
+// maxPrekeyMessages is how many prekey messages fit in one publication message
+const maxPrekeyMessages = 255
+
+// ErrPublicationRejected is returned when the server answers a publication with a failure message
+var ErrPublicationRejected = errors.New("the server rejected the publication")
+
+var errNoReply = errors.New("the server sent no reply")
+
+type randomSource struct {
+	r io.Reader
+}
+
+func (rs randomSource) RandReader() io.Reader {
+	if rs.r == nil {
+		return rand.Reader
+	}
+	return rs.r
+}
+
+// GenerateClientKeys creates new long term keys and a new instance tag. The rand argument
+// works like for CreateFactory
+func GenerateClientKeys(r io.Reader) *ClientKeys {
+	wr := randomSource{r}
+	k := &ClientKeys{
+		LongTerm: gotrx.GenerateKeypair(wr),
+		Forging:  gotrx.GenerateKeypair(wr),
+	}
+	k.Forging.Pub = gotrx.CreatePublicKey(k.Forging.Pub.K(), gotrx.ForgingKey)
+	for k.InstanceTag < minimumInstanceTag {
+		k.InstanceTag = gotrx.RandomUint32(wr)
+	}
+	return k
+}
+
+type clientKeysInStorage struct {
+	InstanceTag uint32
+	LongTerm    *keypairInStorage
+	Forging     *keypairInStorage
+}
+
+// StoreInto writes the keys in JSON format
+func (k *ClientKeys) StoreInto(w io.Writer) error {
+	return json.NewEncoder(w).Encode(&clientKeysInStorage{
+		InstanceTag: k.InstanceTag,
+		LongTerm:    keypairIntoStorage(k.LongTerm),
+		Forging:     keypairIntoStorage(k.Forging),
+	})
+}
+
+// LoadClientKeysFrom reads keys written by StoreInto
+func LoadClientKeysFrom(r io.Reader) (*ClientKeys, error) {
+	kis := &clientKeysInStorage{}
+	if e := json.NewDecoder(r).Decode(kis); e != nil {
+		return nil, e
+	}
+	if kis.InstanceTag < minimumInstanceTag || kis.LongTerm == nil || kis.Forging == nil {
+		return nil, errors.New("incomplete client keys")
+	}
+	lt, e := kis.LongTerm.intoKeypair()
+	if e != nil {
+		return nil, e
+	}
+	fk, e := kis.Forging.intoKeypair()
+	if e != nil {
+		return nil, e
+	}
+	fk.Pub = gotrx.CreatePublicKey(fk.Pub.K(), gotrx.ForgingKey)
+	return &ClientKeys{InstanceTag: kis.InstanceTag, LongTerm: lt, Forging: fk}, nil
+}
+
+// Fingerprint returns the fingerprint of the long term key
+func (k *ClientKeys) Fingerprint() gotrx.Fingerprint {
+	return k.LongTerm.Fingerprint()
+}
+
+// RandReader implements the gotrx.WithRandom interface
+func (c *Client) RandReader() io.Reader {
+	return randomSource{c.Rand}.RandReader()
+}
+
+func (c *Client) clientProfile(expires time.Time) *gotrx.ClientProfile {
+	cp := &gotrx.ClientProfile{
+		InstanceTag: c.Keys.InstanceTag,
+		PublicKey:   c.Keys.LongTerm.Pub,
+		ForgingKey:  c.Keys.Forging.Pub,
+		Versions:    []byte{'4'},
+		Expiration:  expires,
+	}
+	cp.Sig = gotrx.CreateEddsaSignature(cp.GenerateSignature(c.Keys.LongTerm))
+	return cp
+}
+
+// send sends the message to the server and returns the decoded reply, putting fragments together if necessary
+func (c *Client) send(msg []byte) ([]byte, error) {
+	if c.fragments == nil {
+		c.fragments = gotrx.NewFragmentor(fragmentationPrefix)
+	}
+	encoded := encodeMessage(msg) + "."
+	var replies []string
+	for _, m := range c.fragments.PotentiallyFragment(encoded, c.FragmentLength, c.Keys.InstanceTag, 0, c) {
+		r, e := c.Server.Handle(c.From, m)
+		if e != nil {
+			return nil, e
+		}
+		replies = append(replies, r...)
+	}
+
+	for _, r := range replies {
+		if c.fragments.IsFragment(r) {
+			m, complete, e := c.fragments.NewFragmentReceived("server", r)
+			if e != nil {
+				return nil, e
+			}
+			if !complete {
+				continue
+			}
+			r = m
+		}
+		if len(r) == 0 || r[len(r)-1] != '.' {
+			return nil, errors.New("invalid message format - missing ending punctuation")
+		}
+		decoded, ok := decodeMessage(r[:len(r)-1])
+		if !ok {
+			return nil, errors.New("invalid message format - corrupted base64 encoding")
+		}
+		return decoded, nil
+	}
+	return nil, errNoReply
+}
+
+func messageTypeOf(msg []byte) uint8 {
+	if len(msg) <= indexOfMessageType {
+		return 0
+	}
+	return msg[indexOfMessageType]
+}
+
+// expectReply deserializes the reply into the message, if it is of the expected type
+func expectReply(reply []byte, messageType uint8, m serializable) error {
+	if t := messageTypeOf(reply); t != messageType {
+		name, ok := messageTypeNames[t]
+		if !ok {
+			name = fmt.Sprintf("0x%02X", t)
+		}
+		return fmt.Errorf("expected a %s message, but the server sent a %s message", messageTypeNames[messageType], name)
+	}
+	if _, ok := m.deserialize(reply); !ok {
+		return fmt.Errorf("the %s message from the server is corrupted", messageTypeNames[messageType])
+	}
+	return nil
+}
+
+func (c *Client) checkServerFingerprint(fp gotrx.Fingerprint) error {
+	if c.ServerFingerprint != nil && *c.ServerFingerprint != fp {
+		return fmt.Errorf("the server has the fingerprint %s, not the expected %s", FormatFingerprint(fp), FormatFingerprint(*c.ServerFingerprint))
+	}
+	return nil
+}
+
+// startDAKE sends a DAKE-1 message and checks the DAKE-2 message the server answers with
+func (c *Client) startDAKE(cp *gotrx.ClientProfile, i *gotrx.Keypair) (*dake2Message, *gotrx.PublicKey, error) {
+	reply, e := c.send(generateDake1(c.Keys.InstanceTag, cp, i.Pub.K()).serialize())
+	if e != nil {
+		return nil, nil, e
+	}
+	d2 := &dake2Message{}
+	if e := expectReply(reply, messageTypeDAKE2, d2); e != nil {
+		return nil, nil, e
+	}
+	if d2.instanceTag != c.Keys.InstanceTag {
+		return nil, nil, errors.New("the DAKE-2 message has the wrong instance tag")
+	}
+	if gotrx.ValidatePoint(d2.serverKey) != nil || gotrx.ValidatePoint(d2.s) != nil {
+		return nil, nil, errors.New("the DAKE-2 message contains invalid points")
+	}
+	serverKey := gotrx.CreatePublicKey(d2.serverKey, gotrx.Ed448Key)
+	if e := c.checkServerFingerprint(serverKey.Fingerprint()); e != nil {
+		return nil, nil, e
+	}
+	c.ServerIdentity = string(d2.serverIdentity)
+
+	t := append([]byte{}, 0x00)
+	t = append(t, gotrx.KdfPrekeyServer(usageInitiatorClientProfile, 64, cp.Serialize())...)
+	t = append(t, gotrx.KdfPrekeyServer(usageInitiatorPrekeyCompositeIdentity, 64, c.serverCompositeIdentity(d2, serverKey))...)
+	t = append(t, gotrx.SerializePoint(i.Pub.K())...)
+	t = append(t, gotrx.SerializePoint(d2.s)...)
+	t = append(t, gotrx.KdfPrekeyServer(usageInitiatorPrekeyCompositePHI, 64, c.phi(d2))...)
+	if !d2.sigma.Verify(c.Keys.LongTerm.Pub, serverKey, i.Pub, t, gotrx.KdfPrekeyServer, usageAuth) {
+		return nil, nil, errors.New("incorrect ring signature in the DAKE-2 message")
+	}
+	fp := serverKey.Fingerprint()
+	c.ServerFingerprint = &fp
+	return d2, serverKey, nil
+}
+
+func (c *Client) serverCompositeIdentity(d2 *dake2Message, serverKey *gotrx.PublicKey) []byte {
+	return append(gotrx.AppendData(nil, d2.serverIdentity), serverKey.Serialize()...)
+}
+
+func (c *Client) phi(d2 *dake2Message) []byte {
+	return gotrx.AppendData(gotrx.AppendData(nil, []byte(c.From)), d2.serverIdentity)
+}
+
+// Handshake runs only the first half of a DAKE with the server: it sends a DAKE-1 message and checks
+// the DAKE-2 message it gets back. The server keeps the session until it times out
+func (c *Client) Handshake() error {
+	_, _, e := c.startDAKE(c.clientProfile(time.Now().Add(defaultClientProfileExpiry)), gotrx.GenerateKeypair(c))
+	return e
+}
+
+// dake runs a DAKE with the server, and sends the message created by inner in the DAKE-3 message.
+// It returns the reply to the DAKE-3 message and the MAC key of the session
+func (c *Client) dake(cp *gotrx.ClientProfile, inner func(macKey, sk []byte) serializable) ([]byte, []byte, error) {
+	i := gotrx.GenerateKeypair(c)
+	d2, serverKey, e := c.startDAKE(cp, i)
+	if e != nil {
+		return nil, nil, e
+	}
+	compositeIdentity := c.serverCompositeIdentity(d2, serverKey)
+	phi := c.phi(d2)
+	sPub := gotrx.CreatePublicKey(d2.s, gotrx.Ed448Key)
+
+	sk := gotrx.KdfPrekeyServer(usageSK, skLength, gotrx.SerializePoint(ed448.PointScalarMul(d2.s, i.Priv.K())))
+	macKey := gotrx.KdfPrekeyServer(usagePreMACKey, 64, sk)
+
+	t := append([]byte{}, 0x01)
+	t = append(t, gotrx.KdfPrekeyServer(usageReceiverClientProfile, 64, cp.Serialize())...)
+	t = append(t, gotrx.KdfPrekeyServer(usageReceiverPrekeyCompositeIdentity, 64, compositeIdentity)...)
+	t = append(t, gotrx.SerializePoint(i.Pub.K())...)
+	t = append(t, gotrx.SerializePoint(d2.s)...)
+	t = append(t, gotrx.KdfPrekeyServer(usageReceiverPrekeyCompositePHI, 64, phi)...)
+	sigma, e := gotrx.GenerateSignature(c, c.Keys.LongTerm.Priv, c.Keys.LongTerm.Pub, c.Keys.LongTerm.Pub, serverKey, sPub, t, gotrx.KdfPrekeyServer, usageAuth)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	reply, e := c.send(generateDake3(c.Keys.InstanceTag, sigma, inner(macKey, sk).serialize()).serialize())
+	return reply, macKey, e
+}
+
+// Publish runs a DAKE with the server and publishes what the publication describes
+func (c *Client) Publish(p *Publication) error {
+	if p.PrekeyMessages < 0 || p.PrekeyMessages > maxPrekeyMessages {
+		return fmt.Errorf("can't publish %d prekey messages at the same time", p.PrekeyMessages)
+	}
+	tag := c.Keys.InstanceTag
+	cp := c.clientProfile(time.Now().Add(defaultClientProfileExpiry))
+	var published *gotrx.ClientProfile
+	if !p.ClientProfileExpiry.IsZero() {
+		published = c.clientProfile(p.ClientProfileExpiry)
+		cp = published
+	}
+
+	reply, macKey, e := c.dake(cp, func(macKey, sk []byte) serializable {
+		var pp *prekeyProfile
+		var ppKey *gotrx.Keypair
+		if !p.PrekeyProfileExpiry.IsZero() {
+			pp, ppKey = generatePrekeyProfile(c, tag, p.PrekeyProfileExpiry, c.Keys.LongTerm)
+		}
+
+		pms := []*prekeyMessage{}
+		keys := []*gotrx.Keypair{}
+		privs := []*big.Int{}
+		pubs := []*big.Int{}
+		for ix := 0; ix < p.PrekeyMessages; ix++ {
+			pm, k, priv, pub := generatePrekeyMessage(c, tag)
+			pms = append(pms, pm)
+			keys = append(keys, k)
+			privs = append(privs, priv)
+			pubs = append(pubs, pub)
+		}
+
+		prof1, prof2 := generatePrekeyMessagesProofs(c, keys, privs, pubs, sk)
+		prof3 := gemeratePrekeyProfileProof(c, ppKey, sk)
+		return generatePublicationMessage(published, pp, pms, prof1, prof2, prof3, macKey)
+	})
+	if e != nil {
+		return e
+	}
+
+	switch messageTypeOf(reply) {
+	case messageTypeFailure:
+		m := &failureMessage{}
+		if e := expectReply(reply, messageTypeFailure, m); e != nil {
+			return e
+		}
+		if !bytes.Equal(m.mac[:], generateFailureMessage(macKey, tag).mac[:]) {
+			return errors.New("incorrect MAC in the failure message")
+		}
+		return ErrPublicationRejected
+	default:
+		m := &successMessage{}
+		if e := expectReply(reply, messageTypeSuccess, m); e != nil {
+			return e
+		}
+		if !bytes.Equal(m.mac[:], generateSuccessMessage(macKey, tag).mac[:]) {
+			return errors.New("incorrect MAC in the success message")
+		}
+		return nil
+	}
+}
+
+// StorageStatus runs a DAKE with the server and returns how many prekey messages it has stored for the client
+func (c *Client) StorageStatus() (uint32, error) {
+	reply, macKey, e := c.dake(c.clientProfile(time.Now().Add(defaultClientProfileExpiry)), func(macKey, _ []byte) serializable {
+		return generateStorageInformationRequestMessage(macKey)
+	})
+	if e != nil {
+		return 0, e
+	}
+	m := &storageStatusMessage{}
+	if e := expectReply(reply, messageTypeStorageStatusMessage, m); e != nil {
+		return 0, e
+	}
+	mac := gotrx.KdfPrekeyServer(usageStatusMAC, 64, macKey, []byte{messageTypeStorageStatusMessage}, gotrx.SerializeWord(m.instanceTag), gotrx.SerializeWord(m.number))
+	if !bytes.Equal(mac, m.mac[:]) {
+		return 0, errors.New("incorrect MAC in the storage status message")
+	}
+	if m.instanceTag != c.Keys.InstanceTag {
+		return 0, errors.New("the storage status message has the wrong instance tag")
+	}
+	return m.number, nil
+}
+
+// Retrieve asks the server for prekey ensembles for the identity, and checks them. Every ensemble is
+// returned with the problems found in it; no ensembles are returned if the server has none
+func (c *Client) Retrieve(identity string) ([]*EnsembleInspection, error) {
+	q := &ensembleRetrievalQueryMessage{
+		instanceTag: c.Keys.InstanceTag,
+		identity:    identity,
+		versions:    []byte{'4'},
+	}
+	reply, e := c.send(q.serialize())
+	if e != nil {
+		return nil, e
+	}
+	if messageTypeOf(reply) == messageTypeNoPrekeyEnsembles {
+		m := &noPrekeyEnsemblesMessage{}
+		return nil, expectReply(reply, messageTypeNoPrekeyEnsembles, m)
+	}
+
+	m := &ensembleRetrievalMessage{}
+	if e := expectReply(reply, messageTypeEnsembleRetrieval, m); e != nil {
+		return nil, e
+	}
+	if m.instanceTag != c.Keys.InstanceTag {
+		return nil, errors.New("the ensemble retrieval message has the wrong instance tag")
+	}
+	if m.identity != identity {
+		return nil, fmt.Errorf("asked for ensembles for %s, but got them for %s", identity, m.identity)
+	}
+	i := &Inspection{InstanceTag: m.instanceTag}
+	i.inspectEnsembleRetrieval(m)
+	return i.Ensembles, nil
+}
@@ -0,0 +1,138 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/otrv4/gotrx"
+	. "gopkg.in/check.v1"
+)
+
+func createTestServer(fragLen int) (Server, Keypair) {
+	f := CreateFactory(nil)
+	kp := f.CreateKeypair()
+	st, _ := f.LoadStorageType("in-memory")
+	return f.NewServer("prekeys.example.org", kp, fragLen, st, time.Minute, time.Minute, nil), kp
+}
+
+func createTestClient(from string, s Server) *Client {
+	return &Client{From: from, Keys: GenerateClientKeys(nil), Server: s}
+}
+
+func (s *GenericServerSuite) Test_Client_publishesAndRetrievesPrekeys(c *C) {
+	server, kp := createTestServer(0)
+	sita := createTestClient("sita@example.org", server)
+	rama := createTestClient("rama@example.org", server)
+
+	e := sita.Publish(&Publication{
+		ClientProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyMessages:      3,
+	})
+	c.Assert(e, IsNil)
+	c.Assert(*sita.ServerFingerprint, Equals, kp.Fingerprint())
+	c.Assert(sita.ServerIdentity, Equals, "prekeys.example.org")
+
+	num, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(num, Equals, uint32(3))
+
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+	c.Assert(ens[0].ClientProfile.InstanceTag, Equals, sita.Keys.InstanceTag)
+	c.Assert(ens[0].ClientProfile.Fingerprint, Equals, FormatFingerprint(sita.Keys.Fingerprint()))
+	c.Assert(ens[0].ClientProfile.Problems, IsNil)
+	c.Assert(ens[0].PrekeyProfile.Problems, IsNil)
+	c.Assert(ens[0].PrekeyMessage.Problems, IsNil)
+
+	num, _ = sita.StorageStatus()
+	c.Assert(num, Equals, uint32(2))
+
+	ens, e = rama.Retrieve("lakshmana@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_Client_worksWithFragmentedMessages(c *C) {
+	server, _ := createTestServer(200)
+	sita := createTestClient("sita@example.org", server)
+	sita.FragmentLength = 300
+
+	c.Assert(sita.Publish(&Publication{PrekeyMessages: 2}), IsNil)
+	num, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(num, Equals, uint32(2))
+}
+
+func (s *GenericServerSuite) Test_Client_Handshake_leavesTheSessionOnTheServer(c *C) {
+	server, kp := createTestServer(0)
+	sita := createTestClient("sita@example.org", server)
+
+	c.Assert(sita.Handshake(), IsNil)
+	c.Assert(*sita.ServerFingerprint, Equals, kp.Fingerprint())
+	c.Assert(server.(*GenericServer).hasSession("sita@example.org"), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_Client_refusesServersWithOtherFingerprints(c *C) {
+	server, _ := createTestServer(0)
+	other, _ := createTestServer(0)
+	sita := createTestClient("sita@example.org", server)
+	fp := GenerateClientKeys(nil).Fingerprint()
+	sita.ServerFingerprint = &fp
+
+	_, e := sita.StorageStatus()
+	c.Assert(e, ErrorMatches, "the server has the fingerprint .*, not the expected .*")
+
+	sita.ServerFingerprint = nil
+	_, e = sita.StorageStatus()
+	c.Assert(e, IsNil)
+	sita.Server = other
+	_, e = sita.StorageStatus()
+	c.Assert(e, ErrorMatches, "the server has the fingerprint .*, not the expected .*")
+}
+
+type serverFunc func(from, message string) ([]string, error)
+
+func (f serverFunc) Handle(from, message string) ([]string, error) {
+	return f(from, message)
+}
+
+func (s *GenericServerSuite) Test_Client_failsOnUnexpectedReplies(c *C) {
+	sita := createTestClient("sita@example.org", serverFunc(func(string, string) ([]string, error) {
+		return nil, nil
+	}))
+	_, e := sita.StorageStatus()
+	c.Assert(e, Equals, errNoReply)
+
+	sita.Server = serverFunc(func(string, string) ([]string, error) {
+		return nil, errors.New("connection refused")
+	})
+	_, e = sita.StorageStatus()
+	c.Assert(e, ErrorMatches, "connection refused")
+
+	sita.Server = serverFunc(func(string, string) ([]string, error) {
+		m := &successMessage{instanceTag: 0x1245ABCD}
+		return []string{encodeMessage(m.serialize()) + "."}, nil
+	})
+	_, e = sita.StorageStatus()
+	c.Assert(e, ErrorMatches, "expected a DAKE-2 message, but the server sent a success message")
+	_, e = sita.Retrieve("rama@example.org")
+	c.Assert(e, ErrorMatches, "expected a ensemble retrieval message, but the server sent a success message")
+}
+
+func (s *GenericServerSuite) Test_ClientKeys_canBeStoredAndLoaded(c *C) {
+	k := GenerateClientKeys(gotrx.FixtureRand())
+	var b bytes.Buffer
+	c.Assert(k.StoreInto(&b), IsNil)
+
+	k2, e := LoadClientKeysFrom(&b)
+	c.Assert(e, IsNil)
+	c.Assert(k2.InstanceTag, Equals, k.InstanceTag)
+	c.Assert(k2.Fingerprint(), Equals, k.Fingerprint())
+	c.Assert(k2.Forging.Pub.Serialize(), DeepEquals, k.Forging.Pub.Serialize())
+
+	_, e = LoadClientKeysFrom(bytes.NewBufferString(`{"InstanceTag": 12}`))
+	c.Assert(e, ErrorMatches, "incomplete client keys")
+}
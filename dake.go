@@ -2,6 +2,7 @@ package prekeyserver
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/otrv4/ed448"
 	"github.com/otrv4/gotrx"
@@ -67,6 +68,9 @@ func (m *dake1Message) validate(string, *GenericServer) error {
 
 func (m *dake3Message) validate(from string, s *GenericServer) error {
 	sess := s.session(from)
+	if e := sess.loadError(); e != nil {
+		return e
+	}
 	if sess.instanceTag() != m.instanceTag {
 		return errors.New("incorrect instance tag")
 	}
@@ -93,7 +97,9 @@ func (m *dake3Message) validate(from string, s *GenericServer) error {
 
 func (m *dake1Message) respond(from string, s *GenericServer) (serializable, error) {
 	sk := gotrx.GenerateKeypair(s)
-	s.session(from).save(sk, m.i, m.instanceTag, m.clientProfile)
+	if e := s.session(from).save(sk, m.i, m.instanceTag, m.clientProfile); e != nil {
+		return nil, fmt.Errorf("couldn't save the session: %v", e)
+	}
 
 	phi := gotrx.AppendData(gotrx.AppendData(nil, []byte(from)), []byte(s.identity))
 
@@ -0,0 +1,407 @@
+package prekeyserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/otrv4/gotrx"
+)
+
+// The export format moves stored data between storages. It is JSON, one object on every line:
+// first a header with the format name and version, then one line for every client profile,
+// prekey profile and prekey message, and last an end line with the number of items of each
+// kind, so a truncated export is noticed. Items are serialized the way the prekey protocol
+// does, in base64. Items for storages that only keep the hash of the identity have no identity.
+
+const (
+	exportFormat  = "otrng-prekey-server-export"
+	exportVersion = 1
+)
+
+const (
+	exportClientProfile = "client-profile"
+	exportPrekeyProfile = "prekey-profile"
+	exportPrekeyMessage = "prekey-message"
+	exportEnd           = "end"
+)
+
+type exportHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// ExportItem is one line of an export: a client profile, prekey profile or prekey message, stored for an identity
+type ExportItem struct {
+	Type        string `json:"type"`
+	Identity    string `json:"identity,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	InstanceTag uint32 `json:"instanceTag,omitempty"`
+	// Identifier is the identifier of a prekey message
+	Identifier uint32 `json:"identifier,omitempty"`
+	// Expires is the expiry of a profile
+	Expires *time.Time `json:"expires,omitempty"`
+	// Data is the serialized item, in base64
+	Data string `json:"data,omitempty"`
+	// Counts is the number of items of each kind, in the end line
+	Counts *StoredCounts `json:"counts,omitempty"`
+}
+
+// TransferCounts counts the items that were copied by an export, import or migration, and the expired ones left behind
+type TransferCounts struct {
+	Copied  StoredCounts `json:"copied"`
+	Expired StoredCounts `json:"expired"`
+}
+
+// storedItem is one item a storage keeps, with the identity it's kept for. Only one of cp, pp and pm is set
+type storedItem struct {
+	id *StoredIdentity
+	cp *gotrx.ClientProfile
+	pp *prekeyProfile
+	pm *prekeyMessage
+}
+
+func (it *storedItem) hasExpired() bool {
+	return (it.cp != nil && it.cp.HasExpired()) || (it.pp != nil && it.pp.hasExpired())
+}
+
+func (sc *StoredCounts) addItem(it *storedItem) {
+	switch {
+	case it.cp != nil:
+		sc.ClientProfiles++
+	case it.pp != nil:
+		sc.PrekeyProfiles++
+	case it.pm != nil:
+		sc.PrekeyMessages++
+	}
+}
+
+func (it *storedItem) intoExport() *ExportItem {
+	ei := &ExportItem{Identity: it.id.Identity, Hash: it.id.Hash}
+	switch {
+	case it.cp != nil:
+		exp := it.cp.Expiration
+		ei.Type, ei.InstanceTag, ei.Expires, ei.Data = exportClientProfile, it.cp.InstanceTag, &exp, encodeMessage(it.cp.Serialize())
+	case it.pp != nil:
+		exp := it.pp.expiration
+		ei.Type, ei.InstanceTag, ei.Expires, ei.Data = exportPrekeyProfile, it.pp.instanceTag, &exp, encodeMessage(it.pp.serialize())
+	case it.pm != nil:
+		ei.Type, ei.InstanceTag, ei.Identifier, ei.Data = exportPrekeyMessage, it.pm.instanceTag, it.pm.identifier, encodeMessage(it.pm.serialize())
+	}
+	return ei
+}
+
+// intoStored decodes the item, checking that the fields agree with the serialized data
+func (ei *ExportItem) intoStored() (*storedItem, error) {
+	id := &StoredIdentity{Identity: ei.Identity, Hash: ei.Hash}
+	switch {
+	case ei.Identity != "" && ei.Hash == "":
+		id.Hash = identityHash(ei.Identity)
+	case ei.Identity != "" && ei.Hash != identityHash(ei.Identity):
+		return nil, fmt.Errorf("the hash of %s is wrong", ei.Identity)
+	case ei.Identity == "" && !isIdentityHash(ei.Hash):
+		return nil, errors.New("the item has neither an identity nor a valid hash")
+	}
+
+	d, ok := decodeMessage(ei.Data)
+	if !ok {
+		return nil, fmt.Errorf("the %s has corrupted base64 encoding", ei.Type)
+	}
+	it := &storedItem{id: id}
+	var tag uint32
+	switch ei.Type {
+	case exportClientProfile:
+		it.cp = &gotrx.ClientProfile{}
+		_, ok = it.cp.Deserialize(d)
+		tag = it.cp.InstanceTag
+	case exportPrekeyProfile:
+		it.pp = &prekeyProfile{}
+		_, ok = it.pp.deserialize(d)
+		tag = it.pp.instanceTag
+	case exportPrekeyMessage:
+		it.pm = &prekeyMessage{}
+		_, ok = it.pm.deserialize(d)
+		tag = it.pm.instanceTag
+		ok = ok && it.pm.identifier == ei.Identifier
+	default:
+		return nil, fmt.Errorf("unknown item type %q", ei.Type)
+	}
+	if !ok || tag != ei.InstanceTag {
+		return nil, fmt.Errorf("the %s is corrupted", ei.Type)
+	}
+	return it, nil
+}
+
+// ExportWriter writes an export, one item at a time
+type ExportWriter struct {
+	w      *bufio.Writer
+	enc    *json.Encoder
+	counts StoredCounts
+}
+
+// NewExportWriter writes the header of an export
+func NewExportWriter(w io.Writer) (*ExportWriter, error) {
+	bw := bufio.NewWriter(w)
+	ew := &ExportWriter{w: bw, enc: json.NewEncoder(bw)}
+	if e := ew.enc.Encode(&exportHeader{Format: exportFormat, Version: exportVersion, Created: time.Now().UTC()}); e != nil {
+		return nil, e
+	}
+	return ew, nil
+}
+
+// Write writes one item
+func (ew *ExportWriter) Write(ei *ExportItem) error {
+	switch ei.Type {
+	case exportClientProfile:
+		ew.counts.ClientProfiles++
+	case exportPrekeyProfile:
+		ew.counts.PrekeyProfiles++
+	case exportPrekeyMessage:
+		ew.counts.PrekeyMessages++
+	default:
+		return fmt.Errorf("unknown item type %q", ei.Type)
+	}
+	return ew.enc.Encode(ei)
+}
+
+// Close writes the end of the export and returns the number of items written. It doesn't close the underlying writer
+func (ew *ExportWriter) Close() (StoredCounts, error) {
+	counts := ew.counts
+	if e := ew.enc.Encode(&ExportItem{Type: exportEnd, Counts: &counts}); e != nil {
+		return counts, e
+	}
+	return counts, ew.w.Flush()
+}
+
+// ExportReader reads an export, one item at a time
+type ExportReader struct {
+	dec    *json.Decoder
+	counts StoredCounts
+	done   bool
+}
+
+// NewExportReader reads the header of an export, failing if it's not in a format and version it knows
+func NewExportReader(r io.Reader) (*ExportReader, error) {
+	er := &ExportReader{dec: json.NewDecoder(bufio.NewReader(r))}
+	h := &exportHeader{}
+	if e := er.dec.Decode(h); e != nil {
+		return nil, fmt.Errorf("not an export: %v", e)
+	}
+	if h.Format != exportFormat {
+		return nil, fmt.Errorf("not an export: unknown format %q", h.Format)
+	}
+	if h.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", h.Version)
+	}
+	return er, nil
+}
+
+// Next returns the next item. At the end of the export, it checks the number of items read and returns io.EOF
+func (er *ExportReader) Next() (*ExportItem, error) {
+	if er.done {
+		return nil, io.EOF
+	}
+	ei := &ExportItem{}
+	if e := er.dec.Decode(ei); e != nil {
+		if e == io.EOF {
+			return nil, errors.New("the export is truncated")
+		}
+		return nil, fmt.Errorf("the export is corrupted: %v", e)
+	}
+
+	switch ei.Type {
+	case exportClientProfile:
+		er.counts.ClientProfiles++
+	case exportPrekeyProfile:
+		er.counts.PrekeyProfiles++
+	case exportPrekeyMessage:
+		er.counts.PrekeyMessages++
+	case exportEnd:
+		er.done = true
+		if ei.Counts == nil || *ei.Counts != er.counts {
+			return nil, errors.New("the number of items in the export is not the one written")
+		}
+		return nil, io.EOF
+	}
+	return ei, nil
+}
+
+// Export writes everything in the storage that hasn't expired
+func (a *Admin) Export(w io.Writer) (*TransferCounts, error) {
+	ew, e := NewExportWriter(w)
+	if e != nil {
+		return nil, e
+	}
+	tc := &TransferCounts{}
+	e = a.st.exportItems(func(it *storedItem) error {
+		if it.hasExpired() {
+			tc.Expired.addItem(it)
+			return nil
+		}
+		tc.Copied.addItem(it)
+		return ew.Write(it.intoExport())
+	})
+	if e != nil {
+		return nil, e
+	}
+	_, e = ew.Close()
+	return tc, e
+}
+
+func (a *Admin) importItems(next func() (*storedItem, error)) (*TransferCounts, error) {
+	tc := &TransferCounts{}
+	for {
+		it, e := next()
+		if e == io.EOF {
+			return tc, nil
+		}
+		if e != nil {
+			return tc, e
+		}
+		if it.hasExpired() {
+			tc.Expired.addItem(it)
+			continue
+		}
+		if e := a.st.importItem(it); e != nil {
+			return tc, e
+		}
+		tc.Copied.addItem(it)
+	}
+}
+
+// auditTransfer writes the audit entry for an import or migration, and returns the error of the transfer
+func (a *Admin) auditTransfer(action string, tc *TransferCounts, e error) error {
+	entry := &AuditEntry{Time: time.Now().UTC(), Operator: a.Operator, Action: action, Imported: &tc.Copied}
+	if e != nil {
+		entry.Error = e.Error()
+	}
+	if ae := a.writeAudit(entry); ae != nil {
+		return fmt.Errorf("the %s was done, but couldn't be written to the audit log: %v", action, ae)
+	}
+	return e
+}
+
+// Import stores the items of an export that haven't expired. If the export turns out to be
+// broken, the items before the problem are still stored
+func (a *Admin) Import(r io.Reader) (*TransferCounts, error) {
+	if a.audit == nil {
+		return nil, ErrNoAuditLog
+	}
+	er, e := NewExportReader(r)
+	if e != nil {
+		return nil, e
+	}
+	tc, e := a.importItems(func() (*storedItem, error) {
+		ei, e := er.Next()
+		if e != nil {
+			return nil, e
+		}
+		return ei.intoStored()
+	})
+	return tc, a.auditTransfer(auditImport, tc, e)
+}
+
+// migrationKey identifies an instance tag of an identity
+type migrationKey struct {
+	hash string
+	tag  uint32
+}
+
+func (it *storedItem) instanceTag() uint32 {
+	switch {
+	case it.cp != nil:
+		return it.cp.InstanceTag
+	case it.pp != nil:
+		return it.pp.instanceTag
+	}
+	return it.pm.instanceTag
+}
+
+// Migrate copies everything that hasn't expired from one storage to another, and then checks
+// that the destination has at least what was copied for every instance tag. The migration is
+// written to the audit log of the destination
+func Migrate(from, to *Admin) (*TransferCounts, error) {
+	if to.audit == nil {
+		return nil, ErrNoAuditLog
+	}
+	expected := map[migrationKey]*StoredCounts{}
+	items := make(chan *storedItem)
+	exportDone := make(chan error, 1)
+	stop := make(chan struct{})
+	go func() {
+		defer close(items)
+		exportDone <- from.st.exportItems(func(it *storedItem) error {
+			select {
+			case items <- it:
+				return nil
+			case <-stop:
+				return errors.New("the migration was stopped")
+			}
+		})
+	}()
+
+	tc, e := to.importItems(func() (*storedItem, error) {
+		it, ok := <-items
+		if !ok {
+			return nil, io.EOF
+		}
+		if !it.hasExpired() {
+			k := migrationKey{it.id.Hash, it.instanceTag()}
+			if expected[k] == nil {
+				expected[k] = &StoredCounts{}
+			}
+			expected[k].addItem(it)
+		}
+		return it, nil
+	})
+	close(stop)
+	for range items {
+	}
+	if ee := <-exportDone; e == nil {
+		e = ee
+	}
+	if e == nil {
+		e = checkMigrated(to, expected)
+	}
+	return tc, to.auditTransfer(auditMigrate, tc, e)
+}
+
+// checkMigrated checks that the destination has at least the expected items for every instance tag
+func checkMigrated(to *Admin, expected map[migrationKey]*StoredCounts) error {
+	found := map[migrationKey]*StoredCounts{}
+	for k := range expected {
+		if _, ok := found[k]; ok {
+			continue
+		}
+		tags, e := to.st.instanceTagsFor(&StoredIdentity{Hash: k.hash})
+		if e != nil {
+			return e
+		}
+		for _, st := range tags {
+			sc := &StoredCounts{}
+			sc.add(st)
+			found[migrationKey{k.hash, st.tag}] = sc
+		}
+		if _, ok := found[k]; !ok {
+			found[k] = &StoredCounts{}
+		}
+	}
+
+	missing := 0
+	var example string
+	for k, exp := range expected {
+		f := found[k]
+		if f.ClientProfiles < exp.ClientProfiles || f.PrekeyProfiles < exp.PrekeyProfiles || f.PrekeyMessages < exp.PrekeyMessages {
+			missing++
+			example = fmt.Sprintf("instance tag 0x%08X of hash:%s has %d prekey messages, expected %d", k.tag, k.hash, f.PrekeyMessages, exp.PrekeyMessages)
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("after migrating, %d instance tags in the destination are missing items - for example, %s", missing, example)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func createTestAdmin(c *C, desc string, audit io.Writer) (*GenericServer, *Admin) {
+	f := CreateFactory(nil)
+	st, e := f.LoadStorageType(desc)
+	c.Assert(e, IsNil)
+	server := f.NewServer("prekeys.example.org", f.CreateKeypair(), 0, st, time.Minute, time.Minute, nil).(*GenericServer)
+	a, e := server.Admin(audit)
+	c.Assert(e, IsNil)
+	return server, a
+}
+
+func (s *GenericServerSuite) Test_Admin_Export_canBeImportedIntoAnotherStorage(c *C) {
+	server, _, _ := createAdminTestServer(c, "in-memory")
+	from, _ := server.Admin(nil)
+	var exported bytes.Buffer
+	tc, e := from.Export(&exported)
+	c.Assert(e, IsNil)
+	c.Assert(tc.Copied, DeepEquals, StoredCounts{ClientProfiles: 2, PrekeyProfiles: 2, PrekeyMessages: 8})
+	c.Assert(tc.Expired, DeepEquals, StoredCounts{})
+	c.Assert(strings.Count(exported.String(), "\n"), Equals, 14)
+	c.Assert(exported.String(), Matches, `(?s)\{"format":"otrng-prekey-server-export","version":1,"created":".*"\}\n.*`)
+
+	var audit bytes.Buffer
+	_, to := createTestAdmin(c, "dir:"+c.MkDir(), &audit)
+	tc, e = to.Import(&exported)
+	c.Assert(e, IsNil)
+	c.Assert(tc.Copied, DeepEquals, StoredCounts{ClientProfiles: 2, PrekeyProfiles: 2, PrekeyMessages: 8})
+
+	for _, id := range []string{"sita@example.org", "rama@example.org"} {
+		orig, _ := from.Show(id)
+		copied, _ := to.Show(id)
+		c.Assert(copied.InstanceTags, DeepEquals, orig.InstanceTags)
+	}
+	entries, _ := ReadAuditLog(&audit)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Action, Equals, "import")
+	c.Assert(*entries[0].Imported, DeepEquals, tc.Copied)
+}
+
+func (s *GenericServerSuite) Test_Admin_Import_ofHashedIdentitiesIsTakenOverWhenTheIdentityIsSeen(c *C) {
+	server, sita, _ := createAdminTestServer(c, "dir:"+c.MkDir())
+	from, _ := server.Admin(nil)
+	var exported bytes.Buffer
+	_, e := from.Export(&exported)
+	c.Assert(e, IsNil)
+	c.Assert(strings.Contains(exported.String(), "sita@example.org"), Equals, false)
+
+	to, a := createTestAdmin(c, "in-memory", &bytes.Buffer{})
+	_, e = a.Import(&exported)
+	c.Assert(e, IsNil)
+	ids, _ := a.Identities()
+	c.Assert(ids, HasLen, 2)
+	c.Assert(ids[0].Identity, Equals, "")
+
+	rama := createTestClient("rama@example.org", to)
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+	c.Assert(ens[0].ClientProfile.InstanceTag, Equals, sita.Keys.InstanceTag)
+	info, _ := a.Show("sita@example.org")
+	c.Assert(info.InstanceTags, HasLen, 2)
+	ids, _ = a.Identities()
+	c.Assert(ids[1].Identity, Equals, "sita@example.org")
+}
+
+func (s *GenericServerSuite) Test_Admin_Export_skipsExpiredProfiles(c *C) {
+	_, a := createTestAdmin(c, "in-memory", nil)
+	sita := createTestClient("sita@example.org", nil)
+	id, _ := resolveIdentity("sita@example.org")
+	c.Assert(a.st.importItem(&storedItem{id: id, cp: sita.clientProfile(time.Now().Add(-time.Hour))}), IsNil)
+	pm, _, _, _ := generatePrekeyMessage(sita, sita.Keys.InstanceTag)
+	c.Assert(a.st.importItem(&storedItem{id: id, pm: pm}), IsNil)
+
+	var exported bytes.Buffer
+	tc, e := a.Export(&exported)
+	c.Assert(e, IsNil)
+	c.Assert(tc.Copied, DeepEquals, StoredCounts{PrekeyMessages: 1})
+	c.Assert(tc.Expired, DeepEquals, StoredCounts{ClientProfiles: 1})
+}
+
+func (s *GenericServerSuite) Test_ExportReader_refusesBrokenExports(c *C) {
+	server, _, _ := createAdminTestServer(c, "in-memory")
+	a, _ := server.Admin(nil)
+	var exported bytes.Buffer
+	a.Export(&exported)
+	lines := strings.SplitAfter(exported.String(), "\n")
+
+	readAll := func(content string) error {
+		er, e := NewExportReader(bytes.NewBufferString(content))
+		if e != nil {
+			return e
+		}
+		for {
+			ei, e := er.Next()
+			if e == io.EOF {
+				return nil
+			}
+			if e != nil {
+				return e
+			}
+			if _, e := ei.intoStored(); e != nil {
+				return e
+			}
+		}
+	}
+
+	c.Assert(readAll(exported.String()), IsNil)
+	c.Assert(readAll(strings.Join(lines[:len(lines)-2], "")), ErrorMatches, "the export is truncated")
+	c.Assert(readAll(strings.Join(append(lines[:3], lines[4:]...), "")), ErrorMatches, "the number of items in the export is not the one written")
+	c.Assert(readAll(`{"format":"something-else","version":1}`), ErrorMatches, `not an export: unknown format "something-else"`)
+	c.Assert(readAll(`{"format":"otrng-prekey-server-export","version":2}`), ErrorMatches, "unsupported export version 2")
+	c.Assert(readAll("hello"), ErrorMatches, "not an export: .*")
+	c.Assert(readAll(lines[0]+strings.Replace(lines[1], `"instanceTag":`, `"instanceTag":-`, 1)), ErrorMatches, "the export is corrupted: .*")
+	c.Assert(readAll(lines[0]+strings.Replace(lines[1], `"instanceTag":`, `"instanceTag":256,"x":`, 1)), ErrorMatches, "the (client-profile|prekey-profile|prekey-message) is corrupted")
+	c.Assert(readAll(lines[0]+strings.Replace(lines[1], `"hash":"`, `"hash":"00`, 1)), ErrorMatches, "the hash of .* is wrong")
+	c.Assert(readAll(lines[0]+`{"type":"session","hash":"`+identityHash("sita")+`"}`+"\n"), ErrorMatches, `unknown item type "session"`)
+}
+
+func (s *GenericServerSuite) Test_Admin_Import_needsAnAuditLog(c *C) {
+	_, a := createTestAdmin(c, "in-memory", nil)
+	_, e := a.Import(&bytes.Buffer{})
+	c.Assert(e, Equals, ErrNoAuditLog)
+}
+
+func (s *GenericServerSuite) Test_Migrate_copiesBetweenStoragesAndChecksTheResult(c *C) {
+	server, _, _ := createAdminTestServer(c, "dir:"+c.MkDir())
+	from, _ := server.Admin(nil)
+	var audit bytes.Buffer
+	_, to := createTestAdmin(c, "dir:"+c.MkDir(), &audit)
+
+	tc, e := Migrate(from, to)
+	c.Assert(e, IsNil)
+	c.Assert(tc.Copied, DeepEquals, StoredCounts{ClientProfiles: 2, PrekeyProfiles: 2, PrekeyMessages: 8})
+	t1, _ := from.Totals()
+	t2, _ := to.Totals()
+	c.Assert(t2, DeepEquals, t1)
+	entries, _ := ReadAuditLog(&audit)
+	c.Assert(entries[0].Action, Equals, "migrate")
+}
+
+// forgetfulStorage loses the prekey messages imported into it
+type forgetfulStorage struct {
+	*inMemoryStorage
+}
+
+func (fs *forgetfulStorage) importItem(it *storedItem) error {
+	if it.pm != nil {
+		return nil
+	}
+	return fs.inMemoryStorage.importItem(it)
+}
+
+func (s *GenericServerSuite) Test_Migrate_failsIfTheDestinationDoesNotHaveEverything(c *C) {
+	server, _, _ := createAdminTestServer(c, "in-memory")
+	from, _ := server.Admin(nil)
+	var audit bytes.Buffer
+	to, _ := newAdmin(&forgetfulStorage{createInMemoryStorage()}, &audit)
+
+	_, e := Migrate(from, to)
+	c.Assert(e, ErrorMatches, "after migrating, 3 instance tags in the destination are missing items - for example, instance tag 0x.* of hash:.* has 0 prekey messages, expected .*")
+	entries, _ := ReadAuditLog(&audit)
+	c.Assert(entries[0].Error, Matches, "after migrating.*")
+}
@@ -1,14 +1,18 @@
 package prekeyserver
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/otrv4/gotrx"
 )
@@ -67,7 +71,11 @@ func createFileStorageFrom(path string) *fileStorage {
 }
 
 func (fs *fileStorage) writeData(user, file string, itag uint32, data []byte) error {
-	userDir := fs.getOrCreateDirFor(user)
+	return fs.writeDataForHash(identityHash(user), file, itag, data)
+}
+
+func (fs *fileStorage) writeDataForHash(hash, file string, itag uint32, data []byte) error {
+	userDir := fs.getOrCreateDirForHash(hash)
 	t1 := lockDir(userDir)
 	defer unlockDir(userDir, t1)
 
@@ -98,8 +106,16 @@ func entryExists(entry string) bool {
 	return err == nil
 }
 
+// identityHash returns the hash the directory storage keeps the data for an identity under
+func identityHash(identity string) string {
+	return fmt.Sprintf("%X", sha256.Sum256([]byte(identity)))
+}
+
 func (fs *fileStorage) composeDirNameFor(user string) (string, string) {
-	hex := fmt.Sprintf("%X", sha256.Sum256([]byte(user)))
+	return fs.composeDirNameForHash(identityHash(user))
+}
+
+func (fs *fileStorage) composeDirNameForHash(hex string) (string, string) {
 	first := path.Join(fs.path, hex[0:4])
 	return first, path.Join(first, hex)
 }
@@ -118,12 +134,15 @@ func (fs *fileStorage) getPmDir(itagDir string) string {
 }
 
 func (fs *fileStorage) getOrCreateDirFor(user string) string {
-	dir, ok := fs.getDirFor(user)
-	if ok {
-		return dir
+	return fs.getOrCreateDirForHash(identityHash(user))
+}
+
+func (fs *fileStorage) getOrCreateDirForHash(hash string) string {
+	pref, us := fs.composeDirNameForHash(hash)
+	if entryExists(us) {
+		return us
 	}
 
-	pref, us := fs.composeDirNameFor(user)
 	if !entryExists(pref) {
 		t1 := lockDir(fs.path)
 		os.Mkdir(pref, 0700)
@@ -154,10 +173,14 @@ func (fs *fileStorage) getOrCreatePmDir(userDir string) string {
 }
 
 func (fs *fileStorage) storePrekeyMessages(user string, pms []*prekeyMessage) error {
+	return fs.storePrekeyMessagesForHash(identityHash(user), pms)
+}
+
+func (fs *fileStorage) storePrekeyMessagesForHash(hash string, pms []*prekeyMessage) error {
 	if len(pms) == 0 {
 		return nil
 	}
-	userDir := fs.getOrCreateDirFor(user)
+	userDir := fs.getOrCreateDirForHash(hash)
 	t1 := lockDir(userDir)
 	defer unlockDir(userDir, t1)
 
@@ -179,7 +202,10 @@ func (fs *fileStorage) numberStored(user string, itag uint32) uint32 {
 	t1 := lockDir(userDir)
 	defer unlockDir(userDir, t1)
 
-	pmDir := fs.getPmDir(fs.getInstanceTagDir(userDir, itag))
+	return countPrekeyMessagesIn(fs.getPmDir(fs.getInstanceTagDir(userDir, itag)))
+}
+
+func countPrekeyMessagesIn(pmDir string) uint32 {
 	files, err := ioutil.ReadDir(pmDir)
 	if err != nil {
 		return 0
@@ -253,6 +279,37 @@ func (fs *fileStorage) retrieveFor(user string) []*prekeyEnsemble {
 	return entries
 }
 
+// retrievePrekeyMessagesFor takes one prekey message out of every one of the instance tags, without
+// reading the profiles, for the caching storage
+func (fs *fileStorage) retrievePrekeyMessagesFor(user string, itags []uint32) map[uint32]*prekeyMessage {
+	userDir, ok := fs.getDirFor(user)
+	if !ok {
+		return nil
+	}
+	t1 := lockDir(userDir)
+	defer unlockDir(userDir, t1)
+
+	result := map[uint32]*prekeyMessage{}
+	for _, itag := range itags {
+		pmDir := fs.getPmDir(fs.getInstanceTagDir(userDir, itag))
+		pmFiles, _ := ioutil.ReadDir(pmDir)
+		if len(pmFiles) == 0 {
+			continue
+		}
+		pmFile := path.Join(pmDir, pmFiles[0].Name())
+		d, e := ioutil.ReadFile(pmFile)
+		if e != nil {
+			continue
+		}
+		pm := &prekeyMessage{}
+		if _, ok := pm.deserialize(d); ok {
+			os.Remove(pmFile)
+			result[itag] = pm
+		}
+	}
+	return result
+}
+
 func cleanupClientProfile(p string) error {
 	cpFile := path.Join(p, "cp.bin")
 	cp := &gotrx.ClientProfile{}
@@ -369,3 +426,206 @@ func (fs *fileStorage) cleanup() {
 		unlockDir(ff, t2)
 	}
 }
+
+// probe writes a probe file into the top level directory and reads it back. It also checks that
+// no lock file in the top level directory or the prefix directories has been left behind,
+// since that would block all writes below it.
+func (fs *fileStorage) probe() error {
+	name := path.Join(fs.path, fmt.Sprintf(".probe-%016X", rand.Uint64()))
+	content := []byte(name)
+	if e := ioutil.WriteFile(name, content, 0600); e != nil {
+		return e
+	}
+	defer os.Remove(name)
+
+	d, e := ioutil.ReadFile(name)
+	if e != nil {
+		return e
+	}
+	if !bytes.Equal(d, content) {
+		return errors.New("the probe entry read back is not the one written")
+	}
+
+	now := time.Now()
+	for _, dir := range append([]string{fs.path}, listDirsIn(fs.path)...) {
+		if l, ok := staleLockIn(dir, now); ok {
+			return fmt.Errorf("stale lock file %s", l)
+		}
+	}
+	return nil
+}
+
+func isHashPrefix(name string) bool {
+	res, _ := regexp.MatchString("^[0-9A-F]{4}$", name)
+	return res
+}
+
+func isIdentityHash(name string) bool {
+	res, _ := regexp.MatchString("^[0-9A-F]{64}$", name)
+	return res
+}
+
+// listIdentities can only return the hashes, since the identities themselves are not stored
+func (fs *fileStorage) listIdentities() ([]*StoredIdentity, error) {
+	prefixes, e := ioutil.ReadDir(fs.path)
+	if e != nil {
+		return nil, e
+	}
+	result := []*StoredIdentity{}
+	for _, p := range prefixes {
+		if !p.IsDir() || !isHashPrefix(p.Name()) {
+			continue
+		}
+		for _, u := range listDirsIn(path.Join(fs.path, p.Name())) {
+			if name := path.Base(u); isIdentityHash(name) && strings.HasPrefix(name, p.Name()) {
+				result = append(result, &StoredIdentity{Hash: name})
+			}
+		}
+	}
+	return result, nil
+}
+
+// readInstanceTag reads what is stored in the instance tag directory. Profiles that can't be read are left out
+func readInstanceTag(itagDir string, itag uint32) *storedInstanceTag {
+	st := &storedInstanceTag{tag: itag}
+	if d, e := ioutil.ReadFile(path.Join(itagDir, "cp.bin")); e == nil {
+		cp := &gotrx.ClientProfile{}
+		if _, ok := cp.Deserialize(d); ok {
+			st.cp = cp
+		}
+	}
+	if d, e := ioutil.ReadFile(path.Join(itagDir, "pp.bin")); e == nil {
+		pp := &prekeyProfile{}
+		if _, ok := pp.deserialize(d); ok {
+			st.pp = pp
+		}
+	}
+	st.prekeyMessages = int(countPrekeyMessagesIn(path.Join(itagDir, "pm")))
+	return st
+}
+
+// expects the user dir to be locked
+func readInstanceTagsIn(userDir string) []*storedInstanceTag {
+	tags := storedInstanceTags{}
+	for _, itagDir := range listInstanceTagsIn(userDir) {
+		itag, _ := strconv.ParseUint(path.Base(itagDir), 16, 32)
+		tags[uint32(itag)] = readInstanceTag(itagDir, uint32(itag))
+	}
+	return tags.sorted()
+}
+
+func (fs *fileStorage) instanceTagsFor(id *StoredIdentity) ([]*storedInstanceTag, error) {
+	_, userDir := fs.composeDirNameForHash(id.Hash)
+	if !entryExists(userDir) {
+		return nil, nil
+	}
+	t1 := lockDir(userDir)
+	defer unlockDir(userDir, t1)
+	return readInstanceTagsIn(userDir), nil
+}
+
+// purge removes the whole directory of the identity when purging all instance tags, with the
+// prefix directory locked like when cleaning up
+func (fs *fileStorage) purge(id *StoredIdentity, itag uint32) (*StoredCounts, error) {
+	prefixDir, userDir := fs.composeDirNameForHash(id.Hash)
+	removed := &StoredCounts{}
+	if !entryExists(userDir) {
+		return removed, nil
+	}
+
+	if itag != allInstanceTags {
+		t1 := lockDir(userDir)
+		defer unlockDir(userDir, t1)
+		itagDir := fs.getInstanceTagDir(userDir, itag)
+		if !entryExists(itagDir) {
+			return removed, nil
+		}
+		removed.add(readInstanceTag(itagDir, itag))
+		return removed, os.RemoveAll(itagDir)
+	}
+
+	t1 := lockDir(prefixDir)
+	defer unlockDir(prefixDir, t1)
+	t2 := lockDir(userDir)
+	for _, st := range readInstanceTagsIn(userDir) {
+		removed.add(st)
+	}
+	if e := os.RemoveAll(userDir); e != nil {
+		unlockDir(userDir, t2)
+		return nil, e
+	}
+	return removed, nil
+}
+
+// readPrekeyMessagesIn reads the prekey messages in the pm directory, leaving out the ones that can't be read
+func readPrekeyMessagesIn(pmDir string) []*prekeyMessage {
+	result := []*prekeyMessage{}
+	files, _ := ioutil.ReadDir(pmDir)
+	for _, f := range files {
+		if f.IsDir() || path.Ext(f.Name()) != ".bin" || len(f.Name()) != 12 {
+			continue
+		}
+		d, e := ioutil.ReadFile(path.Join(pmDir, f.Name()))
+		if e != nil {
+			continue
+		}
+		pm := &prekeyMessage{}
+		if _, ok := pm.deserialize(d); ok {
+			result = append(result, pm)
+		}
+	}
+	return result
+}
+
+// itemsFor reads everything stored for the identity, with the directory locked
+func (fs *fileStorage) itemsFor(id *StoredIdentity) ([]*storedItem, error) {
+	_, userDir := fs.composeDirNameForHash(id.Hash)
+	t1 := lockDir(userDir)
+	defer unlockDir(userDir, t1)
+
+	result := []*storedItem{}
+	for _, itagDir := range listInstanceTagsIn(userDir) {
+		itag, _ := strconv.ParseUint(path.Base(itagDir), 16, 32)
+		st := readInstanceTag(itagDir, uint32(itag))
+		if st.cp != nil {
+			result = append(result, &storedItem{id: id, cp: st.cp})
+		}
+		if st.pp != nil {
+			result = append(result, &storedItem{id: id, pp: st.pp})
+		}
+		for _, pm := range readPrekeyMessagesIn(fs.getPmDir(itagDir)) {
+			result = append(result, &storedItem{id: id, pm: pm})
+		}
+	}
+	return result, nil
+}
+
+// exportItems reads one identity at a time, so only one directory is locked while calling f
+func (fs *fileStorage) exportItems(f func(*storedItem) error) error {
+	ids, e := fs.listIdentities()
+	if e != nil {
+		return e
+	}
+	for _, id := range ids {
+		items, _ := fs.itemsFor(id)
+		for _, it := range items {
+			if e := f(it); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// importItem only needs the hash of the identity, since that is all the storage keeps
+func (fs *fileStorage) importItem(it *storedItem) error {
+	switch {
+	case it.cp != nil:
+		return fs.writeDataForHash(it.id.Hash, "cp.bin", it.cp.InstanceTag, it.cp.Serialize())
+	case it.pp != nil:
+		return fs.writeDataForHash(it.id.Hash, "pp.bin", it.pp.instanceTag, it.pp.serialize())
+	case it.pm != nil:
+		return fs.storePrekeyMessagesForHash(it.id.Hash, []*prekeyMessage{it.pm})
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package prekeyserver
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HealthLimits are the bounds the state kept in memory by a server should stay within for it
+// to be considered ready. Zero means no bound.
+type HealthLimits struct {
+	// MaxSessions is the maximum number of DAKE sessions in progress
+	MaxSessions int
+	// MaxFragments is the maximum number of senders with fragmented messages that haven't been completed
+	MaxFragments int
+}
+
+// HealthCheck is the result of one of the checks done to decide whether a server is ready
+type HealthCheck struct {
+	Name  string
+	OK    bool
+	Error string
+}
+
+// HealthChecker is implemented by servers that can check whether they are able to serve requests
+type HealthChecker interface {
+	// CheckReadiness checks the keypair, the storage and the sessions and fragments in progress
+	CheckReadiness(l HealthLimits) []*HealthCheck
+}
+
+func healthCheck(name string, e error) *HealthCheck {
+	if e != nil {
+		return &HealthCheck{Name: name, Error: e.Error()}
+	}
+	return &HealthCheck{Name: name, OK: true}
+}
+
+func withinBound(what string, n, max int) error {
+	if max > 0 && n > max {
+		return fmt.Errorf("%d %s in progress, more than the limit of %d", n, what, max)
+	}
+	return nil
+}
+
+// countWithinBound is withinBound for counts that are kept outside of the process, and can fail
+func countWithinBound(what string, count func() (int, error), max int) error {
+	n, e := count()
+	if e != nil {
+		return fmt.Errorf("couldn't count the %s: %v", what, e)
+	}
+	return withinBound(what, n, max)
+}
+
+// fragmentTracker keeps track of the senders that have sent part of a fragmented message
+type fragmentTracker struct {
+	pending map[string]time.Time
+	sync.Mutex
+}
+
+func (ft *fragmentTracker) received(from string) {
+	ft.Lock()
+	defer ft.Unlock()
+	if ft.pending == nil {
+		ft.pending = make(map[string]time.Time)
+	}
+	ft.pending[from] = time.Now()
+}
+
+func (ft *fragmentTracker) completed(from string) {
+	ft.Lock()
+	defer ft.Unlock()
+	delete(ft.pending, from)
+}
+
+func (ft *fragmentTracker) cleanup(timeout time.Duration) {
+	ft.Lock()
+	defer ft.Unlock()
+	for from, t := range ft.pending {
+		if time.Since(t) > timeout {
+			delete(ft.pending, from)
+		}
+	}
+}
+
+func (ft *fragmentTracker) count() int {
+	ft.Lock()
+	defer ft.Unlock()
+	return len(ft.pending)
+}
+
+func (g *GenericServer) checkKeypair() error {
+	if g.key == nil || g.key.Priv == nil || g.key.Pub == nil {
+		return errors.New("the keypair is not loaded")
+	}
+	return nil
+}
+
+// CheckReadiness implements the HealthChecker interface
+func (g *GenericServer) CheckReadiness(l HealthLimits) []*HealthCheck {
+	g.sessions.cleanup(g.sessionTimeout)
+	g.pendingFragments.cleanup(g.fragmentationTimeout)
+
+	return []*HealthCheck{
+		healthCheck("keypair", g.checkKeypair()),
+		healthCheck("storage", g.storageImpl.probe()),
+		healthCheck("sessions", countWithinBound("sessions", g.countSessions, l.MaxSessions)),
+		healthCheck("fragments", countWithinBound("fragmented messages", g.countPendingFragments, l.MaxFragments)),
+	}
+}
@@ -0,0 +1,118 @@
+package prekeyserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/otrv4/gotrx"
+	. "gopkg.in/check.v1"
+)
+
+func createHealthTestServer() *GenericServer {
+	gs := createHandoffTestServer()
+	gs.fragmentations = gotrx.NewFragmentor(fragmentationPrefix)
+	gs.fragmentationTimeout = time.Duration(5) * time.Minute
+	return gs
+}
+
+func failedHealthChecks(checks []*HealthCheck) []string {
+	result := []string{}
+	for _, hc := range checks {
+		if !hc.OK {
+			result = append(result, hc.Name+": "+hc.Error)
+		}
+	}
+	return result
+}
+
+func (s *GenericServerSuite) Test_GenericServer_CheckReadiness_reportsAllChecksAsOK(c *C) {
+	gs := createHealthTestServer()
+
+	checks := gs.CheckReadiness(HealthLimits{MaxSessions: 1, MaxFragments: 1})
+	c.Assert(checks, HasLen, 4)
+	c.Assert(checks[0].Name, Equals, "keypair")
+	c.Assert(checks[1].Name, Equals, "storage")
+	c.Assert(checks[2].Name, Equals, "sessions")
+	c.Assert(checks[3].Name, Equals, "fragments")
+	c.Assert(failedHealthChecks(checks), HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_CheckReadiness_failsWithoutKeypair(c *C) {
+	gs := createHealthTestServer()
+	gs.key = nil
+
+	c.Assert(failedHealthChecks(gs.CheckReadiness(HealthLimits{})), DeepEquals, []string{
+		"keypair: the keypair is not loaded",
+	})
+}
+
+func (s *GenericServerSuite) Test_GenericServer_CheckReadiness_failsWithTooManySessions(c *C) {
+	gs := createHealthTestServer()
+	gs.sessions.add("rama@example.org", &realSession{lastTouched: time.Now()})
+	gs.sessions.add("sita@example.org", &realSession{lastTouched: time.Now()})
+
+	c.Assert(failedHealthChecks(gs.CheckReadiness(HealthLimits{MaxSessions: 2})), HasLen, 0)
+	c.Assert(failedHealthChecks(gs.CheckReadiness(HealthLimits{MaxSessions: 1})), DeepEquals, []string{
+		"sessions: 2 sessions in progress, more than the limit of 1",
+	})
+}
+
+func (s *GenericServerSuite) Test_GenericServer_CheckReadiness_failsWithTooManyFragmentedMessages(c *C) {
+	gs := createHealthTestServer()
+	gs.Handle("rama@example.org", "?OTRP|1234|BEEF|CADE,1,2,aGksIHRoaXMgaXMgbm90IGEg,")
+	gs.Handle("sita@example.org", "?OTRP|1234|BEEF|CADE,1,2,aGksIHRoaXMgaXMgbm90IGEg,")
+
+	c.Assert(failedHealthChecks(gs.CheckReadiness(HealthLimits{MaxFragments: 1})), DeepEquals, []string{
+		"fragments: 2 fragmented messages in progress, more than the limit of 1",
+	})
+
+	gs.Handle("sita@example.org", "?OTRP|1234|BEEF|CADE,2,2,dmFsaWQgb3RyNCBtZXNzYWdlLCBidXQgc3RpbGwuLi4=.,")
+	c.Assert(failedHealthChecks(gs.CheckReadiness(HealthLimits{MaxFragments: 1})), HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_CheckReadiness_forgetsExpiredFragmentedMessages(c *C) {
+	gs := createHealthTestServer()
+	gs.Handle("rama@example.org", "?OTRP|1234|BEEF|CADE,1,2,aGksIHRoaXMgaXMgbm90IGEg,")
+	gs.pendingFragments.pending["rama@example.org"] = time.Now().Add(time.Duration(-6) * time.Minute)
+
+	c.Assert(failedHealthChecks(gs.CheckReadiness(HealthLimits{MaxFragments: 0})), HasLen, 0)
+	c.Assert(gs.pendingFragments.count(), Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_fileStorage_probe_writesAndRemovesAProbeEntry(c *C) {
+	os.Mkdir(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	fs := createFileStorageFrom(testDir)
+	c.Assert(fs.probe(), IsNil)
+	c.Assert(listDir(testDir), HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_fileStorage_probe_failsWhenTheDirectoryIsNotWritable(c *C) {
+	os.Mkdir(testDir, 0500)
+	defer os.RemoveAll(testDir)
+
+	fs := createFileStorageFrom(testDir)
+	c.Assert(fs.probe(), ErrorMatches, "open __dir_for_tests/.probe-[0-9A-F]{16}: permission denied")
+}
+
+func (s *GenericServerSuite) Test_fileStorage_probe_failsWithAStaleLock(c *C) {
+	os.MkdirAll(path.Join(testDir, prefixHexForUser1), 0700)
+	defer os.RemoveAll(testDir)
+
+	lock := path.Join(testDir, prefixHexForUser1, ".lock")
+	ioutil.WriteFile(lock, []byte{0x01}, 0600)
+
+	fs := createFileStorageFrom(testDir)
+	c.Assert(fs.probe(), IsNil)
+
+	old := time.Now().Add(-2 * staleLockAge)
+	os.Chtimes(lock, old, old)
+	c.Assert(fs.probe(), ErrorMatches, "stale lock file __dir_for_tests/D862/.lock")
+}
+
+func (s *GenericServerSuite) Test_inMemoryStorage_probe_succeeds(c *C) {
+	c.Assert(createInMemoryStorage().probe(), IsNil)
+}
@@ -1,6 +1,7 @@
 package prekeyserver
 
 import (
+	"errors"
 	"sync"
 
 	"github.com/otrv4/gotrx"
@@ -25,6 +26,8 @@ type inMemoryStorageEntry struct {
 
 type inMemoryStorage struct {
 	perUser map[string]*inMemoryStorageEntry
+	// hashedOnly has the entries imported with only the hash of the identity, until the identity is seen
+	hashedOnly map[string]*inMemoryStorageEntry
 	sync.RWMutex
 }
 
@@ -50,22 +53,52 @@ func (s *inMemoryStorageEntry) retrieve() []*prekeyEnsemble {
 
 func createInMemoryStorage() *inMemoryStorage {
 	return &inMemoryStorage{
-		perUser: make(map[string]*inMemoryStorageEntry),
+		perUser:    make(map[string]*inMemoryStorageEntry),
+		hashedOnly: make(map[string]*inMemoryStorageEntry),
 	}
 }
 
-func (s *inMemoryStorage) storageEntryFor(from string) *inMemoryStorageEntry {
+func createInMemoryStorageEntry() *inMemoryStorageEntry {
+	return &inMemoryStorageEntry{
+		clientProfiles: make(map[uint32]*gotrx.ClientProfile),
+		prekeyProfiles: make(map[uint32]*prekeyProfile),
+		prekeyMessages: make(map[uint32][]*prekeyMessage),
+	}
+}
+
+// lookup returns the entry for the identity, taking over the entry imported for its hash if there is one
+func (s *inMemoryStorage) lookup(from string) (*inMemoryStorageEntry, bool) {
 	s.RLock()
 	se, ok := s.perUser[from]
+	hashed := len(s.hashedOnly) > 0
 	s.RUnlock()
+	if ok || !hashed {
+		return se, ok
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if se, ok := s.perUser[from]; ok {
+		return se, true
+	}
+	h := identityHash(from)
+	se, ok = s.hashedOnly[h]
+	if ok {
+		delete(s.hashedOnly, h)
+		s.perUser[from] = se
+	}
+	return se, ok
+}
+
+func (s *inMemoryStorage) storageEntryFor(from string) *inMemoryStorageEntry {
+	se, ok := s.lookup(from)
 	if !ok {
-		se = &inMemoryStorageEntry{
-			clientProfiles: make(map[uint32]*gotrx.ClientProfile),
-			prekeyProfiles: make(map[uint32]*prekeyProfile),
-			prekeyMessages: make(map[uint32][]*prekeyMessage),
-		}
 		s.Lock()
 		defer s.Unlock()
+		if existing, ok := s.perUser[from]; ok {
+			return existing
+		}
+		se = createInMemoryStorageEntry()
 		s.perUser[from] = se
 	}
 	return se
@@ -106,19 +139,17 @@ func (s *inMemoryStorage) storePrekeyMessages(from string, pms []*prekeyMessage)
 }
 
 func (s *inMemoryStorage) numberStored(from string, tag uint32) uint32 {
-	s.RLock()
-	defer s.RUnlock()
-	pu, ok := s.perUser[from]
+	pu, ok := s.lookup(from)
 	if !ok {
 		return 0
 	}
+	pu.Lock()
+	defer pu.Unlock()
 	return uint32(len(pu.prekeyMessages[tag]))
 }
 
 func (s *inMemoryStorage) retrieveFor(from string) []*prekeyEnsemble {
-	s.RLock()
-	pu, ok := s.perUser[from]
-	s.RUnlock()
+	pu, ok := s.lookup(from)
 	if !ok {
 		return nil
 	}
@@ -176,4 +207,261 @@ func (s *inMemoryStorage) cleanup() {
 	for _, pu := range toRemove {
 		delete(s.perUser, pu)
 	}
+	toRemove = []string{}
+	for h, pus := range s.hashedOnly {
+		if !pus.cleanup() {
+			toRemove = append(toRemove, h)
+		}
+	}
+	for _, h := range toRemove {
+		delete(s.hashedOnly, h)
+	}
+}
+
+func (s *inMemoryStorage) probe() error {
+	s.RLock()
+	defer s.RUnlock()
+	if s.perUser == nil {
+		return errors.New("the storage hasn't been initialized")
+	}
+	return nil
+}
+
+func (s *inMemoryStorage) listIdentities() ([]*StoredIdentity, error) {
+	s.RLock()
+	defer s.RUnlock()
+	result := []*StoredIdentity{}
+	for from := range s.perUser {
+		result = append(result, &StoredIdentity{Identity: from, Hash: identityHash(from)})
+	}
+	for h := range s.hashedOnly {
+		result = append(result, &StoredIdentity{Hash: h})
+	}
+	return result, nil
+}
+
+// entryFor finds the entry for the identity, by the hash if the identity isn't given, and returns
+// the map it is in. It expects the storage lock to be held
+func (s *inMemoryStorage) entryFor(id *StoredIdentity) (map[string]*inMemoryStorageEntry, string, *inMemoryStorageEntry) {
+	if se, ok := s.hashedOnly[id.Hash]; ok {
+		return s.hashedOnly, id.Hash, se
+	}
+	if id.Identity != "" {
+		return s.perUser, id.Identity, s.perUser[id.Identity]
+	}
+	for from, se := range s.perUser {
+		if identityHash(from) == id.Hash {
+			return s.perUser, from, se
+		}
+	}
+	return nil, "", nil
+}
+
+func (s *inMemoryStorage) instanceTagsFor(id *StoredIdentity) ([]*storedInstanceTag, error) {
+	s.RLock()
+	_, _, se := s.entryFor(id)
+	s.RUnlock()
+	if se == nil {
+		return nil, nil
+	}
+
+	se.Lock()
+	defer se.Unlock()
+	tags := storedInstanceTags{}
+	for itag, cp := range se.clientProfiles {
+		tags.get(itag).cp = cp
+	}
+	for itag, pp := range se.prekeyProfiles {
+		tags.get(itag).pp = pp
+	}
+	for itag, pms := range se.prekeyMessages {
+		if len(pms) > 0 {
+			tags.get(itag).prekeyMessages = len(pms)
+		}
+	}
+	return tags.sorted(), nil
+}
+
+// expects the entry lock to be held
+func (s *inMemoryStorageEntry) purgeInstanceTag(itag uint32, removed *StoredCounts) {
+	if _, ok := s.clientProfiles[itag]; ok {
+		removed.ClientProfiles++
+		delete(s.clientProfiles, itag)
+	}
+	if _, ok := s.prekeyProfiles[itag]; ok {
+		removed.PrekeyProfiles++
+		delete(s.prekeyProfiles, itag)
+	}
+	removed.PrekeyMessages += len(s.prekeyMessages[itag])
+	delete(s.prekeyMessages, itag)
+}
+
+func (s *inMemoryStorage) purge(id *StoredIdentity, itag uint32) (*StoredCounts, error) {
+	s.Lock()
+	defer s.Unlock()
+	removed := &StoredCounts{}
+	m, key, se := s.entryFor(id)
+	if se == nil {
+		return removed, nil
+	}
+
+	se.Lock()
+	defer se.Unlock()
+	if itag != allInstanceTags {
+		se.purgeInstanceTag(itag, removed)
+	} else {
+		for t := range se.clientProfiles {
+			se.purgeInstanceTag(t, removed)
+		}
+		for t := range se.prekeyProfiles {
+			se.purgeInstanceTag(t, removed)
+		}
+		for t := range se.prekeyMessages {
+			se.purgeInstanceTag(t, removed)
+		}
+	}
+	if !se.hasAnyEntries() {
+		delete(m, key)
+	}
+	return removed, nil
+}
+
+// exportItems copies the entries first, so no locks are held while calling f
+func (s *inMemoryStorage) exportItems(f func(*storedItem) error) error {
+	s.RLock()
+	ids := []*StoredIdentity{}
+	entries := []*inMemoryStorageEntry{}
+	for from, se := range s.perUser {
+		ids = append(ids, &StoredIdentity{Identity: from, Hash: identityHash(from)})
+		entries = append(entries, se)
+	}
+	for h, se := range s.hashedOnly {
+		ids = append(ids, &StoredIdentity{Hash: h})
+		entries = append(entries, se)
+	}
+	s.RUnlock()
+
+	for ix, se := range entries {
+		for _, it := range se.items(ids[ix]) {
+			if e := f(it); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (s *inMemoryStorageEntry) items(id *StoredIdentity) []*storedItem {
+	s.Lock()
+	defer s.Unlock()
+	tags := storedInstanceTags{}
+	for itag := range s.clientProfiles {
+		tags.get(itag)
+	}
+	for itag := range s.prekeyProfiles {
+		tags.get(itag)
+	}
+	for itag := range s.prekeyMessages {
+		tags.get(itag)
+	}
+
+	result := []*storedItem{}
+	for _, st := range tags.sorted() {
+		if cp, ok := s.clientProfiles[st.tag]; ok {
+			result = append(result, &storedItem{id: id, cp: cp})
+		}
+		if pp, ok := s.prekeyProfiles[st.tag]; ok {
+			result = append(result, &storedItem{id: id, pp: pp})
+		}
+		for _, pm := range s.prekeyMessages[st.tag] {
+			result = append(result, &storedItem{id: id, pm: pm})
+		}
+	}
+	return result
+}
+
+func (s *inMemoryStorage) itemsFor(id *StoredIdentity) ([]*storedItem, error) {
+	s.RLock()
+	_, _, se := s.entryFor(id)
+	s.RUnlock()
+	if se == nil {
+		return nil, nil
+	}
+	return se.items(id), nil
+}
+
+// hashedEntryFor returns the entry for the identity with the hash, creating one in hashedOnly if the identity isn't known
+func (s *inMemoryStorage) hashedEntryFor(h string) *inMemoryStorageEntry {
+	s.Lock()
+	defer s.Unlock()
+	if se, ok := s.hashedOnly[h]; ok {
+		return se
+	}
+	for from, se := range s.perUser {
+		if identityHash(from) == h {
+			return se
+		}
+	}
+	se := createInMemoryStorageEntry()
+	s.hashedOnly[h] = se
+	return se
+}
+
+func (s *inMemoryStorage) importItem(it *storedItem) error {
+	var se *inMemoryStorageEntry
+	if it.id.Identity != "" {
+		se = s.storageEntryFor(it.id.Identity)
+	} else {
+		se = s.hashedEntryFor(it.id.Hash)
+	}
+
+	se.Lock()
+	defer se.Unlock()
+	switch {
+	case it.cp != nil:
+		se.clientProfiles[it.cp.InstanceTag] = it.cp
+	case it.pp != nil:
+		se.prekeyProfiles[it.pp.instanceTag] = it.pp
+	case it.pm != nil:
+		// the directory storage keeps prekey messages by identifier, so importing one twice doesn't duplicate it there either
+		if se.prekeyMessageIndex(it.pm.instanceTag, it.pm.identifier) == -1 {
+			se.prekeyMessages[it.pm.instanceTag] = append(se.prekeyMessages[it.pm.instanceTag], it.pm)
+		}
+	}
+	return nil
+}
+
+// prekeyMessageIndex returns where the prekey message with the identifier is, or -1. It expects the entry lock to be held
+func (s *inMemoryStorageEntry) prekeyMessageIndex(itag, identifier uint32) int {
+	for ix, pm := range s.prekeyMessages[itag] {
+		if pm.identifier == identifier {
+			return ix
+		}
+	}
+	return -1
+}
+
+// removePrekeyMessage removes the prekey message with the identifier, if it's there
+func (s *inMemoryStorage) removePrekeyMessage(id *StoredIdentity, itag, identifier uint32) {
+	s.Lock()
+	defer s.Unlock()
+	m, key, se := s.entryFor(id)
+	if se == nil {
+		return
+	}
+
+	se.Lock()
+	defer se.Unlock()
+	ix := se.prekeyMessageIndex(itag, identifier)
+	if ix == -1 {
+		return
+	}
+	pms := se.prekeyMessages[itag]
+	se.prekeyMessages[itag] = append(pms[:ix:ix], pms[ix+1:]...)
+	if len(se.prekeyMessages[itag]) == 0 {
+		delete(se.prekeyMessages, itag)
+	}
+	if !se.hasAnyEntries() {
+		delete(m, key)
+	}
 }
@@ -0,0 +1,426 @@
+package prekeyserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/otrv4/ed448"
+	"github.com/otrv4/gotrx"
+)
+
+// Inspection describes the content of one prekey protocol message, for debugging clients and servers.
+// Everything that can be validated without the keys of a session is checked, and the problems found
+// are listed in Problems. The checks that would need session keys - MACs, ring signatures and the
+// proofs for published keys - are listed in Unchecked.
+type Inspection struct {
+	Type              string                     `json:"type"`
+	TypeCode          uint8                      `json:"typeCode"`
+	Version           uint16                     `json:"version"`
+	Size              int                        `json:"size"`
+	InstanceTag       uint32                     `json:"instanceTag,omitempty"`
+	Identity          string                     `json:"identity,omitempty"`
+	Versions          string                     `json:"versions,omitempty"`
+	ServerIdentity    string                     `json:"serverIdentity,omitempty"`
+	ServerFingerprint string                     `json:"serverFingerprint,omitempty"`
+	Stored            *uint32                    `json:"stored,omitempty"`
+	Text              string                     `json:"text,omitempty"`
+	ClientProfile     *ClientProfileInspection   `json:"clientProfile,omitempty"`
+	PrekeyProfile     *PrekeyProfileInspection   `json:"prekeyProfile,omitempty"`
+	PrekeyMessages    []*PrekeyMessageInspection `json:"prekeyMessages,omitempty"`
+	Proofs            []*ProofInspection         `json:"proofs,omitempty"`
+	Ensembles         []*EnsembleInspection      `json:"ensembles,omitempty"`
+	Inner             *Inspection                `json:"inner,omitempty"`
+	MACSize           int                        `json:"macSize,omitempty"`
+	TrailingBytes     int                        `json:"trailingBytes,omitempty"`
+	Problems          []string                   `json:"problems,omitempty"`
+	Unchecked         []string                   `json:"unchecked,omitempty"`
+}
+
+// ClientProfileInspection describes a client profile
+type ClientProfileInspection struct {
+	InstanceTag           uint32    `json:"instanceTag"`
+	Fingerprint           string    `json:"fingerprint"`
+	ForgingKeyFingerprint string    `json:"forgingKeyFingerprint,omitempty"`
+	Versions              string    `json:"versions"`
+	Expires               time.Time `json:"expires"`
+	Expired               bool      `json:"expired"`
+	HasDSAKey             bool      `json:"hasDSAKey"`
+	Problems              []string  `json:"problems,omitempty"`
+}
+
+// PrekeyProfileInspection describes a prekey profile
+type PrekeyProfileInspection struct {
+	InstanceTag uint32    `json:"instanceTag"`
+	Expires     time.Time `json:"expires"`
+	Expired     bool      `json:"expired"`
+	Problems    []string  `json:"problems,omitempty"`
+}
+
+// PrekeyMessageInspection describes a prekey message
+type PrekeyMessageInspection struct {
+	Identifier  uint32   `json:"identifier"`
+	InstanceTag uint32   `json:"instanceTag"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+// ProofInspection describes one of the zero-knowledge proofs in a publication message
+type ProofInspection struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// EnsembleInspection describes one prekey ensemble in an ensemble retrieval message
+type EnsembleInspection struct {
+	ClientProfile *ClientProfileInspection `json:"clientProfile"`
+	PrekeyProfile *PrekeyProfileInspection `json:"prekeyProfile"`
+	PrekeyMessage *PrekeyMessageInspection `json:"prekeyMessage"`
+	Problems      []string                 `json:"problems,omitempty"`
+}
+
+// Valid returns true if no problems were found anywhere in the message
+func (i *Inspection) Valid() bool {
+	if len(i.Problems) > 0 || (i.Inner != nil && !i.Inner.Valid()) {
+		return false
+	}
+	if i.ClientProfile != nil && len(i.ClientProfile.Problems) > 0 {
+		return false
+	}
+	if i.PrekeyProfile != nil && len(i.PrekeyProfile.Problems) > 0 {
+		return false
+	}
+	for _, pm := range i.PrekeyMessages {
+		if len(pm.Problems) > 0 {
+			return false
+		}
+	}
+	for _, e := range i.Ensembles {
+		if len(e.Problems) > 0 || len(e.ClientProfile.Problems) > 0 || len(e.PrekeyProfile.Problems) > 0 || len(e.PrekeyMessage.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var messageTypeNames = map[uint8]string{
+	messageTypeDAKE1:                     "DAKE-1",
+	messageTypeDAKE2:                     "DAKE-2",
+	messageTypeDAKE3:                     "DAKE-3",
+	messageTypePublication:               "publication",
+	messageTypeStorageInformationRequest: "storage information request",
+	messageTypeStorageStatusMessage:      "storage status",
+	messageTypeSuccess:                   "success",
+	messageTypeFailure:                   "failure",
+	messageTypeEnsembleRetrievalQuery:    "ensemble retrieval query",
+	messageTypeEnsembleRetrieval:         "ensemble retrieval",
+	messageTypeNoPrekeyEnsembles:         "no prekey ensembles",
+	messageTypePrekeyMessage:             "prekey message",
+}
+
+// minimumInstanceTag is the smallest valid instance tag, smaller ones are reserved
+const minimumInstanceTag = 0x100
+
+// InspectMessage decodes a complete message in the form it is sent in - base64 encoded, ending with
+// a period - and describes its content. Fragments have to be put together before they can be inspected.
+func InspectMessage(msg string) (*Inspection, error) {
+	msg = strings.TrimSpace(msg)
+	if msg == "" {
+		return nil, errors.New("empty message")
+	}
+	if strings.HasPrefix(msg, fragmentationPrefix) {
+		return nil, errors.New("the message is a fragment")
+	}
+	decoded, ok := decodeMessage(strings.TrimSuffix(msg, "."))
+	if !ok {
+		return nil, errors.New("invalid message format - corrupted base64 encoding")
+	}
+	return InspectBytes(decoded)
+}
+
+// InspectBytes describes the content of a decoded message
+func InspectBytes(msg []byte) (*Inspection, error) {
+	if len(msg) <= indexOfMessageType {
+		return nil, errors.New("message too short to be a valid message")
+	}
+	i := &Inspection{
+		Version:  parseVersion(msg),
+		TypeCode: msg[indexOfMessageType],
+		Size:     len(msg),
+	}
+	if i.Version != version {
+		return nil, fmt.Errorf("invalid protocol version %d", i.Version)
+	}
+	name, ok := messageTypeNames[i.TypeCode]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type: 0x%x", i.TypeCode)
+	}
+	i.Type = name
+
+	var rest []byte
+	switch i.TypeCode {
+	case messageTypeDAKE1:
+		m := &dake1Message{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.inspectDAKE1(m)
+		}
+	case messageTypeDAKE2:
+		m := &dake2Message{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.inspectDAKE2(m)
+		}
+	case messageTypeDAKE3:
+		m := &dake3Message{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.inspectDAKE3(m)
+		}
+	case messageTypePublication:
+		m := &publicationMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.inspectPublication(m)
+		}
+	case messageTypeStorageInformationRequest:
+		m := &storageInformationRequestMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.MACSize = len(m.mac)
+			i.Unchecked = append(i.Unchecked, "MAC")
+		}
+	case messageTypeStorageStatusMessage:
+		m := &storageStatusMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.InstanceTag = m.instanceTag
+			i.Stored = &m.number
+			i.MACSize = len(m.mac)
+			i.Unchecked = append(i.Unchecked, "MAC")
+		}
+	case messageTypeSuccess:
+		m := &successMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.InstanceTag = m.instanceTag
+			i.MACSize = len(m.mac)
+			i.Unchecked = append(i.Unchecked, "MAC")
+		}
+	case messageTypeFailure:
+		m := &failureMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.InstanceTag = m.instanceTag
+			i.MACSize = len(m.mac)
+			i.Unchecked = append(i.Unchecked, "MAC")
+		}
+	case messageTypeEnsembleRetrievalQuery:
+		m := &ensembleRetrievalQueryMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.InstanceTag = m.instanceTag
+			i.Identity = m.identity
+			i.Versions = string(m.versions)
+			if !strings.Contains(i.Versions, "4") {
+				i.Problems = append(i.Problems, "the query doesn't ask for version 4")
+			}
+		}
+	case messageTypeEnsembleRetrieval:
+		m := &ensembleRetrievalMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.inspectEnsembleRetrieval(m)
+		}
+	case messageTypeNoPrekeyEnsembles:
+		m := &noPrekeyEnsemblesMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.InstanceTag = m.instanceTag
+			i.Identity = m.identity
+			i.Text = m.message
+		}
+	case messageTypePrekeyMessage:
+		m := &prekeyMessage{}
+		if rest, ok = m.deserialize(msg); ok {
+			i.PrekeyMessages = []*PrekeyMessageInspection{inspectPrekeyMessage(m)}
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("the %s message is corrupted or truncated", i.Type)
+	}
+
+	i.TrailingBytes = len(rest)
+	if i.TrailingBytes > 0 {
+		i.Problems = append(i.Problems, fmt.Sprintf("%d bytes after the end of the message", i.TrailingBytes))
+	}
+	if i.InstanceTag != 0 && i.InstanceTag < minimumInstanceTag {
+		i.Problems = append(i.Problems, fmt.Sprintf("invalid instance tag 0x%08X", i.InstanceTag))
+	}
+	return i, nil
+}
+
+// FormatFingerprint formats the fingerprint as seven groups of sixteen hexadecimal digits
+func FormatFingerprint(fp gotrx.Fingerprint) string {
+	result := ""
+	sep := ""
+
+	for ix := 0; ix < 7; ix++ {
+		result = fmt.Sprintf("%s%s%02X%02X%02X%02X%02X%02X%02X%02X", result, sep, fp[ix*8+0], fp[ix*8+1], fp[ix*8+2], fp[ix*8+3], fp[ix*8+4], fp[ix*8+5], fp[ix*8+6], fp[ix*8+7])
+		sep = " "
+	}
+
+	return result
+}
+
+func inspectClientProfile(cp *gotrx.ClientProfile) *ClientProfileInspection {
+	ci := &ClientProfileInspection{
+		InstanceTag: cp.InstanceTag,
+		Versions:    string(cp.Versions),
+		Expires:     cp.Expiration,
+		Expired:     cp.HasExpired(),
+		HasDSAKey:   cp.DsaKey != nil,
+	}
+	if cp.PublicKey != nil {
+		ci.Fingerprint = FormatFingerprint(cp.PublicKey.Fingerprint())
+	}
+	if cp.ForgingKey != nil {
+		ci.ForgingKeyFingerprint = FormatFingerprint(cp.ForgingKey.Fingerprint())
+	}
+	if e := cp.Validate(cp.InstanceTag); e != nil {
+		ci.Problems = append(ci.Problems, e.Error())
+	}
+	return ci
+}
+
+// inspectPrekeyProfile checks the signature of the prekey profile if the key of the client profile it belongs to is known
+func inspectPrekeyProfile(pp *prekeyProfile, signer *gotrx.PublicKey) *PrekeyProfileInspection {
+	pi := &PrekeyProfileInspection{
+		InstanceTag: pp.instanceTag,
+		Expires:     pp.expiration,
+		Expired:     pp.hasExpired(),
+	}
+	if signer != nil {
+		if e := pp.validate(pp.instanceTag, signer); e != nil {
+			pi.Problems = append(pi.Problems, e.Error())
+		}
+		return pi
+	}
+	if pi.Expired {
+		pi.Problems = append(pi.Problems, "prekey profile has expired")
+	}
+	if gotrx.ValidatePoint(pp.sharedPrekey.K()) != nil {
+		pi.Problems = append(pi.Problems, "prekey profile shared prekey is not a valid point")
+	}
+	return pi
+}
+
+func inspectPrekeyMessage(pm *prekeyMessage) *PrekeyMessageInspection {
+	mi := &PrekeyMessageInspection{
+		Identifier:  pm.identifier,
+		InstanceTag: pm.instanceTag,
+	}
+	if e := pm.validate(pm.instanceTag); e != nil {
+		mi.Problems = append(mi.Problems, e.Error())
+	}
+	return mi
+}
+
+func checkPoint(p ed448.Point, name string) []string {
+	if gotrx.ValidatePoint(p) != nil {
+		return []string{name + " is not a valid point"}
+	}
+	return nil
+}
+
+func (i *Inspection) checkInstanceTag(what string, tag uint32) {
+	if tag != i.InstanceTag {
+		i.Problems = append(i.Problems, fmt.Sprintf("the instance tag of the %s (0x%08X) doesn't match the message (0x%08X)", what, tag, i.InstanceTag))
+	}
+}
+
+func (i *Inspection) inspectDAKE1(m *dake1Message) {
+	i.InstanceTag = m.instanceTag
+	i.ClientProfile = inspectClientProfile(m.clientProfile)
+	i.checkInstanceTag("client profile", m.clientProfile.InstanceTag)
+	i.Problems = append(i.Problems, checkPoint(m.i, "the I point")...)
+}
+
+func (i *Inspection) inspectDAKE2(m *dake2Message) {
+	i.InstanceTag = m.instanceTag
+	i.ServerIdentity = string(m.serverIdentity)
+	i.ServerFingerprint = FormatFingerprint(gotrx.CreatePublicKey(m.serverKey, gotrx.Ed448Key).Fingerprint())
+	i.Problems = append(i.Problems, checkPoint(m.serverKey, "the server key")...)
+	i.Problems = append(i.Problems, checkPoint(m.s, "the S point")...)
+	i.Unchecked = append(i.Unchecked, "ring signature")
+}
+
+func (i *Inspection) inspectDAKE3(m *dake3Message) {
+	i.InstanceTag = m.instanceTag
+	i.Unchecked = append(i.Unchecked, "ring signature")
+	inner, e := InspectBytes(m.message)
+	if e != nil {
+		i.Problems = append(i.Problems, fmt.Sprintf("the enclosed message can't be decoded: %v", e))
+		return
+	}
+	if inner.TypeCode != messageTypePublication && inner.TypeCode != messageTypeStorageInformationRequest {
+		i.Problems = append(i.Problems, fmt.Sprintf("a %s message can't be sent in a DAKE-3 message", inner.Type))
+	}
+	i.Inner = inner
+}
+
+func (i *Inspection) inspectPublication(m *publicationMessage) {
+	var signer *gotrx.PublicKey
+	var tag uint32
+	if m.clientProfile != nil {
+		i.ClientProfile = inspectClientProfile(m.clientProfile)
+		signer = m.clientProfile.PublicKey
+		tag = m.clientProfile.InstanceTag
+	}
+	if m.prekeyProfile != nil {
+		i.PrekeyProfile = inspectPrekeyProfile(m.prekeyProfile, signer)
+		if signer == nil {
+			i.Unchecked = append(i.Unchecked, "prekey profile signature")
+		}
+		if tag == 0 {
+			tag = m.prekeyProfile.instanceTag
+		}
+	}
+	for _, pm := range m.prekeyMessages {
+		i.PrekeyMessages = append(i.PrekeyMessages, inspectPrekeyMessage(pm))
+		if tag == 0 {
+			tag = pm.instanceTag
+		}
+	}
+
+	i.InstanceTag = tag
+	if m.prekeyProfile != nil {
+		i.checkInstanceTag("prekey profile", m.prekeyProfile.instanceTag)
+	}
+	for _, pm := range m.prekeyMessages {
+		i.checkInstanceTag(fmt.Sprintf("prekey message 0x%08X", pm.identifier), pm.instanceTag)
+	}
+
+	if m.prekeyMessageProofEcdh != nil {
+		i.Proofs = append(i.Proofs, &ProofInspection{Name: "prekey messages ECDH", Size: len(m.prekeyMessageProofEcdh.serialize())})
+	}
+	if m.prekeyMessageProofDh != nil {
+		i.Proofs = append(i.Proofs, &ProofInspection{Name: "prekey messages DH", Size: len(m.prekeyMessageProofDh.serialize())})
+	}
+	if m.prekeyProfileProofEcdh != nil {
+		i.Proofs = append(i.Proofs, &ProofInspection{Name: "prekey profile ECDH", Size: len(m.prekeyProfileProofEcdh.serialize())})
+	}
+	i.MACSize = len(m.mac)
+	i.Unchecked = append(i.Unchecked, "MAC")
+	if len(i.Proofs) > 0 {
+		i.Unchecked = append(i.Unchecked, "proofs")
+	}
+}
+
+func (i *Inspection) inspectEnsembleRetrieval(m *ensembleRetrievalMessage) {
+	i.InstanceTag = m.instanceTag
+	i.Identity = m.identity
+	if len(m.ensembles) == 0 {
+		i.Problems = append(i.Problems, "no ensembles in the message")
+	}
+	for _, pe := range m.ensembles {
+		ei := &EnsembleInspection{
+			ClientProfile: inspectClientProfile(pe.cp),
+			PrekeyProfile: inspectPrekeyProfile(pe.pp, pe.cp.PublicKey),
+			PrekeyMessage: inspectPrekeyMessage(pe.pm),
+		}
+		if pe.pp.instanceTag != pe.cp.InstanceTag || pe.pm.instanceTag != pe.cp.InstanceTag {
+			ei.Problems = append(ei.Problems, "the instance tags in the ensemble don't match")
+		}
+		i.Ensembles = append(i.Ensembles, ei)
+	}
+}
@@ -0,0 +1,147 @@
+package prekeyserver
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/otrv4/gotrx"
+	. "gopkg.in/check.v1"
+)
+
+func (s *GenericServerSuite) Test_FormatFingerprint_willFormatTheFingerprint(c *C) {
+	d := gotrx.Fingerprint{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x11, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x21, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x31, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x41, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x51, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x61, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	}
+	c.Assert(FormatFingerprint(d), Equals, "0102030405060708 1102030405060708 2102030405060708 3102030405060708 4102030405060708 5102030405060708 6102030405060708")
+}
+
+func (s *GenericServerSuite) Test_InspectMessage_describesADAKE1Message(c *C) {
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.Pub.K())
+
+	i, e := InspectMessage(encodeMessage(d1.serialize()) + ".")
+
+	c.Assert(e, IsNil)
+	c.Assert(i.Type, Equals, "DAKE-1")
+	c.Assert(i.TypeCode, Equals, messageTypeDAKE1)
+	c.Assert(i.Version, Equals, version)
+	c.Assert(i.Size, Equals, len(d1.serialize()))
+	c.Assert(i.InstanceTag, Equals, uint32(0x1245ABCD))
+	c.Assert(i.ClientProfile.InstanceTag, Equals, uint32(0x1245ABCD))
+	c.Assert(i.ClientProfile.Fingerprint, Equals, FormatFingerprint(sita.longTerm.Pub.Fingerprint()))
+	c.Assert(i.ClientProfile.Versions, Equals, "4")
+	c.Assert(i.ClientProfile.Expires.Unix(), Equals, sita.clientProfile.Expiration.Unix())
+	c.Assert(i.ClientProfile.Problems, IsNil)
+	c.Assert(i.Problems, IsNil)
+	c.Assert(i.Valid(), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_InspectMessage_reportsProblemsWithoutFailing(c *C) {
+	d1 := generateDake1(0x1245ABCE, sita.clientProfile, sita.i.Pub.K())
+
+	i, e := InspectBytes(append(d1.serialize(), 0x01, 0x02))
+
+	c.Assert(e, IsNil)
+	c.Assert(i.Problems, DeepEquals, []string{
+		"the instance tag of the client profile (0x1245ABCD) doesn't match the message (0x1245ABCE)",
+		"2 bytes after the end of the message",
+	})
+	c.Assert(i.TrailingBytes, Equals, 2)
+	c.Assert(i.Valid(), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_InspectMessage_describesThePublicationInADAKE3Message(c *C) {
+	wr := &GenericServer{rand: gotrx.FixtureRand()}
+	sk := make([]byte, skLength)
+	pp, ppk := generatePrekeyProfile(wr, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 0, time.UTC), sita.longTerm)
+	pm1, pmk1, pmbpriv1, pmbpub1 := generatePrekeyMessage(wr, sita.instanceTag)
+	pm2, pmk2, pmbpriv2, pmbpub2 := generatePrekeyMessage(wr, sita.instanceTag)
+	prof1, prof2 := generatePrekeyMessagesProofs(wr, []*gotrx.Keypair{pmk1, pmk2}, []*big.Int{pmbpriv1, pmbpriv2}, []*big.Int{pmbpub1, pmbpub2}, sk)
+	prof3 := gemeratePrekeyProfileProof(wr, ppk, sk)
+	pub := generatePublicationMessage(sita.clientProfile, pp, []*prekeyMessage{pm1, pm2}, prof1, prof2, prof3, make([]byte, 64))
+	sigma := &gotrx.RingSignature{C1: scalarOne, R1: scalarOne, C2: scalarOne, R2: scalarOne, C3: scalarOne, R3: scalarOne}
+	d3 := generateDake3(sita.instanceTag, sigma, pub.serialize())
+
+	i, e := InspectBytes(d3.serialize())
+
+	c.Assert(e, IsNil)
+	c.Assert(i.Type, Equals, "DAKE-3")
+	c.Assert(i.Unchecked, DeepEquals, []string{"ring signature"})
+	c.Assert(i.Inner, Not(IsNil))
+	c.Assert(i.Inner.Type, Equals, "publication")
+	c.Assert(i.Inner.InstanceTag, Equals, sita.instanceTag)
+	c.Assert(i.Inner.ClientProfile.Problems, IsNil)
+	c.Assert(i.Inner.PrekeyProfile.InstanceTag, Equals, sita.instanceTag)
+	c.Assert(i.Inner.PrekeyProfile.Problems, IsNil)
+	c.Assert(i.Inner.PrekeyMessages, HasLen, 2)
+	c.Assert(i.Inner.PrekeyMessages[0].Identifier, Equals, pm1.identifier)
+	c.Assert(i.Inner.PrekeyMessages[1].Identifier, Equals, pm2.identifier)
+	c.Assert(i.Inner.Proofs, DeepEquals, []*ProofInspection{
+		{Name: "prekey messages ECDH", Size: 120},
+		{Name: "prekey messages DH", Size: len(prof2.serialize())},
+		{Name: "prekey profile ECDH", Size: 120},
+	})
+	c.Assert(i.Inner.MACSize, Equals, macLength)
+	c.Assert(i.Inner.Unchecked, DeepEquals, []string{"MAC", "proofs"})
+	c.Assert(i.Valid(), Equals, true)
+}
+
+func (s *GenericServerSuite) Test_InspectMessage_checksTheSignatureOfPrekeyProfilesInEnsembles(c *C) {
+	wr := &GenericServer{rand: gotrx.FixtureRand()}
+	pp, _ := generatePrekeyProfile(wr, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 0, time.UTC), sita.longTerm)
+	badPP, _ := generatePrekeyProfile(wr, sita.instanceTag, time.Date(2028, 11, 5, 4, 46, 00, 0, time.UTC), sita.forgingKey)
+	pm, _, _, _ := generatePrekeyMessage(wr, sita.instanceTag)
+	m := &ensembleRetrievalMessage{
+		instanceTag: 0x5555DDDD,
+		identity:    "sita@example.org",
+		ensembles: []*prekeyEnsemble{
+			{cp: sita.clientProfile, pp: pp, pm: pm},
+			{cp: sita.clientProfile, pp: badPP, pm: pm},
+		},
+	}
+
+	i, e := InspectBytes(m.serialize())
+
+	c.Assert(e, IsNil)
+	c.Assert(i.Identity, Equals, "sita@example.org")
+	c.Assert(i.Ensembles, HasLen, 2)
+	c.Assert(i.Ensembles[0].PrekeyProfile.Problems, IsNil)
+	c.Assert(i.Ensembles[0].PrekeyMessage.Identifier, Equals, pm.identifier)
+	c.Assert(i.Ensembles[1].PrekeyProfile.Problems, DeepEquals, []string{"invalid signature in prekey profile"})
+	c.Assert(i.Valid(), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_InspectMessage_describesStorageStatusMessages(c *C) {
+	m := &storageStatusMessage{instanceTag: 0x1245ABCD, number: 42}
+
+	i, e := InspectBytes(m.serialize())
+
+	c.Assert(e, IsNil)
+	c.Assert(i.Type, Equals, "storage status")
+	c.Assert(*i.Stored, Equals, uint32(42))
+	c.Assert(i.Unchecked, DeepEquals, []string{"MAC"})
+}
+
+func (s *GenericServerSuite) Test_InspectMessage_failsOnMessagesItCantDecode(c *C) {
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.Pub.K()).serialize()
+
+	_, e := InspectMessage("")
+	c.Assert(e, ErrorMatches, "empty message")
+	_, e = InspectMessage("?OTRP|1|1245ABCD|00000000,1,2,AAQ1,")
+	c.Assert(e, ErrorMatches, "the message is a fragment")
+	_, e = InspectMessage("AAQ1&&.")
+	c.Assert(e, ErrorMatches, "invalid message format - corrupted base64 encoding")
+	_, e = InspectBytes([]byte{0x00, 0x04})
+	c.Assert(e, ErrorMatches, "message too short to be a valid message")
+	_, e = InspectBytes([]byte{0x00, 0x03, 0x35})
+	c.Assert(e, ErrorMatches, "invalid protocol version 3")
+	_, e = InspectBytes([]byte{0x00, 0x04, 0x42})
+	c.Assert(e, ErrorMatches, "unknown message type: 0x42")
+	_, e = InspectBytes(d1[:len(d1)-10])
+	c.Assert(e, ErrorMatches, "the DAKE-1 message is corrupted or truncated")
+}
@@ -11,10 +11,17 @@ import (
 	"time"
 )
 
+// staleLockAge is how old a lock file has to be before we consider it left behind by a process that died
+const staleLockAge = time.Duration(1) * time.Minute
+
+func isLockFile(f os.FileInfo) bool {
+	return !f.IsDir() && (f.Name() == ".lock" || strings.HasPrefix(f.Name(), ".lock-"))
+}
+
 func hasLocks(dir string, without string) bool {
 	files, _ := ioutil.ReadDir(dir)
 	for _, f := range files {
-		if !f.IsDir() && (f.Name() == ".lock" || strings.HasPrefix(f.Name(), ".lock-")) && f.Name() != without {
+		if isLockFile(f) && f.Name() != without {
 			return true
 		}
 
@@ -60,3 +67,14 @@ func unlockDir(dirName string, token uint64) {
 	}
 	os.Remove(path.Join(dirName, ".lock"))
 }
+
+// staleLockIn returns the name of a lock file in the directory that is older than staleLockAge, if any
+func staleLockIn(dir string, now time.Time) (string, bool) {
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if isLockFile(f) && now.Sub(f.ModTime()) > staleLockAge {
+			return path.Join(dir, f.Name()), true
+		}
+	}
+	return "", false
+}
@@ -1,6 +1,6 @@
 package prekeyserver
 
-import "errors"
+import "fmt"
 
 type messageHandler interface {
 	handleMessage(from string, message []byte) ([]byte, error)
@@ -24,14 +24,31 @@ func (mh *otrngMessageHandler) shouldRestrict(from string, mt uint8) bool {
 
 }
 
+func (mh *otrngMessageHandler) checkPolicy(from string, mt uint8, m message) error {
+	if mh.shouldRestrict(from, mt) {
+		return errRestricted
+	}
+
+	kind, ok := messageKindFor(mt)
+	if mh.s.policy == nil || !ok {
+		return nil
+	}
+
+	e := mh.s.policy.Check(from, kind, policyTargetFor(from, m))
+	if e != nil && e != errRestricted {
+		return fmt.Errorf("%v: %v", errRestricted, e)
+	}
+	return e
+}
+
 func (mh *otrngMessageHandler) handleInnerMessage(from string, message []byte) (serializable, error) {
 	result, mt, e := parseMessage(message)
 	if e != nil {
 		return nil, e
 	}
 
-	if mh.shouldRestrict(from, mt) {
-		return nil, errors.New("this from-string is restricted for these kinds of messages")
+	if e := mh.checkPolicy(from, mt, result); e != nil {
+		return nil, e
 	}
 
 	if e := result.validate(from, mh.s); e != nil {
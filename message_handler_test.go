@@ -89,3 +89,64 @@ func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_errorsOnRest
 	_, e := (&otrngMessageHandler{s: gs}).handleMessage("someone@somewhere.org", d3.serialize())
 	c.Assert(e, ErrorMatches, "this from-string is restricted for these kinds of messages")
 }
+
+func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_reportsTheReasonWhenPolicyDeniesDake1(c *C) {
+	serverKey := gotrx.DeriveKeypair([symKeyLength]byte{0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25})
+	p, _ := NewRulePolicy(&PolicyDescription{Rules: []PolicyRuleDescription{
+		{Action: "deny", Messages: []string{"dake1"}, From: "suffix:@somewhere.org", Reason: "publication only for example.org"},
+	}})
+	gs := &GenericServer{
+		identity:    "masterOfKeys.example.org",
+		rand:        gotrx.FixtureRand(),
+		key:         serverKey,
+		fingerprint: serverKey.Pub.Fingerprint(),
+		storageImpl: createInMemoryStorage(),
+		sessions:    newSessionManager(),
+		rest:        nullRestrictor,
+		policy:      p,
+	}
+	mh := &otrngMessageHandler{s: gs}
+	gs.messageHandler = mh
+
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.Pub.K())
+
+	_, e := mh.handleMessage("someone@somewhere.org", d1.serialize())
+	c.Assert(e, ErrorMatches, "this from-string is restricted for these kinds of messages: denied by policy: publication only for example.org")
+}
+
+func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_givesTheQueriedIdentityToThePolicy(c *C) {
+	p, _ := NewRulePolicy(&PolicyDescription{Rules: []PolicyRuleDescription{
+		{Action: "deny", Target: "exact:sita@example.org"},
+	}})
+	gs := &GenericServer{
+		storageImpl: createInMemoryStorage(),
+		sessions:    newSessionManager(),
+		rest:        nullRestrictor,
+		policy:      p,
+	}
+	mh := &otrngMessageHandler{s: gs}
+	gs.messageHandler = mh
+
+	q := &ensembleRetrievalQueryMessage{instanceTag: 0x1245ABCD, identity: "sita@example.org", versions: []byte{0x04}}
+	_, e := mh.handleMessage("rama@example.org", q.serialize())
+	c.Assert(e, ErrorMatches, "this from-string is restricted for these kinds of messages: denied by policy")
+
+	q.identity = "rama@example.org"
+	_, e = mh.handleMessage("sita@example.org", q.serialize())
+	c.Assert(e, IsNil)
+}
+
+func (s *GenericServerSuite) Test_otrngMessageHandler_handleMessage_doesntWrapRestrictorsUsedAsPolicies(c *C) {
+	gs := &GenericServer{
+		storageImpl: createInMemoryStorage(),
+		sessions:    newSessionManager(),
+		rest:        nullRestrictor,
+		policy:      Restrictor(func(string) bool { return true }),
+	}
+	mh := &otrngMessageHandler{s: gs}
+	gs.messageHandler = mh
+
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.Pub.K())
+	_, e := mh.handleMessage("someone@somewhere.org", d1.serialize())
+	c.Assert(e, Equals, errRestricted)
+}
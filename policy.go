@@ -0,0 +1,77 @@
+package prekeyserver
+
+import "fmt"
+
+// MessageKind names the kind of request a Policy is asked about
+type MessageKind string
+
+// These are the kinds of requests that a Policy will be consulted for.
+// The publication and storage information kinds are only seen after
+// a DAKE has been finished, since they are carried inside of DAKE-3
+const (
+	MessageDAKE1              MessageKind = "dake1"
+	MessageDAKE3              MessageKind = "dake3"
+	MessagePublication        MessageKind = "publication"
+	MessageStorageInformation MessageKind = "storage-information"
+	MessageEnsembleRetrieval  MessageKind = "ensemble-retrieval"
+)
+
+var allMessageKinds = []MessageKind{
+	MessageDAKE1,
+	MessageDAKE3,
+	MessagePublication,
+	MessageStorageInformation,
+	MessageEnsembleRetrieval,
+}
+
+func isKnownMessageKind(k MessageKind) bool {
+	for _, kk := range allMessageKinds {
+		if kk == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy decides whether a request should be served by the server.
+// The target is the identity the request is about - for an ensemble retrieval
+// this is the identity asked for, for all other kinds of requests it is the from-name itself.
+// Check should return nil if the request is acceptable, and an error describing the reason otherwise.
+type Policy interface {
+	Check(from string, kind MessageKind, target string) error
+}
+
+// PolicyError is the error returned when a policy rule denies a request
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Reason == "" {
+		return "denied by policy"
+	}
+	return fmt.Sprintf("denied by policy: %s", e.Reason)
+}
+
+func messageKindFor(mt uint8) (MessageKind, bool) {
+	switch mt {
+	case messageTypeDAKE1:
+		return MessageDAKE1, true
+	case messageTypeDAKE3:
+		return MessageDAKE3, true
+	case messageTypePublication:
+		return MessagePublication, true
+	case messageTypeStorageInformationRequest:
+		return MessageStorageInformation, true
+	case messageTypeEnsembleRetrievalQuery:
+		return MessageEnsembleRetrieval, true
+	}
+	return "", false
+}
+
+func policyTargetFor(from string, m message) string {
+	if q, ok := m.(*ensembleRetrievalQueryMessage); ok {
+		return q.identity
+	}
+	return from
+}
@@ -0,0 +1,54 @@
+package prekeyserver
+
+import (
+	"os"
+	"sync"
+)
+
+// PolicyFile is a rule policy read from a file, that can be reloaded
+// while the server is running.
+type PolicyFile struct {
+	name    string
+	current *RulePolicy
+	sync.RWMutex
+}
+
+func readPolicyFile(name string) (*RulePolicy, error) {
+	f, e := os.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return LoadPolicyFrom(f)
+}
+
+// LoadPolicyFile reads the rule policy in the named file
+func LoadPolicyFile(name string) (*PolicyFile, error) {
+	p, e := readPolicyFile(name)
+	if e != nil {
+		return nil, e
+	}
+	return &PolicyFile{name: name, current: p}, nil
+}
+
+// Reload will read the policy file again. If the file can't be read
+// or has errors, the previous policy will be kept and the error returned.
+func (pf *PolicyFile) Reload() error {
+	p, e := readPolicyFile(pf.name)
+	if e != nil {
+		return e
+	}
+
+	pf.Lock()
+	defer pf.Unlock()
+	pf.current = p
+	return nil
+}
+
+// Check implements the Policy interface
+func (pf *PolicyFile) Check(from string, kind MessageKind, target string) error {
+	pf.RLock()
+	p := pf.current
+	pf.RUnlock()
+	return p.Check(from, kind, target)
+}
@@ -0,0 +1,41 @@
+package prekeyserver
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *GenericServerSuite) Test_LoadPolicyFile_returnsErrorForMissingFile(c *C) {
+	_, e := LoadPolicyFile("/somewhere/that/shouldn't/work")
+	c.Assert(e, ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *GenericServerSuite) Test_PolicyFile_Reload_readsTheNewRules(c *C) {
+	f, _ := ioutil.TempFile("", "otrng-policy-file")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Default": "allow"}`)
+	f.Close()
+
+	pf, e := LoadPolicyFile(f.Name())
+	c.Assert(e, IsNil)
+	c.Assert(pf.Check("alice@example.org", MessageDAKE1, "alice@example.org"), IsNil)
+
+	ioutil.WriteFile(f.Name(), []byte(`{"Default": "deny", "Reason": "closed for maintenance"}`), 0600)
+	c.Assert(pf.Reload(), IsNil)
+	c.Assert(pf.Check("alice@example.org", MessageDAKE1, "alice@example.org"), ErrorMatches, "denied by policy: closed for maintenance")
+}
+
+func (s *GenericServerSuite) Test_PolicyFile_Reload_keepsThePreviousRulesOnError(c *C) {
+	f, _ := ioutil.TempFile("", "otrng-policy-file")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Default": "deny"}`)
+	f.Close()
+
+	pf, _ := LoadPolicyFile(f.Name())
+
+	ioutil.WriteFile(f.Name(), []byte(`{"Default": "whatever"}`), 0600)
+	c.Assert(pf.Reload(), ErrorMatches, "invalid default: unknown action \"whatever\"")
+	c.Assert(pf.Check("alice@example.org", MessageDAKE1, "alice@example.org"), ErrorMatches, "denied by policy")
+}
@@ -0,0 +1,230 @@
+package prekeyserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Design:
+// - a rule policy is a list of rules that are tried in order, and the first rule matching
+//   a request decides whether it will be allowed or denied
+// - if no rule matches, the default action is used. If no default is given, requests are allowed
+// - each rule can restrict which message kinds it applies to, and match both the from-name and the target
+// - matchers are written as descriptors, in the same way as storage descriptors:
+//   - "exact:alice@example.org" or just "alice@example.org"
+//   - "prefix:alice@"
+//   - "suffix:@example.org"
+//   - "glob:*@*.example.org" where * matches any sequence of characters, and ? matches one character
+//   - "regex:^[a-z]+@example\.org$"
+//   - "*" matches anything, as does leaving the matcher out
+// - the rules are read from JSON, for example:
+//   {
+//     "Default": "deny",
+//     "Rules": [
+//       {"Action": "allow", "Messages": ["ensemble-retrieval"]},
+//       {"Action": "allow", "From": "suffix:@example.org"},
+//       {"Action": "deny", "Reason": "publication is only allowed for example.org"}
+//     ]
+//   }
+
+const (
+	policyActionAllow = "allow"
+	policyActionDeny  = "deny"
+)
+
+// PolicyRuleDescription is the serialized form of one policy rule
+type PolicyRuleDescription struct {
+	Action   string
+	Messages []string
+	From     string
+	Target   string
+	Reason   string
+}
+
+// PolicyDescription is the serialized form of a rule policy
+type PolicyDescription struct {
+	Default string
+	Reason  string
+	Rules   []PolicyRuleDescription
+}
+
+type matcher func(string) bool
+
+func matchAnything(string) bool {
+	return true
+}
+
+type policyRule struct {
+	allow  bool
+	kinds  []MessageKind
+	from   matcher
+	target matcher
+	reason string
+}
+
+// RulePolicy is a Policy made up of allow and deny rules
+type RulePolicy struct {
+	rules        []*policyRule
+	defaultAllow bool
+	reason       string
+}
+
+func globToRegexp(glob string) string {
+	result := "^"
+	for _, c := range glob {
+		switch c {
+		case '*':
+			result += ".*"
+		case '?':
+			result += "."
+		default:
+			result += regexp.QuoteMeta(string(c))
+		}
+	}
+	return result + "$"
+}
+
+func parseMatcher(desc string) (matcher, error) {
+	if desc == "" || desc == "*" {
+		return matchAnything, nil
+	}
+
+	kind := "exact"
+	value := desc
+	if ix := strings.Index(desc, ":"); ix != -1 {
+		switch desc[:ix] {
+		case "exact", "prefix", "suffix", "glob", "regex":
+			kind = desc[:ix]
+			value = desc[ix+1:]
+		}
+	}
+
+	switch kind {
+	case "prefix":
+		return func(s string) bool { return strings.HasPrefix(s, value) }, nil
+	case "suffix":
+		return func(s string) bool { return strings.HasSuffix(s, value) }, nil
+	case "glob":
+		value = globToRegexp(value)
+		fallthrough
+	case "regex":
+		re, e := regexp.Compile(value)
+		if e != nil {
+			return nil, fmt.Errorf("invalid matcher %q: %v", desc, e)
+		}
+		return re.MatchString, nil
+	}
+	return func(s string) bool { return s == value }, nil
+}
+
+// NewMatcher returns a function matching strings against the given matcher descriptor.
+// The descriptors are the same as the ones used for policy rules.
+func NewMatcher(desc string) (func(string) bool, error) {
+	return parseMatcher(desc)
+}
+
+func parsePolicyAction(action string) (bool, error) {
+	switch action {
+	case policyActionAllow:
+		return true, nil
+	case policyActionDeny:
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown action %q", action)
+}
+
+func parsePolicyRule(d PolicyRuleDescription) (*policyRule, error) {
+	var e error
+	r := &policyRule{reason: d.Reason}
+
+	if r.allow, e = parsePolicyAction(d.Action); e != nil {
+		return nil, e
+	}
+
+	for _, m := range d.Messages {
+		k := MessageKind(m)
+		if !isKnownMessageKind(k) {
+			return nil, fmt.Errorf("unknown message kind %q", m)
+		}
+		r.kinds = append(r.kinds, k)
+	}
+
+	if r.from, e = parseMatcher(d.From); e != nil {
+		return nil, e
+	}
+
+	if r.target, e = parseMatcher(d.Target); e != nil {
+		return nil, e
+	}
+
+	return r, nil
+}
+
+// NewRulePolicy creates a rule policy from the given description,
+// returning an error describing the first problem found in it
+func NewRulePolicy(d *PolicyDescription) (*RulePolicy, error) {
+	res := &RulePolicy{defaultAllow: true, reason: d.Reason}
+	if d.Default != "" {
+		allow, e := parsePolicyAction(d.Default)
+		if e != nil {
+			return nil, fmt.Errorf("invalid default: %v", e)
+		}
+		res.defaultAllow = allow
+	}
+
+	for ix, rd := range d.Rules {
+		r, e := parsePolicyRule(rd)
+		if e != nil {
+			return nil, fmt.Errorf("invalid rule %d: %v", ix+1, e)
+		}
+		res.rules = append(res.rules, r)
+	}
+
+	return res, nil
+}
+
+// LoadPolicyFrom will read a JSON policy description from the reader
+func LoadPolicyFrom(r io.Reader) (*RulePolicy, error) {
+	dec := json.NewDecoder(r)
+	d := &PolicyDescription{}
+	if e := dec.Decode(d); e != nil {
+		return nil, e
+	}
+	return NewRulePolicy(d)
+}
+
+func (r *policyRule) appliesTo(kind MessageKind) bool {
+	if len(r.kinds) == 0 {
+		return true
+	}
+	for _, k := range r.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *policyRule) matches(from string, kind MessageKind, target string) bool {
+	return r.appliesTo(kind) && r.from(from) && r.target(target)
+}
+
+// Check implements the Policy interface
+func (p *RulePolicy) Check(from string, kind MessageKind, target string) error {
+	for _, r := range p.rules {
+		if r.matches(from, kind, target) {
+			if r.allow {
+				return nil
+			}
+			return &PolicyError{Reason: r.reason}
+		}
+	}
+
+	if p.defaultAllow {
+		return nil
+	}
+	return &PolicyError{Reason: p.reason}
+}
@@ -0,0 +1,133 @@
+package prekeyserver
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *GenericServerSuite) Test_parseMatcher_supportsAllKindsOfMatchers(c *C) {
+	m, e := parseMatcher("")
+	c.Assert(e, IsNil)
+	c.Assert(m("anything"), Equals, true)
+
+	m, _ = parseMatcher("*")
+	c.Assert(m("anything"), Equals, true)
+
+	m, _ = parseMatcher("alice@example.org")
+	c.Assert(m("alice@example.org"), Equals, true)
+	c.Assert(m("alice@example.org2"), Equals, false)
+
+	m, _ = parseMatcher("exact:alice@example.org")
+	c.Assert(m("alice@example.org"), Equals, true)
+	c.Assert(m("bob@example.org"), Equals, false)
+
+	m, _ = parseMatcher("prefix:alice@")
+	c.Assert(m("alice@example.org"), Equals, true)
+	c.Assert(m("bob@example.org"), Equals, false)
+
+	m, _ = parseMatcher("suffix:@example.org")
+	c.Assert(m("alice@example.org"), Equals, true)
+	c.Assert(m("alice@example.com"), Equals, false)
+
+	m, _ = parseMatcher("glob:*@?.example.org")
+	c.Assert(m("alice@a.example.org"), Equals, true)
+	c.Assert(m("alice@ab.example.org"), Equals, false)
+	c.Assert(m("alice@aXexample.org"), Equals, false)
+
+	m, _ = parseMatcher("regex:^[a-c]+@example\\.org$")
+	c.Assert(m("abc@example.org"), Equals, true)
+	c.Assert(m("abd@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_parseMatcher_treatsUnknownKindsAsExactMatches(c *C) {
+	m, e := parseMatcher("xmpp:alice@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(m("xmpp:alice@example.org"), Equals, true)
+	c.Assert(m("alice@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_parseMatcher_returnsErrorForInvalidRegex(c *C) {
+	_, e := parseMatcher("regex:(abc")
+	c.Assert(e, ErrorMatches, "invalid matcher \"regex:\\(abc\": .*")
+}
+
+func (s *GenericServerSuite) Test_NewMatcher_usesTheSameDescriptorsAsPolicies(c *C) {
+	m, e := NewMatcher("suffix:@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(m("alice@example.org"), Equals, true)
+	c.Assert(m("alice@example.com"), Equals, false)
+
+	_, e = NewMatcher("regex:(abc")
+	c.Assert(e, ErrorMatches, "invalid matcher \"regex:\\(abc\": .*")
+}
+
+func (s *GenericServerSuite) Test_NewRulePolicy_returnsErrorsForInvalidDescriptions(c *C) {
+	_, e := NewRulePolicy(&PolicyDescription{Default: "maybe"})
+	c.Assert(e, ErrorMatches, "invalid default: unknown action \"maybe\"")
+
+	_, e = NewRulePolicy(&PolicyDescription{Rules: []PolicyRuleDescription{
+		{Action: "allow"},
+		{Action: "perhaps"},
+	}})
+	c.Assert(e, ErrorMatches, "invalid rule 2: unknown action \"perhaps\"")
+
+	_, e = NewRulePolicy(&PolicyDescription{Rules: []PolicyRuleDescription{
+		{Action: "allow", Messages: []string{"dake2"}},
+	}})
+	c.Assert(e, ErrorMatches, "invalid rule 1: unknown message kind \"dake2\"")
+
+	_, e = NewRulePolicy(&PolicyDescription{Rules: []PolicyRuleDescription{
+		{Action: "deny", From: "regex:["},
+	}})
+	c.Assert(e, ErrorMatches, "invalid rule 1: invalid matcher .*")
+
+	_, e = NewRulePolicy(&PolicyDescription{Rules: []PolicyRuleDescription{
+		{Action: "deny", Target: "regex:["},
+	}})
+	c.Assert(e, ErrorMatches, "invalid rule 1: invalid matcher .*")
+}
+
+func (s *GenericServerSuite) Test_RulePolicy_Check_allowsEverythingWithoutRules(c *C) {
+	p, e := NewRulePolicy(&PolicyDescription{})
+	c.Assert(e, IsNil)
+	c.Assert(p.Check("alice@example.org", MessageDAKE1, "alice@example.org"), IsNil)
+}
+
+func (s *GenericServerSuite) Test_RulePolicy_Check_usesTheDefaultWhenNothingMatches(c *C) {
+	p, _ := NewRulePolicy(&PolicyDescription{Default: "deny", Reason: "go away"})
+	c.Assert(p.Check("alice@example.org", MessageDAKE1, "alice@example.org"), ErrorMatches, "denied by policy: go away")
+}
+
+func (s *GenericServerSuite) Test_RulePolicy_Check_firstMatchingRuleDecides(c *C) {
+	p, e := LoadPolicyFrom(strings.NewReader(`{
+  "Default": "deny",
+  "Rules": [
+    {"Action": "deny", "From": "exact:mallory@example.org", "Reason": "mallory is banned"},
+    {"Action": "allow", "Messages": ["ensemble-retrieval"]},
+    {"Action": "allow", "From": "suffix:@example.org"},
+    {"Action": "deny", "Reason": "publication is only allowed for example.org"}
+  ]
+}`))
+	c.Assert(e, IsNil)
+
+	c.Assert(p.Check("bob@example.com", MessageEnsembleRetrieval, "alice@example.org"), IsNil)
+	c.Assert(p.Check("bob@example.com", MessageDAKE1, "bob@example.com"), ErrorMatches, "denied by policy: publication is only allowed for example.org")
+	c.Assert(p.Check("alice@example.org", MessageDAKE1, "alice@example.org"), IsNil)
+	c.Assert(p.Check("alice@example.org", MessagePublication, "alice@example.org"), IsNil)
+	c.Assert(p.Check("mallory@example.org", MessageEnsembleRetrieval, "alice@example.org"), ErrorMatches, "denied by policy: mallory is banned")
+}
+
+func (s *GenericServerSuite) Test_RulePolicy_Check_canMatchOnTheTarget(c *C) {
+	p, _ := NewRulePolicy(&PolicyDescription{Rules: []PolicyRuleDescription{
+		{Action: "deny", Messages: []string{"ensemble-retrieval"}, Target: "suffix:@internal.example.org", Reason: "internal identities are hidden"},
+	}})
+
+	c.Assert(p.Check("bob@example.com", MessageEnsembleRetrieval, "alice@internal.example.org"), ErrorMatches, "denied by policy: internal identities are hidden")
+	c.Assert(p.Check("bob@example.com", MessageEnsembleRetrieval, "alice@example.org"), IsNil)
+}
+
+func (s *GenericServerSuite) Test_LoadPolicyFrom_returnsJSONErrors(c *C) {
+	_, e := LoadPolicyFrom(strings.NewReader(`{"Rules": `))
+	c.Assert(e, ErrorMatches, "unexpected EOF")
+}
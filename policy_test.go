@@ -0,0 +1,46 @@
+package prekeyserver
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (s *GenericServerSuite) Test_PolicyError_Error_includesTheReason(c *C) {
+	c.Assert((&PolicyError{}).Error(), Equals, "denied by policy")
+	c.Assert((&PolicyError{Reason: "only for locals"}).Error(), Equals, "denied by policy: only for locals")
+}
+
+func (s *GenericServerSuite) Test_messageKindFor_returnsTheKindForAllHandledMessages(c *C) {
+	k, ok := messageKindFor(messageTypeDAKE1)
+	c.Assert(ok, Equals, true)
+	c.Assert(k, Equals, MessageDAKE1)
+
+	k, _ = messageKindFor(messageTypeDAKE3)
+	c.Assert(k, Equals, MessageDAKE3)
+
+	k, _ = messageKindFor(messageTypePublication)
+	c.Assert(k, Equals, MessagePublication)
+
+	k, _ = messageKindFor(messageTypeStorageInformationRequest)
+	c.Assert(k, Equals, MessageStorageInformation)
+
+	k, _ = messageKindFor(messageTypeEnsembleRetrievalQuery)
+	c.Assert(k, Equals, MessageEnsembleRetrieval)
+
+	_, ok = messageKindFor(messageTypeDAKE2)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *GenericServerSuite) Test_policyTargetFor_returnsTheQueriedIdentityForRetrievals(c *C) {
+	c.Assert(policyTargetFor("rama@example.org", &ensembleRetrievalQueryMessage{identity: "sita@example.org"}), Equals, "sita@example.org")
+	c.Assert(policyTargetFor("rama@example.org", &dake1Message{}), Equals, "rama@example.org")
+}
+
+func (s *GenericServerSuite) Test_Restrictor_Check_onlyRestrictsDAKEMessages(c *C) {
+	r := Restrictor(func(string) bool { return true })
+	c.Assert(r.Check("foo", MessageDAKE1, "foo"), Equals, errRestricted)
+	c.Assert(r.Check("foo", MessageDAKE3, "foo"), Equals, errRestricted)
+	c.Assert(r.Check("foo", MessagePublication, "foo"), IsNil)
+	c.Assert(r.Check("foo", MessageEnsembleRetrieval, "bar"), IsNil)
+
+	c.Assert(Restrictor(nullRestrictor).Check("foo", MessageDAKE1, "foo"), IsNil)
+}
@@ -0,0 +1,211 @@
+package prekeyserver
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Design:
+// - the DAKE sessions and the fragments can be shared by replicas through the same kind of
+//   key-value server as the Redis storage. The descriptor looks like
+//   redis:address=HOST:PORT[,db=0][,prefix=otrng-prekey-state][,password-file=/PATH/FILE][,timeout=5s]
+// - the keys use the SHA-256 hash of the sender, or of the sender and the fragmented message, in
+//   upper case hex. With the default prefix they are:
+//   - otrng-prekey-state:session:{HASH}      the serialized session, expiring with it
+//   - otrng-prekey-state:sessions            a sorted set of the session hashes, scored by when they expire
+//   - otrng-prekey-state:fragments:{HASH}    a hash with the total and the pieces received, by index
+//   - otrng-prekey-state:pending             a sorted set of the fragment hashes, scored by when they expire
+//   The sorted sets are only used for counting, and expired entries are removed before counting
+// - two replicas can get the last two pieces of a message at the same time, and both see it
+//   complete. Only the one whose DEL removes the pieces handles the message
+
+const (
+	defaultRedisStatePrefix = "otrng-prekey-state"
+	fragmentTotalField      = "total"
+)
+
+// StateStore is a SessionStore and a FragmentStore
+type StateStore interface {
+	SessionStore
+	FragmentStore
+}
+
+// LoadStateStore creates the store the descriptor names, to give to ShareState. The descriptor
+// is either in-process, for an InProcessStore, or the redis: descriptor described above
+func LoadStateStore(desc string) (StateStore, error) {
+	if desc == "in-process" {
+		return NewInProcessStore(), nil
+	}
+	if !isRedisStorageDescriptor(desc) {
+		return nil, errors.New("unknown shared state store")
+	}
+	opts, e := parseStorageOptions(strings.TrimPrefix(desc, redisStoragePrefix), "address", "db", "prefix", "password-file", "timeout")
+	if e != nil {
+		return nil, e
+	}
+	c, e := createRespClientFrom(opts)
+	if e != nil {
+		return nil, e
+	}
+	prefix := defaultRedisStatePrefix
+	if v, ok := opts["prefix"]; ok {
+		prefix = v
+	}
+	return &redisStateStore{c: c, prefix: prefix}, nil
+}
+
+type redisStateStore struct {
+	c      *respClient
+	prefix string
+}
+
+func (rs *redisStateStore) sessionKey(hash string) string {
+	return rs.prefix + ":session:{" + hash + "}"
+}
+
+func (rs *redisStateStore) sessionsKey() string {
+	return rs.prefix + ":sessions"
+}
+
+func (rs *redisStateStore) fragmentsKey(hash string) string {
+	return rs.prefix + ":fragments:{" + hash + "}"
+}
+
+func (rs *redisStateStore) pendingKey() string {
+	return rs.prefix + ":pending"
+}
+
+// millis returns the timeout in milliseconds, at least one since the server doesn't take less
+func millis(timeout time.Duration) string {
+	ms := int64(timeout / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// count removes the expired entries of the sorted set, and returns how many are left
+func (rs *redisStateStore) count(key string) (int, error) {
+	replies, e := rs.c.pipeline(
+		[]string{"ZREMRANGEBYSCORE", key, "-inf", unixMillis(time.Now())},
+		[]string{"ZCARD", key},
+	)
+	if e = firstError(replies, e); e != nil {
+		return 0, e
+	}
+	return int(replies[1].num), nil
+}
+
+// LoadSession implements the SessionStore interface
+func (rs *redisStateStore) LoadSession(from string) ([]byte, error) {
+	r, e := rs.c.do("GET", rs.sessionKey(identityHash(from)))
+	if e != nil {
+		return nil, e
+	}
+	d, _ := r.bytes()
+	return d, nil
+}
+
+// SaveSession implements the SessionStore interface
+func (rs *redisStateStore) SaveSession(from string, session []byte, timeout time.Duration) error {
+	hash := identityHash(from)
+	return firstError(rs.c.pipeline(
+		[]string{"SET", rs.sessionKey(hash), string(session), "PX", millis(timeout)},
+		[]string{"ZADD", rs.sessionsKey(), unixMillis(time.Now().Add(timeout)), hash},
+	))
+}
+
+// DeleteSession implements the SessionStore interface
+func (rs *redisStateStore) DeleteSession(from string) error {
+	hash := identityHash(from)
+	return firstError(rs.c.pipeline(
+		[]string{"DEL", rs.sessionKey(hash)},
+		[]string{"ZREM", rs.sessionsKey(), hash},
+	))
+}
+
+// CountSessions implements the SessionStore interface
+func (rs *redisStateStore) CountSessions() (int, error) {
+	return rs.count(rs.sessionsKey())
+}
+
+// AddFragment implements the FragmentStore interface
+func (rs *redisStateStore) AddFragment(key string, index, total uint16, piece string, timeout time.Duration) ([]string, error) {
+	if index == 0 || index > total {
+		return nil, errors.New("invalid fragment index")
+	}
+	hash := identityHash(key)
+	k := rs.fragmentsKey(hash)
+	t := strconv.Itoa(int(total))
+
+	replies, e := rs.c.pipeline(
+		[]string{"HSETNX", k, fragmentTotalField, t},
+		[]string{"HGET", k, fragmentTotalField},
+	)
+	if e = firstError(replies, e); e != nil {
+		return nil, e
+	}
+	if replies[1].str != t {
+		return nil, errors.New("inconsistent total")
+	}
+
+	replies, e = rs.c.pipeline(
+		[]string{"HSETNX", k, strconv.Itoa(int(index)), piece},
+		[]string{"HLEN", k},
+		[]string{"PEXPIRE", k, millis(timeout)},
+		[]string{"ZADD", rs.pendingKey(), unixMillis(time.Now().Add(timeout)), hash},
+	)
+	if e = firstError(replies, e); e != nil {
+		return nil, e
+	}
+	if replies[1].num <= int64(total) {
+		return nil, nil
+	}
+
+	replies, e = rs.c.pipeline(
+		[]string{"HGETALL", k},
+		[]string{"DEL", k},
+		[]string{"ZREM", rs.pendingKey(), hash},
+	)
+	if e = firstError(replies, e); e != nil {
+		return nil, e
+	}
+	if replies[1].num == 0 {
+		return nil, nil
+	}
+	return fragmentPieces(replies[0].strings(), total)
+}
+
+// fragmentPieces puts the pieces from the field and value pairs of the hash in order
+func fragmentPieces(fields []string, total uint16) ([]string, error) {
+	indexes := []int{}
+	pieces := map[int]string{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == fragmentTotalField {
+			continue
+		}
+		ix, e := strconv.Atoi(fields[i])
+		if e != nil || ix < 1 || ix > int(total) {
+			return nil, errors.New("the stored fragments are corrupted")
+		}
+		indexes = append(indexes, ix)
+		pieces[ix] = fields[i+1]
+	}
+	if len(indexes) != int(total) {
+		return nil, errors.New("the stored fragments are corrupted")
+	}
+	sort.Ints(indexes)
+	result := []string{}
+	for _, ix := range indexes {
+		result = append(result, pieces[ix])
+	}
+	return result, nil
+}
+
+// CountPending implements the FragmentStore interface
+func (rs *redisStateStore) CountPending() (int, error) {
+	return rs.count(rs.pendingKey())
+}
@@ -0,0 +1,150 @@
+package prekeyserver
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func redisStateStoreFor(c *C, kv *respStandIn) *redisStateStore {
+	st, e := LoadStateStore(kv.descriptor())
+	c.Assert(e, IsNil)
+	return st.(*redisStateStore)
+}
+
+func (s *GenericServerSuite) Test_LoadStateStore_checksTheDescriptor(c *C) {
+	st, e := LoadStateStore("in-process")
+	c.Assert(e, IsNil)
+	c.Assert(st, FitsTypeOf, &InProcessStore{})
+
+	st, e = LoadStateStore("redis:address=localhost:6379,db=2")
+	c.Assert(e, IsNil)
+	rs := st.(*redisStateStore)
+	c.Assert(rs.prefix, Equals, "otrng-prekey-state")
+	c.Assert([]interface{}{rs.c.network, rs.c.address, rs.c.db}, DeepEquals, []interface{}{"tcp", "localhost:6379", 2})
+	st, _ = LoadStateStore("redis:address=/run/redis/redis.sock,prefix=state")
+	rs = st.(*redisStateStore)
+	c.Assert(rs.c.network, Equals, "unix")
+	c.Assert(rs.sessionKey(identityHash("sita@example.org")), Equals, "state:session:{"+identityHash("sita@example.org")+"}")
+
+	_, e = LoadStateStore("dir:/tmp")
+	c.Assert(e, ErrorMatches, "unknown shared state store")
+	_, e = LoadStateStore("redis:")
+	c.Assert(e, ErrorMatches, "the address of the key-value server has to be given, like redis:address=HOST:PORT")
+	_, e = LoadStateStore("redis:address=localhost:6379,entries=10")
+	c.Assert(e, ErrorMatches, `unknown storage option "entries"`)
+}
+
+func (s *GenericServerSuite) Test_redisStateStore_letsTwoServersHandleEveryMessageOfAFlow(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	f := CreateFactory(nil)
+	kp := f.CreateKeypair()
+	st, e := f.LoadStorageType("dir:" + c.MkDir())
+	c.Assert(e, IsNil)
+	// every server gets its own connections to the store, like replicas in different processes
+	lb := &roundRobinServer{}
+	for i := 0; i < 2; i++ {
+		gs := f.NewServer("prekeys.example.org", kp, 0, st, time.Minute, time.Minute, nil).(*GenericServer)
+		store := redisStateStoreFor(c, kv)
+		defer store.c.close()
+		var sharer StateSharer = gs
+		sharer.ShareState(store, store)
+		lb.replicas = append(lb.replicas, gs)
+	}
+
+	sita := createTestClient("sita@example.org", lb)
+	sita.FragmentLength = 200
+	c.Assert(sita.Publish(&Publication{
+		ClientProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyMessages:      3,
+	}), IsNil)
+	num, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(num, Equals, uint32(3))
+
+	rama := createTestClient("rama@example.org", lb)
+	rama.FragmentLength = 200
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+
+	store := redisStateStoreFor(c, kv)
+	defer store.c.close()
+	count, e := store.CountSessions()
+	c.Assert(e, IsNil)
+	c.Assert(count, Equals, 1)
+	count, e = store.CountPending()
+	c.Assert(e, IsNil)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_redisStateStore_expiresSessions(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	store := redisStateStoreFor(c, kv)
+	defer store.c.close()
+
+	c.Assert(store.SaveSession("sita@example.org", []byte("one"), time.Minute), IsNil)
+	c.Assert(store.SaveSession("rama@example.org", []byte("two"), time.Millisecond), IsNil)
+	time.Sleep(5 * time.Millisecond)
+
+	d, e := store.LoadSession("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(string(d), Equals, "one")
+	d, e = store.LoadSession("rama@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(d, IsNil)
+	n, _ := store.CountSessions()
+	c.Assert(n, Equals, 1)
+	c.Assert(store.DeleteSession("sita@example.org"), IsNil)
+	n, _ = store.CountSessions()
+	c.Assert(n, Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_redisStateStore_putsFragmentsTogetherOnce(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	store := redisStateStoreFor(c, kv)
+	defer store.c.close()
+
+	p, e := store.AddFragment("sita@example.org/1", 2, 3, "b", time.Minute)
+	c.Assert(e, IsNil)
+	c.Assert(p, IsNil)
+	store.AddFragment("sita@example.org/1", 2, 3, "x", time.Minute)
+	store.AddFragment("sita@example.org/1", 3, 3, "c", time.Minute)
+	n, _ := store.CountPending()
+	c.Assert(n, Equals, 1)
+
+	_, e = store.AddFragment("sita@example.org/1", 1, 4, "a", time.Minute)
+	c.Assert(e, ErrorMatches, "inconsistent total")
+	_, e = store.AddFragment("sita@example.org/1", 4, 3, "a", time.Minute)
+	c.Assert(e, ErrorMatches, "invalid fragment index")
+
+	p, e = store.AddFragment("sita@example.org/1", 1, 3, "a", time.Minute)
+	c.Assert(e, IsNil)
+	c.Assert(p, DeepEquals, []string{"a", "b", "c"})
+	n, _ = store.CountPending()
+	c.Assert(n, Equals, 0)
+
+	// the pieces are gone, so the same piece again starts a new message
+	p, _ = store.AddFragment("sita@example.org/1", 1, 3, "a", time.Minute)
+	c.Assert(p, IsNil)
+
+	store.AddFragment("sita@example.org/2", 1, 2, "a", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	p, _ = store.AddFragment("sita@example.org/2", 2, 2, "b", time.Millisecond)
+	c.Assert(p, IsNil)
+}
+
+func (s *GenericServerSuite) Test_fragmentPieces_rejectsCorruptedFragments(c *C) {
+	p, e := fragmentPieces([]string{"2", "b", "total", "2", "1", "a"}, 2)
+	c.Assert(e, IsNil)
+	c.Assert(p, DeepEquals, []string{"a", "b"})
+
+	_, e = fragmentPieces([]string{"2", "b", "total", "2"}, 2)
+	c.Assert(e, ErrorMatches, "the stored fragments are corrupted")
+	_, e = fragmentPieces([]string{"3", "b", "1", "a"}, 2)
+	c.Assert(e, ErrorMatches, "the stored fragments are corrupted")
+}
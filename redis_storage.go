@@ -0,0 +1,554 @@
+package prekeyserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/otrv4/gotrx"
+)
+
+// Design:
+// - a storage in a Redis-protocol key-value server, so several servers on different hosts can
+//   share it without a shared file system. The descriptor looks like
+//   redis:address=HOST:PORT[,db=0][,prefix=otrng-prekeys][,password-file=/PATH/FILE][,timeout=5s]
+//   and the address can also be the path of a Unix domain socket
+// - like the directory storage, only the SHA-256 hash of an identity is kept, in upper case hex.
+//   The keys are, with the default prefix:
+//   - otrng-prekeys:identities                    a set of the hashes of the identities with anything stored
+//   - otrng-prekeys:{HASH}:tags                   a set of the instance tags of the identity, as 8 hex digits
+//   - otrng-prekeys:{HASH}:1234ABCD:cp            the serialized client profile for the instance tag
+//   - otrng-prekeys:{HASH}:1234ABCD:pp            the serialized prekey profile for the instance tag
+//   - otrng-prekeys:{HASH}:1234ABCD:pm            a list of the serialized prekey messages for the instance tag
+//   The braces make a Redis cluster keep all the keys of an identity on the same node
+// - the profiles expire at the time they expire, and the prekey messages when the later of
+//   the profiles of their instance tag expires, so the server removes them by itself. Prekey
+//   messages stored before any profile don't expire until a profile is stored. Cleaning up only
+//   removes the instance tags and identities that have nothing left from the sets
+// - a retrieval pops one prekey message from the left of each list, so two retrievals can
+//   never get the same one. The profiles for all the instance tags are read with one round
+//   trip, and the prekey messages are popped with another
+
+const (
+	redisStoragePrefix   = "redis:"
+	defaultRedisPrefix   = "otrng-prekeys"
+	defaultRedisTimeout  = 5 * time.Second
+	redisProbeExpiration = 10 * time.Second
+)
+
+func isRedisStorageDescriptor(desc string) bool {
+	return strings.HasPrefix(desc, redisStoragePrefix)
+}
+
+// redisStorageFactory creates the storage once, so every server using it shares the connections
+type redisStorageFactory struct {
+	st *redisStorage
+}
+
+func readPasswordFile(name string) (string, error) {
+	d, e := ioutil.ReadFile(name)
+	if e != nil {
+		return "", fmt.Errorf("couldn't read the password file: %v", e)
+	}
+	p := strings.TrimSpace(string(d))
+	if p == "" {
+		return "", errors.New("the password file is empty")
+	}
+	return p, nil
+}
+
+func createRedisStorageFactoryFrom(desc string) (Storage, error) {
+	opts, e := parseStorageOptions(strings.TrimPrefix(desc, redisStoragePrefix), "address", "db", "prefix", "password-file", "timeout")
+	if e != nil {
+		return nil, e
+	}
+	c, e := createRespClientFrom(opts)
+	if e != nil {
+		return nil, e
+	}
+	prefix := defaultRedisPrefix
+	if v, ok := opts["prefix"]; ok {
+		prefix = v
+	}
+	return &redisStorageFactory{st: &redisStorage{c: c, prefix: prefix}}, nil
+}
+
+// createRespClientFrom creates a client for the address, db, password-file and timeout options
+func createRespClientFrom(opts map[string]string) (*respClient, error) {
+	var e error
+	c := &respClient{network: "tcp", timeout: defaultRedisTimeout}
+	address, ok := opts["address"]
+	if !ok {
+		return nil, errors.New("the address of the key-value server has to be given, like redis:address=HOST:PORT")
+	}
+	c.address = address
+	if strings.HasPrefix(address, "/") {
+		c.network = "unix"
+	} else if _, _, e := net.SplitHostPort(address); e != nil {
+		return nil, fmt.Errorf("invalid key-value server address %q, expected HOST:PORT or /PATH", address)
+	}
+	if v, ok := opts["db"]; ok {
+		if c.db, e = strconv.Atoi(v); e != nil || c.db < 0 {
+			return nil, fmt.Errorf("invalid database number %q", v)
+		}
+	}
+	if v, ok := opts["timeout"]; ok {
+		if c.timeout, e = time.ParseDuration(v); e != nil || c.timeout <= 0 {
+			return nil, fmt.Errorf("invalid key-value server timeout %q", v)
+		}
+	}
+	if v, ok := opts["password-file"]; ok {
+		if c.password, e = readPasswordFile(v); e != nil {
+			return nil, e
+		}
+	}
+	return c, nil
+}
+
+func (rsf *redisStorageFactory) createStorage() storage {
+	return rsf.st
+}
+
+type redisStorage struct {
+	c      *respClient
+	prefix string
+}
+
+func (rs *redisStorage) identitiesKey() string {
+	return rs.prefix + ":identities"
+}
+
+func (rs *redisStorage) tagsKey(hash string) string {
+	return rs.prefix + ":{" + hash + "}:tags"
+}
+
+func (rs *redisStorage) itemKey(hash string, itag uint32, kind string) string {
+	return rs.prefix + ":{" + hash + "}:" + formatUint32(itag) + ":" + kind
+}
+
+func unixMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// firstError returns the error of the pipeline, or the first error reply
+func firstError(replies []*respReply, e error) error {
+	if e != nil {
+		return e
+	}
+	for _, r := range replies {
+		if e := r.err(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// storeProfile stores a profile until it expires, and makes the prekey messages of the instance
+// tag live at least as long
+func (rs *redisStorage) storeProfile(hash string, itag uint32, kind string, data []byte, expiration time.Time) error {
+	key := rs.itemKey(hash, itag, kind)
+	pms := rs.itemKey(hash, itag, "pm")
+	replies, e := rs.c.pipeline(
+		[]string{"SET", key, string(data)},
+		[]string{"PEXPIREAT", key, unixMillis(expiration)},
+		[]string{"SADD", rs.tagsKey(hash), formatUint32(itag)},
+		[]string{"SADD", rs.identitiesKey(), hash},
+		[]string{"PTTL", pms},
+	)
+	if e := firstError(replies, e); e != nil {
+		return e
+	}
+	ttl := replies[4].num
+	if ttl == -1 || (ttl >= 0 && time.Now().Add(time.Duration(ttl)*time.Millisecond).Before(expiration)) {
+		_, e = rs.c.do("PEXPIREAT", pms, unixMillis(expiration))
+	}
+	return e
+}
+
+func (rs *redisStorage) storeClientProfile(from string, cp *gotrx.ClientProfile) error {
+	if cp == nil {
+		return nil
+	}
+	return rs.storeProfile(identityHash(from), cp.InstanceTag, "cp", cp.Serialize(), cp.Expiration)
+}
+
+func (rs *redisStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	if pp == nil {
+		return nil
+	}
+	return rs.storeProfile(identityHash(from), pp.instanceTag, "pp", pp.serialize(), pp.expiration)
+}
+
+func (rs *redisStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	return rs.storePrekeyMessagesForHash(identityHash(from), pms)
+}
+
+// storePrekeyMessagesForHash appends the prekey messages to the lists of their instance tags,
+// which expire with the later of the profiles stored for the instance tag
+func (rs *redisStorage) storePrekeyMessagesForHash(hash string, pms []*prekeyMessage) error {
+	if len(pms) == 0 {
+		return nil
+	}
+	byTag := map[uint32][]string{}
+	tags := []uint32{}
+	for _, pm := range pms {
+		if _, ok := byTag[pm.instanceTag]; !ok {
+			tags = append(tags, pm.instanceTag)
+		}
+		byTag[pm.instanceTag] = append(byTag[pm.instanceTag], string(pm.serialize()))
+	}
+
+	cmds := [][]string{{"SADD", rs.identitiesKey(), hash}}
+	for _, itag := range tags {
+		cmds = append(cmds,
+			append([]string{"RPUSH", rs.itemKey(hash, itag, "pm")}, byTag[itag]...),
+			[]string{"SADD", rs.tagsKey(hash), formatUint32(itag)},
+			[]string{"PTTL", rs.itemKey(hash, itag, "cp")},
+			[]string{"PTTL", rs.itemKey(hash, itag, "pp")},
+		)
+	}
+	replies, e := rs.c.pipeline(cmds...)
+	if e := firstError(replies, e); e != nil {
+		return e
+	}
+
+	expire := [][]string{}
+	for ix, itag := range tags {
+		ttl := replies[1+ix*4+2].num
+		if pp := replies[1+ix*4+3].num; pp > ttl {
+			ttl = pp
+		}
+		if ttl > 0 {
+			expire = append(expire, []string{"PEXPIRE", rs.itemKey(hash, itag, "pm"), strconv.FormatInt(ttl, 10)})
+		}
+	}
+	if len(expire) == 0 {
+		return nil
+	}
+	return firstError(rs.c.pipeline(expire...))
+}
+
+func (rs *redisStorage) numberStored(from string, itag uint32) uint32 {
+	r, e := rs.c.do("LLEN", rs.itemKey(identityHash(from), itag, "pm"))
+	if e != nil {
+		return 0
+	}
+	return uint32(r.num)
+}
+
+// instanceTagsOf returns the instance tags in the set of the identity
+func (rs *redisStorage) instanceTagsOf(hash string) ([]uint32, error) {
+	r, e := rs.c.do("SMEMBERS", rs.tagsKey(hash))
+	if e != nil {
+		return nil, e
+	}
+	result := []uint32{}
+	for _, t := range r.strings() {
+		if itag, e := strconv.ParseUint(t, 16, 32); e == nil && isUint32Hex(t) {
+			result = append(result, uint32(itag))
+		}
+	}
+	return result, nil
+}
+
+// readProfiles reads the profiles of the instance tags with one round trip, leaving out the ones that can't be read
+func (rs *redisStorage) readProfiles(hash string, tags []uint32) ([]*storedInstanceTag, error) {
+	cmds := [][]string{}
+	for _, itag := range tags {
+		cmds = append(cmds,
+			[]string{"GET", rs.itemKey(hash, itag, "cp")},
+			[]string{"GET", rs.itemKey(hash, itag, "pp")},
+			[]string{"LLEN", rs.itemKey(hash, itag, "pm")},
+		)
+	}
+	replies, e := rs.c.pipeline(cmds...)
+	if e := firstError(replies, e); e != nil {
+		return nil, e
+	}
+
+	result := []*storedInstanceTag{}
+	for ix, itag := range tags {
+		st := &storedInstanceTag{tag: itag, prekeyMessages: int(replies[ix*3+2].num)}
+		if d, ok := replies[ix*3].bytes(); ok {
+			cp := &gotrx.ClientProfile{}
+			if _, ok := cp.Deserialize(d); ok {
+				st.cp = cp
+			}
+		}
+		if d, ok := replies[ix*3+1].bytes(); ok {
+			pp := &prekeyProfile{}
+			if _, ok := pp.deserialize(d); ok {
+				st.pp = pp
+			}
+		}
+		result = append(result, st)
+	}
+	return result, nil
+}
+
+func (rs *redisStorage) retrieveFor(from string) []*prekeyEnsemble {
+	hash := identityHash(from)
+	tags, e := rs.instanceTagsOf(hash)
+	if e != nil || len(tags) == 0 {
+		return nil
+	}
+	sts, e := rs.readProfiles(hash, tags)
+	if e != nil {
+		return nil
+	}
+
+	complete := []*storedInstanceTag{}
+	cmds := [][]string{}
+	for _, st := range sts {
+		if st.cp != nil && st.pp != nil && st.prekeyMessages > 0 {
+			complete = append(complete, st)
+			cmds = append(cmds, []string{"LPOP", rs.itemKey(hash, st.tag, "pm")})
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	replies, e := rs.c.pipeline(cmds...)
+	if e != nil {
+		return nil
+	}
+
+	entries := []*prekeyEnsemble{}
+	for ix, st := range complete {
+		d, ok := replies[ix].bytes()
+		if !ok {
+			continue
+		}
+		pm := &prekeyMessage{}
+		if _, ok := pm.deserialize(d); ok {
+			entries = append(entries, &prekeyEnsemble{cp: st.cp, pp: st.pp, pm: pm})
+		}
+	}
+	return entries
+}
+
+// cleanup removes the instance tags with nothing left from the sets, and the identities
+// without instance tags. Everything else expires by itself
+func (rs *redisStorage) cleanup() {
+	ids, e := rs.c.do("SMEMBERS", rs.identitiesKey())
+	if e != nil {
+		return
+	}
+	for _, hash := range ids.strings() {
+		rs.cleanupIdentity(hash)
+	}
+}
+
+func (rs *redisStorage) cleanupIdentity(hash string) {
+	tags, e := rs.instanceTagsOf(hash)
+	if e != nil {
+		return
+	}
+	cmds := [][]string{}
+	for _, itag := range tags {
+		cmds = append(cmds, []string{"EXISTS", rs.itemKey(hash, itag, "cp"), rs.itemKey(hash, itag, "pp"), rs.itemKey(hash, itag, "pm")})
+	}
+	replies, e := rs.c.pipeline(cmds...)
+	if firstError(replies, e) != nil {
+		return
+	}
+	empty := []string{"SREM", rs.tagsKey(hash)}
+	for ix, itag := range tags {
+		if replies[ix].num == 0 {
+			empty = append(empty, formatUint32(itag))
+		}
+	}
+	if len(empty) > 2 {
+		rs.c.do(empty...)
+	}
+	if len(empty)-2 == len(tags) {
+		rs.c.do("SREM", rs.identitiesKey(), hash)
+	}
+}
+
+// probe writes a probe entry that expires by itself, reads it back and removes it
+func (rs *redisStorage) probe() error {
+	key := fmt.Sprintf("%s:probe:%016X", rs.prefix, rand.Uint64())
+	value := key
+	replies, e := rs.c.pipeline(
+		[]string{"SET", key, value},
+		[]string{"PEXPIRE", key, strconv.FormatInt(int64(redisProbeExpiration/time.Millisecond), 10)},
+		[]string{"GET", key},
+		[]string{"DEL", key},
+	)
+	if e := firstError(replies, e); e != nil {
+		return e
+	}
+	if d, _ := replies[2].bytes(); string(d) != value {
+		return errors.New("the probe entry read back is not the one written")
+	}
+	return nil
+}
+
+func (rs *redisStorage) close() error {
+	return rs.c.close()
+}
+
+// listIdentities can only return the hashes, since the identities themselves are not stored
+func (rs *redisStorage) listIdentities() ([]*StoredIdentity, error) {
+	r, e := rs.c.do("SMEMBERS", rs.identitiesKey())
+	if e != nil {
+		return nil, e
+	}
+	result := []*StoredIdentity{}
+	for _, hash := range r.strings() {
+		result = append(result, &StoredIdentity{Hash: hash})
+	}
+	return result, nil
+}
+
+func (rs *redisStorage) instanceTagsFor(id *StoredIdentity) ([]*storedInstanceTag, error) {
+	tags, e := rs.instanceTagsOf(id.Hash)
+	if e != nil || len(tags) == 0 {
+		return nil, e
+	}
+	sts, e := rs.readProfiles(id.Hash, tags)
+	if e != nil {
+		return nil, e
+	}
+	result := storedInstanceTags{}
+	for _, st := range sts {
+		if st.cp != nil || st.pp != nil || st.prekeyMessages > 0 {
+			result[st.tag] = st
+		}
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return result.sorted(), nil
+}
+
+// purge reads what is there before removing it, to count it. Something stored in between is removed without being counted
+func (rs *redisStorage) purge(id *StoredIdentity, itag uint32) (*StoredCounts, error) {
+	tags := []uint32{itag}
+	if itag == allInstanceTags {
+		var e error
+		if tags, e = rs.instanceTagsOf(id.Hash); e != nil {
+			return nil, e
+		}
+	}
+	removed := &StoredCounts{}
+	if len(tags) == 0 {
+		return removed, nil
+	}
+	sts, e := rs.readProfiles(id.Hash, tags)
+	if e != nil {
+		return nil, e
+	}
+
+	del := []string{"DEL"}
+	srem := []string{"SREM", rs.tagsKey(id.Hash)}
+	for _, st := range sts {
+		removed.add(st)
+		del = append(del, rs.itemKey(id.Hash, st.tag, "cp"), rs.itemKey(id.Hash, st.tag, "pp"), rs.itemKey(id.Hash, st.tag, "pm"))
+		srem = append(srem, formatUint32(st.tag))
+	}
+	cmds := [][]string{del, srem}
+	if itag == allInstanceTags {
+		cmds = append(cmds, []string{"DEL", rs.tagsKey(id.Hash)}, []string{"SREM", rs.identitiesKey(), id.Hash})
+	}
+	if e := firstError(rs.c.pipeline(cmds...)); e != nil {
+		return nil, e
+	}
+	return removed, nil
+}
+
+// itemsFor reads everything stored for the identity
+func (rs *redisStorage) itemsFor(id *StoredIdentity) ([]*storedItem, error) {
+	tags, e := rs.instanceTagsOf(id.Hash)
+	if e != nil || len(tags) == 0 {
+		return nil, e
+	}
+	sts, e := rs.readProfiles(id.Hash, tags)
+	if e != nil {
+		return nil, e
+	}
+	cmds := [][]string{}
+	for _, itag := range tags {
+		cmds = append(cmds, []string{"LRANGE", rs.itemKey(id.Hash, itag, "pm"), "0", "-1"})
+	}
+	replies, e := rs.c.pipeline(cmds...)
+	if e := firstError(replies, e); e != nil {
+		return nil, e
+	}
+
+	result := []*storedItem{}
+	for ix, st := range sts {
+		if st.cp != nil {
+			result = append(result, &storedItem{id: id, cp: st.cp})
+		}
+		if st.pp != nil {
+			result = append(result, &storedItem{id: id, pp: st.pp})
+		}
+		for _, d := range replies[ix].strings() {
+			pm := &prekeyMessage{}
+			if _, ok := pm.deserialize([]byte(d)); ok {
+				result = append(result, &storedItem{id: id, pm: pm})
+			}
+		}
+	}
+	return result, nil
+}
+
+// exportItems reads one identity at a time
+func (rs *redisStorage) exportItems(f func(*storedItem) error) error {
+	ids, e := rs.listIdentities()
+	if e != nil {
+		return e
+	}
+	for _, id := range ids {
+		items, e := rs.itemsFor(id)
+		if e != nil {
+			return e
+		}
+		for _, it := range items {
+			if e := f(it); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// hasPrekeyMessage checks whether the list of the instance tag has a prekey message with the identifier
+func (rs *redisStorage) hasPrekeyMessage(hash string, pm *prekeyMessage) (bool, error) {
+	r, e := rs.c.do("LRANGE", rs.itemKey(hash, pm.instanceTag, "pm"), "0", "-1")
+	if e != nil {
+		return false, e
+	}
+	for _, d := range r.strings() {
+		existing := &prekeyMessage{}
+		if _, ok := existing.deserialize([]byte(d)); ok && existing.identifier == pm.identifier {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// importItem only needs the hash of the identity, since that is all the storage keeps. Like the
+// directory storage, importing a prekey message twice doesn't duplicate it
+func (rs *redisStorage) importItem(it *storedItem) error {
+	switch {
+	case it.cp != nil:
+		return rs.storeProfile(it.id.Hash, it.cp.InstanceTag, "cp", it.cp.Serialize(), it.cp.Expiration)
+	case it.pp != nil:
+		return rs.storeProfile(it.id.Hash, it.pp.instanceTag, "pp", it.pp.serialize(), it.pp.expiration)
+	case it.pm != nil:
+		found, e := rs.hasPrekeyMessage(it.id.Hash, it.pm)
+		if e != nil || found {
+			return e
+		}
+		return rs.storePrekeyMessagesForHash(it.id.Hash, []*prekeyMessage{it.pm})
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func redisStorageFor(c *C, kv *respStandIn) *redisStorage {
+	st, e := CreateFactory(nil).LoadStorageType(kv.descriptor())
+	c.Assert(e, IsNil)
+	return st.createStorage().(*redisStorage)
+}
+
+// pttl returns how long the stand-in keeps the key, like PTTL does
+func (s *respStandIn) pttl(key string) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	if s.lookup("0/"+key) == nil {
+		return -2
+	}
+	exp, ok := s.expires["0/"+key]
+	if !ok {
+		return -1
+	}
+	return time.Until(exp)
+}
+
+func (s *GenericServerSuite) Test_LoadStorageType_checksTheRedisOptions(c *C) {
+	f := CreateFactory(nil)
+	password := filepath.Join(c.MkDir(), "password")
+	ioutil.WriteFile(password, []byte("a secret\n"), 0600)
+
+	st, e := f.LoadStorageType("redis:address=localhost:6379")
+	c.Assert(e, IsNil)
+	rs := st.createStorage().(*redisStorage)
+	c.Assert(st.createStorage(), Equals, rs)
+	c.Assert(rs.prefix, Equals, "otrng-prekeys")
+	c.Assert([]interface{}{rs.c.network, rs.c.address, rs.c.db, rs.c.password, rs.c.timeout}, DeepEquals, []interface{}{"tcp", "localhost:6379", 0, "", 5 * time.Second})
+
+	st, e = f.LoadStorageType("redis:address=/run/redis/redis.sock,db=3,prefix=prekeys,timeout=1s,password-file=" + password)
+	c.Assert(e, IsNil)
+	rs = st.createStorage().(*redisStorage)
+	c.Assert(rs.prefix, Equals, "prekeys")
+	c.Assert([]interface{}{rs.c.network, rs.c.address, rs.c.db, rs.c.password, rs.c.timeout}, DeepEquals, []interface{}{"unix", "/run/redis/redis.sock", 3, "a secret", time.Second})
+	c.Assert(rs.itemKey(identityHash("sita@example.org"), 0x1245ABCD, "pm"), Equals, "prekeys:{"+identityHash("sita@example.org")+"}:1245ABCD:pm")
+
+	_, e = f.LoadStorageType("redis:")
+	c.Assert(e, ErrorMatches, "the address of the key-value server has to be given, like redis:address=HOST:PORT")
+	_, e = f.LoadStorageType("redis:address=localhost")
+	c.Assert(e, ErrorMatches, `invalid key-value server address "localhost", expected HOST:PORT or /PATH`)
+	_, e = f.LoadStorageType("redis:address=localhost:6379,db=-1")
+	c.Assert(e, ErrorMatches, `invalid database number "-1"`)
+	_, e = f.LoadStorageType("redis:address=localhost:6379,timeout=0s")
+	c.Assert(e, ErrorMatches, `invalid key-value server timeout "0s"`)
+	_, e = f.LoadStorageType("redis:address=localhost:6379,password-file=" + password + ".missing")
+	c.Assert(e, ErrorMatches, "couldn't read the password file: .*")
+	ioutil.WriteFile(password, []byte("\n"), 0600)
+	_, e = f.LoadStorageType("redis:address=localhost:6379,password-file=" + password)
+	c.Assert(e, ErrorMatches, "the password file is empty")
+	_, e = f.LoadStorageType("redis:address=localhost:6379,user=sita")
+	c.Assert(e, ErrorMatches, `unknown storage option "user"`)
+}
+
+func (s *GenericServerSuite) Test_redisStorage_servesPublicationsAndRetrievals(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	server, sita, sita2 := createAdminTestServer(c, kv.descriptor())
+	c.Assert(server.storageImpl.probe(), IsNil)
+
+	num, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(num, Equals, uint32(3))
+	num, _ = sita2.StorageStatus()
+	c.Assert(num, Equals, uint32(2))
+
+	rama := createTestClient("rama@example.org", server)
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+	c.Assert(ens[0].PrekeyMessage.InstanceTag, Equals, sita.Keys.InstanceTag)
+	num, _ = sita.StorageStatus()
+	c.Assert(num, Equals, uint32(2))
+	c.Assert(server.Close(), IsNil)
+}
+
+func (s *GenericServerSuite) Test_redisStorage_retrievesWithThreeRoundTrips(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	rs := redisStorageFor(c, kv)
+	defer rs.close()
+	for i := 0; i < 4; i++ {
+		sita := createTestClient("sita@example.org", nil)
+		pp, _ := generatePrekeyProfile(sita, sita.Keys.InstanceTag, time.Now().Add(time.Hour), sita.Keys.LongTerm)
+		pm, _, _, _ := generatePrekeyMessage(sita, sita.Keys.InstanceTag)
+		c.Assert(rs.storeClientProfile("sita@example.org", sita.clientProfile(time.Now().Add(time.Hour))), IsNil)
+		c.Assert(rs.storePrekeyProfile("sita@example.org", pp), IsNil)
+		c.Assert(rs.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm}), IsNil)
+	}
+
+	before := kv.currentRoundTrips()
+	c.Assert(rs.retrieveFor("sita@example.org"), HasLen, 4)
+	c.Assert(kv.currentRoundTrips()-before, Equals, 3)
+	c.Assert(rs.retrieveFor("sita@example.org"), HasLen, 0)
+	c.Assert(rs.retrieveFor("rama@example.org"), HasLen, 0)
+}
+
+func (s *GenericServerSuite) Test_redisStorage_popsEveryPrekeyMessageOnlyOnce(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	server, _, _ := createAdminTestServer(c, kv.descriptor())
+	rs := server.storageImpl.(*redisStorage)
+	defer rs.close()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	seen := map[uint32]int{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, pe := range rs.retrieveFor("sita@example.org") {
+				lock.Lock()
+				seen[pe.pm.identifier]++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(seen, HasLen, 3)
+	for _, n := range seen {
+		c.Assert(n, Equals, 1)
+	}
+}
+
+func (s *GenericServerSuite) Test_redisStorage_letsThePrekeyMessagesExpireWithTheLaterProfile(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	rs := redisStorageFor(c, kv)
+	defer rs.close()
+	sita := createTestClient("sita@example.org", nil)
+	itag := sita.Keys.InstanceTag
+	hash := identityHash("sita@example.org")
+	pm, _, _, _ := generatePrekeyMessage(sita, itag)
+
+	c.Assert(rs.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm}), IsNil)
+	c.Assert(kv.pttl(rs.itemKey(hash, itag, "pm")), Equals, time.Duration(-1))
+
+	c.Assert(rs.storeClientProfile("sita@example.org", sita.clientProfile(time.Now().Add(time.Hour))), IsNil)
+	cpTTL := kv.pttl(rs.itemKey(hash, itag, "cp"))
+	c.Assert(cpTTL > 59*time.Minute && cpTTL <= time.Hour, Equals, true)
+	c.Assert(kv.pttl(rs.itemKey(hash, itag, "pm")) > 59*time.Minute, Equals, true)
+
+	pp, _ := generatePrekeyProfile(sita, itag, time.Now().Add(2*time.Hour), sita.Keys.LongTerm)
+	c.Assert(rs.storePrekeyProfile("sita@example.org", pp), IsNil)
+	c.Assert(kv.pttl(rs.itemKey(hash, itag, "pm")) > 119*time.Minute, Equals, true)
+
+	// a profile expiring earlier doesn't shorten it, and prekey messages stored later get it too
+	c.Assert(rs.storeClientProfile("sita@example.org", sita.clientProfile(time.Now().Add(time.Minute))), IsNil)
+	c.Assert(kv.pttl(rs.itemKey(hash, itag, "pm")) > 119*time.Minute, Equals, true)
+	other := createTestClient("sita@example.org", nil)
+	pp2, _ := generatePrekeyProfile(sita, other.Keys.InstanceTag, time.Now().Add(time.Second), other.Keys.LongTerm)
+	c.Assert(rs.storePrekeyProfile("sita@example.org", pp2), IsNil)
+	pm2, _, _, _ := generatePrekeyMessage(sita, other.Keys.InstanceTag)
+	pm3, _, _, _ := generatePrekeyMessage(sita, itag)
+	c.Assert(rs.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm2, pm3}), IsNil)
+	c.Assert(kv.pttl(rs.itemKey(hash, other.Keys.InstanceTag, "pm")) <= time.Second, Equals, true)
+	c.Assert(kv.pttl(rs.itemKey(hash, itag, "pm")) > 119*time.Minute, Equals, true)
+	c.Assert(rs.numberStored("sita@example.org", itag), Equals, uint32(2))
+
+	time.Sleep(time.Second)
+	rs.cleanup()
+	tags, _ := rs.instanceTagsOf(hash)
+	c.Assert(tags, DeepEquals, []uint32{itag})
+
+	c.Assert(rs.storeClientProfile("rama@example.org", createTestClient("rama@example.org", nil).clientProfile(time.Now().Add(-time.Minute))), IsNil)
+	rs.cleanup()
+	ids, _ := rs.listIdentities()
+	c.Assert(ids, DeepEquals, []*StoredIdentity{{Hash: hash}})
+}
+
+func (s *GenericServerSuite) Test_redisStorage_canBeMigratedToWithoutDuplicates(c *C) {
+	kv := startRespStandIn(c)
+	defer kv.close()
+	server, _, _ := createAdminTestServer(c, "in-memory")
+	from, _ := server.Admin(nil)
+	var audit bytes.Buffer
+	_, to := createTestAdmin(c, kv.descriptor(), &audit)
+
+	tc, e := Migrate(from, to)
+	c.Assert(e, IsNil)
+	c.Assert(tc.Copied, DeepEquals, StoredCounts{ClientProfiles: 2, PrekeyProfiles: 2, PrekeyMessages: 8})
+	_, e = Migrate(from, to)
+	c.Assert(e, IsNil)
+	t1, _ := from.Totals()
+	t2, _ := to.Totals()
+	c.Assert(t2, DeepEquals, t1)
+
+	var export bytes.Buffer
+	_, e = to.Export(&export)
+	c.Assert(e, IsNil)
+	c.Assert(bytes.Count(export.Bytes(), []byte(`"type":"prekey-message"`)), Equals, 8)
+}
+
+func (s *GenericServerSuite) Test_redisStorage_reportsWhenTheServerCantBeUsed(c *C) {
+	kv := startRespStandIn(c)
+	rs := redisStorageFor(c, kv)
+	kv.requirePassword("a secret")
+	c.Assert(rs.probe(), ErrorMatches, "NOAUTH Authentication required.")
+	c.Assert(rs.c.idle, HasLen, 1)
+	kv.close()
+
+	// the idle connection fails first, and after that the server can't be reached
+	sita := createTestClient("sita@example.org", nil)
+	c.Assert(rs.probe(), NotNil)
+	c.Assert(rs.c.idle, HasLen, 0)
+	c.Assert(rs.probe(), ErrorMatches, ".*connection refused")
+	c.Assert(rs.storeClientProfile("sita@example.org", sita.clientProfile(time.Now().Add(time.Hour))), ErrorMatches, ".*connection refused")
+	c.Assert(rs.numberStored("sita@example.org", sita.Keys.InstanceTag), Equals, uint32(0))
+	c.Assert(rs.retrieveFor("sita@example.org"), IsNil)
+	_, e := rs.listIdentities()
+	c.Assert(e, ErrorMatches, ".*connection refused")
+	rs.cleanup()
+
+	c.Assert(rs.close(), IsNil)
+	c.Assert(rs.probe(), Equals, errStorageClosed)
+}
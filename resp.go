@@ -0,0 +1,263 @@
+package prekeyserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is a small client for the protocol Redis and compatible key-value servers speak (RESP).
+// Commands are sent as arrays of bulk strings, and every command gets one reply:
+// - +OK\r\n is a simple string
+// - -ERR message\r\n is an error, which only fails that command
+// - :42\r\n is an integer
+// - $5\r\nvalue\r\n is a bulk string, and $-1\r\n means there is no value
+// - *2\r\n followed by two replies is an array, and *-1\r\n means there is none
+// Several commands can be written before reading any replies, which saves a round trip for
+// each command after the first. The replies come back in the order the commands were sent.
+
+const maxIdleRespConnections = 8
+
+type respReply struct {
+	kind  byte
+	str   string
+	num   int64
+	null  bool
+	array []*respReply
+}
+
+// respError is an error reply from the server
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+func (r *respReply) err() error {
+	if r.kind == '-' {
+		return respError(r.str)
+	}
+	return nil
+}
+
+// bytes returns the value of a bulk string, or false if there is none
+func (r *respReply) bytes() ([]byte, bool) {
+	if r.kind != '$' || r.null {
+		return nil, false
+	}
+	return []byte(r.str), true
+}
+
+func (r *respReply) strings() []string {
+	result := []string{}
+	for _, a := range r.array {
+		result = append(result, a.str)
+	}
+	return result
+}
+
+type respConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func writeRespCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+func readRespLine(r *bufio.Reader) (string, error) {
+	l, e := r.ReadString('\n')
+	if e != nil {
+		return "", e
+	}
+	if !strings.HasSuffix(l, "\r\n") {
+		return "", errors.New("invalid reply from the key-value server")
+	}
+	return l[:len(l)-2], nil
+}
+
+func readRespReply(r *bufio.Reader) (*respReply, error) {
+	l, e := readRespLine(r)
+	if e != nil {
+		return nil, e
+	}
+	if l == "" {
+		return nil, errors.New("invalid reply from the key-value server")
+	}
+	reply := &respReply{kind: l[0]}
+	switch reply.kind {
+	case '+', '-':
+		reply.str = l[1:]
+	case ':':
+		if reply.num, e = strconv.ParseInt(l[1:], 10, 64); e != nil {
+			return nil, errors.New("invalid integer from the key-value server")
+		}
+	case '$':
+		n, e := strconv.Atoi(l[1:])
+		if e != nil {
+			return nil, errors.New("invalid bulk string length from the key-value server")
+		}
+		if n < 0 {
+			reply.null = true
+			return reply, nil
+		}
+		d := make([]byte, n+2)
+		if _, e := io.ReadFull(r, d); e != nil {
+			return nil, e
+		}
+		reply.str = string(d[:n])
+	case '*':
+		n, e := strconv.Atoi(l[1:])
+		if e != nil {
+			return nil, errors.New("invalid array length from the key-value server")
+		}
+		if n < 0 {
+			reply.null = true
+			return reply, nil
+		}
+		for i := 0; i < n; i++ {
+			a, e := readRespReply(r)
+			if e != nil {
+				return nil, e
+			}
+			reply.array = append(reply.array, a)
+		}
+	default:
+		return nil, fmt.Errorf("unknown reply type %q from the key-value server", reply.kind)
+	}
+	return reply, nil
+}
+
+// respClient keeps a few idle connections around, so most commands don't have to connect first
+type respClient struct {
+	network  string
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+
+	idle   []*respConn
+	closed bool
+	sync.Mutex
+}
+
+func (c *respClient) connect() (*respConn, error) {
+	nc, e := net.DialTimeout(c.network, c.address, c.timeout)
+	if e != nil {
+		return nil, e
+	}
+	conn := &respConn{c: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	setup := [][]string{}
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		replies, e := conn.exchange(setup, c.timeout)
+		if e == nil {
+			for _, r := range replies {
+				if e = r.err(); e != nil {
+					break
+				}
+			}
+		}
+		if e != nil {
+			nc.Close()
+			return nil, e
+		}
+	}
+	return conn, nil
+}
+
+func (rc *respConn) exchange(cmds [][]string, timeout time.Duration) ([]*respReply, error) {
+	rc.c.SetDeadline(time.Now().Add(timeout))
+	for _, cmd := range cmds {
+		writeRespCommand(rc.w, cmd)
+	}
+	if e := rc.w.Flush(); e != nil {
+		return nil, e
+	}
+	result := []*respReply{}
+	for range cmds {
+		r, e := readRespReply(rc.r)
+		if e != nil {
+			return nil, e
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func (c *respClient) get() (*respConn, error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil, errStorageClosed
+	}
+	if l := len(c.idle); l > 0 {
+		conn := c.idle[l-1]
+		c.idle = c.idle[:l-1]
+		c.Unlock()
+		return conn, nil
+	}
+	c.Unlock()
+	return c.connect()
+}
+
+func (c *respClient) put(conn *respConn) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed || len(c.idle) >= maxIdleRespConnections {
+		conn.c.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// pipeline sends all the commands before reading the replies. Error replies are returned
+// as replies, so only a failing connection makes the whole pipeline fail
+func (c *respClient) pipeline(cmds ...[]string) ([]*respReply, error) {
+	conn, e := c.get()
+	if e != nil {
+		return nil, e
+	}
+	replies, e := conn.exchange(cmds, c.timeout)
+	if e != nil {
+		conn.c.Close()
+		return nil, e
+	}
+	c.put(conn)
+	return replies, nil
+}
+
+// do sends one command, and returns an error reply as an error
+func (c *respClient) do(cmd ...string) (*respReply, error) {
+	replies, e := c.pipeline(cmd)
+	if e != nil {
+		return nil, e
+	}
+	return replies[0], replies[0].err()
+}
+
+func (c *respClient) close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.c.Close()
+	}
+	c.idle = nil
+	return nil
+}
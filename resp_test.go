@@ -0,0 +1,490 @@
+package prekeyserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// respStandIn is an in-process key-value server speaking the protocol, with the commands the
+// Redis storage and the shared state store use. It keeps strings, lists, sets, hashes and sorted
+// sets, which expire like they do in Redis.
+// Replies are only written when everything sent so far has been read, so roundTrips counts
+// how many times a client had to wait for replies
+type respStandIn struct {
+	l          net.Listener
+	conns      []net.Conn
+	password   string
+	values     map[string]interface{}
+	expires    map[string]time.Time
+	roundTrips int
+	sync.Mutex
+}
+
+func startRespStandIn(c *C) *respStandIn {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(e, IsNil)
+	s := &respStandIn{l: l, values: map[string]interface{}{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			s.Lock()
+			s.conns = append(s.conns, conn)
+			s.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *respStandIn) descriptor() string {
+	return "redis:address=" + s.l.Addr().String()
+}
+
+// close stops the stand-in like a server shutting down, closing the connections too
+func (s *respStandIn) close() {
+	s.l.Close()
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// requirePassword makes new connections log in with the password
+func (s *respStandIn) requirePassword(password string) {
+	s.Lock()
+	defer s.Unlock()
+	s.password = password
+}
+
+func (s *respStandIn) currentRoundTrips() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.roundTrips
+}
+
+func readRespCommand(r *bufio.Reader) ([]string, error) {
+	l, e := readRespLine(r)
+	if e != nil {
+		return nil, e
+	}
+	if !strings.HasPrefix(l, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", l)
+	}
+	n, _ := strconv.Atoi(l[1:])
+	result := []string{}
+	for i := 0; i < n; i++ {
+		a, e := readRespReply(r)
+		if e != nil {
+			return nil, e
+		}
+		result = append(result, a.str)
+	}
+	return result, nil
+}
+
+func (s *respStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	s.Lock()
+	password := s.password
+	s.Unlock()
+	authenticated := password == ""
+	db := "0"
+	for {
+		cmd, e := readRespCommand(r)
+		if e != nil {
+			return
+		}
+		switch {
+		case strings.ToUpper(cmd[0]) == "AUTH":
+			authenticated = len(cmd) == 2 && cmd[1] == password
+			if authenticated {
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		case !authenticated:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		case strings.ToUpper(cmd[0]) == "SELECT":
+			db = cmd[1]
+			w.WriteString("+OK\r\n")
+		default:
+			s.Lock()
+			w.WriteString(s.execute(db, strings.ToUpper(cmd[0]), cmd[1:]))
+			s.Unlock()
+		}
+		if r.Buffered() == 0 {
+			s.Lock()
+			s.roundTrips++
+			s.Unlock()
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func bulk(v string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+}
+
+func array(vs []string) string {
+	result := fmt.Sprintf("*%d\r\n", len(vs))
+	for _, v := range vs {
+		result += bulk(v)
+	}
+	return result
+}
+
+func integer(n int) string {
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+const wrongType = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+// lookup returns the value of the key, removing it if it has expired. It expects the lock to be held
+func (s *respStandIn) lookup(key string) interface{} {
+	if exp, ok := s.expires[key]; ok && !time.Now().Before(exp) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+	return s.values[key]
+}
+
+func (s *respStandIn) remove(key string) bool {
+	existed := s.lookup(key) != nil
+	delete(s.values, key)
+	delete(s.expires, key)
+	return existed
+}
+
+func (s *respStandIn) list(key string) ([]string, bool) {
+	switch v := s.lookup(key).(type) {
+	case nil:
+		return nil, true
+	case []string:
+		return v, true
+	}
+	return nil, false
+}
+
+func (s *respStandIn) set(key string) (map[string]bool, bool) {
+	switch v := s.lookup(key).(type) {
+	case nil:
+		return map[string]bool{}, true
+	case map[string]bool:
+		return v, true
+	}
+	return nil, false
+}
+
+func (s *respStandIn) hash(key string) (map[string]string, bool) {
+	switch v := s.lookup(key).(type) {
+	case nil:
+		return map[string]string{}, true
+	case map[string]string:
+		return v, true
+	}
+	return nil, false
+}
+
+func (s *respStandIn) sortedSet(key string) (map[string]float64, bool) {
+	switch v := s.lookup(key).(type) {
+	case nil:
+		return map[string]float64{}, true
+	case map[string]float64:
+		return v, true
+	}
+	return nil, false
+}
+
+// store keeps the list, set, hash or sorted set, removing the key if it's empty like Redis does
+func (s *respStandIn) store(key string, v interface{}, empty bool) {
+	if empty {
+		s.remove(key)
+		return
+	}
+	s.values[key] = v
+}
+
+func (s *respStandIn) expireAt(key string, t time.Time) string {
+	if s.lookup(key) == nil {
+		return integer(0)
+	}
+	s.expires[key] = t
+	s.lookup(key)
+	return integer(1)
+}
+
+func (s *respStandIn) execute(db, cmd string, args []string) string {
+	key := ""
+	if len(args) > 0 {
+		key = db + "/" + args[0]
+	}
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		s.remove(key)
+		s.values[key] = args[1]
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.ParseInt(args[3], 10, 64)
+			s.expireAt(key, time.Now().Add(time.Duration(ms)*time.Millisecond))
+		}
+		return "+OK\r\n"
+	case "GET":
+		switch v := s.lookup(key).(type) {
+		case nil:
+			return "$-1\r\n"
+		case string:
+			return bulk(v)
+		}
+		return wrongType
+	case "DEL", "EXISTS":
+		count := 0
+		for _, k := range args {
+			if cmd == "DEL" && s.remove(db+"/"+k) || cmd == "EXISTS" && s.lookup(db+"/"+k) != nil {
+				count++
+			}
+		}
+		return integer(count)
+	case "PEXPIRE":
+		ms, _ := strconv.ParseInt(args[1], 10, 64)
+		return s.expireAt(key, time.Now().Add(time.Duration(ms)*time.Millisecond))
+	case "PEXPIREAT":
+		ms, _ := strconv.ParseInt(args[1], 10, 64)
+		return s.expireAt(key, time.Unix(0, ms*int64(time.Millisecond)))
+	case "PTTL":
+		if s.lookup(key) == nil {
+			return integer(-2)
+		}
+		exp, ok := s.expires[key]
+		if !ok {
+			return integer(-1)
+		}
+		return integer(int(time.Until(exp) / time.Millisecond))
+	case "RPUSH":
+		l, ok := s.list(key)
+		if !ok {
+			return wrongType
+		}
+		l = append(l, args[1:]...)
+		s.store(key, l, false)
+		return integer(len(l))
+	case "LPOP":
+		l, ok := s.list(key)
+		if !ok {
+			return wrongType
+		}
+		if len(l) == 0 {
+			return "$-1\r\n"
+		}
+		s.store(key, l[1:], len(l) == 1)
+		return bulk(l[0])
+	case "LLEN":
+		l, ok := s.list(key)
+		if !ok {
+			return wrongType
+		}
+		return integer(len(l))
+	case "LRANGE":
+		l, ok := s.list(key)
+		if !ok {
+			return wrongType
+		}
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		if stop < 0 {
+			stop += len(l)
+		}
+		if start > stop || start >= len(l) {
+			return array(nil)
+		}
+		return array(l[start : stop+1])
+	case "SADD", "SREM":
+		m, ok := s.set(key)
+		if !ok {
+			return wrongType
+		}
+		count := 0
+		for _, v := range args[1:] {
+			if m[v] != (cmd == "SADD") {
+				count++
+			}
+			if cmd == "SADD" {
+				m[v] = true
+			} else {
+				delete(m, v)
+			}
+		}
+		s.store(key, m, len(m) == 0)
+		return integer(count)
+	case "SMEMBERS":
+		m, ok := s.set(key)
+		if !ok {
+			return wrongType
+		}
+		result := []string{}
+		for v := range m {
+			result = append(result, v)
+		}
+		return array(result)
+	case "HSETNX":
+		m, ok := s.hash(key)
+		if !ok {
+			return wrongType
+		}
+		if _, ok := m[args[1]]; ok {
+			return integer(0)
+		}
+		m[args[1]] = args[2]
+		s.store(key, m, false)
+		return integer(1)
+	case "HGET":
+		m, ok := s.hash(key)
+		if !ok {
+			return wrongType
+		}
+		if v, ok := m[args[1]]; ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case "HLEN":
+		m, ok := s.hash(key)
+		if !ok {
+			return wrongType
+		}
+		return integer(len(m))
+	case "HGETALL":
+		m, ok := s.hash(key)
+		if !ok {
+			return wrongType
+		}
+		result := []string{}
+		for f, v := range m {
+			result = append(result, f, v)
+		}
+		return array(result)
+	case "ZADD", "ZREM":
+		m, ok := s.sortedSet(key)
+		if !ok {
+			return wrongType
+		}
+		count := 0
+		for i := 1; i < len(args); i++ {
+			if cmd == "ZREM" {
+				if _, ok := m[args[i]]; ok {
+					count++
+				}
+				delete(m, args[i])
+				continue
+			}
+			score, _ := strconv.ParseFloat(args[i], 64)
+			i++
+			if _, ok := m[args[i]]; !ok {
+				count++
+			}
+			m[args[i]] = score
+		}
+		s.store(key, m, len(m) == 0)
+		return integer(count)
+	case "ZREMRANGEBYSCORE":
+		m, ok := s.sortedSet(key)
+		if !ok {
+			return wrongType
+		}
+		max, _ := strconv.ParseFloat(args[2], 64)
+		count := 0
+		for v, score := range m {
+			if score <= max {
+				delete(m, v)
+				count++
+			}
+		}
+		s.store(key, m, len(m) == 0)
+		return integer(count)
+	case "ZCARD":
+		m, ok := s.sortedSet(key)
+		if !ok {
+			return wrongType
+		}
+		return integer(len(m))
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd)
+}
+
+func (s *GenericServerSuite) Test_respClient_pipelinesCommandsAndReturnsErrorReplies(c *C) {
+	si := startRespStandIn(c)
+	defer si.close()
+	rc := &respClient{network: "tcp", address: si.l.Addr().String(), timeout: time.Second}
+	defer rc.close()
+
+	replies, e := rc.pipeline(
+		[]string{"SET", "one", "a value\r\nwith a line break"},
+		[]string{"GET", "one"},
+		[]string{"GET", "two"},
+		[]string{"RPUSH", "one", "x"},
+		[]string{"SADD", "three", "a", "b"},
+		[]string{"SMEMBERS", "nothing"},
+	)
+	c.Assert(e, IsNil)
+	c.Assert(replies[0].str, Equals, "OK")
+	d, ok := replies[1].bytes()
+	c.Assert(ok, Equals, true)
+	c.Assert(string(d), Equals, "a value\r\nwith a line break")
+	_, ok = replies[2].bytes()
+	c.Assert(ok, Equals, false)
+	c.Assert(replies[3].err(), ErrorMatches, "WRONGTYPE .*")
+	c.Assert(replies[4].num, Equals, int64(2))
+	c.Assert(replies[5].strings(), HasLen, 0)
+	c.Assert(si.currentRoundTrips(), Equals, 1)
+
+	_, e = rc.do("FLUSHALL")
+	c.Assert(e, ErrorMatches, "ERR unknown command 'FLUSHALL'")
+	c.Assert(rc.idle, HasLen, 1)
+	c.Assert(rc.close(), IsNil)
+	_, e = rc.do("PING")
+	c.Assert(e, Equals, errStorageClosed)
+}
+
+func (s *GenericServerSuite) Test_respClient_logsInAndSelectsTheDatabase(c *C) {
+	si := startRespStandIn(c)
+	defer si.close()
+	si.requirePassword("a secret")
+	rc := &respClient{network: "tcp", address: si.l.Addr().String(), timeout: time.Second, db: 2}
+
+	_, e := rc.do("GET", "one")
+	c.Assert(e, ErrorMatches, "NOAUTH Authentication required.")
+	rc.password = "another secret"
+	_, e = rc.do("GET", "one")
+	c.Assert(e, ErrorMatches, "WRONGPASS invalid password")
+	rc.password = "a secret"
+	_, e = rc.do("SET", "one", "two")
+	c.Assert(e, IsNil)
+	si.Lock()
+	defer si.Unlock()
+	c.Assert(si.values["2/one"], Equals, "two")
+}
+
+func (s *GenericServerSuite) Test_readRespReply_rejectsInvalidReplies(c *C) {
+	for _, r := range []string{"+OK\n", "\r\n", ":x\r\n", "$x\r\n", "*x\r\n", "$5\r\nab", "*2\r\n:1\r\n", "!1\r\n"} {
+		_, e := readRespReply(bufio.NewReader(strings.NewReader(r)))
+		c.Assert(e, NotNil, Commentf("%q", r))
+	}
+	reply, e := readRespReply(bufio.NewReader(strings.NewReader("*2\r\n$-1\r\n*-1\r\n")))
+	c.Assert(e, IsNil)
+	c.Assert(reply.array[0].null, Equals, true)
+	c.Assert(reply.array[1].null, Equals, true)
+}
@@ -1,5 +1,7 @@
 package prekeyserver
 
+import "errors"
+
 // Restrictor is a function that will return true if the
 // given from-name is not acceptable to this server.
 // The default will return false for anything, thus allowing all from-names
@@ -8,3 +10,15 @@ type Restrictor func(string) bool
 func nullRestrictor(from string) bool {
 	return false
 }
+
+var errRestricted = errors.New("this from-string is restricted for these kinds of messages")
+
+// Check implements the Policy interface. A Restrictor will only ever
+// restrict DAKE messages, since those are needed for both publication and
+// storage information requests.
+func (r Restrictor) Check(from string, kind MessageKind, target string) error {
+	if (kind == MessageDAKE1 || kind == MessageDAKE3) && r(from) {
+		return errRestricted
+	}
+	return nil
+}
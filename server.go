@@ -20,17 +20,24 @@ type GenericServer struct {
 	// Should be minimum 48, since the max envelope size is 47
 	fragLen        int
 	fragmentations *gotrx.Fragmentor
+	// The fragmentor doesn't tell us how much it's keeping track of, so we count it ourselves
+	pendingFragments fragmentTracker
 
 	messageHandler messageHandler
 
 	rand     io.Reader
 	sessions *sessionManager
 
+	// sharedSessions and sharedFragments are used instead of sessions and fragmentations when set
+	sharedSessions  SessionStore
+	sharedFragments FragmentStore
+
 	storageImpl storage
 
 	sessionTimeout       time.Duration
 	fragmentationTimeout time.Duration
 	rest                 Restrictor
+	policy               Policy
 }
 
 func (g *GenericServer) storage() storage {
@@ -57,7 +64,7 @@ func (g *GenericServer) Handle(from, message string) (returns []string, err erro
 	}
 
 	if g.fragmentations.IsFragment(message) {
-		m, c, e := g.fragmentations.NewFragmentReceived(from, message)
+		m, c, e := g.receiveFragment(from, message)
 		if e != nil {
 			return nil, e
 		}
@@ -93,21 +100,43 @@ func (g *GenericServer) Handle(from, message string) (returns []string, err erro
 func (g *GenericServer) cleanupAfter() {
 	g.sessions.cleanup(g.sessionTimeout)
 	g.fragmentations.Cleanup(g.fragmentationTimeout)
+	g.pendingFragments.cleanup(g.fragmentationTimeout)
 	g.storageImpl.cleanup()
 }
 
+// Close lets the storage finish its work before the process stops - the in-memory storage with
+// a snapshot file writes its last snapshot. The server shouldn't be used after it's closed
+func (g *GenericServer) Close() error {
+	if cs, ok := g.storageImpl.(closableStorage); ok {
+		return cs.close()
+	}
+	return nil
+}
+
 func (g *GenericServer) compositeIdentity() []byte {
 	return append(gotrx.AppendData(nil, []byte(g.identity)), g.key.Pub.Serialize()...)
 }
 
 func (g *GenericServer) session(from string) session {
+	if g.sharedSessions != nil {
+		return g.loadSharedSession(from)
+	}
 	return g.sessions.get(from)
 }
 
+// sessionComplete removes the session. If a shared session can't be removed, it stays until it expires
 func (g *GenericServer) sessionComplete(from string) {
+	if g.sharedSessions != nil {
+		_ = g.sharedSessions.DeleteSession(from)
+		return
+	}
 	g.sessions.complete(from)
 }
 
 func (g *GenericServer) hasSession(from string) bool {
+	if g.sharedSessions != nil {
+		d, e := g.sharedSessions.LoadSession(from)
+		return e == nil && d != nil
+	}
 	return g.sessions.has(from)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type AdminSuite struct {
+	dir  string
+	sita *pks.Client
+}
+
+var _ = Suite(&AdminSuite{})
+
+func hashOf(identity string) string {
+	return fmt.Sprintf("%X", sha256.Sum256([]byte(identity)))
+}
+
+func (s *AdminSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	*storageEngine = "dir:" + s.dir
+	*auditLog = ""
+	*operator = "hanuman"
+	*jsonOutput = false
+
+	f := pks.CreateFactory(nil)
+	st, e := f.LoadStorageType(*storageEngine)
+	c.Assert(e, IsNil)
+	server := f.NewServer("prekeys.example.org", f.CreateKeypair(), 0, st, time.Minute, time.Minute, nil)
+	s.sita = &pks.Client{From: "sita@example.org", Keys: pks.GenerateClientKeys(nil), Server: server}
+	c.Assert(s.sita.Publish(&pks.Publication{
+		ClientProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyMessages:      3,
+	}), IsNil)
+}
+
+func (s *AdminSuite) Test_run_listsAndShowsIdentities(c *C) {
+	var out bytes.Buffer
+	c.Assert(run([]string{"identities"}, &out), IsNil)
+	c.Assert(out.String(), Equals, "hash:"+hashOf("sita@example.org")+"\n")
+
+	out.Reset()
+	c.Assert(run([]string{"show", "sita@example.org"}, &out), IsNil)
+	c.Assert(out.String(), Matches, fmt.Sprintf(`Identity: sita@example.org
+Hash: %s
+Instance tag 0x%08X: 3 prekey messages
+  client profile expires .*Z
+  prekey profile expires .*Z
+`, hashOf("sita@example.org"), s.sita.Keys.InstanceTag))
+
+	out.Reset()
+	c.Assert(run([]string{"show", "hash:" + hashOf("sita@example.org")}, &out), IsNil)
+	c.Assert(out.String(), Matches, "(?s)Hash: [0-9A-F]{64}\nInstance tag .*")
+
+	c.Assert(run([]string{"show", "rama@example.org"}, &out), ErrorMatches, "nothing is stored for the identity")
+}
+
+func (s *AdminSuite) Test_run_printsTotals(c *C) {
+	var out bytes.Buffer
+	c.Assert(run([]string{"totals"}, &out), IsNil)
+	c.Assert(out.String(), Equals, `Identities: 1
+Instance tags: 1
+Client profiles: 1 (0 expired)
+Prekey profiles: 1 (0 expired)
+Prekey messages: 3
+`)
+
+	out.Reset()
+	*jsonOutput = true
+	c.Assert(run([]string{"totals"}, &out), IsNil)
+	c.Assert(out.String(), Equals, `{"identities":1,"instanceTags":1,"clientProfiles":1,"prekeyProfiles":1,"prekeyMessages":3,"expiredClientProfiles":0,"expiredPrekeyProfiles":0}`+"\n")
+}
+
+func (s *AdminSuite) Test_run_purgesAndAudits(c *C) {
+	var out bytes.Buffer
+	c.Assert(run([]string{"purge", "sita@example.org", "0x100"}, &out), IsNil)
+	c.Assert(out.String(), Equals, "Removed 0 client profiles, 0 prekey profiles and 0 prekey messages for instance tag 0x00000100 of sita@example.org\n")
+
+	out.Reset()
+	c.Assert(run([]string{"purge", "sita@example.org"}, &out), IsNil)
+	c.Assert(out.String(), Equals, "Removed 1 client profiles, 1 prekey profiles and 3 prekey messages for sita@example.org\n")
+	num, _ := s.sita.StorageStatus()
+	c.Assert(num, Equals, uint32(0))
+
+	out.Reset()
+	c.Assert(run([]string{"audit"}, &out), IsNil)
+	c.Assert(out.String(), Matches, `.*Z hanuman purge-instance-tag sita@example.org 0x00000100: removed 0 client profiles, 0 prekey profiles and 0 prekey messages
+.*Z hanuman purge-identity sita@example.org: removed 1 client profiles, 1 prekey profiles and 3 prekey messages
+`)
+
+	*auditLog = filepath.Join(s.dir, "other.log")
+	out.Reset()
+	c.Assert(run([]string{"audit"}, &out), IsNil)
+	c.Assert(out.String(), Equals, "")
+}
+
+func (s *AdminSuite) Test_run_refusesInvalidInvocations(c *C) {
+	var out bytes.Buffer
+	c.Assert(run(nil, &out), ErrorMatches, "no command given.*")
+	c.Assert(run([]string{"dance"}, &out), ErrorMatches, `unknown command "dance".*`)
+	c.Assert(run([]string{"show"}, &out), ErrorMatches, "usage: show IDENTITY")
+	c.Assert(run([]string{"purge", "sita@example.org", "0x12"}, &out), ErrorMatches, `"0x12" is not an instance tag`)
+
+	*storageEngine = "in-memory"
+	c.Assert(run([]string{"totals"}, &out), ErrorMatches, "the in-memory storage can't be managed from outside of the server")
+	*storageEngine = "cached:;in-memory"
+	c.Assert(run([]string{"totals"}, &out), ErrorMatches, "the in-memory storage can't be managed from outside of the server")
+	*storageEngine = "cached:;dir:" + s.dir
+	c.Assert(run([]string{"totals"}, &out), IsNil)
+	*storageEngine = ""
+	c.Assert(run([]string{"totals"}, &out), ErrorMatches, "the storage to manage has to be given with -storage")
+	*storageEngine = "dir:" + filepath.Join(s.dir, "missing")
+	c.Assert(run([]string{"totals"}, &out), ErrorMatches, "encountered error when opening the storage: directory doesn't exist")
+
+	*storageEngine = "dir:" + s.dir
+	c.Assert(run([]string{"migrate", "redis:address=127.0.0.1:6379"}, &out), ErrorMatches, "the audit log for redis:address=127.0.0.1:6379 has to be given with -audit-log")
+	*storageEngine = "redis:address=127.0.0.1:6379"
+	c.Assert(run([]string{"purge", "sita@example.org"}, &out), ErrorMatches, "the audit log for redis:address=127.0.0.1:6379 has to be given with -audit-log")
+	c.Assert(run([]string{"audit"}, &out), ErrorMatches, "the audit log for redis:address=127.0.0.1:6379 has to be given with -audit-log")
+}
+
+func (s *AdminSuite) Test_run_exportsAndImports(c *C) {
+	file := filepath.Join(c.MkDir(), "export.jsonl")
+	var out bytes.Buffer
+	c.Assert(run([]string{"export", file}, &out), IsNil)
+	c.Assert(out.String(), Equals, "Exported to "+file+": 1 client profiles, 1 prekey profiles and 3 prekey messages\nSkipped as expired: 0 client profiles, 0 prekey profiles and 0 prekey messages\n")
+	c.Assert(run([]string{"export", file}, &out), ErrorMatches, ".*file exists")
+
+	*storageEngine = "dir:" + c.MkDir()
+	out.Reset()
+	c.Assert(run([]string{"import", file}, &out), IsNil)
+	c.Assert(out.String(), Matches, "Imported from .*: 1 client profiles, 1 prekey profiles and 3 prekey messages\n.*\n")
+
+	out.Reset()
+	c.Assert(run([]string{"totals"}, &out), IsNil)
+	c.Assert(out.String(), Matches, "(?s).*Prekey messages: 3\n")
+
+	out.Reset()
+	c.Assert(run([]string{"audit"}, &out), IsNil)
+	c.Assert(out.String(), Matches, ".*Z hanuman import: stored 1 client profiles, 1 prekey profiles and 3 prekey messages\n")
+
+	c.Assert(run([]string{"import", filepath.Join(s.dir, "missing")}, &out), ErrorMatches, ".*no such file or directory")
+}
+
+func (s *AdminSuite) Test_run_migratesToAnotherStorage(c *C) {
+	dest := c.MkDir()
+	var out bytes.Buffer
+	c.Assert(run([]string{"migrate", "dir:" + dest}, &out), IsNil)
+	c.Assert(out.String(), Equals, "Migrated to dir:"+dest+": 1 client profiles, 1 prekey profiles and 3 prekey messages\nSkipped as expired: 0 client profiles, 0 prekey profiles and 0 prekey messages\n")
+
+	*storageEngine = "dir:" + dest
+	out.Reset()
+	c.Assert(run([]string{"show", "sita@example.org"}, &out), IsNil)
+	c.Assert(out.String(), Matches, "(?s).*: 3 prekey messages\n.*")
+	out.Reset()
+	c.Assert(run([]string{"audit"}, &out), IsNil)
+	c.Assert(out.String(), Matches, ".*Z hanuman migrate: stored .*\n")
+
+	c.Assert(run([]string{"migrate", "in-memory"}, &out), ErrorMatches, "the in-memory storage can't be managed from outside of the server")
+}
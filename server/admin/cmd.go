@@ -0,0 +1,14 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// These flags represent all the available command line flags
+var (
+	storageEngine = flag.String("storage", "", "The storage to manage, 'dir:/PATH/HERE', 'redis:address=HOST:PORT[,db=0][,prefix=otrng-prekeys][,password-file=/PATH/FILE]' 'sharded:key-file=/PATH/FILE;STORAGE;STORAGE...' or 'cached:;STORAGE'. The in-memory storage only exists inside a running server")
+	auditLog      = flag.String("audit-log", "", "File every change is appended to. Empty means audit.log in the storage directory - for migrate, in the destination. Has to be given for Redis, sharded and cached storages")
+	operator      = flag.String("operator", os.Getenv("USER"), "The name written to the audit log as the one making the changes")
+	jsonOutput    = flag.Bool("json", false, "Print the results as JSON, instead of as text")
+)
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// result is what a command prints, as text or as JSON
+type result interface {
+	text(w io.Writer)
+}
+
+type command struct {
+	name        string
+	args        string
+	description string
+	minArgs     int
+	maxArgs     int
+	changes     bool
+	run         func(a *pks.Admin, args []string) (result, error)
+}
+
+var commands = []*command{
+	{"identities", "", "List the identities with stored data", 0, 0, false, runIdentities},
+	{"show", "IDENTITY", "Show the prekey messages left and the profile expiries for every instance tag of an identity", 1, 1, false, runShow},
+	{"totals", "", "Count everything in the storage", 0, 0, false, runTotals},
+	{"purge", "IDENTITY [INSTANCE-TAG]", "Remove everything stored for an identity, or only for one of its instance tags", 1, 2, true, runPurge},
+	{"audit", "", "Print the changes in the audit log", 0, 0, false, runAudit},
+	{"export", "FILE", "Write everything that hasn't expired to a new file", 1, 1, false, runExport},
+	{"import", "FILE", "Store what hasn't expired from an export", 1, 1, true, runImport},
+	{"migrate", "DESTINATION", "Copy everything that hasn't expired to another storage, like dir:/PATH, and check the result", 1, 1, false, runMigrate},
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// describeIdentity returns the identity, or the hash in the form the commands accept if the identity is unknown
+func describeIdentity(identity, hash string) string {
+	if identity != "" {
+		return identity
+	}
+	return "hash:" + hash
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+type identitiesResult struct {
+	Identities []*pks.StoredIdentity `json:"identities"`
+}
+
+func (r *identitiesResult) text(w io.Writer) {
+	for _, id := range r.Identities {
+		fmt.Fprintf(w, "%s\n", describeIdentity(id.Identity, id.Hash))
+	}
+}
+
+func runIdentities(a *pks.Admin, _ []string) (result, error) {
+	ids, e := a.Identities()
+	if e != nil {
+		return nil, e
+	}
+	return &identitiesResult{Identities: ids}, nil
+}
+
+type showResult struct {
+	*pks.IdentityInfo
+}
+
+func printExpiry(w io.Writer, what string, expires *time.Time, expired bool) {
+	switch {
+	case expires == nil:
+		fmt.Fprintf(w, "  no %s\n", what)
+	case expired:
+		fmt.Fprintf(w, "  %s expired %s\n", what, formatTime(*expires))
+	default:
+		fmt.Fprintf(w, "  %s expires %s\n", what, formatTime(*expires))
+	}
+}
+
+func (r *showResult) text(w io.Writer) {
+	if r.Identity != "" {
+		fmt.Fprintf(w, "Identity: %s\n", r.Identity)
+	}
+	fmt.Fprintf(w, "Hash: %s\n", r.Hash)
+	for _, it := range r.InstanceTags {
+		fmt.Fprintf(w, "Instance tag 0x%08X: %d prekey messages\n", it.InstanceTag, it.PrekeyMessages)
+		printExpiry(w, "client profile", it.ClientProfileExpires, it.ClientProfileExpired)
+		printExpiry(w, "prekey profile", it.PrekeyProfileExpires, it.PrekeyProfileExpired)
+	}
+}
+
+func runShow(a *pks.Admin, args []string) (result, error) {
+	info, e := a.Show(args[0])
+	if e != nil {
+		return nil, e
+	}
+	return &showResult{info}, nil
+}
+
+type totalsResult struct {
+	*pks.Totals
+}
+
+func (r *totalsResult) text(w io.Writer) {
+	fmt.Fprintf(w, "Identities: %d\n", r.Identities)
+	fmt.Fprintf(w, "Instance tags: %d\n", r.InstanceTags)
+	fmt.Fprintf(w, "Client profiles: %d (%d expired)\n", r.ClientProfiles, r.ExpiredClientProfiles)
+	fmt.Fprintf(w, "Prekey profiles: %d (%d expired)\n", r.PrekeyProfiles, r.ExpiredPrekeyProfiles)
+	fmt.Fprintf(w, "Prekey messages: %d\n", r.PrekeyMessages)
+}
+
+func runTotals(a *pks.Admin, _ []string) (result, error) {
+	t, e := a.Totals()
+	if e != nil {
+		return nil, e
+	}
+	return &totalsResult{t}, nil
+}
+
+func formatRemoved(c *pks.StoredCounts) string {
+	return fmt.Sprintf("%d client profiles, %d prekey profiles and %d prekey messages", c.ClientProfiles, c.PrekeyProfiles, c.PrekeyMessages)
+}
+
+type purgeResult struct {
+	Identity    string            `json:"identity"`
+	InstanceTag uint32            `json:"instanceTag,omitempty"`
+	Removed     *pks.StoredCounts `json:"removed"`
+}
+
+func (r *purgeResult) text(w io.Writer) {
+	if r.InstanceTag != 0 {
+		fmt.Fprintf(w, "Removed %s for instance tag 0x%08X of %s\n", formatRemoved(r.Removed), r.InstanceTag, r.Identity)
+		return
+	}
+	fmt.Fprintf(w, "Removed %s for %s\n", formatRemoved(r.Removed), r.Identity)
+}
+
+func parseInstanceTag(s string) (uint32, error) {
+	v, e := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 32)
+	if e != nil || v < 0x100 {
+		return 0, fmt.Errorf("%q is not an instance tag", s)
+	}
+	return uint32(v), nil
+}
+
+func runPurge(a *pks.Admin, args []string) (result, error) {
+	r := &purgeResult{Identity: args[0]}
+	var e error
+	if len(args) == 2 {
+		if r.InstanceTag, e = parseInstanceTag(args[1]); e != nil {
+			return nil, e
+		}
+		r.Removed, e = a.PurgeInstanceTag(args[0], r.InstanceTag)
+	} else {
+		r.Removed, e = a.PurgeIdentity(args[0])
+	}
+	if e != nil {
+		return nil, e
+	}
+	return r, nil
+}
+
+type auditResult struct {
+	Entries []*pks.AuditEntry `json:"entries"`
+}
+
+func (r *auditResult) text(w io.Writer) {
+	for _, en := range r.Entries {
+		op := en.Operator
+		if op == "" {
+			op = "-"
+		}
+		fmt.Fprintf(w, "%s %s %s", formatTime(en.Time), op, en.Action)
+		if en.Hash != "" {
+			fmt.Fprintf(w, " %s", describeIdentity(en.Identity, en.Hash))
+		}
+		if en.InstanceTag != 0 {
+			fmt.Fprintf(w, " 0x%08X", en.InstanceTag)
+		}
+		if en.Imported != nil {
+			fmt.Fprintf(w, ": stored %s", formatRemoved(en.Imported))
+		}
+		if en.Removed != nil {
+			fmt.Fprintf(w, ": removed %s", formatRemoved(en.Removed))
+		}
+		if en.Error != "" {
+			fmt.Fprintf(w, ": failed: %s", en.Error)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+func runAudit(_ *pks.Admin, _ []string) (result, error) {
+	if auditLogFile() == "" {
+		return nil, errNoAuditLog(*storageEngine)
+	}
+	f, e := os.Open(auditLogFile())
+	if os.IsNotExist(e) {
+		return &auditResult{Entries: []*pks.AuditEntry{}}, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	entries, e := pks.ReadAuditLog(f)
+	if e != nil {
+		return nil, e
+	}
+	return &auditResult{Entries: entries}, nil
+}
+
+type transferResult struct {
+	Action string `json:"action"`
+	File   string `json:"file"`
+	*pks.TransferCounts
+}
+
+func (r *transferResult) text(w io.Writer) {
+	fmt.Fprintf(w, "%s %s: %s\n", r.Action, r.File, formatRemoved(&r.Copied))
+	fmt.Fprintf(w, "Skipped as expired: %s\n", formatRemoved(&r.Expired))
+}
+
+func runExport(a *pks.Admin, args []string) (result, error) {
+	f, e := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		return nil, e
+	}
+	tc, e := a.Export(f)
+	if ce := f.Close(); e == nil {
+		e = ce
+	}
+	if e != nil {
+		os.Remove(args[0])
+		return nil, e
+	}
+	return &transferResult{"Exported to", args[0], tc}, nil
+}
+
+func runImport(a *pks.Admin, args []string) (result, error) {
+	f, e := os.Open(args[0])
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	tc, e := a.Import(f)
+	if tc == nil {
+		return nil, e
+	}
+	return &transferResult{"Imported from", args[0], tc}, e
+}
+
+func runMigrate(from *pks.Admin, args []string) (result, error) {
+	auditFile := *auditLog
+	if auditFile == "" {
+		auditFile = defaultAuditLog(args[0])
+	}
+	if e := checkManageable(args[0]); e != nil {
+		return nil, e
+	}
+	if auditFile == "" {
+		return nil, errNoAuditLog(args[0])
+	}
+	to, audit, e := openAdmin(args[0], auditFile)
+	if e != nil {
+		return nil, e
+	}
+	defer audit.Close()
+	tc, e := pks.Migrate(from, to)
+	if tc == nil {
+		return nil, e
+	}
+	return &transferResult{"Migrated to", args[0], tc}, e
+}
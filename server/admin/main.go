@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// prekey-admin lets operators see and manage what a prekey server has stored, without reading
+// the files of the storage by hand. It works on the storage directly, so it can be used while
+// the server is running. The directory and Redis storages only keep hashes of the identities, so they
+// are listed as hash:HEX - which can be given to the other commands instead of the identity.
+// Every change is appended to an audit log. The storage can also be exported to a file, imported
+// from one, or migrated to another storage directly.
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s -storage dir:/PATH|redis:address=HOST:PORT [flags] command [arguments]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-32s %s\n", c.name+" "+c.args, c.description)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if e := run(flag.Args(), os.Stdout); e != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", e)
+		os.Exit(1)
+	}
+}
+
+func printResult(out io.Writer, r result) {
+	if *jsonOutput {
+		d, _ := json.Marshal(r)
+		fmt.Fprintf(out, "%s\n", d)
+		return
+	}
+	r.text(out)
+}
+
+// defaultAuditLog is the audit log of a directory storage when none is given. Other storages
+// have no directory to put it in, so it has to be given for them
+func defaultAuditLog(storage string) string {
+	if !strings.HasPrefix(storage, "dir:") {
+		return ""
+	}
+	return filepath.Join(strings.TrimPrefix(storage, "dir:"), "audit.log")
+}
+
+func errNoAuditLog(storage string) error {
+	return fmt.Errorf("the audit log for %s has to be given with -audit-log", storage)
+}
+
+func auditLogFile() string {
+	if *auditLog != "" {
+		return *auditLog
+	}
+	return defaultAuditLog(*storageEngine)
+}
+
+// openStorage returns an admin for the storage flag, with the audit log open for the commands that make changes
+func openStorage(changes bool) (*pks.Admin, io.Closer, error) {
+	if *storageEngine == "" {
+		return nil, nil, errors.New("the storage to manage has to be given with -storage")
+	}
+	if !changes {
+		return openAdmin(*storageEngine, "")
+	}
+	if e := checkManageable(*storageEngine); e != nil {
+		return nil, nil, e
+	}
+	if auditLogFile() == "" {
+		return nil, nil, errNoAuditLog(*storageEngine)
+	}
+	return openAdmin(*storageEngine, auditLogFile())
+}
+
+// checkManageable returns an error for the storages that only exist inside a running server. A cached
+// storage can be managed if the storage it caches can
+func checkManageable(storage string) error {
+	if strings.HasPrefix(storage, "cached:") && strings.Contains(storage, ";") {
+		return checkManageable(storage[strings.Index(storage, ";")+1:])
+	}
+	if !strings.HasPrefix(storage, "dir:") && !strings.HasPrefix(storage, "redis:") && !strings.HasPrefix(storage, "sharded:") {
+		return fmt.Errorf("the %s storage can't be managed from outside of the server", storage)
+	}
+	return nil
+}
+
+// openAdmin returns an admin for the storage, with the audit log open if one is given
+func openAdmin(storage, auditFile string) (*pks.Admin, io.Closer, error) {
+	if e := checkManageable(storage); e != nil {
+		return nil, nil, e
+	}
+	st, e := pks.CreateFactory(nil).LoadStorageType(storage)
+	if e != nil {
+		return nil, nil, fmt.Errorf("encountered error when opening the storage: %v", e)
+	}
+
+	var audit *os.File
+	if auditFile != "" {
+		if audit, e = os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); e != nil {
+			return nil, nil, fmt.Errorf("encountered error when opening the audit log: %v", e)
+		}
+	}
+	a, e := pks.NewAdmin(st, audit)
+	if e != nil {
+		if audit != nil {
+			audit.Close()
+		}
+		return nil, nil, e
+	}
+	a.Operator = *operator
+	return a, audit, nil
+}
+
+// run runs the command given in the arguments
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("no command given, run with -help to see the commands")
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q, run with -help to see the commands", args[0])
+	}
+	if len(args)-1 < cmd.minArgs || len(args)-1 > cmd.maxArgs {
+		return fmt.Errorf("usage: %s %s", cmd.name, cmd.args)
+	}
+
+	a, audit, e := openStorage(cmd.changes)
+	if e != nil {
+		return e
+	}
+	if audit != nil {
+		defer audit.Close()
+	}
+	res, e := cmd.run(a, args[1:])
+	if res != nil {
+		printResult(out, res)
+	}
+	return e
+}
@@ -0,0 +1,22 @@
+package main
+
+import "flag"
+
+// These flags represent all the available command line flags
+var (
+	serverAddress     = flag.String("server", "tcp:localhost:3242", "The server to talk to: tcp:HOST:PORT or tls:HOST:PORT for the raw protocol, or an http:// or https:// URL for the HTTP front end")
+	fromAddress       = flag.String("from", "", "The from-address the server will see. For the HTTP front end, it is asked for as the identity to use")
+	keyFile           = flag.String("key-file", "prekey-client.keys", "Location of file where the client long term keys should be stored and loaded")
+	serverFingerprint = flag.String("server-fingerprint", "", "The fingerprint the server has to have. Empty means any")
+	pinFile           = flag.String("pin-file", "", "File of pinned server fingerprints. The first fingerprint seen for a server is added to it, and later ones have to match")
+	httpUser          = flag.String("user", "", "The user to log in to the HTTP front end as")
+	passwordFile      = flag.String("password-file", "", "File containing the password for the HTTP front end")
+	tokenFile         = flag.String("token-file", "", "File containing a bearer token for the HTTP front end, used instead of a password")
+	tlsCAFile         = flag.String("tls-ca-file", "", "File containing the certificates to trust for TLS connections. Empty means the system ones")
+	requestTimeout    = flag.Uint("timeout", 30, "Timeout for every request to the server, in seconds")
+	fragLen           = flag.Uint("fragmentation-length", 0, "Fragmentation length of messages sent to the server - 0 means no fragmenting")
+	prekeyMessages    = flag.Uint("prekey-messages", 10, "The number of prekey messages to publish")
+	profileDays       = flag.Uint("client-profile-days", 14, "How many days published client profiles are valid. 0 means not publishing a client profile")
+	prekeyProfileDays = flag.Uint("prekey-profile-days", 7, "How many days published prekey profiles are valid. 0 means not publishing a prekey profile")
+	jsonOutput        = flag.Bool("json", false, "Print the results as JSON, instead of as text")
+)
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// result is what a command prints, as text or as JSON
+type result interface {
+	text(w io.Writer)
+}
+
+type subcommand struct {
+	name        string
+	args        string
+	description string
+	needsFrom   bool
+	run         func(c *pks.Client, args []string) (result, error)
+}
+
+var commands = []*subcommand{
+	{"fingerprint", "", "Print the fingerprint and instance tag of the client", false, runFingerprint},
+	{"status", "", "Ask the server how many prekey messages it has stored for the client", true, runStatus},
+	{"publish", "", "Publish a client profile, a prekey profile and prekey messages", true, runPublish},
+	{"retrieve", "IDENTITY", "Retrieve the prekey ensembles for an identity, and check them", false, runRetrieve},
+	{"smoke", "", "Publish, check the storage status and retrieve the ensembles of the client, failing if anything is wrong", true, runSmoke},
+}
+
+func findCommand(name string) *subcommand {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+type fingerprintResult struct {
+	Fingerprint string `json:"fingerprint"`
+	InstanceTag uint32 `json:"instanceTag"`
+}
+
+func (r *fingerprintResult) text(w io.Writer) {
+	fmt.Fprintf(w, "Client fingerprint: %s\n", r.Fingerprint)
+	fmt.Fprintf(w, "Instance tag: 0x%08X\n", r.InstanceTag)
+}
+
+func runFingerprint(c *pks.Client, _ []string) (result, error) {
+	return &fingerprintResult{Fingerprint: pks.FormatFingerprint(c.Keys.Fingerprint()), InstanceTag: c.Keys.InstanceTag}, nil
+}
+
+// serverResult describes the server a DAKE was run with
+type serverResult struct {
+	ServerIdentity    string `json:"serverIdentity"`
+	ServerFingerprint string `json:"serverFingerprint"`
+}
+
+func newServerResult(c *pks.Client) serverResult {
+	return serverResult{ServerIdentity: c.ServerIdentity, ServerFingerprint: pks.FormatFingerprint(*c.ServerFingerprint)}
+}
+
+func (r *serverResult) text(w io.Writer) {
+	fmt.Fprintf(w, "Server identity: %s\n", r.ServerIdentity)
+	fmt.Fprintf(w, "Server fingerprint: %s\n", r.ServerFingerprint)
+}
+
+type statusResult struct {
+	serverResult
+	Stored uint32 `json:"stored"`
+}
+
+func (r *statusResult) text(w io.Writer) {
+	r.serverResult.text(w)
+	fmt.Fprintf(w, "Stored prekey messages: %d\n", r.Stored)
+}
+
+func runStatus(c *pks.Client, _ []string) (result, error) {
+	num, e := c.StorageStatus()
+	if e != nil {
+		return nil, e
+	}
+	return &statusResult{serverResult: newServerResult(c), Stored: num}, nil
+}
+
+type publishResult struct {
+	serverResult
+	ClientProfileExpiry *time.Time `json:"clientProfileExpiry,omitempty"`
+	PrekeyProfileExpiry *time.Time `json:"prekeyProfileExpiry,omitempty"`
+	PrekeyMessages      int        `json:"prekeyMessages"`
+}
+
+func (r *publishResult) text(w io.Writer) {
+	r.serverResult.text(w)
+	if r.ClientProfileExpiry != nil {
+		fmt.Fprintf(w, "Published a client profile, expiring %s\n", r.ClientProfileExpiry.UTC().Format(time.RFC3339))
+	}
+	if r.PrekeyProfileExpiry != nil {
+		fmt.Fprintf(w, "Published a prekey profile, expiring %s\n", r.PrekeyProfileExpiry.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Published %d prekey messages\n", r.PrekeyMessages)
+}
+
+func publication() *pks.Publication {
+	now := time.Now()
+	p := &pks.Publication{PrekeyMessages: int(*prekeyMessages)}
+	if *profileDays > 0 {
+		p.ClientProfileExpiry = now.Add(time.Duration(*profileDays*24) * time.Hour)
+	}
+	if *prekeyProfileDays > 0 {
+		p.PrekeyProfileExpiry = now.Add(time.Duration(*prekeyProfileDays*24) * time.Hour)
+	}
+	return p
+}
+
+func runPublish(c *pks.Client, _ []string) (result, error) {
+	p := publication()
+	if e := c.Publish(p); e != nil {
+		return nil, e
+	}
+	r := &publishResult{serverResult: newServerResult(c), PrekeyMessages: p.PrekeyMessages}
+	if !p.ClientProfileExpiry.IsZero() {
+		r.ClientProfileExpiry = &p.ClientProfileExpiry
+	}
+	if !p.PrekeyProfileExpiry.IsZero() {
+		r.PrekeyProfileExpiry = &p.PrekeyProfileExpiry
+	}
+	return r, nil
+}
+
+type retrieveResult struct {
+	Identity  string                    `json:"identity"`
+	Ensembles []*pks.EnsembleInspection `json:"ensembles"`
+}
+
+func printProblems(w io.Writer, problems []string) {
+	for _, p := range problems {
+		fmt.Fprintf(w, "    problem: %s\n", p)
+	}
+}
+
+func (r *retrieveResult) text(w io.Writer) {
+	if len(r.Ensembles) == 0 {
+		fmt.Fprintf(w, "No prekey ensembles available for %s\n", r.Identity)
+		return
+	}
+	fmt.Fprintf(w, "%d prekey ensembles for %s\n", len(r.Ensembles), r.Identity)
+	for ix, e := range r.Ensembles {
+		fmt.Fprintf(w, "Ensemble %d:\n", ix+1)
+		fmt.Fprintf(w, "  client fingerprint: %s\n", e.ClientProfile.Fingerprint)
+		fmt.Fprintf(w, "  instance tag: 0x%08X\n", e.ClientProfile.InstanceTag)
+		fmt.Fprintf(w, "  client profile expires: %s\n", e.ClientProfile.Expires.UTC().Format(time.RFC3339))
+		printProblems(w, e.ClientProfile.Problems)
+		fmt.Fprintf(w, "  prekey profile expires: %s\n", e.PrekeyProfile.Expires.UTC().Format(time.RFC3339))
+		printProblems(w, e.PrekeyProfile.Problems)
+		fmt.Fprintf(w, "  prekey message: 0x%08X\n", e.PrekeyMessage.Identifier)
+		printProblems(w, e.PrekeyMessage.Problems)
+		printProblems(w, e.Problems)
+	}
+}
+
+func ensembleProblems(e *pks.EnsembleInspection) []string {
+	result := append([]string{}, e.ClientProfile.Problems...)
+	result = append(result, e.PrekeyProfile.Problems...)
+	result = append(result, e.PrekeyMessage.Problems...)
+	return append(result, e.Problems...)
+}
+
+var errInvalidEnsembles = errors.New("some of the ensembles are invalid")
+
+// runRetrieve returns the result together with errInvalidEnsembles if any of the ensembles has problems
+func runRetrieve(c *pks.Client, args []string) (result, error) {
+	if len(args) != 1 {
+		return nil, errors.New("retrieve needs the identity to retrieve the ensembles for")
+	}
+	ens, e := c.Retrieve(args[0])
+	if e != nil {
+		return nil, e
+	}
+	r := &retrieveResult{Identity: args[0], Ensembles: ens}
+	for _, en := range ens {
+		if len(ensembleProblems(en)) > 0 {
+			return r, errInvalidEnsembles
+		}
+	}
+	return r, nil
+}
+
+type smokeStep struct {
+	Step  string `json:"step"`
+	Error string `json:"error,omitempty"`
+}
+
+type smokeResult struct {
+	serverResult
+	Steps []*smokeStep `json:"steps"`
+}
+
+func (r *smokeResult) text(w io.Writer) {
+	if r.ServerFingerprint != "" {
+		r.serverResult.text(w)
+	}
+	for _, s := range r.Steps {
+		if s.Error != "" {
+			fmt.Fprintf(w, "FAIL %s: %s\n", s.Step, s.Error)
+		} else {
+			fmt.Fprintf(w, "ok   %s\n", s.Step)
+		}
+	}
+}
+
+var errSmokeTestFailed = errors.New("the smoke test failed")
+
+// runSmoke checks that the server works from end to end: what is published can be retrieved,
+// and the storage status follows along
+func runSmoke(c *pks.Client, _ []string) (result, error) {
+	r := &smokeResult{}
+	step := func(name string, f func() error) bool {
+		s := &smokeStep{Step: name}
+		r.Steps = append(r.Steps, s)
+		if e := f(); e != nil {
+			s.Error = e.Error()
+			return false
+		}
+		return true
+	}
+	fail := func() (result, error) {
+		if c.ServerFingerprint != nil {
+			r.serverResult = newServerResult(c)
+		}
+		return r, errSmokeTestFailed
+	}
+
+	p := publication()
+	if p.PrekeyMessages == 0 || p.ClientProfileExpiry.IsZero() || p.PrekeyProfileExpiry.IsZero() {
+		return nil, errors.New("the smoke test needs to publish profiles and prekey messages")
+	}
+
+	var before, after uint32
+	if !step("check storage status", func() (e error) {
+		before, e = c.StorageStatus()
+		return e
+	}) {
+		return fail()
+	}
+	if !step(fmt.Sprintf("publish %d prekey messages", p.PrekeyMessages), func() error {
+		return c.Publish(p)
+	}) {
+		return fail()
+	}
+	if !step("check the prekey messages were stored", func() (e error) {
+		if after, e = c.StorageStatus(); e != nil {
+			return e
+		}
+		if after != before+uint32(p.PrekeyMessages) {
+			return fmt.Errorf("expected %d stored prekey messages, but the server has %d", before+uint32(p.PrekeyMessages), after)
+		}
+		return nil
+	}) {
+		return fail()
+	}
+	if !step("retrieve the published ensemble", func() error {
+		ens, e := c.Retrieve(c.From)
+		if e != nil {
+			return e
+		}
+		fp := pks.FormatFingerprint(c.Keys.Fingerprint())
+		for _, en := range ens {
+			if en.ClientProfile.InstanceTag != c.Keys.InstanceTag || en.ClientProfile.Fingerprint != fp {
+				continue
+			}
+			if problems := ensembleProblems(en); len(problems) > 0 {
+				return fmt.Errorf("the ensemble is invalid: %s", problems[0])
+			}
+			return nil
+		}
+		return errors.New("no ensemble was returned for the client")
+	}) {
+		return fail()
+	}
+	if !step("check the retrieved prekey message was removed", func() error {
+		num, e := c.StorageStatus()
+		if e != nil {
+			return e
+		}
+		if num != after-1 {
+			return fmt.Errorf("expected %d stored prekey messages, but the server has %d", after-1, num)
+		}
+		return nil
+	}) {
+		return fail()
+	}
+
+	r.serverResult = newServerResult(c)
+	return r, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ClientSuite struct {
+	dir string
+}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	*keyFile = filepath.Join(s.dir, "client.keys")
+	*pinFile = ""
+	*serverFingerprint = ""
+	*fromAddress = "sita@example.org"
+	*serverAddress = "tcp:localhost:3242"
+	*prekeyMessages = 3
+	*profileDays = 14
+	*prekeyProfileDays = 7
+	*jsonOutput = false
+}
+
+func createTestServer() pks.Server {
+	f := pks.CreateFactory(nil)
+	st, _ := f.LoadStorageType("in-memory")
+	return f.NewServer("prekeys.example.org", f.CreateKeypair(), 0, st, time.Minute, time.Minute, nil)
+}
+
+func writeFile(c *C, name, content string) string {
+	c.Assert(ioutil.WriteFile(name, []byte(content), 0600), IsNil)
+	return name
+}
+
+func fileContent(c *C, name string) string {
+	d, e := ioutil.ReadFile(name)
+	c.Assert(e, IsNil)
+	return string(d)
+}
+
+func exists(name string) bool {
+	_, e := os.Stat(name)
+	return e == nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/otrv4/gotrx"
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+func loadOrCreateKeys() (*pks.ClientKeys, error) {
+	fl := *keyFile
+	if command.FileExists(fl) {
+		file, e := os.Open(fl)
+		if e != nil {
+			return nil, e
+		}
+		defer file.Close()
+		return pks.LoadClientKeysFrom(file)
+	}
+
+	file, e := os.OpenFile(fl, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		return nil, e
+	}
+
+	defer file.Close()
+	ret := pks.GenerateClientKeys(nil)
+
+	if e := ret.StoreInto(file); e != nil {
+		return nil, e
+	}
+
+	return ret, nil
+}
+
+// parseFingerprint reads a fingerprint in hexadecimal, ignoring spaces and case
+func parseFingerprint(s string) (gotrx.Fingerprint, error) {
+	var fp gotrx.Fingerprint
+	d, e := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if e != nil || len(d) != len(fp) {
+		return fp, fmt.Errorf("%q is not a fingerprint", s)
+	}
+	copy(fp[:], d)
+	return fp, nil
+}
+
+// The pin file contains one server on each line, as the server flag followed by the fingerprint of the server
+// Empty lines and lines starting with # are ignored.
+
+func parsePins(data []byte) (map[string]gotrx.Fingerprint, error) {
+	result := map[string]gotrx.Fingerprint{}
+	for ix, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d is not in the format server fingerprint", ix+1)
+		}
+		fp, e := parseFingerprint(parts[1])
+		if e != nil {
+			return nil, fmt.Errorf("line %d: %v", ix+1, e)
+		}
+		result[parts[0]] = fp
+	}
+	return result, nil
+}
+
+// pinnedFingerprint returns the fingerprint the server has to have, if any
+func pinnedFingerprint(server string) (*gotrx.Fingerprint, error) {
+	if *serverFingerprint != "" {
+		fp, e := parseFingerprint(*serverFingerprint)
+		return &fp, e
+	}
+	if *pinFile == "" || !command.FileExists(*pinFile) {
+		return nil, nil
+	}
+	d, e := ioutil.ReadFile(*pinFile)
+	if e != nil {
+		return nil, e
+	}
+	pins, e := parsePins(d)
+	if e != nil {
+		return nil, fmt.Errorf("%s: %v", *pinFile, e)
+	}
+	if fp, ok := pins[server]; ok {
+		return &fp, nil
+	}
+	return nil, nil
+}
+
+// pinFingerprint adds the fingerprint of the server to the pin file, unless it is already there
+func pinFingerprint(server string, fp gotrx.Fingerprint) error {
+	if *pinFile == "" {
+		return nil
+	}
+	pinned, e := pinnedFingerprint(server)
+	if e != nil {
+		return e
+	}
+	if pinned != nil {
+		if *pinned != fp {
+			return errors.New("the pinned fingerprint doesn't match the server")
+		}
+		return nil
+	}
+	f, e := os.OpenFile(*pinFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	_, e = fmt.Fprintf(f, "%s %s\n", server, pks.FormatFingerprint(fp))
+	return e
+}
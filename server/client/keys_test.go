@@ -0,0 +1,40 @@
+package main
+
+import (
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ClientSuite) Test_parseFingerprint_ignoresSpacesAndCase(c *C) {
+	fp, e := parseFingerprint("0205149809b14f24 E19FB74A140CFF59 B9C816DEBC63A50E 23498B57D1045B3E 87DCC5892A334325 FAB098989C696591 2AF6484A866DF11C")
+	c.Assert(e, IsNil)
+	c.Assert(fp[0], Equals, byte(0x02))
+	c.Assert(fp[55], Equals, byte(0x1C))
+	c.Assert(pks.FormatFingerprint(fp), Equals, "0205149809B14F24 E19FB74A140CFF59 B9C816DEBC63A50E 23498B57D1045B3E 87DCC5892A334325 FAB098989C696591 2AF6484A866DF11C")
+
+	_, e = parseFingerprint("0205149809B14F24")
+	c.Assert(e, ErrorMatches, `"0205149809B14F24" is not a fingerprint`)
+}
+
+func (s *ClientSuite) Test_parsePins_readsOneServerOnEachLine(c *C) {
+	pins, e := parsePins([]byte("# pinned servers\n\ntcp:localhost:3242 0205149809B14F24 E19FB74A140CFF59 B9C816DEBC63A50E 23498B57D1045B3E 87DCC5892A334325 FAB098989C696591 2AF6484A866DF11C\n"))
+	c.Assert(e, IsNil)
+	c.Assert(pins, HasLen, 1)
+	c.Assert(pins["tcp:localhost:3242"][0], Equals, byte(0x02))
+
+	_, e = parsePins([]byte("tcp:localhost:3242\n"))
+	c.Assert(e, ErrorMatches, "line 1 is not in the format server fingerprint")
+	_, e = parsePins([]byte("tcp:localhost:3242 0205\n"))
+	c.Assert(e, ErrorMatches, `line 1: "0205" is not a fingerprint`)
+}
+
+func (s *ClientSuite) Test_pinnedFingerprint_prefersTheServerFingerprintFlag(c *C) {
+	*serverFingerprint = "00"
+	_, e := pinnedFingerprint("tcp:localhost:3242")
+	c.Assert(e, ErrorMatches, `"00" is not a fingerprint`)
+
+	*serverFingerprint = ""
+	fp, e := pinnedFingerprint("tcp:localhost:3242")
+	c.Assert(e, IsNil)
+	c.Assert(fp, IsNil)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/transport"
+)
+
+// prekey-client talks to a prekey server the way an OTRv4 client would, to test and operate
+// deployed servers. The first time it is run, it creates long term keys and an instance tag
+// for the client, and stores them in the key file. Every command that runs a DAKE prints the
+// fingerprint of the server, and with a pin file, refuses servers whose fingerprint changed.
+// The exit status is 1 if anything failed, including the checks of retrieved ensembles.
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] command [arguments]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-20s %s\n", c.name+" "+c.args, c.description)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// createTransport returns a transport for the server flag
+func createTransport() (pks.Server, error) {
+	return transport.New(&transport.Options{
+		Server:       *serverAddress,
+		User:         *httpUser,
+		PasswordFile: *passwordFile,
+		TokenFile:    *tokenFile,
+		TLSCAFile:    *tlsCAFile,
+		Timeout:      time.Duration(*requestTimeout) * time.Second,
+	})
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	server, e := createTransport()
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", e)
+		os.Exit(1)
+	}
+	if e := run(flag.Args(), os.Stdout, server); e != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", e)
+		os.Exit(1)
+	}
+}
+
+func printResult(out io.Writer, r result) {
+	if *jsonOutput {
+		d, _ := json.Marshal(r)
+		fmt.Fprintf(out, "%s\n", d)
+		return
+	}
+	r.text(out)
+}
+
+// run runs the command given in the arguments against the server
+func run(args []string, out io.Writer, server pks.Server) error {
+	if len(args) == 0 {
+		return errors.New("no command given, run with -help to see the commands")
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q, run with -help to see the commands", args[0])
+	}
+	if cmd.needsFrom && *fromAddress == "" {
+		return fmt.Errorf("the %s command needs a from-address", cmd.name)
+	}
+
+	keys, e := loadOrCreateKeys()
+	if e != nil {
+		return fmt.Errorf("encountered error when loading/creating client keys: %v", e)
+	}
+	pinned, e := pinnedFingerprint(*serverAddress)
+	if e != nil {
+		return e
+	}
+
+	c := &pks.Client{
+		From:              *fromAddress,
+		Keys:              keys,
+		Server:            server,
+		ServerFingerprint: pinned,
+		FragmentLength:    int(*fragLen),
+	}
+	res, e := cmd.run(c, args[1:])
+	if res != nil {
+		printResult(out, res)
+	}
+	if cmd.needsFrom && c.ServerFingerprint != nil {
+		if pe := pinFingerprint(*serverAddress, *c.ServerFingerprint); pe != nil && e == nil {
+			e = pe
+		}
+	}
+	return e
+}
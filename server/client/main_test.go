@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ClientSuite) Test_run_createsKeysAndPrintsTheFingerprint(c *C) {
+	var out bytes.Buffer
+	c.Assert(run([]string{"fingerprint"}, &out, nil), IsNil)
+	c.Assert(exists(*keyFile), Equals, true)
+	c.Assert(out.String(), Matches, "Client fingerprint: [0-9A-F ]{118}\nInstance tag: 0x[0-9A-F]{8}\n")
+
+	var again bytes.Buffer
+	c.Assert(run([]string{"fingerprint"}, &again, nil), IsNil)
+	c.Assert(again.String(), Equals, out.String())
+}
+
+func (s *ClientSuite) Test_run_refusesUnknownCommandsAndMissingArguments(c *C) {
+	var out bytes.Buffer
+	c.Assert(run(nil, &out, nil), ErrorMatches, "no command given.*")
+	c.Assert(run([]string{"dance"}, &out, nil), ErrorMatches, `unknown command "dance".*`)
+	*fromAddress = ""
+	c.Assert(run([]string{"publish"}, &out, nil), ErrorMatches, "the publish command needs a from-address")
+	c.Assert(run([]string{"retrieve"}, &out, createTestServer()), ErrorMatches, "retrieve needs the identity.*")
+}
+
+func (s *ClientSuite) Test_run_publishesAndRetrieves(c *C) {
+	server := createTestServer()
+	var out bytes.Buffer
+	c.Assert(run([]string{"publish"}, &out, server), IsNil)
+	c.Assert(out.String(), Matches, `(?s)Server identity: prekeys.example.org
+Server fingerprint: [0-9A-F ]+
+Published a client profile, expiring .*
+Published a prekey profile, expiring .*
+Published 3 prekey messages
+`)
+
+	out.Reset()
+	*jsonOutput = true
+	c.Assert(run([]string{"status"}, &out, server), IsNil)
+	res := map[string]interface{}{}
+	c.Assert(json.Unmarshal(out.Bytes(), &res), IsNil)
+	c.Assert(res["stored"], Equals, float64(3))
+	c.Assert(res["serverIdentity"], Equals, "prekeys.example.org")
+
+	out.Reset()
+	*jsonOutput = false
+	*keyFile = filepath.Join(s.dir, "rama.keys")
+	*fromAddress = "rama@example.org"
+	c.Assert(run([]string{"retrieve", "sita@example.org"}, &out, server), IsNil)
+	c.Assert(out.String(), Matches, `(?s)1 prekey ensembles for sita@example.org
+Ensemble 1:
+  client fingerprint: .*
+  prekey message: 0x[0-9A-F]{8}
+`)
+	c.Assert(strings.Contains(out.String(), "problem"), Equals, false)
+
+	out.Reset()
+	c.Assert(run([]string{"retrieve", "lakshmana@example.org"}, &out, server), IsNil)
+	c.Assert(out.String(), Equals, "No prekey ensembles available for lakshmana@example.org\n")
+}
+
+func (s *ClientSuite) Test_run_smokeTestsTheServer(c *C) {
+	var out bytes.Buffer
+	c.Assert(run([]string{"smoke"}, &out, createTestServer()), IsNil)
+	c.Assert(out.String(), Matches, `(?s).*ok   check storage status
+ok   publish 3 prekey messages
+ok   check the prekey messages were stored
+ok   retrieve the published ensemble
+ok   check the retrieved prekey message was removed
+`)
+
+	*prekeyMessages = 0
+	c.Assert(run([]string{"smoke"}, &out, createTestServer()), ErrorMatches, "the smoke test needs to publish profiles and prekey messages")
+}
+
+type failingServer struct {
+	pks.Server
+	failAfter int
+}
+
+func (f *failingServer) Handle(from, message string) ([]string, error) {
+	if f.failAfter == 0 {
+		return nil, errors.New("connection refused")
+	}
+	f.failAfter--
+	return f.Server.Handle(from, message)
+}
+
+func (s *ClientSuite) Test_run_reportsTheFailingStepOfTheSmokeTest(c *C) {
+	var out bytes.Buffer
+	e := run([]string{"smoke"}, &out, &failingServer{Server: createTestServer(), failAfter: 3})
+	c.Assert(e, Equals, errSmokeTestFailed)
+	c.Assert(out.String(), Matches, `(?s)Server identity: prekeys.example.org
+.*ok   check storage status
+FAIL publish 3 prekey messages: connection refused
+`)
+}
+
+func (s *ClientSuite) Test_run_pinsTheServerFingerprint(c *C) {
+	*pinFile = filepath.Join(s.dir, "pins")
+	var out bytes.Buffer
+	c.Assert(run([]string{"status"}, &out, createTestServer()), IsNil)
+	c.Assert(fileContent(c, *pinFile), Matches, "tcp:localhost:3242 [0-9A-F ]{118}\n")
+
+	e := run([]string{"status"}, &out, createTestServer())
+	c.Assert(e, ErrorMatches, "the server has the fingerprint .*, not the expected .*")
+
+	*serverAddress = "tcp:otherhost:3242"
+	c.Assert(run([]string{"status"}, &out, createTestServer()), IsNil)
+	c.Assert(strings.Count(fileContent(c, *pinFile), "\n"), Equals, 2)
+}
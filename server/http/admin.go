@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The HTTP server is ready when it has loaded users from the password file, and it can connect
+// to the raw server. The connection to the raw server is closed without sending anything, which
+// the raw server answers with an empty reply.
+// When the raw servers share their sessions in progress with -shared-state, the HTTP server can
+// be given the same store. It doesn't use it for the requests, since the raw servers keep the
+// sessions, but it is only ready when it can count them - otherwise a DAKE going through it would
+// fail halfway.
+
+var sharedStore pks.StateStore
+
+func checkUsers() error {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	if len(users) == 0 {
+		return errors.New("no users have been loaded from the password file")
+	}
+	return nil
+}
+
+func checkRawServer() error {
+	con, e := dialRawServer()
+	if e != nil {
+		return e
+	}
+	defer con.Close()
+	if dc, ok := con.(interface{ SetDeadline(time.Time) error }); ok {
+		dc.SetDeadline(time.Now().Add(command.AdminTimeout))
+	}
+	if e := con.CloseWrite(); e != nil {
+		return e
+	}
+	_, e = io.Copy(ioutil.Discard, con)
+	return e
+}
+
+func loadSharedState() error {
+	if *sharedState == "" {
+		return nil
+	}
+	st, e := pks.LoadStateStore(*sharedState)
+	if e != nil {
+		return e
+	}
+	sharedStore = st
+	return nil
+}
+
+func checkSharedState() error {
+	_, e := sharedStore.CountSessions()
+	return e
+}
+
+func readinessChecks() []*pks.HealthCheck {
+	checks := []*pks.HealthCheck{
+		command.NewHealthCheck("users", checkUsers()),
+		command.NewHealthCheck("raw-server", checkRawServer()),
+	}
+	if sharedStore != nil {
+		checks = append(checks, command.NewHealthCheck("shared-state", checkSharedState()))
+	}
+	return checks
+}
+
+// startAdmin starts serving the health endpoints, if an admin address is given
+func startAdmin() error {
+	if *adminAddress == "" {
+		return nil
+	}
+	l, e := net.Listen("tcp", *adminAddress)
+	if e != nil {
+		return e
+	}
+
+	srv := &http.Server{
+		Handler:      command.HealthHandler(readinessChecks),
+		ReadTimeout:  command.AdminTimeout,
+		WriteTimeout: 2 * command.AdminTimeout,
+	}
+
+	command.Logf("Serving health checks on %s\n", l.Addr())
+	go func() {
+		command.Logf("encountered error when running admin server: %v\n", srv.Serve(l))
+	}()
+	return nil
+}
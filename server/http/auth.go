@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Requests are authenticated by one or more authenticators, chosen with the auth-methods flag.
+// Each of them looks for its own kind of credentials in the request. The first one that finds
+// credentials decides who sent the request, and whether to accept it.
+
+// authenticator decides who sent a request
+type authenticator interface {
+	// authenticate returns the name of the user who sent the request. It returns
+	// errMissingCredentials if the request doesn't have the kind of credentials it checks
+	authenticate(r *http.Request) (string, error)
+	// challenge returns the WWW-Authenticate header that tells clients how to authenticate
+	challenge() string
+}
+
+var errMissingCredentials = errors.New("no credentials given")
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// basicAuthenticator checks usernames and passwords against the password file
+type basicAuthenticator struct{}
+
+func (basicAuthenticator) authenticate(r *http.Request) (string, error) {
+	u, p, ok := r.BasicAuth()
+	if !ok {
+		return "", errMissingCredentials
+	}
+	if e := checkLogin(u, p, remoteAddress(r)); e != nil {
+		return "", e
+	}
+	return u, nil
+}
+
+func (basicAuthenticator) challenge() string {
+	return `Basic realm="prekey server"`
+}
+
+type authenticators []authenticator
+
+func (as authenticators) authenticate(r *http.Request) (string, error) {
+	for _, a := range as {
+		u, e := a.authenticate(r)
+		if e == errMissingCredentials {
+			continue
+		}
+		return u, e
+	}
+	return "", errMissingCredentials
+}
+
+var activeAuthenticators authenticators
+var activeAuthenticatorsLock sync.RWMutex
+
+func currentAuthenticators() authenticators {
+	activeAuthenticatorsLock.RLock()
+	defer activeAuthenticatorsLock.RUnlock()
+	return activeAuthenticators
+}
+
+func parseAuthMethods(methods string) (authenticators, error) {
+	result := authenticators{}
+	for _, m := range strings.Split(methods, ",") {
+		switch strings.TrimSpace(m) {
+		case "basic":
+			result = append(result, basicAuthenticator{})
+		case "bearer":
+			result = append(result, bearerAuthenticator{})
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", strings.TrimSpace(m))
+		}
+	}
+	return result, nil
+}
+
+func usesAuthMethod(methods, method string) bool {
+	for _, m := range strings.Split(methods, ",") {
+		if strings.TrimSpace(m) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAuthenticators sets up the authenticators given by the auth-methods flag
+func loadAuthenticators() error {
+	as, e := parseAuthMethods(*authMethods)
+	if e != nil {
+		return e
+	}
+	if usesAuthMethod(*authMethods, "bearer") {
+		if e := loadTokenKeys(); e != nil {
+			return e
+		}
+	}
+
+	activeAuthenticatorsLock.Lock()
+	defer activeAuthenticatorsLock.Unlock()
+	activeAuthenticators = as
+	return nil
+}
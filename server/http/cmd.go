@@ -4,14 +4,55 @@ import "flag"
 
 // These flags represent all the available command line flags
 var (
-	passwordHash   = flag.String("pwd", "", "If we should generate a password hash instead of running the server")
-	listenPort     = flag.Uint("listen-port", 8080, "Port to listen on")
-	listenIP       = flag.String("listen-address", "localhost", "Address to listen on")
-	connectPort    = flag.Uint("connect-port", 3242, "Port to connect to the raw server on")
-	connectIP      = flag.String("connect-address", "localhost", "Address to connect to the raw server on")
-	runTLS         = flag.Bool("tls", false, "If TLS should be used for the server")
-	filePrivateKey = flag.String("key-file", "", "File where private key is stored for tls")
-	fileCert       = flag.String("cert-file", "", "File where certificate is stored for tls")
-	bindPath       = flag.String("path", "/prekeys", "Path of the url where server should listen")
-	passwordFile   = flag.String("pwd-file", "passwords.asc", "File containing the usernames and passwords, one line for each entry, user:pwd")
+	configFile        = flag.String("config", "", "Configuration file in JSON format. Flags given on the command line take precedence over the file")
+	passwordToHash    = flag.String("pwd", "", "Generate a hash of the given password instead of running the server. Use the users subcommand to manage the password file")
+	listenPort        = flag.Uint("listen-port", 8080, "Port to listen on")
+	listenIP          = flag.String("listen-address", "localhost", "Address to listen on")
+	connectPort       = flag.Uint("connect-port", 3242, "Port to connect to the raw server on")
+	connectIP         = flag.String("connect-address", "localhost", "Address to connect to the raw server on")
+	connectSocket     = flag.String("connect-socket", "", "Unix domain socket to connect to the raw server on. If given, the connect address and port are not used")
+	connectTLS        = flag.Bool("connect-tls", false, "If TLS should be used when connecting to the raw server")
+	connectCAFile     = flag.String("connect-ca-file", "", "File containing the CA certificates used to verify the raw server. Empty means the system roots")
+	connectCertFile   = flag.String("connect-cert-file", "", "File containing the client certificate to present to the raw server")
+	connectKeyFile    = flag.String("connect-key-file", "", "File containing the private key for the client certificate")
+	connectServerName = flag.String("connect-server-name", "", "The name to verify the raw server certificate against. Empty means the connect address")
+	sharedState       = flag.String("shared-state", "", "Store the raw servers share their sessions in progress in, like 'redis:address=HOST:PORT'. If given, the server is only ready when it can reach the store too. Empty means not checking it")
+	runTLS            = flag.Bool("tls", false, "If TLS should be used for the server")
+	filePrivateKey    = flag.String("key-file", "", "File where private key is stored for tls")
+	fileCert          = flag.String("cert-file", "", "File where certificate is stored for tls")
+	bindPath          = flag.String("path", "/prekeys", "Path of the url where server should listen")
+	passwordFile      = flag.String("pwd-file", "passwords.asc", "File containing the usernames and password hashes, one line for each entry, user:hash")
+	pwdCheckInterval  = flag.Uint("pwd-file-check-interval", 5, "How often to check whether the password file has changed, in seconds. 0 means only reading it again on SIGHUP")
+	scryptCost        = flag.Uint("scrypt-cost", 15, "The base 2 logarithm of the scrypt cost parameter used for new password hashes")
+	scryptBlockSize   = flag.Uint("scrypt-block-size", 8, "The scrypt block size used for new password hashes")
+	scryptParallelism = flag.Uint("scrypt-parallelism", 1, "The scrypt parallelization parameter used for new password hashes")
+	authMethods       = flag.String("auth-methods", "basic", "Comma separated list of the ways users can authenticate: basic, for a username and password from the password file, and bearer, for tokens signed by an identity provider")
+	tokenKeysFile     = flag.String("token-keys-file", "", "File containing the keys tokens can be signed with, one line for each key, id:algorithm:key. The algorithm is EdDSA or HS256")
+	tokenIssuer       = flag.String("token-issuer", "", "The issuer tokens have to come from")
+	tokenAudience     = flag.String("token-audience", "", "The audience tokens have to be meant for")
+	tokenSubjectClaim = flag.String("token-subject-claim", "sub", "The claim in tokens that gives the name of the user")
+	tokenLeeway       = flag.Uint("token-leeway", 60, "How far off the clock of the identity provider can be when checking the expiry of tokens, in seconds")
+	fromTemplate      = flag.String("from-template", "{user}", "The from-address of users that aren't in the identities file, where {user} is replaced with the name of the user. For example, {user}@chat.example.org")
+	identitiesFile    = flag.String("identities-file", "", "File containing the identities users are allowed to publish for, one line for each user, user:identity,identity,...")
+	authBackoffAfter  = flag.Uint("auth-backoff-after", 3, "The number of failed logins for a user or from an address after which further attempts are delayed. 0 means never delaying them")
+	authBackoffTime   = flag.Uint("auth-backoff-seconds", 1, "How long to refuse attempts after the first delayed failure, in seconds. It doubles with every further failure")
+	authMaxBackoff    = flag.Uint("auth-max-backoff-seconds", 60, "The longest time to refuse attempts between failures, in seconds")
+	authLockoutAfter  = flag.Uint("auth-lockout-after", 10, "The number of failed logins for a user or from an address after which it is locked out. 0 means never locking out")
+	authLockoutTime   = flag.Uint("auth-lockout-seconds", 900, "How long a lockout lasts, in seconds. Failures are also forgotten after this long")
+	authMaxTracked    = flag.Uint("auth-max-tracked", 10000, "The maximum number of users and of addresses to count failed logins for")
+	authCacheSize     = flag.Uint("auth-cache-size", 1000, "The maximum number of successful logins to remember, to avoid checking the password again. 0 means not remembering them")
+	authCacheTime     = flag.Uint("auth-cache-seconds", 300, "How long to remember a successful login, in seconds")
+	gatewayID         = flag.String("gateway-id", "", "The ID of this gateway, used when signing frames sent to the raw server")
+	gatewaySecretFile = flag.String("gateway-secret-file", "", "File containing the base64 encoded secret shared with the raw server. If given, all frames will be signed")
+	readTimeout       = flag.Uint("read-timeout", 60, "Timeout for reading a request, in seconds")
+	writeTimeout      = flag.Uint("write-timeout", 60, "Timeout for writing a response, in seconds")
+	maxBodySize       = flag.Uint("max-body-size", 1048576, "The maximum size of a request body, in bytes")
+	maxConcurrent     = flag.Uint("max-concurrent", 0, "The maximum number of requests handled at the same time. Requests beyond that get a 503 response. 0 means no limit")
+	wsPath            = flag.String("websocket-path", "", "Path of the url where WebSocket connections are accepted, for example '/prekeys/ws'. Empty means no WebSocket endpoint")
+	wsOrigins         = flag.String("websocket-origins", "", "Comma separated list of the origins of web pages allowed to open WebSocket connections, or * for any. Empty means only pages from the same host")
+	wsPingInterval    = flag.Uint("websocket-ping-interval", 30, "How often to ping WebSocket clients, in seconds. Clients that don't answer within two intervals are disconnected. 0 means never pinging them")
+	wsMaxMessages     = flag.Uint("websocket-max-messages", 1000, "The maximum number of messages a WebSocket connection can send. 0 means no limit")
+	wsPerMinute       = flag.Uint("websocket-messages-per-minute", 60, "The maximum number of messages a WebSocket connection can send every minute. 0 means no limit")
+	adminAddress      = flag.String("admin-address", "", "Address to serve the health endpoints /healthz and /readyz on, for example 'localhost:8081'. Empty means no health endpoints")
+	logFile           = flag.String("log-file", "", "File to write log messages to. Empty means standard out")
 )
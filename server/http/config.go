@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The configuration file, applied as described in the command package. The settings
+// marked as reloadable below are changed on SIGHUP.
+// The password file is always read again on SIGHUP.
+//
+//   {
+//     "Listen": {"Address": "localhost", "Port": 8080, "Path": "/prekeys"},
+//     "Connect": {"Address": "localhost", "Port": 3242, "Socket": "", "TLS": {"Enabled": true, "CAFile": "/etc/otrng/raw-ca.pem",
+//                 "CertFile": "/etc/otrng/gateway.pem", "KeyFile": "/etc/otrng/gateway-key.pem", "ServerName": "raw.example.org"},
+//                 "SharedState": "redis:address=kv.example.org:6379"},
+//     "TLS": {"Enabled": true, "CertFile": "/etc/otrng/cert.pem", "KeyFile": "/etc/otrng/key.pem"},
+//     "Gateway": {"ID": "gateway-1", "SecretFile": "/etc/otrng/gateway-secret.asc"},
+//     "PasswordFile": "/etc/otrng/passwords.asc",
+//     "AuthMethods": "basic,bearer",
+//     "Tokens": {"KeysFile": "/etc/otrng/token-keys.asc", "Issuer": "https://id.example.org", "Audience": "prekeys",
+//                "SubjectClaim": "sub", "LeewaySeconds": 60},
+//     "Identities": {"FromTemplate": "{user}@chat.example.org", "File": "/etc/otrng/identities.asc"},
+//     "Passwords": {"CheckSeconds": 5, "ScryptCost": 15, "ScryptBlockSize": 8, "ScryptParallelism": 1},
+//     "Logins": {"BackoffAfter": 3, "BackoffSeconds": 1, "MaxBackoffSeconds": 60, "LockoutAfter": 10,
+//                "LockoutSeconds": 900, "MaxTracked": 10000, "CacheSize": 1000, "CacheSeconds": 300},
+//     "Timeouts": {"ReadSeconds": 60, "WriteSeconds": 60},
+//     "WebSocket": {"Path": "/prekeys/ws", "Origins": "https://chat.example.org", "PingSeconds": 30,
+//                   "MaxMessages": 1000, "MessagesPerMinute": 60},
+//     "Admin": {"Address": "localhost:8081"},
+//     "Limits": {"MaxBodySize": 1048576, "MaxConcurrent": 0},
+//     "Logging": {"File": ""}
+//   }
+
+type listenConfig struct {
+	Address *string
+	Port    *uint
+	Path    *string
+}
+
+// the names of the files can't change, but the files themselves are always reloaded
+type connectTLSConfig struct {
+	Enabled    *bool
+	CAFile     *string
+	CertFile   *string
+	KeyFile    *string
+	ServerName *string
+}
+
+type connectConfig struct {
+	Address     *string
+	Port        *uint
+	Socket      *string
+	TLS         connectTLSConfig
+	SharedState *string
+}
+
+type tlsConfig struct {
+	Enabled  *bool
+	CertFile *string
+	KeyFile  *string
+}
+
+type gatewayConfig struct {
+	ID         *string
+	SecretFile *string // the name can't change, but the file itself is always reloaded
+}
+
+// changing the scrypt parameters upgrades the hash of every user the next time they log in
+type passwordsConfig struct {
+	CheckSeconds      *uint
+	ScryptCost        *uint // reloadable
+	ScryptBlockSize   *uint // reloadable
+	ScryptParallelism *uint // reloadable
+}
+
+type tokensConfig struct {
+	KeysFile      *string // the name can't change, but the file itself is always reloaded
+	Issuer        *string // reloadable
+	Audience      *string // reloadable
+	SubjectClaim  *string // reloadable
+	LeewaySeconds *uint   // reloadable
+}
+
+type identitiesConfig struct {
+	FromTemplate *string // reloadable
+	File         *string // the name can't change, but the file itself is always reloaded
+}
+
+type loginsConfig struct {
+	BackoffAfter      *uint // reloadable
+	BackoffSeconds    *uint // reloadable
+	MaxBackoffSeconds *uint // reloadable
+	LockoutAfter      *uint // reloadable
+	LockoutSeconds    *uint // reloadable
+	MaxTracked        *uint // reloadable
+	CacheSize         *uint // reloadable
+	CacheSeconds      *uint // reloadable
+}
+
+type timeoutsConfig struct {
+	ReadSeconds  *uint
+	WriteSeconds *uint
+}
+
+type webSocketConfig struct {
+	Path              *string
+	Origins           *string // reloadable
+	PingSeconds       *uint
+	MaxMessages       *uint // reloadable
+	MessagesPerMinute *uint // reloadable
+}
+
+type adminConfig struct {
+	Address *string
+}
+
+type limitsConfig struct {
+	MaxBodySize   *uint // reloadable
+	MaxConcurrent *uint
+}
+
+type loggingConfig struct {
+	File *string // reloadable
+}
+
+type httpConfig struct {
+	Listen       listenConfig
+	Connect      connectConfig
+	TLS          tlsConfig
+	Gateway      gatewayConfig
+	PasswordFile *string
+	AuthMethods  *string
+	Tokens       tokensConfig
+	Identities   identitiesConfig
+	Passwords    passwordsConfig
+	Logins       loginsConfig
+	Timeouts     timeoutsConfig
+	WebSocket    webSocketConfig
+	Admin        adminConfig
+	Limits       limitsConfig
+	Logging      loggingConfig
+}
+
+func readConfigFile(name string) (*httpConfig, error) {
+	c := &httpConfig{}
+	if e := command.ReadConfigFile(name, c); e != nil {
+		return nil, e
+	}
+	return c, nil
+}
+
+func validatePort(path string, p *uint) error {
+	if p != nil && *p > 65535 {
+		return fmt.Errorf("%s: %d is not a valid port", path, *p)
+	}
+	return nil
+}
+
+func validateNotEmpty(path string, s *string) error {
+	if s != nil && *s == "" {
+		return fmt.Errorf("%s: can't be empty", path)
+	}
+	return nil
+}
+
+// Validate implements the command.Config interface
+func (c *httpConfig) Validate() error {
+	if e := validateNotEmpty("Listen.Address", c.Listen.Address); e != nil {
+		return e
+	}
+	if e := validatePort("Listen.Port", c.Listen.Port); e != nil {
+		return e
+	}
+	if c.Listen.Path != nil && !strings.HasPrefix(*c.Listen.Path, "/") {
+		return fmt.Errorf("Listen.Path: %q has to start with a slash", *c.Listen.Path)
+	}
+	if e := validateNotEmpty("Connect.Address", c.Connect.Address); e != nil {
+		return e
+	}
+	if e := validatePort("Connect.Port", c.Connect.Port); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Connect.Socket", c.Connect.Socket); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Connect.TLS.CAFile", c.Connect.TLS.CAFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Connect.TLS.CertFile", c.Connect.TLS.CertFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Connect.TLS.KeyFile", c.Connect.TLS.KeyFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Connect.TLS.ServerName", c.Connect.TLS.ServerName); e != nil {
+		return e
+	}
+	if c.Connect.SharedState != nil && *c.Connect.SharedState != "" && !strings.HasPrefix(*c.Connect.SharedState, "redis:") {
+		return fmt.Errorf("Connect.SharedState: unknown shared state store %q", *c.Connect.SharedState)
+	}
+	if e := validateNotEmpty("TLS.CertFile", c.TLS.CertFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("TLS.KeyFile", c.TLS.KeyFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Gateway.ID", c.Gateway.ID); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Gateway.SecretFile", c.Gateway.SecretFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("PasswordFile", c.PasswordFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("AuthMethods", c.AuthMethods); e != nil {
+		return e
+	}
+	if c.AuthMethods != nil {
+		if _, e := parseAuthMethods(*c.AuthMethods); e != nil {
+			return fmt.Errorf("AuthMethods: %v", e)
+		}
+	}
+	if e := validateNotEmpty("Tokens.KeysFile", c.Tokens.KeysFile); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Tokens.Issuer", c.Tokens.Issuer); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Tokens.Audience", c.Tokens.Audience); e != nil {
+		return e
+	}
+	if e := validateNotEmpty("Tokens.SubjectClaim", c.Tokens.SubjectClaim); e != nil {
+		return e
+	}
+	if c.Identities.FromTemplate != nil && !strings.Contains(*c.Identities.FromTemplate, userPlaceholder) {
+		return fmt.Errorf("Identities.FromTemplate: %q doesn't contain %s", *c.Identities.FromTemplate, userPlaceholder)
+	}
+	if e := validateNotEmpty("Identities.File", c.Identities.File); e != nil {
+		return e
+	}
+	if e := validateScryptSettings(c.Passwords); e != nil {
+		return e
+	}
+	if c.Logins.LockoutSeconds != nil && *c.Logins.LockoutSeconds == 0 {
+		return errors.New("Logins.LockoutSeconds: has to be larger than zero")
+	}
+	if c.Logins.MaxTracked != nil && *c.Logins.MaxTracked == 0 {
+		return errors.New("Logins.MaxTracked: has to be larger than zero")
+	}
+	if c.Timeouts.ReadSeconds != nil && *c.Timeouts.ReadSeconds == 0 {
+		return errors.New("Timeouts.ReadSeconds: has to be larger than zero")
+	}
+	if c.Timeouts.WriteSeconds != nil && *c.Timeouts.WriteSeconds == 0 {
+		return errors.New("Timeouts.WriteSeconds: has to be larger than zero")
+	}
+	if c.WebSocket.Path != nil && !strings.HasPrefix(*c.WebSocket.Path, "/") {
+		return fmt.Errorf("WebSocket.Path: %q has to start with a slash", *c.WebSocket.Path)
+	}
+	if c.Admin.Address != nil {
+		if _, _, e := net.SplitHostPort(*c.Admin.Address); e != nil {
+			return fmt.Errorf("Admin.Address: %v", e)
+		}
+	}
+	if c.Limits.MaxBodySize != nil && *c.Limits.MaxBodySize == 0 {
+		return errors.New("Limits.MaxBodySize: has to be larger than zero")
+	}
+	return nil
+}
+
+func validateScryptSettings(c passwordsConfig) error {
+	if c.ScryptCost != nil && (*c.ScryptCost < 1 || *c.ScryptCost > 30) {
+		return errors.New("Passwords.ScryptCost: has to be between 1 and 30")
+	}
+	if c.ScryptBlockSize != nil && *c.ScryptBlockSize == 0 {
+		return errors.New("Passwords.ScryptBlockSize: has to be larger than zero")
+	}
+	if c.ScryptParallelism != nil && *c.ScryptParallelism == 0 {
+		return errors.New("Passwords.ScryptParallelism: has to be larger than zero")
+	}
+	return nil
+}
+
+// Settings implements the command.Config interface
+func (c *httpConfig) Settings() []command.Setting {
+	res := []command.Setting{}
+	res = command.AppendString(res, "Listen.Address", "listen-address", c.Listen.Address, false)
+	res = command.AppendUint(res, "Listen.Port", "listen-port", c.Listen.Port, false)
+	res = command.AppendString(res, "Listen.Path", "path", c.Listen.Path, false)
+	res = command.AppendString(res, "Connect.Address", "connect-address", c.Connect.Address, false)
+	res = command.AppendUint(res, "Connect.Port", "connect-port", c.Connect.Port, false)
+	res = command.AppendString(res, "Connect.Socket", "connect-socket", c.Connect.Socket, false)
+	res = command.AppendBool(res, "Connect.TLS.Enabled", "connect-tls", c.Connect.TLS.Enabled, false)
+	res = command.AppendString(res, "Connect.TLS.CAFile", "connect-ca-file", c.Connect.TLS.CAFile, false)
+	res = command.AppendString(res, "Connect.TLS.CertFile", "connect-cert-file", c.Connect.TLS.CertFile, false)
+	res = command.AppendString(res, "Connect.TLS.KeyFile", "connect-key-file", c.Connect.TLS.KeyFile, false)
+	res = command.AppendString(res, "Connect.TLS.ServerName", "connect-server-name", c.Connect.TLS.ServerName, false)
+	res = command.AppendString(res, "Connect.SharedState", "shared-state", c.Connect.SharedState, false)
+	res = command.AppendBool(res, "TLS.Enabled", "tls", c.TLS.Enabled, false)
+	res = command.AppendString(res, "TLS.CertFile", "cert-file", c.TLS.CertFile, false)
+	res = command.AppendString(res, "TLS.KeyFile", "key-file", c.TLS.KeyFile, false)
+	res = command.AppendString(res, "Gateway.ID", "gateway-id", c.Gateway.ID, false)
+	res = command.AppendString(res, "Gateway.SecretFile", "gateway-secret-file", c.Gateway.SecretFile, false)
+	res = command.AppendString(res, "PasswordFile", "pwd-file", c.PasswordFile, false)
+	res = command.AppendString(res, "AuthMethods", "auth-methods", c.AuthMethods, false)
+	res = command.AppendString(res, "Tokens.KeysFile", "token-keys-file", c.Tokens.KeysFile, false)
+	res = command.AppendString(res, "Tokens.Issuer", "token-issuer", c.Tokens.Issuer, true)
+	res = command.AppendString(res, "Tokens.Audience", "token-audience", c.Tokens.Audience, true)
+	res = command.AppendString(res, "Tokens.SubjectClaim", "token-subject-claim", c.Tokens.SubjectClaim, true)
+	res = command.AppendUint(res, "Tokens.LeewaySeconds", "token-leeway", c.Tokens.LeewaySeconds, true)
+	res = command.AppendString(res, "Identities.FromTemplate", "from-template", c.Identities.FromTemplate, true)
+	res = command.AppendString(res, "Identities.File", "identities-file", c.Identities.File, false)
+	res = command.AppendUint(res, "Passwords.CheckSeconds", "pwd-file-check-interval", c.Passwords.CheckSeconds, false)
+	res = command.AppendUint(res, "Passwords.ScryptCost", "scrypt-cost", c.Passwords.ScryptCost, true)
+	res = command.AppendUint(res, "Passwords.ScryptBlockSize", "scrypt-block-size", c.Passwords.ScryptBlockSize, true)
+	res = command.AppendUint(res, "Passwords.ScryptParallelism", "scrypt-parallelism", c.Passwords.ScryptParallelism, true)
+	res = command.AppendUint(res, "Logins.BackoffAfter", "auth-backoff-after", c.Logins.BackoffAfter, true)
+	res = command.AppendUint(res, "Logins.BackoffSeconds", "auth-backoff-seconds", c.Logins.BackoffSeconds, true)
+	res = command.AppendUint(res, "Logins.MaxBackoffSeconds", "auth-max-backoff-seconds", c.Logins.MaxBackoffSeconds, true)
+	res = command.AppendUint(res, "Logins.LockoutAfter", "auth-lockout-after", c.Logins.LockoutAfter, true)
+	res = command.AppendUint(res, "Logins.LockoutSeconds", "auth-lockout-seconds", c.Logins.LockoutSeconds, true)
+	res = command.AppendUint(res, "Logins.MaxTracked", "auth-max-tracked", c.Logins.MaxTracked, true)
+	res = command.AppendUint(res, "Logins.CacheSize", "auth-cache-size", c.Logins.CacheSize, true)
+	res = command.AppendUint(res, "Logins.CacheSeconds", "auth-cache-seconds", c.Logins.CacheSeconds, true)
+	res = command.AppendUint(res, "Timeouts.ReadSeconds", "read-timeout", c.Timeouts.ReadSeconds, false)
+	res = command.AppendUint(res, "Timeouts.WriteSeconds", "write-timeout", c.Timeouts.WriteSeconds, false)
+	res = command.AppendString(res, "WebSocket.Path", "websocket-path", c.WebSocket.Path, false)
+	res = command.AppendString(res, "WebSocket.Origins", "websocket-origins", c.WebSocket.Origins, true)
+	res = command.AppendUint(res, "WebSocket.PingSeconds", "websocket-ping-interval", c.WebSocket.PingSeconds, false)
+	res = command.AppendUint(res, "WebSocket.MaxMessages", "websocket-max-messages", c.WebSocket.MaxMessages, true)
+	res = command.AppendUint(res, "WebSocket.MessagesPerMinute", "websocket-messages-per-minute", c.WebSocket.MessagesPerMinute, true)
+	res = command.AppendString(res, "Admin.Address", "admin-address", c.Admin.Address, false)
+	res = command.AppendUint(res, "Limits.MaxBodySize", "max-body-size", c.Limits.MaxBodySize, true)
+	res = command.AppendUint(res, "Limits.MaxConcurrent", "max-concurrent", c.Limits.MaxConcurrent, false)
+	res = command.AppendString(res, "Logging.File", "log-file", c.Logging.File, true)
+	return res
+}
+
+// validateSettings checks the combination of settings from the command line and the configuration file
+func validateSettings() error {
+	if *runTLS && *fileCert == "" {
+		return errors.New("TLS is enabled, but no certificate file is given")
+	}
+	if *runTLS && *filePrivateKey == "" {
+		return errors.New("TLS is enabled, but no private key file is given")
+	}
+	if e := currentHashParams().validate(); e != nil {
+		return e
+	}
+	if _, e := parseAuthMethods(*authMethods); e != nil {
+		return e
+	}
+	if *wsPath != "" && *wsPath == *bindPath {
+		return errors.New("the WebSocket path can't be the same as the path for POST requests")
+	}
+	if !strings.Contains(*fromTemplate, userPlaceholder) {
+		return fmt.Errorf("the from template %q doesn't contain %s", *fromTemplate, userPlaceholder)
+	}
+	if usesAuthMethod(*authMethods, "bearer") && (*tokenKeysFile == "" || *tokenIssuer == "" || *tokenAudience == "") {
+		return errors.New("bearer authentication is enabled, but the token keys file, issuer or audience is missing")
+	}
+	if *authLockoutTime == 0 || *authMaxTracked == 0 {
+		return errors.New("the lockout time and the number of tracked failures have to be larger than zero")
+	}
+	if *connectTLS && *connectSocket != "" {
+		return errors.New("TLS can't be used when connecting to the raw server over a Unix domain socket")
+	}
+	return nil
+}
+
+func loadConfig() error {
+	if e := command.LoadConfig(*configFile, &httpConfig{}); e != nil {
+		return e
+	}
+	return validateSettings()
+}
+
+// reloadConfig reads the configuration file again, and applies the settings that can be changed at runtime
+func reloadConfig() ([]string, error) {
+	return command.ReloadConfig(*configFile, &httpConfig{})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The raw server is reached either over TCP, possibly using TLS, or over a Unix domain socket.
+// The raw server never uses TLS on Unix domain sockets, so neither do we.
+
+// rawServerConn is a connection to the raw server, where we can signal that we are done writing
+type rawServerConn interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+func dialRawServerSocket(name string) (rawServerConn, error) {
+	addr, e := net.ResolveUnixAddr("unix", name)
+	if e != nil {
+		return nil, e
+	}
+	con, e := net.DialUnix("unix", nil, addr)
+	if e != nil {
+		return nil, e
+	}
+	return con, nil
+}
+
+func dialRawServer() (rawServerConn, error) {
+	if *connectSocket != "" {
+		return dialRawServerSocket(*connectSocket)
+	}
+
+	addr := net.JoinHostPort(*connectIP, fmt.Sprintf("%d", *connectPort))
+	if conf := currentConnectTLSConfig(); conf != nil {
+		con, e := tls.Dial("tcp", addr, conf)
+		if e != nil {
+			return nil, e
+		}
+		return con, nil
+	}
+
+	tcpAddr, e := net.ResolveTCPAddr("tcp", addr)
+	if e != nil {
+		return nil, e
+	}
+	con, e := net.DialTCP(tcpAddr.Network(), nil, tcpAddr)
+	if e != nil {
+		return nil, e
+	}
+	return con, nil
+}
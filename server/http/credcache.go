@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// Checking a password with scrypt is deliberately expensive, so a limited number of successful
+// logins are remembered for a while. Only a keyed hash of the username and password is kept,
+// together with the password hash it was checked against, so changing or removing a user
+// makes their entries useless right away.
+
+type cachedLogin struct {
+	key     string
+	hash    *passwordHash
+	expires time.Time
+}
+
+type credentialCache struct {
+	sync.Mutex
+	secret  []byte
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newCredentialCache() *credentialCache {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &credentialCache{secret: secret, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+var successfulLogins = newCredentialCache()
+
+type cacheLimits struct {
+	size int
+	ttl  time.Duration
+}
+
+func currentCacheLimits() cacheLimits {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return cacheLimits{size: int(*authCacheSize), ttl: time.Duration(*authCacheTime) * time.Second}
+}
+
+func (cc *credentialCache) keyFor(u, p string) string {
+	m := hmac.New(sha256.New, cc.secret)
+	m.Write([]byte(u))
+	m.Write([]byte{0})
+	m.Write([]byte(p))
+	return string(m.Sum(nil))
+}
+
+// contains returns true if the user logged in with the password recently, and the password hash hasn't changed since
+func (cc *credentialCache) contains(u, p string, ph *passwordHash, now time.Time) bool {
+	key := cc.keyFor(u, p)
+	cc.Lock()
+	defer cc.Unlock()
+	el, ok := cc.entries[key]
+	if !ok {
+		return false
+	}
+	cl := el.Value.(*cachedLogin)
+	if cl.hash != ph || !now.Before(cl.expires) {
+		cc.remove(el)
+		return false
+	}
+	cc.order.MoveToFront(el)
+	return true
+}
+
+func (cc *credentialCache) add(u, p string, ph *passwordHash, now time.Time, l cacheLimits) {
+	if l.size == 0 || l.ttl == 0 {
+		return
+	}
+	key := cc.keyFor(u, p)
+	cc.Lock()
+	defer cc.Unlock()
+	if el, ok := cc.entries[key]; ok {
+		cc.remove(el)
+	}
+	for cc.order.Len() >= l.size {
+		cc.remove(cc.order.Back())
+	}
+	cc.entries[key] = cc.order.PushFront(&cachedLogin{key: key, hash: ph, expires: now.Add(l.ttl)})
+}
+
+func (cc *credentialCache) remove(el *list.Element) {
+	cc.order.Remove(el)
+	delete(cc.entries, el.Value.(*cachedLogin).key)
+}
+
+func (cc *credentialCache) size() int {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.order.Len()
+}
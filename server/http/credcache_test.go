@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var testCacheLimits = cacheLimits{size: 2, ttl: time.Duration(1) * time.Minute}
+
+func (s *HTTPServerSuite) Test_credentialCache_remembersSuccessfulLoginsForAWhile(c *C) {
+	cc := newCredentialCache()
+	ph := &passwordHash{}
+	now := time.Now()
+
+	c.Assert(cc.contains("sita", "secret", ph, now), Equals, false)
+	cc.add("sita", "secret", ph, now, testCacheLimits)
+	c.Assert(cc.contains("sita", "secret", ph, now), Equals, true)
+	c.Assert(cc.contains("sita", "wrong", ph, now), Equals, false)
+	c.Assert(cc.contains("rama", "secret", ph, now), Equals, false)
+	c.Assert(cc.contains("sita", "secret", ph, now.Add(time.Duration(1)*time.Minute)), Equals, false)
+	c.Assert(cc.size(), Equals, 0)
+}
+
+func (s *HTTPServerSuite) Test_credentialCache_forgetsLoginsWhenThePasswordHashChanges(c *C) {
+	cc := newCredentialCache()
+	now := time.Now()
+
+	cc.add("sita", "secret", &passwordHash{}, now, testCacheLimits)
+	c.Assert(cc.contains("sita", "secret", &passwordHash{}, now), Equals, false)
+	c.Assert(cc.size(), Equals, 0)
+}
+
+func (s *HTTPServerSuite) Test_credentialCache_forgetsTheLeastRecentlyUsedLogins(c *C) {
+	cc := newCredentialCache()
+	ph := &passwordHash{}
+	now := time.Now()
+
+	cc.add("sita", "secret", ph, now, testCacheLimits)
+	cc.add("rama", "secret", ph, now, testCacheLimits)
+	cc.contains("sita", "secret", ph, now)
+	cc.add("lakshmana", "secret", ph, now, testCacheLimits)
+
+	c.Assert(cc.size(), Equals, 2)
+	c.Assert(cc.contains("sita", "secret", ph, now), Equals, true)
+	c.Assert(cc.contains("rama", "secret", ph, now), Equals, false)
+	c.Assert(cc.contains("lakshmana", "secret", ph, now), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_credentialCache_canBeDisabled(c *C) {
+	cc := newCredentialCache()
+	cc.add("sita", "secret", &passwordHash{}, time.Now(), cacheLimits{size: 0, ttl: time.Duration(1) * time.Minute})
+	c.Assert(cc.size(), Equals, 0)
+}
+
+func (s *HTTPServerSuite) Test_checkCredentials_doesNotHashAgainForRememberedLogins(c *C) {
+	_, done := withPasswordFile("sita:" + testHash("secret") + "\n")
+	defer done()
+	loadUsers()
+
+	c.Assert(checkCredentials("sita", "secret"), Equals, true)
+	// Replacing the stored hash in place would make a real check fail
+	users["sita"].hash = make([]byte, hashLength)
+	c.Assert(checkCredentials("sita", "secret"), Equals, true)
+	c.Assert(checkCredentials("sita", "wrong"), Equals, false)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// Passwords are stored as self-describing scrypt hashes:
+//
+//   $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+//
+// where ln is the base 2 logarithm of the cost parameter N, r is the block size and p the
+// parallelization parameter. The salt is random for every user, and both the salt and the hash
+// are base64 encoded without padding.
+// Older password files contain base64 encoded hashes made with one salt shared by every user.
+// Those are still accepted, and replaced with a new hash the next time the user logs in. A hash
+// made with other parameters than the configured ones is replaced the same way.
+
+const hashPrefix = "$scrypt$"
+const hashSaltLength = 16
+const hashLength = 32
+
+var legacyHashSalt = []byte{0xDD, 0x59, 0x1B, 0x22, 0xDE, 0xAC, 0x5B, 0xDA}
+
+var legacyHashParams = hashParams{logN: 15, r: 8, p: 1}
+
+var hashEncoding = base64.RawStdEncoding
+
+type hashParams struct {
+	logN int
+	r    int
+	p    int
+}
+
+type passwordHash struct {
+	params hashParams
+	salt   []byte
+	hash   []byte
+	legacy bool
+}
+
+func currentHashParams() hashParams {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return hashParams{logN: int(*scryptCost), r: int(*scryptBlockSize), p: int(*scryptParallelism)}
+}
+
+func (p hashParams) validate() error {
+	if p.logN < 1 || p.logN > 30 {
+		return fmt.Errorf("the scrypt cost has to be between 1 and 30, not %d", p.logN)
+	}
+	if p.r < 1 || p.p < 1 || uint64(p.r)*uint64(p.p) >= 1<<30 {
+		return errors.New("the scrypt block size and parallelism have to be positive, and their product less than 2^30")
+	}
+	return nil
+}
+
+func (p hashParams) String() string {
+	return fmt.Sprintf("ln=%d,r=%d,p=%d", p.logN, p.r, p.p)
+}
+
+func parseHashParams(s string) (hashParams, error) {
+	p := hashParams{}
+	if _, e := fmt.Sscanf(s, "ln=%d,r=%d,p=%d", &p.logN, &p.r, &p.p); e != nil || p.String() != s {
+		return p, fmt.Errorf("invalid scrypt parameters %q", s)
+	}
+	return p, p.validate()
+}
+
+func scryptKey(password string, salt []byte, p hashParams) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, 1<<uint(p.logN), p.r, p.p, hashLength)
+}
+
+// newPasswordHash hashes the password with a new random salt
+func newPasswordHash(password string, p hashParams) (*passwordHash, error) {
+	if e := p.validate(); e != nil {
+		return nil, e
+	}
+	salt := make([]byte, hashSaltLength)
+	if _, e := rand.Read(salt); e != nil {
+		return nil, e
+	}
+	h, e := scryptKey(password, salt, p)
+	if e != nil {
+		return nil, e
+	}
+	return &passwordHash{params: p, salt: salt, hash: h}, nil
+}
+
+// parsePasswordHash parses a hash in either the current or the legacy format
+func parsePasswordHash(s string) (*passwordHash, error) {
+	if !strings.HasPrefix(s, "$") {
+		h, e := base64.StdEncoding.DecodeString(s)
+		if e != nil || len(h) != hashLength {
+			return nil, errors.New("invalid password hash")
+		}
+		return &passwordHash{params: legacyHashParams, salt: legacyHashSalt, hash: h, legacy: true}, nil
+	}
+
+	if !strings.HasPrefix(s, hashPrefix) {
+		return nil, errors.New("unknown password hash algorithm")
+	}
+	parts := strings.Split(strings.TrimPrefix(s, hashPrefix), "$")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid password hash")
+	}
+	p, e := parseHashParams(parts[0])
+	if e != nil {
+		return nil, e
+	}
+	salt, e := hashEncoding.DecodeString(parts[1])
+	if e != nil || len(salt) == 0 {
+		return nil, errors.New("invalid salt in password hash")
+	}
+	h, e := hashEncoding.DecodeString(parts[2])
+	if e != nil || len(h) != hashLength {
+		return nil, errors.New("invalid password hash")
+	}
+	return &passwordHash{params: p, salt: salt, hash: h}, nil
+}
+
+func (ph *passwordHash) String() string {
+	if ph.legacy {
+		return base64.StdEncoding.EncodeToString(ph.hash)
+	}
+	return hashPrefix + ph.params.String() + "$" + hashEncoding.EncodeToString(ph.salt) + "$" + hashEncoding.EncodeToString(ph.hash)
+}
+
+// verify checks the password against the hash, in constant time
+func (ph *passwordHash) verify(password string) bool {
+	h, e := scryptKey(password, ph.salt, ph.params)
+	if e != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(h, ph.hash) == 1
+}
+
+// needsUpgrade returns true if the hash should be replaced by one made with the given parameters
+func (ph *passwordHash) needsUpgrade(p hashParams) bool {
+	return ph.legacy || ph.params != p
+}
+
+var dummyHashes = map[hashParams]*passwordHash{}
+var dummyHashesLock sync.Mutex
+
+// dummyHash returns a hash to verify passwords of unknown users against, so that checking them
+// takes as long as checking the password of a user that exists
+func dummyHash(p hashParams) *passwordHash {
+	dummyHashesLock.Lock()
+	defer dummyHashesLock.Unlock()
+	if dh, ok := dummyHashes[p]; ok {
+		return dh
+	}
+	dh, e := newPasswordHash("", p)
+	if e != nil {
+		dh = &passwordHash{params: legacyHashParams, salt: legacyHashSalt, hash: make([]byte, hashLength)}
+	}
+	dummyHashes[p] = dh
+	return dh
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+
+	"golang.org/x/crypto/scrypt"
+	. "gopkg.in/check.v1"
+)
+
+var testHashParams = hashParams{logN: 4, r: 8, p: 1}
+
+func (s *HTTPServerSuite) Test_newPasswordHash_usesARandomSaltForEveryHash(c *C) {
+	ph1, e := newPasswordHash("secret", testHashParams)
+	c.Assert(e, IsNil)
+	ph2, _ := newPasswordHash("secret", testHashParams)
+
+	c.Assert(ph1.salt, HasLen, hashSaltLength)
+	c.Assert(ph1.salt, Not(DeepEquals), ph2.salt)
+	c.Assert(ph1.hash, Not(DeepEquals), ph2.hash)
+	c.Assert(ph1.verify("secret"), Equals, true)
+	c.Assert(ph2.verify("secret"), Equals, true)
+	c.Assert(ph1.verify("Secret"), Equals, false)
+}
+
+func (s *HTTPServerSuite) Test_newPasswordHash_refusesInvalidParameters(c *C) {
+	_, e := newPasswordHash("secret", hashParams{logN: 31, r: 8, p: 1})
+	c.Assert(e, ErrorMatches, "the scrypt cost has to be between 1 and 30, not 31")
+	_, e = newPasswordHash("secret", hashParams{logN: 4, r: 0, p: 1})
+	c.Assert(e, ErrorMatches, "the scrypt block size and parallelism have to be positive.*")
+}
+
+func (s *HTTPServerSuite) Test_passwordHash_String_canBeParsedAgain(c *C) {
+	ph, _ := newPasswordHash("secret", testHashParams)
+	str := ph.String()
+	c.Assert(str, Matches, `\$scrypt\$ln=4,r=8,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}`)
+
+	parsed, e := parsePasswordHash(str)
+	c.Assert(e, IsNil)
+	c.Assert(parsed, DeepEquals, ph)
+	c.Assert(parsed.verify("secret"), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_parsePasswordHash_acceptsLegacyHashes(c *C) {
+	h, _ := scrypt.Key([]byte("secret"), legacyHashSalt, 1<<15, 8, 1, 32)
+	legacy := base64.StdEncoding.EncodeToString(h)
+
+	ph, e := parsePasswordHash(legacy)
+	c.Assert(e, IsNil)
+	c.Assert(ph.legacy, Equals, true)
+	c.Assert(ph.String(), Equals, legacy)
+	c.Assert(ph.verify("secret"), Equals, true)
+	c.Assert(ph.verify("secrets"), Equals, false)
+	c.Assert(ph.needsUpgrade(legacyHashParams), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_parsePasswordHash_returnsErrors(c *C) {
+	expected := map[string]string{
+		"":                                    "invalid password hash",
+		"abc":                                 "invalid password hash",
+		"$argon2id$v=19$abc$def":              "unknown password hash algorithm",
+		"$scrypt$ln=4,r=8,p=1$c2FsdA":         "invalid password hash",
+		"$scrypt$ln=4,r=8$c2FsdA$aGFzaA":      `invalid scrypt parameters "ln=4,r=8"`,
+		"$scrypt$ln=40,r=8,p=1$c2FsdA$aGFzaA": "the scrypt cost has to be between 1 and 30, not 40",
+		"$scrypt$ln=4,r=8,p=1$$aGFzaA":        "invalid salt in password hash",
+		"$scrypt$ln=4,r=8,p=1$c2FsdA$aGFzaA":  "invalid password hash",
+		"$scrypt$ln=4,r=8,p=1$c2FsdA$!!!!AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA": "invalid password hash",
+	}
+	for h, msg := range expected {
+		_, e := parsePasswordHash(h)
+		c.Assert(e, ErrorMatches, msg, Commentf("%s", h))
+	}
+}
+
+func (s *HTTPServerSuite) Test_passwordHash_needsUpgrade_whenTheParametersChange(c *C) {
+	ph, _ := newPasswordHash("secret", testHashParams)
+	c.Assert(ph.needsUpgrade(testHashParams), Equals, false)
+	c.Assert(ph.needsUpgrade(hashParams{logN: 5, r: 8, p: 1}), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_dummyHash_isReusedForTheSameParameters(c *C) {
+	c.Assert(dummyHash(testHashParams), Equals, dummyHash(testHashParams))
+	c.Assert(dummyHash(testHashParams).verify("secret"), Equals, false)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// When the raw server only accepts frames from trusted gateways, every frame
+// we forward has to be signed with the secret we share with it. The format is
+// documented in server/internal/frame/auth.go
+// The secret file contains the base64 encoded secret on one line.
+
+var gatewaySecret []byte
+var gatewaySecretLock sync.RWMutex
+
+func loadGatewaySecret() error {
+	if *gatewaySecretFile == "" {
+		return nil
+	}
+	if *gatewayID == "" {
+		return errors.New("a gateway secret file is given, but no gateway ID")
+	}
+
+	secret, e := frame.ReadSecret(*gatewaySecretFile)
+	if e != nil {
+		return e
+	}
+
+	gatewaySecretLock.Lock()
+	defer gatewaySecretLock.Unlock()
+	gatewaySecret = secret
+	return nil
+}
+
+func currentGatewaySecret() []byte {
+	gatewaySecretLock.RLock()
+	defer gatewaySecretLock.RUnlock()
+	return gatewaySecret
+}
+
+func encodeFrame(u string, data []byte) ([]byte, error) {
+	pe := &frame.Element{From: u, Data: string(data)}
+	secret := currentGatewaySecret()
+	if secret == nil {
+		return frame.Encode(pe)
+	}
+	return frame.EncodeAuthenticated(*gatewayID, secret, time.Now(), pe)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The from-address used for a request is chosen from the identities the authenticated user is
+// allowed to publish for. Users listed in the identities file can use the identities given there;
+// all other users get one identity, made from the from-template by replacing {user} with their
+// name - for example, {user}@chat.example.org.
+// A client can pick one of its identities for a request with the X-Prekey-Identity header, or the
+// identity query parameter. Without a choice, the first identity is used.
+//
+// The identities file contains one user on each line, as user:identity,identity,...
+// Empty lines and lines starting with # are ignored. The file is read again on SIGHUP.
+
+const identityHeader = "X-Prekey-Identity"
+const identityParameter = "identity"
+const userPlaceholder = "{user}"
+
+var identityTable map[string][]string
+var identityTableLock sync.RWMutex
+
+// identityError is returned when a user asks for an identity they're not allowed to use
+type identityError struct {
+	user     string
+	identity string
+}
+
+func (ie *identityError) Error() string {
+	return fmt.Sprintf("%s is not allowed to use the identity %s", ie.user, ie.identity)
+}
+
+func parseIdentityTable(data []byte) (map[string][]string, error) {
+	result := make(map[string][]string)
+	for ix, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d is not in the format user:identity,identity,...", ix+1)
+		}
+		ids := []string{}
+		for _, id := range strings.Split(parts[1], ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("line %d: no identities given for %s", ix+1, parts[0])
+		}
+		result[parts[0]] = append(result[parts[0]], ids...)
+	}
+	return result, nil
+}
+
+// loadIdentities reads the identities file, if one is given
+func loadIdentities() error {
+	table := map[string][]string{}
+	if *identitiesFile != "" {
+		d, e := ioutil.ReadFile(*identitiesFile)
+		if e != nil {
+			return e
+		}
+		table, e = parseIdentityTable(d)
+		if e != nil {
+			return fmt.Errorf("%s: %v", *identitiesFile, e)
+		}
+	}
+
+	identityTableLock.Lock()
+	defer identityTableLock.Unlock()
+	identityTable = table
+	return nil
+}
+
+func currentFromTemplate() string {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return *fromTemplate
+}
+
+// identitiesFor returns the identities the user is allowed to use, the default one first
+func identitiesFor(user string) []string {
+	identityTableLock.RLock()
+	ids, ok := identityTable[user]
+	identityTableLock.RUnlock()
+	if ok {
+		return ids
+	}
+	return []string{strings.Replace(currentFromTemplate(), userPlaceholder, user, -1)}
+}
+
+func requestedIdentity(r *http.Request) string {
+	if id := r.Header.Get(identityHeader); id != "" {
+		return id
+	}
+	return r.URL.Query().Get(identityParameter)
+}
+
+// chooseIdentity returns the from-address to use for the user, given the identity they asked for, if any
+func chooseIdentity(user, requested string) (string, error) {
+	ids := identitiesFor(user)
+	if requested == "" {
+		return ids[0], nil
+	}
+	for _, id := range ids {
+		if id == requested {
+			return id, nil
+		}
+	}
+	return "", &identityError{user: user, identity: requested}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+func withIdentities(template, table string) func() {
+	restore := command.WithFlags("from-template", "identities-file")
+	*fromTemplate = template
+	f, _ := ioutil.TempFile("", "otrng-http-identities")
+	f.WriteString(table)
+	f.Close()
+	*identitiesFile = f.Name()
+	if e := loadIdentities(); e != nil {
+		panic(e)
+	}
+	return func() {
+		os.Remove(f.Name())
+		restore()
+		loadIdentities()
+	}
+}
+
+func (s *HTTPServerSuite) Test_parseIdentityTable_parsesUsersAndTheirIdentities(c *C) {
+	table, e := parseIdentityTable([]byte("# service accounts\nbot: a@example.org, b@example.org\n\nbot:c@example.org\nsita:sita@example.org\n"))
+	c.Assert(e, IsNil)
+	c.Assert(table, DeepEquals, map[string][]string{
+		"bot":  []string{"a@example.org", "b@example.org", "c@example.org"},
+		"sita": []string{"sita@example.org"},
+	})
+}
+
+func (s *HTTPServerSuite) Test_parseIdentityTable_returnsErrors(c *C) {
+	_, e := parseIdentityTable([]byte("sita@example.org\n"))
+	c.Assert(e, ErrorMatches, "line 1 is not in the format user:identity,identity,...")
+	_, e = parseIdentityTable([]byte("\n:sita@example.org\n"))
+	c.Assert(e, ErrorMatches, "line 2 is not in the format user:identity,identity,...")
+	_, e = parseIdentityTable([]byte("sita: , \n"))
+	c.Assert(e, ErrorMatches, "line 1: no identities given for sita")
+}
+
+func (s *HTTPServerSuite) Test_loadIdentities_returnsErrors(c *C) {
+	defer command.WithFlags("identities-file")()
+	*identitiesFile = "/somewhere/that/shouldn't/work"
+	c.Assert(loadIdentities(), ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *HTTPServerSuite) Test_chooseIdentity_usesTheTemplateForUsersNotInTheTable(c *C) {
+	defer withIdentities("{user}@chat.example.org", "bot:a@example.org,b@example.org\n")()
+
+	id, e := chooseIdentity("sita", "")
+	c.Assert(e, IsNil)
+	c.Assert(id, Equals, "sita@chat.example.org")
+	id, e = chooseIdentity("sita", "sita@chat.example.org")
+	c.Assert(e, IsNil)
+	c.Assert(id, Equals, "sita@chat.example.org")
+	_, e = chooseIdentity("sita", "rama@chat.example.org")
+	c.Assert(e, ErrorMatches, "sita is not allowed to use the identity rama@chat.example.org")
+}
+
+func (s *HTTPServerSuite) Test_chooseIdentity_onlyAllowsTheIdentitiesInTheTable(c *C) {
+	defer withIdentities("{user}@chat.example.org", "bot:a@example.org,b@example.org\n")()
+
+	id, e := chooseIdentity("bot", "")
+	c.Assert(e, IsNil)
+	c.Assert(id, Equals, "a@example.org")
+	id, e = chooseIdentity("bot", "b@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(id, Equals, "b@example.org")
+	_, e = chooseIdentity("bot", "bot@chat.example.org")
+	c.Assert(e, FitsTypeOf, &identityError{})
+}
+
+func (s *HTTPServerSuite) Test_requestedIdentity_prefersTheHeader(c *C) {
+	r, _ := http.NewRequest("POST", "http://localhost/prekeys?identity=a@example.org", nil)
+	c.Assert(requestedIdentity(r), Equals, "a@example.org")
+	r.Header.Set("X-Prekey-Identity", "b@example.org")
+	c.Assert(requestedIdentity(r), Equals, "b@example.org")
+}
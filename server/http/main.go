@@ -1,131 +1,169 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/base64"
+	"encoding/binary"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"golang.org/x/crypto/scrypt"
+	"github.com/otrv4/otrng-prekey-server/adapter"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
 )
 
-func loadUsers() {
-	users = make(map[string][]byte)
-	dd, e := ioutil.ReadFile(*passwordFile)
+var signalHandler = make(chan os.Signal, 1)
+
+func reload() {
+	ignored, e := reloadConfig()
 	if e != nil {
-		return
-	}
-	rr := bufio.NewReader(bytes.NewBuffer(dd))
-	for {
-		s, e := rr.ReadString('\n')
-		if s != "" {
-			s = s[:len(s)-1]
-			up := strings.SplitN(s, ":", 2)
-			decoded, _ := base64.StdEncoding.DecodeString(up[1])
-			users[up[0]] = decoded
+		command.Logf("Encountered error when reloading configuration, keeping the old settings: %v\n", e)
+	} else {
+		for _, s := range ignored {
+			command.Logf("The setting %s can't be changed without a restart, ignoring it\n", s)
 		}
-		if e != nil {
-			return
+		if e := command.OpenLog(logFile); e != nil {
+			command.Logf("Encountered error when opening log file: %v\n", e)
 		}
 	}
+	if e := loadUsers(); e != nil {
+		command.Logf("Encountered error when reading password file, keeping the old users: %v\n", e)
+	}
+	if e := loadGatewaySecret(); e != nil {
+		command.Logf("Encountered error when reloading gateway secret, keeping the old secret: %v\n", e)
+	}
+	if usesAuthMethod(*authMethods, "bearer") {
+		if e := loadTokenKeys(); e != nil {
+			command.Logf("Encountered error when reloading token keys, keeping the old keys: %v\n", e)
+		}
+	}
+	if e := loadIdentities(); e != nil {
+		command.Logf("Encountered error when reloading identities, keeping the old identities: %v\n", e)
+	}
+	if e := loadConnectTLS(); e != nil {
+		command.Logf("Encountered error when reloading TLS settings for the raw server, keeping the old settings: %v\n", e)
+	}
+	command.Logf("Reloaded configuration and password file\n")
 }
 
-var users map[string][]byte
+func handleSignals() {
+	signal.Notify(signalHandler, syscall.SIGHUP)
+	for range signalHandler {
+		reload()
+	}
+}
 
 func main() {
 	flag.Parse()
 
-	if *passwordHash != "" {
-		fmt.Println(base64.StdEncoding.EncodeToString(h(*passwordHash)))
+	if e := loadConfig(); e != nil {
+		fmt.Println(e)
 		return
 	}
 
-	loadUsers()
+	if *passwordToHash != "" {
+		ph, e := newPasswordHash(*passwordToHash, currentHashParams())
+		if e != nil {
+			fmt.Printf("encountered error when hashing password: %v\n", e)
+			return
+		}
+		fmt.Println(ph)
+		return
+	}
 
-	handler := http.NewServeMux()
-	handler.HandleFunc(*bindPath, prekeyHandler)
+	if flag.Arg(0) == "users" {
+		if e := runUsersCommand(flag.Args()[1:], os.Stdin, os.Stdout); e != nil {
+			fmt.Println(e)
+			os.Exit(1)
+		}
+		return
+	}
 
-	addr := net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort))
+	if e := command.OpenLog(logFile); e != nil {
+		fmt.Printf("encountered error when opening log file: %v\n", e)
+		return
+	}
 
-	if !*runTLS {
-		http.ListenAndServe(addr, handler)
-	} else {
-		http.ListenAndServeTLS(addr, *fileCert, *filePrivateKey, handler)
+	if e := loadGatewaySecret(); e != nil {
+		command.Logf("encountered error when loading gateway secret: %v\n", e)
+		return
 	}
-}
 
-var hashSalt = []byte{0xDD, 0x59, 0x1B, 0x22, 0xDE, 0xAC, 0x5B, 0xDA}
+	if e := loadConnectTLS(); e != nil {
+		command.Logf("encountered error when loading TLS settings for the raw server: %v\n", e)
+		return
+	}
 
-func h(s string) []byte {
-	val, _ := scrypt.Key([]byte(s), hashSalt, 1<<15, 8, 1, 32)
-	return val[:]
-}
+	if e := loadSharedState(); e != nil {
+		command.Logf("encountered error when creating the shared state store: %v\n", e)
+		return
+	}
 
-func getPwdFor(u string) ([]byte, bool) {
-	return users[u], true
-}
+	if e := loadAuthenticators(); e != nil {
+		command.Logf("encountered error when setting up authentication: %v\n", e)
+		return
+	}
 
-func prekeyHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.NotFound(w, r)
+	if e := loadIdentities(); e != nil {
+		command.Logf("encountered error when loading identities: %v\n", e)
 		return
 	}
 
-	u, p, ok := r.BasicAuth()
+	if e := loadUsers(); e != nil {
+		command.Logf("Encountered error when reading password file: %v\n", e)
+	}
+	if *pwdCheckInterval > 0 {
+		go watchPasswordFile(time.Duration(*pwdCheckInterval) * time.Second)
+	}
+	go handleSignals()
 
-	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="prekey server"`)
-		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+	if e := startAdmin(); e != nil {
+		command.Logf("encountered error when starting admin listener: %v\n", e)
 		return
 	}
 
-	p2, ok2 := getPwdFor(u)
-	if !(ok2 && bytes.Equal(h(p), p2)) {
-		w.Header().Set("WWW-Authenticate", `Basic realm="prekey server"`)
-		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
-		return
+	transport := newHTTPTransport()
+	runner := &adapter.Runner{
+		Server:        rawServerClient{},
+		MaxConcurrent: int(*maxConcurrent),
+		Logf:          command.Logf,
 	}
+	go runner.Run(transport)
+	defer transport.Close()
 
-	bod, _ := ioutil.ReadAll(r.Body)
-	res := getPrekeyResponseFromRealServer(u, bod)
-	w.Write(res)
-}
+	handler := http.NewServeMux()
+	handler.Handle(*bindPath, transport)
+	if *wsPath != "" {
+		handler.Handle(*wsPath, &websocketHandler{runner: runner})
+	}
 
-func getPrekeyResponseFromRealServer(u string, data []byte) []byte {
-	addr, _ := net.ResolveTCPAddr("tcp", net.JoinHostPort(*connectIP, fmt.Sprintf("%d", *connectPort)))
-	con, _ := net.DialTCP(addr.Network(), nil, addr)
-	defer con.Close()
-
-	toSend := []byte{}
-	toSend = appendShort(toSend, uint16(len(u)))
-	toSend = append(toSend, []byte(u)...)
-	toSend = appendShort(toSend, uint16(len(data)))
-	toSend = append(toSend, data...)
-	con.Write(toSend)
-	con.CloseWrite()
-	res, _ := ioutil.ReadAll(con)
-	res2, ss, _ := extractShort(res)
-	if uint16(len(res2)) != ss {
-		fmt.Printf("Unexpected length of data received\n")
-		return nil
-	}
-	return res2
-}
+	srv := &http.Server{
+		Addr:         net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)),
+		Handler:      handler,
+		ReadTimeout:  time.Duration(*readTimeout) * time.Second,
+		WriteTimeout: time.Duration(*writeTimeout) * time.Second,
+	}
 
-func appendShort(l []byte, r uint16) []byte {
-	return append(l, byte(r>>8), byte(r))
+	var e error
+	if !*runTLS {
+		e = srv.ListenAndServe()
+	} else {
+		e = srv.ListenAndServeTLS(*fileCert, *filePrivateKey)
+	}
+	command.Logf("encountered error when running server: %v\n", e)
 }
 
-func extractShort(d []byte) ([]byte, uint16, bool) {
-	if len(d) < 2 {
-		return nil, 0, false
-	}
+func currentMaxBodySize() int64 {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return int64(*maxBodySize)
+}
 
-	return d[2:], uint16(d[0])<<8 |
-		uint16(d[1]), true
+func appendUint64(l []byte, r uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, r)
+	return append(l, b...)
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// rawServerClient forwards messages to the raw server. Every message is sent over its own
+// connection, and the replies are all the packets the raw server writes back before closing it.
+type rawServerClient struct{}
+
+func (rawServerClient) Handle(from, message string) ([]string, error) {
+	toSend, e := encodeFrame(from, []byte(message))
+	if e != nil {
+		return nil, e
+	}
+
+	con, e := dialRawServer()
+	if e != nil {
+		return nil, e
+	}
+	defer con.Close()
+
+	if _, e := con.Write(toSend); e != nil {
+		return nil, e
+	}
+	if e := con.CloseWrite(); e != nil {
+		return nil, e
+	}
+	res, e := ioutil.ReadAll(con)
+	if e != nil {
+		return nil, e
+	}
+	return frame.ParsePackets(res)
+}
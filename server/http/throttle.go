@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// Failed logins are counted for every username and for every source address. When either
+// has failed too many times, further attempts are refused without checking the password,
+// for a time that doubles with every failure. After even more failures the username or address
+// is locked out for a longer time. The counters are forgotten once there have been no
+// failures for as long as the lockout time, and the counter for a user is reset when they log in.
+
+type authLimits struct {
+	backoffAfter int
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	lockoutAfter int
+	lockout      time.Duration
+	maxTracked   int
+}
+
+func currentAuthLimits() authLimits {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return authLimits{
+		backoffAfter: int(*authBackoffAfter),
+		backoff:      time.Duration(*authBackoffTime) * time.Second,
+		maxBackoff:   time.Duration(*authMaxBackoff) * time.Second,
+		lockoutAfter: int(*authLockoutAfter),
+		lockout:      time.Duration(*authLockoutTime) * time.Second,
+		maxTracked:   int(*authMaxTracked),
+	}
+}
+
+// delayAfter returns how long to refuse attempts after the given number of failures
+func (l authLimits) delayAfter(failures int) time.Duration {
+	if l.lockoutAfter > 0 && failures >= l.lockoutAfter {
+		return l.lockout
+	}
+	if l.backoffAfter == 0 || failures < l.backoffAfter {
+		return 0
+	}
+	d := l.backoff
+	for ix := l.backoffAfter; ix < failures && d < l.maxBackoff; ix++ {
+		d *= 2
+	}
+	if d > l.maxBackoff {
+		return l.maxBackoff
+	}
+	return d
+}
+
+type failureRecord struct {
+	failures     int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// failureTracker counts failed logins for one kind of key - usernames or addresses
+type failureTracker struct {
+	sync.Mutex
+	kind    string
+	entries map[string]*failureRecord
+}
+
+func newFailureTracker(kind string) *failureTracker {
+	return &failureTracker{kind: kind, entries: make(map[string]*failureRecord)}
+}
+
+var userFailures = newFailureTracker("user")
+var addressFailures = newFailureTracker("address")
+
+// blocked returns how long attempts for the key will be refused
+func (ft *failureTracker) blocked(key string, now time.Time) time.Duration {
+	ft.Lock()
+	defer ft.Unlock()
+	if r, ok := ft.entries[key]; ok && now.Before(r.blockedUntil) {
+		return r.blockedUntil.Sub(now)
+	}
+	return 0
+}
+
+func (ft *failureTracker) fail(key string, now time.Time, l authLimits) {
+	ft.Lock()
+	defer ft.Unlock()
+
+	r, ok := ft.entries[key]
+	if !ok || now.Sub(r.last) >= l.lockout {
+		ft.makeRoom(now, l)
+		r = &failureRecord{}
+		ft.entries[key] = r
+	}
+	r.failures++
+	r.last = now
+	d := l.delayAfter(r.failures)
+	r.blockedUntil = now.Add(d)
+
+	switch {
+	case l.lockoutAfter > 0 && r.failures == l.lockoutAfter:
+		command.Logf("Locking out %s %s for %v after %d failed logins\n", ft.kind, key, d, r.failures)
+	case r.failures == l.backoffAfter:
+		command.Logf("Repeated failed logins for %s %s, delaying further attempts\n", ft.kind, key)
+	}
+}
+
+func (ft *failureTracker) succeed(key string) {
+	ft.Lock()
+	defer ft.Unlock()
+	delete(ft.entries, key)
+}
+
+// makeRoom forgets old failures, and if too many keys are still tracked, the one that failed
+// longest ago
+func (ft *failureTracker) makeRoom(now time.Time, l authLimits) {
+	if len(ft.entries) < l.maxTracked {
+		return
+	}
+	oldest := ""
+	for k, r := range ft.entries {
+		if now.Sub(r.last) >= l.lockout {
+			delete(ft.entries, k)
+		} else if oldest == "" || r.last.Before(ft.entries[oldest].last) {
+			oldest = k
+		}
+	}
+	if len(ft.entries) >= l.maxTracked {
+		delete(ft.entries, oldest)
+	}
+}
+
+// throttledError is returned when a login is refused without checking the password
+type throttledError struct {
+	retryAfter time.Duration
+}
+
+func (te *throttledError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %v", te.retryAfter)
+}
+
+func remoteAddress(r *http.Request) string {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLogin checks the username and password of a login from the given address
+func checkLogin(u, p, addr string) error {
+	now := time.Now()
+	wait := userFailures.blocked(u, now)
+	if aw := addressFailures.blocked(addr, now); aw > wait {
+		wait = aw
+	}
+	if wait > 0 {
+		return &throttledError{retryAfter: (wait + time.Second - 1).Truncate(time.Second)}
+	}
+
+	if !checkCredentials(u, p) {
+		l := currentAuthLimits()
+		userFailures.fail(u, now, l)
+		addressFailures.fail(addr, now, l)
+		return errInvalidCredentials
+	}
+	userFailures.succeed(u)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+var testAuthLimits = authLimits{
+	backoffAfter: 3,
+	backoff:      time.Duration(1) * time.Second,
+	maxBackoff:   time.Duration(8) * time.Second,
+	lockoutAfter: 10,
+	lockout:      time.Duration(15) * time.Minute,
+	maxTracked:   3,
+}
+
+func (s *HTTPServerSuite) Test_authLimits_delayAfter_backsOffExponentiallyAndThenLocksOut(c *C) {
+	expected := []time.Duration{0, 0, 0, 1, 2, 4, 8, 8, 8, 8}
+	for ix, d := range expected {
+		c.Assert(testAuthLimits.delayAfter(ix), Equals, d*time.Second, Commentf("%d failures", ix))
+	}
+	c.Assert(testAuthLimits.delayAfter(10), Equals, time.Duration(15)*time.Minute)
+	c.Assert(testAuthLimits.delayAfter(11), Equals, time.Duration(15)*time.Minute)
+}
+
+func (s *HTTPServerSuite) Test_authLimits_delayAfter_canBeDisabled(c *C) {
+	l := authLimits{lockout: time.Duration(1) * time.Minute}
+	c.Assert(l.delayAfter(1000), Equals, time.Duration(0))
+}
+
+func (s *HTTPServerSuite) Test_failureTracker_blocksKeysAfterRepeatedFailures(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+	ft := newFailureTracker("user")
+	now := time.Now()
+
+	for ix := 0; ix < 3; ix++ {
+		c.Assert(ft.blocked("sita", now), Equals, time.Duration(0))
+		ft.fail("sita", now, testAuthLimits)
+	}
+	c.Assert(ft.blocked("sita", now), Equals, time.Duration(1)*time.Second)
+	c.Assert(ft.blocked("sita", now.Add(time.Duration(1)*time.Second)), Equals, time.Duration(0))
+	c.Assert(ft.blocked("rama", now), Equals, time.Duration(0))
+
+	for ix := 3; ix < 10; ix++ {
+		ft.fail("sita", now, testAuthLimits)
+	}
+	c.Assert(ft.blocked("sita", now.Add(time.Duration(14)*time.Minute)), Equals, time.Duration(1)*time.Minute)
+
+	ft.succeed("sita")
+	c.Assert(ft.blocked("sita", now), Equals, time.Duration(0))
+	c.Assert(capture.finish(), Equals, ""+
+		"Repeated failed logins for user sita, delaying further attempts\n"+
+		"Locking out user sita for 15m0s after 10 failed logins\n")
+}
+
+func (s *HTTPServerSuite) Test_failureTracker_forgetsOldFailures(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+	ft := newFailureTracker("address")
+	now := time.Now()
+
+	ft.fail("192.0.2.1", now, testAuthLimits)
+	ft.fail("192.0.2.1", now, testAuthLimits)
+	later := now.Add(time.Duration(15) * time.Minute)
+	ft.fail("192.0.2.1", later, testAuthLimits)
+	c.Assert(ft.entries["192.0.2.1"].failures, Equals, 1)
+	c.Assert(capture.finish(), Equals, "")
+}
+
+func (s *HTTPServerSuite) Test_failureTracker_onlyTracksALimitedNumberOfKeys(c *C) {
+	ft := newFailureTracker("address")
+	now := time.Now()
+
+	ft.fail("192.0.2.1", now.Add(time.Duration(-20)*time.Minute), testAuthLimits)
+	ft.fail("192.0.2.2", now.Add(time.Duration(-2)*time.Minute), testAuthLimits)
+	ft.fail("192.0.2.3", now.Add(time.Duration(-3)*time.Minute), testAuthLimits)
+	ft.fail("192.0.2.4", now, testAuthLimits)
+	c.Assert(ft.entries, HasLen, 3)
+	c.Assert(ft.entries["192.0.2.1"], IsNil)
+
+	ft.fail("192.0.2.5", now, testAuthLimits)
+	c.Assert(ft.entries, HasLen, 3)
+	c.Assert(ft.entries["192.0.2.3"], IsNil)
+}
+
+func (s *HTTPServerSuite) Test_remoteAddress_leavesOutThePort(c *C) {
+	c.Assert(remoteAddress(&http.Request{RemoteAddr: "192.0.2.1:4567"}), Equals, "192.0.2.1")
+	c.Assert(remoteAddress(&http.Request{RemoteAddr: "[2001:db8::1]:4567"}), Equals, "2001:db8::1")
+	c.Assert(remoteAddress(&http.Request{RemoteAddr: "@"}), Equals, "@")
+}
+
+func (s *HTTPServerSuite) Test_checkLogin_refusesAttemptsWithoutCheckingThePassword(c *C) {
+	_, done := withPasswordFile("sita:" + testHash("secret") + "\n")
+	defer done()
+	defer command.WithFlags("auth-backoff-after", "auth-lockout-after")()
+	*authBackoffAfter = 2
+	*authLockoutAfter = 0
+	loadUsers()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	defer func() {
+		userFailures.succeed("sita")
+		userFailures.succeed("rama")
+		addressFailures.succeed("192.0.2.1")
+		addressFailures.succeed("192.0.2.2")
+	}()
+
+	c.Assert(checkLogin("sita", "wrong", "192.0.2.1"), Equals, errInvalidCredentials)
+	c.Assert(checkLogin("sita", "wrong", "192.0.2.2"), Equals, errInvalidCredentials)
+	e := checkLogin("sita", "secret", "192.0.2.2")
+	c.Assert(e, FitsTypeOf, &throttledError{})
+	c.Assert(e, ErrorMatches, "too many failed logins, try again in 1s")
+
+	userFailures.succeed("sita")
+	c.Assert(checkLogin("sita", "secret", "192.0.2.2"), IsNil)
+	c.Assert(checkLogin("rama", "secret", "192.0.2.1"), Equals, errInvalidCredentials)
+	c.Assert(checkLogin("sita", "secret", "192.0.2.1"), ErrorMatches, "too many failed logins.*")
+	c.Assert(capture.finish(), Equals, ""+
+		"Repeated failed logins for user sita, delaying further attempts\n"+
+		"Repeated failed logins for address 192.0.2.1, delaying further attempts\n")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// When the raw server only accepts TLS connections, we connect to it using TLS,
+// verifying its certificate with the given CA file, or the system roots if none is given.
+// If a client certificate and key are given, they will be presented to the raw server,
+// which can use them to decide what we are allowed to do.
+// The CA file and the client certificate are read again on SIGHUP.
+
+type rawServerTLS struct {
+	roots *x509.CertPool
+	cert  *tls.Certificate
+}
+
+var connectTLSSettings *rawServerTLS
+var connectTLSLock sync.RWMutex
+
+func loadConnectTLS() error {
+	if !*connectTLS {
+		return nil
+	}
+	if (*connectCertFile == "") != (*connectKeyFile == "") {
+		return errors.New("both a client certificate file and a client key file are needed")
+	}
+
+	res := &rawServerTLS{}
+	if *connectCAFile != "" {
+		d, e := ioutil.ReadFile(*connectCAFile)
+		if e != nil {
+			return e
+		}
+		res.roots = x509.NewCertPool()
+		if !res.roots.AppendCertsFromPEM(d) {
+			return fmt.Errorf("%s: no certificates found", *connectCAFile)
+		}
+	}
+	if *connectCertFile != "" {
+		cert, e := tls.LoadX509KeyPair(*connectCertFile, *connectKeyFile)
+		if e != nil {
+			return e
+		}
+		res.cert = &cert
+	}
+
+	connectTLSLock.Lock()
+	defer connectTLSLock.Unlock()
+	connectTLSSettings = res
+	return nil
+}
+
+func currentConnectTLSConfig() *tls.Config {
+	connectTLSLock.RLock()
+	defer connectTLSLock.RUnlock()
+	if connectTLSSettings == nil {
+		return nil
+	}
+
+	res := &tls.Config{
+		RootCAs:    connectTLSSettings.roots,
+		ServerName: *connectServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if res.ServerName == "" {
+		res.ServerName = *connectIP
+	}
+	if connectTLSSettings.cert != nil {
+		res.Certificates = []tls.Certificate{*connectTLSSettings.cert}
+	}
+	return res
+}
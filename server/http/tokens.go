@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The bearer authenticator accepts signed tokens from an identity provider, in the JSON Web Token
+// compact format: base64url encoded header, claims and signature, separated by dots. The tokens
+// have to be signed with EdDSA (Ed25519) or HS256 (HMAC-SHA256), using one of the keys in the
+// token keys file. The issuer and audience both have to be configured, and the iss and aud claims
+// of the token have to match them. The token has to have
+// an expiry and not have expired, and the subject claim gives the name of the user.
+//
+// The token keys file contains one key on each line, as id:algorithm:key, where the key is the
+// base64 encoded Ed25519 public key or HMAC secret. The id is matched against the kid header of
+// tokens; tokens without a kid are checked against every key for the algorithm.
+// Empty lines and lines starting with # are ignored. The file is read again on SIGHUP.
+
+const minimumHMACKeyLength = 32
+
+type tokenKey struct {
+	id        string
+	algorithm string
+	key       []byte
+}
+
+var tokenKeys []*tokenKey
+var tokenKeysLock sync.RWMutex
+
+func parseTokenKeys(data []byte) ([]*tokenKey, error) {
+	result := []*tokenKey{}
+	for ix, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("line %d is not in the format id:algorithm:key", ix+1)
+		}
+		key, e := base64.StdEncoding.DecodeString(parts[2])
+		if e != nil {
+			return nil, fmt.Errorf("line %d: the key is not valid base64", ix+1)
+		}
+		switch parts[1] {
+		case "EdDSA":
+			if len(key) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("line %d: an Ed25519 public key has to be %d bytes", ix+1, ed25519.PublicKeySize)
+			}
+		case "HS256":
+			if len(key) < minimumHMACKeyLength {
+				return nil, fmt.Errorf("line %d: an HMAC secret has to be at least %d bytes", ix+1, minimumHMACKeyLength)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown algorithm %q", ix+1, parts[1])
+		}
+		result = append(result, &tokenKey{id: parts[0], algorithm: parts[1], key: key})
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return result, nil
+}
+
+var errMissingTokenSettings = errors.New("bearer authentication needs both a token issuer and a token audience")
+
+// loadTokenKeys reads the token keys file, refusing to if tokens can't be checked against an issuer and an audience
+func loadTokenKeys() error {
+	if s := currentTokenSettings(); s.issuer == "" || s.audience == "" {
+		return errMissingTokenSettings
+	}
+	d, e := ioutil.ReadFile(*tokenKeysFile)
+	if e != nil {
+		return e
+	}
+	keys, e := parseTokenKeys(d)
+	if e != nil {
+		return fmt.Errorf("%s: %v", *tokenKeysFile, e)
+	}
+
+	tokenKeysLock.Lock()
+	defer tokenKeysLock.Unlock()
+	tokenKeys = keys
+	return nil
+}
+
+func currentTokenKeys() []*tokenKey {
+	tokenKeysLock.RLock()
+	defer tokenKeysLock.RUnlock()
+	return tokenKeys
+}
+
+type tokenSettings struct {
+	issuer       string
+	audience     string
+	subjectClaim string
+	leeway       time.Duration
+}
+
+func currentTokenSettings() tokenSettings {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return tokenSettings{
+		issuer:       *tokenIssuer,
+		audience:     *tokenAudience,
+		subjectClaim: *tokenSubjectClaim,
+		leeway:       time.Duration(*tokenLeeway) * time.Second,
+	}
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var errMalformedToken = errors.New("the token is malformed")
+var errInvalidSignature = errors.New("the token signature is invalid")
+
+var tokenEncoding = base64.RawURLEncoding
+
+func decodeTokenPart(s string, into interface{}) error {
+	d, e := tokenEncoding.DecodeString(s)
+	if e != nil {
+		return errMalformedToken
+	}
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	if e := dec.Decode(into); e != nil {
+		return errMalformedToken
+	}
+	return nil
+}
+
+func (k *tokenKey) verify(signed, sig []byte) bool {
+	switch k.algorithm {
+	case "EdDSA":
+		return ed25519.Verify(ed25519.PublicKey(k.key), signed, sig)
+	case "HS256":
+		m := hmac.New(sha256.New, k.key)
+		m.Write(signed)
+		return hmac.Equal(m.Sum(nil), sig)
+	}
+	return false
+}
+
+func verifyTokenSignature(parts []string, h *tokenHeader, keys []*tokenKey) error {
+	if h.Alg != "EdDSA" && h.Alg != "HS256" {
+		return fmt.Errorf("the token is signed with an unsupported algorithm %q", h.Alg)
+	}
+	sig, e := tokenEncoding.DecodeString(parts[2])
+	if e != nil {
+		return errMalformedToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	for _, k := range keys {
+		if k.algorithm != h.Alg || (h.Kid != "" && k.id != h.Kid) {
+			continue
+		}
+		if k.verify(signed, sig) {
+			return nil
+		}
+	}
+	return errInvalidSignature
+}
+
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("the %s claim is not a number", name)
+	}
+	f, e := n.Float64()
+	if e != nil {
+		return time.Time{}, false, fmt.Errorf("the %s claim is not a number", name)
+	}
+	return time.Unix(int64(f), 0), true, nil
+}
+
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkTokenClaims(claims map[string]interface{}, s tokenSettings, now time.Time) (string, error) {
+	if s.issuer == "" || s.audience == "" {
+		return "", errMissingTokenSettings
+	}
+	iss, _ := claims["iss"].(string)
+	if iss == "" {
+		return "", errors.New("the token has no issuer")
+	}
+	if iss != s.issuer {
+		return "", fmt.Errorf("the token was issued by %q, not %q", iss, s.issuer)
+	}
+	if _, ok := claims["aud"]; !ok {
+		return "", errors.New("the token has no audience")
+	}
+	if !hasAudience(claims, s.audience) {
+		return "", fmt.Errorf("the token is not meant for %q", s.audience)
+	}
+
+	exp, ok, e := numericClaim(claims, "exp")
+	if e != nil {
+		return "", e
+	}
+	if !ok {
+		return "", errors.New("the token has no expiry")
+	}
+	if !now.Before(exp.Add(s.leeway)) {
+		return "", errors.New("the token has expired")
+	}
+	nbf, ok, e := numericClaim(claims, "nbf")
+	if e != nil {
+		return "", e
+	}
+	if ok && now.Add(s.leeway).Before(nbf) {
+		return "", errors.New("the token is not valid yet")
+	}
+
+	sub, _ := claims[s.subjectClaim].(string)
+	if sub == "" {
+		return "", fmt.Errorf("the token has no %s claim", s.subjectClaim)
+	}
+	return sub, nil
+}
+
+// verifyToken checks the token and returns the subject it was issued for
+func verifyToken(token string, keys []*tokenKey, s tokenSettings, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errMalformedToken
+	}
+	h := &tokenHeader{}
+	if e := decodeTokenPart(parts[0], h); e != nil {
+		return "", e
+	}
+	if e := verifyTokenSignature(parts, h, keys); e != nil {
+		return "", e
+	}
+	claims := map[string]interface{}{}
+	if e := decodeTokenPart(parts[1], &claims); e != nil {
+		return "", e
+	}
+	return checkTokenClaims(claims, s, now)
+}
+
+// bearerAuthenticator checks signed tokens given in the Authorization header
+type bearerAuthenticator struct{}
+
+func (bearerAuthenticator) authenticate(r *http.Request) (string, error) {
+	a := r.Header.Get("Authorization")
+	if len(a) < 7 || !strings.EqualFold(a[:7], "Bearer ") {
+		return "", errMissingCredentials
+	}
+	return verifyToken(strings.TrimSpace(a[7:]), currentTokenKeys(), currentTokenSettings(), time.Now())
+}
+
+func (bearerAuthenticator) challenge() string {
+	return `Bearer realm="prekey server"`
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+var testHMACSecret = []byte("0123456789abcdef0123456789abcdef")
+
+var testTokenSettings = tokenSettings{
+	issuer:       "https://id.example.org",
+	audience:     "prekeys",
+	subjectClaim: "sub",
+	leeway:       time.Duration(1) * time.Minute,
+}
+
+// mintToken creates a token signed with the given key, the way an identity provider would
+func mintToken(header, claims map[string]interface{}, key interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := tokenEncoding.EncodeToString(h) + "." + tokenEncoding.EncodeToString(c)
+
+	var sig []byte
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case []byte:
+		m := hmac.New(sha256.New, k)
+		m.Write([]byte(signed))
+		sig = m.Sum(nil)
+	}
+	return signed + "." + tokenEncoding.EncodeToString(sig)
+}
+
+func validClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://id.example.org",
+		"aud": "prekeys",
+		"sub": "sita",
+		"exp": now.Add(time.Duration(5) * time.Minute).Unix(),
+	}
+}
+
+func testTokenKeys() ([]*tokenKey, ed25519.PrivateKey) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	return []*tokenKey{
+		&tokenKey{id: "ed", algorithm: "EdDSA", key: pub},
+		&tokenKey{id: "mac", algorithm: "HS256", key: testHMACSecret},
+	}, priv
+}
+
+func (s *HTTPServerSuite) Test_verifyToken_acceptsTokensSignedWithEitherAlgorithm(c *C) {
+	keys, priv := testTokenKeys()
+	now := time.Now()
+
+	t1 := mintToken(map[string]interface{}{"alg": "EdDSA", "kid": "ed"}, validClaims(now), priv)
+	sub, e := verifyToken(t1, keys, testTokenSettings, now)
+	c.Assert(e, IsNil)
+	c.Assert(sub, Equals, "sita")
+
+	t2 := mintToken(map[string]interface{}{"alg": "HS256"}, validClaims(now), testHMACSecret)
+	sub, e = verifyToken(t2, keys, testTokenSettings, now)
+	c.Assert(e, IsNil)
+	c.Assert(sub, Equals, "sita")
+}
+
+func (s *HTTPServerSuite) Test_verifyToken_refusesInvalidSignatures(c *C) {
+	keys, priv := testTokenKeys()
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+
+	expected := map[string]string{
+		mintToken(map[string]interface{}{"alg": "EdDSA"}, validClaims(now), otherPriv):                "the token signature is invalid",
+		mintToken(map[string]interface{}{"alg": "EdDSA", "kid": "mac"}, validClaims(now), priv):       "the token signature is invalid",
+		mintToken(map[string]interface{}{"alg": "HS256"}, validClaims(now), []byte("another secret")): "the token signature is invalid",
+		mintToken(map[string]interface{}{"alg": "none"}, validClaims(now), nil):                       `the token is signed with an unsupported algorithm "none"`,
+		mintToken(map[string]interface{}{"alg": "RS256"}, validClaims(now), nil):                      `the token is signed with an unsupported algorithm "RS256"`,
+		"abc.def":                      "the token is malformed",
+		"!!!.abc.def":                  "the token is malformed",
+		"e30.abc.def":                  `the token is signed with an unsupported algorithm ""`,
+		"eyJhbGciOiJFZERTQSJ9.abc.!!!": "the token is malformed",
+		"bm90IGpzb24.abc.de":           "the token is malformed",
+	}
+	for t, msg := range expected {
+		_, e := verifyToken(t, keys, testTokenSettings, now)
+		c.Assert(e, ErrorMatches, msg, Commentf("%s", t))
+	}
+
+	// The claims can't be changed after signing
+	t := mintToken(map[string]interface{}{"alg": "EdDSA"}, validClaims(now), priv)
+	parts := strings.Split(t, ".")
+	claims := validClaims(now)
+	claims["sub"] = "rama"
+	forged, _ := json.Marshal(claims)
+	_, e := verifyToken(parts[0]+"."+tokenEncoding.EncodeToString(forged)+"."+parts[2], keys, testTokenSettings, now)
+	c.Assert(e, ErrorMatches, "the token signature is invalid")
+}
+
+func (s *HTTPServerSuite) Test_verifyToken_checksTheClaims(c *C) {
+	keys, priv := testTokenKeys()
+	now := time.Now()
+	withClaim := func(name string, value interface{}) string {
+		claims := validClaims(now)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return mintToken(map[string]interface{}{"alg": "EdDSA"}, claims, priv)
+	}
+
+	expected := map[string]string{
+		withClaim("iss", "https://evil.example.org"):     `the token was issued by "https://evil.example.org", not "https://id.example.org"`,
+		withClaim("iss", nil):                            "the token has no issuer",
+		withClaim("iss", ""):                             "the token has no issuer",
+		withClaim("aud", "other"):                        `the token is not meant for "prekeys"`,
+		withClaim("aud", []string{"a", "b"}):             `the token is not meant for "prekeys"`,
+		withClaim("aud", nil):                            "the token has no audience",
+		withClaim("exp", nil):                            "the token has no expiry",
+		withClaim("exp", "tomorrow"):                     "the exp claim is not a number",
+		withClaim("exp", now.Add(-2*time.Minute).Unix()): "the token has expired",
+		withClaim("nbf", now.Add(2*time.Minute).Unix()):  "the token is not valid yet",
+		withClaim("sub", nil):                            "the token has no sub claim",
+		withClaim("sub", 42):                             "the token has no sub claim",
+	}
+	for t, msg := range expected {
+		_, e := verifyToken(t, keys, testTokenSettings, now)
+		c.Assert(e, ErrorMatches, msg)
+	}
+
+	sub, e := verifyToken(withClaim("aud", []string{"a", "prekeys"}), keys, testTokenSettings, now)
+	c.Assert(e, IsNil)
+	c.Assert(sub, Equals, "sita")
+	_, e = verifyToken(withClaim("exp", now.Add(-30*time.Second).Unix()), keys, testTokenSettings, now)
+	c.Assert(e, IsNil)
+}
+
+func (s *HTTPServerSuite) Test_verifyToken_refusesEveryTokenWithoutAnIssuerAndAudienceConfigured(c *C) {
+	keys, priv := testTokenKeys()
+	now := time.Now()
+	claims := validClaims(now)
+	delete(claims, "iss")
+	delete(claims, "aud")
+	t := mintToken(map[string]interface{}{"alg": "EdDSA"}, claims, priv)
+
+	for _, settings := range []tokenSettings{
+		tokenSettings{audience: "prekeys", subjectClaim: "sub"},
+		tokenSettings{issuer: "https://id.example.org", subjectClaim: "sub"},
+		tokenSettings{subjectClaim: "sub"},
+	} {
+		_, e := verifyToken(t, keys, settings, now)
+		c.Assert(e, ErrorMatches, "bearer authentication needs both a token issuer and a token audience")
+	}
+}
+
+func (s *HTTPServerSuite) Test_verifyToken_usesTheConfiguredSubjectClaim(c *C) {
+	keys, priv := testTokenKeys()
+	now := time.Now()
+	claims := validClaims(now)
+	claims["preferred_username"] = "rama"
+	settings := testTokenSettings
+	settings.subjectClaim = "preferred_username"
+
+	sub, e := verifyToken(mintToken(map[string]interface{}{"alg": "EdDSA"}, claims, priv), keys, settings, now)
+	c.Assert(e, IsNil)
+	c.Assert(sub, Equals, "rama")
+}
+
+func (s *HTTPServerSuite) Test_parseTokenKeys_returnsErrors(c *C) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	b := base64.StdEncoding.EncodeToString
+	expected := map[string]string{
+		"":                               "no keys found",
+		"# only a comment\n":             "no keys found",
+		"abc":                            "line 1 is not in the format id:algorithm:key",
+		"a:EdDSA:!!!":                    "line 1: the key is not valid base64",
+		"a:EdDSA:" + b(pub[:16]):         "line 1: an Ed25519 public key has to be 32 bytes",
+		"a:HS256:" + b([]byte("short")):  "line 1: an HMAC secret has to be at least 32 bytes",
+		"\na:RS256:" + b(testHMACSecret): `line 2: unknown algorithm "RS256"`,
+	}
+	for d, msg := range expected {
+		_, e := parseTokenKeys([]byte(d))
+		c.Assert(e, ErrorMatches, msg)
+	}
+
+	keys, e := parseTokenKeys([]byte("# keys\nidp-1:EdDSA:" + b(pub) + "\nidp-2:HS256:" + b(testHMACSecret) + "\n"))
+	c.Assert(e, IsNil)
+	c.Assert(keys, DeepEquals, []*tokenKey{
+		&tokenKey{id: "idp-1", algorithm: "EdDSA", key: pub},
+		&tokenKey{id: "idp-2", algorithm: "HS256", key: testHMACSecret},
+	})
+}
+
+func (s *HTTPServerSuite) Test_loadAuthenticators_loadsTheTokenKeys(c *C) {
+	defer command.WithFlags("auth-methods", "token-keys-file", "token-issuer", "token-audience")()
+	f, _ := ioutil.TempFile("", "otrng-http-token-keys")
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "mac:HS256:%s\n", base64.StdEncoding.EncodeToString(testHMACSecret))
+	f.Close()
+
+	*authMethods = "basic, bearer"
+	*tokenKeysFile = f.Name()
+	*tokenIssuer = ""
+	*tokenAudience = "prekeys"
+	c.Assert(loadAuthenticators(), ErrorMatches, "bearer authentication needs both a token issuer and a token audience")
+
+	*tokenIssuer = testTokenSettings.issuer
+	c.Assert(loadAuthenticators(), IsNil)
+	c.Assert(currentAuthenticators(), DeepEquals, authenticators{basicAuthenticator{}, bearerAuthenticator{}})
+	c.Assert(currentTokenKeys(), HasLen, 1)
+
+	*authMethods = "basic,digest"
+	c.Assert(loadAuthenticators(), ErrorMatches, `unknown authentication method "digest"`)
+}
+
+func (s *HTTPServerSuite) Test_authenticators_usesTheAuthenticatorForTheGivenCredentials(c *C) {
+	_, done := withPasswordFile("rama:" + testHash("secret") + "\n")
+	defer done()
+	defer command.WithFlags("token-issuer", "token-audience")()
+	*tokenIssuer = testTokenSettings.issuer
+	*tokenAudience = testTokenSettings.audience
+	loadUsers()
+	keys, priv := testTokenKeys()
+	tokenKeys = keys
+	defer func() { tokenKeys = nil }()
+	as := authenticators{basicAuthenticator{}, bearerAuthenticator{}}
+
+	r, _ := http.NewRequest("POST", "http://localhost/prekeys", nil)
+	r.RemoteAddr = "192.0.2.10:1234"
+	_, e := as.authenticate(r)
+	c.Assert(e, Equals, errMissingCredentials)
+
+	r.Header.Set("Authorization", "Bearer "+mintToken(map[string]interface{}{"alg": "EdDSA"}, validClaims(time.Now()), priv))
+	u, e := as.authenticate(r)
+	c.Assert(e, IsNil)
+	c.Assert(u, Equals, "sita")
+
+	r.Header.Set("Authorization", "bearer not-a-token")
+	_, e = as.authenticate(r)
+	c.Assert(e, ErrorMatches, "the token is malformed")
+
+	r.Header.Del("Authorization")
+	r.SetBasicAuth("rama", "secret")
+	u, e = as.authenticate(r)
+	c.Assert(e, IsNil)
+	c.Assert(u, Equals, "rama")
+
+	_, e = authenticators{basicAuthenticator{}}.authenticate(r)
+	c.Assert(e, IsNil)
+	_, e = authenticators{bearerAuthenticator{}}.authenticate(r)
+	c.Assert(e, Equals, errMissingCredentials)
+}
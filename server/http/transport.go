@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/adapter"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// httpTransport hands the POST requests received by the HTTP server to the runner. The from-address
+// is one of the identities of the authenticated user, as described in identity.go, and the replies
+// are written in the response body, one message on each line.
+type httpTransport struct {
+	requests  chan *httpRequest
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+var errRequestTooLarge = errors.New("the request body is too large")
+
+type httpRequest struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	done chan bool
+}
+
+func newHTTPTransport() *httpTransport {
+	return &httpTransport{
+		requests: make(chan *httpRequest),
+		closed:   make(chan bool),
+	}
+}
+
+func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := &httpRequest{w: w, r: r, done: make(chan bool)}
+	select {
+	case t.requests <- req:
+		<-req.done
+	case <-t.closed:
+		http.Error(w, "Service unavailable.", http.StatusServiceUnavailable)
+	}
+}
+
+func (t *httpTransport) Receive() (adapter.Request, error) {
+	select {
+	case req := <-t.requests:
+		return req, nil
+	case <-t.closed:
+		return nil, adapter.ErrClosed
+	}
+}
+
+func (t *httpTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+func (r *httpRequest) Envelopes() ([]*adapter.Envelope, error) {
+	u, e := currentAuthenticators().authenticate(r.r)
+	if e != nil {
+		return nil, adapter.NewError(adapter.Unauthorized, e)
+	}
+	from, e := chooseIdentity(u, requestedIdentity(r.r))
+	if e != nil {
+		return nil, adapter.NewError(adapter.Unauthorized, e)
+	}
+
+	max := currentMaxBodySize()
+	bod, e := ioutil.ReadAll(http.MaxBytesReader(r.w, r.r.Body, max))
+	if e != nil {
+		// MaxBytesReader has read everything it allows when it refuses the rest
+		if int64(len(bod)) >= max {
+			return nil, errRequestTooLarge
+		}
+		return nil, e
+	}
+	return []*adapter.Envelope{&adapter.Envelope{From: from, Message: string(bod)}}, nil
+}
+
+func (r *httpRequest) Reply(replies [][]string) error {
+	all := []string{}
+	for _, rr := range replies {
+		all = append(all, rr...)
+	}
+	_, e := r.w.Write([]byte(strings.Join(all, "\n")))
+	return e
+}
+
+func (r *httpRequest) Fail(e *adapter.Error) {
+	switch e.Kind {
+	case adapter.Unauthorized:
+		r.failUnauthorized(e.Err)
+	case adapter.ReadFailed:
+		if e.Err == errRequestTooLarge {
+			http.Error(r.w, "Request too large.", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(r.w, "Bad request.", http.StatusBadRequest)
+		}
+	case adapter.Overloaded:
+		http.Error(r.w, "Service unavailable.", http.StatusServiceUnavailable)
+	case adapter.HandleFailed:
+		// The raw protocol can't carry elements longer than 65535 bytes, even if the body is allowed
+		if e.Err == frame.ErrTooLong {
+			http.Error(r.w, "Request too large.", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(r.w, "Bad gateway.", http.StatusBadGateway)
+		}
+	default:
+		http.Error(r.w, "Bad gateway.", http.StatusBadGateway)
+	}
+}
+
+func (r *httpRequest) failUnauthorized(e error) {
+	switch ee := e.(type) {
+	case *throttledError:
+		r.w.Header().Set("Retry-After", fmt.Sprintf("%d", int(ee.retryAfter/time.Second)))
+		http.Error(r.w, "Too many failed logins.", http.StatusTooManyRequests)
+	case *identityError:
+		http.Error(r.w, "Identity not allowed.", http.StatusForbidden)
+	default:
+		for _, a := range currentAuthenticators() {
+			r.w.Header().Add("WWW-Authenticate", a.challenge())
+		}
+		http.Error(r.w, "Unauthorized.", http.StatusUnauthorized)
+	}
+}
+
+func (r *httpRequest) Close() error {
+	close(r.done)
+	return nil
+}
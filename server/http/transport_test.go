@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/adapter"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+	. "gopkg.in/check.v1"
+)
+
+type mockServer struct {
+	sync.Mutex
+	received []string
+	reply    []string
+	err      error
+}
+
+func (ms *mockServer) Handle(from, message string) ([]string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.received = append(ms.received, from+" "+message)
+	return ms.reply, ms.err
+}
+
+// serveForTest sends one request through a transport and a runner using the given server
+func serveForTest(ms *mockServer, r *http.Request) *httptest.ResponseRecorder {
+	t := newHTTPTransport()
+	runner := &adapter.Runner{Server: ms, Logf: func(string, ...interface{}) {}}
+	go runner.Run(t)
+	defer t.Close()
+
+	w := httptest.NewRecorder()
+	t.ServeHTTP(w, r)
+	return w
+}
+
+func newTestRequest(body string) *http.Request {
+	r := httptest.NewRequest("POST", "http://localhost/prekeys", strings.NewReader(body))
+	r.SetBasicAuth("sita", "secret")
+	return r
+}
+
+func withTestUser() func() {
+	_, done := withPasswordFile("sita:" + testHash("secret") + "\n")
+	loadUsers()
+	old := activeAuthenticators
+	activeAuthenticators = authenticators{basicAuthenticator{}}
+	return func() {
+		activeAuthenticators = old
+		done()
+	}
+}
+
+func (s *HTTPServerSuite) Test_httpTransport_handsTheBodyToTheServerAsTheChosenIdentity(c *C) {
+	defer withTestUser()()
+	defer withIdentities("{user}@chat.example.org", "")()
+	ms := &mockServer{reply: []string{"?OTRP|1|one", "?OTRP|2|two"}}
+
+	w := serveForTest(ms, newTestRequest("?OTRPhello."))
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "?OTRP|1|one\n?OTRP|2|two")
+	c.Assert(ms.received, DeepEquals, []string{"sita@chat.example.org ?OTRPhello."})
+}
+
+func (s *HTTPServerSuite) Test_httpTransport_mapsErrorsToStatusCodes(c *C) {
+	defer withTestUser()()
+	defer withIdentities("{user}@chat.example.org", "")()
+	ms := &mockServer{}
+
+	r := httptest.NewRequest("POST", "http://localhost/prekeys", strings.NewReader("?OTRPhello."))
+	w := serveForTest(ms, r)
+	c.Assert(w.Code, Equals, http.StatusUnauthorized)
+	c.Assert(w.Header().Get("WWW-Authenticate"), Equals, `Basic realm="prekey server"`)
+
+	r = newTestRequest("?OTRPhello.")
+	r.Header.Set("X-Prekey-Identity", "rama@chat.example.org")
+	w = serveForTest(ms, r)
+	c.Assert(w.Code, Equals, http.StatusForbidden)
+
+	ms.err = errors.New("invalid message format")
+	w = serveForTest(ms, newTestRequest("?OTRPhello."))
+	c.Assert(w.Code, Equals, http.StatusBadGateway)
+
+	ms.err = frame.ErrTooLong
+	w = serveForTest(ms, newTestRequest("?OTRPhello."))
+	c.Assert(w.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	w = serveForTest(ms, httptest.NewRequest("GET", "http://localhost/prekeys", nil))
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	c.Assert(ms.received, HasLen, 2)
+}
+
+func (s *HTTPServerSuite) Test_encodeFrame_refusesMessagesTheRawProtocolCantCarry(c *C) {
+	_, e := encodeFrame("sita@chat.example.org", []byte(strings.Repeat("a", 0x10000)))
+	c.Assert(e, Equals, frame.ErrTooLong)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func (s *HTTPServerSuite) Test_httpTransport_onlyReportsBodiesOverTheLimitAsTooLarge(c *C) {
+	defer withTestUser()()
+	defer withIdentities("{user}@chat.example.org", "")()
+	defer command.WithFlags("max-body-size")()
+	*maxBodySize = 10
+	ms := &mockServer{}
+
+	w := serveForTest(ms, newTestRequest("?OTRPhello, this is too long."))
+	c.Assert(w.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	r := httptest.NewRequest("POST", "http://localhost/prekeys", failingReader{})
+	r.SetBasicAuth("sita", "secret")
+	w = serveForTest(ms, r)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	c.Assert(ms.received, HasLen, 0)
+}
+
+func (s *HTTPServerSuite) Test_httpTransport_refusesRequestsAfterBeingClosed(c *C) {
+	t := newHTTPTransport()
+	t.Close()
+	w := httptest.NewRecorder()
+	t.ServeHTTP(w, newTestRequest("?OTRPhello."))
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+
+	_, e := t.Receive()
+	c.Assert(e, Equals, adapter.ErrClosed)
+}
+
+func (s *HTTPServerSuite) Test_httpTransport_tellsThrottledClientsWhenToRetry(c *C) {
+	r := &httpRequest{w: httptest.NewRecorder(), done: make(chan bool)}
+	r.Fail(adapter.NewError(adapter.Unauthorized, &throttledError{retryAfter: time.Duration(4) * time.Second}))
+	w := r.w.(*httptest.ResponseRecorder)
+	c.Assert(w.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(w.Header().Get("Retry-After"), Equals, "4")
+}
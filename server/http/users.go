@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The password file contains one user on each line, as user:hash, where the hash is in one of
+// the formats described in credentials.go. Empty lines and lines starting with # are ignored.
+// The file is read again when the server receives SIGHUP, and when it changes on disk.
+
+var users map[string]*passwordHash
+var usersLock sync.RWMutex
+
+// passwordFileLock makes sure only one change to the password file is made at a time
+var passwordFileLock sync.Mutex
+
+type passwordFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+var loadedPasswordFile passwordFileState
+
+// passwordLine is one line of the password file. Lines that aren't entries have no user,
+// and are written back as they were
+type passwordLine struct {
+	user string
+	hash string
+	text string
+}
+
+func (pl *passwordLine) String() string {
+	if pl.user == "" {
+		return pl.text
+	}
+	return pl.user + ":" + pl.hash
+}
+
+func parsePasswordLines(data []byte) []*passwordLine {
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	result := []*passwordLine{}
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimSuffix(l, "\r")
+		up := strings.SplitN(l, ":", 2)
+		if len(up) != 2 || strings.HasPrefix(l, "#") {
+			result = append(result, &passwordLine{text: l})
+			continue
+		}
+		result = append(result, &passwordLine{user: up[0], hash: strings.TrimSpace(up[1])})
+	}
+	return result
+}
+
+func formatPasswordLines(lines []*passwordLine) []byte {
+	var b bytes.Buffer
+	for _, l := range lines {
+		b.WriteString(l.String())
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// parseUsers returns the users in the password file, and a description of every line that couldn't be used
+func parseUsers(lines []*passwordLine) (map[string]*passwordHash, []string) {
+	result := make(map[string]*passwordHash)
+	problems := []string{}
+	for ix, l := range lines {
+		if l.user == "" {
+			if t := strings.TrimSpace(l.text); t != "" && !strings.HasPrefix(t, "#") {
+				problems = append(problems, fmt.Sprintf("line %d is not in the format user:hash", ix+1))
+			}
+			continue
+		}
+		ph, e := parsePasswordHash(l.hash)
+		if e != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %v", ix+1, e))
+			continue
+		}
+		result[l.user] = ph
+	}
+	return result, problems
+}
+
+func statPasswordFile(name string) passwordFileState {
+	fi, e := os.Stat(name)
+	if e != nil {
+		return passwordFileState{}
+	}
+	return passwordFileState{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// loadUsers reads the password file. If it can't be read, the users read before are kept
+func loadUsers() error {
+	passwordFileLock.Lock()
+	defer passwordFileLock.Unlock()
+
+	state := statPasswordFile(*passwordFile)
+	dd, e := ioutil.ReadFile(*passwordFile)
+	if e != nil {
+		return e
+	}
+	newUsers, problems := parseUsers(parsePasswordLines(dd))
+	for _, p := range problems {
+		command.Logf("Ignoring invalid entry in password file %s, %s\n", *passwordFile, p)
+	}
+
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	users = newUsers
+	loadedPasswordFile = state
+	return nil
+}
+
+func passwordFileChanged() bool {
+	passwordFileLock.Lock()
+	defer passwordFileLock.Unlock()
+	state := statPasswordFile(*passwordFile)
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	return state != loadedPasswordFile
+}
+
+// watchPasswordFile reads the password file again every time it changes. It never returns
+func watchPasswordFile(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !passwordFileChanged() {
+			continue
+		}
+		if e := loadUsers(); e != nil {
+			command.Logf("Encountered error when reading password file, keeping the old users: %v\n", e)
+			continue
+		}
+		command.Logf("Reloaded password file %s\n", *passwordFile)
+	}
+}
+
+// updatePasswordFile changes the password file. The new content is written to a temporary
+// file that replaces the old one, so the server never reads a half-written file.
+func updatePasswordFile(name string, update func([]*passwordLine) ([]*passwordLine, error)) error {
+	passwordFileLock.Lock()
+	defer passwordFileLock.Unlock()
+
+	mode := os.FileMode(0600)
+	dd, e := ioutil.ReadFile(name)
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	if fi, e := os.Stat(name); e == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	lines, e := update(parsePasswordLines(dd))
+	if e != nil {
+		return e
+	}
+
+	tmp, e := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(tmp.Name())
+	if _, e := tmp.Write(formatPasswordLines(lines)); e != nil {
+		tmp.Close()
+		return e
+	}
+	if e := tmp.Chmod(mode); e != nil {
+		tmp.Close()
+		return e
+	}
+	if e := tmp.Close(); e != nil {
+		return e
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func lookupUser(u string) (*passwordHash, bool) {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	ph, ok := users[u]
+	return ph, ok
+}
+
+// checkCredentials returns true if the password is correct for the user. A correct password
+// stored with an outdated hash gets a new hash
+func checkCredentials(u, p string) bool {
+	params := currentHashParams()
+	ph, ok := lookupUser(u)
+	if !ok {
+		dummyHash(params).verify(p)
+		return false
+	}
+	now := time.Now()
+	if successfulLogins.contains(u, p, ph, now) {
+		return true
+	}
+	if !ph.verify(p) {
+		return false
+	}
+	successfulLogins.add(u, p, ph, now, currentCacheLimits())
+	if ph.needsUpgrade(params) {
+		if e := upgradeHash(u, p, ph, params); e != nil {
+			command.Logf("Encountered error when upgrading password hash for %s: %v\n", u, e)
+		}
+	}
+	return true
+}
+
+var errHashChanged = errors.New("the password hash was changed while upgrading it")
+
+// upgradeHash replaces the hash of the user with a new one, unless it was changed in the meantime
+func upgradeHash(u, p string, old *passwordHash, params hashParams) error {
+	nh, e := newPasswordHash(p, params)
+	if e != nil {
+		return e
+	}
+
+	e = updatePasswordFile(*passwordFile, func(lines []*passwordLine) ([]*passwordLine, error) {
+		for _, l := range lines {
+			if l.user == u && l.hash == old.String() {
+				l.hash = nh.String()
+				return lines, nil
+			}
+		}
+		return nil, errHashChanged
+	})
+	if e == errHashChanged {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	if users[u] == old {
+		users[u] = nh
+	}
+	command.Logf("Upgraded password hash for %s\n", u)
+	return nil
+}
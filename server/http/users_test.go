@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// withPasswordFile points the pwd-file flag at a new file with the given content,
+// and uses cheap scrypt parameters for new hashes
+func withPasswordFile(content string) (string, func()) {
+	restore := command.WithFlags("pwd-file", "scrypt-cost")
+	dir, _ := ioutil.TempDir("", "otrng-http-passwords")
+	name := filepath.Join(dir, "passwords.asc")
+	ioutil.WriteFile(name, []byte(content), 0600)
+	*passwordFile = name
+	*scryptCost = uint(testHashParams.logN)
+	return name, func() {
+		os.RemoveAll(dir)
+		restore()
+	}
+}
+
+func testHash(password string) string {
+	ph, _ := newPasswordHash(password, testHashParams)
+	return ph.String()
+}
+
+func readFile(name string) string {
+	d, _ := ioutil.ReadFile(name)
+	return string(d)
+}
+
+func (s *HTTPServerSuite) Test_parsePasswordLines_keepsLinesThatAreNotEntries(c *C) {
+	data := "# the users\nsita:abc\n\nrama:def:ghi\r\n"
+	lines := parsePasswordLines([]byte(data))
+	c.Assert(lines, DeepEquals, []*passwordLine{
+		&passwordLine{text: "# the users"},
+		&passwordLine{user: "sita", hash: "abc"},
+		&passwordLine{text: ""},
+		&passwordLine{user: "rama", hash: "def:ghi"},
+	})
+	c.Assert(string(formatPasswordLines(lines)), Equals, "# the users\nsita:abc\n\nrama:def:ghi\n")
+}
+
+func (s *HTTPServerSuite) Test_loadUsers_ignoresInvalidEntries(c *C) {
+	h := testHash("secret")
+	_, done := withPasswordFile("# comment\nsita:" + h + "\nno colon here\nrama:not a hash\n")
+	defer done()
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	c.Assert(loadUsers(), IsNil)
+	c.Assert(users, HasLen, 1)
+	c.Assert(users["sita"].String(), Equals, h)
+	out := capture.finish()
+	c.Assert(out, Matches, "(?s).*line 3 is not in the format user:hash\n.*")
+	c.Assert(out, Matches, "(?s).*line 4: invalid password hash\n.*")
+}
+
+func (s *HTTPServerSuite) Test_loadUsers_returnsErrorForMissingFileAndKeepsTheUsers(c *C) {
+	_, done := withPasswordFile("sita:" + testHash("secret") + "\n")
+	defer done()
+	c.Assert(loadUsers(), IsNil)
+	c.Assert(users, HasLen, 1)
+	state := loadedPasswordFile
+
+	*passwordFile = "/somewhere/that/shouldn't/work"
+	c.Assert(loadUsers(), ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+	c.Assert(users, HasLen, 1)
+	c.Assert(loadedPasswordFile, Equals, state)
+	c.Assert(checkCredentials("sita", "secret"), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_checkCredentials_onlyAcceptsTheRightPasswordForKnownUsers(c *C) {
+	_, done := withPasswordFile("sita:" + testHash("secret") + "\n")
+	defer done()
+	loadUsers()
+
+	c.Assert(checkCredentials("sita", "secret"), Equals, true)
+	c.Assert(checkCredentials("sita", "wrong"), Equals, false)
+	c.Assert(checkCredentials("rama", "secret"), Equals, false)
+	c.Assert(checkCredentials("", ""), Equals, false)
+}
+
+func (s *HTTPServerSuite) Test_checkCredentials_upgradesLegacyHashes(c *C) {
+	h, _ := scrypt.Key([]byte("secret"), legacyHashSalt, 1<<15, 8, 1, 32)
+	legacy := base64.StdEncoding.EncodeToString(h)
+	name, done := withPasswordFile("# comment\nsita:" + legacy + "\nrama:" + legacy + "\n")
+	defer done()
+	loadUsers()
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	c.Assert(checkCredentials("sita", "wrong"), Equals, false)
+	c.Assert(users["sita"].legacy, Equals, true)
+
+	c.Assert(checkCredentials("sita", "secret"), Equals, true)
+	c.Assert(users["sita"].legacy, Equals, false)
+	c.Assert(users["sita"].params, Equals, testHashParams)
+	c.Assert(readFile(name), Equals, "# comment\nsita:"+users["sita"].String()+"\nrama:"+legacy+"\n")
+	c.Assert(checkCredentials("sita", "secret"), Equals, true)
+	c.Assert(capture.finish(), Equals, "Upgraded password hash for sita\n")
+
+	fi, _ := os.Stat(name)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
+func (s *HTTPServerSuite) Test_upgradeHash_leavesHashesThatChangedInTheMeantime(c *C) {
+	old, _ := newPasswordHash("secret", hashParams{logN: 5, r: 8, p: 1})
+	rotated := testHash("other")
+	name, done := withPasswordFile("sita:" + rotated + "\n")
+	defer done()
+
+	c.Assert(upgradeHash("sita", "secret", old, testHashParams), IsNil)
+	c.Assert(readFile(name), Equals, "sita:"+rotated+"\n")
+}
+
+func (s *HTTPServerSuite) Test_passwordFileChanged_noticesChangesOnDisk(c *C) {
+	name, done := withPasswordFile("sita:" + testHash("secret") + "\n")
+	defer done()
+	loadUsers()
+	c.Assert(passwordFileChanged(), Equals, false)
+
+	ioutil.WriteFile(name, []byte("sita:"+testHash("secret")+"\nrama:"+testHash("secret")+"\n"), 0600)
+	c.Assert(passwordFileChanged(), Equals, true)
+	loadUsers()
+	c.Assert(passwordFileChanged(), Equals, false)
+	c.Assert(users, HasLen, 2)
+
+	later := time.Now().Add(time.Duration(1) * time.Hour)
+	os.Chtimes(name, later, later)
+	c.Assert(passwordFileChanged(), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_runUsersCommand_addsUsers(c *C) {
+	name, done := withPasswordFile("")
+	defer done()
+	os.Remove(name)
+
+	var out bytes.Buffer
+	c.Assert(runUsersCommand([]string{"add", "sita"}, strings.NewReader("secret\n"), &out), IsNil)
+	c.Assert(out.String(), Equals, "")
+	fi, _ := os.Stat(name)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	e := runUsersCommand([]string{"add", "sita"}, strings.NewReader("secret\n"), &out)
+	c.Assert(e, ErrorMatches, "the user sita already exists")
+
+	c.Assert(runUsersCommand([]string{"-generate", "add", "rama"}, nil, &out), IsNil)
+	generated := strings.TrimSpace(out.String())
+	c.Assert(generated, HasLen, 24)
+
+	loadUsers()
+	c.Assert(checkCredentials("sita", "secret"), Equals, true)
+	c.Assert(checkCredentials("rama", generated), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_runUsersCommand_rotatesPasswords(c *C) {
+	name, done := withPasswordFile("sita:" + testHash("secret") + "\n")
+	defer done()
+
+	c.Assert(runUsersCommand([]string{"rotate", "sita"}, strings.NewReader("new secret"), ioutil.Discard), IsNil)
+	c.Assert(readFile(name), Matches, `sita:\$scrypt\$.*\n`)
+	loadUsers()
+	c.Assert(checkCredentials("sita", "secret"), Equals, false)
+	c.Assert(checkCredentials("sita", "new secret"), Equals, true)
+
+	e := runUsersCommand([]string{"rotate", "rama"}, strings.NewReader("secret\n"), ioutil.Discard)
+	c.Assert(e, ErrorMatches, "there is no user rama")
+}
+
+func (s *HTTPServerSuite) Test_runUsersCommand_removesUsers(c *C) {
+	h := testHash("secret")
+	name, done := withPasswordFile("# comment\nsita:" + h + "\nrama:" + h + "\n")
+	defer done()
+
+	c.Assert(runUsersCommand([]string{"remove", "sita"}, nil, ioutil.Discard), IsNil)
+	c.Assert(readFile(name), Equals, "# comment\nrama:"+h+"\n")
+
+	e := runUsersCommand([]string{"remove", "sita"}, nil, ioutil.Discard)
+	c.Assert(e, ErrorMatches, "there is no user sita")
+}
+
+func (s *HTTPServerSuite) Test_runUsersCommand_listsUsers(c *C) {
+	_, done := withPasswordFile("sita:" + testHash("secret") + "\nrama:" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n")
+	defer done()
+
+	var out bytes.Buffer
+	c.Assert(runUsersCommand([]string{"list"}, nil, &out), IsNil)
+	c.Assert(out.String(), Equals, "rama legacy\nsita scrypt ln=4,r=8,p=1\n")
+}
+
+func (s *HTTPServerSuite) Test_runUsersCommand_returnsErrors(c *C) {
+	_, done := withPasswordFile("")
+	defer done()
+
+	usage := "usage: users .*"
+	c.Assert(runUsersCommand([]string{}, nil, ioutil.Discard), ErrorMatches, usage)
+	c.Assert(runUsersCommand([]string{"add"}, nil, ioutil.Discard), ErrorMatches, usage)
+	c.Assert(runUsersCommand([]string{"list", "sita"}, nil, ioutil.Discard), ErrorMatches, usage)
+	c.Assert(runUsersCommand([]string{"frob", "sita"}, nil, ioutil.Discard), ErrorMatches, usage)
+	c.Assert(runUsersCommand([]string{"add", "si:ta"}, nil, ioutil.Discard), ErrorMatches, `"si:ta" is not a valid username`)
+	c.Assert(runUsersCommand([]string{"add", "sita"}, strings.NewReader("\n"), ioutil.Discard), ErrorMatches, "the password can't be empty")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// The users subcommand manages the password file:
+//
+//   users [-generate] add <user>      adds a user
+//   users [-generate] rotate <user>   gives an existing user a new password
+//   users remove <user>               removes a user
+//   users list                        lists the users and how their passwords are hashed
+//
+// The password is read from the first line of standard input, unless -generate is given, in which
+// case a random password is generated and printed. The password file is the one given by the
+// pwd-file flag or the configuration file. A running server notices the change by itself.
+
+const generatedPasswordLength = 18
+
+func readPassword(in io.Reader) (string, error) {
+	l, e := bufio.NewReader(in).ReadString('\n')
+	if e != nil && e != io.EOF {
+		return "", e
+	}
+	l = strings.TrimRight(l, "\r\n")
+	if l == "" {
+		return "", errors.New("the password can't be empty")
+	}
+	return l, nil
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, generatedPasswordLength)
+	if _, e := rand.Read(b); e != nil {
+		return "", e
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validateUsername(u string) error {
+	if u == "" || strings.ContainsAny(u, ":\r\n") || strings.HasPrefix(u, "#") {
+		return fmt.Errorf("%q is not a valid username", u)
+	}
+	return nil
+}
+
+func findUser(lines []*passwordLine, u string) *passwordLine {
+	for _, l := range lines {
+		if l.user == u {
+			return l
+		}
+	}
+	return nil
+}
+
+func newPassword(generate bool, in io.Reader, out io.Writer) (*passwordHash, error) {
+	var p string
+	var e error
+	if generate {
+		p, e = generatePassword()
+	} else {
+		p, e = readPassword(in)
+	}
+	if e != nil {
+		return nil, e
+	}
+	ph, e := newPasswordHash(p, currentHashParams())
+	if e != nil {
+		return nil, e
+	}
+	if generate {
+		fmt.Fprintf(out, "%s\n", p)
+	}
+	return ph, nil
+}
+
+func setPassword(u string, mustExist, generate bool, in io.Reader, out io.Writer) error {
+	if e := validateUsername(u); e != nil {
+		return e
+	}
+	return updatePasswordFile(*passwordFile, func(lines []*passwordLine) ([]*passwordLine, error) {
+		l := findUser(lines, u)
+		if mustExist && l == nil {
+			return nil, fmt.Errorf("there is no user %s", u)
+		}
+		if !mustExist && l != nil {
+			return nil, fmt.Errorf("the user %s already exists", u)
+		}
+		ph, e := newPassword(generate, in, out)
+		if e != nil {
+			return nil, e
+		}
+		if l == nil {
+			return append(lines, &passwordLine{user: u, hash: ph.String()}), nil
+		}
+		l.hash = ph.String()
+		return lines, nil
+	})
+}
+
+func removeUser(u string) error {
+	return updatePasswordFile(*passwordFile, func(lines []*passwordLine) ([]*passwordLine, error) {
+		result := []*passwordLine{}
+		for _, l := range lines {
+			if l.user != u {
+				result = append(result, l)
+			}
+		}
+		if len(result) == len(lines) {
+			return nil, fmt.Errorf("there is no user %s", u)
+		}
+		return result, nil
+	})
+}
+
+func listUsers(out io.Writer) error {
+	dd, e := ioutil.ReadFile(*passwordFile)
+	if e != nil {
+		return e
+	}
+	found, _ := parseUsers(parsePasswordLines(dd))
+	names := []string{}
+	for u := range found {
+		names = append(names, u)
+	}
+	sort.Strings(names)
+	for _, u := range names {
+		if ph := found[u]; ph.legacy {
+			fmt.Fprintf(out, "%s legacy\n", u)
+		} else {
+			fmt.Fprintf(out, "%s scrypt %s\n", u, ph.params)
+		}
+	}
+	return nil
+}
+
+// runUsersCommand runs the users subcommand with the given arguments
+func runUsersCommand(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("users", flag.ContinueOnError)
+	fs.SetOutput(out)
+	generate := fs.Bool("generate", false, "Generate a random password and print it, instead of reading it from standard input")
+	if e := fs.Parse(args); e != nil {
+		return e
+	}
+
+	wantArgs := map[string]int{"add": 2, "rotate": 2, "remove": 2, "list": 1}
+	if n, ok := wantArgs[fs.Arg(0)]; !ok || fs.NArg() != n {
+		return errors.New("usage: users [-generate] add|rotate|remove <user>, or users list")
+	}
+
+	switch fs.Arg(0) {
+	case "add":
+		return setPassword(fs.Arg(1), false, *generate, in, out)
+	case "rotate":
+		return setPassword(fs.Arg(1), true, *generate, in, out)
+	case "remove":
+		return removeUser(fs.Arg(1))
+	}
+	return listUsers(out)
+}
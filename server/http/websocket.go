@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// This file implements the parts of the WebSocket protocol (RFC 6455) we need: the opening
+// handshake, and reading and writing frames. Only the server side is implemented, so frames
+// from the client have to be masked, and ours never are.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const (
+	closeNormal         = 1000
+	closeProtocolError  = 1002
+	closeUnsupported    = 1003
+	closeInvalidPayload = 1007
+	closePolicy         = 1008
+	closeTooLarge       = 1009
+	closeInternalError  = 1011
+	closeTryAgainLater  = 1013
+)
+
+const maxControlPayload = 125
+
+var errFrameTooLarge = errors.New("the frame is larger than allowed")
+
+// protocolError is a violation of the WebSocket protocol by the client
+type protocolError struct {
+	reason string
+}
+
+func (pe *protocolError) Error() string {
+	return "WebSocket protocol error: " + pe.reason
+}
+
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+func (f *wsFrame) isControl() bool {
+	return f.opcode&0x8 != 0
+}
+
+// headerHasToken returns true if the comma separated header contains the token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkHandshake returns the status to reply with if the request is not a valid opening handshake
+func checkHandshake(r *http.Request) (int, string) {
+	if r.Method != "GET" {
+		return http.StatusMethodNotAllowed, "WebSocket handshakes have to use GET."
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return http.StatusBadRequest, "Not a WebSocket handshake."
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return http.StatusUpgradeRequired, "Unsupported WebSocket version."
+	}
+	if k, e := base64.StdEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Key")); e != nil || len(k) != 16 {
+		return http.StatusBadRequest, "Invalid WebSocket key."
+	}
+	return 0, ""
+}
+
+func readWebSocketFrame(r *bufio.Reader, maxPayload int64) (*wsFrame, error) {
+	var head [2]byte
+	if _, e := io.ReadFull(r, head[:]); e != nil {
+		return nil, e
+	}
+	f := &wsFrame{fin: head[0]&0x80 != 0, opcode: head[0] & 0x0F}
+	if head[0]&0x70 != 0 {
+		return nil, &protocolError{"reserved bits are set"}
+	}
+	if head[1]&0x80 == 0 {
+		return nil, &protocolError{"frames from the client have to be masked"}
+	}
+
+	l := int64(head[1] & 0x7F)
+	switch l {
+	case 126:
+		var ext [2]byte
+		if _, e := io.ReadFull(r, ext[:]); e != nil {
+			return nil, e
+		}
+		l = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, e := io.ReadFull(r, ext[:]); e != nil {
+			return nil, e
+		}
+		u := binary.BigEndian.Uint64(ext[:])
+		if u>>63 != 0 {
+			return nil, &protocolError{"invalid payload length"}
+		}
+		l = int64(u)
+	}
+	if f.isControl() && (l > maxControlPayload || !f.fin) {
+		return nil, &protocolError{"invalid control frame"}
+	}
+	if !f.isControl() && l > maxPayload {
+		return nil, errFrameTooLarge
+	}
+
+	var mask [4]byte
+	if _, e := io.ReadFull(r, mask[:]); e != nil {
+		return nil, e
+	}
+	f.payload = make([]byte, l)
+	if _, e := io.ReadFull(r, f.payload); e != nil {
+		return nil, e
+	}
+	for ix := range f.payload {
+		f.payload[ix] ^= mask[ix%4]
+	}
+	return f, nil
+}
+
+func encodeWebSocketFrame(opcode byte, payload []byte) []byte {
+	res := []byte{0x80 | opcode}
+	switch l := len(payload); {
+	case l < 126:
+		res = append(res, byte(l))
+	case l <= 0xFFFF:
+		res = append(res, 126, byte(l>>8), byte(l))
+	default:
+		res = append(res, 127)
+		res = appendUint64(res, uint64(l))
+	}
+	return append(res, payload...)
+}
+
+func closePayload(code int, reason string) []byte {
+	return append([]byte{byte(code >> 8), byte(code)}, []byte(reason)...)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/adapter"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	. "gopkg.in/check.v1"
+)
+
+// wsTestClient is the client side of a WebSocket connection, just enough to test the server
+type wsTestClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(addr, path string, header map[string]string) (*wsTestClient, *http.Response, error) {
+	conn, e := net.Dial("tcp", addr)
+	if e != nil {
+		return nil, nil, e
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(5) * time.Second))
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	for k, v := range header {
+		req += k + ": " + v + "\r\n"
+	}
+	fmt.Fprintf(conn, "%s\r\n", req)
+
+	r := bufio.NewReader(conn)
+	resp, e := http.ReadResponse(r, nil)
+	if e != nil {
+		conn.Close()
+		return nil, nil, e
+	}
+	return &wsTestClient{conn: conn, r: r}, resp, nil
+}
+
+func (c *wsTestClient) send(fin bool, opcode byte, payload []byte) {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for ix, b := range payload {
+		frame = append(frame, b^mask[ix%4])
+	}
+	c.conn.Write(frame)
+}
+
+// next returns the next frame from the server, which is never masked
+func (c *wsTestClient) next() (byte, string) {
+	head := make([]byte, 2)
+	if _, e := c.r.Read(head[:1]); e != nil {
+		return 0xFF, e.Error()
+	}
+	c.r.Read(head[1:])
+	l := int(head[1] & 0x7F)
+	if l == 126 {
+		ext := make([]byte, 2)
+		c.r.Read(ext)
+		l = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, l)
+	for read := 0; read < l; {
+		n, _ := c.r.Read(payload[read:])
+		read += n
+	}
+	return head[0] & 0x0F, string(payload)
+}
+
+func (c *wsTestClient) nextClose() int {
+	op, p := c.next()
+	if op != opClose || len(p) < 2 {
+		return -1
+	}
+	return int(p[0])<<8 | int(p[1])
+}
+
+func startWebSocketServer(ms *mockServer) *httptest.Server {
+	runner := &adapter.Runner{Server: ms, Logf: func(string, ...interface{}) {}}
+	return httptest.NewServer(&websocketHandler{runner: runner})
+}
+
+func withWebSocketFlags() func() {
+	restore := command.WithFlags("websocket-origins", "websocket-ping-interval", "websocket-max-messages", "websocket-messages-per-minute", "max-body-size")
+	*wsOrigins = ""
+	*wsPingInterval = 30
+	*wsMaxMessages = 0
+	*wsPerMinute = 0
+	return restore
+}
+
+var basicSita = "Basic " + "c2l0YTpzZWNyZXQ="
+
+func (s *HTTPServerSuite) Test_websocketAccept_usesTheExampleFromTheRFC(c *C) {
+	c.Assert(websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func (s *HTTPServerSuite) Test_checkHandshake_refusesInvalidHandshakes(c *C) {
+	valid := func() *http.Request {
+		r := httptest.NewRequest("GET", "http://localhost/ws", nil)
+		r.Header.Set("Connection", "keep-alive, Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return r
+	}
+	status, _ := checkHandshake(valid())
+	c.Assert(status, Equals, 0)
+
+	r := valid()
+	r.Method = "POST"
+	status, _ = checkHandshake(r)
+	c.Assert(status, Equals, http.StatusMethodNotAllowed)
+	r = valid()
+	r.Header.Del("Upgrade")
+	status, _ = checkHandshake(r)
+	c.Assert(status, Equals, http.StatusBadRequest)
+	r = valid()
+	r.Header.Set("Sec-WebSocket-Version", "8")
+	status, _ = checkHandshake(r)
+	c.Assert(status, Equals, http.StatusUpgradeRequired)
+	r = valid()
+	r.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=")
+	status, _ = checkHandshake(r)
+	c.Assert(status, Equals, http.StatusBadRequest)
+}
+
+func (s *HTTPServerSuite) Test_originAllowed_checksTheOriginOfBrowsers(c *C) {
+	r := httptest.NewRequest("GET", "http://prekeys.example.org/ws", nil)
+	c.Assert(originAllowed(r, ""), Equals, true)
+
+	r.Header.Set("Origin", "https://prekeys.example.org")
+	c.Assert(originAllowed(r, ""), Equals, true)
+	r.Header.Set("Origin", "https://evil.example.org")
+	c.Assert(originAllowed(r, ""), Equals, false)
+	c.Assert(originAllowed(r, "https://chat.example.org, https://evil.example.org"), Equals, true)
+	c.Assert(originAllowed(r, "https://chat.example.org"), Equals, false)
+	c.Assert(originAllowed(r, "*"), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_withQueryToken_usesTheAccessTokenParameter(c *C) {
+	r := httptest.NewRequest("GET", "http://localhost/ws?access_token=abc", nil)
+	c.Assert(withQueryToken(r).Header.Get("Authorization"), Equals, "Bearer abc")
+	c.Assert(r.Header.Get("Authorization"), Equals, "")
+
+	r.Header.Set("Authorization", "Basic xyz")
+	c.Assert(withQueryToken(r).Header.Get("Authorization"), Equals, "Basic xyz")
+}
+
+func (s *HTTPServerSuite) Test_websocketHandler_sendsEveryFragmentAsItsOwnMessage(c *C) {
+	defer withTestUser()()
+	defer withIdentities("{user}@chat.example.org", "")()
+	defer withWebSocketFlags()()
+	ms := &mockServer{reply: []string{"?OTRP|1|one", "?OTRP|2|two"}}
+	srv := startWebSocketServer(ms)
+	defer srv.Close()
+
+	ws, resp, e := dialWebSocket(srv.Listener.Addr().String(), "/", map[string]string{"Authorization": basicSita})
+	c.Assert(e, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Assert(resp.Header.Get("Sec-WebSocket-Accept"), Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+
+	ws.send(true, opText, []byte("?OTRPhello.\n"))
+	op, p := ws.next()
+	c.Assert(op, Equals, byte(opText))
+	c.Assert(p, Equals, "?OTRP|1|one")
+	op, p = ws.next()
+	c.Assert(p, Equals, "?OTRP|2|two")
+
+	ws.send(true, opPing, []byte("are you there"))
+	op, p = ws.next()
+	c.Assert(op, Equals, byte(opPong))
+	c.Assert(p, Equals, "are you there")
+
+	ws.send(false, opText, []byte("?OTRP"))
+	ws.send(true, opPing, nil)
+	ws.send(true, opContinuation, []byte("again."))
+	op, _ = ws.next()
+	c.Assert(op, Equals, byte(opPong))
+	ws.next()
+	ws.next()
+
+	ws.send(true, opClose, closePayload(closeNormal, ""))
+	c.Assert(ws.nextClose(), Equals, closeNormal)
+	c.Assert(ms.received, DeepEquals, []string{"sita@chat.example.org ?OTRPhello.", "sita@chat.example.org ?OTRPagain."})
+}
+
+func (s *HTTPServerSuite) Test_websocketHandler_refusesUnauthenticatedClientsAndOtherOrigins(c *C) {
+	defer withTestUser()()
+	defer withWebSocketFlags()()
+	srv := startWebSocketServer(&mockServer{})
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	_, resp, e := dialWebSocket(addr, "/", nil)
+	c.Assert(e, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	_, resp, _ = dialWebSocket(addr, "/", map[string]string{"Authorization": basicSita, "Origin": "https://evil.example.org"})
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+
+	_, resp, _ = dialWebSocket(addr, "/?identity=rama", map[string]string{"Authorization": basicSita})
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *HTTPServerSuite) Test_websocketHandler_enforcesTheLimitsOfAConnection(c *C) {
+	defer withTestUser()()
+	defer withWebSocketFlags()()
+	*wsMaxMessages = 1
+	*maxBodySize = 200
+	srv := startWebSocketServer(&mockServer{reply: []string{"ok"}})
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	auth := map[string]string{"Authorization": basicSita}
+
+	ws, _, _ := dialWebSocket(addr, "/", auth)
+	ws.send(true, opText, []byte("one"))
+	ws.next()
+	ws.send(true, opText, []byte("two"))
+	c.Assert(ws.nextClose(), Equals, closePolicy)
+
+	ws, _, _ = dialWebSocket(addr, "/", auth)
+	ws.send(true, opText, []byte(strings.Repeat("a", 201)))
+	c.Assert(ws.nextClose(), Equals, closeTooLarge)
+
+	ws, _, _ = dialWebSocket(addr, "/", auth)
+	ws.send(true, opBinary, []byte("one"))
+	c.Assert(ws.nextClose(), Equals, closeUnsupported)
+
+	ws, _, _ = dialWebSocket(addr, "/", auth)
+	ws.send(true, opContinuation, []byte("one"))
+	c.Assert(ws.nextClose(), Equals, closeProtocolError)
+
+	ws, _, _ = dialWebSocket(addr, "/", auth)
+	ws.send(true, opText, []byte{0xFF, 0xFE})
+	c.Assert(ws.nextClose(), Equals, closeInvalidPayload)
+}
+
+func (s *HTTPServerSuite) Test_websocketHandler_closesConnectionsWhenTheServerFails(c *C) {
+	defer withTestUser()()
+	defer withWebSocketFlags()()
+	ms := &mockServer{err: fmt.Errorf("invalid message format")}
+	srv := startWebSocketServer(ms)
+	defer srv.Close()
+
+	ws, _, _ := dialWebSocket(srv.Listener.Addr().String(), "/", map[string]string{"Authorization": basicSita})
+	ws.send(true, opText, []byte("?OTRPhello."))
+	c.Assert(ws.nextClose(), Equals, closeInvalidPayload)
+}
+
+func (s *HTTPServerSuite) Test_wsConn_allowMessage_limitsMessagesEveryMinute(c *C) {
+	wc := &wsConn{limits: wsLimits{perMinute: 2}}
+	now := time.Now()
+	c.Assert(wc.allowMessage(now), Equals, true)
+	c.Assert(wc.allowMessage(now), Equals, true)
+	c.Assert(wc.allowMessage(now), Equals, false)
+	c.Assert(wc.allowMessage(now.Add(time.Minute)), Equals, true)
+}
+
+func (s *HTTPServerSuite) Test_wsConn_pingsTheClient(c *C) {
+	client, server := net.Pipe()
+	defer client.Close()
+	wc := newWSConn(server, bufio.NewReader(server), "sita", wsLimits{pingInterval: time.Duration(10) * time.Millisecond})
+	go wc.keepAlive()
+	defer wc.close(closeNormal, "")
+
+	ws := &wsTestClient{conn: client, r: bufio.NewReader(client)}
+	client.SetDeadline(time.Now().Add(time.Duration(5) * time.Second))
+	op, _ := ws.next()
+	c.Assert(op, Equals, byte(opPing))
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/otrv4/otrng-prekey-server/adapter"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// The WebSocket endpoint lets browser clients keep one connection open for a whole exchange with the
+// prekey server. The client authenticates in the opening handshake, the same way as for POST requests,
+// and picks its identity there. Browsers can't set the Authorization header for WebSocket connections,
+// so a bearer token can also be given in the access_token query parameter.
+// After the handshake, every text message is one OTRP message, handed to the prekey server,
+// and every message in the reply is sent back as its own text message.
+// The server pings the client regularly, and closes the connection if nothing has been
+// heard from it for two ping intervals. Each connection can only send a limited number of
+// messages, in total and every minute.
+
+const accessTokenParameter = "access_token"
+
+const wsWriteTimeout = time.Duration(10) * time.Second
+
+type wsLimits struct {
+	maxMessageSize int64
+	maxMessages    int
+	perMinute      int
+	pingInterval   time.Duration
+}
+
+func currentWSLimits() wsLimits {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return wsLimits{
+		maxMessageSize: int64(*maxBodySize),
+		maxMessages:    int(*wsMaxMessages),
+		perMinute:      int(*wsPerMinute),
+		pingInterval:   time.Duration(*wsPingInterval) * time.Second,
+	}
+}
+
+func currentWSOrigins() string {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return *wsOrigins
+}
+
+// originAllowed checks the Origin header that browsers send. Without a list of allowed origins,
+// only pages from the same host can connect. Clients that aren't browsers don't send the header.
+func originAllowed(r *http.Request, allowed string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if allowed == "" {
+		u, e := url.Parse(origin)
+		return e == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, a := range strings.Split(allowed, ",") {
+		if a = strings.TrimSpace(a); a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withQueryToken returns the request with the access token from the query as its Authorization header,
+// if it has no Authorization header
+func withQueryToken(r *http.Request) *http.Request {
+	t := r.URL.Query().Get(accessTokenParameter)
+	if t == "" || r.Header.Get("Authorization") != "" {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	r2.Header.Set("Authorization", "Bearer "+t)
+	return r2
+}
+
+type websocketHandler struct {
+	runner *adapter.Runner
+}
+
+func (h *websocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if status, msg := checkHandshake(r); status != 0 {
+		if status == http.StatusUpgradeRequired {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	if !originAllowed(r, currentWSOrigins()) {
+		http.Error(w, "Origin not allowed.", http.StatusForbidden)
+		return
+	}
+
+	req := &httpRequest{w: w, r: r}
+	u, e := currentAuthenticators().authenticate(withQueryToken(r))
+	if e != nil {
+		command.Logf("Encountered error when verifying client: %v\n", e)
+		req.failUnauthorized(e)
+		return
+	}
+	from, e := chooseIdentity(u, requestedIdentity(r))
+	if e != nil {
+		command.Logf("Encountered error when verifying client: %v\n", e)
+		req.failUnauthorized(e)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket connections are not supported.", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, e := hj.Hijack()
+	if e != nil {
+		command.Logf("Encountered error when taking over WebSocket connection: %v\n", e)
+		return
+	}
+	// The timeouts of the HTTP server only apply to the handshake
+	conn.SetDeadline(time.Time{})
+
+	c := newWSConn(conn, brw.Reader, from, currentWSLimits())
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		websocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+	c.serve(h.runner)
+}
+
+// wsConn is one WebSocket connection, after the handshake
+type wsConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	from   string
+	limits wsLimits
+
+	writeLock sync.Mutex
+	closed    bool
+	done      chan bool
+
+	messages    int
+	windowStart time.Time
+	inWindow    int
+}
+
+func newWSConn(conn net.Conn, r *bufio.Reader, from string, l wsLimits) *wsConn {
+	return &wsConn{conn: conn, r: r, from: from, limits: l, done: make(chan bool)}
+}
+
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return errClosedConnection
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, e := c.conn.Write(encodeWebSocketFrame(opcode, payload))
+	return e
+}
+
+var errClosedConnection = errors.New("the WebSocket connection is closed")
+
+// close sends a close frame with the code and reason, and closes the connection
+func (c *wsConn) close(code int, reason string) {
+	c.write(opClose, closePayload(code, reason))
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+		c.conn.Close()
+	}
+}
+
+func (c *wsConn) keepAlive() {
+	if c.limits.pingInterval == 0 {
+		return
+	}
+	t := time.NewTicker(c.limits.pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if e := c.write(opPing, nil); e != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsConn) extendDeadline() {
+	if c.limits.pingInterval > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(2 * c.limits.pingInterval))
+	}
+}
+
+// allowMessage counts a message from the client, and returns false if it goes over the limits
+func (c *wsConn) allowMessage(now time.Time) bool {
+	c.messages++
+	if c.limits.maxMessages > 0 && c.messages > c.limits.maxMessages {
+		return false
+	}
+	if now.Sub(c.windowStart) >= time.Minute {
+		c.windowStart = now
+		c.inWindow = 0
+	}
+	c.inWindow++
+	return c.limits.perMinute == 0 || c.inWindow <= c.limits.perMinute
+}
+
+// readMessage returns the next complete text message, answering control frames on the way
+func (c *wsConn) readMessage() (string, error) {
+	var msg []byte
+	started := false
+	for {
+		c.extendDeadline()
+		f, e := readWebSocketFrame(c.r, c.limits.maxMessageSize-int64(len(msg)))
+		if e != nil {
+			return "", e
+		}
+		switch f.opcode {
+		case opPing:
+			if e := c.write(opPong, f.payload); e != nil {
+				return "", e
+			}
+		case opPong:
+		case opClose:
+			return "", io.EOF
+		case opBinary:
+			return "", errBinaryMessage
+		case opText, opContinuation:
+			if started == (f.opcode == opText) {
+				return "", &protocolError{"unexpected continuation frame"}
+			}
+			started = true
+			msg = append(msg, f.payload...)
+			if f.fin {
+				return string(msg), nil
+			}
+		default:
+			return "", &protocolError{fmt.Sprintf("unknown opcode %d", f.opcode)}
+		}
+	}
+}
+
+var errBinaryMessage = errors.New("binary messages are not supported")
+var errInvalidUTF8 = errors.New("the text message is not valid UTF-8")
+var errTooManyMessages = errors.New("too many messages on this connection")
+
+func (c *wsConn) serve(runner *adapter.Runner) {
+	go c.keepAlive()
+	for {
+		msg, e := c.readMessage()
+		if e == nil && !utf8.ValidString(msg) {
+			e = errInvalidUTF8
+		}
+		if e == nil && !c.allowMessage(time.Now()) {
+			e = errTooManyMessages
+		}
+		if e != nil {
+			c.closeWithError(e)
+			return
+		}
+		runner.Serve(&wsRequest{c: c, message: strings.TrimSpace(msg)})
+		if c.isClosed() {
+			return
+		}
+	}
+}
+
+func (c *wsConn) isClosed() bool {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.closed
+}
+
+func (c *wsConn) closeWithError(e error) {
+	switch ee := e.(type) {
+	case *protocolError:
+		c.close(closeProtocolError, ee.reason)
+		return
+	case net.Error:
+		if ee.Timeout() {
+			c.close(closePolicy, "no response to ping")
+			return
+		}
+	}
+	switch e {
+	case io.EOF:
+		c.close(closeNormal, "")
+	case errFrameTooLarge:
+		c.close(closeTooLarge, "message too large")
+	case errBinaryMessage:
+		c.close(closeUnsupported, "only text messages are supported")
+	case errInvalidUTF8:
+		c.close(closeInvalidPayload, "invalid UTF-8")
+	case errTooManyMessages:
+		c.close(closePolicy, "too many messages")
+	default:
+		c.close(closeInternalError, "")
+	}
+}
+
+// wsRequest is one message received on a WebSocket connection
+type wsRequest struct {
+	c       *wsConn
+	message string
+}
+
+func (r *wsRequest) Envelopes() ([]*adapter.Envelope, error) {
+	return []*adapter.Envelope{&adapter.Envelope{From: r.c.from, Message: r.message}}, nil
+}
+
+func (r *wsRequest) Reply(replies [][]string) error {
+	for _, rr := range replies {
+		for _, m := range rr {
+			if e := r.c.write(opText, []byte(m)); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (r *wsRequest) Fail(e *adapter.Error) {
+	switch e.Kind {
+	case adapter.HandleFailed:
+		if e.Err == frame.ErrTooLong {
+			r.c.close(closeTooLarge, "message too large")
+			return
+		}
+		r.c.close(closeInvalidPayload, "invalid message")
+	case adapter.Overloaded:
+		r.c.close(closeTryAgainLater, "too many requests in progress")
+	default:
+		r.c.close(closeInternalError, "")
+	}
+}
+
+// Close leaves the connection open for the next message
+func (r *wsRequest) Close() error {
+	return nil
+}
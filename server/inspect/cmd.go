@@ -0,0 +1,9 @@
+package main
+
+import "flag"
+
+// These flags represent all the available command line flags
+var (
+	jsonOutput = flag.Bool("json", false, "Print every message as one line of JSON, instead of as text")
+	quiet      = flag.Bool("quiet", false, "Only print messages that couldn't be decoded or have problems")
+)
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+func (p *printer) printJSON(r *jsonResult) {
+	d, _ := json.Marshal(r)
+	fmt.Fprintf(p.out, "%s\n", d)
+}
+
+func formatExpiry(t time.Time, expired bool) string {
+	s := t.UTC().Format("2006-01-02 15:04:05 MST")
+	if expired {
+		s += " (expired)"
+	}
+	return s
+}
+
+func printProblems(out io.Writer, problems []string, indent string) {
+	for _, p := range problems {
+		fmt.Fprintf(out, "%sproblem: %s\n", indent, p)
+	}
+}
+
+func printClientProfile(out io.Writer, cp *pks.ClientProfileInspection, indent string) {
+	fmt.Fprintf(out, "%sclient profile:\n", indent)
+	indent += "  "
+	fmt.Fprintf(out, "%sinstance tag: 0x%08X\n", indent, cp.InstanceTag)
+	fmt.Fprintf(out, "%sfingerprint: %s\n", indent, cp.Fingerprint)
+	if cp.ForgingKeyFingerprint != "" {
+		fmt.Fprintf(out, "%sforging key: %s\n", indent, cp.ForgingKeyFingerprint)
+	}
+	fmt.Fprintf(out, "%sversions: %q\n", indent, cp.Versions)
+	fmt.Fprintf(out, "%sexpires: %s\n", indent, formatExpiry(cp.Expires, cp.Expired))
+	if cp.HasDSAKey {
+		fmt.Fprintf(out, "%stransitional DSA key: yes\n", indent)
+	}
+	printProblems(out, cp.Problems, indent)
+}
+
+func printPrekeyProfile(out io.Writer, pp *pks.PrekeyProfileInspection, indent string) {
+	fmt.Fprintf(out, "%sprekey profile:\n", indent)
+	indent += "  "
+	fmt.Fprintf(out, "%sinstance tag: 0x%08X\n", indent, pp.InstanceTag)
+	fmt.Fprintf(out, "%sexpires: %s\n", indent, formatExpiry(pp.Expires, pp.Expired))
+	printProblems(out, pp.Problems, indent)
+}
+
+func printPrekeyMessage(out io.Writer, pm *pks.PrekeyMessageInspection, indent string) {
+	fmt.Fprintf(out, "%sprekey message 0x%08X, instance tag 0x%08X\n", indent, pm.Identifier, pm.InstanceTag)
+	printProblems(out, pm.Problems, indent+"  ")
+}
+
+func printInspection(out io.Writer, i *pks.Inspection, indent string) {
+	if i.InstanceTag != 0 {
+		fmt.Fprintf(out, "%sinstance tag: 0x%08X\n", indent, i.InstanceTag)
+	}
+	if i.Identity != "" {
+		fmt.Fprintf(out, "%sidentity: %s\n", indent, i.Identity)
+	}
+	if i.Versions != "" {
+		fmt.Fprintf(out, "%sversions: %q\n", indent, i.Versions)
+	}
+	if i.ServerIdentity != "" {
+		fmt.Fprintf(out, "%sserver identity: %s\n", indent, i.ServerIdentity)
+	}
+	if i.ServerFingerprint != "" {
+		fmt.Fprintf(out, "%sserver fingerprint: %s\n", indent, i.ServerFingerprint)
+	}
+	if i.Stored != nil {
+		fmt.Fprintf(out, "%sstored prekey messages: %d\n", indent, *i.Stored)
+	}
+	if i.Text != "" {
+		fmt.Fprintf(out, "%stext: %q\n", indent, i.Text)
+	}
+	if i.ClientProfile != nil {
+		printClientProfile(out, i.ClientProfile, indent)
+	}
+	if i.PrekeyProfile != nil {
+		printPrekeyProfile(out, i.PrekeyProfile, indent)
+	}
+	if len(i.PrekeyMessages) > 0 {
+		fmt.Fprintf(out, "%sprekey messages: %d\n", indent, len(i.PrekeyMessages))
+		for _, pm := range i.PrekeyMessages {
+			printPrekeyMessage(out, pm, indent+"  ")
+		}
+	}
+	for _, pr := range i.Proofs {
+		fmt.Fprintf(out, "%sproof for %s: %d bytes\n", indent, pr.Name, pr.Size)
+	}
+	for ix, e := range i.Ensembles {
+		fmt.Fprintf(out, "%sensemble %d:\n", indent, ix+1)
+		printClientProfile(out, e.ClientProfile, indent+"  ")
+		printPrekeyProfile(out, e.PrekeyProfile, indent+"  ")
+		printPrekeyMessage(out, e.PrekeyMessage, indent+"  ")
+		printProblems(out, e.Problems, indent+"  ")
+	}
+	if i.Inner != nil {
+		fmt.Fprintf(out, "%senclosed %s message (0x%02X), %d bytes:\n", indent, i.Inner.Type, i.Inner.TypeCode, i.Inner.Size)
+		printInspection(out, i.Inner, indent+"  ")
+	}
+	if i.MACSize > 0 {
+		fmt.Fprintf(out, "%sMAC: %d bytes\n", indent, i.MACSize)
+	}
+	printProblems(out, i.Problems, indent)
+	if len(i.Unchecked) > 0 {
+		fmt.Fprintf(out, "%snot checked without the session keys: %s\n", indent, strings.Join(i.Unchecked, ", "))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/otrv4/gotrx"
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+const fragmentationPrefix = "?OTRP|"
+
+// maxLineLength is the longest message we read, ensemble retrieval messages can be big
+const maxLineLength = 16 * 1024 * 1024
+
+// fragmentHeader is the information in the prefix of a fragment
+type fragmentHeader struct {
+	id       uint32
+	sender   uint32
+	receiver uint32
+	index    uint16
+	total    uint16
+	data     string
+}
+
+func parseFragmentHeader(frag string) (*fragmentHeader, bool) {
+	body := strings.TrimSuffix(strings.TrimPrefix(frag, fragmentationPrefix), ",")
+	if len(body) == len(frag)-len(fragmentationPrefix) {
+		return nil, false
+	}
+	one := strings.SplitN(body, "|", 3)
+	if len(one) != 3 {
+		return nil, false
+	}
+	two := strings.SplitN(one[2], ",", 4)
+	if len(two) != 4 {
+		return nil, false
+	}
+
+	id, e1 := strconv.ParseUint(one[0], 10, 32)
+	sender, e2 := strconv.ParseUint(one[1], 16, 32)
+	receiver, e3 := strconv.ParseUint(two[0], 16, 32)
+	index, e4 := strconv.ParseUint(two[1], 10, 16)
+	total, e5 := strconv.ParseUint(two[2], 10, 16)
+	if e1 != nil || e2 != nil || e3 != nil || e4 != nil || e5 != nil || index == 0 || total == 0 || index > total {
+		return nil, false
+	}
+	return &fragmentHeader{
+		id:       uint32(id),
+		sender:   uint32(sender),
+		receiver: uint32(receiver),
+		index:    uint16(index),
+		total:    uint16(total),
+		data:     two[3],
+	}, true
+}
+
+var errInvalidFragment = errors.New("invalid fragment")
+
+// pendingMessage keeps track of a message we have received some of the fragments for
+type pendingMessage struct {
+	header   *fragmentHeader
+	received map[uint16]bool
+}
+
+// inspectAll inspects every message read, putting fragments together first
+func inspectAll(in io.Reader, p *printer) error {
+	frags := gotrx.NewFragmentor(fragmentationPrefix)
+	pending := map[uint32]*pendingMessage{}
+
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	line := 0
+	for sc.Scan() {
+		line++
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if !strings.HasPrefix(l, fragmentationPrefix) {
+			p.message(line, 0, l)
+			continue
+		}
+
+		h, ok := parseFragmentHeader(l)
+		if !ok {
+			p.failure(line, errInvalidFragment)
+			continue
+		}
+		pm, ok := pending[h.id]
+		if !ok {
+			pm = &pendingMessage{header: h, received: map[uint16]bool{}}
+			pending[h.id] = pm
+		}
+		pm.received[h.index] = true
+		p.fragment(line, h)
+
+		msg, complete, e := frags.NewFragmentReceived("", l)
+		if e != nil {
+			p.failure(line, e)
+			delete(pending, h.id)
+			continue
+		}
+		if complete {
+			delete(pending, h.id)
+			p.message(line, int(h.total), msg)
+		}
+	}
+
+	ids := []uint32{}
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		pm := pending[id]
+		p.failure(line, fmt.Errorf("message %d is incomplete, only %d of %d fragments were given", id, len(pm.received), pm.header.total))
+	}
+	return sc.Err()
+}
+
+// printer writes the descriptions of messages, as text or JSON
+type printer struct {
+	out    io.Writer
+	json   bool
+	quiet  bool
+	failed bool
+}
+
+func newPrinter(out io.Writer, json, quiet bool) *printer {
+	return &printer{out: out, json: json, quiet: quiet}
+}
+
+// jsonResult is what we print for every message in JSON mode
+type jsonResult struct {
+	Line      int    `json:"line"`
+	Fragments int    `json:"fragments,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Valid     *bool  `json:"valid,omitempty"`
+	*pks.Inspection
+}
+
+func (p *printer) message(line, fragments int, msg string) {
+	i, e := pks.InspectMessage(msg)
+	if e != nil {
+		p.failure(line, e)
+		return
+	}
+	valid := i.Valid()
+	if !valid {
+		p.failed = true
+	}
+	if p.quiet && valid {
+		return
+	}
+
+	if p.json {
+		p.printJSON(&jsonResult{Line: line, Fragments: fragments, Valid: &valid, Inspection: i})
+		return
+	}
+	fmt.Fprintf(p.out, "Line %d: %s message (0x%02X), version %d, %d bytes", line, i.Type, i.TypeCode, i.Version, i.Size)
+	if fragments > 0 {
+		fmt.Fprintf(p.out, ", from %d fragments", fragments)
+	}
+	fmt.Fprintf(p.out, "\n")
+	printInspection(p.out, i, "  ")
+	if valid {
+		fmt.Fprintf(p.out, "  valid: yes\n\n")
+	} else {
+		fmt.Fprintf(p.out, "  valid: no\n\n")
+	}
+}
+
+func (p *printer) fragment(line int, h *fragmentHeader) {
+	if p.json || p.quiet {
+		return
+	}
+	fmt.Fprintf(p.out, "Line %d: fragment %d of %d of message %d, from instance 0x%08X to 0x%08X, %d characters\n",
+		line, h.index, h.total, h.id, h.sender, h.receiver, len(h.data))
+}
+
+func (p *printer) failure(line int, e error) {
+	p.failed = true
+	if p.json {
+		p.printJSON(&jsonResult{Line: line, Error: e.Error()})
+		return
+	}
+	fmt.Fprintf(p.out, "Line %d: %v\n\n", line, e)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type InspectSuite struct{}
+
+var _ = Suite(&InspectSuite{})
+
+// sitaDAKE1 is a valid DAKE-1 message, and sitaFragments the same message in two fragments
+const sitaDAKE1 = "AAQ1EkWrzQAAAAUAARJFq80AAgAQABKClgbBYUlgKSHrRbwPz7rLXI+syMD4/zL6OHUdRInVgvUqfWvFlSmj+6YW5HlbIsPHy2SOLjcAAAMAEslFKFtsQX8CDa9Chhtrlfop47GsKcWZf8WaAFUYKgwsac3IK3FWJBLvLddTsnfbjXugf1vra1/HAAAEAAAAATQABQAAAABusEEYVFpDebG+J6B94oG+IJMjMOsbZLwF4HBbDYQfBr1cSD3uBjbFJB8xhMvV9hEs3XvIADMRCAyy16cAuhbnAE2eMgkLUoikH6XMLC0oT7yCoC8VzBbNxdJdxKXC06mpkqxYXtVn3ouGfJsGjWnuK3sDpS0AKyFLc2Vo5g3uvcieQOkeomY2qwcIvAcKz8dqCkQIugQcSJ9DMgjPbCH0eQ+tV54+EBQxTdN2Fz8A."
+
+var sitaFragments = []string{
+	"?OTRP|2882382797|1245ABCD|00000000,1,2,AAQ1EkWrzQAAAAUAARJFq80AAgAQABKClgbBYUlgKSHrRbwPz7rLXI+syMD4/zL6OHUdRInVgvUqfWvFlSmj+6YW5HlbIsPHy2SOLjcAAAMAEslFKFtsQX8CDa9Chhtrlfop47GsKcWZf8WaAFUYKgwsac3IK3FWJBLvLddTsnfbjXugf1vra1/HAAAEAAAAATQABQAAAABusEEYVFpDebG+J6B94oG+IJMjMOsbZLwF4HBbDYQfBr1cSD3u,",
+	"?OTRP|2882382797|1245ABCD|00000000,2,2,BjbFJB8xhMvV9hEs3XvIADMRCAyy16cAuhbnAE2eMgkLUoikH6XMLC0oT7yCoC8VzBbNxdJdxKXC06mpkqxYXtVn3ouGfJsGjWnuK3sDpS0AKyFLc2Vo5g3uvcieQOkeomY2qwcIvAcKz8dqCkQIugQcSJ9DMgjPbCH0eQ+tV54+EBQxTdN2Fz8A.,",
+}
+
+const storageStatus = "AAQLEkWrzQAAACoAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA."
+
+func inspectText(text string, json, quiet bool) (string, bool) {
+	var out bytes.Buffer
+	p := newPrinter(&out, json, quiet)
+	inspectAll(strings.NewReader(text), p)
+	return out.String(), p.failed
+}
+
+func (s *InspectSuite) Test_parseFragmentHeader_parsesTheFragmentPrefix(c *C) {
+	h, ok := parseFragmentHeader("?OTRP|42|1245ABCD|00000100,2,3,abc,")
+	c.Assert(ok, Equals, true)
+	c.Assert(*h, DeepEquals, fragmentHeader{id: 42, sender: 0x1245ABCD, receiver: 0x100, index: 2, total: 3, data: "abc"})
+
+	for _, f := range []string{
+		"?OTRP|42|1245ABCD|00000100,2,3,abc",
+		"?OTRP|42|1245ABCD,2,3,abc,",
+		"?OTRP|42|1245ABCD|00000100,4,3,abc,",
+		"?OTRP|42|1245ABCD|00000100,0,3,abc,",
+		"?OTRP|x|1245ABCD|00000100,1,3,abc,",
+		"?OTRP|,",
+	} {
+		_, ok := parseFragmentHeader(f)
+		c.Assert(ok, Equals, false, Commentf("%s", f))
+	}
+}
+
+func (s *InspectSuite) Test_inspectAll_describesMessagesAsText(c *C) {
+	out, failed := inspectText("# a comment\n\n"+sitaDAKE1+"\n", false, false)
+
+	c.Assert(failed, Equals, false)
+	c.Assert(out, Matches, `(?s)Line 3: DAKE-1 message \(0x35\), version 4, \d+ bytes
+  instance tag: 0x1245ABCD
+  client profile:
+    instance tag: 0x1245ABCD
+    fingerprint: [0-9A-F ]+
+    forging key: [0-9A-F ]+
+    versions: "4"
+    expires: 2028-11-05 13:46:00 UTC
+  valid: yes
+
+`)
+}
+
+func (s *InspectSuite) Test_inspectAll_putsFragmentsTogether(c *C) {
+	out, failed := inspectText(strings.Join(sitaFragments, "\n"), false, false)
+
+	c.Assert(failed, Equals, false)
+	c.Assert(out, Matches, `(?s)Line 1: fragment 1 of 2 of message 2882382797, from instance 0x1245ABCD to 0x00000000, \d+ characters
+Line 2: fragment 2 of 2 of message 2882382797, from instance 0x1245ABCD to 0x00000000, \d+ characters
+Line 2: DAKE-1 message \(0x35\), version 4, \d+ bytes, from 2 fragments
+.*valid: yes
+
+`)
+}
+
+func (s *InspectSuite) Test_inspectAll_reportsIncompleteMessages(c *C) {
+	out, failed := inspectText(sitaFragments[1], false, true)
+
+	c.Assert(failed, Equals, true)
+	c.Assert(out, Equals, "Line 1: message 2882382797 is incomplete, only 1 of 2 fragments were given\n\n")
+}
+
+func (s *InspectSuite) Test_inspectAll_printsJSON(c *C) {
+	out, failed := inspectText(storageStatus+"\nnot a message\n", true, false)
+
+	c.Assert(failed, Equals, true)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	c.Assert(lines, HasLen, 2)
+
+	res := map[string]interface{}{}
+	c.Assert(json.Unmarshal([]byte(lines[0]), &res), IsNil)
+	c.Assert(res["line"], Equals, float64(1))
+	c.Assert(res["type"], Equals, "storage status")
+	c.Assert(res["instanceTag"], Equals, float64(0x1245ABCD))
+	c.Assert(res["stored"], Equals, float64(42))
+	c.Assert(res["valid"], Equals, true)
+	c.Assert(lines[1], Equals, `{"line":2,"error":"invalid message format - corrupted base64 encoding"}`)
+}
+
+func (s *InspectSuite) Test_inspectAll_onlyPrintsProblemsWhenQuiet(c *C) {
+	out, failed := inspectText(sitaDAKE1+"\n"+sitaDAKE1[:100]+".\n", false, true)
+
+	c.Assert(failed, Equals, true)
+	c.Assert(out, Equals, "Line 2: the DAKE-1 message is corrupted or truncated\n\n")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// prekey-inspect decodes prekey protocol messages and describes their content. The messages are
+// given as arguments, or read from standard input, one on each line, when there are none. Fragments
+// are put together before the complete message is described. Empty lines and lines starting with #
+// are ignored. The exit status is 1 if any message couldn't be decoded, had problems, or was left
+// incomplete.
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [message ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() > 0 {
+		in = strings.NewReader(strings.Join(flag.Args(), "\n"))
+	}
+
+	p := newPrinter(os.Stdout, *jsonOutput, *quiet)
+	if e := inspectAll(in, p); e != nil {
+		fmt.Fprintf(os.Stderr, "encountered error when reading messages: %v\n", e)
+		os.Exit(1)
+	}
+	if p.failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,40 @@
+package command
+
+import (
+	"errors"
+	"flag"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type CommandSuite struct{}
+
+var _ = Suite(&CommandSuite{})
+
+var (
+	testName    = flag.String("command-test-name", "", "Only used by the tests")
+	testCount   = flag.Uint("command-test-count", 0, "Only used by the tests")
+	testLogFile = flag.String("command-test-log-file", "", "Only used by the tests")
+)
+
+type testConfig struct {
+	Name  *string
+	Count *uint // reloadable
+}
+
+func (c *testConfig) Validate() error {
+	if c.Name != nil && *c.Name == "" {
+		return errors.New("Name: can't be empty")
+	}
+	return nil
+}
+
+func (c *testConfig) Settings() []Setting {
+	res := []Setting{}
+	res = AppendString(res, "Name", "command-test-name", c.Name, false)
+	res = AppendUint(res, "Count", "command-test-count", c.Count, true)
+	return res
+}
@@ -0,0 +1,222 @@
+// Package command contains the configuration file handling, the logging, the health endpoints and
+// the key file handling shared by the commands that run the front ends of the prekey server.
+package command
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The configuration file is a JSON document where every setting is optional.
+// Each setting corresponds to a command line flag, and a flag given on the
+// command line always takes precedence over the configuration file.
+// When the command receives SIGHUP, the file is read again, and the settings
+// marked as reloadable are changed. All other settings require a restart.
+// A reloadable setting that is removed from the file goes back to its default.
+
+// Setting is one setting given in the configuration file,
+// translated into the value of the flag it corresponds to
+type Setting struct {
+	Path       string
+	Flag       string
+	Value      string
+	Reloadable bool
+}
+
+// Config is implemented by the configuration of every command
+type Config interface {
+	// Validate checks the settings that can be checked without looking at the flags
+	Validate() error
+	// Settings returns the settings given in the configuration
+	Settings() []Setting
+}
+
+// ConfigLock protects the flag values that can change when the configuration is reloaded
+var ConfigLock sync.RWMutex
+
+// CommandLineFlags contains the names of the flags that were given on the command line.
+// It has to be captured before the configuration is applied, since applying it will mark flags as set
+var CommandLineFlags map[string]bool
+
+// configuredFlags contains the settings the configuration file has set, by flag name, so the
+// ones removed from the file can be found when it's reloaded
+var configuredFlags map[string]Setting
+
+// AppendString adds the setting if it's given
+func AppendString(res []Setting, path, flagName string, v *string, reloadable bool) []Setting {
+	if v == nil {
+		return res
+	}
+	return append(res, Setting{Path: path, Flag: flagName, Value: *v, Reloadable: reloadable})
+}
+
+// AppendUint adds the setting if it's given
+func AppendUint(res []Setting, path, flagName string, v *uint, reloadable bool) []Setting {
+	if v == nil {
+		return res
+	}
+	return append(res, Setting{Path: path, Flag: flagName, Value: fmt.Sprintf("%d", *v), Reloadable: reloadable})
+}
+
+// AppendBool adds the setting if it's given
+func AppendBool(res []Setting, path, flagName string, v *bool, reloadable bool) []Setting {
+	if v == nil {
+		return res
+	}
+	return append(res, Setting{Path: path, Flag: flagName, Value: fmt.Sprintf("%v", *v), Reloadable: reloadable})
+}
+
+// AppendList adds the setting if it's given, as a comma separated flag value
+func AppendList(res []Setting, path, flagName string, v []string, reloadable bool) []Setting {
+	if v == nil {
+		return res
+	}
+	return append(res, Setting{Path: path, Flag: flagName, Value: strings.Join(v, ","), Reloadable: reloadable})
+}
+
+// ReadConfigFile decodes the named file into the configuration, and validates it
+func ReadConfigFile(name string, c Config) error {
+	f, e := os.Open(name)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if e := dec.Decode(c); e != nil {
+		return fmt.Errorf("config file %s: %v", name, e)
+	}
+
+	if e := c.Validate(); e != nil {
+		return fmt.Errorf("config file %s: %v", name, e)
+	}
+
+	return nil
+}
+
+func flagsSetOnCommandLine() map[string]bool {
+	result := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		result[f.Name] = true
+	})
+	return result
+}
+
+// resetRemovedSettings sets the flags the configuration file set before, but doesn't set anymore,
+// back to their defaults. Settings that can't change at runtime are left alone, and their paths returned
+func resetRemovedSettings(settings []Setting) ([]string, error) {
+	given := map[string]bool{}
+	for _, s := range settings {
+		given[s.Flag] = true
+	}
+
+	ignored := []string{}
+	for name, s := range configuredFlags {
+		if given[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		if !s.Reloadable {
+			if f.Value.String() != f.DefValue {
+				ignored = append(ignored, s.Path)
+			}
+			continue
+		}
+		if e := flag.Set(name, f.DefValue); e != nil {
+			return nil, fmt.Errorf("%s: %v", s.Path, e)
+		}
+		delete(configuredFlags, name)
+	}
+	sort.Strings(ignored)
+	return ignored, nil
+}
+
+// ApplyConfig sets the flags from the configuration, unless they were given on the command line.
+// If onlyReloadable is true, settings that can't change at runtime will be left alone, and the
+// paths of those that would have changed are returned. The reloadable settings the configuration
+// set before, but doesn't give anymore, are then reset to their defaults
+func ApplyConfig(c Config, onlyReloadable bool) ([]string, error) {
+	ConfigLock.Lock()
+	defer ConfigLock.Unlock()
+
+	if configuredFlags == nil {
+		configuredFlags = map[string]Setting{}
+	}
+
+	settings := c.Settings()
+	ignored := []string{}
+	if onlyReloadable {
+		var e error
+		if ignored, e = resetRemovedSettings(settings); e != nil {
+			return nil, e
+		}
+	}
+	for _, s := range settings {
+		if CommandLineFlags[s.Flag] {
+			continue
+		}
+		if onlyReloadable && !s.Reloadable {
+			if flag.Lookup(s.Flag).Value.String() != s.Value {
+				ignored = append(ignored, s.Path)
+			}
+			continue
+		}
+		if e := flag.Set(s.Flag, s.Value); e != nil {
+			return nil, fmt.Errorf("%s: %v", s.Path, e)
+		}
+		configuredFlags[s.Flag] = s
+	}
+	return ignored, nil
+}
+
+// LoadConfig remembers the flags given on the command line, and then applies the named
+// configuration file, read into c. Nothing is read if the name is empty
+func LoadConfig(name string, c Config) error {
+	CommandLineFlags = flagsSetOnCommandLine()
+	if name == "" {
+		return nil
+	}
+	if e := ReadConfigFile(name, c); e != nil {
+		return e
+	}
+	_, e := ApplyConfig(c, false)
+	return e
+}
+
+// ReloadConfig reads the configuration file again into c, and applies the settings that can be changed at runtime
+func ReloadConfig(name string, c Config) ([]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if e := ReadConfigFile(name, c); e != nil {
+		return nil, e
+	}
+	return ApplyConfig(c, true)
+}
+
+// WithFlags will reset the given flags, and the flags considered given on the command line or set
+// by the configuration file, to their current values when the returned function is called. It's meant for tests
+func WithFlags(names ...string) func() {
+	old := map[string]string{}
+	for _, n := range names {
+		old[n] = flag.Lookup(n).Value.String()
+	}
+	oldCommandLine := CommandLineFlags
+	oldConfigured := map[string]Setting{}
+	for n, s := range configuredFlags {
+		oldConfigured[n] = s
+	}
+	return func() {
+		for n, v := range old {
+			flag.Set(n, v)
+		}
+		CommandLineFlags = oldCommandLine
+		configuredFlags = oldConfigured
+	}
+}
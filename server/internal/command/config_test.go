@@ -0,0 +1,96 @@
+package command
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func writeConfig(c *C, content string) string {
+	fn := filepath.Join(c.MkDir(), "config.json")
+	c.Assert(ioutil.WriteFile(fn, []byte(content), 0600), IsNil)
+	return fn
+}
+
+func (s *CommandSuite) Test_ReadConfigFile_returnsErrorsWithTheNameOfTheFile(c *C) {
+	fn := writeConfig(c, `{"Nmae": "x"}`)
+	c.Assert(ReadConfigFile(fn, &testConfig{}), ErrorMatches, "config file "+fn+": json: unknown field \"Nmae\"")
+
+	fn = writeConfig(c, `{"Name": ""}`)
+	c.Assert(ReadConfigFile(fn, &testConfig{}), ErrorMatches, "config file "+fn+": Name: can't be empty")
+}
+
+func (s *CommandSuite) Test_LoadConfig_andReloadConfig_applyTheSettings(c *C) {
+	defer WithFlags("command-test-name", "command-test-count")()
+	fn := writeConfig(c, `{"Name": "first", "Count": 1}`)
+
+	c.Assert(LoadConfig(fn, &testConfig{}), IsNil)
+	c.Assert(*testName, Equals, "first")
+	c.Assert(*testCount, Equals, uint(1))
+
+	c.Assert(ioutil.WriteFile(fn, []byte(`{"Name": "second", "Count": 2}`), 0600), IsNil)
+	ignored, e := ReloadConfig(fn, &testConfig{})
+	c.Assert(e, IsNil)
+	c.Assert(ignored, DeepEquals, []string{"Name"})
+	c.Assert(*testName, Equals, "first")
+	c.Assert(*testCount, Equals, uint(2))
+}
+
+func (s *CommandSuite) Test_ReloadConfig_resetsTheSettingsRemovedFromTheFile(c *C) {
+	defer WithFlags("command-test-name", "command-test-count")()
+	// earlier tests have set the flags, so they would be taken as given on the command line
+	CommandLineFlags = map[string]bool{}
+	fn := writeConfig(c, `{"Name": "first", "Count": 1}`)
+	cfg := &testConfig{}
+	c.Assert(ReadConfigFile(fn, cfg), IsNil)
+	_, e := ApplyConfig(cfg, false)
+	c.Assert(e, IsNil)
+	c.Assert(*testCount, Equals, uint(1))
+
+	c.Assert(ioutil.WriteFile(fn, []byte(`{}`), 0600), IsNil)
+	ignored, e := ReloadConfig(fn, &testConfig{})
+	c.Assert(e, IsNil)
+	c.Assert(ignored, DeepEquals, []string{"Name"})
+	c.Assert(*testName, Equals, "first")
+	c.Assert(*testCount, Equals, uint(0))
+
+	c.Assert(ioutil.WriteFile(fn, []byte(`{"Count": 3}`), 0600), IsNil)
+	_, e = ReloadConfig(fn, &testConfig{})
+	c.Assert(e, IsNil)
+	c.Assert(*testCount, Equals, uint(3))
+}
+
+func (s *CommandSuite) Test_ReloadConfig_keepsTheCommandLineValueOfARemovedSetting(c *C) {
+	defer WithFlags("command-test-count")()
+	c.Assert(flag.Set("command-test-count", "7"), IsNil)
+	fn := writeConfig(c, `{"Count": 1}`)
+	c.Assert(LoadConfig(fn, &testConfig{}), IsNil)
+	c.Assert(*testCount, Equals, uint(7))
+
+	c.Assert(ioutil.WriteFile(fn, []byte(`{}`), 0600), IsNil)
+	_, e := ReloadConfig(fn, &testConfig{})
+	c.Assert(e, IsNil)
+	c.Assert(*testCount, Equals, uint(7))
+}
+
+func (s *CommandSuite) Test_LoadConfig_doesNothingWithoutAName(c *C) {
+	defer WithFlags("command-test-name")()
+	c.Assert(LoadConfig("", &testConfig{}), IsNil)
+	ignored, e := ReloadConfig("", &testConfig{})
+	c.Assert(e, IsNil)
+	c.Assert(ignored, IsNil)
+}
+
+func (s *CommandSuite) Test_WithFlags_restoresTheFlagsAndTheCommandLine(c *C) {
+	CommandLineFlags = map[string]bool{"command-test-name": true}
+	*testName = "before"
+	restore := WithFlags("command-test-name")
+	*testName = "after"
+	CommandLineFlags = nil
+	restore()
+	c.Assert(*testName, Equals, "before")
+	c.Assert(CommandLineFlags, DeepEquals, map[string]bool{"command-test-name": true})
+	CommandLineFlags = nil
+}
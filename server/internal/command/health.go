@@ -0,0 +1,79 @@
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// The commands can serve health endpoints over HTTP on a separate admin address, meant for
+// load balancers and service managers. It should not be reachable from the outside.
+// - GET /healthz returns 200 as long as the process is running
+// - GET /readyz returns 200 if every readiness check of the command passes, and 503 otherwise
+// Both return a JSON document with the status and, for readiness, the result of each check.
+// The commands describe their own checks, and the other endpoints they add, like /stats.
+
+// AdminTimeout is the read and write timeout of the admin endpoints
+const AdminTimeout = time.Duration(10) * time.Second
+
+// HealthResponse is the document returned by the health endpoints
+type HealthResponse struct {
+	Status string
+	Checks []*pks.HealthCheck `json:",omitempty"`
+}
+
+// NewHealthCheck returns a passing check if e is nil, and a failing check with the error otherwise
+func NewHealthCheck(name string, e error) *pks.HealthCheck {
+	if e != nil {
+		return &pks.HealthCheck{Name: name, Error: e.Error()}
+	}
+	return &pks.HealthCheck{Name: name, OK: true}
+}
+
+// WriteJSON writes the result as a JSON document that shouldn't be cached
+func WriteJSON(w http.ResponseWriter, status int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// OnlyGet answers requests with other methods than GET and HEAD with 405
+func OnlyGet(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, &HealthResponse{Status: "alive"})
+}
+
+func handleReadiness(readinessChecks func() []*pks.HealthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := &HealthResponse{Status: "ready", Checks: readinessChecks()}
+		status := http.StatusOK
+		for _, c := range res.Checks {
+			if !c.OK {
+				res.Status = "not ready"
+				status = http.StatusServiceUnavailable
+			}
+		}
+		WriteJSON(w, status, res)
+	}
+}
+
+// HealthHandler returns a handler serving /healthz and /readyz, using the given checks for readiness
+func HealthHandler(readinessChecks func() []*pks.HealthCheck) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", OnlyGet(handleLiveness))
+	mux.HandleFunc("/readyz", OnlyGet(handleReadiness(readinessChecks)))
+	return mux
+}
@@ -0,0 +1,50 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func serveHealth(c *C, checks []*pks.HealthCheck, method, path string) (*httptest.ResponseRecorder, *HealthResponse) {
+	h := HealthHandler(func() []*pks.HealthCheck { return checks })
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	res := &HealthResponse{}
+	if w.Code != http.StatusMethodNotAllowed {
+		c.Assert(json.NewDecoder(w.Body).Decode(res), IsNil)
+	}
+	return w, res
+}
+
+func (s *CommandSuite) Test_HealthHandler_reportsLivenessWithoutChecks(c *C) {
+	w, res := serveHealth(c, []*pks.HealthCheck{NewHealthCheck("storage", errors.New("broken"))}, "GET", "/healthz")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Cache-Control"), Equals, "no-store")
+	c.Assert(res, DeepEquals, &HealthResponse{Status: "alive"})
+}
+
+func (s *CommandSuite) Test_HealthHandler_reportsNotReadyWhenAnyCheckFails(c *C) {
+	checks := []*pks.HealthCheck{NewHealthCheck("users", nil), NewHealthCheck("storage", errors.New("broken"))}
+	w, res := serveHealth(c, checks, "GET", "/readyz")
+	c.Assert(w.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(res.Status, Equals, "not ready")
+	c.Assert(res.Checks, DeepEquals, []*pks.HealthCheck{
+		&pks.HealthCheck{Name: "users", OK: true},
+		&pks.HealthCheck{Name: "storage", Error: "broken"},
+	})
+
+	w, res = serveHealth(c, checks[:1], "GET", "/readyz")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(res.Status, Equals, "ready")
+}
+
+func (s *CommandSuite) Test_HealthHandler_onlyAllowsGet(c *C) {
+	w, _ := serveHealth(c, nil, "POST", "/readyz")
+	c.Assert(w.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(w.Header().Get("Allow"), Equals, "GET, HEAD")
+}
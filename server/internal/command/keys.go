@@ -0,0 +1,40 @@
+package command
+
+import (
+	"os"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// FileExists returns true if the file can be found
+func FileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// LoadOrCreateKeypair loads the long term keys of the server from the named file. If the file
+// doesn't exist, new keys are created and written to it
+func LoadOrCreateKeypair(f pks.Factory, keyFile string) (pks.Keypair, error) {
+	if FileExists(keyFile) {
+		file, e := os.Open(keyFile)
+		if e != nil {
+			return nil, e
+		}
+		defer file.Close()
+		return f.LoadKeypairFrom(file)
+	}
+
+	file, e := os.Create(keyFile)
+	if e != nil {
+		return nil, e
+	}
+
+	defer file.Close()
+	ret := f.CreateKeypair()
+
+	if e := f.StoreKeysInto(ret, file); e != nil {
+		return nil, e
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,90 @@
+package command
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+type mockFactory struct {
+	loadKeypairFromArgFileName string
+	loadKeypairFromReturnError error
+	storeKeysIntoReturnError   error
+}
+
+func (f *mockFactory) CreateKeypair() pks.Keypair {
+	return nil
+}
+
+func (f *mockFactory) LoadKeypairFrom(r io.Reader) (pks.Keypair, error) {
+	f.loadKeypairFromArgFileName = r.(*os.File).Name()
+	return nil, f.loadKeypairFromReturnError
+}
+
+func (f *mockFactory) StoreKeysInto(pks.Keypair, io.Writer) error {
+	return f.storeKeysIntoReturnError
+}
+
+func (f *mockFactory) LoadStorageType(name string) (pks.Storage, error) {
+	return nil, nil
+}
+
+func (f *mockFactory) NewServer(string, pks.Keypair, int, pks.Storage, time.Duration, time.Duration, pks.Restrictor) pks.Server {
+	return nil
+}
+
+func (s *CommandSuite) Test_LoadOrCreateKeypair_willTryToLoadFromAnExistingFile(c *C) {
+	fn := filepath.Join(c.MkDir(), "keys")
+	ioutil.WriteFile(fn, nil, 0600)
+
+	fac := &mockFactory{}
+	_, e := LoadOrCreateKeypair(fac, fn)
+	c.Assert(e, IsNil)
+	c.Assert(fac.loadKeypairFromArgFileName, Equals, fn)
+}
+
+func (s *CommandSuite) Test_LoadOrCreateKeypair_willReturnErrorIfSomethingGoesWrongWithFile(c *C) {
+	fn := filepath.Join(c.MkDir(), "keys")
+	ioutil.WriteFile(fn, nil, 0200)
+
+	_, e := LoadOrCreateKeypair(&mockFactory{}, fn)
+	c.Assert(e, ErrorMatches, ".* permission denied")
+}
+
+func (s *CommandSuite) Test_LoadOrCreateKeypair_returnsErrorFromLoadingOfKeypair(c *C) {
+	fn := filepath.Join(c.MkDir(), "keys")
+	ioutil.WriteFile(fn, nil, 0600)
+
+	_, e := LoadOrCreateKeypair(&mockFactory{loadKeypairFromReturnError: errors.New("something blah")}, fn)
+	c.Assert(e, ErrorMatches, "something blah")
+}
+
+func (s *CommandSuite) Test_LoadOrCreateKeypair_returnsErrorIfFileCantBeCreated(c *C) {
+	_, e := LoadOrCreateKeypair(&mockFactory{}, "/somewhere/that/shouldn't/work")
+	c.Assert(e, ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *CommandSuite) Test_LoadOrCreateKeypair_writesANewlyCreatedKeypairToTheFile(c *C) {
+	fn := filepath.Join(c.MkDir(), "keys")
+	f := pks.CreateFactory(nil)
+	c.Assert(FileExists(fn), Equals, false)
+	r, e := LoadOrCreateKeypair(f, fn)
+	c.Assert(e, IsNil)
+	c.Assert(FileExists(fn), Equals, true)
+
+	r2, e2 := LoadOrCreateKeypair(f, fn)
+	c.Assert(e2, IsNil)
+	c.Assert(r.Fingerprint(), DeepEquals, r2.Fingerprint())
+}
+
+func (s *CommandSuite) Test_LoadOrCreateKeypair_willReturnTheErrorFromStoringKeysInto(c *C) {
+	fn := filepath.Join(c.MkDir(), "keys")
+	_, e := LoadOrCreateKeypair(&mockFactory{storeKeysIntoReturnError: errors.New("something blah")}, fn)
+	c.Assert(e, ErrorMatches, "something blah")
+}
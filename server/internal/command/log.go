@@ -0,0 +1,55 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var logLock sync.Mutex
+var logOutput *os.File
+var logOutputName string
+
+// OpenLog will start writing log messages to the file named by the given flag,
+// or to standard out if it is empty. It's safe to call this again when the flag changes
+func OpenLog(logFile *string) error {
+	ConfigLock.RLock()
+	name := *logFile
+	ConfigLock.RUnlock()
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if name == logOutputName {
+		return nil
+	}
+
+	var f *os.File
+	if name != "" {
+		var e error
+		f, e = os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if e != nil {
+			return e
+		}
+	}
+
+	if logOutput != nil {
+		logOutput.Close()
+	}
+	logOutput = f
+	logOutputName = name
+	return nil
+}
+
+// Logf writes a log message to the file opened by OpenLog, or to standard out
+func Logf(format string, args ...interface{}) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	var out io.Writer = os.Stdout
+	if logOutput != nil {
+		out = logOutput
+	}
+	fmt.Fprintf(out, format, args...)
+}
@@ -0,0 +1,29 @@
+package command
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *CommandSuite) Test_OpenLog_makesLogfWriteToTheLogFile(c *C) {
+	defer WithFlags("command-test-log-file")()
+	fn := filepath.Join(c.MkDir(), "log")
+
+	*testLogFile = fn
+	c.Assert(OpenLog(testLogFile), IsNil)
+	Logf("something %d\n", 42)
+
+	*testLogFile = ""
+	c.Assert(OpenLog(testLogFile), IsNil)
+
+	res, _ := ioutil.ReadFile(fn)
+	c.Assert(string(res), Equals, "something 42\n")
+}
+
+func (s *CommandSuite) Test_OpenLog_returnsErrorIfTheFileCantBeOpened(c *C) {
+	defer WithFlags("command-test-log-file")()
+	*testLogFile = "/somewhere/that/shouldn't/work"
+	c.Assert(OpenLog(testLogFile), ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
@@ -0,0 +1,277 @@
+package frame
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticated frames are used when the raw server is only supposed to be reached
+// by trusted gateways, each one having its own shared secret. The secrets are stored
+// in a file with one line for each gateway, in the format gateway-id:base64-secret
+// Empty lines and lines starting with # are ignored. A gateway stores its own secret
+// in a file containing only the base64 encoded secret.
+//
+// An authenticated frame looks like this:
+// - 2 bytes uint16 len1
+// - len1 bytes containing the gateway ID
+// - 8 bytes uint64 timestamp, in seconds since the epoch
+// - 16 bytes nonce
+// - 2 bytes uint16 len2
+// - len2 bytes containing the "from"
+// - 2 bytes uint16 len3
+// - len3 bytes containing the message
+// - 32 bytes HMAC-SHA256 of all the above, keyed with the secret of the gateway
+// Frames that are older (or newer) than the max age will be rejected,
+// and so will frames where the nonce has already been seen inside of that time window.
+
+const frameNonceLength = 16
+const frameMACLength = sha256.Size
+const minimumGatewaySecretLength = 16
+
+var errUnknownGateway = errors.New("unknown gateway")
+var errInvalidFrameMAC = errors.New("invalid frame MAC")
+var errStaleFrame = errors.New("stale frame")
+var errReplayedFrame = errors.New("replayed frame")
+
+// Authenticator verifies authenticated frames with the secrets of the gateways
+type Authenticator struct {
+	secretsFile string
+	secrets     map[string][]byte
+	maxAge      time.Duration
+	seen        map[string]time.Time
+	lastPruned  time.Time
+	now         func() time.Time
+	sync.Mutex
+}
+
+func parseGatewaySecrets(name string) (map[string][]byte, error) {
+	f, e := os.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	result := make(map[string][]byte)
+	sc := bufio.NewScanner(f)
+	line := 0
+	for sc.Scan() {
+		line++
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected gateway-id:secret", name, line)
+		}
+		secret, e := base64.StdEncoding.DecodeString(parts[1])
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: secret is not valid base64", name, line)
+		}
+		if len(secret) < minimumGatewaySecretLength {
+			return nil, fmt.Errorf("%s:%d: secret has to be at least %d bytes", name, line, minimumGatewaySecretLength)
+		}
+		result[parts[0]] = secret
+	}
+	if e := sc.Err(); e != nil {
+		return nil, e
+	}
+	return result, nil
+}
+
+// NewAuthenticator reads the secrets of the gateways from the file
+func NewAuthenticator(secretsFile string, maxAge time.Duration) (*Authenticator, error) {
+	secrets, e := parseGatewaySecrets(secretsFile)
+	if e != nil {
+		return nil, e
+	}
+	return &Authenticator{
+		secretsFile: secretsFile,
+		secrets:     secrets,
+		maxAge:      maxAge,
+		seen:        make(map[string]time.Time),
+		now:         time.Now,
+	}, nil
+}
+
+// Reload reads the secrets file again. If it fails, the old secrets are kept
+func (a *Authenticator) Reload() error {
+	secrets, e := parseGatewaySecrets(a.secretsFile)
+	if e != nil {
+		return e
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.secrets = secrets
+	return nil
+}
+
+// ReadSecret reads the secret of one gateway from a file containing only the base64 encoded secret
+func ReadSecret(name string) ([]byte, error) {
+	d, e := ioutil.ReadFile(name)
+	if e != nil {
+		return nil, e
+	}
+	secret, e := base64.StdEncoding.DecodeString(strings.TrimSpace(string(d)))
+	if e != nil {
+		return nil, fmt.Errorf("%s: secret is not valid base64", name)
+	}
+	if len(secret) < minimumGatewaySecretLength {
+		return nil, fmt.Errorf("%s: secret has to be at least %d bytes", name, minimumGatewaySecretLength)
+	}
+	return secret, nil
+}
+
+func computeFrameMAC(secret, data []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// expects the lock to be held
+func (a *Authenticator) pruneSeen(now time.Time) {
+	if now.Sub(a.lastPruned) < time.Second {
+		return
+	}
+	a.lastPruned = now
+	for k, exp := range a.seen {
+		if now.After(exp) {
+			delete(a.seen, k)
+		}
+	}
+}
+
+func (a *Authenticator) verify(gateway string, timestamp uint64, nonce, signed, mac []byte) error {
+	a.Lock()
+	defer a.Unlock()
+
+	secret, ok := a.secrets[gateway]
+	if !ok {
+		return errUnknownGateway
+	}
+
+	if !hmac.Equal(computeFrameMAC(secret, signed), mac) {
+		return errInvalidFrameMAC
+	}
+
+	now := a.now()
+	ts := time.Unix(int64(timestamp), 0)
+	if ts.Before(now.Add(-a.maxAge)) || ts.After(now.Add(a.maxAge)) {
+		return errStaleFrame
+	}
+
+	a.pruneSeen(now)
+	key := gateway + "\x00" + string(nonce)
+	if _, ok := a.seen[key]; ok {
+		return errReplayedFrame
+	}
+	a.seen[key] = ts.Add(a.maxAge)
+
+	return nil
+}
+
+func extractUint64(d []byte) ([]byte, uint64, bool) {
+	if len(d) < 8 {
+		return nil, 0, false
+	}
+	return d[8:], binary.BigEndian.Uint64(d), true
+}
+
+func appendUint64(l []byte, r uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, r)
+	return append(l, b...)
+}
+
+// ParseAuthenticated returns the elements of the authenticated frames in the data,
+// failing if any of them can't be verified
+func ParseAuthenticated(data []byte, a *Authenticator) ([]*Element, error) {
+	result := []*Element{}
+	remaining := data
+	var ok bool
+	var l uint16
+	var ts uint64
+	var gateway, nonce, from, d, mac []byte
+
+	for len(remaining) > 0 {
+		start := remaining
+		remaining, l, ok = extractShort(remaining)
+		if !ok {
+			return nil, errors.New("can't parse length of gateway element")
+		}
+		remaining, gateway, ok = extractFixedData(remaining, int(l))
+		if !ok {
+			return nil, errors.New("can't parse gateway element")
+		}
+		remaining, ts, ok = extractUint64(remaining)
+		if !ok {
+			return nil, errors.New("can't parse timestamp element")
+		}
+		remaining, nonce, ok = extractFixedData(remaining, frameNonceLength)
+		if !ok {
+			return nil, errors.New("can't parse nonce element")
+		}
+		remaining, l, ok = extractShort(remaining)
+		if !ok {
+			return nil, errors.New("can't parse length of from element")
+		}
+		remaining, from, ok = extractFixedData(remaining, int(l))
+		if !ok {
+			return nil, errors.New("can't parse from element")
+		}
+		remaining, l, ok = extractShort(remaining)
+		if !ok {
+			return nil, errors.New("can't parse length of data element")
+		}
+		remaining, d, ok = extractFixedData(remaining, int(l))
+		if !ok {
+			return nil, errors.New("can't parse data element")
+		}
+		signed := start[:len(start)-len(remaining)]
+		remaining, mac, ok = extractFixedData(remaining, frameMACLength)
+		if !ok {
+			return nil, errors.New("can't parse mac element")
+		}
+		if e := a.verify(string(gateway), ts, nonce, signed, mac); e != nil {
+			return nil, e
+		}
+		result = append(result, &Element{From: string(from), Data: string(d)})
+	}
+
+	return result, nil
+}
+
+// EncodeAuthenticated returns the frame for the element, signed with the secret of the gateway.
+// It returns ErrTooLong if the gateway, the from-address or the data doesn't fit
+func EncodeAuthenticated(gateway string, secret []byte, now time.Time, pe *Element) ([]byte, error) {
+	if len(gateway) > maxLength {
+		return nil, ErrTooLong
+	}
+	plain, e := Encode(pe)
+	if e != nil {
+		return nil, e
+	}
+	nonce := make([]byte, frameNonceLength)
+	if _, e := rand.Read(nonce); e != nil {
+		return nil, e
+	}
+
+	toSend := []byte{}
+	toSend = appendShort(toSend, uint16(len(gateway)))
+	toSend = append(toSend, []byte(gateway)...)
+	toSend = appendUint64(toSend, uint64(now.Unix()))
+	toSend = append(toSend, nonce...)
+	toSend = append(toSend, plain...)
+	return append(toSend, computeFrameMAC(secret, toSend)...), nil
+}
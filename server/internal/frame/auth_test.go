@@ -0,0 +1,238 @@
+package frame
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var testGatewaySecret = []byte("0123456789abcdef0123456789abcdef")
+
+func createAuthenticatedFrame(gateway string, secret []byte, ts time.Time, nonce byte, from, data string) []byte {
+	res := appendShort(nil, uint16(len(gateway)))
+	res = append(res, []byte(gateway)...)
+	tsb := make([]byte, 8)
+	binary.BigEndian.PutUint64(tsb, uint64(ts.Unix()))
+	res = append(res, tsb...)
+	n := make([]byte, frameNonceLength)
+	n[0] = nonce
+	res = append(res, n...)
+	res = appendShort(res, uint16(len(from)))
+	res = append(res, []byte(from)...)
+	res = appendShort(res, uint16(len(data)))
+	res = append(res, []byte(data)...)
+	m := hmac.New(sha256.New, secret)
+	m.Write(res)
+	return m.Sum(res)
+}
+
+func createTestAuthenticator(now time.Time) *Authenticator {
+	return &Authenticator{
+		secrets: map[string][]byte{"gw1": testGatewaySecret},
+		maxAge:  time.Duration(30) * time.Second,
+		seen:    make(map[string]time.Time),
+		now:     func() time.Time { return now },
+	}
+}
+
+func writeTempSecrets(content string) string {
+	f, _ := ioutil.TempFile("", "otrng-gateway-secrets")
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func (s *FrameSuite) Test_parseGatewaySecrets_readsAllSecrets(c *C) {
+	fn := writeTempSecrets("# our gateways\n\ngw1:MDEyMzQ1Njc4OWFiY2RlZg==\ngw2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYQ==\n")
+	defer os.Remove(fn)
+
+	res, e := parseGatewaySecrets(fn)
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 2)
+	c.Assert(res["gw1"], DeepEquals, []byte("0123456789abcdef"))
+	c.Assert(res["gw2"], DeepEquals, []byte("fedcba9876543210fedcba"))
+}
+
+func (s *FrameSuite) Test_parseGatewaySecrets_reportsTheLineOfErrors(c *C) {
+	invalid := map[string]string{
+		"gw1\n":                              ":1: expected gateway-id:secret",
+		"gw1:MDEyMzQ1Njc4OWFiY2RlZg==\n:x\n": ":2: expected gateway-id:secret",
+		"gw1:not base64!\n":                  ":1: secret is not valid base64",
+		"gw1:c2hvcnQ=\n":                     ":1: secret has to be at least 16 bytes",
+	}
+
+	for content, msg := range invalid {
+		fn := writeTempSecrets(content)
+		_, e := parseGatewaySecrets(fn)
+		os.Remove(fn)
+		c.Assert(e, ErrorMatches, fn+msg)
+	}
+}
+
+func (s *FrameSuite) Test_NewAuthenticator_returnsErrorForMissingFile(c *C) {
+	_, e := NewAuthenticator("/somewhere/that/shouldn't/work", time.Second)
+	c.Assert(e, ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *FrameSuite) Test_Authenticator_reload_keepsOldSecretsOnError(c *C) {
+	fn := writeTempSecrets("gw1:MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.Remove(fn)
+	a, e := NewAuthenticator(fn, time.Second)
+	c.Assert(e, IsNil)
+
+	ioutil.WriteFile(fn, []byte("gw2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYQ==\n"), 0600)
+	c.Assert(a.Reload(), IsNil)
+	c.Assert(a.secrets["gw1"], IsNil)
+	c.Assert(a.secrets["gw2"], Not(IsNil))
+
+	ioutil.WriteFile(fn, []byte("gw3\n"), 0600)
+	c.Assert(a.Reload(), ErrorMatches, ".*expected gateway-id:secret")
+	c.Assert(a.secrets["gw2"], Not(IsNil))
+}
+
+func (s *FrameSuite) Test_ParseAuthenticated_acceptsValidFrames(c *C) {
+	now := time.Unix(1500000000, 0)
+	a := createTestAuthenticator(now)
+
+	data := createAuthenticatedFrame("gw1", testGatewaySecret, now, 0x01, "ola", "abcde")
+	data = append(data, createAuthenticatedFrame("gw1", testGatewaySecret, now.Add(-time.Duration(10)*time.Second), 0x02, "arnold", "123")...)
+
+	res, e := ParseAuthenticated(data, a)
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 2)
+	c.Assert(res[0].From, Equals, "ola")
+	c.Assert(res[0].Data, Equals, "abcde")
+	c.Assert(res[1].From, Equals, "arnold")
+	c.Assert(res[1].Data, Equals, "123")
+}
+
+func (s *FrameSuite) Test_ParseAuthenticated_rejectsUnauthenticatedFrames(c *C) {
+	a := createTestAuthenticator(time.Now())
+
+	data := append([]byte{}, 0x00, 0x03)
+	data = append(data, []byte("ola")...)
+	data = append(data, 0x00, 0x05)
+	data = append(data, []byte("abcde")...)
+
+	_, e := ParseAuthenticated(data, a)
+	c.Assert(e, ErrorMatches, "can't parse .*")
+}
+
+func (s *FrameSuite) Test_ParseAuthenticated_rejectsUnknownGateways(c *C) {
+	now := time.Now()
+	a := createTestAuthenticator(now)
+
+	_, e := ParseAuthenticated(createAuthenticatedFrame("gw2", testGatewaySecret, now, 0x01, "ola", "abcde"), a)
+	c.Assert(e, Equals, errUnknownGateway)
+}
+
+func (s *FrameSuite) Test_ParseAuthenticated_rejectsFramesWithTheWrongMAC(c *C) {
+	now := time.Now()
+	a := createTestAuthenticator(now)
+
+	_, e := ParseAuthenticated(createAuthenticatedFrame("gw1", []byte("another secret that is not right"), now, 0x01, "ola", "abcde"), a)
+	c.Assert(e, Equals, errInvalidFrameMAC)
+
+	frame := createAuthenticatedFrame("gw1", testGatewaySecret, now, 0x01, "ola", "abcde")
+	frame[len(frame)-frameMACLength-1] = 'f'
+	_, e = ParseAuthenticated(frame, a)
+	c.Assert(e, Equals, errInvalidFrameMAC)
+}
+
+func (s *FrameSuite) Test_ParseAuthenticated_rejectsStaleFrames(c *C) {
+	now := time.Unix(1500000000, 0)
+	a := createTestAuthenticator(now)
+
+	_, e := ParseAuthenticated(createAuthenticatedFrame("gw1", testGatewaySecret, now.Add(-time.Duration(31)*time.Second), 0x01, "ola", "abcde"), a)
+	c.Assert(e, Equals, errStaleFrame)
+
+	_, e = ParseAuthenticated(createAuthenticatedFrame("gw1", testGatewaySecret, now.Add(time.Duration(31)*time.Second), 0x01, "ola", "abcde"), a)
+	c.Assert(e, Equals, errStaleFrame)
+}
+
+func (s *FrameSuite) Test_ParseAuthenticated_rejectsReplayedFrames(c *C) {
+	now := time.Unix(1500000000, 0)
+	a := createTestAuthenticator(now)
+	frame := createAuthenticatedFrame("gw1", testGatewaySecret, now, 0x01, "ola", "abcde")
+
+	_, e := ParseAuthenticated(frame, a)
+	c.Assert(e, IsNil)
+
+	_, e = ParseAuthenticated(frame, a)
+	c.Assert(e, Equals, errReplayedFrame)
+}
+
+func (s *FrameSuite) Test_Authenticator_forgetsNoncesAfterTheyExpire(c *C) {
+	now := time.Unix(1500000000, 0)
+	a := createTestAuthenticator(now)
+	c.Assert(a.verify("gw1", uint64(now.Unix()), []byte{0x01}, []byte{}, computeFrameMAC(testGatewaySecret, []byte{})), IsNil)
+	c.Assert(a.seen, HasLen, 1)
+
+	a.now = func() time.Time { return now.Add(time.Duration(31) * time.Second) }
+	c.Assert(a.verify("gw1", uint64(now.Unix())+31, []byte{0x02}, []byte{}, computeFrameMAC(testGatewaySecret, []byte{})), IsNil)
+	c.Assert(a.seen, HasLen, 1)
+}
+
+func (s *FrameSuite) Test_ParseAuthenticated_reportsParseErrors(c *C) {
+	a := createTestAuthenticator(time.Now())
+	full := createAuthenticatedFrame("gw1", testGatewaySecret, time.Now(), 0x01, "ola", "abcde")
+
+	expected := map[int]string{
+		1:                   "can't parse length of gateway element",
+		3:                   "can't parse gateway element",
+		6:                   "can't parse timestamp element",
+		14:                  "can't parse nonce element",
+		30:                  "can't parse length of from element",
+		33:                  "can't parse from element",
+		35:                  "can't parse length of data element",
+		40:                  "can't parse data element",
+		len(full) - 1:       "can't parse mac element",
+		len(full) - 32 + 10: "can't parse mac element",
+	}
+	for l, msg := range expected {
+		_, e := ParseAuthenticated(full[:l], a)
+		c.Assert(e, ErrorMatches, msg)
+	}
+}
+
+func (s *FrameSuite) Test_EncodeAuthenticated_createsFramesTheAuthenticatorAccepts(c *C) {
+	now := time.Unix(1500000000, 0)
+	a := createTestAuthenticator(now)
+
+	one, e := EncodeAuthenticated("gw1", testGatewaySecret, now, &Element{From: "ola", Data: "abcde"})
+	c.Assert(e, IsNil)
+	two, e := EncodeAuthenticated("gw1", testGatewaySecret, now, &Element{From: "ola", Data: "abcde"})
+	c.Assert(e, IsNil)
+	c.Assert(one, Not(DeepEquals), two)
+
+	res, e := ParseAuthenticated(append(one, two...), a)
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []*Element{&Element{From: "ola", Data: "abcde"}, &Element{From: "ola", Data: "abcde"}})
+
+	_, e = EncodeAuthenticated("gw1", testGatewaySecret, now, &Element{From: "ola", Data: strings.Repeat("a", 0x10000)})
+	c.Assert(e, Equals, ErrTooLong)
+	_, e = EncodeAuthenticated(strings.Repeat("g", 0x10000), testGatewaySecret, now, &Element{From: "ola", Data: "abcde"})
+	c.Assert(e, Equals, ErrTooLong)
+}
+
+func (s *FrameSuite) Test_ReadSecret_readsTheBase64EncodedSecret(c *C) {
+	fn := writeTempSecrets("MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.Remove(fn)
+	secret, e := ReadSecret(fn)
+	c.Assert(e, IsNil)
+	c.Assert(secret, DeepEquals, []byte("0123456789abcdef"))
+
+	ioutil.WriteFile(fn, []byte("c2hvcnQ=\n"), 0600)
+	_, e = ReadSecret(fn)
+	c.Assert(e, ErrorMatches, fn+": secret has to be at least 16 bytes")
+
+	ioutil.WriteFile(fn, []byte("not base64!\n"), 0600)
+	_, e = ReadSecret(fn)
+	c.Assert(e, ErrorMatches, fn+": secret is not valid base64")
+}
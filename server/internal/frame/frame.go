@@ -0,0 +1,104 @@
+// Package frame reads and writes the frames of the raw protocol, described in server/raw/protocol.go,
+// for the raw server and the commands that send frames to it.
+package frame
+
+import (
+	"errors"
+)
+
+// maxLength is the longest element a frame can hold, since the lengths are written as 2 bytes
+const maxLength = 0xFFFF
+
+// ErrTooLong is returned when an element is too long to fit in a frame
+var ErrTooLong = errors.New("the message is too long for the raw protocol, use fragmentation")
+
+// Element is the content of one frame
+type Element struct {
+	From string
+	Data string
+}
+
+func extractShort(d []byte) ([]byte, uint16, bool) {
+	if len(d) < 2 {
+		return nil, 0, false
+	}
+
+	return d[2:], uint16(d[0])<<8 |
+		uint16(d[1]), true
+}
+
+func extractFixedData(d []byte, l int) (newPoint []byte, data []byte, ok bool) {
+	if len(d) < l {
+		return d, nil, false
+	}
+	return d[l:], d[0:l], true
+}
+
+func appendShort(l []byte, r uint16) []byte {
+	return append(l, byte(r>>8), byte(r))
+}
+
+// Parse returns the elements of the plain frames in the data
+func Parse(data []byte) ([]*Element, error) {
+	result := []*Element{}
+	remaining := data
+	var ok bool
+	var l uint16
+	var from, d []byte
+
+	for len(remaining) > 0 {
+		remaining, l, ok = extractShort(remaining)
+		if !ok {
+			return nil, errors.New("can't parse length of from element")
+		}
+		remaining, from, ok = extractFixedData(remaining, int(l))
+		if !ok {
+			return nil, errors.New("can't parse from element")
+		}
+		remaining, l, ok = extractShort(remaining)
+		if !ok {
+			return nil, errors.New("can't parse length of data element")
+		}
+		remaining, d, ok = extractFixedData(remaining, int(l))
+		if !ok {
+			return nil, errors.New("can't parse data element")
+		}
+		result = append(result, &Element{From: string(from), Data: string(d)})
+	}
+
+	return result, nil
+}
+
+// Encode returns the plain frame for the element, or ErrTooLong if the from-address or the data doesn't fit
+func Encode(pe *Element) ([]byte, error) {
+	if len(pe.From) > maxLength || len(pe.Data) > maxLength {
+		return nil, ErrTooLong
+	}
+	toSend := []byte{}
+	toSend = appendShort(toSend, uint16(len(pe.From)))
+	toSend = append(toSend, []byte(pe.From)...)
+	toSend = appendShort(toSend, uint16(len(pe.Data)))
+	return append(toSend, []byte(pe.Data)...), nil
+}
+
+// ParsePackets returns the data of the packets the raw server replies with
+func ParsePackets(data []byte) ([]string, error) {
+	result := []string{}
+	remaining := data
+	var ok bool
+	var l uint16
+	var d []byte
+
+	for len(remaining) > 0 {
+		remaining, l, ok = extractShort(remaining)
+		if ok {
+			remaining, d, ok = extractFixedData(remaining, int(l))
+		}
+		if !ok {
+			return nil, errors.New("unexpected length of data received from the server")
+		}
+		result = append(result, string(d))
+	}
+
+	return result, nil
+}
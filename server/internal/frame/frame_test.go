@@ -0,0 +1,119 @@
+package frame
+
+import (
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type FrameSuite struct{}
+
+var _ = Suite(&FrameSuite{})
+
+func (s *FrameSuite) Test_appendShort_willAppendTheWord(c *C) {
+	res := appendShort(nil, 0x4215)
+	c.Assert(res, DeepEquals, []byte{0x42, 0x15})
+}
+
+func (s *FrameSuite) Test_extractShort_willExtractTheShortAndReturnTheRemaining(c *C) {
+	d := []byte{0x42, 0x15, 0x11}
+	rem, sh, ok := extractShort(d)
+	c.Assert(rem, DeepEquals, []byte{0x11})
+	c.Assert(ok, Equals, true)
+	c.Assert(sh, Equals, uint16(0x4215))
+}
+
+func (s *FrameSuite) Test_extractShort_willFailIfNotEnoughBytesGiven(c *C) {
+	_, _, ok := extractShort([]byte{})
+	c.Assert(ok, Equals, false)
+
+	_, _, ok = extractShort([]byte{0x01})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *FrameSuite) Test_extractFixedData_willExtractTheLengthOfDataAndReturnTheRest(c *C) {
+	d := []byte{0x42, 0x15, 0x11}
+	rem, sh, ok := extractFixedData(d, 2)
+	c.Assert(rem, DeepEquals, []byte{0x11})
+	c.Assert(ok, Equals, true)
+	c.Assert(sh, DeepEquals, []byte{0x42, 0x15})
+}
+
+func (s *FrameSuite) Test_extractFixedData_willFailIfNotEnoughBytesGiven(c *C) {
+	_, _, ok := extractFixedData([]byte{}, 2)
+	c.Assert(ok, Equals, false)
+
+	_, _, ok = extractFixedData([]byte{0x01}, 2)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *FrameSuite) Test_Parse_willParseDataAndReturnIt(c *C) {
+	data := append([]byte{}, 0x00, 0x03)
+	data = append(data, []byte("ola")...)
+	data = append(data, 0x00, 0x05)
+	data = append(data, []byte("abcde")...)
+	data = append(data, 0x00, 0x06)
+	data = append(data, []byte("arnold")...)
+	data = append(data, 0x00, 0x03)
+	data = append(data, []byte("123")...)
+
+	res, e := Parse(data)
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []*Element{
+		&Element{From: "ola", Data: "abcde"},
+		&Element{From: "arnold", Data: "123"},
+	})
+}
+
+func (s *FrameSuite) Test_Parse_willGenerateErrorsForIncompleteFrames(c *C) {
+	_, e := Parse([]byte{0x00})
+	c.Assert(e, ErrorMatches, "can't parse length of from element")
+	_, e = Parse([]byte{0x00, 0x03, 0x01})
+	c.Assert(e, ErrorMatches, "can't parse from element")
+	_, e = Parse([]byte{0x00, 0x01, 0x65, 0x00})
+	c.Assert(e, ErrorMatches, "can't parse length of data element")
+	_, e = Parse([]byte{0x00, 0x01, 0x65, 0x00, 0x05, 0x01})
+	c.Assert(e, ErrorMatches, "can't parse data element")
+}
+
+func (s *FrameSuite) Test_Encode_returnsWhatParseReads(c *C) {
+	pe := &Element{From: "sita@example.org", Data: "?OTRP..."}
+	one, e := Encode(pe)
+	c.Assert(e, IsNil)
+	two, _ := Encode(&Element{From: "rama@example.org"})
+	res, e := Parse(append(one, two...))
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []*Element{pe, &Element{From: "rama@example.org"}})
+}
+
+func (s *FrameSuite) Test_ParsePackets_returnsTheDataOfEveryPacket(c *C) {
+	res, e := ParsePackets([]byte{0x00, 0x03, 'o', 'n', 'e', 0x00, 0x00, 0x00, 0x03, 't', 'w', 'o'})
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []string{"one", "", "two"})
+
+	res, e = ParsePackets(nil)
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 0)
+}
+
+func (s *FrameSuite) Test_ParsePackets_failsOnTruncatedData(c *C) {
+	_, e := ParsePackets([]byte{0x00, 0x05, 'a'})
+	c.Assert(e, ErrorMatches, "unexpected length of data received from the server")
+	_, e = ParsePackets([]byte{0x00})
+	c.Assert(e, ErrorMatches, "unexpected length of data received from the server")
+}
+
+func (s *FrameSuite) Test_Encode_refusesElementsThatDontFit(c *C) {
+	long := strings.Repeat("a", 0x10000)
+	_, e := Encode(&Element{From: "sita@example.org", Data: long})
+	c.Assert(e, Equals, ErrTooLong)
+	_, e = Encode(&Element{From: long, Data: "?OTRP..."})
+	c.Assert(e, Equals, ErrTooLong)
+
+	res, e := Encode(&Element{From: "sita@example.org", Data: long[1:]})
+	c.Assert(e, IsNil)
+	c.Assert(res, HasLen, 2+16+2+0xFFFF)
+}
@@ -0,0 +1,209 @@
+// Package transport contains the client side of the protocols the front ends of the prekey server
+// talk, for the commands that act as clients.
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// The transports send every message to the server in its own request, and return the replies.
+// They implement the same interface as the prekey server itself, so clients can also talk
+// to a server in the same process.
+
+// Options describe the server to talk to, and how
+type Options struct {
+	// Server is tcp:HOST:PORT or tls:HOST:PORT for the raw protocol, or an http:// or https:// URL for the HTTP front end
+	Server string
+	// User and PasswordFile are used to log in to the HTTP front end, unless TokenFile is given
+	User         string
+	PasswordFile string
+	TokenFile    string
+	// TLSCAFile contains the certificates to trust. Empty means the system ones
+	TLSCAFile string
+	Timeout   time.Duration
+}
+
+func loadCertPool(name string) (*x509.CertPool, error) {
+	if name == "" {
+		return nil, nil
+	}
+	d, e := ioutil.ReadFile(name)
+	if e != nil {
+		return nil, e
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(d) {
+		return nil, fmt.Errorf("%s: no certificates found", name)
+	}
+	return pool, nil
+}
+
+// New returns a transport for the server in the options
+func New(o *Options) (pks.Server, error) {
+	pool, e := loadCertPool(o.TLSCAFile)
+	if e != nil {
+		return nil, e
+	}
+
+	switch {
+	case strings.HasPrefix(o.Server, "tcp:"):
+		return &rawTransport{address: strings.TrimPrefix(o.Server, "tcp:"), timeout: o.Timeout}, nil
+	case strings.HasPrefix(o.Server, "tls:"):
+		addr := strings.TrimPrefix(o.Server, "tls:")
+		host, _, e := net.SplitHostPort(addr)
+		if e != nil {
+			return nil, e
+		}
+		return &rawTransport{address: addr, timeout: o.Timeout, tls: &tls.Config{ServerName: host, RootCAs: pool}}, nil
+	case strings.HasPrefix(o.Server, "http://"), strings.HasPrefix(o.Server, "https://"):
+		auth, e := loadAuthorization(o)
+		if e != nil {
+			return nil, e
+		}
+		client := &http.Client{
+			Timeout:   o.Timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+		return &httpTransport{url: o.Server, authorization: auth, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown server %q - it has to start with tcp:, tls:, http:// or https://", o.Server)
+}
+
+func readSecret(name string) (string, error) {
+	d, e := ioutil.ReadFile(name)
+	if e != nil {
+		return "", e
+	}
+	s := strings.TrimSpace(string(d))
+	if s == "" {
+		return "", fmt.Errorf("%s: the file is empty", name)
+	}
+	return s, nil
+}
+
+// loadAuthorization returns the Authorization header to send to the HTTP front end
+func loadAuthorization(o *Options) (string, error) {
+	if o.TokenFile != "" {
+		t, e := readSecret(o.TokenFile)
+		if e != nil {
+			return "", e
+		}
+		return "Bearer " + t, nil
+	}
+	if o.User == "" {
+		return "", nil
+	}
+	if o.PasswordFile == "" {
+		return "", errors.New("a password file is needed to log in")
+	}
+	p, e := readSecret(o.PasswordFile)
+	if e != nil {
+		return "", e
+	}
+	r := &http.Request{Header: http.Header{}}
+	r.SetBasicAuth(o.User, p)
+	return r.Header.Get("Authorization"), nil
+}
+
+// rawTransport talks the raw protocol, described in server/raw/protocol.go
+type rawTransport struct {
+	address string
+	timeout time.Duration
+	tls     *tls.Config
+}
+
+type closeWriter interface {
+	net.Conn
+	CloseWrite() error
+}
+
+func (t *rawTransport) dial() (closeWriter, error) {
+	d := &net.Dialer{Timeout: t.timeout}
+	if t.tls != nil {
+		return tls.DialWithDialer(d, "tcp", t.address, t.tls)
+	}
+	c, e := d.Dial("tcp", t.address)
+	if e != nil {
+		return nil, e
+	}
+	return c.(*net.TCPConn), nil
+}
+
+func (t *rawTransport) Handle(from, message string) ([]string, error) {
+	toSend, e := frame.Encode(&frame.Element{From: from, Data: message})
+	if e != nil {
+		return nil, e
+	}
+	con, e := t.dial()
+	if e != nil {
+		return nil, e
+	}
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(t.timeout))
+
+	if _, e := con.Write(toSend); e != nil {
+		return nil, e
+	}
+	if e := con.CloseWrite(); e != nil {
+		return nil, e
+	}
+	res, e := ioutil.ReadAll(con)
+	if e != nil {
+		return nil, e
+	}
+	return frame.ParsePackets(res)
+}
+
+// httpTransport posts every message to the HTTP front end, asking for the from-address as the identity to use
+type httpTransport struct {
+	url           string
+	authorization string
+	client        *http.Client
+}
+
+func (t *httpTransport) Handle(from, message string) ([]string, error) {
+	req, e := http.NewRequest("POST", t.url, bytes.NewBufferString(message))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if from != "" {
+		req.Header.Set("X-Prekey-Identity", from)
+	}
+	if t.authorization != "" {
+		req.Header.Set("Authorization", t.authorization)
+	}
+
+	resp, e := t.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	body, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	result := []string{}
+	for _, l := range strings.Split(string(body), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
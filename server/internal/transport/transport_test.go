@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TransportSuite struct{}
+
+var _ = Suite(&TransportSuite{})
+
+func writeFile(c *C, name, content string) string {
+	c.Assert(ioutil.WriteFile(name, []byte(content), 0600), IsNil)
+	return name
+}
+
+func (s *TransportSuite) Test_rawTransport_sendsAFrameAndReadsThePackets(c *C) {
+	l, e := net.Listen("tcp", "localhost:0")
+	c.Assert(e, IsNil)
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		con, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer con.Close()
+		d, _ := ioutil.ReadAll(con)
+		received <- d
+		con.Write([]byte{0x00, 0x03, 'o', 'n', 'e', 0x00, 0x03, 't', 'w', 'o'})
+	}()
+
+	t := &rawTransport{address: l.Addr().String(), timeout: time.Duration(5) * time.Second}
+	res, e := t.Handle("sita", "hello.")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []string{"one", "two"})
+	c.Assert(<-received, DeepEquals, []byte{0x00, 0x04, 's', 'i', 't', 'a', 0x00, 0x06, 'h', 'e', 'l', 'l', 'o', '.'})
+}
+
+func (s *TransportSuite) Test_httpTransport_postsTheMessageWithTheIdentity(c *C) {
+	var req *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte("one\ntwo\n"))
+	}))
+	defer srv.Close()
+
+	t := &httpTransport{url: srv.URL, authorization: "Bearer abc", client: srv.Client()}
+	res, e := t.Handle("sita@example.org", "hello.")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []string{"one", "two"})
+	c.Assert(req.Method, Equals, "POST")
+	c.Assert(req.Header.Get("X-Prekey-Identity"), Equals, "sita@example.org")
+	c.Assert(req.Header.Get("Authorization"), Equals, "Bearer abc")
+	c.Assert(string(body), Equals, "hello.")
+}
+
+func (s *TransportSuite) Test_httpTransport_failsOnErrorStatuses(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Identity not allowed.", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	t := &httpTransport{url: srv.URL, client: srv.Client()}
+	_, e := t.Handle("rama@example.org", "hello.")
+	c.Assert(e, ErrorMatches, "the server answered 403 Forbidden: Identity not allowed.")
+}
+
+func (s *TransportSuite) Test_New_choosesTheTransportFromTheServer(c *C) {
+	dir := c.MkDir()
+	t, e := New(&Options{Server: "tls:prekeys.example.org:3242"})
+	c.Assert(e, IsNil)
+	c.Assert(t.(*rawTransport).tls.ServerName, Equals, "prekeys.example.org")
+
+	o := &Options{
+		Server:       "https://prekeys.example.org/prekeys",
+		User:         "sita",
+		PasswordFile: writeFile(c, filepath.Join(dir, "password"), "secret\n"),
+	}
+	t, e = New(o)
+	c.Assert(e, IsNil)
+	c.Assert(t.(*httpTransport).authorization, Equals, "Basic c2l0YTpzZWNyZXQ=")
+
+	o.TokenFile = writeFile(c, filepath.Join(dir, "token"), "abc\n")
+	t, _ = New(o)
+	c.Assert(t.(*httpTransport).authorization, Equals, "Bearer abc")
+
+	o.PasswordFile, o.TokenFile = "", ""
+	_, e = New(o)
+	c.Assert(e, ErrorMatches, "a password file is needed to log in")
+
+	_, e = New(&Options{Server: "xmpp:prekeys.example.org"})
+	c.Assert(e, ErrorMatches, "unknown server .*")
+}
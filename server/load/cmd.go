@@ -0,0 +1,23 @@
+package main
+
+import "flag"
+
+// These flags represent all the available command line flags
+var (
+	serverAddress  = flag.String("server", "in-process", "The server to load: tcp:HOST:PORT or tls:HOST:PORT for the raw protocol, an http:// or https:// URL for the HTTP front end, or in-process for a server in the same process")
+	httpUser       = flag.String("user", "", "The user to log in to the HTTP front end as. It has to be allowed to use the from-addresses of all the clients as identities")
+	passwordFile   = flag.String("password-file", "", "File containing the password for the HTTP front end")
+	tokenFile      = flag.String("token-file", "", "File containing a bearer token for the HTTP front end, used instead of a password")
+	tlsCAFile      = flag.String("tls-ca-file", "", "File containing the certificates to trust for TLS connections. Empty means the system ones")
+	requestTimeout = flag.Uint("timeout", 30, "Timeout for every request to the server, in seconds")
+	storageEngine  = flag.String("storage", "in-memory", "What storage engine the in-process server uses: 'in-memory', 'in-memory:snapshot=/PATH/FILE[,interval=5m]', 'dir:/PATH/HERE', 'redis:address=HOST:PORT[,db=0][,prefix=otrng-prekeys][,password-file=/PATH/FILE][,timeout=5s]', 'sharded:key-file=/PATH/FILE[,rebalance=true];STORAGE;STORAGE...' or 'cached:[entries=10000][,ttl=1m];STORAGE' are the choices available")
+	clientCount    = flag.Uint("clients", 1000, "The number of distinct clients to simulate, each with its own keys and from-address")
+	fromTemplate   = flag.String("from-template", "load-{n}@example.org", "The from-address of the clients, where {n} is replaced by the number of the client")
+	concurrency    = flag.Uint("concurrency", 16, "The number of flows run at the same time")
+	duration       = flag.Uint("duration", 30, "How long to run, in seconds. 0 means until -flows flows have run")
+	maxFlows       = flag.Uint("flows", 0, "The number of flows to run. 0 means running for -duration seconds")
+	flowMix        = flag.String("mix", "dake=1,publish=1,status=1,retrieve=2", "The flows to run and their relative frequencies, as flow=weight separated by comma. The flows are dake, publish, status and retrieve")
+	prekeyMessages = flag.Uint("prekey-messages", 5, "The number of prekey messages every publication contains")
+	fragLen        = flag.Uint("fragmentation-length", 0, "Fragmentation length of messages sent to the server - 0 means no fragmenting")
+	jsonOutput     = flag.Bool("json", false, "Print the report as JSON, instead of as text")
+)
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// flow is something a client does, sending one or more messages to the server
+type flow struct {
+	name string
+	// messages are the names of the messages the flow sends, in order
+	messages []string
+	run      func(w *worker, c *simulatedClient) error
+}
+
+var flows = []*flow{
+	{"dake", []string{"DAKE-1"}, runDAKE},
+	{"publish", []string{"DAKE-1", "DAKE-3 publication"}, runPublish},
+	{"status", []string{"DAKE-1", "DAKE-3 storage information request"}, runStatus},
+	{"retrieve", []string{"ensemble retrieval query"}, runRetrieve},
+}
+
+func findFlow(name string) *flow {
+	for _, f := range flows {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+type weightedFlow struct {
+	*flow
+	weight int
+}
+
+// parseMix parses flow weights in the format of the mix flag
+func parseMix(s string) ([]weightedFlow, error) {
+	result := []weightedFlow{}
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		f := findFlow(strings.TrimSpace(kv[0]))
+		if f == nil {
+			return nil, fmt.Errorf("unknown flow %q", kv[0])
+		}
+		weight := 1
+		if len(kv) == 2 {
+			w, e := strconv.Atoi(strings.TrimSpace(kv[1]))
+			if e != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight for the %s flow: %q", f.name, kv[1])
+			}
+			weight = w
+		}
+		total += weight
+		result = append(result, weightedFlow{f, weight})
+	}
+	if total == 0 {
+		return nil, errors.New("no flows to run")
+	}
+	return result, nil
+}
+
+// simulatedClient is one of the clients of the load test. Only one worker uses it
+type simulatedClient struct {
+	*pks.Client
+	published bool
+}
+
+var errInvalidEnsemble = errors.New("the server returned an invalid ensemble")
+
+func runDAKE(_ *worker, c *simulatedClient) error {
+	return c.Handshake()
+}
+
+// runPublish publishes profiles the first time, and only prekey messages after that
+func runPublish(w *worker, c *simulatedClient) error {
+	p := &pks.Publication{PrekeyMessages: w.load.prekeyMessages}
+	if !c.published {
+		now := time.Now()
+		p.ClientProfileExpiry = now.Add(time.Duration(14*24) * time.Hour)
+		p.PrekeyProfileExpiry = now.Add(time.Duration(7*24) * time.Hour)
+	}
+	if e := c.Publish(p); e != nil {
+		return e
+	}
+	c.published = true
+	return nil
+}
+
+func runStatus(_ *worker, c *simulatedClient) error {
+	_, e := c.StorageStatus()
+	return e
+}
+
+// runRetrieve asks for the ensembles of any of the clients - finding none is not an error
+func runRetrieve(w *worker, c *simulatedClient) error {
+	ens, e := c.Retrieve(w.load.from(w.rand.Intn(w.load.clients)))
+	if e != nil {
+		return e
+	}
+	for _, en := range ens {
+		if len(en.Problems)+len(en.ClientProfile.Problems)+len(en.PrekeyProfile.Problems)+len(en.PrekeyMessage.Problems) > 0 {
+			return errInvalidEnsemble
+		}
+	}
+	return nil
+}
+
+// loadTest describes a load test, and keeps track of how far it is
+type loadTest struct {
+	server         pks.Server
+	description    string
+	clients        int
+	fromTemplate   string
+	concurrency    int
+	duration       time.Duration
+	maxFlows       int64
+	mix            []weightedFlow
+	prekeyMessages int
+	fragmentLength int
+
+	started  int64
+	deadline time.Time
+}
+
+func (l *loadTest) from(n int) string {
+	return strings.Replace(l.fromTemplate, "{n}", strconv.Itoa(n), -1)
+}
+
+// nextFlow returns false when no more flows should be started
+func (l *loadTest) nextFlow() bool {
+	if l.duration > 0 && !time.Now().Before(l.deadline) {
+		return false
+	}
+	return l.maxFlows == 0 || atomic.AddInt64(&l.started, 1) <= l.maxFlows
+}
+
+// run runs the load test, with every worker keeping its own statistics until the end
+func (l *loadTest) run() *report {
+	start := time.Now()
+	l.deadline = start.Add(l.duration)
+	workers := make([]*worker, l.concurrency)
+	wg := sync.WaitGroup{}
+	for ix := range workers {
+		workers[ix] = newWorker(l, ix)
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.work()
+		}(workers[ix])
+	}
+	wg.Wait()
+
+	st := newStats()
+	for _, w := range workers {
+		st.merge(w.stats)
+	}
+	return st.report(l, time.Since(start))
+}
+
+// worker runs one flow at a time, for the clients numbered ix, ix+concurrency, ix+2*concurrency and so on
+type worker struct {
+	load    *loadTest
+	ix      int
+	rand    *mrand.Rand
+	stats   *stats
+	rec     *recorder
+	clients map[int]*simulatedClient
+	total   int
+}
+
+func newWorker(l *loadTest, ix int) *worker {
+	st := newStats()
+	w := &worker{
+		load:    l,
+		ix:      ix,
+		rand:    mrand.New(mrand.NewSource(time.Now().UnixNano() + int64(ix))),
+		stats:   st,
+		rec:     &recorder{server: l.server, stats: st},
+		clients: map[int]*simulatedClient{},
+	}
+	for _, f := range l.mix {
+		w.total += f.weight
+	}
+	return w
+}
+
+func (w *worker) chooseFlow() *flow {
+	n := w.rand.Intn(w.total)
+	for _, f := range w.load.mix {
+		if n < f.weight {
+			return f.flow
+		}
+		n -= f.weight
+	}
+	return nil
+}
+
+// chooseClient returns one of the clients of the worker, creating its keys the first time it is used
+func (w *worker) chooseClient() *simulatedClient {
+	n := w.ix + w.load.concurrency*w.rand.Intn((w.load.clients-w.ix+w.load.concurrency-1)/w.load.concurrency)
+	c, ok := w.clients[n]
+	if !ok {
+		c = &simulatedClient{Client: &pks.Client{
+			From:           w.load.from(n),
+			Keys:           pks.GenerateClientKeys(nil),
+			Server:         w.rec,
+			FragmentLength: w.load.fragmentLength,
+		}}
+		w.clients[n] = c
+	}
+	return c
+}
+
+func (w *worker) work() {
+	for w.load.nextFlow() {
+		f := w.chooseFlow()
+		c := w.chooseClient()
+		w.rec.start(f)
+		start := time.Now()
+		e := f.run(w, c)
+		w.stats.flow(f.name, time.Since(start), e)
+		w.rec.finish(e)
+	}
+}
+
+// recorder sits between a client and the server, and times every message sent
+type recorder struct {
+	server pks.Server
+	stats  *stats
+
+	flow    *flow
+	sent    int
+	elapsed time.Duration
+	failed  bool
+}
+
+func (r *recorder) start(f *flow) {
+	r.flow = f
+	r.sent = 0
+	r.elapsed = 0
+	r.failed = false
+}
+
+// current returns the name of the message being sent
+func (r *recorder) current() string {
+	if r.sent < len(r.flow.messages) {
+		return r.flow.messages[r.sent]
+	}
+	return r.flow.messages[len(r.flow.messages)-1]
+}
+
+// finish records the error of the flow against the last message sent, if the server answered it
+func (r *recorder) finish(e error) {
+	if e != nil && !r.failed && r.sent > 0 {
+		r.sent--
+		r.stats.messageError(r.current(), e)
+	}
+}
+
+func (r *recorder) Handle(from, message string) ([]string, error) {
+	start := time.Now()
+	res, e := r.server.Handle(from, message)
+	r.elapsed += time.Since(start)
+	if e == nil && !isLastFragment(message) {
+		return res, nil
+	}
+
+	r.stats.message(r.current(), r.elapsed, e)
+	r.failed = e != nil
+	r.sent++
+	r.elapsed = 0
+	return res, e
+}
+
+const fragmentationPrefix = "?OTRP|"
+
+// isLastFragment returns true for the last fragment of a message, and for messages that are not fragmented
+func isLastFragment(message string) bool {
+	if !strings.HasPrefix(message, fragmentationPrefix) {
+		return true
+	}
+	parts := strings.SplitN(message, "|", 4)
+	if len(parts) != 4 {
+		return true
+	}
+	fields := strings.SplitN(parts[3], ",", 4)
+	return len(fields) < 3 || fields[1] == fields[2]
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type LoadSuite struct{}
+
+var _ = Suite(&LoadSuite{})
+
+func createTestServer() pks.Server {
+	f := pks.CreateFactory(nil)
+	st, _ := f.LoadStorageType("in-memory")
+	return f.NewServer("prekeys.example.org", f.CreateKeypair(), 0, st, time.Minute, time.Minute, nil)
+}
+
+func createTestLoad(server pks.Server, mix string, n int) *loadTest {
+	m, _ := parseMix(mix)
+	return &loadTest{
+		server:         server,
+		description:    "in-process",
+		clients:        4,
+		fromTemplate:   "load-{n}@example.org",
+		concurrency:    2,
+		maxFlows:       int64(n),
+		mix:            m,
+		prekeyMessages: 2,
+	}
+}
+
+type serverFunc func(from, message string) ([]string, error)
+
+func (f serverFunc) Handle(from, message string) ([]string, error) {
+	return f(from, message)
+}
+
+func (s *LoadSuite) Test_parseMix_parsesWeights(c *C) {
+	m, e := parseMix("dake=2, retrieve ,status=0")
+	c.Assert(e, IsNil)
+	c.Assert(m, HasLen, 3)
+	c.Assert(m[0].name, Equals, "dake")
+	c.Assert(m[0].weight, Equals, 2)
+	c.Assert(m[1].name, Equals, "retrieve")
+	c.Assert(m[1].weight, Equals, 1)
+	c.Assert(m[2].weight, Equals, 0)
+
+	_, e = parseMix("dance=1")
+	c.Assert(e, ErrorMatches, `unknown flow "dance"`)
+	_, e = parseMix("dake=many")
+	c.Assert(e, ErrorMatches, `invalid weight for the dake flow: "many"`)
+	_, e = parseMix("dake=0")
+	c.Assert(e, ErrorMatches, "no flows to run")
+}
+
+func (s *LoadSuite) Test_isLastFragment_looksAtTheFragmentIndex(c *C) {
+	c.Assert(isLastFragment("AAQ1."), Equals, true)
+	c.Assert(isLastFragment("?OTRP|2882382797|1245ABCD|00000000,1,2,AAQ1,"), Equals, false)
+	c.Assert(isLastFragment("?OTRP|2882382797|1245ABCD|00000000,2,2,AAQ1,"), Equals, true)
+}
+
+func (s *LoadSuite) Test_percentile_usesTheNearestRank(c *C) {
+	l := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	c.Assert(percentile(l, 50), Equals, time.Duration(5))
+	c.Assert(percentile(l, 90), Equals, time.Duration(9))
+	c.Assert(percentile(l, 99), Equals, time.Duration(10))
+	c.Assert(percentile(nil, 99), Equals, time.Duration(0))
+}
+
+func (s *LoadSuite) Test_loadTest_runsTheFlowsAgainstTheServer(c *C) {
+	r := createTestLoad(createTestServer(), "dake=1,publish=1,status=1,retrieve=1", 8).run()
+	c.Assert(r.Flows, Equals, 8)
+	c.Assert(r.Errors, Equals, 0)
+
+	flowCount := map[string]int{}
+	for _, f := range r.FlowStats {
+		flowCount[f.Name] = f.Count
+	}
+	messageCount := map[string]int{}
+	for _, m := range r.Messages {
+		messageCount[m.Name] = m.Count
+		c.Assert(m.Latency.Max >= m.Latency.P50, Equals, true)
+	}
+	c.Assert(messageCount["DAKE-1"], Equals, flowCount["dake"]+flowCount["publish"]+flowCount["status"])
+	c.Assert(messageCount["DAKE-3 publication"], Equals, flowCount["publish"])
+	c.Assert(messageCount["ensemble retrieval query"], Equals, flowCount["retrieve"])
+}
+
+func (s *LoadSuite) Test_loadTest_timesFragmentedMessagesAsOne(c *C) {
+	l := createTestLoad(createTestServer(), "status=1", 2)
+	l.fragmentLength = 200
+	r := l.run()
+	c.Assert(r.Errors, Equals, 0)
+	c.Assert(r.Messages, HasLen, 2)
+	c.Assert(r.Messages[0].Name, Equals, "DAKE-1")
+	c.Assert(r.Messages[0].Count, Equals, 2)
+	c.Assert(r.Messages[1].Name, Equals, "DAKE-3 storage information request")
+	c.Assert(r.Messages[1].Count, Equals, 2)
+}
+
+func (s *LoadSuite) Test_loadTest_reportsErrorsForTheMessageThatFailed(c *C) {
+	server := createTestServer()
+	sent := 0
+	failing := serverFunc(func(from, message string) ([]string, error) {
+		sent++
+		if sent == 2 || sent == 5 {
+			return nil, errors.New("connection refused")
+		}
+		return server.Handle(from, message)
+	})
+	l := createTestLoad(failing, "status=1", 3)
+	l.concurrency = 1
+	r := l.run()
+
+	c.Assert(r.Flows, Equals, 3)
+	c.Assert(r.Errors, Equals, 2)
+	c.Assert(r.Messages[1].Name, Equals, "DAKE-3 storage information request")
+	c.Assert(r.Messages[1].Errors, Equals, 1)
+	c.Assert(r.Messages[1].ErrorKind, DeepEquals, map[string]int{"connection refused": 1})
+	c.Assert(r.Messages[0].Errors, Equals, 1)
+
+	var out bytes.Buffer
+	r.text(&out)
+	c.Assert(out.String(), Matches, `(?s)Ran 3 flows against in-process in .* seconds, with 4 clients and 1 at the same time
+Throughput: .* flows per second, 2 errors
+.*
+Errors for every message:
+  DAKE-1: 1 x connection refused
+  DAKE-3 storage information request: 1 x connection refused
+`)
+}
+
+func (s *LoadSuite) Test_loadTest_countsRepliesTheClientRefusesAsErrors(c *C) {
+	wrong := serverFunc(func(from, message string) ([]string, error) {
+		return []string{"AAQ1."}, nil
+	})
+	r := createTestLoad(wrong, "dake=1", 2).run()
+	c.Assert(r.Errors, Equals, 2)
+	c.Assert(r.Messages, HasLen, 1)
+	c.Assert(r.Messages[0].Count, Equals, 2)
+	c.Assert(r.Messages[0].Errors, Equals, 2)
+	c.Assert(r.Messages[0].Latency, Equals, latencyReport{})
+}
+
+func (s *LoadSuite) Test_series_countsRareErrorsTogether(c *C) {
+	st := newStats()
+	for ix := 0; ix < maxErrorKinds+3; ix++ {
+		st.flow("dake", 0, errors.New(string(rune('a'+ix))))
+	}
+	c.Assert(st.flows["dake"].errorKind, HasLen, maxErrorKinds+1)
+	c.Assert(st.flows["dake"].errorKind[otherErrors], Equals, 3)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/transport"
+)
+
+// prekey-load finds out how much load a prekey server can take. It simulates many clients,
+// every one with its own long term keys, running the flows a real client would - DAKEs,
+// publications, storage status requests and ensemble retrievals - as fast as the server
+// answers, and reports the throughput, the latency percentiles and the errors for every
+// flow and every kind of message sent.
+
+const inProcessServer = "in-process"
+
+// createServer returns a transport for the server flag, or a server in this process
+func createServer() (pks.Server, error) {
+	if *serverAddress != inProcessServer {
+		return transport.New(&transport.Options{
+			Server:       *serverAddress,
+			User:         *httpUser,
+			PasswordFile: *passwordFile,
+			TokenFile:    *tokenFile,
+			TLSCAFile:    *tlsCAFile,
+			Timeout:      time.Duration(*requestTimeout) * time.Second,
+		})
+	}
+
+	f := pks.CreateFactory(nil)
+	st, e := f.LoadStorageType(*storageEngine)
+	if e != nil {
+		return nil, e
+	}
+	return f.NewServer("prekeys.example.org", f.CreateKeypair(), 0, st, time.Duration(5)*time.Minute, time.Duration(5)*time.Minute, nil), nil
+}
+
+// createLoadTest returns the load test the flags describe
+func createLoadTest(server pks.Server) (*loadTest, error) {
+	mix, e := parseMix(*flowMix)
+	if e != nil {
+		return nil, e
+	}
+	if *duration == 0 && *maxFlows == 0 {
+		return nil, errors.New("either -duration or -flows has to be given")
+	}
+	if *concurrency == 0 {
+		return nil, errors.New("the concurrency has to be at least 1")
+	}
+	if *clientCount < *concurrency {
+		return nil, fmt.Errorf("at least %d clients are needed to run %d flows at the same time", *concurrency, *concurrency)
+	}
+	if *prekeyMessages == 0 || *prekeyMessages > 255 {
+		return nil, errors.New("every publication has to contain between 1 and 255 prekey messages")
+	}
+
+	return &loadTest{
+		server:         server,
+		description:    *serverAddress,
+		clients:        int(*clientCount),
+		fromTemplate:   *fromTemplate,
+		concurrency:    int(*concurrency),
+		duration:       time.Duration(*duration) * time.Second,
+		maxFlows:       int64(*maxFlows),
+		mix:            mix,
+		prekeyMessages: int(*prekeyMessages),
+		fragmentLength: int(*fragLen),
+	}, nil
+}
+
+func printReport(out io.Writer, r *report) {
+	if *jsonOutput {
+		d, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Fprintf(out, "%s\n", d)
+		return
+	}
+	r.text(out)
+}
+
+func main() {
+	flag.Parse()
+
+	server, e := createServer()
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", e)
+		os.Exit(1)
+	}
+	l, e := createLoadTest(server)
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", e)
+		os.Exit(1)
+	}
+	printReport(os.Stdout, l.run())
+}
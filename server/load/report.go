@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// maxErrorKinds is how many different errors we keep apart for every flow and message, the rest are counted together
+const maxErrorKinds = 10
+
+const otherErrors = "other errors"
+
+// series is what we know about all the flows or messages of one kind
+type series struct {
+	count     int
+	errors    int
+	errorKind map[string]int
+	latencies []time.Duration
+}
+
+func (s *series) add(d time.Duration, e error) {
+	s.count++
+	if e == nil {
+		s.latencies = append(s.latencies, d)
+		return
+	}
+	s.addError(e)
+}
+
+func (s *series) addError(e error) {
+	s.errors++
+	kind := e.Error()
+	if _, ok := s.errorKind[kind]; !ok && len(s.errorKind) >= maxErrorKinds {
+		kind = otherErrors
+	}
+	s.errorKind[kind]++
+}
+
+func (s *series) merge(o *series) {
+	s.count += o.count
+	s.errors += o.errors
+	s.latencies = append(s.latencies, o.latencies...)
+	for k, n := range o.errorKind {
+		if _, ok := s.errorKind[k]; !ok && len(s.errorKind) >= maxErrorKinds {
+			k = otherErrors
+		}
+		s.errorKind[k] += n
+	}
+}
+
+// stats keeps the series for every flow and message. It is not safe to use from several goroutines
+type stats struct {
+	flows    map[string]*series
+	messages map[string]*series
+}
+
+func newStats() *stats {
+	return &stats{flows: map[string]*series{}, messages: map[string]*series{}}
+}
+
+func seriesFor(m map[string]*series, name string) *series {
+	s, ok := m[name]
+	if !ok {
+		s = &series{errorKind: map[string]int{}}
+		m[name] = s
+	}
+	return s
+}
+
+func (s *stats) flow(name string, d time.Duration, e error) {
+	seriesFor(s.flows, name).add(d, e)
+}
+
+func (s *stats) message(name string, d time.Duration, e error) {
+	seriesFor(s.messages, name).add(d, e)
+}
+
+// messageError records an error for a message that was already counted - when the server answered, but with the wrong thing
+func (s *stats) messageError(name string, e error) {
+	ms := seriesFor(s.messages, name)
+	ms.addError(e)
+	ms.latencies = ms.latencies[:len(ms.latencies)-1]
+}
+
+func (s *stats) merge(o *stats) {
+	for k, v := range o.flows {
+		seriesFor(s.flows, k).merge(v)
+	}
+	for k, v := range o.messages {
+		seriesFor(s.messages, k).merge(v)
+	}
+}
+
+// latencyReport has the latency percentiles of the successful flows or messages, in milliseconds
+type latencyReport struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	ix := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if ix < 0 {
+		ix = 0
+	}
+	return sorted[ix]
+}
+
+func newLatencyReport(latencies []time.Duration) latencyReport {
+	if len(latencies) == 0 {
+		return latencyReport{}
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, l := range sorted {
+		total += l
+	}
+	return latencyReport{
+		Mean: milliseconds(total / time.Duration(len(sorted))),
+		P50:  milliseconds(percentile(sorted, 50)),
+		P90:  milliseconds(percentile(sorted, 90)),
+		P99:  milliseconds(percentile(sorted, 99)),
+		Max:  milliseconds(sorted[len(sorted)-1]),
+	}
+}
+
+type seriesReport struct {
+	Name      string         `json:"name"`
+	Count     int            `json:"count"`
+	Errors    int            `json:"errors"`
+	PerSecond float64        `json:"perSecond"`
+	Latency   latencyReport  `json:"latencyMilliseconds"`
+	ErrorKind map[string]int `json:"errorKinds,omitempty"`
+}
+
+type report struct {
+	Server      string          `json:"server"`
+	Clients     int             `json:"clients"`
+	Concurrency int             `json:"concurrency"`
+	Seconds     float64         `json:"seconds"`
+	Flows       int             `json:"flows"`
+	Errors      int             `json:"errors"`
+	PerSecond   float64         `json:"perSecond"`
+	FlowStats   []*seriesReport `json:"flowStats"`
+	Messages    []*seriesReport `json:"messageStats"`
+}
+
+// seriesReports returns reports in the order of the names given, followed by any others sorted by name
+func seriesReports(m map[string]*series, order []string, elapsed time.Duration) []*seriesReport {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, n := range order {
+		if _, ok := m[n]; ok && !seen[n] {
+			names = append(names, n)
+			seen[n] = true
+		}
+	}
+	rest := []string{}
+	for n := range m {
+		if !seen[n] {
+			rest = append(rest, n)
+		}
+	}
+	sort.Strings(rest)
+
+	result := []*seriesReport{}
+	for _, n := range append(names, rest...) {
+		s := m[n]
+		r := &seriesReport{
+			Name:      n,
+			Count:     s.count,
+			Errors:    s.errors,
+			PerSecond: float64(s.count) / elapsed.Seconds(),
+			Latency:   newLatencyReport(s.latencies),
+		}
+		if len(s.errorKind) > 0 {
+			r.ErrorKind = s.errorKind
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func (s *stats) report(l *loadTest, elapsed time.Duration) *report {
+	flowOrder := []string{}
+	messageOrder := []string{}
+	for _, f := range flows {
+		flowOrder = append(flowOrder, f.name)
+		messageOrder = append(messageOrder, f.messages...)
+	}
+
+	r := &report{
+		Server:      l.description,
+		Clients:     l.clients,
+		Concurrency: l.concurrency,
+		Seconds:     elapsed.Seconds(),
+		FlowStats:   seriesReports(s.flows, flowOrder, elapsed),
+		Messages:    seriesReports(s.messages, messageOrder, elapsed),
+	}
+	for _, f := range r.FlowStats {
+		r.Flows += f.Count
+		r.Errors += f.Errors
+	}
+	r.PerSecond = float64(r.Flows) / elapsed.Seconds()
+	return r
+}
+
+func printSeries(tw io.Writer, title string, rs []*seriesReport) {
+	fmt.Fprintf(tw, "%s\tcount\terrors\tper second\tmean\tp50\tp90\tp99\tmax\t\n", title)
+	for _, s := range rs {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t\n",
+			s.Name, s.Count, s.Errors, s.PerSecond, s.Latency.Mean, s.Latency.P50, s.Latency.P90, s.Latency.P99, s.Latency.Max)
+	}
+}
+
+func printErrors(w io.Writer, rs []*seriesReport) {
+	for _, s := range rs {
+		kinds := []string{}
+		for k := range s.ErrorKind {
+			kinds = append(kinds, k)
+		}
+		sort.Slice(kinds, func(i, j int) bool {
+			if s.ErrorKind[kinds[i]] != s.ErrorKind[kinds[j]] {
+				return s.ErrorKind[kinds[i]] > s.ErrorKind[kinds[j]]
+			}
+			return kinds[i] < kinds[j]
+		})
+		for _, k := range kinds {
+			fmt.Fprintf(w, "  %s: %d x %s\n", s.Name, s.ErrorKind[k], k)
+		}
+	}
+}
+
+func (r *report) text(w io.Writer) {
+	fmt.Fprintf(w, "Ran %d flows against %s in %.1f seconds, with %d clients and %d at the same time\n",
+		r.Flows, r.Server, r.Seconds, r.Clients, r.Concurrency)
+	fmt.Fprintf(w, "Throughput: %.1f flows per second, %d errors\n\n", r.PerSecond, r.Errors)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	printSeries(tw, "flow", r.FlowStats)
+	fmt.Fprintf(tw, "\n")
+	printSeries(tw, "message", r.Messages)
+	tw.Flush()
+
+	if r.Errors > 0 {
+		fmt.Fprintf(w, "\nErrors for every message:\n")
+		printErrors(w, r.Messages)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The raw server is ready when its keypair is loaded, the storage can write and read a probe
+// entry, the sessions and fragmented messages in progress are within the configured bounds,
+// it's listening, and it's not draining connections before shutting down or handing over to
+// a new process. Next to the health endpoints, GET /stats returns the statistics the storage
+// keeps, like the requests every shard of a sharded storage has served and the identities
+// moved between them
+
+func currentHealthLimits() pks.HealthLimits {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return pks.HealthLimits{
+		MaxSessions:  int(*readyMaxSessions),
+		MaxFragments: int(*readyMaxFragments),
+	}
+}
+
+func (rs *rawServer) readinessChecks() []*pks.HealthCheck {
+	checks := []*pks.HealthCheck{}
+	if hc, ok := rs.s.(pks.HealthChecker); ok {
+		checks = append(checks, hc.CheckReadiness(currentHealthLimits())...)
+	}
+
+	listening := &pks.HealthCheck{Name: "listening", OK: rs.addrs() != nil}
+	if !listening.OK {
+		listening.Error = "the server isn't listening yet"
+	}
+	draining := &pks.HealthCheck{Name: "draining", OK: !rs.finishRequested}
+	if !draining.OK {
+		draining.Error = "the server is draining connections before stopping"
+	}
+	return append(checks, listening, draining)
+}
+
+func (rs *rawServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	var stats *pks.StorageStats
+	if sr, ok := rs.s.(pks.StorageStatsReporter); ok {
+		stats = sr.StorageStats()
+	}
+	if stats == nil {
+		stats = &pks.StorageStats{}
+	}
+	command.WriteJSON(w, http.StatusOK, stats)
+}
+
+func (rs *rawServer) adminHandler() http.Handler {
+	mux := command.HealthHandler(rs.readinessChecks)
+	mux.HandleFunc("/stats", command.OnlyGet(rs.handleStats))
+	return mux
+}
+
+// startAdmin starts serving the health endpoints and the statistics, if an admin address is given
+func (rs *rawServer) startAdmin() error {
+	if *adminAddress == "" {
+		return nil
+	}
+	l, e := net.Listen("tcp", *adminAddress)
+	if e != nil {
+		return fmt.Errorf("encountered error when starting admin listener: %v", e)
+	}
+
+	rs.listenersLock.Lock()
+	rs.admin = &http.Server{
+		Handler:      rs.adminHandler(),
+		ReadTimeout:  command.AdminTimeout,
+		WriteTimeout: command.AdminTimeout,
+	}
+	rs.adminAddr = l.Addr()
+	rs.listenersLock.Unlock()
+
+	command.Logf("Serving health checks and statistics on %s\n", l.Addr())
+	go rs.admin.Serve(l)
+	return nil
+}
+
+func (rs *rawServer) stopAdmin() {
+	rs.listenersLock.Lock()
+	defer rs.listenersLock.Unlock()
+	if rs.admin != nil {
+		rs.admin.Close()
+		rs.admin = nil
+	}
+}
+
+// currentAdminAddr returns the address of the admin listener, or nil if it's not running
+func (rs *rawServer) currentAdminAddr() net.Addr {
+	rs.listenersLock.Lock()
+	defer rs.listenersLock.Unlock()
+	if rs.admin == nil {
+		return nil
+	}
+	return rs.adminAddr
+}
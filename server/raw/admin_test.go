@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	. "gopkg.in/check.v1"
+)
+
+type mockHealthServer struct {
+	mockServer
+	limits pks.HealthLimits
+	checks []*pks.HealthCheck
+}
+
+func (ms *mockHealthServer) CheckReadiness(l pks.HealthLimits) []*pks.HealthCheck {
+	ms.limits = l
+	return ms.checks
+}
+
+type mockStatsServer struct {
+	mockServer
+	stats *pks.StorageStats
+}
+
+func (ms *mockStatsServer) StorageStats() *pks.StorageStats {
+	return ms.stats
+}
+
+func getHealth(addr, path string) (int, *command.HealthResponse, error) {
+	resp, e := http.Get("http://" + addr + path)
+	if e != nil {
+		return 0, nil, e
+	}
+	defer resp.Body.Close()
+	res := &command.HealthResponse{}
+	if e := json.NewDecoder(resp.Body).Decode(res); e != nil {
+		return 0, nil, e
+	}
+	return resp.StatusCode, res, nil
+}
+
+func startAdminForTest(rs *rawServer) func() {
+	flag := command.WithFlags("admin-address")
+	*adminAddress = "127.0.0.1:0"
+	if e := rs.startAdmin(); e != nil {
+		panic(e)
+	}
+	return func() {
+		rs.stopAdmin()
+		flag()
+	}
+}
+
+func (s *RawServerSuite) Test_startAdmin_doesNothingWithoutAnAdminAddress(c *C) {
+	defer command.WithFlags("admin-address")()
+	*adminAddress = ""
+	rs := &rawServer{}
+	c.Assert(rs.startAdmin(), IsNil)
+	c.Assert(rs.currentAdminAddr(), IsNil)
+}
+
+func (s *RawServerSuite) Test_startAdmin_returnsErrorWhenItCantListen(c *C) {
+	defer command.WithFlags("admin-address")()
+	*adminAddress = "256.0.0.1:0"
+	rs := &rawServer{}
+	c.Assert(rs.startAdmin(), ErrorMatches, "encountered error when starting admin listener: .*")
+}
+
+func (s *RawServerSuite) Test_handleLiveness_reportsTheServerAsAlive(c *C) {
+	sc := startStdoutCapture()
+	defer sc.restore()
+	rs := &rawServer{s: &mockServer{}}
+	defer startAdminForTest(rs)()
+
+	status, res, e := getHealth(rs.currentAdminAddr().String(), "/healthz")
+	c.Assert(e, IsNil)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(res.Status, Equals, "alive")
+	c.Assert(res.Checks, HasLen, 0)
+}
+
+func (s *RawServerSuite) Test_handleReadiness_reportsTheChecksFromTheServer(c *C) {
+	sc := startStdoutCapture()
+	defer sc.restore()
+	defer command.WithFlags("ready-max-sessions", "ready-max-fragments")()
+	*readyMaxSessions = 100
+	*readyMaxFragments = 200
+	ms := &mockHealthServer{checks: []*pks.HealthCheck{&pks.HealthCheck{Name: "storage", OK: true}}}
+	rs := &rawServer{s: ms}
+	rs.setListeners([]deadlineListener{})
+	defer startAdminForTest(rs)()
+
+	status, res, e := getHealth(rs.currentAdminAddr().String(), "/readyz")
+	c.Assert(e, IsNil)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(res.Status, Equals, "ready")
+	c.Assert(res.Checks, DeepEquals, []*pks.HealthCheck{
+		&pks.HealthCheck{Name: "storage", OK: true},
+		&pks.HealthCheck{Name: "listening", OK: true},
+		&pks.HealthCheck{Name: "draining", OK: true},
+	})
+	c.Assert(ms.limits, Equals, pks.HealthLimits{MaxSessions: 100, MaxFragments: 200})
+}
+
+func (s *RawServerSuite) Test_handleReadiness_reportsNotReadyWhenAnyCheckFails(c *C) {
+	sc := startStdoutCapture()
+	defer sc.restore()
+	ms := &mockHealthServer{checks: []*pks.HealthCheck{&pks.HealthCheck{Name: "storage", Error: "stale lock file /tmp/.lock"}}}
+	rs := &rawServer{s: ms}
+	rs.setListeners([]deadlineListener{})
+	defer startAdminForTest(rs)()
+
+	status, res, e := getHealth(rs.currentAdminAddr().String(), "/readyz")
+	c.Assert(e, IsNil)
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+	c.Assert(res.Status, Equals, "not ready")
+	c.Assert(res.Checks[0].Error, Equals, "stale lock file /tmp/.lock")
+}
+
+func (s *RawServerSuite) Test_handleReadiness_reportsNotReadyBeforeListeningAndWhileDraining(c *C) {
+	sc := startStdoutCapture()
+	defer sc.restore()
+	rs := &rawServer{s: &mockServer{}}
+	defer startAdminForTest(rs)()
+
+	status, res, e := getHealth(rs.currentAdminAddr().String(), "/readyz")
+	c.Assert(e, IsNil)
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+	c.Assert(res.Checks, DeepEquals, []*pks.HealthCheck{
+		&pks.HealthCheck{Name: "listening", Error: "the server isn't listening yet"},
+		&pks.HealthCheck{Name: "draining", OK: true},
+	})
+
+	rs.setListeners([]deadlineListener{})
+	rs.finishRequested = true
+	status, res, e = getHealth(rs.currentAdminAddr().String(), "/readyz")
+	c.Assert(e, IsNil)
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+	c.Assert(res.Checks[1], DeepEquals, &pks.HealthCheck{Name: "draining", Error: "the server is draining connections before stopping"})
+}
+
+func (s *RawServerSuite) Test_adminHandler_onlyAllowsGet(c *C) {
+	sc := startStdoutCapture()
+	defer sc.restore()
+	rs := &rawServer{s: &mockServer{}}
+	defer startAdminForTest(rs)()
+
+	resp, e := http.Post("http://"+rs.currentAdminAddr().String()+"/healthz", "text/plain", nil)
+	c.Assert(e, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+}
+
+func getStats(addr string) (*pks.StorageStats, error) {
+	resp, e := http.Get("http://" + addr + "/stats")
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	res := &pks.StorageStats{}
+	return res, json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (s *RawServerSuite) Test_handleStats_reportsTheStatisticsOfTheStorage(c *C) {
+	sc := startStdoutCapture()
+	defer sc.restore()
+	ms := &mockStatsServer{stats: &pks.StorageStats{
+		Rebalancing: true,
+		Shards:      []*pks.ShardStats{{Shard: "dir:/srv/a", Stores: 3, MovedIn: 1}, {Shard: "dir:/srv/b", Retrievals: 2}},
+	}}
+	rs := &rawServer{s: ms}
+	defer startAdminForTest(rs)()
+
+	res, e := getStats(rs.currentAdminAddr().String())
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, ms.stats)
+
+	ms.stats = nil
+	res, e = getStats(rs.currentAdminAddr().String())
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, &pks.StorageStats{})
+}
+
+func (s *RawServerSuite) Test_shutdown_keepsServingReadinessWhileDraining(c *C) {
+	sc := startStdoutCapture()
+	defer sc.restore()
+	defer command.WithFlags("drain-timeout")()
+	*drainTimeout = 5
+	rs := &rawServer{s: &mockServer{}}
+	rs.setListeners([]deadlineListener{})
+	defer startAdminForTest(rs)()
+	addr := rs.currentAdminAddr().String()
+
+	release := startBlockedRequest(rs)
+	done := make(chan bool)
+	go func() {
+		rs.shutdown()
+		close(done)
+	}()
+	for !rs.finishRequested {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+
+	status, _, e := getHealth(addr, "/readyz")
+	c.Assert(e, IsNil)
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+
+	close(release)
+	<-done
+	c.Assert(rs.currentAdminAddr(), IsNil)
+	_, _, e = getHealth(addr, "/healthz")
+	c.Assert(e, NotNil)
+}
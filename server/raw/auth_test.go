@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+var testGatewaySecret = []byte("0123456789abcdef0123456789abcdef")
+
+func createAuthenticatedFrame(gateway string, secret []byte, ts time.Time, nonce byte, from, data string) []byte {
+	res := appendShort(nil, uint16(len(gateway)))
+	res = append(res, []byte(gateway)...)
+	tsb := make([]byte, 8)
+	binary.BigEndian.PutUint64(tsb, uint64(ts.Unix()))
+	res = append(res, tsb...)
+	n := make([]byte, 16)
+	n[0] = nonce
+	res = append(res, n...)
+	res = appendShort(res, uint16(len(from)))
+	res = append(res, []byte(from)...)
+	res = appendShort(res, uint16(len(data)))
+	res = append(res, []byte(data)...)
+	m := hmac.New(sha256.New, secret)
+	m.Write(res)
+	return m.Sum(res)
+}
+
+func createTestAuthenticator(c *C) *frame.Authenticator {
+	fn := filepath.Join(c.MkDir(), "gateways.asc")
+	c.Assert(ioutil.WriteFile(fn, []byte("gw1:"+base64.StdEncoding.EncodeToString(testGatewaySecret)+"\n"), 0600), IsNil)
+	a, e := frame.NewAuthenticator(fn, time.Duration(30)*time.Second)
+	c.Assert(e, IsNil)
+	return a
+}
+
+func writeTempSecrets(content string) string {
+	f, _ := ioutil.TempFile("", "otrng-raw-gateway-secrets")
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func (s *RawServerSuite) Test_handleRequest_handsOverAuthenticatedDataToTheServer(c *C) {
+	now := time.Now()
+	ms := &mockServer{}
+	ms.returnData = [][]string{[]string{"one"}}
+	ms.returnError = []error{nil}
+
+	data := createAuthenticatedFrame("gw1", testGatewaySecret, now, 0x01, "ola", "abcde")
+	m := &mockRWC{retReadN: len(data), retReadE: io.EOF, retReadBuf: data}
+	(&rawServer{s: ms, auth: createTestAuthenticator(c)}).handleRequest(m)
+	c.Assert(ms.receivedFrom, DeepEquals, []string{"ola"})
+	c.Assert(m.written, DeepEquals, []byte{0x00, 0x03, 0x6f, 0x6e, 0x65})
+}
+
+func (s *RawServerSuite) Test_rawServer_parseData_requiresAuthenticationWithGatewaySecrets(c *C) {
+	data := append([]byte{}, 0x00, 0x03)
+	data = append(data, []byte("ola")...)
+	data = append(data, 0x00, 0x05)
+	data = append(data, []byte("abcde")...)
+
+	rs := &rawServer{auth: createTestAuthenticator(c)}
+	_, e := rs.parseData(data)
+	c.Assert(e, ErrorMatches, "can't parse .*")
+
+	rs.auth = nil
+	_, e = rs.parseData(data)
+	c.Assert(e, IsNil)
+}
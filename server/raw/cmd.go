@@ -4,10 +4,16 @@ import "flag"
 
 // These flags represent all the available command line flags
 var (
+	configFile           = flag.String("config", "", "Configuration file in JSON format. Flags given on the command line take precedence over the file")
 	keyFile              = flag.String("key-file", "raw-server.keys", "Location of file where server long term keys should be stored and loaded")
 	listenPort           = flag.Uint("port", 3242, "Port to listen to")
 	listenIP             = flag.String("address", "localhost", "Address to listen to")
-	storageEngine        = flag.String("storage", "in-memory", "What storage engine to use: 'in-memory' or 'dir:/PATH/HERE' are the choices available")
+	listenAddresses      = flag.String("listen", "", "The addresses to listen to, separated by comma, for example 'tcp:localhost:3242,unix:/run/otrng/raw.sock'. Empty means using -address and -port")
+	socketMode           = flag.String("socket-mode", "", "The file mode of Unix domain sockets, in octal. Empty means the default")
+	socketOwner          = flag.String("socket-owner", "", "The user owning Unix domain sockets. Empty means the user running the server")
+	socketGroup          = flag.String("socket-group", "", "The group owning Unix domain sockets. Empty means the default")
+	storageEngine        = flag.String("storage", "in-memory", "What storage engine to use: 'in-memory', 'in-memory:snapshot=/PATH/FILE[,interval=5m]', 'dir:/PATH/HERE', 'redis:address=HOST:PORT[,db=0][,prefix=otrng-prekeys][,password-file=/PATH/FILE][,timeout=5s]', 'sharded:key-file=/PATH/FILE[,rebalance=true];STORAGE;STORAGE...' or 'cached:[entries=10000][,ttl=1m];STORAGE' are the choices available")
+	sharedState          = flag.String("shared-state", "", "Store shared with the other replicas for the sessions and fragmented messages in progress, so any replica can get any message of a client: 'redis:address=HOST:PORT[,db=0][,prefix=otrng-prekey-state][,password-file=/PATH/FILE][,timeout=5s]'. Empty means keeping them in the process")
 	serverIdentity       = flag.String("identity", "keys.example.org", "The identity of the server")
 	fragLen              = flag.Uint("fragmentation-length", 0, "Fragmentation length - 0 means no fragmenting")
 	sessionTimeout       = flag.Uint("session-timeout", 5, "Session timeout, in minutes")
@@ -15,4 +21,20 @@ var (
 	allowOnlyPrefix      = flag.String("only-prefix", "", "The prefixes of 'from' that should be allowed, separated by comma. Empty means no restrictions")
 	allowOnlySuffix      = flag.String("only-suffix", "", "The suffixes of 'from' that should be allowed, separated by comma. Empty means no restrictions")
 	allowOnly            = flag.String("only", "", "The only 'from' addresses that are allowed, separated by comma. Empty means no restrictions")
+	connectionTimeout    = flag.Uint("connection-timeout", 120, "Connection timeout, in seconds")
+	maxConcurrent        = flag.Uint("max-concurrent", 0, "The maximum number of connections handled at the same time. Connections beyond that are closed right away. 0 means no limit")
+	readLimit            = flag.Uint("read-limit", 268435456, "The maximum number of bytes to read from one connection")
+	logFile              = flag.String("log-file", "", "File to write log messages to. Empty means standard out")
+	gatewaySecrets       = flag.String("gateway-secrets", "", "File containing the shared secrets of trusted gateways, one line for each, gateway-id:base64-secret. If given, only authenticated frames will be accepted")
+	frameMaxAge          = flag.Uint("frame-max-age", 30, "The maximum age of authenticated frames, in seconds")
+	tlsCertFile          = flag.String("tls-cert-file", "", "File containing the TLS certificate. If given, only TLS connections will be accepted")
+	tlsKeyFile           = flag.String("tls-key-file", "", "File containing the private key for the TLS certificate")
+	tlsClientCAFile      = flag.String("tls-client-ca-file", "", "File containing the CA certificates used to verify client certificates. If given, clients have to present a certificate")
+	tlsClientPermissions = flag.String("tls-client-permissions", "", "File mapping client certificate identities to the from-addresses they can send messages for, in JSON format")
+	drainTimeout         = flag.Uint("drain-timeout", 30, "When shutting down or restarting, the maximum time to wait for connections in progress to finish, in seconds")
+	sessionStateFile     = flag.String("session-state-file", "", "File where sessions in progress are saved when shutting down, and restored from when starting. Empty means sessions in progress are dropped")
+	adminAddress         = flag.String("admin-address", "", "Address to serve the health endpoints /healthz and /readyz and the storage statistics /stats on, over HTTP, for example 'localhost:3243'. Empty means no health endpoints")
+	readyMaxSessions     = flag.Uint("ready-max-sessions", 0, "The maximum number of sessions in progress before the server reports itself as not ready - 0 means no limit")
+	readyMaxFragments    = flag.Uint("ready-max-fragments", 0, "The maximum number of fragmented messages in progress before the server reports itself as not ready - 0 means no limit")
+	policyFile           = flag.String("policy-file", "", "File containing the restriction policy rules, in JSON format. It will be reloaded on SIGHUP. Empty means no policy file")
 )
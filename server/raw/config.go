@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The configuration file, applied as described in the command package. The settings
+// marked as reloadable below are changed on SIGHUP.
+//
+//   {
+//     "Listen": {"Address": "localhost", "Port": 3242, "Addresses": ["tcp:localhost:3242", "unix:/run/otrng/raw.sock"],
+//                "SocketMode": "0660", "SocketOwner": "otrng", "SocketGroup": "otrng-gateways"},
+//     "KeyFile": "/etc/otrng/raw-server.keys",
+//     "Storage": "dir:/var/lib/otrng-prekeys",
+//     "SharedState": "redis:address=kv.example.org:6379",
+//     "Identity": "keys.example.org",
+//     "FragmentationLength": 0,
+//     "Timeouts": {"SessionMinutes": 5, "FragmentationMinutes": 5, "ConnectionSeconds": 120},
+//     "Restrictions": {"Only": [], "OnlyPrefix": [], "OnlySuffix": ["@example.org"], "PolicyFile": ""},
+//     "Gateways": {"SecretsFile": "/etc/otrng/gateways.asc", "MaxFrameAgeSeconds": 30},
+//     "TLS": {"CertFile": "/etc/otrng/cert.pem", "KeyFile": "/etc/otrng/key.pem", "ClientCAFile": "/etc/otrng/gateways-ca.pem", "ClientPermissionsFile": "/etc/otrng/gateways.json"},
+//     "Restart": {"DrainSeconds": 30, "SessionStateFile": "/var/lib/otrng/raw-sessions.json"},
+//     "Admin": {"Address": "localhost:3243", "MaxSessions": 10000, "MaxFragments": 10000},
+//     "Limits": {"ReadLimit": 268435456, "MaxConcurrent": 0},
+//     "Logging": {"File": ""}
+//   }
+
+type listenConfig struct {
+	Address     *string
+	Port        *uint
+	Addresses   []string
+	SocketMode  *string
+	SocketOwner *string
+	SocketGroup *string
+}
+
+type timeoutsConfig struct {
+	SessionMinutes       *uint
+	FragmentationMinutes *uint
+	ConnectionSeconds    *uint // reloadable
+}
+
+type restrictionsConfig struct {
+	Only       []string // reloadable
+	OnlyPrefix []string // reloadable
+	OnlySuffix []string // reloadable
+	PolicyFile *string  // the name can't change, but the file itself is always reloaded
+}
+
+type gatewaysConfig struct {
+	SecretsFile        *string // the name can't change, but the file itself is always reloaded
+	MaxFrameAgeSeconds *uint
+}
+
+// the names of the files can't change, but the files themselves are always reloaded
+type tlsConfig struct {
+	CertFile              *string
+	KeyFile               *string
+	ClientCAFile          *string
+	ClientPermissionsFile *string
+}
+
+type restartConfig struct {
+	DrainSeconds     *uint // reloadable
+	SessionStateFile *string
+}
+
+type adminConfig struct {
+	Address      *string
+	MaxSessions  *uint // reloadable
+	MaxFragments *uint // reloadable
+}
+
+type limitsConfig struct {
+	ReadLimit     *uint // reloadable
+	MaxConcurrent *uint
+}
+
+type loggingConfig struct {
+	File *string // reloadable
+}
+
+type rawConfig struct {
+	Listen              listenConfig
+	KeyFile             *string
+	Storage             *string
+	SharedState         *string
+	Identity            *string
+	FragmentationLength *uint
+	Timeouts            timeoutsConfig
+	Restrictions        restrictionsConfig
+	Gateways            gatewaysConfig
+	TLS                 tlsConfig
+	Restart             restartConfig
+	Admin               adminConfig
+	Limits              limitsConfig
+	Logging             loggingConfig
+}
+
+func readConfigFile(name string) (*rawConfig, error) {
+	c := &rawConfig{}
+	if e := command.ReadConfigFile(name, c); e != nil {
+		return nil, e
+	}
+	return c, nil
+}
+
+func validateRestrictionList(path string, l []string) error {
+	for ix, v := range l {
+		if v == "" {
+			return fmt.Errorf("%s[%d]: can't be empty", path, ix)
+		}
+		if strings.Contains(v, ",") {
+			return fmt.Errorf("%s[%d]: can't contain a comma", path, ix)
+		}
+	}
+	return nil
+}
+
+// Validate implements the command.Config interface
+func (c *rawConfig) Validate() error {
+	if c.Listen.Port != nil && *c.Listen.Port > 65535 {
+		return fmt.Errorf("Listen.Port: %d is not a valid port", *c.Listen.Port)
+	}
+	if c.Listen.Address != nil && *c.Listen.Address == "" {
+		return errors.New("Listen.Address: can't be empty")
+	}
+	for ix, a := range c.Listen.Addresses {
+		if strings.Contains(a, ",") {
+			return fmt.Errorf("Listen.Addresses[%d]: can't contain a comma", ix)
+		}
+		if _, e := parseListenerDescriptor(a); e != nil {
+			return fmt.Errorf("Listen.Addresses[%d]: %v", ix, e)
+		}
+	}
+	if c.Listen.SocketMode != nil {
+		if _, e := parseSocketMode(*c.Listen.SocketMode); e != nil {
+			return fmt.Errorf("Listen.SocketMode: %v", e)
+		}
+	}
+	if c.KeyFile != nil && *c.KeyFile == "" {
+		return errors.New("KeyFile: can't be empty")
+	}
+	if c.Storage != nil && *c.Storage != "in-memory" && !strings.HasPrefix(*c.Storage, "in-memory:") && !strings.HasPrefix(*c.Storage, "dir:") && !strings.HasPrefix(*c.Storage, "redis:") && !strings.HasPrefix(*c.Storage, "sharded:") && !strings.HasPrefix(*c.Storage, "cached:") {
+		return fmt.Errorf("Storage: unknown storage descriptor %q", *c.Storage)
+	}
+	if c.SharedState != nil && *c.SharedState != "" && !strings.HasPrefix(*c.SharedState, "redis:") {
+		return fmt.Errorf("SharedState: unknown shared state store %q", *c.SharedState)
+	}
+	if c.Identity != nil && *c.Identity == "" {
+		return errors.New("Identity: can't be empty")
+	}
+	if c.FragmentationLength != nil && *c.FragmentationLength != 0 && *c.FragmentationLength < 48 {
+		return fmt.Errorf("FragmentationLength: %d is too small, it has to be 0 or at least 48", *c.FragmentationLength)
+	}
+	if c.Timeouts.SessionMinutes != nil && *c.Timeouts.SessionMinutes == 0 {
+		return errors.New("Timeouts.SessionMinutes: has to be larger than zero")
+	}
+	if c.Timeouts.FragmentationMinutes != nil && *c.Timeouts.FragmentationMinutes == 0 {
+		return errors.New("Timeouts.FragmentationMinutes: has to be larger than zero")
+	}
+	if c.Timeouts.ConnectionSeconds != nil && *c.Timeouts.ConnectionSeconds == 0 {
+		return errors.New("Timeouts.ConnectionSeconds: has to be larger than zero")
+	}
+	if e := validateRestrictionList("Restrictions.Only", c.Restrictions.Only); e != nil {
+		return e
+	}
+	if e := validateRestrictionList("Restrictions.OnlyPrefix", c.Restrictions.OnlyPrefix); e != nil {
+		return e
+	}
+	if e := validateRestrictionList("Restrictions.OnlySuffix", c.Restrictions.OnlySuffix); e != nil {
+		return e
+	}
+	if c.Gateways.SecretsFile != nil && *c.Gateways.SecretsFile == "" {
+		return errors.New("Gateways.SecretsFile: can't be empty")
+	}
+	if c.Gateways.MaxFrameAgeSeconds != nil && *c.Gateways.MaxFrameAgeSeconds == 0 {
+		return errors.New("Gateways.MaxFrameAgeSeconds: has to be larger than zero")
+	}
+	if c.TLS.CertFile != nil && *c.TLS.CertFile == "" {
+		return errors.New("TLS.CertFile: can't be empty")
+	}
+	if c.TLS.KeyFile != nil && *c.TLS.KeyFile == "" {
+		return errors.New("TLS.KeyFile: can't be empty")
+	}
+	if c.TLS.ClientCAFile != nil && *c.TLS.ClientCAFile == "" {
+		return errors.New("TLS.ClientCAFile: can't be empty")
+	}
+	if c.TLS.ClientPermissionsFile != nil && *c.TLS.ClientPermissionsFile == "" {
+		return errors.New("TLS.ClientPermissionsFile: can't be empty")
+	}
+	if c.Restart.SessionStateFile != nil && *c.Restart.SessionStateFile == "" {
+		return errors.New("Restart.SessionStateFile: can't be empty")
+	}
+	if c.Admin.Address != nil {
+		if _, _, e := net.SplitHostPort(*c.Admin.Address); e != nil {
+			return fmt.Errorf("Admin.Address: %v", e)
+		}
+	}
+	if c.Limits.ReadLimit != nil && *c.Limits.ReadLimit == 0 {
+		return errors.New("Limits.ReadLimit: has to be larger than zero")
+	}
+	return nil
+}
+
+// Settings implements the command.Config interface
+func (c *rawConfig) Settings() []command.Setting {
+	res := []command.Setting{}
+	res = command.AppendString(res, "Listen.Address", "address", c.Listen.Address, false)
+	res = command.AppendUint(res, "Listen.Port", "port", c.Listen.Port, false)
+	res = command.AppendList(res, "Listen.Addresses", "listen", c.Listen.Addresses, false)
+	res = command.AppendString(res, "Listen.SocketMode", "socket-mode", c.Listen.SocketMode, false)
+	res = command.AppendString(res, "Listen.SocketOwner", "socket-owner", c.Listen.SocketOwner, false)
+	res = command.AppendString(res, "Listen.SocketGroup", "socket-group", c.Listen.SocketGroup, false)
+	res = command.AppendString(res, "KeyFile", "key-file", c.KeyFile, false)
+	res = command.AppendString(res, "Storage", "storage", c.Storage, false)
+	res = command.AppendString(res, "SharedState", "shared-state", c.SharedState, false)
+	res = command.AppendString(res, "Identity", "identity", c.Identity, false)
+	res = command.AppendUint(res, "FragmentationLength", "fragmentation-length", c.FragmentationLength, false)
+	res = command.AppendUint(res, "Timeouts.SessionMinutes", "session-timeout", c.Timeouts.SessionMinutes, false)
+	res = command.AppendUint(res, "Timeouts.FragmentationMinutes", "fragmentation-timeout", c.Timeouts.FragmentationMinutes, false)
+	res = command.AppendUint(res, "Timeouts.ConnectionSeconds", "connection-timeout", c.Timeouts.ConnectionSeconds, true)
+	res = command.AppendList(res, "Restrictions.Only", "only", c.Restrictions.Only, true)
+	res = command.AppendList(res, "Restrictions.OnlyPrefix", "only-prefix", c.Restrictions.OnlyPrefix, true)
+	res = command.AppendList(res, "Restrictions.OnlySuffix", "only-suffix", c.Restrictions.OnlySuffix, true)
+	res = command.AppendString(res, "Restrictions.PolicyFile", "policy-file", c.Restrictions.PolicyFile, false)
+	res = command.AppendString(res, "Gateways.SecretsFile", "gateway-secrets", c.Gateways.SecretsFile, false)
+	res = command.AppendUint(res, "Gateways.MaxFrameAgeSeconds", "frame-max-age", c.Gateways.MaxFrameAgeSeconds, false)
+	res = command.AppendString(res, "TLS.CertFile", "tls-cert-file", c.TLS.CertFile, false)
+	res = command.AppendString(res, "TLS.KeyFile", "tls-key-file", c.TLS.KeyFile, false)
+	res = command.AppendString(res, "TLS.ClientCAFile", "tls-client-ca-file", c.TLS.ClientCAFile, false)
+	res = command.AppendString(res, "TLS.ClientPermissionsFile", "tls-client-permissions", c.TLS.ClientPermissionsFile, false)
+	res = command.AppendUint(res, "Restart.DrainSeconds", "drain-timeout", c.Restart.DrainSeconds, true)
+	res = command.AppendString(res, "Restart.SessionStateFile", "session-state-file", c.Restart.SessionStateFile, false)
+	res = command.AppendString(res, "Admin.Address", "admin-address", c.Admin.Address, false)
+	res = command.AppendUint(res, "Admin.MaxSessions", "ready-max-sessions", c.Admin.MaxSessions, true)
+	res = command.AppendUint(res, "Admin.MaxFragments", "ready-max-fragments", c.Admin.MaxFragments, true)
+	res = command.AppendUint(res, "Limits.ReadLimit", "read-limit", c.Limits.ReadLimit, true)
+	res = command.AppendUint(res, "Limits.MaxConcurrent", "max-concurrent", c.Limits.MaxConcurrent, false)
+	res = command.AppendString(res, "Logging.File", "log-file", c.Logging.File, true)
+	return res
+}
+
+func loadConfig() error {
+	return command.LoadConfig(*configFile, &rawConfig{})
+}
+
+// reloadConfig reads the configuration file again, and applies the settings that can be changed at runtime
+func reloadConfig() ([]string, error) {
+	return command.ReloadConfig(*configFile, &rawConfig{})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+func writeTempConfig(content string) string {
+	f, _ := ioutil.TempFile("", "otrng-raw-config-file")
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func (s *RawServerSuite) Test_readConfigFile_returnsErrorForMissingFile(c *C) {
+	_, e := readConfigFile("/somewhere/that/shouldn't/work")
+	c.Assert(e, ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *RawServerSuite) Test_readConfigFile_returnsErrorForUnknownSettings(c *C) {
+	fn := writeTempConfig(`{"Listen": {"Adress": "localhost"}}`)
+	defer os.Remove(fn)
+	_, e := readConfigFile(fn)
+	c.Assert(e, ErrorMatches, "config file "+fn+": json: unknown field \"Adress\"")
+}
+
+func (s *RawServerSuite) Test_readConfigFile_returnsErrorForWrongTypes(c *C) {
+	fn := writeTempConfig(`{"Listen": {"Port": "3242"}}`)
+	defer os.Remove(fn)
+	_, e := readConfigFile(fn)
+	c.Assert(e, ErrorMatches, "config file "+fn+": json: cannot unmarshal string into Go struct field .*Port of type uint")
+}
+
+func (s *RawServerSuite) Test_readConfigFile_validatesTheSettings(c *C) {
+	invalid := map[string]string{
+		`{"Listen": {"Port": 70000}}`:                         "Listen.Port: 70000 is not a valid port",
+		`{"Listen": {"Address": ""}}`:                         "Listen.Address: can't be empty",
+		`{"Listen": {"Addresses": ["tcp:localhost"]}}`:        "Listen.Addresses\\[0\\]: invalid listener descriptor \"tcp:localhost\": .*",
+		`{"Listen": {"Addresses": ["unix:/tmp/a,b"]}}`:        "Listen.Addresses\\[0\\]: can't contain a comma",
+		`{"Listen": {"SocketMode": "rw-rw----"}}`:             "Listen.SocketMode: invalid socket mode \"rw-rw----\"",
+		`{"KeyFile": ""}`:                                     "KeyFile: can't be empty",
+		`{"Storage": "sql:foo"}`:                              "Storage: unknown storage descriptor \"sql:foo\"",
+		`{"SharedState": "memcached:localhost:11211"}`:        "SharedState: unknown shared state store \"memcached:localhost:11211\"",
+		`{"Identity": ""}`:                                    "Identity: can't be empty",
+		`{"FragmentationLength": 20}`:                         "FragmentationLength: 20 is too small, it has to be 0 or at least 48",
+		`{"Timeouts": {"SessionMinutes": 0}}`:                 "Timeouts.SessionMinutes: has to be larger than zero",
+		`{"Timeouts": {"FragmentationMinutes": 0}}`:           "Timeouts.FragmentationMinutes: has to be larger than zero",
+		`{"Timeouts": {"ConnectionSeconds": 0}}`:              "Timeouts.ConnectionSeconds: has to be larger than zero",
+		`{"Restrictions": {"Only": ["a", ""]}}`:               "Restrictions.Only\\[1\\]: can't be empty",
+		`{"Restrictions": {"OnlyPrefix": ["a,b"]}}`:           "Restrictions.OnlyPrefix\\[0\\]: can't contain a comma",
+		`{"Restrictions": {"OnlySuffix": ["@example.org,"]}}`: "Restrictions.OnlySuffix\\[0\\]: can't contain a comma",
+		`{"Gateways": {"SecretsFile": ""}}`:                   "Gateways.SecretsFile: can't be empty",
+		`{"Gateways": {"MaxFrameAgeSeconds": 0}}`:             "Gateways.MaxFrameAgeSeconds: has to be larger than zero",
+		`{"TLS": {"CertFile": ""}}`:                           "TLS.CertFile: can't be empty",
+		`{"TLS": {"KeyFile": ""}}`:                            "TLS.KeyFile: can't be empty",
+		`{"TLS": {"ClientCAFile": ""}}`:                       "TLS.ClientCAFile: can't be empty",
+		`{"TLS": {"ClientPermissionsFile": ""}}`:              "TLS.ClientPermissionsFile: can't be empty",
+		`{"Restart": {"SessionStateFile": ""}}`:               "Restart.SessionStateFile: can't be empty",
+		`{"Admin": {"Address": "localhost"}}`:                 "Admin.Address: address localhost: missing port in address",
+		`{"Limits": {"ReadLimit": 0}}`:                        "Limits.ReadLimit: has to be larger than zero",
+	}
+
+	for content, msg := range invalid {
+		fn := writeTempConfig(content)
+		_, e := readConfigFile(fn)
+		os.Remove(fn)
+		c.Assert(e, ErrorMatches, "config file "+fn+": "+msg)
+	}
+}
+
+func (s *RawServerSuite) Test_applyConfig_setsTheFlagsFromTheConfiguration(c *C) {
+	defer command.WithFlags("address", "port", "storage", "shared-state", "only-suffix", "connection-timeout")()
+	command.CommandLineFlags = map[string]bool{}
+
+	fn := writeTempConfig(`{
+  "Listen": {"Address": "prekeys.example.org", "Port": 4242},
+  "Storage": "dir:/tmp",
+  "SharedState": "redis:address=localhost:6379",
+  "Timeouts": {"ConnectionSeconds": 30},
+  "Restrictions": {"OnlySuffix": ["@example.org", "@example.com"]}
+}`)
+	defer os.Remove(fn)
+	conf, e := readConfigFile(fn)
+	c.Assert(e, IsNil)
+
+	ignored, e := command.ApplyConfig(conf, false)
+	c.Assert(e, IsNil)
+	c.Assert(ignored, HasLen, 0)
+	c.Assert(*listenIP, Equals, "prekeys.example.org")
+	c.Assert(*listenPort, Equals, uint(4242))
+	c.Assert(*storageEngine, Equals, "dir:/tmp")
+	c.Assert(*sharedState, Equals, "redis:address=localhost:6379")
+	c.Assert(*connectionTimeout, Equals, uint(30))
+	c.Assert(*allowOnlySuffix, Equals, "@example.org,@example.com")
+}
+
+func (s *RawServerSuite) Test_applyConfig_letsTheCommandLineTakePrecedence(c *C) {
+	defer command.WithFlags("address", "port")()
+	*listenIP = "localhost"
+	command.CommandLineFlags = map[string]bool{"address": true}
+
+	fn := writeTempConfig(`{"Listen": {"Address": "prekeys.example.org", "Port": 4242}}`)
+	defer os.Remove(fn)
+	conf, _ := readConfigFile(fn)
+
+	_, e := command.ApplyConfig(conf, false)
+	c.Assert(e, IsNil)
+	c.Assert(*listenIP, Equals, "localhost")
+	c.Assert(*listenPort, Equals, uint(4242))
+}
+
+func (s *RawServerSuite) Test_applyConfig_onlyChangesReloadableSettingsWhenReloading(c *C) {
+	defer command.WithFlags("address", "port", "only", "read-limit")()
+	command.CommandLineFlags = map[string]bool{}
+	*listenIP = "localhost"
+	*listenPort = 3242
+
+	fn := writeTempConfig(`{
+  "Listen": {"Address": "prekeys.example.org", "Port": 3242},
+  "Restrictions": {"Only": ["alice@example.org"]},
+  "Limits": {"ReadLimit": 1024}
+}`)
+	defer os.Remove(fn)
+	conf, _ := readConfigFile(fn)
+
+	ignored, e := command.ApplyConfig(conf, true)
+	c.Assert(e, IsNil)
+	c.Assert(ignored, DeepEquals, []string{"Listen.Address"})
+	c.Assert(*listenIP, Equals, "localhost")
+	c.Assert(*allowOnly, Equals, "alice@example.org")
+	c.Assert(*readLimit, Equals, uint(1024))
+}
+
+func (s *RawServerSuite) Test_loadConfig_doesNothingWithoutConfigFile(c *C) {
+	defer command.WithFlags("config")()
+	*configFile = ""
+	c.Assert(loadConfig(), IsNil)
+	command.CommandLineFlags = map[string]bool{}
+}
+
+func (s *RawServerSuite) Test_loadConfig_returnsErrorsFromTheConfigFile(c *C) {
+	defer command.WithFlags("config")()
+	*configFile = "/somewhere/that/shouldn't/work"
+	c.Assert(loadConfig(), ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *RawServerSuite) Test_reloadConfig_doesNothingWithoutConfigFile(c *C) {
+	defer command.WithFlags("config")()
+	*configFile = ""
+	ignored, e := reloadConfig()
+	c.Assert(e, IsNil)
+	c.Assert(ignored, IsNil)
+}
+
+func (s *RawServerSuite) Test_reloadConfig_appliesTheNewFile(c *C) {
+	defer command.WithFlags("config", "identity", "only-prefix")()
+	fn := writeTempConfig(`{"Identity": "keys.example.org"}`)
+	defer os.Remove(fn)
+	*configFile = fn
+	*serverIdentity = "keys.example.org"
+	c.Assert(loadConfig(), IsNil)
+	command.CommandLineFlags = map[string]bool{}
+
+	ioutil.WriteFile(fn, []byte(`{"Identity": "other.example.org", "Restrictions": {"OnlyPrefix": ["admin"]}}`), 0600)
+	ignored, e := reloadConfig()
+	c.Assert(e, IsNil)
+	c.Assert(ignored, DeepEquals, []string{"Identity"})
+	c.Assert(*serverIdentity, Equals, "keys.example.org")
+	c.Assert(*allowOnlyPrefix, Equals, "admin")
+}
@@ -22,11 +22,11 @@ func (s *RawServerSuite) Test_flowTest_success(c *C) {
 	*listenPort = 0
 	go rs.run()
 
-	for rs.l == nil {
+	for rs.addrs() == nil {
 		time.Sleep(time.Duration(10) * time.Millisecond)
 	}
 
-	a := rs.l.Addr().(*net.TCPAddr)
+	a := rs.addrs()[0].(*net.TCPAddr)
 	con, _ := net.DialTCP(a.Network(), nil, a)
 	defer con.Close()
 
@@ -47,13 +47,12 @@ func (s *RawServerSuite) Test_flowTest_success(c *C) {
 
 	res, e := ioutil.ReadAll(con)
 	c.Assert(e, IsNil)
-	_, ss, _ := extractShort(res)
-	c.Assert(ss, Equals, uint16(105))
+	c.Assert(res[:2], DeepEquals, []byte{0x00, 105})
 	c.Assert(string(res[2:]), Equals, expectedResult)
 
 	c.Assert(capture.finish(), Equals,
 		"Starting server on localhost:0...\n"+
 			"BBF1E0F815113A2E 016ADE9398D8CA6C C48DB33134F09918 A478A6CC98A9F0E7 A435962990B44512 5D1BC95FA9AA2D91 46BBC3F5061AE490\n")
 
-	rs.l.Close()
+	rs.finishRequested = true
 }
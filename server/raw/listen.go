@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The raw server can listen to several addresses at the same time. They are given as
+// descriptors, in the same way as storage descriptors:
+// - "tcp:localhost:3242" listens to TCP on both IPv4 and IPv6, if available
+// - "tcp4:0.0.0.0:3242" only listens to TCP over IPv4
+// - "tcp6:[::1]:3242" only listens to TCP over IPv6
+// - "unix:/run/otrng/raw.sock" listens to a Unix domain socket
+// If no descriptors are given, the server listens to TCP on the -address and -port flags.
+// Unix domain sockets get the mode, owner and group given by the socket flags, and are
+// never wrapped in TLS - access to them should be controlled with the file permissions instead.
+// When a mode is given, the socket is created only accessible by the server user, and gets the
+// mode afterwards, so nobody can connect to it before the mode is set.
+
+// deadlineListener is a listener where we can stop waiting for connections after a while
+type deadlineListener interface {
+	net.Listener
+	SetDeadline(time.Time) error
+}
+
+type listenerDescription struct {
+	network string
+	address string
+}
+
+func (d *listenerDescription) String() string {
+	if d.network == "tcp" {
+		return d.address
+	}
+	return d.network + ":" + d.address
+}
+
+func (d *listenerDescription) isUnix() bool {
+	return d.network == "unix"
+}
+
+func parseListenerDescriptor(desc string) (*listenerDescription, error) {
+	ix := strings.Index(desc, ":")
+	if ix == -1 {
+		return nil, fmt.Errorf("invalid listener descriptor %q", desc)
+	}
+	d := &listenerDescription{network: desc[:ix], address: desc[ix+1:]}
+	switch d.network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, e := net.SplitHostPort(d.address); e != nil {
+			return nil, fmt.Errorf("invalid listener descriptor %q: %v", desc, e)
+		}
+	case "unix":
+		if d.address == "" {
+			return nil, fmt.Errorf("invalid listener descriptor %q: no socket path", desc)
+		}
+	default:
+		return nil, fmt.Errorf("invalid listener descriptor %q: unknown network %q", desc, d.network)
+	}
+	return d, nil
+}
+
+func listenerDescriptions() ([]*listenerDescription, error) {
+	if *listenAddresses == "" {
+		return []*listenerDescription{
+			&listenerDescription{network: "tcp", address: net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort))},
+		}, nil
+	}
+
+	result := []*listenerDescription{}
+	for _, desc := range strings.Split(*listenAddresses, ",") {
+		d, e := parseListenerDescriptor(desc)
+		if e != nil {
+			return nil, e
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, e := strconv.ParseUint(mode, 8, 32)
+	if e != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+func lookupSocketOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		u, e := user.Lookup(owner)
+		if e != nil {
+			if u, e = user.LookupId(owner); e != nil {
+				return 0, 0, fmt.Errorf("unknown socket owner %q", owner)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, e := user.LookupGroup(group)
+		if e != nil {
+			if g, e = user.LookupGroupId(group); e != nil {
+				return 0, 0, fmt.Errorf("unknown socket group %q", group)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+func setupSocketFile(name string) error {
+	if *socketMode != "" {
+		mode, e := parseSocketMode(*socketMode)
+		if e != nil {
+			return e
+		}
+		if e := os.Chmod(name, mode); e != nil {
+			return e
+		}
+	}
+	if *socketOwner != "" || *socketGroup != "" {
+		uid, gid, e := lookupSocketOwner(*socketOwner, *socketGroup)
+		if e != nil {
+			return e
+		}
+		if e := os.Chown(name, uid, gid); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// removeStaleSocket removes a socket file left behind by a server that is no longer running
+func removeStaleSocket(name string) error {
+	fi, e := os.Lstat(name)
+	if e != nil {
+		return nil
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", name)
+	}
+	if c, e := net.Dial("unix", name); e == nil {
+		c.Close()
+		return fmt.Errorf("%s is already in use", name)
+	}
+	return os.Remove(name)
+}
+
+// umaskLock is held while the umask is changed, since it's shared by the whole process
+var umaskLock sync.Mutex
+
+// createSocket creates the socket, only accessible by the server user if a mode will be set afterwards
+func createSocket(addr *net.UnixAddr) (*net.UnixListener, error) {
+	if *socketMode == "" {
+		return net.ListenUnix("unix", addr)
+	}
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.ListenUnix("unix", addr)
+}
+
+func listenUnix(name string) (deadlineListener, error) {
+	if e := removeStaleSocket(name); e != nil {
+		return nil, e
+	}
+	addr, e := net.ResolveUnixAddr("unix", name)
+	if e != nil {
+		return nil, e
+	}
+	l, e := createSocket(addr)
+	if e != nil {
+		return nil, e
+	}
+	if e := setupSocketFile(name); e != nil {
+		l.Close()
+		return nil, e
+	}
+	return l, nil
+}
+
+func (d *listenerDescription) listen() (deadlineListener, error) {
+	if d.isUnix() {
+		return listenUnix(d.address)
+	}
+	addr, e := net.ResolveTCPAddr(d.network, d.address)
+	if e != nil {
+		return nil, e
+	}
+	l, e := net.ListenTCP(d.network, addr)
+	if e != nil {
+		return nil, e
+	}
+	return l, nil
+}
+
+func listenToAll(ds []*listenerDescription) ([]deadlineListener, error) {
+	result := []deadlineListener{}
+	for _, d := range ds {
+		l, e := d.listen()
+		if e != nil {
+			for _, ll := range result {
+				ll.Close()
+			}
+			return nil, e
+		}
+		result = append(result, l)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no addresses to listen to")
+	}
+	return result, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func withListenFlags(addresses, mode, owner, group string) func() {
+	oldAddresses, oldMode, oldOwner, oldGroup := *listenAddresses, *socketMode, *socketOwner, *socketGroup
+	*listenAddresses, *socketMode, *socketOwner, *socketGroup = addresses, mode, owner, group
+	return func() {
+		*listenAddresses, *socketMode, *socketOwner, *socketGroup = oldAddresses, oldMode, oldOwner, oldGroup
+	}
+}
+
+func (s *RawServerSuite) Test_parseListenerDescriptor_supportsTCPAndUnixSockets(c *C) {
+	d, e := parseListenerDescriptor("tcp:localhost:3242")
+	c.Assert(e, IsNil)
+	c.Assert(d, DeepEquals, &listenerDescription{network: "tcp", address: "localhost:3242"})
+	c.Assert(d.String(), Equals, "localhost:3242")
+
+	d, _ = parseListenerDescriptor("tcp6:[::1]:3242")
+	c.Assert(d, DeepEquals, &listenerDescription{network: "tcp6", address: "[::1]:3242"})
+	c.Assert(d.String(), Equals, "tcp6:[::1]:3242")
+
+	d, _ = parseListenerDescriptor("tcp4:0.0.0.0:3242")
+	c.Assert(d, DeepEquals, &listenerDescription{network: "tcp4", address: "0.0.0.0:3242"})
+
+	d, _ = parseListenerDescriptor("unix:/run/otrng/raw.sock")
+	c.Assert(d, DeepEquals, &listenerDescription{network: "unix", address: "/run/otrng/raw.sock"})
+	c.Assert(d.isUnix(), Equals, true)
+}
+
+func (s *RawServerSuite) Test_parseListenerDescriptor_returnsErrorsForInvalidDescriptors(c *C) {
+	invalid := map[string]string{
+		"localhost":         "invalid listener descriptor \"localhost\"",
+		"tcp:localhost":     "invalid listener descriptor \"tcp:localhost\": address localhost: missing port in address",
+		"unix:":             "invalid listener descriptor \"unix:\": no socket path",
+		"udp:localhost:123": "invalid listener descriptor \"udp:localhost:123\": unknown network \"udp\"",
+	}
+	for desc, msg := range invalid {
+		_, e := parseListenerDescriptor(desc)
+		c.Assert(e, ErrorMatches, msg)
+	}
+}
+
+func (s *RawServerSuite) Test_listenerDescriptions_usesAddressAndPortByDefault(c *C) {
+	defer withListenFlags("", "", "", "")()
+	*listenIP = "localhost"
+	*listenPort = 3242
+
+	ds, e := listenerDescriptions()
+	c.Assert(e, IsNil)
+	c.Assert(ds, DeepEquals, []*listenerDescription{{network: "tcp", address: "localhost:3242"}})
+
+	*listenAddresses = "tcp4:127.0.0.1:1234,unix:/tmp/raw.sock"
+	ds, e = listenerDescriptions()
+	c.Assert(e, IsNil)
+	c.Assert(ds, DeepEquals, []*listenerDescription{{network: "tcp4", address: "127.0.0.1:1234"}, {network: "unix", address: "/tmp/raw.sock"}})
+
+	*listenAddresses = "tcp4:127.0.0.1:1234,"
+	_, e = listenerDescriptions()
+	c.Assert(e, ErrorMatches, "invalid listener descriptor \"\"")
+}
+
+func (s *RawServerSuite) Test_parseSocketMode_onlyAcceptsOctalPermissions(c *C) {
+	m, e := parseSocketMode("0660")
+	c.Assert(e, IsNil)
+	c.Assert(m, Equals, os.FileMode(0660))
+
+	_, e = parseSocketMode("0999")
+	c.Assert(e, ErrorMatches, "invalid socket mode \"0999\"")
+
+	_, e = parseSocketMode("10000")
+	c.Assert(e, ErrorMatches, "invalid socket mode \"10000\"")
+}
+
+func (s *RawServerSuite) Test_lookupSocketOwner_returnsErrorsForUnknownUsersAndGroups(c *C) {
+	_, _, e := lookupSocketOwner("no-user-with-this-name", "")
+	c.Assert(e, ErrorMatches, "unknown socket owner \"no-user-with-this-name\"")
+
+	_, _, e = lookupSocketOwner("", "no-group-with-this-name")
+	c.Assert(e, ErrorMatches, "unknown socket group \"no-group-with-this-name\"")
+
+	uid, gid, e := lookupSocketOwner("", "")
+	c.Assert(e, IsNil)
+	c.Assert(uid, Equals, -1)
+	c.Assert(gid, Equals, -1)
+}
+
+func (s *RawServerSuite) Test_listenUnix_setsTheModeAndOwnerOfTheSocket(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-socket")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw.sock")
+	u, _ := user.Current()
+	defer withListenFlags("", "0640", u.Uid, u.Gid)()
+
+	l, e := listenUnix(name)
+	c.Assert(e, IsNil)
+	defer l.Close()
+
+	fi, _ := os.Stat(name)
+	c.Assert(fi.Mode()&os.ModeSocket, Not(Equals), os.FileMode(0))
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0640))
+	c.Assert(fi.Sys().(*syscall.Stat_t).Uid, Equals, uint32(os.Getuid()))
+}
+
+func (s *RawServerSuite) Test_createSocket_onlyLetsTheServerUserConnectUntilTheModeIsSet(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-socket")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw.sock")
+	defer withListenFlags("", "0666", "", "")()
+	old := syscall.Umask(0022)
+	defer syscall.Umask(old)
+
+	addr, _ := net.ResolveUnixAddr("unix", name)
+	l, e := createSocket(addr)
+	c.Assert(e, IsNil)
+	defer l.Close()
+
+	fi, _ := os.Stat(name)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+	c.Assert(syscall.Umask(0022), Equals, 0022)
+}
+
+func (s *RawServerSuite) Test_listenUnix_closesTheSocketIfItCantBeSetUp(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-socket")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw.sock")
+	defer withListenFlags("", "", "no-user-with-this-name", "")()
+
+	_, e := listenUnix(name)
+	c.Assert(e, ErrorMatches, "unknown socket owner \"no-user-with-this-name\"")
+	_, e = os.Stat(name)
+	c.Assert(os.IsNotExist(e), Equals, true)
+}
+
+func (s *RawServerSuite) Test_listenUnix_removesStaleSockets(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-socket")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw.sock")
+	defer withListenFlags("", "", "", "")()
+
+	addr, _ := net.ResolveUnixAddr("unix", name)
+	old, _ := net.ListenUnix("unix", addr)
+	old.SetUnlinkOnClose(false)
+	old.Close()
+
+	l, e := listenUnix(name)
+	c.Assert(e, IsNil)
+
+	_, e = listenUnix(name)
+	c.Assert(e, ErrorMatches, name+" is already in use")
+	l.Close()
+
+	ioutil.WriteFile(name, []byte("hello"), 0600)
+	_, e = listenUnix(name)
+	c.Assert(e, ErrorMatches, name+" exists and is not a socket")
+}
+
+func (s *RawServerSuite) Test_listenToAll_closesTheOtherListenersOnErrors(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-socket")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw.sock")
+	defer withListenFlags("", "", "", "")()
+
+	_, e := listenToAll([]*listenerDescription{
+		{network: "unix", address: name},
+		{network: "tcp", address: "localhost:1234567"},
+	})
+	c.Assert(e, ErrorMatches, "address 1234567: invalid port")
+	_, e = os.Stat(name)
+	c.Assert(os.IsNotExist(e), Equals, true)
+
+	_, e = listenToAll([]*listenerDescription{})
+	c.Assert(e, ErrorMatches, "no addresses to listen to")
+}
+
+func sendPlain(network, addr, from, data string) ([]byte, error) {
+	con, e := net.Dial(network, addr)
+	if e != nil {
+		return nil, e
+	}
+	defer con.Close()
+
+	toSend := appendShort(nil, uint16(len(from)))
+	toSend = append(toSend, []byte(from)...)
+	toSend = appendShort(toSend, uint16(len(data)))
+	toSend = append(toSend, []byte(data)...)
+	con.Write(toSend)
+	con.(interface{ CloseWrite() error }).CloseWrite()
+	return ioutil.ReadAll(con)
+}
+
+func (s *RawServerSuite) Test_listenWith_servesAllListenersTogether(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-socket")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw.sock")
+	defer withListenFlags("tcp4:127.0.0.1:0,unix:"+name, "", "", "")()
+
+	ms := &mockServer{}
+	ms.returnData = [][]string{[]string{"one"}, []string{"two"}}
+	ms.returnError = []error{nil, nil}
+	rs := &rawServer{s: ms}
+
+	done := make(chan error)
+	go func() { done <- rs.listenWith() }()
+	for rs.addrs() == nil {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	addrs := rs.addrs()
+	c.Assert(addrs, HasLen, 2)
+
+	res, e := sendPlain("tcp", addrs[0].String(), "sita@example.org", "hello")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []byte{0x00, 0x03, 0x6f, 0x6e, 0x65})
+
+	res, e = sendPlain("unix", name, "rama@example.org", "hello")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []byte{0x00, 0x03, 0x74, 0x77, 0x6f})
+
+	rs.finishRequested = true
+	c.Assert(<-done, IsNil)
+	_, e = os.Stat(name)
+	c.Assert(os.IsNotExist(e), Equals, true)
+}
@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
 )
 
 var signalHandler = make(chan os.Signal, 1)
@@ -18,23 +19,56 @@ func main() {
 	rs := &rawServer{}
 	ending := make(chan bool)
 
-	if e := rs.load(pks.CreateFactory(rand.Reader)); e != nil {
+	if e := loadConfig(); e != nil {
 		fmt.Println(e)
 		return
 	}
 
+	if e := command.OpenLog(logFile); e != nil {
+		fmt.Printf("encountered error when opening log file: %v\n", e)
+		return
+	}
+
+	if e := rs.inherit(); e != nil {
+		command.Logf("%v\n", e)
+		return
+	}
+
+	if e := rs.load(pks.CreateFactory(rand.Reader)); e != nil {
+		command.Logf("%v\n", e)
+		return
+	}
+
+	rs.takeOver()
+
 	go func() {
-		signal.Notify(signalHandler, os.Interrupt, syscall.SIGTERM)
-		select {
-		case <-signalHandler:
-			rs.shutdown()
-		case <-ending:
+		signal.Notify(signalHandler, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+		for {
+			select {
+			case sig := <-signalHandler:
+				if sig == syscall.SIGHUP {
+					rs.reload()
+					continue
+				}
+				if sig == syscall.SIGUSR2 {
+					if e := rs.restart(); e != nil {
+						command.Logf("Encountered error when restarting, continuing to serve: %v\n", e)
+						continue
+					}
+					command.Logf("The new process is ready, handing over\n")
+				}
+				rs.shutdown()
+				return
+			case <-ending:
+				return
+			}
 		}
 	}()
 
 	if e := rs.run(); e != nil {
-		fmt.Println(e)
+		command.Logf("%v\n", e)
 		ending <- true
 		return
 	}
+	rs.stopping.Wait()
 }
@@ -3,12 +3,24 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 
 	. "gopkg.in/check.v1"
 )
 
+// testKeypair is the keypair with the fingerprint the tests expect the server to print
+const testKeypair = `{"Symmetric":"q82rzavNq82rzavNq82rzavNq82rzavNq82rzavNq82rzavNq82rzavNq82rzavNq82rzavNq82r","Private":"Gp+w9aHMLvx43lTY2avIVmTHIxrgy4oSH4UZrOilrHCW6HQtkhyns+mrjY4n2z89LNEoH3Ozuz0=","Public":"bfCN8wiUOqC27SnA69JpdKe5zFME6viJc6Y1YgbF0yZjkNgZsvmEyLlmnWjqcy+aF5Ed0jZ3gW4A"}`
+
+func testKeyFile(c *C) string {
+	fn := filepath.Join(c.MkDir(), "raw-server.keys")
+	c.Assert(ioutil.WriteFile(fn, []byte(testKeypair), 0600), IsNil)
+	return fn
+}
+
 func (s *RawServerSuite) Test_main_printsErrorFromLoad(c *C) {
 	flag.Parse()
 	*keyFile = "/somewhere/that/shouldn't/work"
@@ -24,18 +36,14 @@ func (s *RawServerSuite) Test_main_printsErrorFromLoad(c *C) {
 func (s *RawServerSuite) Test_main_printsErrorFromRun(c *C) {
 	flag.Parse()
 	*listenPort = 3242
-	*keyFile = "raw-server.keys"
+	*keyFile = testKeyFile(c)
 	*storageEngine = "in-memory"
-	defer os.Remove(*keyFile)
 
 	capture := startStdoutCapture()
 	defer capture.restore()
 
-	var l *net.TCPListener
-	go func() {
-		addr, _ := net.ResolveTCPAddr("tcp", net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)))
-		l, _ = net.ListenTCP("tcp", addr)
-	}()
+	addr, _ := net.ResolveTCPAddr("tcp", net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)))
+	l, _ := net.ListenTCP("tcp", addr)
 
 	main()
 
@@ -51,9 +59,50 @@ func (s *RawServerSuite) Test_main_printsErrorFromRun(c *C) {
 func (s *RawServerSuite) Test_main_shutsdownIfSigintIsSent(c *C) {
 	flag.Parse()
 	*listenPort = 3242
-	*keyFile = "raw-server.keys"
+	*keyFile = testKeyFile(c)
+	*storageEngine = "in-memory"
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	ch := make(chan bool)
+
+	go func() {
+		main()
+		ch <- true
+	}()
+
+	signalHandler <- os.Interrupt
+	c.Assert(<-ch, Equals, true)
+}
+
+func (s *RawServerSuite) Test_main_survivesSighupBeforeShuttingDown(c *C) {
+	flag.Parse()
+	*listenPort = 3242
+	*keyFile = testKeyFile(c)
+	*storageEngine = "in-memory"
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	ch := make(chan bool)
+
+	go func() {
+		main()
+		ch <- true
+	}()
+
+	signalHandler <- syscall.SIGHUP
+	signalHandler <- os.Interrupt
+	c.Assert(<-ch, Equals, true)
+}
+
+func (s *RawServerSuite) Test_main_survivesFailedRestartBeforeShuttingDown(c *C) {
+	flag.Parse()
+	*listenPort = 3242
+	*keyFile = testKeyFile(c)
 	*storageEngine = "in-memory"
-	defer os.Remove(*keyFile)
+	defer withRestartCommand(`exit 1`)()
 
 	capture := startStdoutCapture()
 	defer capture.restore()
@@ -65,6 +114,8 @@ func (s *RawServerSuite) Test_main_shutsdownIfSigintIsSent(c *C) {
 		ch <- true
 	}()
 
+	signalHandler <- syscall.SIGUSR2
 	signalHandler <- os.Interrupt
 	c.Assert(<-ch, Equals, true)
+	c.Assert(capture.finish(), Matches, "(?s).*Encountered error when restarting, continuing to serve: .*Shutting down server carefully...\n")
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/adapter"
+)
+
+// rawRequest is one connection to the raw server. All the data sent on the connection is
+// read, and the replies to all the elements in it are written back together.
+// The protocol has no way of reporting errors, so when something fails the connection
+// is closed without writing anything.
+type rawRequest struct {
+	rs        *rawServer
+	c         io.ReadWriteCloser
+	permitted *permittedServer
+}
+
+func (r *rawRequest) Envelopes() ([]*adapter.Envelope, error) {
+	p, e := r.rs.verifyClient(r.c)
+	if e != nil {
+		return nil, adapter.NewError(adapter.Unauthorized, e)
+	}
+	r.permitted = p
+
+	data, e := ioutil.ReadAll(io.LimitReader(r.c, currentReadLimit()))
+	if e != nil {
+		return nil, e
+	}
+
+	elements, e := r.rs.parseData(data)
+	if e != nil {
+		return nil, adapter.NewError(adapter.HandleFailed, e)
+	}
+	result := []*adapter.Envelope{}
+	for _, pe := range elements {
+		result = append(result, &adapter.Envelope{From: pe.From, Message: pe.Data})
+	}
+	return result, nil
+}
+
+// Restrict implements the adapter.Restricter interface, to only allow the from-addresses
+// the client certificate gives permissions for
+func (r *rawRequest) Restrict(s pks.Server) pks.Server {
+	if r.permitted == nil {
+		return s
+	}
+	return &permittedServer{Server: s, identity: r.permitted.identity, allowed: r.permitted.allowed}
+}
+
+func (r *rawRequest) Reply(replies [][]string) error {
+	result := []byte{}
+	for _, outp := range replies {
+		for _, o := range outp {
+			result = append(result, protocolEncodePacket([]byte(o))...)
+		}
+	}
+	_, e := r.c.Write(result)
+	return e
+}
+
+func (r *rawRequest) Fail(e *adapter.Error) {}
+
+func (r *rawRequest) Close() error {
+	return r.c.Close()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The raw server can be restarted without refusing any connections:
+// - On SIGUSR2, the server starts a new copy of itself, with the same arguments, and hands
+//   over the listening sockets to it. The OTRNG_RAW_HANDOFF environment variable tells the new
+//   process how many sockets it got - they are file descriptors 3 and onwards, followed by two
+//   pipes. The new process writes one byte to the first pipe when it's ready. If a session state
+//   file is given, it waits for the old process to close the second pipe before it starts serving,
+//   so the sessions in progress are restored before their next messages arrive. Otherwise it
+//   starts serving right away, while the old process drains.
+// - When the new process is ready, the old process stops accepting connections, waits for the
+//   connections in progress to finish, up to the drain timeout, saves the DAKE sessions in
+//   progress if a session state file is given, and closes the second pipe.
+// - Under systemd socket activation, the listening sockets are given by systemd instead,
+//   in the LISTEN_PID and LISTEN_FDS environment variables. The old process is stopped with
+//   SIGTERM, and drains and saves its sessions in the same way.
+// The session state file contains the ephemeral keys of the sessions, so it is only readable
+// by the server user, and it's removed as soon as the new process has loaded it.
+// If the new process doesn't get ready in time, it is killed and the old process keeps serving.
+
+const handoffEnvironment = "OTRNG_RAW_HANDOFF"
+const firstInheritedFD = 3
+
+var handoffReadyTimeout = time.Duration(30) * time.Second
+
+// handoffWaitMargin is the extra time the new process waits for the old one, on top of the drain timeout
+var handoffWaitMargin = time.Duration(10) * time.Second
+
+// restartCommand returns the command used to start the new process
+var restartCommand = func() *exec.Cmd {
+	return exec.Command(os.Args[0], os.Args[1:]...)
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// inheritedFDCount returns the number of listening sockets given to this process, and whether
+// they come from a previous process of ours, instead of from systemd
+func inheritedFDCount(getenv func(string) string, pid int) (int, bool, error) {
+	if v := getenv(handoffEnvironment); v != "" {
+		n, e := strconv.Atoi(v)
+		if e != nil || n < 1 {
+			return 0, false, fmt.Errorf("invalid %s: %q", handoffEnvironment, v)
+		}
+		return n, true, nil
+	}
+
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return 0, false, nil
+	}
+	n, e := strconv.Atoi(getenv("LISTEN_FDS"))
+	if e != nil || n < 1 {
+		return 0, false, fmt.Errorf("invalid LISTEN_FDS: %q", getenv("LISTEN_FDS"))
+	}
+	return n, false, nil
+}
+
+func inheritListeners(fds []uintptr) ([]deadlineListener, error) {
+	result := []deadlineListener{}
+	for _, fd := range fds {
+		f := os.NewFile(fd, fmt.Sprintf("listener-%d", fd))
+		l, e := net.FileListener(f)
+		f.Close()
+		if e != nil {
+			return nil, fmt.Errorf("file descriptor %d: %v", fd, e)
+		}
+		dl, ok := l.(deadlineListener)
+		if !ok {
+			l.Close()
+			return nil, fmt.Errorf("file descriptor %d: unsupported listener", fd)
+		}
+		result = append(result, dl)
+	}
+	return result, nil
+}
+
+// inherit takes over the listening sockets given to this process, if any
+func (rs *rawServer) inherit() error {
+	n, handoff, e := inheritedFDCount(os.Getenv, os.Getpid())
+	if e != nil {
+		return fmt.Errorf("encountered error when inheriting listeners: %v", e)
+	}
+	os.Unsetenv(handoffEnvironment)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n == 0 {
+		return nil
+	}
+
+	fds := []uintptr{}
+	for i := 0; i < n; i++ {
+		fds = append(fds, uintptr(firstInheritedFD+i))
+	}
+	rs.inherited, e = inheritListeners(fds)
+	if e != nil {
+		return fmt.Errorf("encountered error when inheriting listeners: %v", e)
+	}
+	if handoff {
+		rs.previousReady = os.NewFile(uintptr(firstInheritedFD+n), "handoff-ready")
+		rs.previousDone = os.NewFile(uintptr(firstInheritedFD+n+1), "handoff-done")
+	}
+	return nil
+}
+
+// takeOver tells the previous process that we are ready and restores the sessions it saved.
+// Only when there are sessions to restore does it wait for the previous process to finish
+func (rs *rawServer) takeOver() {
+	if rs.previousReady != nil {
+		rs.previousReady.Write([]byte{0x01})
+		rs.previousReady.Close()
+		if rs.restoresSessions() {
+			rs.previousDone.SetReadDeadline(time.Now().Add(currentDrainTimeout() + handoffWaitMargin))
+			if _, e := io.Copy(ioutil.Discard, rs.previousDone); e != nil {
+				command.Logf("Encountered error when waiting for the previous process, continuing without it: %v\n", e)
+			}
+		}
+		rs.previousDone.Close()
+	}
+	rs.restoreSessions()
+}
+
+func (rs *rawServer) currentListeners() []deadlineListener {
+	rs.listenersLock.Lock()
+	defer rs.listenersLock.Unlock()
+	return rs.listeners
+}
+
+// restart starts a new process with our listening sockets, and waits for it to get ready
+func (rs *rawServer) restart() error {
+	ls := rs.currentListeners()
+	if ls == nil {
+		return errors.New("the server isn't listening yet")
+	}
+
+	files := []*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range ls {
+		f, e := l.(filer).File()
+		if e != nil {
+			return e
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, e := os.Pipe()
+	if e != nil {
+		return e
+	}
+	defer readyR.Close()
+	doneR, doneW, e := os.Pipe()
+	if e != nil {
+		readyW.Close()
+		return e
+	}
+
+	cmd := restartCommand()
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), readyW, doneR)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", handoffEnvironment, len(files)))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	e = cmd.Start()
+	readyW.Close()
+	doneR.Close()
+	if e != nil {
+		doneW.Close()
+		return e
+	}
+	go cmd.Wait()
+
+	readyR.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	if _, e := io.ReadFull(readyR, make([]byte, 1)); e != nil {
+		cmd.Process.Kill()
+		doneW.Close()
+		return fmt.Errorf("the new process didn't get ready: %v", e)
+	}
+
+	rs.nextDone = doneW
+	return nil
+}
+
+func currentDrainTimeout() time.Duration {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return time.Duration(*drainTimeout) * time.Second
+}
+
+// stopAccepting makes the listeners stop, leaving the socket files in place if someone else uses them
+func (rs *rawServer) stopAccepting() {
+	if rs.nextDone != nil {
+		for _, l := range rs.currentListeners() {
+			if ul, ok := l.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+	}
+	rs.finishRequested = true
+}
+
+// drain waits for the connections in progress, up to the drain timeout
+func (rs *rawServer) drain() {
+	r := rs.requestRunner()
+	if !r.Wait(currentDrainTimeout()) {
+		command.Logf("Drain timeout reached with %d connections still in progress\n", r.Active())
+	}
+}
+
+// restoresSessions returns true if the sessions saved by the previous process will be restored
+func (rs *rawServer) restoresSessions() bool {
+	_, ok := rs.s.(pks.SessionHandoff)
+	return *sessionStateFile != "" && ok
+}
+
+func (rs *rawServer) restoreSessions() {
+	if !rs.restoresSessions() {
+		return
+	}
+	sh := rs.s.(pks.SessionHandoff)
+	f, e := os.Open(*sessionStateFile)
+	if os.IsNotExist(e) {
+		return
+	}
+	if e != nil {
+		command.Logf("Encountered error when restoring sessions: %v\n", e)
+		return
+	}
+	defer os.Remove(*sessionStateFile)
+	defer f.Close()
+
+	n, e := sh.ImportSessions(f)
+	if e != nil {
+		command.Logf("Encountered error when restoring sessions: %v\n", e)
+	}
+	command.Logf("Restored %d sessions in progress\n", n)
+}
+
+func writeSessionState(name string, sh pks.SessionHandoff) (int, error) {
+	tmp := name + ".tmp"
+	f, e := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if e != nil {
+		return 0, e
+	}
+	n, e := sh.ExportSessions(f)
+	if ec := f.Close(); e == nil {
+		e = ec
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return 0, e
+	}
+	return n, os.Rename(tmp, name)
+}
+
+func (rs *rawServer) saveSessions() {
+	sh, ok := rs.s.(pks.SessionHandoff)
+	if !ok {
+		return
+	}
+	if *sessionStateFile == "" {
+		if n := sh.ActiveSessions(); n > 0 {
+			command.Logf("Dropping %d sessions in progress\n", n)
+		}
+		return
+	}
+
+	n, e := writeSessionState(*sessionStateFile, sh)
+	if e != nil {
+		command.Logf("Encountered error when saving sessions: %v\n", e)
+		return
+	}
+	command.Logf("Saved %d sessions in progress\n", n)
+}
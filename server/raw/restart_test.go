@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+type mockHandoffServer struct {
+	mockServer
+	sessions    int
+	exported    string
+	imported    string
+	importError error
+}
+
+func (ms *mockHandoffServer) ActiveSessions() int {
+	return ms.sessions
+}
+
+func (ms *mockHandoffServer) ExportSessions(w io.Writer) (int, error) {
+	_, e := io.WriteString(w, ms.exported)
+	return ms.sessions, e
+}
+
+func (ms *mockHandoffServer) ImportSessions(r io.Reader) (int, error) {
+	d, _ := ioutil.ReadAll(r)
+	ms.imported = string(d)
+	if ms.importError != nil {
+		return 0, ms.importError
+	}
+	return strings.Count(ms.imported, "session"), nil
+}
+
+func fakeEnvironment(env map[string]string) func(string) string {
+	return func(k string) string {
+		return env[k]
+	}
+}
+
+func withRestartCommand(script string) func() {
+	old := restartCommand
+	restartCommand = func() *exec.Cmd {
+		return exec.Command("/bin/sh", "-c", script)
+	}
+	return func() {
+		restartCommand = old
+	}
+}
+
+func (s *RawServerSuite) Test_inheritedFDCount_readsOurOwnHandoffAndSystemd(c *C) {
+	n, handoff, e := inheritedFDCount(fakeEnvironment(map[string]string{}), 42)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 0)
+	c.Assert(handoff, Equals, false)
+
+	n, handoff, e = inheritedFDCount(fakeEnvironment(map[string]string{"OTRNG_RAW_HANDOFF": "2"}), 42)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(handoff, Equals, true)
+
+	n, handoff, e = inheritedFDCount(fakeEnvironment(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "3"}), 42)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(handoff, Equals, false)
+
+	n, _, e = inheritedFDCount(fakeEnvironment(map[string]string{"LISTEN_PID": "43", "LISTEN_FDS": "3"}), 42)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *RawServerSuite) Test_inheritedFDCount_returnsErrorsForInvalidValues(c *C) {
+	_, _, e := inheritedFDCount(fakeEnvironment(map[string]string{"OTRNG_RAW_HANDOFF": "x"}), 42)
+	c.Assert(e, ErrorMatches, "invalid OTRNG_RAW_HANDOFF: \"x\"")
+
+	_, _, e = inheritedFDCount(fakeEnvironment(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "0"}), 42)
+	c.Assert(e, ErrorMatches, "invalid LISTEN_FDS: \"0\"")
+}
+
+func (s *RawServerSuite) Test_inheritListeners_takesOverListeningSockets(c *C) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	f, _ := l.(filer).File()
+
+	ls, e := inheritListeners([]uintptr{f.Fd()})
+	c.Assert(e, IsNil)
+	c.Assert(ls, HasLen, 1)
+	c.Assert(ls[0].Addr().String(), Equals, l.Addr().String())
+	ls[0].Close()
+
+	tmp, _ := ioutil.TempFile("", "otrng-raw-not-a-socket")
+	defer os.Remove(tmp.Name())
+	_, e = inheritListeners([]uintptr{tmp.Fd()})
+	c.Assert(e, ErrorMatches, "file descriptor [0-9]+: .*")
+}
+
+func (s *RawServerSuite) Test_restart_needsToBeListening(c *C) {
+	c.Assert((&rawServer{}).restart(), ErrorMatches, "the server isn't listening yet")
+}
+
+func (s *RawServerSuite) Test_restart_handsOverTheListenersToTheNewProcess(c *C) {
+	defer withRestartCommand(`[ -S /proc/self/fd/3 ] && [ "$OTRNG_RAW_HANDOFF" = "1" ] && printf x >&4 && cat <&5 >/dev/null`)()
+	l, _ := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer l.Close()
+	rs := &rawServer{}
+	rs.setListeners([]deadlineListener{l})
+
+	c.Assert(rs.restart(), IsNil)
+	c.Assert(rs.nextDone, Not(IsNil))
+	rs.nextDone.Close()
+}
+
+func (s *RawServerSuite) Test_restart_returnsErrorWhenTheNewProcessDoesntGetReady(c *C) {
+	defer withRestartCommand(`exit 1`)()
+	l, _ := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer l.Close()
+	rs := &rawServer{}
+	rs.setListeners([]deadlineListener{l})
+
+	c.Assert(rs.restart(), ErrorMatches, "the new process didn't get ready: EOF")
+	c.Assert(rs.nextDone, IsNil)
+
+	restartCommand = func() *exec.Cmd { return exec.Command("/bin/sleep", "5") }
+	old := handoffReadyTimeout
+	handoffReadyTimeout = time.Duration(50) * time.Millisecond
+	defer func() { handoffReadyTimeout = old }()
+	c.Assert(rs.restart(), ErrorMatches, "the new process didn't get ready: .*i/o timeout")
+
+	restartCommand = func() *exec.Cmd { return exec.Command("/somewhere/that/shouldn't/work") }
+	c.Assert(rs.restart(), ErrorMatches, ".*no such file or directory")
+}
+
+func (s *RawServerSuite) Test_takeOver_waitsForThePreviousProcessAndRestoresSessions(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-sessions")
+	defer os.RemoveAll(dir)
+	*sessionStateFile = filepath.Join(dir, "sessions.json")
+	defer func() { *sessionStateFile = "" }()
+
+	readyR, readyW, _ := os.Pipe()
+	doneR, doneW, _ := os.Pipe()
+	ms := &mockHandoffServer{}
+	rs := &rawServer{s: ms, previousReady: readyW, previousDone: doneR}
+
+	go func() {
+		b := make([]byte, 1)
+		readyR.Read(b)
+		ioutil.WriteFile(*sessionStateFile, []byte("one session, two session"), 0600)
+		doneW.Close()
+	}()
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.takeOver()
+	c.Assert(capture.finish(), Equals, "Restored 2 sessions in progress\n")
+	c.Assert(ms.imported, Equals, "one session, two session")
+	_, e := os.Stat(*sessionStateFile)
+	c.Assert(os.IsNotExist(e), Equals, true)
+}
+
+func (s *RawServerSuite) Test_takeOver_doesntWaitForThePreviousProcessWithoutSessionsToRestore(c *C) {
+	readyR, readyW, _ := os.Pipe()
+	defer readyR.Close()
+	doneR, doneW, _ := os.Pipe()
+	defer doneW.Close()
+	rs := &rawServer{s: &mockHandoffServer{}, previousReady: readyW, previousDone: doneR}
+
+	finished := make(chan bool)
+	go func() {
+		rs.takeOver()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Duration(5) * time.Second):
+		c.Fatal("takeOver waited for the previous process")
+	}
+
+	b := make([]byte, 1)
+	n, _ := readyR.Read(b)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *RawServerSuite) Test_restoreSessions_reportsErrors(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-sessions")
+	defer os.RemoveAll(dir)
+	*sessionStateFile = filepath.Join(dir, "sessions.json")
+	defer func() { *sessionStateFile = "" }()
+	ioutil.WriteFile(*sessionStateFile, []byte("{}"), 0600)
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	(&rawServer{s: &mockHandoffServer{importError: errors.New("unknown session state version 0")}}).restoreSessions()
+	c.Assert(capture.finish(), Equals, "Encountered error when restoring sessions: unknown session state version 0\nRestored 0 sessions in progress\n")
+}
+
+func (s *RawServerSuite) Test_saveSessions_writesTheSessionStateFile(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-sessions")
+	defer os.RemoveAll(dir)
+	*sessionStateFile = filepath.Join(dir, "sessions.json")
+	defer func() { *sessionStateFile = "" }()
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	(&rawServer{s: &mockHandoffServer{sessions: 3, exported: "state"}}).saveSessions()
+	c.Assert(capture.finish(), Equals, "Saved 3 sessions in progress\n")
+
+	d, _ := ioutil.ReadFile(*sessionStateFile)
+	c.Assert(string(d), Equals, "state")
+	fi, _ := os.Stat(*sessionStateFile)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+}
+
+func (s *RawServerSuite) Test_saveSessions_reportsDroppedSessionsWithoutStateFile(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+	(&rawServer{s: &mockHandoffServer{sessions: 3}}).saveSessions()
+	(&rawServer{s: &mockHandoffServer{}}).saveSessions()
+	c.Assert(capture.finish(), Equals, "Dropping 3 sessions in progress\n")
+}
+
+func (s *RawServerSuite) Test_saveSessions_reportsErrors(c *C) {
+	*sessionStateFile = "/somewhere/that/shouldn't/work"
+	defer func() { *sessionStateFile = "" }()
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	(&rawServer{s: &mockHandoffServer{sessions: 3}}).saveSessions()
+	c.Assert(capture.finish(), Equals, "Encountered error when saving sessions: open /somewhere/that/shouldn't/work.tmp: no such file or directory\n")
+}
+
+func (s *RawServerSuite) Test_drain_givesUpAfterTheDrainTimeout(c *C) {
+	defer command.WithFlags("drain-timeout")()
+	*drainTimeout = 0
+	rs := &rawServer{s: &mockServer{}}
+	defer close(startBlockedRequest(rs))
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.drain()
+	c.Assert(capture.finish(), Equals, "Drain timeout reached with 1 connections still in progress\n")
+}
+
+func (s *RawServerSuite) Test_shutdown_leavesTheSocketFileForTheNextProcess(c *C) {
+	dir, _ := ioutil.TempDir("", "otrng-raw-socket")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw.sock")
+	defer withListenFlags("unix:"+name, "", "", "")()
+
+	ms := &mockHandoffServer{}
+	doneR, doneW, _ := os.Pipe()
+	rs := &rawServer{s: ms, nextDone: doneW}
+
+	finished := make(chan error)
+	go func() { finished <- rs.listenWith() }()
+	for rs.addrs() == nil {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.shutdown()
+	c.Assert(<-finished, IsNil)
+	c.Assert(capture.finish(), Equals, "Shutting down server carefully...\n")
+
+	_, e := os.Stat(name)
+	c.Assert(e, IsNil)
+	d, e := ioutil.ReadAll(doneR)
+	c.Assert(e, IsNil)
+	c.Assert(d, HasLen, 0)
+}
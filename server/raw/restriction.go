@@ -1,6 +1,11 @@
 package main
 
-import "strings"
+import (
+	"strings"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
 
 func contains(a []string, x string) bool {
 	for _, n := range a {
@@ -41,6 +46,9 @@ func separateRestrictions() ([]string, []string, []string) {
 }
 
 func commandLineRestrictor(from string) bool {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+
 	if *allowOnlyPrefix == "" && *allowOnlySuffix == "" && *allowOnly == "" {
 		return false
 	}
@@ -49,3 +57,29 @@ func commandLineRestrictor(from string) bool {
 
 	return !(hasAnyPrefix(px, from) || hasAnySuffix(sx, from) || contains(o, from))
 }
+
+// policies will only allow a request if all of the contained policies allow it
+type policies []pks.Policy
+
+func (ps policies) Check(from string, kind pks.MessageKind, target string) error {
+	for _, p := range ps {
+		if e := p.Check(from, kind, target); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func loadPolicies() (policies, *pks.PolicyFile, error) {
+	result := policies{pks.Restrictor(commandLineRestrictor)}
+	if *policyFile == "" {
+		return result, nil, nil
+	}
+
+	pf, e := pks.LoadPolicyFile(*policyFile)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	return append(result, pf), pf, nil
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+
+	pks "github.com/otrv4/otrng-prekey-server"
 	. "gopkg.in/check.v1"
 )
 
@@ -89,3 +94,65 @@ func (s *RawServerSuite) Test_commandLineRestrictor_restrictsOnOnly(c *C) {
 	c.Assert(commandLineRestrictor("two"), Equals, false)
 	c.Assert(commandLineRestrictor("onebar"), Equals, true)
 }
+
+type mockPolicy struct {
+	receivedFrom string
+	returnError  error
+}
+
+func (m *mockPolicy) Check(from string, kind pks.MessageKind, target string) error {
+	m.receivedFrom = from
+	return m.returnError
+}
+
+func (s *RawServerSuite) Test_policies_Check_requiresAllPoliciesToAllow(c *C) {
+	p1 := &mockPolicy{}
+	p2 := &mockPolicy{returnError: errors.New("no way")}
+	p3 := &mockPolicy{}
+
+	c.Assert(policies{p1, p3}.Check("foo", pks.MessageDAKE1, "foo"), IsNil)
+	c.Assert(policies{p1, p2, p3}.Check("bar", pks.MessageDAKE1, "bar"), ErrorMatches, "no way")
+	c.Assert(p1.receivedFrom, Equals, "bar")
+	c.Assert(p3.receivedFrom, Equals, "foo")
+}
+
+func (s *RawServerSuite) Test_loadPolicies_usesOnlyTheCommandLineWithoutPolicyFile(c *C) {
+	*policyFile = ""
+	*allowOnlyPrefix = ""
+	*allowOnlySuffix = ""
+	*allowOnly = "one"
+	ps, pf, e := loadPolicies()
+	c.Assert(e, IsNil)
+	c.Assert(pf, IsNil)
+	c.Assert(ps, HasLen, 1)
+	c.Assert(ps.Check("two", pks.MessageDAKE1, "two"), ErrorMatches, "this from-string is restricted for these kinds of messages")
+	*allowOnly = ""
+}
+
+func (s *RawServerSuite) Test_loadPolicies_includesThePolicyFile(c *C) {
+	f, _ := ioutil.TempFile("", "otrng-raw-policy-file")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Rules": [{"Action": "deny", "Messages": ["publication"], "Reason": "read only"}]}`)
+	f.Close()
+
+	*policyFile = f.Name()
+	defer func() { *policyFile = "" }()
+	*allowOnlyPrefix = ""
+	*allowOnlySuffix = ""
+	*allowOnly = ""
+
+	ps, pf, e := loadPolicies()
+	c.Assert(e, IsNil)
+	c.Assert(pf, Not(IsNil))
+	c.Assert(ps, HasLen, 2)
+	c.Assert(ps.Check("one", pks.MessageDAKE1, "one"), IsNil)
+	c.Assert(ps.Check("one", pks.MessagePublication, "one"), ErrorMatches, "denied by policy: read only")
+}
+
+func (s *RawServerSuite) Test_loadPolicies_returnsErrorFromPolicyFile(c *C) {
+	*policyFile = "/somewhere/that/shouldn't/work"
+	defer func() { *policyFile = "" }()
+
+	_, _, e := loadPolicies()
+	c.Assert(e, ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
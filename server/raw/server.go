@@ -1,14 +1,22 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/adapter"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
 )
 
 // This implements the TCP network protocol for talking to
@@ -20,15 +28,28 @@ import (
 
 type rawServer struct {
 	s               pks.Server
-	l               *net.TCPListener
+	listeners       []deadlineListener
+	listenersLock   sync.Mutex
 	kp              pks.Keypair
+	policy          *pks.PolicyFile
+	auth            *frame.Authenticator
+	tlsSettings     *tlsSettings
+	permissions     *clientPermissions
 	finishRequested bool
-	activeConns     sync.WaitGroup
+	runner          *adapter.Runner
+	runnerOnce      sync.Once
+	stopping        sync.WaitGroup
+	inherited       []deadlineListener
+	previousReady   *os.File
+	previousDone    *os.File
+	nextDone        *os.File
+	admin           *http.Server
+	adminAddr       net.Addr
 }
 
 func (rs *rawServer) load(f pks.Factory) error {
 	var e error
-	rs.kp, e = loadOrCreateKeypair(f)
+	rs.kp, e = command.LoadOrCreateKeypair(f, *keyFile)
 	if e != nil {
 		return fmt.Errorf("encountered error when loading/creating keypair: %v", e)
 	}
@@ -36,45 +57,179 @@ func (rs *rawServer) load(f pks.Factory) error {
 	if e != nil {
 		return fmt.Errorf("encountered error when creating storage engine: %v", e)
 	}
-	server := f.NewServer(*serverIdentity,
-		rs.kp,
-		int(*fragLen),
-		storage,
-		time.Duration(*sessionTimeout)*time.Minute,
-		time.Duration(*fragmentationTimeout)*time.Minute,
-		commandLineRestrictor)
+	pols, pf, e := loadPolicies()
+	if e != nil {
+		return fmt.Errorf("encountered error when loading policy file: %v", e)
+	}
+	rs.policy = pf
+	if *gatewaySecrets != "" {
+		rs.auth, e = frame.NewAuthenticator(*gatewaySecrets, time.Duration(*frameMaxAge)*time.Second)
+		if e != nil {
+			return fmt.Errorf("encountered error when loading gateway secrets: %v", e)
+		}
+	}
+	if e = rs.loadTLS(); e != nil {
+		return e
+	}
+	server, e := rs.newServer(f, storage, pols, pf)
+	if e != nil {
+		return e
+	}
+	if e = shareState(server); e != nil {
+		return e
+	}
 
 	rs.s = server
 
 	return nil
 }
 
+// newServer creates a server consulting the policies, if the factory can do that. Otherwise only
+// the command line restrictions can be used
+func (rs *rawServer) newServer(f pks.Factory, storage pks.Storage, pols policies, pf *pks.PolicyFile) (pks.Server, error) {
+	sessionTimeout := time.Duration(*sessionTimeout) * time.Minute
+	fragmentationTimeout := time.Duration(*fragmentationTimeout) * time.Minute
+	if polf, ok := f.(pks.PolicyFactory); ok {
+		return polf.NewServerWithPolicy(*serverIdentity, rs.kp, int(*fragLen), storage, sessionTimeout, fragmentationTimeout, pols), nil
+	}
+	if pf != nil {
+		return nil, errors.New("encountered error when creating server: policy files can't be used with this factory")
+	}
+	return f.NewServer(*serverIdentity, rs.kp, int(*fragLen), storage, sessionTimeout, fragmentationTimeout, commandLineRestrictor), nil
+}
+
+// shareState makes the server keep the sessions and fragments in progress in the shared store, if one is given
+func shareState(s pks.Server) error {
+	if *sharedState == "" {
+		return nil
+	}
+	ss, ok := s.(pks.StateSharer)
+	if !ok {
+		return errors.New("encountered error when sharing state: the server can't keep its sessions in a shared store")
+	}
+	st, e := pks.LoadStateStore(*sharedState)
+	if e != nil {
+		return fmt.Errorf("encountered error when creating the shared state store: %v", e)
+	}
+	ss.ShareState(st, st)
+	return nil
+}
+
+func (rs *rawServer) loadTLS() error {
+	var e error
+	if *tlsCertFile != "" || *tlsKeyFile != "" || *tlsClientCAFile != "" {
+		rs.tlsSettings, e = newTLSSettings(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile)
+		if e != nil {
+			return fmt.Errorf("encountered error when loading TLS settings: %v", e)
+		}
+	}
+	if *tlsClientPermissions != "" {
+		if *tlsClientCAFile == "" {
+			return fmt.Errorf("encountered error when loading client permissions: a client CA file is needed to verify client certificates")
+		}
+		rs.permissions, e = newClientPermissions(*tlsClientPermissions)
+		if e != nil {
+			return fmt.Errorf("encountered error when loading client permissions: %v", e)
+		}
+	}
+	return nil
+}
+
+func listenerName(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return "unix:" + addr.String()
+	}
+	return addr.String()
+}
+
+func (rs *rawServer) listenerNames() ([]string, error) {
+	names := []string{}
+	if rs.inherited != nil {
+		for _, l := range rs.inherited {
+			names = append(names, listenerName(l.Addr()))
+		}
+		return names, nil
+	}
+
+	ds, e := listenerDescriptions()
+	if e != nil {
+		return nil, e
+	}
+	for _, d := range ds {
+		names = append(names, d.String())
+	}
+	return names, nil
+}
+
 func (rs *rawServer) run() error {
-	fmt.Printf("Starting server on %s...\n", net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)))
-	fmt.Printf("%s\n", formatFingerprint(rs.kp.Fingerprint()))
+	names, e := rs.listenerNames()
+	if e != nil {
+		return fmt.Errorf("encountered error when running listener: %v", e)
+	}
+	command.Logf("Starting server on %s...\n", strings.Join(names, ", "))
+	command.Logf("%s\n", pks.FormatFingerprint(rs.kp.Fingerprint()))
 
+	// The health endpoints keep being served while draining, and are stopped by shutdown
+	if e := rs.startAdmin(); e != nil {
+		return e
+	}
 	if e := rs.listenWith(); e != nil {
+		rs.stopAdmin()
 		return fmt.Errorf("encountered error when running listener: %v", e)
 	}
 	return nil
 }
 
+func (rs *rawServer) openListeners() ([]deadlineListener, error) {
+	if rs.inherited != nil {
+		return rs.inherited, nil
+	}
+	ds, e := listenerDescriptions()
+	if e != nil {
+		return nil, e
+	}
+	return listenToAll(ds)
+}
+
+// listenWith serves all the listeners until shutdown is requested, or one of them fails
 func (rs *rawServer) listenWith() error {
-	addr, e := net.ResolveTCPAddr("tcp", net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)))
+	ls, e := rs.openListeners()
 	if e != nil {
 		return e
 	}
-	l, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return err
+	rs.setListeners(ls)
+
+	var failed int32
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l deadlineListener, useTLS bool) {
+			defer l.Close()
+			e := rs.serve(l, useTLS, &failed)
+			if e != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+			errs <- e
+		}(l, rs.tlsSettings != nil && l.Addr().Network() != "unix")
+	}
+
+	var result error
+	for range ls {
+		if e := <-errs; e != nil && result == nil {
+			result = e
+		}
 	}
-	rs.l = l
-	defer rs.l.Close()
-	for !rs.finishRequested {
+	return result
+}
+
+func (rs *rawServer) serve(l deadlineListener, useTLS bool, failed *int32) error {
+	for !rs.finishRequested && atomic.LoadInt32(failed) == 0 {
 		l.SetDeadline(time.Now().Add(time.Duration(100) * time.Millisecond))
-		conn, err := rs.l.Accept()
+		conn, err := l.Accept()
 		if err == nil {
-			conn.SetDeadline(time.Now().Add(time.Duration(2) * time.Minute))
+			conn.SetDeadline(time.Now().Add(currentConnectionTimeout()))
+			if useTLS {
+				conn = tls.Server(conn, rs.tlsSettings.config())
+			}
 			go rs.handleRequest(conn)
 		} else {
 			if te, ok := err.(net.Error); !ok || !te.Timeout() {
@@ -85,31 +240,167 @@ func (rs *rawServer) listenWith() error {
 	return nil
 }
 
-const readLimit = 268435456 // 2 ** 28 ~ 268 Mb
+func (rs *rawServer) setListeners(ls []deadlineListener) {
+	rs.listenersLock.Lock()
+	defer rs.listenersLock.Unlock()
+	rs.listeners = ls
+}
+
+// addrs returns the addresses of all the listeners, or nil if the server isn't listening yet
+func (rs *rawServer) addrs() []net.Addr {
+	rs.listenersLock.Lock()
+	defer rs.listenersLock.Unlock()
+	if rs.listeners == nil {
+		return nil
+	}
+	result := []net.Addr{}
+	for _, l := range rs.listeners {
+		result = append(result, l.Addr())
+	}
+	return result
+}
+
+// requestRunner returns the runner handling the connections, creating it the first time
+func (rs *rawServer) requestRunner() *adapter.Runner {
+	rs.runnerOnce.Do(func() {
+		rs.runner = &adapter.Runner{
+			Server:        rs.s,
+			MaxConcurrent: int(*maxConcurrent),
+			Logf:          command.Logf,
+		}
+	})
+	return rs.runner
+}
 
 func (rs *rawServer) handleRequest(c io.ReadWriteCloser) {
-	rs.activeConns.Add(1)
-	defer rs.activeConns.Done()
-	defer c.Close()
-	data, e := ioutil.ReadAll(io.LimitReader(c, readLimit))
+	rs.requestRunner().Serve(&rawRequest{rs: rs, c: c})
+}
+
+// verifyClient finishes the TLS handshake, if the connection uses TLS, and returns the
+// permissions of the client, or nil if it has no restrictions
+func (rs *rawServer) verifyClient(c io.ReadWriteCloser) (*permittedServer, error) {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if e := tc.Handshake(); e != nil {
+		return nil, e
+	}
+	if rs.permissions == nil {
+		return nil, nil
+	}
+	id, allowed, e := rs.permissions.forConnection(tc.ConnectionState())
 	if e != nil {
-		fmt.Printf("Encountered error when reading data: %v\n", e)
+		return nil, e
+	}
+	return &permittedServer{identity: id, allowed: allowed}, nil
+}
+
+func (rs *rawServer) parseData(data []byte) ([]*frame.Element, error) {
+	if rs.auth != nil {
+		return frame.ParseAuthenticated(data, rs.auth)
+	}
+	return frame.Parse(data)
+}
+
+func currentConnectionTimeout() time.Duration {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return time.Duration(*connectionTimeout) * time.Second
+}
+
+func currentReadLimit() int64 {
+	command.ConfigLock.RLock()
+	defer command.ConfigLock.RUnlock()
+	return int64(*readLimit)
+}
+
+func (rs *rawServer) reloadConfig() {
+	if *configFile == "" {
 		return
 	}
-	res, e := protocolHandleData(data, rs.s)
+	ignored, e := reloadConfig()
 	if e != nil {
-		fmt.Printf("Encountered error when handling data: %v\n", e)
+		command.Logf("Encountered error when reloading configuration, keeping the old settings: %v\n", e)
 		return
 	}
-	_, e = c.Write(res)
-	if e != nil {
-		fmt.Printf("Encountered error when writing data: %v\n", e)
+	for _, s := range ignored {
+		command.Logf("The setting %s can't be changed without a restart, ignoring it\n", s)
+	}
+	if e := command.OpenLog(logFile); e != nil {
+		command.Logf("Encountered error when opening log file: %v\n", e)
+	}
+	command.Logf("Reloaded configuration\n")
+}
+
+func (rs *rawServer) reloadPolicy() {
+	if rs.policy == nil {
+		return
+	}
+	if e := rs.policy.Reload(); e != nil {
+		command.Logf("Encountered error when reloading policy file, keeping the old policy: %v\n", e)
+		return
+	}
+	command.Logf("Reloaded policy file\n")
+}
+
+func (rs *rawServer) reloadGatewaySecrets() {
+	if rs.auth == nil {
 		return
 	}
+	if e := rs.auth.Reload(); e != nil {
+		command.Logf("Encountered error when reloading gateway secrets, keeping the old secrets: %v\n", e)
+		return
+	}
+	command.Logf("Reloaded gateway secrets\n")
+}
+
+func (rs *rawServer) reloadTLS() {
+	if rs.tlsSettings != nil {
+		if e := rs.tlsSettings.reload(); e != nil {
+			command.Logf("Encountered error when reloading TLS certificates, keeping the old certificates: %v\n", e)
+		} else {
+			command.Logf("Reloaded TLS certificates\n")
+		}
+	}
+	if rs.permissions != nil {
+		if e := rs.permissions.reload(); e != nil {
+			command.Logf("Encountered error when reloading client permissions, keeping the old permissions: %v\n", e)
+		} else {
+			command.Logf("Reloaded client permissions\n")
+		}
+	}
+}
+
+func (rs *rawServer) reload() {
+	rs.reloadConfig()
+	rs.reloadPolicy()
+	rs.reloadGatewaySecrets()
+	rs.reloadTLS()
+}
+
+// closeServer lets the storage write what it keeps in memory, before the next process reads it
+func (rs *rawServer) closeServer() {
+	if c, ok := rs.s.(io.Closer); ok {
+		if e := c.Close(); e != nil {
+			command.Logf("Encountered error when closing the storage: %v\n", e)
+		}
+	}
 }
 
+// shutdown stops accepting connections, drains the ones in progress and saves the sessions in progress.
+// If a new process has taken over, it will be told when we are done
 func (rs *rawServer) shutdown() {
-	fmt.Println("Shutting down server carefully...")
-	rs.finishRequested = true
-	rs.activeConns.Wait()
+	rs.stopping.Add(1)
+	defer rs.stopping.Done()
+
+	command.Logf("Shutting down server carefully...\n")
+	rs.stopAccepting()
+	rs.drain()
+	rs.saveSessions()
+	rs.closeServer()
+	rs.stopAdmin()
+	if rs.nextDone != nil {
+		rs.nextDone.Close()
+	}
 }
@@ -4,9 +4,13 @@ import (
 	"crypto/rand"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
+	"time"
 
 	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
 	. "gopkg.in/check.v1"
 )
 
@@ -47,6 +51,7 @@ type mockRWC struct {
 	readCalled  bool
 	writeCalled bool
 	closeCalled bool
+	written     []byte
 }
 
 func (m *mockRWC) Read(inp []byte) (int, error) {
@@ -55,8 +60,9 @@ func (m *mockRWC) Read(inp []byte) (int, error) {
 	return m.retReadN, m.retReadE
 }
 
-func (m *mockRWC) Write([]byte) (int, error) {
+func (m *mockRWC) Write(data []byte) (int, error) {
 	m.writeCalled = true
+	m.written = append(m.written, data...)
 	return m.retWriteN, m.retWriteE
 }
 
@@ -65,6 +71,35 @@ func (m *mockRWC) Close() error {
 	return m.retCloseE
 }
 
+// blockingRWC is a connection that doesn't send anything until it's released
+type blockingRWC struct {
+	release chan bool
+}
+
+func (b *blockingRWC) Read(inp []byte) (int, error) {
+	<-b.release
+	return 0, io.EOF
+}
+
+func (b *blockingRWC) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (b *blockingRWC) Close() error {
+	return nil
+}
+
+// startBlockedRequest starts handling a connection that stays in progress until the returned
+// channel is closed
+func startBlockedRequest(rs *rawServer) chan bool {
+	b := &blockingRWC{release: make(chan bool)}
+	go rs.handleRequest(b)
+	for rs.requestRunner().Active() == 0 {
+		time.Sleep(time.Duration(1) * time.Millisecond)
+	}
+	return b.release
+}
+
 func (s *RawServerSuite) Test_handleRequest_willPrintErrorEncounteredWhenReading(c *C) {
 	capture := startStdoutCapture()
 	defer capture.restore()
@@ -102,6 +137,45 @@ func (s *RawServerSuite) Test_handleRequest_willPrintErrorEncounteredWhenWriting
 	c.Assert(capture.finish(), Equals, "Encountered error when writing data: something even worse\n")
 }
 
+func (s *RawServerSuite) Test_handleRequest_refusesConnectionsBeyondTheLimit(c *C) {
+	defer command.WithFlags("max-concurrent")()
+	*maxConcurrent = 1
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	rs := &rawServer{s: &mockServer{}}
+	release := startBlockedRequest(rs)
+	defer close(release)
+
+	m := &mockRWC{retReadN: 0, retReadE: io.EOF}
+	rs.handleRequest(m)
+	c.Assert(m.readCalled, Equals, false)
+	c.Assert(m.closeCalled, Equals, true)
+	c.Assert(capture.finish(), Equals, "Encountered error when accepting request: too many requests in progress\n")
+}
+
+type mockFactory struct{}
+
+func (f *mockFactory) CreateKeypair() pks.Keypair {
+	return nil
+}
+
+func (f *mockFactory) LoadKeypairFrom(r io.Reader) (pks.Keypair, error) {
+	return nil, nil
+}
+
+func (f *mockFactory) StoreKeysInto(pks.Keypair, io.Writer) error {
+	return nil
+}
+
+func (f *mockFactory) LoadStorageType(name string) (pks.Storage, error) {
+	return nil, nil
+}
+
+func (f *mockFactory) NewServer(string, pks.Keypair, int, pks.Storage, time.Duration, time.Duration, pks.Restrictor) pks.Server {
+	return nil
+}
+
 func (s *RawServerSuite) Test_load_willReturnErrorEncounteredWithKeypair(c *C) {
 	*keyFile = "/somewhere/that/shouldn't/work"
 	fac := &mockFactory{}
@@ -130,3 +204,149 @@ func (s *RawServerSuite) Test_run_willReturnNilOnControlledShutdown(c *C) {
 	c.Assert(e, IsNil)
 
 }
+
+func (s *RawServerSuite) Test_load_willReturnErrorEncounteredWithPolicyFile(c *C) {
+	*keyFile = "__test_thing_that_should_be_removed"
+	*storageEngine = "in-memory"
+	*policyFile = "/somewhere/that/shouldn't/work"
+	defer func() { *policyFile = "" }()
+	defer os.Remove(*keyFile)
+	e := (&rawServer{}).load(pks.CreateFactory(rand.Reader))
+	c.Assert(e, ErrorMatches, "encountered error when loading policy file: open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *RawServerSuite) Test_newServer_onlyUsesPolicyFilesWithFactoriesSupportingThem(c *C) {
+	_, e := (&rawServer{}).newServer(&mockFactory{}, nil, nil, nil)
+	c.Assert(e, IsNil)
+	_, e = (&rawServer{}).newServer(&mockFactory{}, nil, nil, &pks.PolicyFile{})
+	c.Assert(e, ErrorMatches, "encountered error when creating server: policy files can't be used with this factory")
+}
+
+func (s *RawServerSuite) Test_shareState_givesTheServerTheSharedStore(c *C) {
+	defer func() { *sharedState = "" }()
+	c.Assert(shareState(&mockServer{}), IsNil)
+
+	*sharedState = "redis:address=localhost:6379"
+	c.Assert(shareState(&mockServer{}), ErrorMatches, "encountered error when sharing state: the server can't keep its sessions in a shared store")
+	f := pks.CreateFactory(rand.Reader)
+	st, _ := f.LoadStorageType("in-memory")
+	server := f.NewServer("keys.example.org", f.CreateKeypair(), 0, st, time.Minute, time.Minute, nil)
+	c.Assert(shareState(server), IsNil)
+
+	*sharedState = "redis:address=localhost"
+	c.Assert(shareState(server), ErrorMatches, `encountered error when creating the shared state store: invalid key-value server address "localhost", expected HOST:PORT or /PATH`)
+}
+
+func (s *RawServerSuite) Test_load_willReturnErrorEncounteredWithGatewaySecrets(c *C) {
+	*keyFile = "__test_thing_that_should_be_removed"
+	*storageEngine = "in-memory"
+	*gatewaySecrets = "/somewhere/that/shouldn't/work"
+	defer func() { *gatewaySecrets = "" }()
+	defer os.Remove(*keyFile)
+	e := (&rawServer{}).load(pks.CreateFactory(rand.Reader))
+	c.Assert(e, ErrorMatches, "encountered error when loading gateway secrets: open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *RawServerSuite) Test_reload_doesNothingWithoutPolicyFile(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	(&rawServer{}).reload()
+	c.Assert(capture.finish(), Equals, "")
+}
+
+func (s *RawServerSuite) Test_reload_reloadsThePolicyFile(c *C) {
+	f, _ := ioutil.TempFile("", "otrng-raw-policy-file")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Default": "allow"}`)
+	f.Close()
+
+	pf, _ := pks.LoadPolicyFile(f.Name())
+	rs := &rawServer{policy: pf}
+
+	ioutil.WriteFile(f.Name(), []byte(`{"Default": "deny"}`), 0600)
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.reload()
+	c.Assert(capture.finish(), Equals, "Reloaded policy file\n")
+	c.Assert(pf.Check("one", pks.MessageDAKE1, "one"), ErrorMatches, "denied by policy")
+}
+
+func (s *RawServerSuite) Test_reload_keepsTheOldPolicyOnErrors(c *C) {
+	f, _ := ioutil.TempFile("", "otrng-raw-policy-file")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"Default": "allow"}`)
+	f.Close()
+
+	pf, _ := pks.LoadPolicyFile(f.Name())
+	rs := &rawServer{policy: pf}
+
+	ioutil.WriteFile(f.Name(), []byte(`{"Default": "nope"}`), 0600)
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.reload()
+	c.Assert(capture.finish(), Equals, "Encountered error when reloading policy file, keeping the old policy: invalid default: unknown action \"nope\"\n")
+	c.Assert(pf.Check("one", pks.MessageDAKE1, "one"), IsNil)
+}
+
+func (s *RawServerSuite) Test_reloadConfig_reportsSettingsThatNeedARestart(c *C) {
+	defer command.WithFlags("config", "storage")()
+	fn := writeTempConfig(`{"Storage": "in-memory"}`)
+	defer os.Remove(fn)
+	*configFile = fn
+	*storageEngine = "in-memory"
+	c.Assert(loadConfig(), IsNil)
+	command.CommandLineFlags = map[string]bool{}
+
+	ioutil.WriteFile(fn, []byte(`{"Storage": "dir:/tmp"}`), 0600)
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	(&rawServer{}).reloadConfig()
+	c.Assert(capture.finish(), Equals,
+		"The setting Storage can't be changed without a restart, ignoring it\n"+
+			"Reloaded configuration\n")
+}
+
+func (s *RawServerSuite) Test_reloadConfig_keepsTheOldSettingsOnErrors(c *C) {
+	defer command.WithFlags("config")()
+	fn := writeTempConfig(`{"Storage": "in-memory"}`)
+	defer os.Remove(fn)
+	*configFile = fn
+
+	ioutil.WriteFile(fn, []byte(`{"Storage": 42}`), 0600)
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	(&rawServer{}).reloadConfig()
+	c.Assert(capture.finish(), Matches, "Encountered error when reloading configuration, keeping the old settings: config file .*: json: cannot unmarshal number .*\n")
+}
+
+func (s *RawServerSuite) Test_reload_reloadsTheGatewaySecrets(c *C) {
+	fn := writeTempSecrets("gw1:MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.Remove(fn)
+	a, _ := frame.NewAuthenticator(fn, time.Second)
+	rs := &rawServer{auth: a}
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.reload()
+	c.Assert(capture.finish(), Equals, "Reloaded gateway secrets\n")
+}
+
+func (s *RawServerSuite) Test_reload_keepsTheOldGatewaySecretsOnErrors(c *C) {
+	fn := writeTempSecrets("gw1:MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	defer os.Remove(fn)
+	a, _ := frame.NewAuthenticator(fn, time.Second)
+	rs := &rawServer{auth: a}
+	ioutil.WriteFile(fn, []byte("gw1:c2hvcnQ=\n"), 0600)
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.reload()
+	c.Assert(capture.finish(), Equals, "Encountered error when reloading gateway secrets, keeping the old secrets: "+fn+":1: secret has to be at least 16 bytes\n")
+	_, e := frame.ParseAuthenticated(createAuthenticatedFrame("gw1", []byte("0123456789abcdef"), time.Now(), 0x01, "ola", "abcde"), a)
+	c.Assert(e, IsNil)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+)
+
+// When a certificate and key are given, the raw server only accepts TLS connections.
+// If a client CA file is given as well, gateways have to present a certificate signed
+// by one of those CAs. The identity of a gateway is the first DNS name in its certificate
+// that can be found in the client permissions file, or otherwise the common name.
+// The client permissions file maps those identities to the from-addresses the gateway
+// is allowed to send messages for, using the same matchers as the policy rules:
+//
+//   {
+//     "gateway-1.example.org": ["suffix:@example.org"],
+//     "gateway-2.example.org": ["*"]
+//   }
+//
+// Gateways with an identity not in the file will not be able to send anything.
+// The certificate, the client CAs and the client permissions are read again on SIGHUP.
+
+var errUnknownClientIdentity = errors.New("the client certificate identity has no permissions")
+
+type tlsSettings struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	cert         *tls.Certificate
+	clientCAs    *x509.CertPool
+	sync.RWMutex
+}
+
+func readClientCAs(name string) (*x509.CertPool, error) {
+	d, e := ioutil.ReadFile(name)
+	if e != nil {
+		return nil, e
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(d) {
+		return nil, fmt.Errorf("%s: no certificates found", name)
+	}
+	return pool, nil
+}
+
+func readTLSFiles(certFile, keyFile, clientCAFile string) (*tls.Certificate, *x509.CertPool, error) {
+	cert, e := tls.LoadX509KeyPair(certFile, keyFile)
+	if e != nil {
+		return nil, nil, e
+	}
+	if clientCAFile == "" {
+		return &cert, nil, nil
+	}
+	pool, e := readClientCAs(clientCAFile)
+	if e != nil {
+		return nil, nil, e
+	}
+	return &cert, pool, nil
+}
+
+func newTLSSettings(certFile, keyFile, clientCAFile string) (*tlsSettings, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate file and a key file are needed for TLS")
+	}
+	cert, pool, e := readTLSFiles(certFile, keyFile, clientCAFile)
+	if e != nil {
+		return nil, e
+	}
+	return &tlsSettings{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		cert:         cert,
+		clientCAs:    pool,
+	}, nil
+}
+
+// reload reads the certificate, key and client CAs again. If it fails, the old ones are kept
+func (t *tlsSettings) reload() error {
+	cert, pool, e := readTLSFiles(t.certFile, t.keyFile, t.clientCAFile)
+	if e != nil {
+		return e
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.cert = cert
+	t.clientCAs = pool
+	return nil
+}
+
+func (t *tlsSettings) currentConfig() *tls.Config {
+	t.RLock()
+	defer t.RUnlock()
+
+	res := &tls.Config{
+		Certificates: []tls.Certificate{*t.cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.clientCAs != nil {
+		res.ClientCAs = t.clientCAs
+		res.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return res
+}
+
+// config returns a TLS configuration that will always use the most recently loaded files
+func (t *tlsSettings) config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.currentConfig(), nil
+		},
+	}
+}
+
+type clientPermissions struct {
+	file    string
+	allowed map[string][]func(string) bool
+	sync.RWMutex
+}
+
+func parseClientPermissions(name string) (map[string][]func(string) bool, error) {
+	f, e := os.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	desc := map[string][]string{}
+	dec := json.NewDecoder(f)
+	if e := dec.Decode(&desc); e != nil {
+		return nil, fmt.Errorf("%s: %v", name, e)
+	}
+
+	result := make(map[string][]func(string) bool)
+	for id, ms := range desc {
+		result[id] = []func(string) bool{}
+		for _, m := range ms {
+			mm, e := pks.NewMatcher(m)
+			if e != nil {
+				return nil, fmt.Errorf("%s: %s: %v", name, id, e)
+			}
+			result[id] = append(result[id], mm)
+		}
+	}
+	return result, nil
+}
+
+func newClientPermissions(file string) (*clientPermissions, error) {
+	allowed, e := parseClientPermissions(file)
+	if e != nil {
+		return nil, e
+	}
+	return &clientPermissions{file: file, allowed: allowed}, nil
+}
+
+// reload reads the permissions file again. If it fails, the old permissions are kept
+func (p *clientPermissions) reload() error {
+	allowed, e := parseClientPermissions(p.file)
+	if e != nil {
+		return e
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.allowed = allowed
+	return nil
+}
+
+func certificateIdentities(cert *x509.Certificate) []string {
+	result := append([]string{}, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		result = append(result, cert.Subject.CommonName)
+	}
+	return result
+}
+
+// forConnection returns the from-address matchers for the verified client certificate of the connection
+func (p *clientPermissions) forConnection(st tls.ConnectionState) (string, []func(string) bool, error) {
+	if len(st.VerifiedChains) == 0 || len(st.VerifiedChains[0]) == 0 {
+		return "", nil, errors.New("no verified client certificate")
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+	for _, id := range certificateIdentities(st.VerifiedChains[0][0]) {
+		if ms, ok := p.allowed[id]; ok {
+			return id, ms, nil
+		}
+	}
+	return "", nil, errUnknownClientIdentity
+}
+
+// permittedServer only hands over messages with a from-address the gateway is allowed to send for
+type permittedServer struct {
+	pks.Server
+	identity string
+	allowed  []func(string) bool
+}
+
+func (ps *permittedServer) Handle(from, message string) ([]string, error) {
+	for _, m := range ps.allowed {
+		if m(from) {
+			return ps.Server.Handle(from, message)
+		}
+	}
+	return nil, fmt.Errorf("the gateway %s is not allowed to send messages from %s", ps.identity, from)
+}
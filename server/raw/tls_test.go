@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func createTestCertificate(cn string, dnsNames []string, parent *testCertificate) *testCertificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func (tc *testCertificate) writeTo(dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	kd, _ := x509.MarshalECPrivateKey(tc.key)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kd}), 0600)
+	return certFile, keyFile
+}
+
+func (tc *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+type testTLSFiles struct {
+	dir           string
+	ca            *testCertificate
+	caFile        string
+	certFile      string
+	keyFile       string
+	permissions   string
+	gateway       *testCertificate
+	unknownClient *testCertificate
+}
+
+func createTestTLSFiles() *testTLSFiles {
+	res := &testTLSFiles{}
+	res.dir, _ = ioutil.TempDir("", "otrng-raw-tls")
+	res.ca = createTestCertificate("Test CA", nil, nil)
+	res.caFile, _ = res.ca.writeTo(res.dir, "ca")
+	res.certFile, res.keyFile = createTestCertificate("127.0.0.1", nil, res.ca).writeTo(res.dir, "server")
+	res.gateway = createTestCertificate("gateway", []string{"gateway-1.example.org"}, res.ca)
+	res.unknownClient = createTestCertificate("someone-else", nil, res.ca)
+	res.permissions = filepath.Join(res.dir, "permissions.json")
+	ioutil.WriteFile(res.permissions, []byte(`{"gateway-1.example.org": ["suffix:@example.org"]}`), 0600)
+	return res
+}
+
+func (f *testTLSFiles) remove() {
+	os.RemoveAll(f.dir)
+}
+
+func (f *testTLSFiles) clientConfig(cert *testCertificate) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(f.ca.cert)
+	res := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if cert != nil {
+		res.Certificates = []tls.Certificate{cert.tlsCertificate()}
+	}
+	return res
+}
+
+func (s *RawServerSuite) Test_newTLSSettings_needsBothCertificateAndKey(c *C) {
+	_, e := newTLSSettings("cert.pem", "", "")
+	c.Assert(e, ErrorMatches, "both a certificate file and a key file are needed for TLS")
+
+	_, e = newTLSSettings("", "", "ca.pem")
+	c.Assert(e, ErrorMatches, "both a certificate file and a key file are needed for TLS")
+}
+
+func (s *RawServerSuite) Test_newTLSSettings_returnsErrorsForInvalidFiles(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+
+	_, e := newTLSSettings(f.certFile, f.caFile, "")
+	c.Assert(e, ErrorMatches, "tls: found a certificate rather than a key in the PEM for the private key")
+
+	_, e = newTLSSettings(f.certFile, f.keyFile, f.permissions)
+	c.Assert(e, ErrorMatches, f.permissions+": no certificates found")
+
+	_, e = newTLSSettings(f.certFile, f.keyFile, "/somewhere/that/shouldn't/work")
+	c.Assert(e, ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *RawServerSuite) Test_tlsSettings_config_onlyRequiresClientCertificatesWithClientCAs(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+
+	t, e := newTLSSettings(f.certFile, f.keyFile, "")
+	c.Assert(e, IsNil)
+	conf, _ := t.config().GetConfigForClient(nil)
+	c.Assert(conf.ClientAuth, Equals, tls.NoClientCert)
+	c.Assert(conf.Certificates, HasLen, 1)
+
+	t, e = newTLSSettings(f.certFile, f.keyFile, f.caFile)
+	c.Assert(e, IsNil)
+	conf, _ = t.config().GetConfigForClient(nil)
+	c.Assert(conf.ClientAuth, Equals, tls.RequireAndVerifyClientCert)
+	c.Assert(conf.ClientCAs, Not(IsNil))
+}
+
+func (s *RawServerSuite) Test_tlsSettings_reload_usesTheNewCertificate(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+
+	t, _ := newTLSSettings(f.certFile, f.keyFile, "")
+	conf := t.config()
+
+	other := createTestCertificate("127.0.0.1", nil, f.ca)
+	other.writeTo(f.dir, "server")
+	c.Assert(t.reload(), IsNil)
+
+	current, _ := conf.GetConfigForClient(nil)
+	c.Assert(current.Certificates[0].Certificate[0], DeepEquals, other.der)
+
+	ioutil.WriteFile(f.keyFile, []byte("nothing here"), 0600)
+	c.Assert(t.reload(), ErrorMatches, "tls: failed to find any PEM data in key input")
+	current, _ = conf.GetConfigForClient(nil)
+	c.Assert(current.Certificates[0].Certificate[0], DeepEquals, other.der)
+}
+
+func (s *RawServerSuite) Test_parseClientPermissions_returnsErrors(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+
+	ioutil.WriteFile(f.permissions, []byte(`{"gateway": "*"}`), 0600)
+	_, e := parseClientPermissions(f.permissions)
+	c.Assert(e, ErrorMatches, f.permissions+": json: cannot unmarshal .*")
+
+	ioutil.WriteFile(f.permissions, []byte(`{"gateway": ["regex:(abc"]}`), 0600)
+	_, e = parseClientPermissions(f.permissions)
+	c.Assert(e, ErrorMatches, f.permissions+": gateway: invalid matcher .*")
+
+	_, e = parseClientPermissions("/somewhere/that/shouldn't/work")
+	c.Assert(e, ErrorMatches, "open /somewhere/that/shouldn't/work: no such file or directory")
+}
+
+func (s *RawServerSuite) Test_clientPermissions_forConnection_findsTheIdentityOfTheCertificate(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+	ioutil.WriteFile(f.permissions, []byte(`{"gateway-1.example.org": ["suffix:@example.org"], "gateway": [], "someone-else": ["*"]}`), 0600)
+	p, e := newClientPermissions(f.permissions)
+	c.Assert(e, IsNil)
+
+	id, allowed, e := p.forConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{f.gateway.cert, f.ca.cert}}})
+	c.Assert(e, IsNil)
+	c.Assert(id, Equals, "gateway-1.example.org")
+	c.Assert(allowed, HasLen, 1)
+
+	id, _, e = p.forConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{f.unknownClient.cert}}})
+	c.Assert(e, IsNil)
+	c.Assert(id, Equals, "someone-else")
+
+	_, _, e = p.forConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{f.ca.cert}}})
+	c.Assert(e, Equals, errUnknownClientIdentity)
+
+	_, _, e = p.forConnection(tls.ConnectionState{})
+	c.Assert(e, ErrorMatches, "no verified client certificate")
+}
+
+func (s *RawServerSuite) Test_permittedServer_onlyHandsOverAllowedFromAddresses(c *C) {
+	ms := &mockServer{}
+	ms.returnData = [][]string{[]string{"one"}}
+	ms.returnError = []error{nil}
+	m1 := func(s string) bool { return s == "sita@example.org" }
+	ps := &permittedServer{Server: ms, identity: "gateway-1", allowed: []func(string) bool{m1}}
+
+	res, e := ps.Handle("sita@example.org", "hello")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []string{"one"})
+
+	_, e = ps.Handle("rama@example.org", "hello")
+	c.Assert(e, ErrorMatches, "the gateway gateway-1 is not allowed to send messages from rama@example.org")
+	c.Assert(ms.receivedFrom, DeepEquals, []string{"sita@example.org"})
+}
+
+func (s *RawServerSuite) Test_loadTLS_returnsErrors(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+	defer func() {
+		*tlsCertFile, *tlsKeyFile, *tlsClientCAFile, *tlsClientPermissions = "", "", "", ""
+	}()
+
+	*tlsCertFile = f.certFile
+	c.Assert((&rawServer{}).loadTLS(), ErrorMatches, "encountered error when loading TLS settings: both a certificate file and a key file are needed for TLS")
+
+	*tlsKeyFile = f.keyFile
+	*tlsClientPermissions = f.permissions
+	c.Assert((&rawServer{}).loadTLS(), ErrorMatches, "encountered error when loading client permissions: a client CA file is needed to verify client certificates")
+
+	*tlsClientCAFile = f.caFile
+	*tlsClientPermissions = "/somewhere/that/shouldn't/work"
+	c.Assert((&rawServer{}).loadTLS(), ErrorMatches, "encountered error when loading client permissions: open /somewhere/that/shouldn't/work: no such file or directory")
+
+	*tlsClientPermissions = f.permissions
+	rs := &rawServer{}
+	c.Assert(rs.loadTLS(), IsNil)
+	c.Assert(rs.tlsSettings, Not(IsNil))
+	c.Assert(rs.permissions, Not(IsNil))
+}
+
+func (s *RawServerSuite) Test_reload_reloadsTheTLSFiles(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+	t, _ := newTLSSettings(f.certFile, f.keyFile, f.caFile)
+	p, _ := newClientPermissions(f.permissions)
+	rs := &rawServer{tlsSettings: t, permissions: p}
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.reload()
+	c.Assert(capture.finish(), Equals, "Reloaded TLS certificates\nReloaded client permissions\n")
+}
+
+func (s *RawServerSuite) Test_reload_keepsTheOldTLSFilesOnErrors(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+	t, _ := newTLSSettings(f.certFile, f.keyFile, f.caFile)
+	p, _ := newClientPermissions(f.permissions)
+	rs := &rawServer{tlsSettings: t, permissions: p}
+	os.Remove(f.caFile)
+	ioutil.WriteFile(f.permissions, []byte(`[]`), 0600)
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+	rs.reload()
+	c.Assert(capture.finish(), Matches, "Encountered error when reloading TLS certificates, keeping the old certificates: open .*ca.pem: no such file or directory\n"+
+		"Encountered error when reloading client permissions, keeping the old permissions: .*permissions.json: json: cannot unmarshal .*\n")
+	c.Assert(p.allowed, HasLen, 1)
+}
+
+func sendOverTLS(addr net.Addr, conf *tls.Config, from, data string) ([]byte, error) {
+	con, e := tls.Dial(addr.Network(), addr.String(), conf)
+	if e != nil {
+		return nil, e
+	}
+	defer con.Close()
+
+	toSend := appendShort(nil, uint16(len(from)))
+	toSend = append(toSend, []byte(from)...)
+	toSend = appendShort(toSend, uint16(len(data)))
+	toSend = append(toSend, []byte(data)...)
+	if _, e := con.Write(toSend); e != nil {
+		return nil, e
+	}
+	con.CloseWrite()
+	return ioutil.ReadAll(con)
+}
+
+func (s *RawServerSuite) Test_listenWith_verifiesClientCertificatesAndPermissions(c *C) {
+	f := createTestTLSFiles()
+	defer f.remove()
+
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	ms := &mockServer{}
+	ms.returnData = [][]string{[]string{"one"}}
+	ms.returnError = []error{nil}
+	t, _ := newTLSSettings(f.certFile, f.keyFile, f.caFile)
+	p, _ := newClientPermissions(f.permissions)
+	rs := &rawServer{s: ms, tlsSettings: t, permissions: p}
+
+	*listenIP = "127.0.0.1"
+	*listenPort = 0
+	done := make(chan error)
+	go func() { done <- rs.listenWith() }()
+	for rs.addrs() == nil {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	addr := rs.addrs()[0]
+
+	res, e := sendOverTLS(addr, f.clientConfig(f.gateway), "sita@example.org", "hello")
+	c.Assert(e, IsNil)
+	c.Assert(res, DeepEquals, []byte{0x00, 0x03, 0x6f, 0x6e, 0x65})
+
+	res, _ = sendOverTLS(addr, f.clientConfig(f.gateway), "rama@example.com", "hello")
+	c.Assert(res, HasLen, 0)
+
+	res, _ = sendOverTLS(addr, f.clientConfig(f.unknownClient), "sita@example.org", "hello")
+	c.Assert(res, HasLen, 0)
+
+	res, _ = sendOverTLS(addr, f.clientConfig(nil), "sita@example.org", "hello")
+	c.Assert(res, HasLen, 0)
+
+	rs.finishRequested = true
+	c.Assert(<-done, IsNil)
+	c.Assert(ms.receivedFrom, DeepEquals, []string{"sita@example.org"})
+
+	c.Assert(capture.finish(), Matches, "(?s)"+
+		"Encountered error when handling data: the gateway gateway-1.example.org is not allowed to send messages from rama@example.com\n"+
+		"Encountered error when verifying client: the client certificate identity has no permissions\n"+
+		"Encountered error when verifying client: .*certificate.*\n")
+}
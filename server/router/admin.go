@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The router is ready when it's listening, isn't shutting down and has at least one healthy
+// backend. Next to the health endpoints, GET /stats returns for every backend whether it's
+// healthy, the part of the hash space it has, the connections and messages forwarded to it,
+// the failures and the health checks, and the number of messages that couldn't be forwarded
+// because no backend was healthy
+
+type statsResponse struct {
+	Backends []*backendStats
+	Unrouted uint64
+}
+
+func (r *router) readinessChecks() []*pks.HealthCheck {
+	listening := &pks.HealthCheck{Name: "listening", OK: r.addr() != nil}
+	if !listening.OK {
+		listening.Error = "the router isn't listening yet"
+	}
+	backends := &pks.HealthCheck{Name: "backends", OK: r.healthyBackends() > 0}
+	if !backends.OK {
+		backends.Error = errNoHealthyBackend.Error()
+	}
+	stopping := &pks.HealthCheck{Name: "stopping", OK: atomic.LoadInt32(&r.finishRequested) == 0}
+	if !stopping.OK {
+		stopping.Error = "the router is shutting down"
+	}
+	return []*pks.HealthCheck{listening, backends, stopping}
+}
+
+func (r *router) handleStats(w http.ResponseWriter, req *http.Request) {
+	command.WriteJSON(w, http.StatusOK, &statsResponse{Backends: r.stats(), Unrouted: atomic.LoadUint64(&r.unrouted)})
+}
+
+func (r *router) adminHandler() http.Handler {
+	mux := command.HealthHandler(r.readinessChecks)
+	mux.HandleFunc("/stats", command.OnlyGet(r.handleStats))
+	return mux
+}
+
+// startAdmin starts serving the admin endpoints, if an admin address is given
+func (r *router) startAdmin() error {
+	if *adminAddress == "" {
+		return nil
+	}
+	l, e := net.Listen("tcp", *adminAddress)
+	if e != nil {
+		return fmt.Errorf("encountered error when starting admin listener: %v", e)
+	}
+
+	r.listenerLock.Lock()
+	r.admin = &http.Server{
+		Handler:      r.adminHandler(),
+		ReadTimeout:  command.AdminTimeout,
+		WriteTimeout: command.AdminTimeout,
+	}
+	r.adminAddr = l.Addr()
+	r.listenerLock.Unlock()
+
+	command.Logf("Serving health checks and statistics on %s\n", l.Addr())
+	go r.admin.Serve(l)
+	return nil
+}
+
+func (r *router) stopAdmin() {
+	r.listenerLock.Lock()
+	defer r.listenerLock.Unlock()
+	if r.admin != nil {
+		r.admin.Close()
+		r.admin = nil
+	}
+}
+
+// currentAdminAddr returns the address of the admin listener, or nil if it's not running
+func (r *router) currentAdminAddr() net.Addr {
+	r.listenerLock.Lock()
+	defer r.listenerLock.Unlock()
+	if r.admin == nil {
+		return nil
+	}
+	return r.adminAddr
+}
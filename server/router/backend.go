@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// backend is one raw server the router forwards to. It keeps the same statistics
+// for as long as it's configured, also while it's off the hash ring
+type backend struct {
+	address string
+	network string
+	addr    string
+	conn    *backendConnection
+
+	healthy             bool
+	consecutiveFailures uint
+	lastChecked         time.Time
+	lastError           string
+	requests            uint64
+	messages            uint64
+	failures            uint64
+	healthChecks        uint64
+	failedHealthChecks  uint64
+	sync.Mutex
+}
+
+// backendStats is what /stats shows for every backend
+type backendStats struct {
+	Address            string
+	Healthy            bool
+	Share              float64
+	Requests           uint64
+	Messages           uint64
+	Failures           uint64
+	HealthChecks       uint64
+	FailedHealthChecks uint64
+	LastChecked        *time.Time `json:",omitempty"`
+	LastError          string     `json:",omitempty"`
+}
+
+// backendConnection is how the router talks to a backend: over TLS if tls is set,
+// and signing every frame if secret is set
+type backendConnection struct {
+	tls     *tls.Config
+	gateway string
+	secret  []byte
+}
+
+// The options of a backend follow its address after a question mark, separated by &, like this:
+//   tls:10.0.0.1:3242?ca-file=/etc/otrng/raw-ca.pem&cert-file=/etc/otrng/router.pem&key-file=/etc/otrng/router-key.pem
+//   tcp:10.0.0.2:3242?gateway-id=router-1&gateway-secret-file=/etc/otrng/router-secret.asc
+// The TLS options are the same as the connect options of the HTTP server, and the gateway
+// options make the router sign every frame it forwards, for backends started with -gateway-secrets.
+// The files are read again on SIGHUP.
+
+var tlsBackendOptions = []string{"ca-file", "cert-file", "key-file", "server-name"}
+var gatewayBackendOptions = []string{"gateway-id", "gateway-secret-file"}
+
+func invalidBackend(desc string) error {
+	return fmt.Errorf("invalid backend %q, expected tcp:HOST:PORT, tls:HOST:PORT or unix:/PATH", desc)
+}
+
+// parseBackend accepts tcp:HOST:PORT, tls:HOST:PORT, unix:/PATH or just HOST:PORT, followed by the options
+func parseBackend(desc string) (*backend, error) {
+	address := desc
+	var options url.Values
+	if ix := strings.Index(desc, "?"); ix != -1 {
+		address = desc[:ix]
+		var e error
+		if options, e = url.ParseQuery(desc[ix+1:]); e != nil {
+			return nil, fmt.Errorf("invalid options of backend %q: %v", desc, e)
+		}
+	}
+
+	b := &backend{address: desc, network: "tcp", addr: address, healthy: true}
+	useTLS := false
+	switch {
+	case strings.HasPrefix(address, "tcp:"):
+		b.addr = strings.TrimPrefix(address, "tcp:")
+	case strings.HasPrefix(address, "tls:"):
+		b.addr = strings.TrimPrefix(address, "tls:")
+		useTLS = true
+	case strings.HasPrefix(address, "unix:"):
+		b.network = "unix"
+		b.addr = strings.TrimPrefix(address, "unix:")
+	}
+	if b.addr == "" {
+		return nil, invalidBackend(desc)
+	}
+	if b.network == "tcp" {
+		if _, _, e := net.SplitHostPort(b.addr); e != nil {
+			return nil, invalidBackend(desc)
+		}
+	}
+
+	conn, e := loadBackendConnection(b.addr, useTLS, options)
+	if e != nil {
+		return nil, fmt.Errorf("backend %q: %v", desc, e)
+	}
+	b.conn = conn
+	return b, nil
+}
+
+func loadBackendTLS(addr string, options url.Values) (*tls.Config, error) {
+	res := &tls.Config{
+		ServerName: options.Get("server-name"),
+		MinVersion: tls.VersionTLS12,
+	}
+	if res.ServerName == "" {
+		res.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if name := options.Get("ca-file"); name != "" {
+		d, e := ioutil.ReadFile(name)
+		if e != nil {
+			return nil, e
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(d) {
+			return nil, fmt.Errorf("%s: no certificates found", name)
+		}
+	}
+	certFile, keyFile := options.Get("cert-file"), options.Get("key-file")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both a client certificate file and a client key file are needed")
+	}
+	if certFile != "" {
+		cert, e := tls.LoadX509KeyPair(certFile, keyFile)
+		if e != nil {
+			return nil, e
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+func isOneOf(n string, names []string) bool {
+	for _, o := range names {
+		if n == o {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyOption(options url.Values, names []string) bool {
+	for _, n := range names {
+		if _, ok := options[n]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadBackendConnection checks the options and reads the files they name
+func loadBackendConnection(addr string, useTLS bool, options url.Values) (*backendConnection, error) {
+	for n := range options {
+		if !isOneOf(n, tlsBackendOptions) && !isOneOf(n, gatewayBackendOptions) {
+			return nil, fmt.Errorf("unknown option %q", n)
+		}
+	}
+
+	res := &backendConnection{}
+	if useTLS {
+		var e error
+		if res.tls, e = loadBackendTLS(addr, options); e != nil {
+			return nil, e
+		}
+	} else if hasAnyOption(options, tlsBackendOptions) {
+		return nil, errors.New("the TLS options can only be used with tls:HOST:PORT")
+	}
+
+	if hasAnyOption(options, gatewayBackendOptions) {
+		res.gateway = options.Get("gateway-id")
+		secretFile := options.Get("gateway-secret-file")
+		if res.gateway == "" || secretFile == "" {
+			return nil, errors.New("both a gateway ID and a gateway secret file are needed")
+		}
+		var e error
+		if res.secret, e = frame.ReadSecret(secretFile); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+func (b *backend) connection() *backendConnection {
+	b.Lock()
+	defer b.Unlock()
+	return b.conn
+}
+
+// reloaded takes the connection settings of the same backend, parsed again
+func (b *backend) reloaded(newer *backend) {
+	conn := newer.connection()
+	b.Lock()
+	defer b.Unlock()
+	b.conn = conn
+}
+
+type closeWriter interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// exchange sends the data to the backend, and returns everything it writes back before closing the connection
+func (b *backend) exchange(data []byte, timeout time.Duration) ([]byte, error) {
+	var c net.Conn
+	var e error
+	d := &net.Dialer{Timeout: timeout}
+	if cfg := b.connection().tls; cfg != nil {
+		c, e = tls.DialWithDialer(d, b.network, b.addr, cfg)
+	} else {
+		c, e = d.Dial(b.network, b.addr)
+	}
+	if e != nil {
+		return nil, e
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	if len(data) > 0 {
+		if _, e := c.Write(data); e != nil {
+			return nil, e
+		}
+	}
+	if e := c.(closeWriter).CloseWrite(); e != nil {
+		return nil, e
+	}
+	return ioutil.ReadAll(c)
+}
+
+// encode returns the frames for the elements, signed if the backend needs it
+func (b *backend) encode(elements []*frame.Element) ([]byte, error) {
+	conn := b.connection()
+	now := time.Now()
+	result := []byte{}
+	for _, pe := range elements {
+		var f []byte
+		var e error
+		if conn.secret == nil {
+			f, e = frame.Encode(pe)
+		} else {
+			f, e = frame.EncodeAuthenticated(conn.gateway, conn.secret, now, pe)
+		}
+		if e != nil {
+			return nil, e
+		}
+		result = append(result, f...)
+	}
+	return result, nil
+}
+
+// forward sends the elements to the backend, and returns its replies
+func (b *backend) forward(elements []*frame.Element, timeout time.Duration) ([]byte, error) {
+	var res []byte
+	frames, e := b.encode(elements)
+	if e == nil {
+		res, e = b.exchange(frames, timeout)
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.requests++
+	b.messages += uint64(len(elements))
+	if e != nil {
+		b.failures++
+		return nil, e
+	}
+	return res, nil
+}
+
+// check connects without sending anything, the same way gateways check that they can reach
+// the raw server, and returns true if the backend went up or down because of it
+func (b *backend) check(timeout time.Duration, unhealthyAfter uint) bool {
+	_, e := b.exchange(nil, timeout)
+
+	b.Lock()
+	defer b.Unlock()
+	b.healthChecks++
+	b.lastChecked = time.Now()
+	if e == nil {
+		b.consecutiveFailures = 0
+		b.lastError = ""
+		changed := !b.healthy
+		b.healthy = true
+		return changed
+	}
+
+	b.failedHealthChecks++
+	b.consecutiveFailures++
+	b.lastError = e.Error()
+	if b.healthy && b.consecutiveFailures >= unhealthyAfter {
+		b.healthy = false
+		return true
+	}
+	return false
+}
+
+func (b *backend) isHealthy() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.healthy
+}
+
+func (b *backend) stats(share float64) *backendStats {
+	b.Lock()
+	defer b.Unlock()
+	s := &backendStats{
+		Address:            b.address,
+		Healthy:            b.healthy,
+		Share:              share,
+		Requests:           b.requests,
+		Messages:           b.messages,
+		Failures:           b.failures,
+		HealthChecks:       b.healthChecks,
+		FailedHealthChecks: b.failedHealthChecks,
+		LastError:          b.lastError,
+	}
+	if !b.lastChecked.IsZero() {
+		t := b.lastChecked
+		s.LastChecked = &t
+	}
+	return s
+}
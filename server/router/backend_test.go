@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+var testGatewaySecret = []byte("0123456789abcdef0123456789abcdef")
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func createTestCertificate(cn string, parent *testCertificate) *testCertificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func (tc *testCertificate) writeTo(dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	kd, _ := x509.MarshalECPrivateKey(tc.key)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kd}), 0600)
+	return certFile, keyFile
+}
+
+func writeSecret(c *C, content string) string {
+	fn := filepath.Join(c.MkDir(), "secret.asc")
+	c.Assert(ioutil.WriteFile(fn, []byte(content), 0600), IsNil)
+	return fn
+}
+
+func testAuthenticator(c *C, gateway string) *frame.Authenticator {
+	a, e := frame.NewAuthenticator(writeSecret(c, gateway+":"+base64.StdEncoding.EncodeToString(testGatewaySecret)+"\n"), 30*time.Second)
+	c.Assert(e, IsNil)
+	return a
+}
+
+func (s *RouterSuite) Test_parseBackend_readsTheOptions(c *C) {
+	dir := c.MkDir()
+	ca := createTestCertificate("Test CA", nil)
+	caFile, _ := ca.writeTo(dir, "ca")
+	certFile, keyFile := createTestCertificate("router", ca).writeTo(dir, "router")
+	secretFile := writeSecret(c, base64.StdEncoding.EncodeToString(testGatewaySecret))
+
+	b, e := parseBackend("tls:raw.example.org:3242?ca-file=" + caFile + "&cert-file=" + certFile + "&key-file=" + keyFile +
+		"&gateway-id=router-1&gateway-secret-file=" + secretFile)
+	c.Assert(e, IsNil)
+	c.Assert(b.network, Equals, "tcp")
+	c.Assert(b.addr, Equals, "raw.example.org:3242")
+	c.Assert(b.conn.tls.ServerName, Equals, "raw.example.org")
+	c.Assert(b.conn.tls.Certificates, HasLen, 1)
+	c.Assert(b.conn.gateway, Equals, "router-1")
+	c.Assert(b.conn.secret, DeepEquals, testGatewaySecret)
+
+	b, e = parseBackend("tls:10.0.0.1:3242?server-name=raw.example.org")
+	c.Assert(e, IsNil)
+	c.Assert(b.conn.tls.ServerName, Equals, "raw.example.org")
+	c.Assert(b.conn.tls.RootCAs, IsNil)
+	c.Assert(b.conn.secret, IsNil)
+
+	b, e = parseBackend("unix:/run/otrng/raw.sock?gateway-id=router-1&gateway-secret-file=" + secretFile)
+	c.Assert(e, IsNil)
+	c.Assert(b.addr, Equals, "/run/otrng/raw.sock")
+	c.Assert(b.conn.tls, IsNil)
+	c.Assert(b.conn.gateway, Equals, "router-1")
+}
+
+func (s *RouterSuite) Test_parseBackend_rejectsOptionsItCantUse(c *C) {
+	secretFile := writeSecret(c, base64.StdEncoding.EncodeToString(testGatewaySecret))
+	invalid := map[string]string{
+		"tcp:10.0.0.1:3242?ciphers=all":                                          `backend ".*": unknown option "ciphers"`,
+		"tcp:10.0.0.1:3242?ca-file=/etc/otrng/raw-ca.pem":                        `backend ".*": the TLS options can only be used with tls:HOST:PORT`,
+		"unix:/run/otrng/raw.sock?server-name=raw.example.org":                   `backend ".*": the TLS options can only be used with tls:HOST:PORT`,
+		"tls:10.0.0.1:3242?cert-file=/etc/otrng/router.pem":                      `backend ".*": both a client certificate file and a client key file are needed`,
+		"tls:10.0.0.1:3242?ca-file=/somewhere/that/shouldn't/work":               `backend ".*": open /somewhere/that/shouldn't/work: no such file or directory`,
+		"tcp:10.0.0.1:3242?gateway-id=router-1":                                  `backend ".*": both a gateway ID and a gateway secret file are needed`,
+		"tcp:10.0.0.1:3242?gateway-secret-file=" + secretFile:                    `backend ".*": both a gateway ID and a gateway secret file are needed`,
+		"tcp:10.0.0.1:3242?gateway-id=router-1&gateway-secret-file=/nowhere.asc": `backend ".*": open /nowhere.asc: no such file or directory`,
+		"tcp:10.0.0.1:3242?gateway-id=%zz":                                       `invalid options of backend ".*": invalid URL escape "%zz"`,
+		"tls:10.0.0.1?server-name=raw.example.org":                               `invalid backend ".*", expected tcp:HOST:PORT, tls:HOST:PORT or unix:/PATH`,
+	}
+	for desc, msg := range invalid {
+		_, e := parseBackend(desc)
+		c.Assert(e, ErrorMatches, msg, Commentf("%s", desc))
+	}
+}
+
+func (s *RouterSuite) Test_router_signsTheFramesForBackendsThatOnlyAcceptAuthenticatedFrames(c *C) {
+	defer withFlags()()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(e, IsNil)
+	fb := serveFakeBackend(&fakeBackend{name: "one", l: l, auth: testAuthenticator(c, "router-1")})
+	defer l.Close()
+	secretFile := writeSecret(c, base64.StdEncoding.EncodeToString(testGatewaySecret))
+
+	r, done := startRouter(c, []string{fb.address() + "?gateway-id=router-1&gateway-secret-file=" + secretFile})
+	r.auth = testAuthenticator(c, "gateway-1")
+
+	signed, e := frame.EncodeAuthenticated("gateway-1", testGatewaySecret, time.Now(), &frame.Element{From: "sita@example.org", Data: "?OTRP..."})
+	c.Assert(e, IsNil)
+	c.Assert(packets(exchange(c, r.addr(), signed)), DeepEquals, []string{"one:sita@example.org"})
+	c.Assert(exchange(c, r.addr(), signed), HasLen, 0)
+	c.Assert(exchange(c, r.addr(), encodeFrame("sita@example.org", "?OTRP...")), HasLen, 0)
+
+	r.shutdown()
+	c.Assert(<-done, IsNil)
+	c.Assert(capture.finish(), Matches, "(?s).*Encountered error when parsing data: replayed frame\n"+
+		"Encountered error when parsing data: can't parse .*")
+}
+
+func (s *RouterSuite) Test_router_connectsToBackendsOverTLSWithTheClientCertificate(c *C) {
+	defer withFlags()()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	dir := c.MkDir()
+	ca := createTestCertificate("Test CA", nil)
+	caFile, _ := ca.writeTo(dir, "ca")
+	serverCert, serverKey := createTestCertificate("127.0.0.1", ca).writeTo(dir, "server")
+	clientCert, clientKey := createTestCertificate("router", ca).writeTo(dir, "router")
+
+	cert, e := tls.LoadX509KeyPair(serverCert, serverKey)
+	c.Assert(e, IsNil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	l, e := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert})
+	c.Assert(e, IsNil)
+	defer l.Close()
+	serveFakeBackend(&fakeBackend{name: "one", l: l})
+	address := "tls:" + l.Addr().String() + "?ca-file=" + caFile
+
+	r, done := startRouter(c, []string{address + "&cert-file=" + clientCert + "&key-file=" + clientKey})
+	c.Assert(packets(exchange(c, r.addr(), encodeFrame("sita@example.org", "?OTRP..."))), DeepEquals, []string{"one:sita@example.org"})
+	r.checkHealth()
+	c.Assert(r.stats()[0].Healthy, Equals, true)
+	r.shutdown()
+	c.Assert(<-done, IsNil)
+
+	*unhealthyAfter = 1
+	r, done = startRouter(c, []string{address})
+	r.checkHealth()
+	c.Assert(r.stats()[0].Healthy, Equals, false)
+	c.Assert(r.stats()[0].LastError, Matches, ".*certificate.*")
+	c.Assert(exchange(c, r.addr(), encodeFrame("sita@example.org", "?OTRP...")), HasLen, 0)
+	r.shutdown()
+	c.Assert(<-done, IsNil)
+}
+
+func (s *RouterSuite) Test_setBackends_readsTheFilesOfTheBackendsThatStayAgain(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+	secretFile := writeSecret(c, base64.StdEncoding.EncodeToString(testGatewaySecret))
+	desc := "tcp:10.0.0.1:3242?gateway-id=router-1&gateway-secret-file=" + secretFile
+	r := newRouter(10)
+	c.Assert(r.setBackends([]string{desc}), IsNil)
+	b := r.backends[desc]
+	b.requests = 5
+
+	c.Assert(ioutil.WriteFile(secretFile, []byte(base64.StdEncoding.EncodeToString([]byte("fedcba9876543210"))), 0600), IsNil)
+	c.Assert(r.setBackends([]string{desc}), IsNil)
+	c.Assert(r.backends[desc], Equals, b)
+	c.Assert(b.requests, Equals, uint64(5))
+	c.Assert(b.connection().secret, DeepEquals, []byte("fedcba9876543210"))
+}
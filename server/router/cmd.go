@@ -0,0 +1,21 @@
+package main
+
+import "flag"
+
+// These flags represent all the available command line flags
+var (
+	listenPort        = flag.Uint("port", 3240, "Port to listen to")
+	listenIP          = flag.String("address", "localhost", "Address to listen to")
+	backendList       = flag.String("backends", "", "The raw servers to forward to, separated by comma, for example 'tcp:10.0.0.1:3242,tcp:10.0.0.2:3242' or 'unix:/run/otrng/raw.sock'. TLS and the gateway secret are given as options, like 'tls:10.0.0.1:3242?ca-file=/etc/otrng/raw-ca.pem&gateway-id=router-1&gateway-secret-file=/etc/otrng/router-secret.asc'")
+	backendsFile      = flag.String("backends-file", "", "File listing the raw servers to forward to, one on each line, used instead of -backends. It will be reloaded on SIGHUP")
+	virtualNodes      = flag.Uint("virtual-nodes", 160, "The number of points every backend gets on the hash ring. More points spread the from-addresses more evenly")
+	healthInterval    = flag.Uint("health-interval", 5, "How often to check that the backends accept connections, in seconds")
+	healthTimeout     = flag.Uint("health-timeout", 2, "The time a backend has to answer a health check, in seconds")
+	unhealthyAfter    = flag.Uint("unhealthy-after", 2, "The number of failed health checks in a row before a backend is taken off the hash ring")
+	backendTimeout    = flag.Uint("backend-timeout", 30, "The time a backend has to answer forwarded messages, in seconds")
+	connectionTimeout = flag.Uint("connection-timeout", 120, "Connection timeout, in seconds")
+	readLimit         = flag.Uint("read-limit", 268435456, "The maximum number of bytes to read from one connection")
+	gatewaySecrets    = flag.String("gateway-secrets", "", "File containing the shared secrets of trusted gateways, one line for each, gateway-id:base64-secret. If given, only authenticated frames will be accepted")
+	frameMaxAge       = flag.Uint("frame-max-age", 30, "The maximum age of authenticated frames, in seconds")
+	adminAddress      = flag.String("admin-address", "", "Address to serve /healthz, /readyz and the backend statistics on /stats on, over HTTP, for example 'localhost:3241'. Empty means no admin endpoints")
+)
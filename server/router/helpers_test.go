@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RouterSuite struct{}
+
+var _ = Suite(&RouterSuite{})
+
+func encodeFrame(from, message string) []byte {
+	res, _ := frame.Encode(&frame.Element{From: from, Data: message})
+	return res
+}
+
+type stdoutCapture struct {
+	old  *os.File
+	outC chan string
+	r, w *os.File
+}
+
+func startStdoutCapture() *stdoutCapture {
+	s := &stdoutCapture{}
+
+	s.old = os.Stdout
+	s.r, s.w, _ = os.Pipe()
+	os.Stdout = s.w
+	s.outC = make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, s.r)
+		s.outC <- buf.String()
+	}()
+
+	return s
+}
+
+func (s *stdoutCapture) finish() string {
+	s.w.Close()
+	return <-s.outC
+}
+
+func (s *stdoutCapture) restore() {
+	s.w.Close()
+	os.Stdout = s.old
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+var signalHandler = make(chan os.Signal, 1)
+
+func main() {
+	flag.Parse()
+
+	descs, e := configuredBackends()
+	if e != nil {
+		fmt.Println(e)
+		return
+	}
+	if *virtualNodes == 0 {
+		fmt.Println("the number of virtual nodes has to be at least 1")
+		return
+	}
+	r := newRouter(int(*virtualNodes))
+	if e := r.setBackends(descs); e != nil {
+		fmt.Println(e)
+		return
+	}
+	if *gatewaySecrets != "" {
+		if r.auth, e = frame.NewAuthenticator(*gatewaySecrets, time.Duration(*frameMaxAge)*time.Second); e != nil {
+			fmt.Printf("encountered error when loading gateway secrets: %v\n", e)
+			return
+		}
+	}
+
+	go func() {
+		signal.Notify(signalHandler, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range signalHandler {
+			if sig == syscall.SIGHUP {
+				r.reload()
+				continue
+			}
+			r.shutdown()
+			return
+		}
+	}()
+
+	if e := r.run(); e != nil {
+		command.Logf("%v\n", e)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// hashRing maps from-addresses to backends with consistent hashing. Every backend gets a number
+// of points on a ring of 64-bit hashes, and a from-address belongs to the backend of the first
+// point at or after its own hash. When a backend is added or removed, only the from-addresses
+// between its points and the ones before them move, so the DAKEs in progress on the other
+// backends are not disturbed.
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend string
+}
+
+func ringHash(s string) uint64 {
+	h := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// newHashRing returns a ring with the given number of points for every backend
+func newHashRing(backends []string, pointsEach int) *hashRing {
+	r := &hashRing{}
+	for _, b := range backends {
+		for i := 0; i < pointsEach; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(b + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].backend < r.points[j].backend
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// lookup returns the backend for the key, or false if the ring is empty
+func (r *hashRing) lookup(key string) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].backend, true
+}
+
+// shares returns the part of the hash space every backend has, between 0 and 1
+func (r *hashRing) shares() map[string]float64 {
+	result := map[string]float64{}
+	if len(r.points) < 2 {
+		for _, p := range r.points {
+			result[p.backend] = 1
+		}
+		return result
+	}
+	prev := r.points[len(r.points)-1].hash
+	for _, p := range r.points {
+		// The subtraction wraps around for the first point, which is what we want
+		result[p.backend] += float64(p.hash-prev) / (1 << 64)
+		prev = p.hash
+	}
+	return result
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	. "gopkg.in/check.v1"
+)
+
+func keysOf(r *hashRing, n int) map[string]string {
+	result := map[string]string{}
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("user%d@example.org", i)
+		result[k], _ = r.lookup(k)
+	}
+	return result
+}
+
+func (s *RouterSuite) Test_hashRing_returnsNothingWhenEmpty(c *C) {
+	_, ok := newHashRing(nil, 10).lookup("sita@example.org")
+	c.Assert(ok, Equals, false)
+	c.Assert(newHashRing(nil, 10).shares(), HasLen, 0)
+	c.Assert(newHashRing([]string{"a"}, 1).shares(), DeepEquals, map[string]float64{"a": 1})
+}
+
+func (s *RouterSuite) Test_hashRing_spreadsTheKeysAndAlwaysGivesTheSameAnswer(c *C) {
+	backends := []string{"tcp:10.0.0.1:3242", "tcp:10.0.0.2:3242", "tcp:10.0.0.3:3242"}
+	r := newHashRing(backends, 160)
+	keys := keysOf(r, 3000)
+	c.Assert(keysOf(newHashRing([]string{backends[2], backends[0], backends[1]}, 160), 3000), DeepEquals, keys)
+
+	counts := map[string]int{}
+	for _, b := range keys {
+		counts[b]++
+	}
+	total := 0.0
+	for _, b := range backends {
+		c.Assert(counts[b] > 700, Equals, true, Commentf("%s got %d", b, counts[b]))
+		total += r.shares()[b]
+	}
+	c.Assert(math.Abs(total-1) < 1e-9, Equals, true)
+}
+
+func (s *RouterSuite) Test_hashRing_onlyMovesTheKeysOfTheBackendAddedOrRemoved(c *C) {
+	three := []string{"tcp:10.0.0.1:3242", "tcp:10.0.0.2:3242", "tcp:10.0.0.3:3242"}
+	before := keysOf(newHashRing(three, 160), 3000)
+	after := keysOf(newHashRing(append(three, "tcp:10.0.0.4:3242"), 160), 3000)
+
+	moved := 0
+	for k, b := range after {
+		if b != before[k] {
+			c.Assert(b, Equals, "tcp:10.0.0.4:3242")
+			moved++
+		}
+	}
+	c.Assert(moved > 500 && moved < 1000, Equals, true, Commentf("%d moved", moved))
+
+	without := keysOf(newHashRing([]string{three[0], three[2]}, 160), 3000)
+	for k, b := range before {
+		if b != three[1] {
+			c.Assert(without[k], Equals, b)
+		}
+	}
+}
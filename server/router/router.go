@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// The router forwards connections in the raw protocol to a number of raw servers. The
+// messages of a DAKE have to reach the same server, unless the servers share their state,
+// so the router picks the server from the "from" of every frame with consistent hashing.
+// A connection with frames from several from-addresses is split up, and the replies are
+// written back in the order of the frames.
+// The backends are checked regularly, and taken off the hash ring when they fail, which
+// moves their from-addresses to the other backends until they come back.
+// The router reads the same frames as the raw server, with the frame package. With -gateway-secrets
+// it only accepts authenticated frames, like the raw server does. Every backend gets the frames in the
+// form its options ask for - signed with the secret of the router if it's a gateway of the backend,
+// and over TLS for tls: backends - and the replies of the backends are sent back as they are.
+
+var errNoBackends = errors.New("no backends are given, use -backends or -backends-file")
+var errNoHealthyBackend = errors.New("there is no healthy backend")
+
+type router struct {
+	auth       *frame.Authenticator
+	backends   map[string]*backend
+	order      []string
+	ring       *hashRing
+	unrouted   uint64
+	pointsEach int
+	sync.RWMutex
+
+	listener        net.Listener
+	admin           *http.Server
+	adminAddr       net.Addr
+	listenerLock    sync.Mutex
+	finishRequested int32
+	handling        sync.WaitGroup
+	stopHealth      chan bool
+	healthStopped   chan bool
+}
+
+func newRouter(pointsEach int) *router {
+	return &router{backends: map[string]*backend{}, ring: newHashRing(nil, pointsEach), pointsEach: pointsEach}
+}
+
+// readBackendsFile reads one backend on each line, ignoring empty lines and lines starting with #
+func readBackendsFile(name string) ([]string, error) {
+	f, e := os.Open(name)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	result := []string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		result = append(result, l)
+	}
+	return result, sc.Err()
+}
+
+func configuredBackends() ([]string, error) {
+	var descs []string
+	if *backendsFile != "" {
+		var e error
+		if descs, e = readBackendsFile(*backendsFile); e != nil {
+			return nil, e
+		}
+	} else {
+		for _, d := range strings.Split(*backendList, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				descs = append(descs, d)
+			}
+		}
+	}
+	if len(descs) == 0 {
+		return nil, errNoBackends
+	}
+	return descs, nil
+}
+
+// setBackends replaces the backends with the ones described. The ones that were already
+// there keep their health and statistics, so a reload only moves the from-addresses of
+// the backends that were added or removed
+func (r *router) setBackends(descs []string) error {
+	bs := map[string]*backend{}
+	for _, d := range descs {
+		if _, ok := bs[d]; ok {
+			return fmt.Errorf("the backend %q is given more than once", d)
+		}
+		b, e := parseBackend(d)
+		if e != nil {
+			return e
+		}
+		bs[d] = b
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, d := range descs {
+		if old, ok := r.backends[d]; ok {
+			old.reloaded(bs[d])
+			bs[d] = old
+		} else if len(r.backends) > 0 {
+			command.Logf("Adding backend %s\n", d)
+		}
+	}
+	for _, d := range r.order {
+		if _, ok := bs[d]; !ok {
+			command.Logf("Removing backend %s\n", d)
+		}
+	}
+	r.backends = bs
+	r.order = descs
+	r.rebuildRing()
+	return nil
+}
+
+// rebuildRing puts the healthy backends on the ring. It expects the lock to be held
+func (r *router) rebuildRing() {
+	healthy := []string{}
+	for _, d := range r.order {
+		if r.backends[d].isHealthy() {
+			healthy = append(healthy, d)
+		}
+	}
+	r.ring = newHashRing(healthy, r.pointsEach)
+}
+
+func (r *router) backendFor(from string) (*backend, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	d, ok := r.ring.lookup(from)
+	if !ok {
+		return nil, false
+	}
+	return r.backends[d], true
+}
+
+// forwarding is the frames that follow each other in a connection and go to the same backend
+type forwarding struct {
+	to       *backend
+	elements []*frame.Element
+}
+
+// route groups the elements, keeping their order
+func (r *router) route(elements []*frame.Element) ([]*forwarding, error) {
+	result := []*forwarding{}
+	var last *forwarding
+	for _, pe := range elements {
+		b, ok := r.backendFor(pe.From)
+		if !ok {
+			atomic.AddUint64(&r.unrouted, uint64(len(elements)))
+			return nil, errNoHealthyBackend
+		}
+		if last == nil || last.to != b {
+			last = &forwarding{to: b}
+			result = append(result, last)
+		}
+		last.elements = append(last.elements, pe)
+	}
+	return result, nil
+}
+
+// parseData reads authenticated frames if the router is given gateway secrets, and plain frames otherwise
+func (r *router) parseData(data []byte) ([]*frame.Element, error) {
+	if r.auth != nil {
+		return frame.ParseAuthenticated(data, r.auth)
+	}
+	return frame.Parse(data)
+}
+
+// handle forwards everything read from the connection. The protocol has no way of reporting
+// errors, so when something fails the connection is closed without writing anything
+func (r *router) handle(c net.Conn) {
+	defer r.handling.Done()
+	defer c.Close()
+
+	data, e := ioutil.ReadAll(io.LimitReader(c, int64(*readLimit)))
+	if e != nil || len(data) == 0 {
+		return
+	}
+	elements, e := r.parseData(data)
+	if e != nil {
+		command.Logf("Encountered error when parsing data: %v\n", e)
+		return
+	}
+	fs, e := r.route(elements)
+	if e != nil {
+		command.Logf("Encountered error when routing: %v\n", e)
+		return
+	}
+
+	replies := []byte{}
+	for _, f := range fs {
+		res, e := f.to.forward(f.elements, time.Duration(*backendTimeout)*time.Second)
+		if e != nil {
+			command.Logf("Encountered error when forwarding to %s: %v\n", f.to.address, e)
+			return
+		}
+		replies = append(replies, res...)
+	}
+	c.Write(replies)
+}
+
+func (r *router) currentBackends() []*backend {
+	r.RLock()
+	defer r.RUnlock()
+	result := []*backend{}
+	for _, d := range r.order {
+		result = append(result, r.backends[d])
+	}
+	return result
+}
+
+// checkHealth checks all the backends at the same time, and remaps the from-addresses
+// if any of them went up or down
+func (r *router) checkHealth() {
+	bs := r.currentBackends()
+	changed := make([]bool, len(bs))
+	var wg sync.WaitGroup
+	for i, b := range bs {
+		wg.Add(1)
+		go func(i int, b *backend) {
+			defer wg.Done()
+			changed[i] = b.check(time.Duration(*healthTimeout)*time.Second, *unhealthyAfter)
+		}(i, b)
+	}
+	wg.Wait()
+
+	remap := false
+	for i, b := range bs {
+		if !changed[i] {
+			continue
+		}
+		remap = true
+		if b.isHealthy() {
+			command.Logf("Backend %s is healthy again, giving it back its from-addresses\n", b.address)
+		} else {
+			command.Logf("Backend %s is unhealthy, moving its from-addresses to the other backends\n", b.address)
+		}
+	}
+	if remap {
+		r.Lock()
+		r.rebuildRing()
+		r.Unlock()
+	}
+}
+
+func (r *router) keepCheckingHealth(interval time.Duration) {
+	r.stopHealth = make(chan bool)
+	r.healthStopped = make(chan bool)
+	go func() {
+		defer close(r.healthStopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				r.checkHealth()
+			case <-r.stopHealth:
+				return
+			}
+		}
+	}()
+}
+
+func (r *router) stopCheckingHealth() {
+	if r.stopHealth != nil {
+		close(r.stopHealth)
+		<-r.healthStopped
+		r.stopHealth = nil
+	}
+}
+
+func (r *router) stats() []*backendStats {
+	r.RLock()
+	shares := r.ring.shares()
+	r.RUnlock()
+	result := []*backendStats{}
+	for _, b := range r.currentBackends() {
+		result = append(result, b.stats(shares[b.address]))
+	}
+	return result
+}
+
+func (r *router) healthyBackends() int {
+	count := 0
+	for _, b := range r.currentBackends() {
+		if b.isHealthy() {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *router) listen() error {
+	l, e := net.Listen("tcp", net.JoinHostPort(*listenIP, fmt.Sprintf("%d", *listenPort)))
+	if e != nil {
+		return e
+	}
+	r.listenerLock.Lock()
+	r.listener = l
+	r.listenerLock.Unlock()
+	return nil
+}
+
+// addr returns the address the router listens to, or nil if it isn't listening yet
+func (r *router) addr() net.Addr {
+	r.listenerLock.Lock()
+	defer r.listenerLock.Unlock()
+	if r.listener == nil {
+		return nil
+	}
+	return r.listener.Addr()
+}
+
+// serve accepts connections until shutdown is requested
+func (r *router) serve() error {
+	r.listenerLock.Lock()
+	l := r.listener.(*net.TCPListener)
+	r.listenerLock.Unlock()
+	defer l.Close()
+
+	for atomic.LoadInt32(&r.finishRequested) == 0 {
+		l.SetDeadline(time.Now().Add(time.Duration(100) * time.Millisecond))
+		conn, err := l.Accept()
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(time.Duration(*connectionTimeout) * time.Second))
+			r.handling.Add(1)
+			go r.handle(conn)
+		} else if te, ok := err.(net.Error); !ok || !te.Timeout() {
+			return err
+		}
+	}
+	return nil
+}
+
+// reload reads the gateway secrets, the backends and the files named in their options again
+func (r *router) reload() {
+	if r.auth != nil {
+		if e := r.auth.Reload(); e != nil {
+			command.Logf("Encountered error when reloading gateway secrets, keeping the old secrets: %v\n", e)
+		} else {
+			command.Logf("Reloaded gateway secrets\n")
+		}
+	}
+
+	descs, e := configuredBackends()
+	if e == nil {
+		e = r.setBackends(descs)
+	}
+	if e != nil {
+		command.Logf("Encountered error when reloading backends, keeping the old backends: %v\n", e)
+		return
+	}
+	command.Logf("Reloaded backends\n")
+}
+
+// shutdown makes run stop accepting connections and return, once the ones in progress are finished
+func (r *router) shutdown() {
+	command.Logf("Shutting down router...\n")
+	atomic.StoreInt32(&r.finishRequested, 1)
+}
+
+// run serves the connections until shutdown is requested, checking the backends in the meantime
+func (r *router) run() error {
+	if e := r.listen(); e != nil {
+		return fmt.Errorf("encountered error when running listener: %v", e)
+	}
+	command.Logf("Starting router on %s, forwarding to %s...\n", r.addr(), strings.Join(r.order, ", "))
+	if e := r.startAdmin(); e != nil {
+		r.listener.Close()
+		return e
+	}
+	r.checkHealth()
+	r.keepCheckingHealth(time.Duration(*healthInterval) * time.Second)
+
+	e := r.serve()
+	r.handling.Wait()
+	r.stopCheckingHealth()
+	r.stopAdmin()
+	if e != nil {
+		return fmt.Errorf("encountered error when running listener: %v", e)
+	}
+	return nil
+}
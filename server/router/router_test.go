@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+	"github.com/otrv4/otrng-prekey-server/server/internal/frame"
+)
+
+// fakeBackend answers every frame with a packet naming itself and the from-address.
+// If it has an authenticator, it only answers authenticated frames
+type fakeBackend struct {
+	name string
+	l    net.Listener
+	auth *frame.Authenticator
+}
+
+func startFakeBackend(c *C, name string) *fakeBackend {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(e, IsNil)
+	return serveFakeBackend(&fakeBackend{name: name, l: l})
+}
+
+func serveFakeBackend(fb *fakeBackend) *fakeBackend {
+	go func() {
+		for {
+			conn, e := fb.l.Accept()
+			if e != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				parse := frame.Parse
+				if fb.auth != nil {
+					parse = func(d []byte) ([]*frame.Element, error) { return frame.ParseAuthenticated(d, fb.auth) }
+				}
+				elements, _ := parse(data)
+				for _, pe := range elements {
+					reply := fb.name + ":" + pe.From
+					conn.Write(append([]byte{byte(len(reply) >> 8), byte(len(reply))}, reply...))
+				}
+			}(conn)
+		}
+	}()
+	return fb
+}
+
+func (fb *fakeBackend) address() string {
+	return "tcp:" + fb.l.Addr().String()
+}
+
+func startFakeBackends(c *C, names ...string) ([]*fakeBackend, []string) {
+	fbs := []*fakeBackend{}
+	descs := []string{}
+	for _, n := range names {
+		fb := startFakeBackend(c, n)
+		fbs = append(fbs, fb)
+		descs = append(descs, fb.address())
+	}
+	return fbs, descs
+}
+
+// withFlags restores the flags to their current values when the returned function is called
+func withFlags() func() {
+	ip, port, admin, file := *listenIP, *listenPort, *adminAddress, *backendsFile
+	after := *unhealthyAfter
+	return func() {
+		*listenIP, *listenPort, *adminAddress, *backendsFile = ip, port, admin, file
+		*unhealthyAfter = after
+	}
+}
+
+// exchange sends the data to the router as a client would
+func exchange(c *C, addr net.Addr, data []byte) []byte {
+	conn, e := net.Dial("tcp", addr.String())
+	c.Assert(e, IsNil)
+	defer conn.Close()
+	conn.Write(data)
+	conn.(*net.TCPConn).CloseWrite()
+	res, e := ioutil.ReadAll(conn)
+	c.Assert(e, IsNil)
+	return res
+}
+
+func packets(d []byte) []string {
+	result := []string{}
+	for len(d) >= 2 {
+		l := int(d[0])<<8 | int(d[1])
+		result = append(result, string(d[2:2+l]))
+		d = d[2+l:]
+	}
+	return result
+}
+
+func startRouter(c *C, descs []string) (*router, chan error) {
+	*listenIP = "127.0.0.1"
+	*listenPort = 0
+	r := newRouter(160)
+	c.Assert(r.setBackends(descs), IsNil)
+	done := make(chan error, 1)
+	go func() { done <- r.run() }()
+	for r.addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	return r, done
+}
+
+func (s *RouterSuite) Test_router_sendsEveryFromAddressToOneBackendAndKeepsTheOrderOfTheReplies(c *C) {
+	defer withFlags()()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	fbs, descs := startFakeBackends(c, "one", "two", "three")
+	for _, fb := range fbs {
+		defer fb.l.Close()
+	}
+	r, done := startRouter(c, descs)
+
+	froms := []string{"sita@example.org", "rama@example.org", "sita@example.org", "lakshmana@example.org", "hanuman@example.org"}
+	data := []byte{}
+	for _, f := range froms {
+		data = append(data, encodeFrame(f, "?OTRP...")...)
+	}
+	replies := packets(exchange(c, r.addr(), data))
+	c.Assert(replies, HasLen, len(froms))
+	for i, f := range froms {
+		b, _ := r.backendFor(f)
+		c.Assert(replies[i], Matches, ".*:"+f)
+		for _, fb := range fbs {
+			if fb.address() == b.address {
+				c.Assert(replies[i], Equals, fb.name+":"+f)
+			}
+		}
+	}
+	c.Assert(packets(exchange(c, r.addr(), encodeFrame("sita@example.org", "again"))), DeepEquals, replies[:1])
+
+	messages := uint64(0)
+	for _, st := range r.stats() {
+		messages += st.Messages
+		c.Assert(st.Healthy, Equals, true)
+		c.Assert(st.HealthChecks, Equals, uint64(1))
+	}
+	c.Assert(messages, Equals, uint64(6))
+
+	r.shutdown()
+	c.Assert(<-done, IsNil)
+}
+
+func (s *RouterSuite) Test_router_closesTheConnectionWhenTheDataIsInvalidOrNoBackendIsHealthy(c *C) {
+	defer withFlags()()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	*unhealthyAfter = 1
+	fbs, descs := startFakeBackends(c, "one")
+	r, done := startRouter(c, descs)
+
+	c.Assert(exchange(c, r.addr(), []byte{0x00}), HasLen, 0)
+
+	fbs[0].l.Close()
+	r.checkHealth()
+	c.Assert(exchange(c, r.addr(), encodeFrame("sita@example.org", "one")), HasLen, 0)
+	c.Assert(r.unrouted, Equals, uint64(1))
+	c.Assert(r.stats()[0].LastError, Matches, ".*connection refused")
+
+	r.shutdown()
+	c.Assert(<-done, IsNil)
+	c.Assert(capture.finish(), Matches, "(?s).*Encountered error when parsing data: can't parse length of from element\n"+
+		".*is unhealthy, moving its from-addresses to the other backends\n"+
+		"Encountered error when routing: there is no healthy backend\n.*")
+}
+
+func (s *RouterSuite) Test_checkHealth_movesTheFromAddressesOfAnUnhealthyBackendAndGivesThemBack(c *C) {
+	defer withFlags()()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	*unhealthyAfter = 2
+	fbs, descs := startFakeBackends(c, "one", "two")
+	defer fbs[1].l.Close()
+	r := newRouter(160)
+	c.Assert(r.setBackends(descs), IsNil)
+
+	var sita string
+	for _, f := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if b, _ := r.backendFor(f + "@example.org"); b.address == descs[0] {
+			sita = f + "@example.org"
+		}
+	}
+	c.Assert(sita, Not(Equals), "")
+
+	addr := fbs[0].l.Addr().String()
+	fbs[0].l.Close()
+	r.checkHealth()
+	b, _ := r.backendFor(sita)
+	c.Assert(b.address, Equals, descs[0])
+	r.checkHealth()
+	b, _ = r.backendFor(sita)
+	c.Assert(b.address, Equals, descs[1])
+	c.Assert(r.stats()[0].Share, Equals, float64(0))
+	c.Assert(r.stats()[1].Share > 0.999999, Equals, true)
+
+	l, e := net.Listen("tcp", addr)
+	if e != nil {
+		c.Skip("the port of the stopped backend is taken: " + e.Error())
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	r.checkHealth()
+	b, _ = r.backendFor(sita)
+	c.Assert(b.address, Equals, descs[0])
+	st := r.stats()[0]
+	c.Assert(st.Healthy, Equals, true)
+	c.Assert(st.HealthChecks, Equals, uint64(3))
+	c.Assert(st.FailedHealthChecks, Equals, uint64(2))
+	c.Assert(st.LastError, Equals, "")
+}
+
+func (s *RouterSuite) Test_setBackends_keepsTheStatisticsOfTheBackendsThatStay(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+	r := newRouter(10)
+	c.Assert(r.setBackends([]string{"tcp:10.0.0.1:3242", "10.0.0.2:3242"}), IsNil)
+	r.backends["tcp:10.0.0.1:3242"].requests = 5
+
+	c.Assert(r.setBackends([]string{"tcp:10.0.0.1:3242", "unix:/run/otrng/raw.sock"}), IsNil)
+	st := r.stats()
+	c.Assert(st, HasLen, 2)
+	c.Assert(st[0].Requests, Equals, uint64(5))
+	c.Assert(st[1].Address, Equals, "unix:/run/otrng/raw.sock")
+	c.Assert(r.backends["unix:/run/otrng/raw.sock"].network, Equals, "unix")
+
+	c.Assert(r.setBackends([]string{"tcp:10.0.0.1:3242", "tcp:10.0.0.1:3242"}), ErrorMatches, `the backend "tcp:10.0.0.1:3242" is given more than once`)
+	c.Assert(r.setBackends([]string{"tcp:10.0.0.1"}), ErrorMatches, `invalid backend "tcp:10.0.0.1", expected tcp:HOST:PORT, tls:HOST:PORT or unix:/PATH`)
+	c.Assert(r.setBackends([]string{"unix:"}), ErrorMatches, `invalid backend "unix:", expected tcp:HOST:PORT, tls:HOST:PORT or unix:/PATH`)
+	c.Assert(r.stats(), HasLen, 2)
+	c.Assert(capture.finish(), Equals, "Adding backend unix:/run/otrng/raw.sock\nRemoving backend 10.0.0.2:3242\n")
+}
+
+func (s *RouterSuite) Test_reload_readsTheBackendsFileAgain(c *C) {
+	defer withFlags()()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	*backendsFile = filepath.Join(c.MkDir(), "backends")
+	c.Assert(ioutil.WriteFile(*backendsFile, []byte("# the raw servers\ntcp:10.0.0.1:3242\n\n tcp:10.0.0.2:3242\n"), 0600), IsNil)
+	descs, e := configuredBackends()
+	c.Assert(e, IsNil)
+	c.Assert(descs, DeepEquals, []string{"tcp:10.0.0.1:3242", "tcp:10.0.0.2:3242"})
+	r := newRouter(10)
+	c.Assert(r.setBackends(descs), IsNil)
+
+	c.Assert(ioutil.WriteFile(*backendsFile, []byte("tcp:10.0.0.1:3242\ntcp:10.0.0.1\n"), 0600), IsNil)
+	r.reload()
+	c.Assert(r.order, HasLen, 2)
+	c.Assert(ioutil.WriteFile(*backendsFile, []byte("tcp:10.0.0.2:3242\n"), 0600), IsNil)
+	r.reload()
+	c.Assert(r.order, DeepEquals, []string{"tcp:10.0.0.2:3242"})
+
+	c.Assert(ioutil.WriteFile(*backendsFile, []byte("# none left\n"), 0600), IsNil)
+	r.reload()
+	c.Assert(r.order, DeepEquals, []string{"tcp:10.0.0.2:3242"})
+	c.Assert(capture.finish(), Equals, "Encountered error when reloading backends, keeping the old backends: invalid backend \"tcp:10.0.0.1\", expected tcp:HOST:PORT, tls:HOST:PORT or unix:/PATH\n"+
+		"Removing backend tcp:10.0.0.1:3242\nReloaded backends\n"+
+		"Encountered error when reloading backends, keeping the old backends: no backends are given, use -backends or -backends-file\n")
+}
+
+func getJSON(c *C, addr net.Addr, path string, res interface{}) int {
+	resp, e := http.Get("http://" + addr.String() + path)
+	c.Assert(e, IsNil)
+	defer resp.Body.Close()
+	c.Assert(json.NewDecoder(resp.Body).Decode(res), IsNil)
+	return resp.StatusCode
+}
+
+func (s *RouterSuite) Test_admin_servesHealthAndStatistics(c *C) {
+	defer withFlags()()
+	capture := startStdoutCapture()
+	defer capture.restore()
+	*adminAddress = "127.0.0.1:0"
+	*unhealthyAfter = 1
+	fbs, descs := startFakeBackends(c, "one", "two")
+	defer fbs[1].l.Close()
+	r, done := startRouter(c, descs)
+	exchange(c, r.addr(), encodeFrame("sita@example.org", "one"))
+
+	admin := r.currentAdminAddr()
+	health := &command.HealthResponse{}
+	c.Assert(getJSON(c, admin, "/healthz", health), Equals, http.StatusOK)
+	c.Assert(health.Status, Equals, "alive")
+	c.Assert(getJSON(c, admin, "/readyz", health), Equals, http.StatusOK)
+	c.Assert(health.Status, Equals, "ready")
+
+	stats := &statsResponse{}
+	c.Assert(getJSON(c, admin, "/stats", stats), Equals, http.StatusOK)
+	c.Assert(stats.Backends, HasLen, 2)
+	c.Assert(stats.Backends[0].Address, Equals, descs[0])
+	c.Assert(stats.Backends[0].Requests+stats.Backends[1].Requests, Equals, uint64(1))
+	c.Assert(stats.Backends[0].LastChecked, NotNil)
+
+	fbs[0].l.Close()
+	fbs[1].l.Close()
+	r.checkHealth()
+	health = &command.HealthResponse{}
+	c.Assert(getJSON(c, admin, "/readyz", health), Equals, http.StatusServiceUnavailable)
+	c.Assert(health.Checks[1].Error, Equals, "there is no healthy backend")
+
+	resp, _ := http.Post("http://"+admin.String()+"/stats", "text/plain", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+	resp.Body.Close()
+
+	r.shutdown()
+	c.Assert(<-done, IsNil)
+	c.Assert(r.currentAdminAddr(), IsNil)
+}
+
+func (s *RouterSuite) Test_run_reportsWhenItCantListen(c *C) {
+	defer withFlags()()
+	*listenIP = "256.0.0.1"
+	r := newRouter(10)
+	c.Assert(r.run(), ErrorMatches, "encountered error when running listener: .*")
+}
@@ -0,0 +1,21 @@
+package main
+
+import "flag"
+
+// These flags represent all the available command line flags
+var (
+	componentAddress     = flag.String("component-address", "localhost", "Address of the XMPP server to connect to")
+	componentPort        = flag.Uint("component-port", 5347, "Port of the XMPP server to connect to, for external components")
+	componentJID         = flag.String("component-jid", "prekeys.example.org", "The JID of the component, as configured in the XMPP server")
+	componentSecretFile  = flag.String("component-secret-file", "component-secret.asc", "File containing the secret shared with the XMPP server for this component")
+	componentName        = flag.String("component-name", "OTRv4 prekey server", "The name of the component, given in service discovery")
+	keyFile              = flag.String("key-file", "xmpp-server.keys", "Location of file where server long term keys should be stored and loaded")
+	storageEngine        = flag.String("storage", "in-memory", "What storage engine to use: 'in-memory', 'in-memory:snapshot=/PATH/FILE[,interval=5m]', 'dir:/PATH/HERE', 'redis:address=HOST:PORT[,db=0][,prefix=otrng-prekeys][,password-file=/PATH/FILE][,timeout=5s]', 'sharded:key-file=/PATH/FILE[,rebalance=true];STORAGE;STORAGE...' or 'cached:[entries=10000][,ttl=1m];STORAGE' are the choices available")
+	serverIdentity       = flag.String("identity", "", "The identity of the server. Empty means the JID of the component")
+	fragLen              = flag.Uint("fragmentation-length", 0, "Fragmentation length - 0 means no fragmenting")
+	sessionTimeout       = flag.Uint("session-timeout", 5, "Session timeout, in minutes")
+	fragmentationTimeout = flag.Uint("fragmentation-timeout", 5, "Fragment timeout, in minutes")
+	maxConcurrent        = flag.Uint("max-concurrent", 100, "The maximum number of messages handled at the same time - messages beyond that are answered with an error. 0 means no limit")
+	reconnectMax         = flag.Uint("reconnect-max", 60, "The maximum time to wait before reconnecting to the XMPP server, in seconds")
+	logFile              = flag.String("log-file", "", "File to write log messages to. Empty means standard out")
+)
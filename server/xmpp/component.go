@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"sync"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/adapter"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// The component handles three kinds of stanzas:
+// - messages with a body are given to the prekey server, using the bare JID of the sender as the
+//   from-address, and each message returned is sent back to the sender as a separate message.
+//   Messages of type error are ignored, so that we never end up in a loop with another entity.
+//   At most max-concurrent messages are handled at the same time, and the ones beyond that are
+//   answered with a resource-constraint error, so the sender can try again later.
+// - disco#info and disco#items queries are answered, so clients can find the prekey server among
+//   the services of their XMPP server.
+// - pings are answered. All other queries get a service-unavailable error, as required by RFC 6120.
+
+const (
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+	nsPing       = "urn:xmpp:ping"
+	nsStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+)
+
+type component struct {
+	s          pks.Server
+	jid        string
+	name       string
+	handling   sync.WaitGroup
+	runner     *adapter.Runner
+	runnerOnce sync.Once
+}
+
+type incomingMessage struct {
+	From string `xml:"from,attr"`
+	To   string `xml:"to,attr"`
+	Type string `xml:"type,attr"`
+	Body string `xml:"body"`
+}
+
+type outgoingMessage struct {
+	XMLName xml.Name `xml:"message"`
+	From    string   `xml:"from,attr"`
+	To      string   `xml:"to,attr"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Body    string   `xml:"body,omitempty"`
+	Error   *stanzaError
+}
+
+type iqPayload struct {
+	XMLName xml.Name
+}
+
+type incomingIQ struct {
+	From    string     `xml:"from,attr"`
+	To      string     `xml:"to,attr"`
+	ID      string     `xml:"id,attr"`
+	Type    string     `xml:"type,attr"`
+	Payload *iqPayload `xml:",any"`
+}
+
+type discoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Name     string `xml:"name,attr"`
+}
+
+type discoFeature struct {
+	Var string `xml:"var,attr"`
+}
+
+type discoInfo struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Identities []discoIdentity `xml:"identity"`
+	Features   []discoFeature  `xml:"feature"`
+}
+
+type discoItems struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/disco#items query"`
+}
+
+type serviceUnavailable struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-stanzas service-unavailable"`
+}
+
+type resourceConstraint struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-stanzas resource-constraint"`
+}
+
+type stanzaError struct {
+	XMLName   xml.Name `xml:"error"`
+	Type      string   `xml:"type,attr"`
+	Condition interface{}
+}
+
+type outgoingIQ struct {
+	XMLName xml.Name `xml:"iq"`
+	From    string   `xml:"from,attr"`
+	To      string   `xml:"to,attr"`
+	ID      string   `xml:"id,attr"`
+	Type    string   `xml:"type,attr"`
+	Payload interface{}
+	Error   *stanzaError
+}
+
+// bareJID removes the resource, and lowercases the rest so the same user always gets the same
+// from-address. Localparts and domains are compared without case in XMPP
+func bareJID(jid string) string {
+	if ix := strings.Index(jid, "/"); ix != -1 {
+		jid = jid[:ix]
+	}
+	return strings.ToLower(jid)
+}
+
+// serve handles all stanzas on the stream until it's closed, or an error happens
+func (c *component) serve(st *stream) error {
+	for {
+		se, e := st.next()
+		if e != nil {
+			return e
+		}
+		switch {
+		case se.Name.Space == nsStreams && se.Name.Local == "error":
+			return st.readError(se)
+		case se.Name.Local == "message":
+			m := &incomingMessage{}
+			if e := st.dec.DecodeElement(m, se); e != nil {
+				return e
+			}
+			c.handleMessage(st, m)
+		case se.Name.Local == "iq":
+			iq := &incomingIQ{}
+			if e := st.dec.DecodeElement(iq, se); e != nil {
+				return e
+			}
+			c.handleIQ(st, iq)
+		default:
+			if e := st.dec.Skip(); e != nil {
+				return e
+			}
+		}
+	}
+}
+
+func (c *component) ourJID(to string) string {
+	if to != "" {
+		return to
+	}
+	return c.jid
+}
+
+func (c *component) handleMessage(st *stream, m *incomingMessage) {
+	body := strings.TrimSpace(m.Body)
+	if m.Type == "error" || body == "" || m.From == "" {
+		return
+	}
+
+	c.handling.Add(1)
+	c.requestRunner().Dispatch(&messageRequest{c: c, st: st, m: m, from: bareJID(m.From), body: body})
+}
+
+// requestRunner returns the runner handling the messages, creating it the first time
+func (c *component) requestRunner() *adapter.Runner {
+	c.runnerOnce.Do(func() {
+		c.runner = &adapter.Runner{
+			Server:        c.s,
+			MaxConcurrent: int(*maxConcurrent),
+		}
+	})
+	return c.runner
+}
+
+// messageRequest is one message with a body. Errors are logged here instead of by the runner,
+// and refused messages aren't logged at all, since anyone can send as many as they want
+type messageRequest struct {
+	c    *component
+	st   *stream
+	m    *incomingMessage
+	from string
+	body string
+}
+
+func (r *messageRequest) Envelopes() ([]*adapter.Envelope, error) {
+	return []*adapter.Envelope{&adapter.Envelope{From: r.from, Message: r.body}}, nil
+}
+
+func (r *messageRequest) Reply(replies [][]string) error {
+	for _, rr := range replies {
+		for _, res := range rr {
+			if e := r.st.send(&outgoingMessage{From: r.c.ourJID(r.m.To), To: r.m.From, Type: r.m.Type, Body: res}); e != nil {
+				command.Logf("Encountered error when sending message to %s: %v\n", r.m.From, e)
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (r *messageRequest) Fail(e *adapter.Error) {
+	if e.Kind != adapter.Overloaded {
+		command.Logf("Encountered error when handling message from %s: %v\n", r.from, e.Err)
+		return
+	}
+	res := &outgoingMessage{From: r.c.ourJID(r.m.To), To: r.m.From, Type: "error", Error: &stanzaError{Type: "wait", Condition: resourceConstraint{}}}
+	if e := r.st.send(res); e != nil {
+		command.Logf("Encountered error when sending message to %s: %v\n", r.m.From, e)
+	}
+}
+
+func (r *messageRequest) Close() error {
+	r.c.handling.Done()
+	return nil
+}
+
+func (c *component) discoInfo() *discoInfo {
+	return &discoInfo{
+		Identities: []discoIdentity{
+			discoIdentity{Category: "component", Type: "generic", Name: c.name},
+		},
+		Features: []discoFeature{
+			discoFeature{Var: nsDiscoInfo},
+			discoFeature{Var: nsDiscoItems},
+			discoFeature{Var: nsPing},
+		},
+	}
+}
+
+func (c *component) handleIQ(st *stream, iq *incomingIQ) {
+	if iq.Type != "get" && iq.Type != "set" {
+		return
+	}
+
+	res := &outgoingIQ{From: c.ourJID(iq.To), To: iq.From, ID: iq.ID, Type: "result"}
+	switch {
+	case iq.Type == "get" && iq.Payload != nil && iq.Payload.XMLName.Space == nsDiscoInfo:
+		res.Payload = c.discoInfo()
+	case iq.Type == "get" && iq.Payload != nil && iq.Payload.XMLName.Space == nsDiscoItems:
+		res.Payload = &discoItems{}
+	case iq.Type == "get" && iq.Payload != nil && iq.Payload.XMLName.Space == nsPing:
+	default:
+		res.Type = "error"
+		res.Error = &stanzaError{Type: "cancel", Condition: serviceUnavailable{}}
+	}
+
+	if e := st.send(res); e != nil {
+		command.Logf("Encountered error when answering query from %s: %v\n", iq.From, e)
+	}
+}
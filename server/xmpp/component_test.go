@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type XMPPServerSuite struct{}
+
+var _ = Suite(&XMPPServerSuite{})
+
+type mockServer struct {
+	sync.Mutex
+	receivedFrom []string
+	receivedData []string
+	returnData   []string
+	returnError  error
+}
+
+func (ms *mockServer) Handle(from, message string) ([]string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.receivedFrom = append(ms.receivedFrom, from)
+	ms.receivedData = append(ms.receivedData, message)
+	return ms.returnData, ms.returnError
+}
+
+type stdoutCapture struct {
+	old  *os.File
+	outC chan string
+	r, w *os.File
+}
+
+func startStdoutCapture() *stdoutCapture {
+	s := &stdoutCapture{}
+
+	s.old = os.Stdout
+	s.r, s.w, _ = os.Pipe()
+	os.Stdout = s.w
+	s.outC = make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, s.r)
+		s.outC <- buf.String()
+	}()
+
+	return s
+}
+
+func (s *stdoutCapture) finish() string {
+	s.w.Close()
+	return <-s.outC
+}
+
+func (s *stdoutCapture) restore() {
+	s.w.Close()
+	os.Stdout = s.old
+}
+
+// connectedComponent starts serving a component connected to the fake server
+func connectedComponent(c *C, ms *mockServer) (*fakeXMPPServer, *fakeConnection, *component, chan error) {
+	fs := startFakeXMPPServer("s3cr3t")
+	comp := &component{s: ms, jid: "prekeys.example.org", name: "OTRv4 prekey server"}
+	st, e := comp.connect(fs.addr(), "s3cr3t")
+	c.Assert(e, IsNil)
+	fc := fs.nextConnection()
+	c.Assert(fc, NotNil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- comp.serve(st)
+	}()
+	return fs, fc, comp, done
+}
+
+func (s *XMPPServerSuite) Test_handshakeDigest_isTheHexOfTheSHA1OfIDAndSecret(c *C) {
+	c.Assert(handshakeDigest("3BF96D32", "s3cr3t"), Equals, "ba33290100f616a33656a931798d6c9011cfa840")
+}
+
+func (s *XMPPServerSuite) Test_bareJID_removesTheResource(c *C) {
+	c.Assert(bareJID("sita@example.org/phone/1"), Equals, "sita@example.org")
+	c.Assert(bareJID("sita@example.org"), Equals, "sita@example.org")
+	c.Assert(bareJID("Sita@Example.ORG/Phone"), Equals, "sita@example.org")
+}
+
+func (s *XMPPServerSuite) Test_openStream_authenticatesWithTheServer(c *C) {
+	fs := startFakeXMPPServer("s3cr3t")
+	defer fs.stop()
+
+	conn, _ := net.Dial("tcp", fs.addr())
+	st, e := openStream(conn, "prekeys.example.org", "s3cr3t")
+	c.Assert(e, IsNil)
+	defer st.close()
+	fc := fs.nextConnection()
+	c.Assert(fc, NotNil)
+	c.Assert(fc.to, Equals, "prekeys.example.org")
+}
+
+func (s *XMPPServerSuite) Test_openStream_returnsErrorWhenTheHandshakeIsRefused(c *C) {
+	fs := startFakeXMPPServer("s3cr3t")
+	defer fs.stop()
+
+	conn, _ := net.Dial("tcp", fs.addr())
+	defer conn.Close()
+	_, e := openStream(conn, "prekeys.example.org", "wrong")
+	c.Assert(e, ErrorMatches, "the XMPP server refused the handshake: not-authorized")
+}
+
+func (s *XMPPServerSuite) Test_openStream_returnsErrorWithoutStreamID(c *C) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go func() {
+		conn, _ := l.Accept()
+		conn.Write([]byte("<stream:stream xmlns:stream='http://etherx.jabber.org/streams' xmlns='jabber:component:accept'>"))
+		time.Sleep(time.Duration(100) * time.Millisecond)
+		conn.Close()
+	}()
+
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	defer conn.Close()
+	_, e := openStream(conn, "prekeys.example.org", "s3cr3t")
+	c.Assert(e, ErrorMatches, "the XMPP server didn't give a stream ID")
+}
+
+func (s *XMPPServerSuite) Test_serve_handsMessagesToTheServerAndSendsBackEachResult(c *C) {
+	ms := &mockServer{returnData: []string{"?OTRP|1|2|3,1,2,abc,", "?OTRP|1|2|3,2,2,def,"}}
+	fs, fc, _, _ := connectedComponent(c, ms)
+	defer fs.stop()
+
+	fc.send("<message from='sita@example.org/phone' to='prekeys.example.org' type='chat'><body>AAQ1.</body></message>")
+
+	m1 := fc.next()
+	c.Assert(m1, NotNil)
+	c.Assert(m1.XMLName.Local, Equals, "message")
+	c.Assert(m1.From, Equals, "prekeys.example.org")
+	c.Assert(m1.To, Equals, "sita@example.org/phone")
+	c.Assert(m1.Type, Equals, "chat")
+	c.Assert(m1.Body, Equals, "?OTRP|1|2|3,1,2,abc,")
+	m2 := fc.next()
+	c.Assert(m2, NotNil)
+	c.Assert(m2.Body, Equals, "?OTRP|1|2|3,2,2,def,")
+
+	ms.Lock()
+	defer ms.Unlock()
+	c.Assert(ms.receivedFrom, DeepEquals, []string{"sita@example.org"})
+	c.Assert(ms.receivedData, DeepEquals, []string{"AAQ1."})
+}
+
+func (s *XMPPServerSuite) Test_serve_ignoresErrorMessagesAndMessagesWithoutBody(c *C) {
+	ms := &mockServer{returnData: []string{"answer"}}
+	fs, fc, _, _ := connectedComponent(c, ms)
+	defer fs.stop()
+
+	fc.send("<message from='sita@example.org/phone' type='error'><body>AAQ1.</body></message>")
+	fc.send("<message from='sita@example.org/phone'><composing xmlns='http://jabber.org/protocol/chatstates'/></message>")
+	fc.send("<presence from='sita@example.org/phone'/>")
+	fc.send("<message from='rama@example.org/laptop'><body>AAQ2.</body></message>")
+
+	m := fc.next()
+	c.Assert(m, NotNil)
+	c.Assert(m.To, Equals, "rama@example.org/laptop")
+	c.Assert(m.Type, Equals, "")
+
+	ms.Lock()
+	defer ms.Unlock()
+	c.Assert(ms.receivedFrom, DeepEquals, []string{"rama@example.org"})
+}
+
+func (s *XMPPServerSuite) Test_serve_logsErrorsFromTheServer(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+
+	ms := &mockServer{returnError: errors.New("invalid message format")}
+	fs, fc, comp, _ := connectedComponent(c, ms)
+	defer fs.stop()
+
+	fc.send("<message from='sita@example.org/phone'><body>AAQ1.</body></message>")
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	comp.handling.Wait()
+	c.Assert(capture.finish(), Equals, "Encountered error when handling message from sita@example.org: invalid message format\n")
+}
+
+// blockingServer doesn't answer until it's released
+type blockingServer struct {
+	started chan bool
+	release chan bool
+}
+
+func (bs *blockingServer) Handle(from, message string) ([]string, error) {
+	bs.started <- true
+	<-bs.release
+	return []string{"answer"}, nil
+}
+
+func (s *XMPPServerSuite) Test_serve_refusesMessagesBeyondTheLimit(c *C) {
+	old := *maxConcurrent
+	defer func() { *maxConcurrent = old }()
+	*maxConcurrent = 1
+
+	fs := startFakeXMPPServer("s3cr3t")
+	defer fs.stop()
+	bs := &blockingServer{started: make(chan bool, 1), release: make(chan bool)}
+	comp := &component{s: bs, jid: "prekeys.example.org"}
+	st, e := comp.connect(fs.addr(), "s3cr3t")
+	c.Assert(e, IsNil)
+	fc := fs.nextConnection()
+	c.Assert(fc, NotNil)
+	go comp.serve(st)
+
+	fc.send("<message from='sita@example.org/phone'><body>AAQ1.</body></message>")
+	<-bs.started
+	fc.send("<message from='rama@example.org/laptop'><body>AAQ2.</body></message>")
+	m := fc.next()
+	c.Assert(m, NotNil)
+	c.Assert(m.To, Equals, "rama@example.org/laptop")
+	c.Assert(m.Type, Equals, "error")
+	c.Assert(m.Inner, Matches, `.*<error type="wait"><resource-constraint xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></resource-constraint></error>.*`)
+
+	close(bs.release)
+	m = fc.next()
+	c.Assert(m, NotNil)
+	c.Assert(m.To, Equals, "sita@example.org/phone")
+	c.Assert(m.Body, Equals, "answer")
+	comp.handling.Wait()
+}
+
+func (s *XMPPServerSuite) Test_serveUntil_stopsReadingBeforeWaitingForTheMessagesInProgress(c *C) {
+	fs := startFakeXMPPServer("s3cr3t")
+	defer fs.stop()
+	bs := &blockingServer{started: make(chan bool, 2), release: make(chan bool)}
+	comp := &component{s: bs, jid: "prekeys.example.org"}
+	st, e := comp.connect(fs.addr(), "s3cr3t")
+	c.Assert(e, IsNil)
+	fc := fs.nextConnection()
+	c.Assert(fc, NotNil)
+
+	stop := make(chan bool)
+	finished := make(chan error, 1)
+	go func() {
+		finished <- comp.serveUntil(st, stop)
+	}()
+
+	fc.send("<message from='sita@example.org/phone'><body>AAQ1.</body></message>")
+	<-bs.started
+	close(stop)
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	fc.send("<message from='rama@example.org/laptop'><body>AAQ2.</body></message>")
+	close(bs.release)
+
+	m := fc.next()
+	c.Assert(m, NotNil)
+	c.Assert(m.To, Equals, "sita@example.org/phone")
+	c.Assert(m.Body, Equals, "answer")
+	c.Assert(<-finished, IsNil)
+	c.Assert(fc.next(), IsNil)
+	c.Assert(bs.started, HasLen, 0)
+}
+
+func (s *XMPPServerSuite) Test_serve_answersDiscoInfo(c *C) {
+	fs, fc, _, _ := connectedComponent(c, &mockServer{})
+	defer fs.stop()
+
+	fc.send("<iq from='sita@example.org/phone' to='prekeys.example.org' id='d1' type='get'><query xmlns='http://jabber.org/protocol/disco#info'/></iq>")
+	iq := fc.next()
+	c.Assert(iq, NotNil)
+	c.Assert(iq.XMLName.Local, Equals, "iq")
+	c.Assert(iq.Type, Equals, "result")
+	c.Assert(iq.ID, Equals, "d1")
+	c.Assert(iq.To, Equals, "sita@example.org/phone")
+	c.Assert(iq.From, Equals, "prekeys.example.org")
+	c.Assert(iq.Inner, Equals, `<query xmlns="http://jabber.org/protocol/disco#info">`+
+		`<identity category="component" type="generic" name="OTRv4 prekey server"></identity>`+
+		`<feature var="http://jabber.org/protocol/disco#info"></feature>`+
+		`<feature var="http://jabber.org/protocol/disco#items"></feature>`+
+		`<feature var="urn:xmpp:ping"></feature></query>`)
+}
+
+func (s *XMPPServerSuite) Test_serve_answersDiscoItemsAndPings(c *C) {
+	fs, fc, _, _ := connectedComponent(c, &mockServer{})
+	defer fs.stop()
+
+	fc.send("<iq from='sita@example.org/phone' id='d2' type='get'><query xmlns='http://jabber.org/protocol/disco#items'/></iq>")
+	iq := fc.next()
+	c.Assert(iq, NotNil)
+	c.Assert(iq.Type, Equals, "result")
+	c.Assert(iq.Inner, Equals, `<query xmlns="http://jabber.org/protocol/disco#items"></query>`)
+
+	fc.send("<iq from='example.org' id='p1' type='get'><ping xmlns='urn:xmpp:ping'/></iq>")
+	iq = fc.next()
+	c.Assert(iq, NotNil)
+	c.Assert(iq.Type, Equals, "result")
+	c.Assert(iq.ID, Equals, "p1")
+	c.Assert(iq.Inner, Equals, "")
+}
+
+func (s *XMPPServerSuite) Test_serve_answersOtherQueriesWithAnError(c *C) {
+	fs, fc, _, _ := connectedComponent(c, &mockServer{})
+	defer fs.stop()
+
+	fc.send("<iq from='sita@example.org/phone' id='r1' type='result'/>")
+	fc.send("<iq from='sita@example.org/phone' id='v1' type='get'><query xmlns='jabber:iq:version'/></iq>")
+	iq := fc.next()
+	c.Assert(iq, NotNil)
+	c.Assert(iq.ID, Equals, "v1")
+	c.Assert(iq.Type, Equals, "error")
+	c.Assert(iq.Inner, Equals, `<error type="cancel"><service-unavailable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></service-unavailable></error>`)
+}
+
+func (s *XMPPServerSuite) Test_serve_returnsStreamErrors(c *C) {
+	fs, fc, _, done := connectedComponent(c, &mockServer{})
+	defer fs.stop()
+
+	fc.send("<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/><text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>Replaced by new connection</text></stream:error>")
+	c.Assert(<-done, ErrorMatches, "conflict \\(Replaced by new connection\\)")
+}
+
+func (s *XMPPServerSuite) Test_serve_returnsWhenTheStreamIsClosed(c *C) {
+	fs, fc, _, done := connectedComponent(c, &mockServer{})
+	defer fs.stop()
+
+	fc.close()
+	c.Assert(<-done, Equals, errStreamClosed)
+}
+
+func (s *XMPPServerSuite) Test_nextReconnectDelay_doublesUpToTheMaximum(c *C) {
+	old := *reconnectMax
+	defer func() { *reconnectMax = old }()
+	*reconnectMax = 5
+
+	c.Assert(nextReconnectDelay(time.Duration(1)*time.Second), Equals, time.Duration(2)*time.Second)
+	c.Assert(nextReconnectDelay(time.Duration(4)*time.Second), Equals, time.Duration(5)*time.Second)
+	c.Assert(nextReconnectDelay(0), Equals, minReconnectDelay)
+}
+
+func (s *XMPPServerSuite) Test_run_reconnectsWhenTheConnectionIsLost(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+	oldDelay := minReconnectDelay
+	defer func() { minReconnectDelay = oldDelay }()
+	minReconnectDelay = time.Duration(10) * time.Millisecond
+
+	fs := startFakeXMPPServer("s3cr3t")
+	defer fs.stop()
+	ms := &mockServer{returnData: []string{"answer"}}
+	comp := &component{s: ms, jid: "prekeys.example.org", name: "OTRv4 prekey server"}
+
+	stop := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		comp.run(fs.addr(), "s3cr3t", stop)
+		close(finished)
+	}()
+
+	fc := fs.nextConnection()
+	c.Assert(fc, NotNil)
+	fc.close()
+
+	fc = fs.nextConnection()
+	c.Assert(fc, NotNil)
+	fc.send("<message from='sita@example.org/phone'><body>AAQ1.</body></message>")
+	m := fc.next()
+	c.Assert(m, NotNil)
+	c.Assert(m.Body, Equals, "answer")
+
+	close(stop)
+	<-finished
+	c.Assert(fc.next(), IsNil)
+
+	out := capture.finish()
+	c.Assert(strings.Count(out, "Connected to "+fs.addr()+" as prekeys.example.org\n"), Equals, 2)
+	c.Assert(out, Matches, "(?s).*Encountered error when talking to the XMPP server, reconnecting in 10ms: the XMPP server closed the stream\n.*")
+}
+
+func (s *XMPPServerSuite) Test_run_keepsTryingWhenTheServerIsUnavailable(c *C) {
+	capture := startStdoutCapture()
+	defer capture.restore()
+	oldDelay := minReconnectDelay
+	defer func() { minReconnectDelay = oldDelay }()
+	minReconnectDelay = time.Duration(10) * time.Millisecond
+
+	fs := startFakeXMPPServer("s3cr3t")
+	defer fs.stop()
+	comp := &component{s: &mockServer{}, jid: "prekeys.example.org"}
+
+	stop := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		comp.run(fs.addr(), "wrong", stop)
+		close(finished)
+	}()
+
+	<-fs.streamIDs
+	<-fs.streamIDs
+	close(stop)
+	<-finished
+
+	c.Assert(capture.finish(), Matches, "Encountered error when talking to the XMPP server, reconnecting in 10ms: the XMPP server refused the handshake: not-authorized\n"+
+		"Encountered error when talking to the XMPP server, reconnecting in 20ms: the XMPP server refused the handshake: not-authorized\n(.|\n)*")
+}
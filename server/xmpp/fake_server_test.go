@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// fakeXMPPServer is a stand-in for the component side of an XMPP server. It accepts
+// components, checks their handshake, and hands over the authenticated connections
+// so the tests can exchange stanzas with the component.
+type fakeXMPPServer struct {
+	l         net.Listener
+	secret    string
+	streamIDs chan string
+	conns     chan *fakeConnection
+}
+
+type fakeConnection struct {
+	conn net.Conn
+	dec  *xml.Decoder
+	to   string
+}
+
+// fakeStanza is any stanza sent by the component
+type fakeStanza struct {
+	XMLName xml.Name
+	From    string `xml:"from,attr"`
+	To      string `xml:"to,attr"`
+	ID      string `xml:"id,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:"body"`
+	Inner   string `xml:",innerxml"`
+}
+
+func startFakeXMPPServer(secret string) *fakeXMPPServer {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		panic(e)
+	}
+	s := &fakeXMPPServer{
+		l:         l,
+		secret:    secret,
+		streamIDs: make(chan string, 10),
+		conns:     make(chan *fakeConnection, 10),
+	}
+	go s.acceptAll()
+	return s
+}
+
+func (s *fakeXMPPServer) addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeXMPPServer) stop() {
+	s.l.Close()
+}
+
+func (s *fakeXMPPServer) acceptAll() {
+	for ix := 1; ; ix++ {
+		conn, e := s.l.Accept()
+		if e != nil {
+			return
+		}
+		go s.handshake(conn, fmt.Sprintf("stream-%d", ix))
+	}
+}
+
+func (s *fakeXMPPServer) handshake(conn net.Conn, id string) {
+	fc := &fakeConnection{conn: conn, dec: xml.NewDecoder(conn)}
+	conn.SetDeadline(time.Now().Add(time.Duration(5) * time.Second))
+
+	for {
+		t, e := fc.dec.Token()
+		if e != nil {
+			conn.Close()
+			return
+		}
+		if st, ok := t.(xml.StartElement); ok {
+			for _, a := range st.Attr {
+				if a.Name.Local == "to" {
+					fc.to = a.Value
+				}
+			}
+			break
+		}
+	}
+	s.streamIDs <- id
+	fc.send(fmt.Sprintf("<?xml version='1.0'?><stream:stream xmlns:stream='%s' xmlns='%s' from='%s' id='%s'>", nsStreams, nsComponent, fc.to, id))
+
+	hs := struct {
+		Digest string `xml:",chardata"`
+	}{}
+	if e := fc.dec.Decode(&hs); e != nil || hs.Digest != handshakeDigest(id, s.secret) {
+		fc.send("<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>")
+		conn.Close()
+		return
+	}
+	fc.send("<handshake/>")
+	conn.SetDeadline(time.Time{})
+	s.conns <- fc
+}
+
+func (s *fakeXMPPServer) nextConnection() *fakeConnection {
+	select {
+	case fc := <-s.conns:
+		return fc
+	case <-time.After(time.Duration(5) * time.Second):
+		return nil
+	}
+}
+
+func (fc *fakeConnection) send(data string) {
+	io.WriteString(fc.conn, data)
+}
+
+// next returns the next stanza sent by the component, or nil if the stream was closed
+func (fc *fakeConnection) next() *fakeStanza {
+	fc.conn.SetReadDeadline(time.Now().Add(time.Duration(5) * time.Second))
+	for {
+		t, e := fc.dec.Token()
+		if e != nil {
+			return nil
+		}
+		switch tt := t.(type) {
+		case xml.StartElement:
+			res := &fakeStanza{}
+			if e := fc.dec.DecodeElement(res, &tt); e != nil {
+				return nil
+			}
+			return res
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+func (fc *fakeConnection) close() {
+	fc.send("</stream:stream>")
+	fc.conn.Close()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	pks "github.com/otrv4/otrng-prekey-server"
+	"github.com/otrv4/otrng-prekey-server/server/internal/command"
+)
+
+// When the connection to the XMPP server is lost, or can't be made, we try again after
+// a delay that starts at minReconnectDelay and doubles every time, up to the reconnect-max flag.
+// The delay goes back to the minimum as soon as we have authenticated successfully.
+
+var minReconnectDelay = time.Duration(1) * time.Second
+
+// keepaliveInterval is how often we send whitespace, so a dead connection is noticed
+var keepaliveInterval = time.Duration(60) * time.Second
+
+var signalHandler = make(chan os.Signal, 1)
+
+func loadSecret() (string, error) {
+	d, e := ioutil.ReadFile(*componentSecretFile)
+	if e != nil {
+		return "", e
+	}
+	s := strings.TrimSpace(string(d))
+	if s == "" {
+		return "", fmt.Errorf("%s: no secret found", *componentSecretFile)
+	}
+	return s, nil
+}
+
+func loadServer(f pks.Factory) (pks.Server, pks.Keypair, error) {
+	kp, e := command.LoadOrCreateKeypair(f, *keyFile)
+	if e != nil {
+		return nil, nil, fmt.Errorf("encountered error when loading/creating keypair: %v", e)
+	}
+	storage, e := f.LoadStorageType(*storageEngine)
+	if e != nil {
+		return nil, nil, fmt.Errorf("encountered error when creating storage engine: %v", e)
+	}
+	identity := *serverIdentity
+	if identity == "" {
+		identity = *componentJID
+	}
+	server := f.NewServer(identity,
+		kp,
+		int(*fragLen),
+		storage,
+		time.Duration(*sessionTimeout)*time.Minute,
+		time.Duration(*fragmentationTimeout)*time.Minute,
+		nil)
+	return server, kp, nil
+}
+
+func (c *component) connect(addr, secret string) (*stream, error) {
+	conn, e := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if e != nil {
+		return nil, e
+	}
+	st, e := openStream(conn, c.jid, secret)
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	return st, nil
+}
+
+// serveUntil serves the stream until it fails, or we are asked to stop. It returns nil if we were asked to stop
+func (c *component) serveUntil(st *stream, stop <-chan bool) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.serve(st)
+	}()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-done:
+			st.conn.Close()
+			return e
+		case <-keepalive.C:
+			if e := st.write(" "); e != nil {
+				st.conn.Close()
+				<-done
+				return e
+			}
+		case <-stop:
+			// Stop reading first, so no more messages are dispatched, but keep the connection
+			// open so the messages in progress can still be answered
+			st.conn.SetReadDeadline(time.Now())
+			<-done
+			c.handling.Wait()
+			st.close()
+			return nil
+		}
+	}
+}
+
+func nextReconnectDelay(d time.Duration) time.Duration {
+	max := time.Duration(*reconnectMax) * time.Second
+	d = d * 2
+	if d > max {
+		d = max
+	}
+	if d < minReconnectDelay {
+		d = minReconnectDelay
+	}
+	return d
+}
+
+// run keeps the component connected to the XMPP server until we are asked to stop
+func (c *component) run(addr, secret string, stop <-chan bool) {
+	delay := minReconnectDelay
+	for {
+		st, e := c.connect(addr, secret)
+		if e == nil {
+			command.Logf("Connected to %s as %s\n", addr, c.jid)
+			delay = minReconnectDelay
+			e = c.serveUntil(st, stop)
+			if e == nil {
+				return
+			}
+		}
+		command.Logf("Encountered error when talking to the XMPP server, reconnecting in %v: %v\n", delay, e)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		delay = nextReconnectDelay(delay)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if e := command.OpenLog(logFile); e != nil {
+		fmt.Printf("encountered error when opening log file: %v\n", e)
+		return
+	}
+
+	secret, e := loadSecret()
+	if e != nil {
+		command.Logf("encountered error when loading component secret: %v\n", e)
+		return
+	}
+
+	server, kp, e := loadServer(pks.CreateFactory(rand.Reader))
+	if e != nil {
+		command.Logf("%v\n", e)
+		return
+	}
+
+	c := &component{s: server, jid: *componentJID, name: *componentName}
+	addr := net.JoinHostPort(*componentAddress, fmt.Sprintf("%d", *componentPort))
+	command.Logf("Starting component %s, connecting to %s...\n", c.jid, addr)
+	command.Logf("%s\n", pks.FormatFingerprint(kp.Fingerprint()))
+
+	stop := make(chan bool)
+	go func() {
+		signal.Notify(signalHandler, os.Interrupt, syscall.SIGTERM)
+		<-signalHandler
+		command.Logf("Shutting down component...\n")
+		close(stop)
+	}()
+
+	c.run(addr, secret, stop)
+	if cl, ok := server.(io.Closer); ok {
+		if e := cl.Close(); e != nil {
+			command.Logf("encountered error when closing the storage: %v\n", e)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// This implements the component side of the Jabber Component Protocol (XEP-0114).
+// The component connects to the XMPP server and opens a stream in the jabber:component:accept
+// namespace, addressed to its own JID. The server answers with a stream header containing a
+// stream ID, and the component authenticates with a handshake: the lower case hex encoding of
+// the SHA-1 hash of the stream ID concatenated with the secret shared with the server.
+// After that, all stanzas addressed to the JID of the component are sent to us over the stream,
+// and we can send stanzas from it.
+
+const (
+	nsComponent = "jabber:component:accept"
+	nsStreams   = "http://etherx.jabber.org/streams"
+)
+
+var handshakeTimeout = time.Duration(30) * time.Second
+var writeTimeout = time.Duration(30) * time.Second
+
+var errStreamClosed = errors.New("the XMPP server closed the stream")
+
+type stream struct {
+	conn      net.Conn
+	dec       *xml.Decoder
+	writeLock sync.Mutex
+}
+
+type streamErrorCondition struct {
+	XMLName xml.Name
+}
+
+type streamError struct {
+	Text       string                 `xml:"text"`
+	Conditions []streamErrorCondition `xml:",any"`
+}
+
+func (se *streamError) Error() string {
+	result := "unknown error"
+	for _, c := range se.Conditions {
+		if c.XMLName.Local != "text" {
+			result = c.XMLName.Local
+			break
+		}
+	}
+	if se.Text != "" {
+		result = fmt.Sprintf("%s (%s)", result, se.Text)
+	}
+	return result
+}
+
+func handshakeDigest(id, secret string) string {
+	h := sha1.Sum([]byte(id + secret))
+	return hex.EncodeToString(h[:])
+}
+
+func escapeAttr(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// openStream opens a stream on the connection and authenticates as the component
+func openStream(conn net.Conn, jid, secret string) (*stream, error) {
+	s := &stream{conn: conn, dec: xml.NewDecoder(conn)}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream xmlns='%s' xmlns:stream='%s' to='%s'>", nsComponent, nsStreams, escapeAttr(jid))
+	if e := s.write(header); e != nil {
+		return nil, e
+	}
+	id, e := s.readHeader()
+	if e != nil {
+		return nil, e
+	}
+	if e := s.write("<handshake>" + handshakeDigest(id, secret) + "</handshake>"); e != nil {
+		return nil, e
+	}
+
+	se, e := s.next()
+	if e != nil {
+		return nil, e
+	}
+	if se.Name.Space == nsStreams && se.Name.Local == "error" {
+		return nil, fmt.Errorf("the XMPP server refused the handshake: %v", s.readError(se))
+	}
+	if se.Name.Local != "handshake" {
+		return nil, fmt.Errorf("unexpected answer to the handshake: %s", se.Name.Local)
+	}
+	if e := s.dec.Skip(); e != nil {
+		return nil, e
+	}
+
+	conn.SetDeadline(time.Time{})
+	return s, nil
+}
+
+func (s *stream) readHeader() (string, error) {
+	for {
+		t, e := s.dec.Token()
+		if e != nil {
+			return "", e
+		}
+		st, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if st.Name.Space != nsStreams || st.Name.Local != "stream" {
+			return "", fmt.Errorf("unexpected stream header: %s", st.Name.Local)
+		}
+		for _, a := range st.Attr {
+			if a.Name.Local == "id" && a.Value != "" {
+				return a.Value, nil
+			}
+		}
+		return "", errors.New("the XMPP server didn't give a stream ID")
+	}
+}
+
+// next returns the start of the next top level element in the stream
+func (s *stream) next() (*xml.StartElement, error) {
+	for {
+		t, e := s.dec.Token()
+		if e == io.EOF {
+			return nil, errStreamClosed
+		}
+		if e != nil {
+			return nil, e
+		}
+		switch tt := t.(type) {
+		case xml.StartElement:
+			return &tt, nil
+		case xml.EndElement:
+			return nil, errStreamClosed
+		}
+	}
+}
+
+// readError reads a stream error, after its start element has been returned by next
+func (s *stream) readError(se *xml.StartElement) error {
+	res := &streamError{}
+	if e := s.dec.DecodeElement(res, se); e != nil {
+		return e
+	}
+	return res
+}
+
+func (s *stream) write(data string) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, e := io.WriteString(s.conn, data)
+	return e
+}
+
+func (s *stream) send(v interface{}) error {
+	d, e := xml.Marshal(v)
+	if e != nil {
+		return e
+	}
+	return s.write(string(d))
+}
+
+// close ends the stream and closes the connection
+func (s *stream) close() {
+	s.write("</stream:stream>")
+	s.conn.Close()
+}
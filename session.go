@@ -14,7 +14,9 @@ type sessionManager struct {
 }
 
 type session interface {
-	save(*gotrx.Keypair, ed448.Point, uint32, *gotrx.ClientProfile)
+	save(*gotrx.Keypair, ed448.Point, uint32, *gotrx.ClientProfile) error
+	// loadError returns why the session couldn't be loaded, for sessions that are kept outside of the process
+	loadError() error
 	instanceTag() uint32
 	macKey() []byte
 	sharedSecret() []byte
@@ -40,7 +42,7 @@ func (s *realSession) touch() {
 	s.lastTouched = time.Now()
 }
 
-func (s *realSession) save(kp *gotrx.Keypair, i ed448.Point, tag uint32, cp *gotrx.ClientProfile) {
+func (s *realSession) save(kp *gotrx.Keypair, i ed448.Point, tag uint32, cp *gotrx.ClientProfile) error {
 	s.Lock()
 	defer s.Unlock()
 
@@ -49,6 +51,11 @@ func (s *realSession) save(kp *gotrx.Keypair, i ed448.Point, tag uint32, cp *got
 	s.i = i
 	s.tag = tag
 	s.cp = cp
+	return nil
+}
+
+func (s *realSession) loadError() error {
+	return nil
 }
 
 func (s *realSession) instanceTag() uint32 {
@@ -160,3 +167,9 @@ func (sm *sessionManager) cleanup(timeout time.Duration) {
 		delete(sm.s, nm)
 	}
 }
+
+func (sm *sessionManager) size() int {
+	sm.RLock()
+	defer sm.RUnlock()
+	return len(sm.s)
+}
@@ -0,0 +1,189 @@
+package prekeyserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/otrv4/gotrx"
+)
+
+// SessionHandoff is implemented by servers that can hand over the DAKE sessions
+// in progress to another server process, for example when restarting.
+type SessionHandoff interface {
+	// ActiveSessions returns the number of sessions in progress
+	ActiveSessions() int
+	// ExportSessions writes all sessions in progress, returning how many were written
+	ExportSessions(w io.Writer) (int, error)
+	// ImportSessions reads sessions written by ExportSessions, skipping the ones that
+	// have expired, and returns how many were imported
+	ImportSessions(r io.Reader) (int, error)
+}
+
+const sessionStateVersion = 1
+
+type sessionInStorage struct {
+	From          string
+	InstanceTag   uint32
+	Keypair       keypairInStorage
+	PointI        string
+	ClientProfile string
+	LastTouched   time.Time
+}
+
+type sessionStateInStorage struct {
+	Version  int
+	Sessions []*sessionInStorage
+}
+
+// expects the session lock to be held
+func (s *realSession) intoStorage(from string) *sessionInStorage {
+	return &sessionInStorage{
+		From:        from,
+		InstanceTag: s.tag,
+		Keypair: keypairInStorage{
+			Symmetric: encodeMessage(s.s.Sym[:]),
+			Private:   encodeMessage(gotrx.SerializeScalar(s.s.Priv.K())),
+			Public:    encodeMessage(gotrx.SerializePoint(s.s.Pub.K())),
+		},
+		PointI:        encodeMessage(gotrx.SerializePoint(s.i)),
+		ClientProfile: encodeMessage(s.cp.Serialize()),
+		LastTouched:   s.lastTouched,
+	}
+}
+
+func (sis *sessionInStorage) intoSession() (*realSession, error) {
+	kp, e := sis.Keypair.intoKeypair()
+	if e != nil {
+		return nil, e
+	}
+
+	ib, ok := decodeMessage(sis.PointI)
+	if !ok {
+		return nil, errors.New("couldn't decode point I")
+	}
+	_, i, ok := gotrx.DeserializePoint(ib)
+	if !ok {
+		return nil, errors.New("couldn't decode point I")
+	}
+
+	cpb, ok := decodeMessage(sis.ClientProfile)
+	if !ok {
+		return nil, errors.New("couldn't decode client profile")
+	}
+	cp := &gotrx.ClientProfile{}
+	if _, ok := cp.Deserialize(cpb); !ok {
+		return nil, errors.New("couldn't decode client profile")
+	}
+
+	return &realSession{
+		tag:         sis.InstanceTag,
+		s:           kp,
+		i:           i,
+		cp:          cp,
+		lastTouched: sis.LastTouched,
+	}, nil
+}
+
+func (sm *sessionManager) count() int {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	result := 0
+	for _, s := range sm.s {
+		s.Lock()
+		if s.s != nil {
+			result++
+		}
+		s.Unlock()
+	}
+	return result
+}
+
+func (sm *sessionManager) export() []*sessionInStorage {
+	sm.RLock()
+	defer sm.RUnlock()
+
+	result := []*sessionInStorage{}
+	for from, s := range sm.s {
+		s.Lock()
+		// Sessions are created before the DAKE1 has been handled, so they might not have anything to hand over yet
+		if s.s != nil {
+			result = append(result, s.intoStorage(from))
+		}
+		s.Unlock()
+	}
+	return result
+}
+
+func (sm *sessionManager) add(from string, s *realSession) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.s[from] = s
+}
+
+func (g *GenericServer) addSession(sis *sessionInStorage, s *realSession) error {
+	if g.sharedSessions == nil {
+		g.sessions.add(sis.From, s)
+		return nil
+	}
+	d, e := json.Marshal(sis)
+	if e != nil {
+		return e
+	}
+	return g.sharedSessions.SaveSession(sis.From, d, time.Until(s.lastTouched.Add(g.sessionTimeout)))
+}
+
+// ActiveSessions implements the SessionHandoff interface. Sessions in a shared store don't have to be handed over, so they aren't counted
+func (g *GenericServer) ActiveSessions() int {
+	if g.sharedSessions != nil {
+		return 0
+	}
+	return g.sessions.count()
+}
+
+// ExportSessions implements the SessionHandoff interface. Sessions in a shared store stay there,
+// so there is nothing to hand over
+func (g *GenericServer) ExportSessions(w io.Writer) (int, error) {
+	st := &sessionStateInStorage{
+		Version:  sessionStateVersion,
+		Sessions: []*sessionInStorage{},
+	}
+	if g.sharedSessions == nil {
+		st.Sessions = g.sessions.export()
+	}
+	if e := json.NewEncoder(w).Encode(st); e != nil {
+		return 0, e
+	}
+	return len(st.Sessions), nil
+}
+
+// ImportSessions implements the SessionHandoff interface. With a shared store, the sessions are added to it
+func (g *GenericServer) ImportSessions(r io.Reader) (int, error) {
+	st := &sessionStateInStorage{}
+	if e := json.NewDecoder(r).Decode(st); e != nil {
+		return 0, e
+	}
+	if st.Version != sessionStateVersion {
+		return 0, fmt.Errorf("unknown session state version %d", st.Version)
+	}
+
+	result := 0
+	for ix, sis := range st.Sessions {
+		s, e := sis.intoSession()
+		if e != nil {
+			return result, fmt.Errorf("invalid session %d: %v", ix+1, e)
+		}
+		if s.hasExpired(g.sessionTimeout) {
+			continue
+		}
+		if e := g.addSession(sis, s); e != nil {
+			return result, e
+		}
+		result++
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/otrv4/ed448"
+	"github.com/otrv4/gotrx"
+	. "gopkg.in/check.v1"
+)
+
+func createHandoffTestServer() *GenericServer {
+	serverKey := gotrx.DeriveKeypair([symKeyLength]byte{0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25, 0x25})
+	gs := &GenericServer{
+		identity:       "masterOfKeys.example.org",
+		rand:           gotrx.FixtureRand(),
+		key:            serverKey,
+		fingerprint:    serverKey.Pub.Fingerprint(),
+		storageImpl:    createInMemoryStorage(),
+		sessions:       newSessionManager(),
+		rest:           nullRestrictor,
+		sessionTimeout: time.Duration(5) * time.Minute,
+	}
+	gs.messageHandler = &otrngMessageHandler{s: gs}
+	return gs
+}
+
+func (s *GenericServerSuite) Test_GenericServer_ExportSessions_canBeImportedToFinishTheDAKE(c *C) {
+	gs1 := createHandoffTestServer()
+	gs1.sessions.get("rama@example.org")
+
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.Pub.K())
+	r, e := gs1.handleMessage("sita@example.org", d1.serialize())
+	c.Assert(e, IsNil)
+	d2 := dake2Message{}
+	d2.deserialize(r)
+	c.Assert(gs1.ActiveSessions(), Equals, 1)
+
+	var buf bytes.Buffer
+	n, e := gs1.ExportSessions(&buf)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 1)
+
+	gs2 := createHandoffTestServer()
+	n, e = gs2.ImportSessions(&buf)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(gs2.ActiveSessions(), Equals, 1)
+
+	phi := gotrx.AppendData(gotrx.AppendData(nil, []byte("sita@example.org")), []byte(gs2.identity))
+	t := append([]byte{}, 0x01)
+	t = append(t, gotrx.KdfPrekeyServer(usageReceiverClientProfile, 64, sita.clientProfile.Serialize())...)
+	t = append(t, gotrx.KdfPrekeyServer(usageReceiverPrekeyCompositeIdentity, 64, gs2.compositeIdentity())...)
+	t = append(t, gotrx.SerializePoint(sita.i.Pub.K())...)
+	t = append(t, gotrx.SerializePoint(d2.s)...)
+	t = append(t, gotrx.KdfPrekeyServer(usageReceiverPrekeyCompositePHI, 64, phi)...)
+	sigma, _ := gotrx.GenerateSignature(gs2, sita.longTerm.Priv, sita.longTerm.Pub, sita.longTerm.Pub, gs2.key.Pub, gotrx.CreatePublicKey(d2.s, gotrx.Ed448Key), t, gotrx.KdfPrekeyServer, usageAuth)
+	sk := gotrx.KdfPrekeyServer(usageSK, skLength, gotrx.SerializePoint(ed448.PointScalarMul(d2.s, sita.i.Priv.K())))
+	msg := generateStorageInformationRequestMessage(gotrx.KdfPrekeyServer(usagePreMACKey, 64, sk))
+	d3 := generateDake3(sita.instanceTag, sigma, msg.serialize())
+
+	r, e = gs2.handleMessage("sita@example.org", d3.serialize())
+	c.Assert(e, IsNil)
+	res := &storageStatusMessage{}
+	_, ok := res.deserialize(r)
+	c.Assert(ok, Equals, true)
+	c.Assert(res.instanceTag, Equals, uint32(0x1245ABCD))
+}
+
+func (s *GenericServerSuite) Test_GenericServer_ImportSessions_skipsExpiredSessions(c *C) {
+	gs1 := createHandoffTestServer()
+	d1 := generateDake1(sita.instanceTag, sita.clientProfile, sita.i.Pub.K())
+	gs1.handleMessage("sita@example.org", d1.serialize())
+	gs1.sessions.s["sita@example.org"].lastTouched = time.Now().Add(-time.Duration(6) * time.Minute)
+
+	var buf bytes.Buffer
+	gs1.ExportSessions(&buf)
+
+	gs2 := createHandoffTestServer()
+	n, e := gs2.ImportSessions(&buf)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 0)
+	c.Assert(gs2.hasSession("sita@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_GenericServer_ImportSessions_returnsErrorsForInvalidState(c *C) {
+	gs := createHandoffTestServer()
+
+	_, e := gs.ImportSessions(bytes.NewBufferString(`{"Version": 2}`))
+	c.Assert(e, ErrorMatches, "unknown session state version 2")
+
+	_, e = gs.ImportSessions(bytes.NewBufferString(`[]`))
+	c.Assert(e, ErrorMatches, "json: cannot unmarshal .*")
+
+	_, e = gs.ImportSessions(bytes.NewBufferString(`{"Version": 1, "Sessions": [{"Keypair": {"Symmetric": "!"}}]}`))
+	c.Assert(e, ErrorMatches, "invalid session 1: couldn't decode symmetric key")
+
+	kp := `{"Symmetric": "", "Private": "` + encodeMessage(gotrx.SerializeScalar(sita.i.Priv.K())) + `", "Public": "` + encodeMessage(gotrx.SerializePoint(sita.i.Pub.K())) + `"}`
+	_, e = gs.ImportSessions(bytes.NewBufferString(`{"Version": 1, "Sessions": [{"Keypair": ` + kp + `, "PointI": "AAAA"}]}`))
+	c.Assert(e, ErrorMatches, "invalid session 1: couldn't decode point I")
+
+	i := encodeMessage(gotrx.SerializePoint(sita.i.Pub.K()))
+	_, e = gs.ImportSessions(bytes.NewBufferString(`{"Version": 1, "Sessions": [{"Keypair": ` + kp + `, "PointI": "` + i + `", "ClientProfile": "AAAA"}]}`))
+	c.Assert(e, ErrorMatches, "invalid session 1: couldn't decode client profile")
+}
@@ -0,0 +1,520 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/otrv4/gotrx"
+)
+
+// Design:
+// - several storages can be combined into one, each keeping part of the identities, with a descriptor like
+//   sharded:key-file=/etc/otrng/shards.key;dir:/srv/otrng/a;dir:/srv/otrng/b;in-memory
+//   The options come first, and every part after them is the descriptor of a shard. Any storage can be
+//   a shard except another sharded one, and the descriptors of the shards can't contain semicolons
+// - the shard of an identity is picked by rendezvous hashing: every shard scores the identity with an
+//   HMAC-SHA256 of the descriptor of the shard and the hash of the identity, keyed with the contents of
+//   the key file, and the highest score wins. Without the key, nobody can come up with identities that
+//   all end up in the same shard. Since a score only depends on the shard and the identity, adding a
+//   shard only moves the identities it scores highest - about one in every number of shards - and the
+//   order the shards are given in doesn't matter. Changing the descriptor of a shard moves identities
+//   like replacing it with a new shard would
+// - the score uses the hash of the identity, since that is all the directory storage keeps, and
+//   rebalancing has to find the shard of what a storage lists
+// - after adding shards, the storage is started with rebalance=true. The identities kept in a shard
+//   that isn't theirs are then moved in the background, one at a time. Until that is done, every request
+//   first moves what the other shards keep for the identity, with the identity locked, so nothing is
+//   missed or handed out twice. A shard that is removed isn't read anymore, so its contents have to be
+//   migrated into the sharded storage with prekey-admin
+// - cleanup runs on all shards at the same time
+// - every shard counts the requests it has served, the identities moved and the cleanups, which
+//   StorageStats reports
+
+const (
+	shardedStoragePrefix   = "sharded:"
+	shardSeparator         = ";"
+	minimumShardKeyLength  = 16
+	shardLocks             = 64
+	rebalanceRetryInterval = time.Minute
+)
+
+func isShardedStorageDescriptor(desc string) bool {
+	return strings.HasPrefix(desc, shardedStoragePrefix)
+}
+
+// shardedStorageFactory creates the storage once, so every server using it shares the shards
+type shardedStorageFactory struct {
+	st *shardedStorage
+}
+
+func readShardKey(file string) ([]byte, error) {
+	key, e := ioutil.ReadFile(file)
+	if e != nil {
+		return nil, fmt.Errorf("couldn't read the shard key file: %v", e)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < minimumShardKeyLength {
+		return nil, fmt.Errorf("the shard key has to be at least %d bytes", minimumShardKeyLength)
+	}
+	return key, nil
+}
+
+func createShardedStorageFactoryFrom(desc string) (Storage, error) {
+	parts := strings.Split(strings.TrimPrefix(desc, shardedStoragePrefix), shardSeparator)
+	opts, e := parseStorageOptions(parts[0], "key-file", "rebalance")
+	if e != nil {
+		return nil, e
+	}
+	file, ok := opts["key-file"]
+	if !ok {
+		return nil, errors.New("the key file has to be given, like sharded:key-file=/PATH/FILE;SHARD;SHARD")
+	}
+	key, e := readShardKey(file)
+	if e != nil {
+		return nil, e
+	}
+	rebalance := false
+	if v, ok := opts["rebalance"]; ok {
+		if rebalance, e = strconv.ParseBool(v); e != nil {
+			return nil, fmt.Errorf("invalid rebalance option %q, expected true or false", v)
+		}
+	}
+	if len(parts) < 2 {
+		return nil, errors.New("no shards given, they have to follow the options, like sharded:key-file=/PATH/FILE;SHARD;SHARD")
+	}
+
+	shards := []*shard{}
+	seen := map[string]bool{}
+	for _, d := range parts[1:] {
+		if isShardedStorageDescriptor(d) {
+			return nil, errors.New("a sharded storage can't be a shard")
+		}
+		if seen[d] {
+			return nil, fmt.Errorf("the shard %q is given more than once", d)
+		}
+		seen[d] = true
+		f, e := loadStorageType(d)
+		if e != nil {
+			return nil, fmt.Errorf("shard %q: %v", d, e)
+		}
+		shards = append(shards, &shard{name: d, st: f.createStorage()})
+	}
+	return &shardedStorageFactory{st: createShardedStorage(key, shards, rebalance)}, nil
+}
+
+func (ssf *shardedStorageFactory) createStorage() storage {
+	return ssf.st
+}
+
+// shard is one of the storages of a sharded storage, with its counters. The counters come first, so
+// they are aligned for the atomic operations also on 32-bit platforms
+type shard struct {
+	stores      uint64
+	retrievals  uint64
+	failures    uint64
+	movedIn     uint64
+	movedOut    uint64
+	cleanups    uint64
+	lastCleanup int64
+
+	name string
+	st   storage
+}
+
+func (sh *shard) admin() (adminStorage, error) {
+	if as, ok := sh.st.(adminStorage); ok {
+		return as, nil
+	}
+	return nil, errNoAdministration
+}
+
+func (sh *shard) failed(e error) error {
+	if e != nil {
+		atomic.AddUint64(&sh.failures, 1)
+		return fmt.Errorf("shard %s: %v", sh.name, e)
+	}
+	return nil
+}
+
+type shardedStorage struct {
+	key    []byte
+	shards []*shard
+
+	// locks are held by identity hash while moving identities, and while using them when rebalancing
+	locks       [shardLocks]sync.Mutex
+	rebalancing int32
+
+	startOnce sync.Once
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func createShardedStorage(key []byte, shards []*shard, rebalance bool) *shardedStorage {
+	s := &shardedStorage{
+		key:     key,
+		shards:  shards,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if rebalance {
+		s.rebalancing = 1
+	}
+	return s
+}
+
+// score is the rendezvous hashing score of the shard for the identity with the hash
+func (s *shardedStorage) score(sh *shard, hash string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(sh.name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(hash))
+	return mac.Sum(nil)
+}
+
+func (s *shardedStorage) shardFor(hash string) *shard {
+	var best *shard
+	var bestScore []byte
+	for _, sh := range s.shards {
+		if sc := s.score(sh, hash); best == nil || bytes.Compare(sc, bestScore) > 0 {
+			best, bestScore = sh, sc
+		}
+	}
+	return best
+}
+
+func (s *shardedStorage) lockFor(hash string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	return &s.locks[h.Sum32()%shardLocks]
+}
+
+// start starts rebalancing the first time the storage is used, so a server taking over from
+// another process doesn't touch the shards before it has to
+func (s *shardedStorage) start() {
+	s.startOnce.Do(func() {
+		if atomic.LoadInt32(&s.rebalancing) == 1 {
+			go s.keepRebalancing()
+		} else {
+			close(s.stopped)
+		}
+	})
+}
+
+// keepRebalancing goes through the identities of all shards until every one of them has been moved to its shard
+func (s *shardedStorage) keepRebalancing() {
+	defer close(s.stopped)
+	for {
+		if s.rebalance() {
+			atomic.StoreInt32(&s.rebalancing, 0)
+			return
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(rebalanceRetryInterval):
+		}
+	}
+}
+
+// rebalance moves the identities kept in the wrong shard, returning false if some couldn't be moved
+func (s *shardedStorage) rebalance() bool {
+	done := true
+	for _, sh := range s.shards {
+		as, e := sh.admin()
+		if e != nil {
+			return false
+		}
+		ids, e := as.listIdentities()
+		if sh.failed(e) != nil {
+			done = false
+			continue
+		}
+		for _, id := range ids {
+			select {
+			case <-s.stop:
+				return false
+			default:
+			}
+			if s.shardFor(id.Hash) == sh {
+				continue
+			}
+			l := s.lockFor(id.Hash)
+			l.Lock()
+			e := s.move(id, s.shardFor(id.Hash))
+			l.Unlock()
+			done = done && e == nil
+		}
+	}
+	return done
+}
+
+// move moves what the other shards keep for the identity to its shard, leaving out what has expired.
+// It expects the lock for the identity to be held
+func (s *shardedStorage) move(id *StoredIdentity, to *shard) error {
+	dest, e := to.admin()
+	if e != nil {
+		return e
+	}
+	for _, sh := range s.shards {
+		if sh == to {
+			continue
+		}
+		src, e := sh.admin()
+		if e != nil {
+			return e
+		}
+		items, e := src.itemsFor(id)
+		if e != nil {
+			return sh.failed(e)
+		}
+		if len(items) == 0 {
+			continue
+		}
+		for _, it := range items {
+			if !it.hasExpired() {
+				if e := dest.importItem(it); e != nil {
+					return to.failed(e)
+				}
+			}
+		}
+		if _, e := src.purge(id, allInstanceTags); e != nil {
+			return sh.failed(e)
+		}
+		atomic.AddUint64(&sh.movedOut, 1)
+		atomic.AddUint64(&to.movedIn, 1)
+	}
+	return nil
+}
+
+// with calls f with the shard of the identity. While rebalancing, what the other shards keep for the
+// identity is moved there first, and the identity stays locked until f returns
+func (s *shardedStorage) with(id *StoredIdentity, f func(*shard) error) error {
+	s.start()
+	sh := s.shardFor(id.Hash)
+	if atomic.LoadInt32(&s.rebalancing) == 0 {
+		return f(sh)
+	}
+	l := s.lockFor(id.Hash)
+	l.Lock()
+	defer l.Unlock()
+	if e := s.move(id, sh); e != nil {
+		return e
+	}
+	return f(sh)
+}
+
+func (s *shardedStorage) store(from string, f func(storage) error) error {
+	return s.with(identityOf(from), func(sh *shard) error {
+		atomic.AddUint64(&sh.stores, 1)
+		return sh.failed(f(sh.st))
+	})
+}
+
+func (s *shardedStorage) storeClientProfile(from string, cp *gotrx.ClientProfile) error {
+	return s.store(from, func(st storage) error {
+		return st.storeClientProfile(from, cp)
+	})
+}
+
+func (s *shardedStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	return s.store(from, func(st storage) error {
+		return st.storePrekeyProfile(from, pp)
+	})
+}
+
+func (s *shardedStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	return s.store(from, func(st storage) error {
+		return st.storePrekeyMessages(from, pms)
+	})
+}
+
+func (s *shardedStorage) numberStored(from string, tag uint32) uint32 {
+	result := uint32(0)
+	s.with(identityOf(from), func(sh *shard) error {
+		result = sh.st.numberStored(from, tag)
+		return nil
+	})
+	return result
+}
+
+func (s *shardedStorage) retrieveFor(from string) []*prekeyEnsemble {
+	var result []*prekeyEnsemble
+	s.with(identityOf(from), func(sh *shard) error {
+		atomic.AddUint64(&sh.retrievals, 1)
+		result = sh.st.retrieveFor(from)
+		return nil
+	})
+	return result
+}
+
+func (s *shardedStorage) cleanup() {
+	s.start()
+	var wg sync.WaitGroup
+	for _, sh := range s.shards {
+		wg.Add(1)
+		go func(sh *shard) {
+			defer wg.Done()
+			started := time.Now()
+			sh.st.cleanup()
+			atomic.AddUint64(&sh.cleanups, 1)
+			atomic.StoreInt64(&sh.lastCleanup, int64(time.Since(started)))
+		}(sh)
+	}
+	wg.Wait()
+}
+
+func (s *shardedStorage) probe() error {
+	s.start()
+	for _, sh := range s.shards {
+		if e := sh.st.probe(); e != nil {
+			return fmt.Errorf("shard %s: %v", sh.name, e)
+		}
+	}
+	return nil
+}
+
+// close stops rebalancing and closes the shards
+func (s *shardedStorage) close() error {
+	s.closeOnce.Do(func() {
+		s.startOnce.Do(func() {
+			close(s.stopped)
+		})
+		close(s.stop)
+		<-s.stopped
+		for _, sh := range s.shards {
+			if cs, ok := sh.st.(closableStorage); ok {
+				if e := cs.close(); e != nil && s.closeErr == nil {
+					s.closeErr = fmt.Errorf("shard %s: %v", sh.name, e)
+				}
+			}
+		}
+	})
+	return s.closeErr
+}
+
+func (s *shardedStorage) stats() *StorageStats {
+	result := &StorageStats{Rebalancing: atomic.LoadInt32(&s.rebalancing) == 1}
+	for _, sh := range s.shards {
+		result.Shards = append(result.Shards, &ShardStats{
+			Shard:             sh.name,
+			Stores:            atomic.LoadUint64(&sh.stores),
+			Retrievals:        atomic.LoadUint64(&sh.retrievals),
+			Failures:          atomic.LoadUint64(&sh.failures),
+			MovedIn:           atomic.LoadUint64(&sh.movedIn),
+			MovedOut:          atomic.LoadUint64(&sh.movedOut),
+			Cleanups:          atomic.LoadUint64(&sh.cleanups),
+			LastCleanupMillis: time.Duration(atomic.LoadInt64(&sh.lastCleanup)).Milliseconds(),
+		})
+	}
+	return result
+}
+
+// listIdentities lists an identity once, also while it's being moved from one shard to another
+func (s *shardedStorage) listIdentities() ([]*StoredIdentity, error) {
+	result := []*StoredIdentity{}
+	seen := map[string]*StoredIdentity{}
+	for _, sh := range s.shards {
+		as, e := sh.admin()
+		if e != nil {
+			return nil, e
+		}
+		ids, e := as.listIdentities()
+		if e != nil {
+			return nil, sh.failed(e)
+		}
+		for _, id := range ids {
+			if prev, ok := seen[id.Hash]; ok {
+				if prev.Identity == "" {
+					prev.Identity = id.Identity
+				}
+				continue
+			}
+			seen[id.Hash] = id
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+func (s *shardedStorage) instanceTagsFor(id *StoredIdentity) ([]*storedInstanceTag, error) {
+	var result []*storedInstanceTag
+	e := s.with(id, func(sh *shard) error {
+		as, e := sh.admin()
+		if e == nil {
+			result, e = as.instanceTagsFor(id)
+		}
+		return e
+	})
+	return result, e
+}
+
+// purge removes the identity from all shards, so nothing is left behind by a move that failed halfway
+func (s *shardedStorage) purge(id *StoredIdentity, itag uint32) (*StoredCounts, error) {
+	l := s.lockFor(id.Hash)
+	l.Lock()
+	defer l.Unlock()
+	removed := &StoredCounts{}
+	for _, sh := range s.shards {
+		as, e := sh.admin()
+		if e != nil {
+			return removed, e
+		}
+		r, e := as.purge(id, itag)
+		if r != nil {
+			removed.ClientProfiles += r.ClientProfiles
+			removed.PrekeyProfiles += r.PrekeyProfiles
+			removed.PrekeyMessages += r.PrekeyMessages
+		}
+		if e != nil {
+			return removed, sh.failed(e)
+		}
+	}
+	return removed, nil
+}
+
+func (s *shardedStorage) exportItems(f func(*storedItem) error) error {
+	for _, sh := range s.shards {
+		as, e := sh.admin()
+		if e != nil {
+			return e
+		}
+		if e := as.exportItems(f); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *shardedStorage) importItem(it *storedItem) error {
+	return s.with(it.id, func(sh *shard) error {
+		as, e := sh.admin()
+		if e != nil {
+			return e
+		}
+		return sh.failed(as.importItem(it))
+	})
+}
+
+func (s *shardedStorage) itemsFor(id *StoredIdentity) ([]*storedItem, error) {
+	var result []*storedItem
+	e := s.with(id, func(sh *shard) error {
+		as, e := sh.admin()
+		if e == nil {
+			result, e = as.itemsFor(id)
+		}
+		return e
+	})
+	return result, e
+}
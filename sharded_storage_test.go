@@ -0,0 +1,277 @@
+package prekeyserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func shardKeyFile(c *C, key string) string {
+	file := filepath.Join(c.MkDir(), "shards.key")
+	c.Assert(ioutil.WriteFile(file, []byte(key+"\n"), 0600), IsNil)
+	return file
+}
+
+func shardedDescriptor(c *C, shards ...string) string {
+	desc := "sharded:key-file=" + shardKeyFile(c, "a key that is long enough")
+	for _, sh := range shards {
+		desc += ";" + sh
+	}
+	return desc
+}
+
+func shardedStorageFor(c *C, desc string) *shardedStorage {
+	st, e := CreateFactory(nil).LoadStorageType(desc)
+	c.Assert(e, IsNil)
+	return st.createStorage().(*shardedStorage)
+}
+
+// stored returns the names of the shards that keep something for the identity
+func (s *shardedStorage) stored(c *C, from string) []string {
+	result := []string{}
+	for _, sh := range s.shards {
+		items, e := sh.st.(adminStorage).itemsFor(identityOf(from))
+		c.Assert(e, IsNil)
+		if len(items) > 0 {
+			result = append(result, sh.name)
+		}
+	}
+	return result
+}
+
+func (s *GenericServerSuite) Test_LoadStorageType_checksTheShardedOptions(c *C) {
+	f := CreateFactory(nil)
+	key := shardKeyFile(c, "a key that is long enough")
+	dir := c.MkDir()
+
+	st, e := f.LoadStorageType("sharded:key-file=" + key + ",rebalance=true;in-memory;dir:" + dir)
+	c.Assert(e, IsNil)
+	ss := st.createStorage().(*shardedStorage)
+	c.Assert(st.createStorage(), Equals, ss)
+	c.Assert(string(ss.key), Equals, "a key that is long enough")
+	c.Assert(ss.shards, HasLen, 2)
+	c.Assert(ss.shards[0].name, Equals, "in-memory")
+	c.Assert(ss.shards[1].st, DeepEquals, createFileStorageFrom(dir))
+	c.Assert(ss.rebalancing, Equals, int32(1))
+
+	_, e = f.LoadStorageType("sharded:;in-memory")
+	c.Assert(e, ErrorMatches, "the key file has to be given, like sharded:key-file=/PATH/FILE;SHARD;SHARD")
+	_, e = f.LoadStorageType("sharded:key-file=" + key + ".missing;in-memory")
+	c.Assert(e, ErrorMatches, "couldn't read the shard key file: .*")
+	_, e = f.LoadStorageType("sharded:key-file=" + shardKeyFile(c, "too short") + ";in-memory")
+	c.Assert(e, ErrorMatches, "the shard key has to be at least 16 bytes")
+	_, e = f.LoadStorageType("sharded:key-file=" + key + ",rebalance=sometimes;in-memory")
+	c.Assert(e, ErrorMatches, `invalid rebalance option "sometimes", expected true or false`)
+	_, e = f.LoadStorageType("sharded:key-file=" + key + ",shards=2;in-memory")
+	c.Assert(e, ErrorMatches, `unknown storage option "shards"`)
+	_, e = f.LoadStorageType("sharded:key-file=" + key)
+	c.Assert(e, ErrorMatches, "no shards given, they have to follow the options, like sharded:key-file=/PATH/FILE;SHARD;SHARD")
+	_, e = f.LoadStorageType("sharded:key-file=" + key + ";sharded:key-file=" + key)
+	c.Assert(e, ErrorMatches, "a sharded storage can't be a shard")
+	_, e = f.LoadStorageType("sharded:key-file=" + key + ";dir:" + dir + ";dir:" + dir)
+	c.Assert(e, ErrorMatches, `the shard "dir:`+dir+`" is given more than once`)
+	_, e = f.LoadStorageType("sharded:key-file=" + key + ";dir:" + filepath.Join(dir, "missing"))
+	c.Assert(e, ErrorMatches, `shard "dir:.*missing": directory doesn't exist`)
+	_, e = f.LoadStorageType("sharded:key-file=" + key + ";in-memory;")
+	c.Assert(e, ErrorMatches, `shard "": unknown storage type`)
+}
+
+func (s *GenericServerSuite) Test_shardedStorage_routesIdentitiesByKeyedHash(c *C) {
+	a, b, d := "dir:"+c.MkDir(), "dir:"+c.MkDir(), "dir:"+c.MkDir()
+	key := shardKeyFile(c, "a key that is long enough")
+	ss := shardedStorageFor(c, "sharded:key-file="+key+";in-memory;"+a+";"+b)
+	reordered := shardedStorageFor(c, "sharded:key-file="+key+";"+b+";in-memory;"+a)
+	otherKey := shardedStorageFor(c, "sharded:key-file="+shardKeyFile(c, "another key that is long enough")+";in-memory;"+a+";"+b)
+	added := shardedStorageFor(c, "sharded:key-file="+key+";in-memory;"+a+";"+b+";"+d)
+
+	perShard := map[string]int{}
+	differentWithOtherKey, moved := 0, 0
+	for i := 0; i < 600; i++ {
+		h := identityHash(fmt.Sprintf("user%d@example.org", i))
+		name := ss.shardFor(h).name
+		perShard[name]++
+		c.Assert(reordered.shardFor(h).name, Equals, name)
+		if otherKey.shardFor(h).name != name {
+			differentWithOtherKey++
+		}
+		// adding a shard only moves identities to the new one
+		if n := added.shardFor(h).name; n != name {
+			c.Assert(n, Equals, d)
+			moved++
+		}
+	}
+	c.Assert(perShard, HasLen, 3)
+	for _, n := range perShard {
+		c.Assert(n > 150 && n < 250, Equals, true, Commentf("%v", perShard))
+	}
+	c.Assert(differentWithOtherKey > 300, Equals, true)
+	c.Assert(moved > 100 && moved < 200, Equals, true)
+}
+
+func (s *GenericServerSuite) Test_shardedStorage_servesPublicationsAndRetrievals(c *C) {
+	desc, file := snapshotDescriptor(c)
+	server, sita, sita2 := createAdminTestServer(c, shardedDescriptor(c, "dir:"+c.MkDir(), "dir:"+c.MkDir(), desc))
+	ss := server.storageImpl.(*shardedStorage)
+	c.Assert(server.storageImpl.probe(), IsNil)
+	c.Assert(ss.stored(c, "sita@example.org"), DeepEquals, []string{ss.shardFor(identityHash("sita@example.org")).name})
+	c.Assert(ss.stored(c, "rama@example.org"), DeepEquals, []string{ss.shardFor(identityHash("rama@example.org")).name})
+
+	num, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(num, Equals, uint32(3))
+	num, _ = sita2.StorageStatus()
+	c.Assert(num, Equals, uint32(2))
+	rama := createTestClient("rama@example.org", server)
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+
+	a, _ := server.Admin(nil)
+	t, e := a.Totals()
+	c.Assert(e, IsNil)
+	c.Assert(t.Identities, Equals, 2)
+	c.Assert(t.StoredCounts, DeepEquals, StoredCounts{ClientProfiles: 2, PrekeyProfiles: 2, PrekeyMessages: 7})
+
+	stats := server.StorageStats()
+	c.Assert(stats.Rebalancing, Equals, false)
+	c.Assert(stats.Shards, HasLen, 3)
+	total := ShardStats{}
+	for _, st := range stats.Shards {
+		total.Stores += st.Stores
+		total.Retrievals += st.Retrievals
+		c.Assert(st.Cleanups > 0, Equals, true)
+	}
+	c.Assert(total.Stores, Equals, uint64(9))
+	c.Assert(total.Retrievals, Equals, uint64(1))
+	sitaShard := ss.shardFor(identityHash("sita@example.org"))
+	c.Assert(sitaShard.retrievals, Equals, uint64(1))
+
+	c.Assert(server.Close(), IsNil)
+	c.Assert(entryExists(file), Equals, true)
+	c.Assert(ss.close(), IsNil)
+}
+
+// slowStorage is an in-memory storage that waits for the others to start cleaning up before it finishes
+type slowStorage struct {
+	*inMemoryStorage
+	cleaning *sync.WaitGroup
+	timedOut bool
+}
+
+func (s *slowStorage) cleanup() {
+	s.cleaning.Done()
+	done := make(chan struct{})
+	go func() {
+		s.cleaning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.timedOut = true
+	}
+}
+
+func (s *GenericServerSuite) Test_shardedStorage_cleansUpAllShardsAtTheSameTime(c *C) {
+	cleaning := &sync.WaitGroup{}
+	cleaning.Add(3)
+	shards := []*shard{}
+	for i := 0; i < 3; i++ {
+		shards = append(shards, &shard{name: fmt.Sprintf("slow%d", i), st: &slowStorage{inMemoryStorage: createInMemoryStorage(), cleaning: cleaning}})
+	}
+	ss := createShardedStorage([]byte("a key that is long enough"), shards, false)
+	ss.cleanup()
+	for _, sh := range shards {
+		c.Assert(sh.st.(*slowStorage).timedOut, Equals, false)
+		c.Assert(sh.cleanups, Equals, uint64(1))
+	}
+	c.Assert(ss.close(), IsNil)
+}
+
+func (s *GenericServerSuite) Test_shardedStorage_movesIdentitiesToAddedShardsWhileServing(c *C) {
+	a, b, d := "dir:"+c.MkDir(), "dir:"+c.MkDir(), "dir:"+c.MkDir()
+	key := shardKeyFile(c, "a key that is long enough")
+	before := shardedStorageFor(c, "sharded:key-file="+key+";"+a+";"+b)
+
+	sita := createTestClient("sita@example.org", nil)
+	itag := sita.Keys.InstanceTag
+	pp, _ := generatePrekeyProfile(sita, itag, time.Now().Add(time.Hour), sita.Keys.LongTerm)
+	users := []string{}
+	for i := 0; i < 30; i++ {
+		u := fmt.Sprintf("user%d@example.org", i)
+		users = append(users, u)
+		pm1, _, _, _ := generatePrekeyMessage(sita, itag)
+		pm2, _, _, _ := generatePrekeyMessage(sita, itag)
+		c.Assert(before.storeClientProfile(u, sita.clientProfile(time.Now().Add(time.Hour))), IsNil)
+		c.Assert(before.storePrekeyProfile(u, pp), IsNil)
+		c.Assert(before.storePrekeyMessages(u, []*prekeyMessage{pm1, pm2}), IsNil)
+	}
+	c.Assert(before.close(), IsNil)
+
+	after := shardedStorageFor(c, "sharded:key-file="+key+",rebalance=true;"+a+";"+b+";"+d)
+	c.Assert(after.stats().Rebalancing, Equals, true)
+	// an identity is moved to its shard before it's used
+	var first string
+	for _, u := range users {
+		if after.shardFor(identityHash(u)).name == d {
+			first = u
+			break
+		}
+	}
+	c.Assert(after.retrieveFor(first), HasLen, 1)
+	c.Assert(after.stored(c, first), DeepEquals, []string{d})
+	c.Assert(after.numberStored(first, itag), Equals, uint32(1))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for after.stats().Rebalancing && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(after.stats().Rebalancing, Equals, false)
+
+	moved := 0
+	for _, u := range users {
+		owner := after.shardFor(identityHash(u)).name
+		c.Assert(after.stored(c, u), DeepEquals, []string{owner})
+		if owner == d {
+			moved++
+		}
+		if u != first {
+			c.Assert(after.numberStored(u, itag), Equals, uint32(2))
+		}
+	}
+	c.Assert(moved > 0, Equals, true)
+	stats := after.stats()
+	c.Assert(stats.Shards[2].MovedIn, Equals, uint64(moved))
+	c.Assert(stats.Shards[0].MovedOut+stats.Shards[1].MovedOut, Equals, uint64(moved))
+	c.Assert(stats.Shards[0].MovedIn+stats.Shards[1].MovedIn, Equals, uint64(0))
+
+	adm, _ := newAdmin(after, nil)
+	t, e := adm.Totals()
+	c.Assert(e, IsNil)
+	c.Assert(t.Identities, Equals, 30)
+	c.Assert(t.PrekeyMessages, Equals, 59)
+	c.Assert(after.close(), IsNil)
+}
+
+func (s *GenericServerSuite) Test_shardedStorage_purgesFromEveryShard(c *C) {
+	a, b := "dir:"+c.MkDir(), "dir:"+c.MkDir()
+	ss := shardedStorageFor(c, shardedDescriptor(c, a, b))
+	sita := createTestClient("sita@example.org", nil)
+	pm, _, _, _ := generatePrekeyMessage(sita, sita.Keys.InstanceTag)
+	// a copy left in the wrong shard, like a move that failed halfway would leave
+	for _, sh := range ss.shards {
+		c.Assert(sh.st.storePrekeyMessages("sita@example.org", []*prekeyMessage{pm}), IsNil)
+	}
+
+	ids, e := ss.listIdentities()
+	c.Assert(e, IsNil)
+	c.Assert(ids, DeepEquals, []*StoredIdentity{{Hash: identityHash("sita@example.org")}})
+	removed, e := ss.purge(identityOf("sita@example.org"), allInstanceTags)
+	c.Assert(e, IsNil)
+	c.Assert(removed.PrekeyMessages, Equals, 2)
+	c.Assert(ss.stored(c, "sita@example.org"), HasLen, 0)
+}
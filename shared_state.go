@@ -0,0 +1,321 @@
+package prekeyserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/ed448"
+	"github.com/otrv4/gotrx"
+)
+
+// Replicas of a server behind a load balancer can get different messages of the same DAKE, or
+// different fragments of the same message. By default the DAKE sessions in progress and the
+// fragments received are kept in the process, so everything from a sender has to be sent to the
+// same replica. Replicas that share a SessionStore and a FragmentStore - and the keypair, identity
+// and storage - can handle any message instead.
+// Sessions are kept serialized, as JSON with the ephemeral keypair S, the point I, the instance tag
+// and the client profile. A session expires after the session timeout counted from the DAKE-1,
+// instead of from the last message, since the messages reading it don't write it back.
+
+// SessionStore keeps the serialized DAKE sessions in progress, for servers that share them
+type SessionStore interface {
+	// LoadSession returns the session of the sender, or nil if there is none or it has expired
+	LoadSession(from string) ([]byte, error)
+	// SaveSession stores the session of the sender, replacing any earlier one, until the timeout has passed
+	SaveSession(from string, session []byte, timeout time.Duration) error
+	// DeleteSession removes the session of the sender, if there is one
+	DeleteSession(from string) error
+	// CountSessions returns the number of sessions that haven't expired
+	CountSessions() (int, error)
+}
+
+// FragmentStore keeps the fragments of messages that haven't been received completely, for servers that share them
+type FragmentStore interface {
+	// AddFragment stores piece number index, counted from 1, of the message with the key. If the
+	// message is complete, it removes the pieces and returns them in order, otherwise it returns nil.
+	// The pieces of a message are dropped when no piece has been added for the timeout, and adding a
+	// piece with a different total than the earlier ones is an error
+	AddFragment(key string, index, total uint16, piece string, timeout time.Duration) ([]string, error)
+	// CountPending returns the number of messages that have pieces missing
+	CountPending() (int, error)
+}
+
+// StateSharer is implemented by servers that can keep the DAKE sessions and the fragments in shared stores
+type StateSharer interface {
+	// ShareState makes the server keep the sessions and fragments in the given stores. Either can be
+	// nil to keep it in the process. It has to be called before handling any messages
+	ShareState(sessions SessionStore, fragments FragmentStore)
+}
+
+// ShareState makes the server keep the DAKE sessions and the fragments in the given stores, instead
+// of in the process. Either can be nil to keep it in the process. It has to be called before
+// handling any messages
+func (g *GenericServer) ShareState(sessions SessionStore, fragments FragmentStore) {
+	g.sharedSessions = sessions
+	g.sharedFragments = fragments
+}
+
+// storedSession is a session loaded from a SessionStore, that is written back when it's saved
+type storedSession struct {
+	*realSession
+	from    string
+	store   SessionStore
+	timeout time.Duration
+	err     error
+}
+
+func (s *storedSession) save(kp *gotrx.Keypair, i ed448.Point, tag uint32, cp *gotrx.ClientProfile) error {
+	s.realSession.save(kp, i, tag, cp)
+	s.realSession.Lock()
+	sis := s.realSession.intoStorage(s.from)
+	s.realSession.Unlock()
+	d, e := json.Marshal(sis)
+	if e != nil {
+		return e
+	}
+	return s.store.SaveSession(s.from, d, s.timeout)
+}
+
+func (s *storedSession) loadError() error {
+	return s.err
+}
+
+func (g *GenericServer) loadSharedSession(from string) session {
+	s := &storedSession{realSession: &realSession{}, from: from, store: g.sharedSessions, timeout: g.sessionTimeout}
+	d, e := g.sharedSessions.LoadSession(from)
+	if e != nil {
+		s.err = fmt.Errorf("couldn't load the session: %v", e)
+		return s
+	}
+	if d == nil {
+		return s
+	}
+	sis := &sessionInStorage{}
+	if e := json.Unmarshal(d, sis); e != nil {
+		s.err = fmt.Errorf("the stored session is corrupted: %v", e)
+		return s
+	}
+	if s.realSession, e = sis.intoSession(); e != nil {
+		s.realSession = &realSession{}
+		s.err = fmt.Errorf("the stored session is corrupted: %v", e)
+	}
+	return s
+}
+
+func (g *GenericServer) countSessions() (int, error) {
+	if g.sharedSessions != nil {
+		return g.sharedSessions.CountSessions()
+	}
+	return g.sessions.size(), nil
+}
+
+func (g *GenericServer) countPendingFragments() (int, error) {
+	if g.sharedFragments != nil {
+		return g.sharedFragments.CountPending()
+	}
+	return g.pendingFragments.count(), nil
+}
+
+// fragmentKey identifies a fragmented message of a sender. Unlike the fragmentor, it includes the
+// instance tag, so pieces from different clients of the same sender are never put together
+func fragmentKey(from string, senderTag, id uint32) string {
+	return fmt.Sprintf("%s/%08X/%d", from, senderTag, id)
+}
+
+type fragment struct {
+	id        uint32
+	senderTag uint32
+	index     uint16
+	total     uint16
+	piece     string
+}
+
+// parseFragment parses a fragment of the form ?OTRP|id|sender|receiver,index,total,piece,
+func parseFragment(frag string) (*fragment, bool) {
+	body := strings.TrimSuffix(strings.TrimPrefix(frag, fragmentationPrefix), ",")
+	one := strings.SplitN(body, "|", 3)
+	if len(one) != 3 {
+		return nil, false
+	}
+	two := strings.SplitN(one[2], ",", 4)
+	if len(two) != 4 {
+		return nil, false
+	}
+
+	id, e1 := strconv.ParseUint(one[0], 10, 32)
+	senderTag, e2 := strconv.ParseUint(one[1], 16, 32)
+	_, e3 := strconv.ParseUint(two[0], 16, 32)
+	index, e4 := strconv.ParseUint(two[1], 10, 16)
+	total, e5 := strconv.ParseUint(two[2], 10, 16)
+	if e1 != nil || e2 != nil || e3 != nil || e4 != nil || e5 != nil || index == 0 || total == 0 || index > total {
+		return nil, false
+	}
+	return &fragment{id: uint32(id), senderTag: uint32(senderTag), index: uint16(index), total: uint16(total), piece: two[3]}, true
+}
+
+// messageInstanceTag returns the sender instance tag of a complete message, which follows the version
+// and the message type in every message a client sends. It returns false if the message is too short
+func messageInstanceTag(message string) (uint32, bool) {
+	decoded, ok := decodeMessage(strings.TrimSuffix(message, "."))
+	if !ok || len(decoded) < 7 {
+		return 0, false
+	}
+	_, tag, ok := gotrx.ExtractWord(decoded[3:])
+	return tag, ok
+}
+
+// receiveFragment adds the fragment, and returns the message if it's now complete
+func (g *GenericServer) receiveFragment(from, frag string) (string, bool, error) {
+	if g.sharedFragments == nil {
+		m, c, e := g.fragmentations.NewFragmentReceived(from, frag)
+		if e != nil {
+			return "", false, e
+		}
+		if !c {
+			g.pendingFragments.received(from)
+		} else {
+			g.pendingFragments.completed(from)
+		}
+		return m, c, nil
+	}
+
+	f, ok := parseFragment(frag)
+	if !ok {
+		return "", false, errors.New("invalid fragmentation parse")
+	}
+	if f.senderTag < minimumInstanceTag {
+		return "", false, errors.New("invalid sender instance tag in fragment")
+	}
+	pieces, e := g.sharedFragments.AddFragment(fragmentKey(from, f.senderTag, f.id), f.index, f.total, f.piece, g.fragmentationTimeout)
+	if e != nil || pieces == nil {
+		return "", false, e
+	}
+	m := strings.Join(pieces, "")
+	// Messages that can't be decoded are rejected the same way as unfragmented ones
+	if tag, ok := messageInstanceTag(m); ok && tag != f.senderTag {
+		return "", false, errors.New("the instance tag of the fragments doesn't match the message")
+	}
+	return m, true, nil
+}
+
+// InProcessStore is a SessionStore and FragmentStore that keeps everything in the process, copied
+// in and out the way an external store would. Servers in one process sharing it behave like
+// replicas sharing an external store, which is mostly useful for tests
+type InProcessStore struct {
+	sessions  map[string]*inProcessSession
+	fragments map[string]*inProcessFragments
+	sync.Mutex
+}
+
+type inProcessSession struct {
+	data    []byte
+	expires time.Time
+}
+
+type inProcessFragments struct {
+	pieces  []string
+	have    []bool
+	count   uint16
+	expires time.Time
+}
+
+// NewInProcessStore returns an empty store
+func NewInProcessStore() *InProcessStore {
+	return &InProcessStore{
+		sessions:  make(map[string]*inProcessSession),
+		fragments: make(map[string]*inProcessFragments),
+	}
+}
+
+// removeExpired expects the lock to be held
+func (s *InProcessStore) removeExpired() {
+	now := time.Now()
+	for from, ses := range s.sessions {
+		if ses.expires.Before(now) {
+			delete(s.sessions, from)
+		}
+	}
+	for key, fs := range s.fragments {
+		if fs.expires.Before(now) {
+			delete(s.fragments, key)
+		}
+	}
+}
+
+// LoadSession implements the SessionStore interface
+func (s *InProcessStore) LoadSession(from string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	ses, ok := s.sessions[from]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, ses.data...), nil
+}
+
+// SaveSession implements the SessionStore interface
+func (s *InProcessStore) SaveSession(from string, session []byte, timeout time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sessions[from] = &inProcessSession{data: append([]byte{}, session...), expires: time.Now().Add(timeout)}
+	return nil
+}
+
+// DeleteSession implements the SessionStore interface
+func (s *InProcessStore) DeleteSession(from string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, from)
+	return nil
+}
+
+// CountSessions implements the SessionStore interface
+func (s *InProcessStore) CountSessions() (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	return len(s.sessions), nil
+}
+
+// AddFragment implements the FragmentStore interface
+func (s *InProcessStore) AddFragment(key string, index, total uint16, piece string, timeout time.Duration) ([]string, error) {
+	if index == 0 || index > total {
+		return nil, errors.New("invalid fragment index")
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	fs, ok := s.fragments[key]
+	if !ok {
+		fs = &inProcessFragments{pieces: make([]string, total), have: make([]bool, total)}
+		s.fragments[key] = fs
+	}
+	if len(fs.pieces) != int(total) {
+		return nil, errors.New("inconsistent total")
+	}
+	fs.expires = time.Now().Add(timeout)
+	if !fs.have[index-1] {
+		fs.have[index-1] = true
+		fs.pieces[index-1] = piece
+		fs.count++
+	}
+	if fs.count < total {
+		return nil, nil
+	}
+	delete(s.fragments, key)
+	return fs.pieces, nil
+}
+
+// CountPending implements the FragmentStore interface
+func (s *InProcessStore) CountPending() (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired()
+	return len(s.fragments), nil
+}
@@ -0,0 +1,243 @@
+package prekeyserver
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// roundRobinServer sends every message to the next replica, like a load balancer without sticky routing
+type roundRobinServer struct {
+	replicas []Server
+	next     int
+	sync.Mutex
+}
+
+func (r *roundRobinServer) Handle(from, message string) ([]string, error) {
+	r.Lock()
+	s := r.replicas[r.next%len(r.replicas)]
+	r.next++
+	r.Unlock()
+	return s.Handle(from, message)
+}
+
+func createReplicas(c *C, n int, sessions SessionStore, fragments FragmentStore) []*GenericServer {
+	f := CreateFactory(nil)
+	kp := f.CreateKeypair()
+	st, e := f.LoadStorageType("dir:" + c.MkDir())
+	c.Assert(e, IsNil)
+	result := []*GenericServer{}
+	for i := 0; i < n; i++ {
+		gs := f.NewServer("prekeys.example.org", kp, 0, st, time.Minute, time.Minute, nil).(*GenericServer)
+		gs.ShareState(sessions, fragments)
+		result = append(result, gs)
+	}
+	return result
+}
+
+func roundRobin(replicas []*GenericServer) *roundRobinServer {
+	r := &roundRobinServer{}
+	for _, gs := range replicas {
+		r.replicas = append(r.replicas, gs)
+	}
+	return r
+}
+
+func (s *GenericServerSuite) Test_ShareState_letsReplicasHandleEveryMessageOfAFlow(c *C) {
+	store := NewInProcessStore()
+	replicas := createReplicas(c, 3, store, store)
+	lb := roundRobin(replicas)
+	sita := createTestClient("sita@example.org", lb)
+	sita.FragmentLength = 200
+
+	c.Assert(sita.Publish(&Publication{
+		ClientProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyProfileExpiry: time.Now().Add(time.Hour),
+		PrekeyMessages:      3,
+	}), IsNil)
+	num, e := sita.StorageStatus()
+	c.Assert(e, IsNil)
+	c.Assert(num, Equals, uint32(3))
+
+	rama := createTestClient("rama@example.org", lb)
+	rama.FragmentLength = 200
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+
+	// the storage status request leaves its session to expire, as it does when kept in the process
+	count, _ := store.CountSessions()
+	c.Assert(count, Equals, 1)
+	count, _ = store.CountPending()
+	c.Assert(count, Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_ShareState_isNeededWithoutStickyRouting(c *C) {
+	lb := roundRobin(createReplicas(c, 2, nil, nil))
+	sita := createTestClient("sita@example.org", lb)
+	_, e := sita.StorageStatus()
+	c.Assert(e, ErrorMatches, ".*incorrect instance tag")
+}
+
+// retaggingServer changes the sender instance tag of the fragments it passes on
+type retaggingServer struct {
+	s   Server
+	tag string
+}
+
+func (r *retaggingServer) Handle(from, message string) ([]string, error) {
+	parts := strings.SplitN(message, "|", 4)
+	if len(parts) == 4 {
+		parts[2] = r.tag
+		message = strings.Join(parts, "|")
+	}
+	return r.s.Handle(from, message)
+}
+
+func (s *GenericServerSuite) Test_ShareState_checksTheInstanceTagsOfFragments(c *C) {
+	store := NewInProcessStore()
+	gs := createReplicas(c, 1, store, store)[0]
+	sita := createTestClient("sita@example.org", &retaggingServer{s: gs, tag: "000000FF"})
+	sita.FragmentLength = 200
+	c.Assert(sita.Handshake(), ErrorMatches, "invalid sender instance tag in fragment")
+
+	sita.Server = &retaggingServer{s: gs, tag: "1245ABCD"}
+	c.Assert(sita.Handshake(), ErrorMatches, "the instance tag of the fragments doesn't match the message")
+	count, _ := store.CountPending()
+	c.Assert(count, Equals, 0)
+
+	// the pieces of clients with different instance tags are kept apart
+	c.Assert(fragmentKey("sita@example.org", 0x1245ABCD, 1), Equals, "sita@example.org/1245ABCD/1")
+	c.Assert(fragmentKey("sita@example.org", 0x1245ABCD, 1), Not(Equals), fragmentKey("sita@example.org", 0x1245ABCE, 1))
+}
+
+func (s *GenericServerSuite) Test_ShareState_keepsTheSessionUntilTheDAKEIsComplete(c *C) {
+	store := NewInProcessStore()
+	replicas := createReplicas(c, 2, store, nil)
+	sita := createTestClient("sita@example.org", replicas[0])
+	c.Assert(sita.Handshake(), IsNil)
+
+	c.Assert(replicas[1].hasSession("sita@example.org"), Equals, true)
+	c.Assert(replicas[1].hasSession("rama@example.org"), Equals, false)
+	checks := replicas[1].CheckReadiness(HealthLimits{MaxSessions: 1})
+	c.Assert(checks[2].OK, Equals, true)
+	c.Assert(replicas[1].ActiveSessions(), Equals, 0)
+
+	var state bytes.Buffer
+	n, e := replicas[0].ExportSessions(&state)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 0)
+
+	replicas[1].sessionComplete("sita@example.org")
+	c.Assert(replicas[0].hasSession("sita@example.org"), Equals, false)
+}
+
+func (s *GenericServerSuite) Test_ShareState_importsHandedOverSessionsIntoTheStore(c *C) {
+	local := createReplicas(c, 1, nil, nil)[0]
+	c.Assert(createTestClient("sita@example.org", local).Handshake(), IsNil)
+	var state bytes.Buffer
+	n, _ := local.ExportSessions(&state)
+	c.Assert(n, Equals, 1)
+
+	store := NewInProcessStore()
+	shared := createReplicas(c, 1, store, store)[0]
+	n, e := shared.ImportSessions(&state)
+	c.Assert(e, IsNil)
+	c.Assert(n, Equals, 1)
+	count, _ := store.CountSessions()
+	c.Assert(count, Equals, 1)
+	c.Assert(shared.session("sita@example.org").instanceTag(), Equals, local.sessions.get("sita@example.org").instanceTag())
+}
+
+// failingStore fails every operation
+type failingStore struct{}
+
+var errStoreDown = errors.New("the store is down")
+
+func (failingStore) LoadSession(string) ([]byte, error)              { return nil, errStoreDown }
+func (failingStore) SaveSession(string, []byte, time.Duration) error { return errStoreDown }
+func (failingStore) DeleteSession(string) error                      { return errStoreDown }
+func (failingStore) CountSessions() (int, error)                     { return 0, errStoreDown }
+func (failingStore) CountPending() (int, error)                      { return 0, errStoreDown }
+func (failingStore) AddFragment(string, uint16, uint16, string, time.Duration) ([]string, error) {
+	return nil, errStoreDown
+}
+
+func (s *GenericServerSuite) Test_ShareState_reportsStoreFailures(c *C) {
+	gs := createReplicas(c, 1, failingStore{}, failingStore{})[0]
+	sita := createTestClient("sita@example.org", gs)
+	c.Assert(sita.Handshake(), ErrorMatches, ".*couldn't save the session: the store is down")
+
+	sita.FragmentLength = 200
+	c.Assert(sita.Handshake(), ErrorMatches, ".*the store is down")
+
+	checks := gs.CheckReadiness(HealthLimits{})
+	c.Assert(checks[2].Error, Equals, "couldn't count the sessions: the store is down")
+	c.Assert(checks[3].Error, Equals, "couldn't count the fragmented messages: the store is down")
+
+	gs.ShareState(NewInProcessStore(), nil)
+	gs.sharedSessions.SaveSession("rama@example.org", []byte("{}"), time.Minute)
+	c.Assert(gs.session("rama@example.org").loadError(), ErrorMatches, "the stored session is corrupted: .*")
+	gs.ShareState(failingStore{}, nil)
+	c.Assert(gs.session("rama@example.org").loadError(), ErrorMatches, "couldn't load the session: the store is down")
+}
+
+func (s *GenericServerSuite) Test_InProcessStore_expiresSessions(c *C) {
+	store := NewInProcessStore()
+	c.Assert(store.SaveSession("sita@example.org", []byte("one"), time.Minute), IsNil)
+	c.Assert(store.SaveSession("rama@example.org", []byte("two"), time.Millisecond), IsNil)
+	time.Sleep(5 * time.Millisecond)
+
+	d, _ := store.LoadSession("sita@example.org")
+	c.Assert(string(d), Equals, "one")
+	d, _ = store.LoadSession("rama@example.org")
+	c.Assert(d, IsNil)
+	n, _ := store.CountSessions()
+	c.Assert(n, Equals, 1)
+	c.Assert(store.DeleteSession("sita@example.org"), IsNil)
+	n, _ = store.CountSessions()
+	c.Assert(n, Equals, 0)
+}
+
+func (s *GenericServerSuite) Test_InProcessStore_putsFragmentsTogether(c *C) {
+	store := NewInProcessStore()
+	p, e := store.AddFragment("sita@example.org/1", 2, 3, "b", time.Minute)
+	c.Assert(e, IsNil)
+	c.Assert(p, IsNil)
+	store.AddFragment("sita@example.org/1", 2, 3, "b", time.Minute)
+	store.AddFragment("sita@example.org/1", 3, 3, "c", time.Minute)
+	n, _ := store.CountPending()
+	c.Assert(n, Equals, 1)
+
+	_, e = store.AddFragment("sita@example.org/1", 1, 4, "a", time.Minute)
+	c.Assert(e, ErrorMatches, "inconsistent total")
+	_, e = store.AddFragment("sita@example.org/1", 4, 3, "a", time.Minute)
+	c.Assert(e, ErrorMatches, "invalid fragment index")
+
+	p, _ = store.AddFragment("sita@example.org/1", 1, 3, "a", time.Minute)
+	c.Assert(p, DeepEquals, []string{"a", "b", "c"})
+	n, _ = store.CountPending()
+	c.Assert(n, Equals, 0)
+
+	store.AddFragment("sita@example.org/2", 1, 2, "a", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	p, _ = store.AddFragment("sita@example.org/2", 2, 2, "b", time.Millisecond)
+	c.Assert(p, IsNil)
+}
+
+func (s *GenericServerSuite) Test_parseFragment_parsesTheFragmentPrefix(c *C) {
+	f, ok := parseFragment("?OTRP|3735928559|1245ABCD|00000000,2,3,abc,")
+	c.Assert(ok, Equals, true)
+	c.Assert(*f, DeepEquals, fragment{id: 3735928559, senderTag: 0x1245ABCD, index: 2, total: 3, piece: "abc"})
+
+	_, ok = parseFragment("?OTRP|1|1245ABCD|00000000,4,3,abc,")
+	c.Assert(ok, Equals, false)
+	_, ok = parseFragment("?OTRP|1|1245ABCD,1,1,abc,")
+	c.Assert(ok, Equals, false)
+	_, ok = parseFragment("?OTRP|x|1245ABCD|00000000,1,1,abc,")
+	c.Assert(ok, Equals, false)
+}
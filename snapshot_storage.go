@@ -0,0 +1,554 @@
+package prekeyserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otrv4/gotrx"
+)
+
+// Design:
+// - the in-memory storage can be persisted by giving it a snapshot file, with a descriptor like
+//   in-memory:snapshot=/var/lib/otrng/prekeys.snapshot,interval=5m
+// - the snapshot is everything stored, in the export format. It's written to a temporary file
+//   that is renamed over the old one, so there is always one complete snapshot
+// - every change made between snapshots is appended to a journal, one JSON line per change: the
+//   items stored, in the export format, and the prekey messages retrieved and the purges
+// - journals are numbered, like prekeys.snapshot.journal.7. Before taking a snapshot, a new
+//   journal is started, and once the snapshot is written, the journals it includes are removed.
+//   If the process dies in between, the old journals are replayed on top of the new snapshot,
+//   which is fine since replaying a change that is already in the snapshot doesn't change anything
+// - the files are only read the first time the storage is used, so that a server taking over from
+//   another process doesn't read them until the other process has written its last snapshot.
+//   Everything that expired in the meantime is dropped, and a new snapshot is taken right away
+// - the journal is written, but not synced, so a crash of the process loses nothing, but a crash
+//   of the machine can lose the last changes
+
+const (
+	snapshotStoragePrefix   = "in-memory:"
+	defaultSnapshotInterval = 5 * time.Minute
+	minimumSnapshotInterval = time.Second
+	journalFormat           = "otrng-prekey-server-journal"
+	journalVersion          = 1
+	journalSuffix           = ".journal."
+)
+
+const (
+	journalRetrieved = "retrieved"
+	journalPurged    = "purged"
+)
+
+var errStorageClosed = errors.New("the storage is closed")
+
+func isSnapshotStorageDescriptor(desc string) bool {
+	return strings.HasPrefix(desc, snapshotStoragePrefix)
+}
+
+// snapshotStorageFactory creates the storage once, so every server using it shares the files
+type snapshotStorageFactory struct {
+	st *snapshotStorage
+}
+
+func createSnapshotStorageFactoryFrom(desc string) (Storage, error) {
+	opts, e := parseStorageOptions(strings.TrimPrefix(desc, snapshotStoragePrefix), "snapshot", "interval")
+	if e != nil {
+		return nil, e
+	}
+	file, ok := opts["snapshot"]
+	if !ok {
+		return nil, errors.New("the snapshot file has to be given, like in-memory:snapshot=/PATH/FILE")
+	}
+	if !entryExists(filepath.Dir(file)) {
+		return nil, errors.New("the directory of the snapshot file doesn't exist")
+	}
+	interval := defaultSnapshotInterval
+	if v, ok := opts["interval"]; ok {
+		if interval, e = time.ParseDuration(v); e != nil || interval < minimumSnapshotInterval {
+			return nil, fmt.Errorf("invalid snapshot interval %q, it has to be at least %v", v, minimumSnapshotInterval)
+		}
+	}
+	return &snapshotStorageFactory{st: createSnapshotStorage(file, interval)}, nil
+}
+
+func (ssf *snapshotStorageFactory) createStorage() storage {
+	return ssf.st
+}
+
+type snapshotStorage struct {
+	*inMemoryStorage
+	file     string
+	interval time.Duration
+
+	openOnce sync.Once
+	openErr  error
+
+	// changes is held while making a change and writing it to the journal, so the journal
+	// has the changes in the order they were made, and while starting a new journal
+	changes    sync.Mutex
+	journal    *os.File
+	journalNum int
+	closed     bool
+	lastErr    error
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func createSnapshotStorage(file string, interval time.Duration) *snapshotStorage {
+	return &snapshotStorage{
+		inMemoryStorage: createInMemoryStorage(),
+		file:            file,
+		interval:        interval,
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+}
+
+func (s *snapshotStorage) journalName(num int) string {
+	return s.file + journalSuffix + strconv.Itoa(num)
+}
+
+// journals returns the numbers of the journals on disk, in order
+func (s *snapshotStorage) journals() ([]int, error) {
+	names, e := filepath.Glob(s.file + journalSuffix + "*")
+	if e != nil {
+		return nil, e
+	}
+	result := []int{}
+	for _, n := range names {
+		if num, e := strconv.Atoi(strings.TrimPrefix(n, s.file+journalSuffix)); e == nil {
+			result = append(result, num)
+		}
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+// open restores the storage from the files the first time it's used
+func (s *snapshotStorage) open() error {
+	s.openOnce.Do(func() {
+		if s.openErr = s.restore(); s.openErr != nil {
+			s.openErr = fmt.Errorf("couldn't restore the in-memory storage: %v", s.openErr)
+			return
+		}
+		go s.keepSnapshotting()
+	})
+	return s.openErr
+}
+
+func (s *snapshotStorage) restore() error {
+	if e := s.readSnapshot(); e != nil {
+		return e
+	}
+	nums, e := s.journals()
+	if e != nil {
+		return e
+	}
+	for _, num := range nums {
+		if e := s.replayJournal(s.journalName(num)); e != nil {
+			return e
+		}
+	}
+	s.inMemoryStorage.cleanup()
+
+	if len(nums) > 0 {
+		s.journalNum = nums[len(nums)-1]
+	}
+	return s.snapshot(false)
+}
+
+// restoreItem stores an item read from the snapshot or a journal, unless it has expired
+func (s *snapshotStorage) restoreItem(ei *ExportItem) error {
+	it, e := ei.intoStored()
+	if e != nil {
+		return e
+	}
+	if it.hasExpired() {
+		return nil
+	}
+	return s.inMemoryStorage.importItem(it)
+}
+
+func (s *snapshotStorage) readSnapshot() error {
+	f, e := os.Open(s.file)
+	if os.IsNotExist(e) {
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	er, e := NewExportReader(f)
+	if e != nil {
+		return fmt.Errorf("the snapshot: %v", e)
+	}
+	for {
+		ei, e := er.Next()
+		if e == io.EOF {
+			return nil
+		}
+		if e == nil {
+			e = s.restoreItem(ei)
+		}
+		if e != nil {
+			return fmt.Errorf("the snapshot: %v", e)
+		}
+	}
+}
+
+// replayJournal makes the changes in the journal. The last line is ignored if it's incomplete,
+// since that is what's left when the process stops while writing it
+func (s *snapshotStorage) replayJournal(name string) error {
+	f, e := os.Open(name)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		l, e := r.ReadBytes('\n')
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		if line == 1 {
+			h := &exportHeader{}
+			if json.Unmarshal(l, h) != nil || h.Format != journalFormat || h.Version != journalVersion {
+				return fmt.Errorf("%s is not a journal this version can read", name)
+			}
+			continue
+		}
+		ei := &ExportItem{}
+		if e = json.Unmarshal(l, ei); e == nil {
+			e = s.replay(ei)
+		}
+		if e != nil {
+			return fmt.Errorf("line %d of %s: %v", line, name, e)
+		}
+	}
+}
+
+func (s *snapshotStorage) replay(ei *ExportItem) error {
+	id := &StoredIdentity{Identity: ei.Identity, Hash: ei.Hash}
+	switch ei.Type {
+	case journalRetrieved:
+		s.inMemoryStorage.removePrekeyMessage(id, ei.InstanceTag, ei.Identifier)
+	case journalPurged:
+		_, e := s.inMemoryStorage.purge(id, ei.InstanceTag)
+		return e
+	default:
+		return s.restoreItem(ei)
+	}
+	return nil
+}
+
+// startJournal starts a new journal, expecting the changes lock to be held
+func (s *snapshotStorage) startJournal() error {
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	f, e := os.OpenFile(s.journalName(s.journalNum+1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if e != nil {
+		return e
+	}
+	d, _ := json.Marshal(&exportHeader{Format: journalFormat, Version: journalVersion, Created: time.Now().UTC()})
+	if _, e := f.Write(append(d, '\n')); e != nil {
+		f.Close()
+		return e
+	}
+	s.journal = f
+	s.journalNum++
+	return nil
+}
+
+// writeJournal writes the changes to the journal with one write, expecting the changes lock to be held
+func (s *snapshotStorage) writeJournal(entries ...*ExportItem) error {
+	if s.journal == nil {
+		return errStorageClosed
+	}
+	data := []byte{}
+	for _, ei := range entries {
+		d, e := json.Marshal(ei)
+		if e != nil {
+			return e
+		}
+		data = append(append(data, d...), '\n')
+	}
+	_, e := s.journal.Write(data)
+	return e
+}
+
+// snapshot writes everything stored to the snapshot file, and removes the journals it includes.
+// The final snapshot is taken when closing, and no journal is started after it
+func (s *snapshotStorage) snapshot(final bool) error {
+	items := []*storedItem{}
+	s.changes.Lock()
+	if s.closed {
+		s.changes.Unlock()
+		return errStorageClosed
+	}
+	s.inMemoryStorage.exportItems(func(it *storedItem) error {
+		items = append(items, it)
+		return nil
+	})
+	included := s.journalNum
+	var e error
+	if final {
+		s.closed = true
+		if s.journal != nil {
+			e = s.journal.Close()
+			s.journal = nil
+		}
+	} else {
+		e = s.startJournal()
+	}
+	s.changes.Unlock()
+	if e != nil {
+		return e
+	}
+
+	if e := s.writeSnapshot(items); e != nil {
+		return e
+	}
+	nums, e := s.journals()
+	if e != nil {
+		return e
+	}
+	for _, num := range nums {
+		if num <= included {
+			if e := os.Remove(s.journalName(num)); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (s *snapshotStorage) writeSnapshot(items []*storedItem) error {
+	tmp := s.file + ".tmp"
+	f, e := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if e != nil {
+		return e
+	}
+	e = writeSnapshotTo(f, items)
+	if e == nil {
+		e = f.Sync()
+	}
+	if ec := f.Close(); e == nil {
+		e = ec
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func writeSnapshotTo(w io.Writer, items []*storedItem) error {
+	ew, e := NewExportWriter(w)
+	if e != nil {
+		return e
+	}
+	for _, it := range items {
+		if it.hasExpired() {
+			continue
+		}
+		if e := ew.Write(it.intoExport()); e != nil {
+			return e
+		}
+	}
+	_, e = ew.Close()
+	return e
+}
+
+func (s *snapshotStorage) keepSnapshotting() {
+	defer close(s.stopped)
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			e := s.snapshot(false)
+			s.changes.Lock()
+			s.lastErr = e
+			s.changes.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops taking snapshots and takes the last one. If the storage was never used, there is nothing to write
+func (s *snapshotStorage) close() error {
+	s.openOnce.Do(func() { s.openErr = errStorageClosed })
+	if s.openErr != nil {
+		return nil
+	}
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.stopped
+		s.closeErr = s.snapshot(true)
+	})
+	return s.closeErr
+}
+
+func identityOf(from string) *StoredIdentity {
+	return &StoredIdentity{Identity: from, Hash: identityHash(from)}
+}
+
+// change writes the change to the journal and makes it
+func (s *snapshotStorage) change(f func() error, entries ...*ExportItem) error {
+	if e := s.open(); e != nil {
+		return e
+	}
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	if e := s.writeJournal(entries...); e != nil {
+		s.lastErr = e
+		return e
+	}
+	return f()
+}
+
+func (s *snapshotStorage) storeClientProfile(from string, cp *gotrx.ClientProfile) error {
+	if cp == nil {
+		return nil
+	}
+	return s.change(func() error {
+		return s.inMemoryStorage.storeClientProfile(from, cp)
+	}, (&storedItem{id: identityOf(from), cp: cp}).intoExport())
+}
+
+func (s *snapshotStorage) storePrekeyProfile(from string, pp *prekeyProfile) error {
+	if pp == nil {
+		return nil
+	}
+	return s.change(func() error {
+		return s.inMemoryStorage.storePrekeyProfile(from, pp)
+	}, (&storedItem{id: identityOf(from), pp: pp}).intoExport())
+}
+
+func (s *snapshotStorage) storePrekeyMessages(from string, pms []*prekeyMessage) error {
+	if len(pms) == 0 {
+		return nil
+	}
+	entries := []*ExportItem{}
+	id := identityOf(from)
+	for _, pm := range pms {
+		entries = append(entries, (&storedItem{id: id, pm: pm}).intoExport())
+	}
+	return s.change(func() error {
+		return s.inMemoryStorage.storePrekeyMessages(from, pms)
+	}, entries...)
+}
+
+func (s *snapshotStorage) numberStored(from string, tag uint32) uint32 {
+	if s.open() != nil {
+		return 0
+	}
+	return s.inMemoryStorage.numberStored(from, tag)
+}
+
+// retrieveFor writes the prekey messages taken to the journal after taking them. If that fails,
+// they are still given out, since they can't be given out again, and the failure is reported by probe
+func (s *snapshotStorage) retrieveFor(from string) []*prekeyEnsemble {
+	if s.open() != nil {
+		return nil
+	}
+	s.changes.Lock()
+	defer s.changes.Unlock()
+	ens := s.inMemoryStorage.retrieveFor(from)
+	if len(ens) == 0 {
+		return ens
+	}
+	id := identityOf(from)
+	entries := []*ExportItem{}
+	for _, en := range ens {
+		entries = append(entries, &ExportItem{Type: journalRetrieved, Identity: id.Identity, Hash: id.Hash, InstanceTag: en.pm.instanceTag, Identifier: en.pm.identifier})
+	}
+	if e := s.writeJournal(entries...); e != nil {
+		s.lastErr = e
+	}
+	return ens
+}
+
+func (s *snapshotStorage) cleanup() {
+	if s.open() == nil {
+		s.inMemoryStorage.cleanup()
+	}
+}
+
+// probe also fails if the last snapshot or journal write failed
+func (s *snapshotStorage) probe() error {
+	if e := s.open(); e != nil {
+		return e
+	}
+	s.changes.Lock()
+	e := s.lastErr
+	s.changes.Unlock()
+	if e != nil {
+		return fmt.Errorf("couldn't write to %s: %v", s.file, e)
+	}
+	return s.inMemoryStorage.probe()
+}
+
+func (s *snapshotStorage) listIdentities() ([]*StoredIdentity, error) {
+	if e := s.open(); e != nil {
+		return nil, e
+	}
+	return s.inMemoryStorage.listIdentities()
+}
+
+func (s *snapshotStorage) instanceTagsFor(id *StoredIdentity) ([]*storedInstanceTag, error) {
+	if e := s.open(); e != nil {
+		return nil, e
+	}
+	return s.inMemoryStorage.instanceTagsFor(id)
+}
+
+func (s *snapshotStorage) purge(id *StoredIdentity, itag uint32) (*StoredCounts, error) {
+	var removed *StoredCounts
+	e := s.change(func() error {
+		var e error
+		removed, e = s.inMemoryStorage.purge(id, itag)
+		return e
+	}, &ExportItem{Type: journalPurged, Identity: id.Identity, Hash: id.Hash, InstanceTag: itag})
+	return removed, e
+}
+
+func (s *snapshotStorage) exportItems(f func(*storedItem) error) error {
+	if e := s.open(); e != nil {
+		return e
+	}
+	return s.inMemoryStorage.exportItems(f)
+}
+
+func (s *snapshotStorage) itemsFor(id *StoredIdentity) ([]*storedItem, error) {
+	if e := s.open(); e != nil {
+		return nil, e
+	}
+	return s.inMemoryStorage.itemsFor(id)
+}
+
+func (s *snapshotStorage) importItem(it *storedItem) error {
+	return s.change(func() error {
+		return s.inMemoryStorage.importItem(it)
+	}, it.intoExport())
+}
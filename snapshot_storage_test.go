@@ -0,0 +1,193 @@
+package prekeyserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func snapshotDescriptor(c *C) (string, string) {
+	file := filepath.Join(c.MkDir(), "prekeys.snapshot")
+	return "in-memory:snapshot=" + file, file
+}
+
+// restartedSnapshotStorage returns a new storage for the same files, as a new process would have
+func restartedSnapshotStorage(c *C, desc string) (*snapshotStorage, *Admin) {
+	st, e := CreateFactory(nil).LoadStorageType(desc)
+	c.Assert(e, IsNil)
+	ss := st.createStorage().(*snapshotStorage)
+	a, _ := newAdmin(ss, nil)
+	return ss, a
+}
+
+func (s *GenericServerSuite) Test_LoadStorageType_checksTheSnapshotOptions(c *C) {
+	f := CreateFactory(nil)
+	dir := c.MkDir()
+
+	st, e := f.LoadStorageType("in-memory:snapshot=" + filepath.Join(dir, "s") + ",interval=2m")
+	c.Assert(e, IsNil)
+	c.Assert(st.createStorage().(*snapshotStorage).interval, Equals, 2*time.Minute)
+	c.Assert(st.createStorage(), Equals, st.createStorage())
+	st, _ = f.LoadStorageType("in-memory:snapshot=" + filepath.Join(dir, "s"))
+	c.Assert(st.createStorage().(*snapshotStorage).interval, Equals, defaultSnapshotInterval)
+
+	_, e = f.LoadStorageType("in-memory:")
+	c.Assert(e, ErrorMatches, "the snapshot file has to be given, like in-memory:snapshot=/PATH/FILE")
+	_, e = f.LoadStorageType("in-memory:file=/tmp/s")
+	c.Assert(e, ErrorMatches, `unknown storage option "file"`)
+	_, e = f.LoadStorageType("in-memory:snapshot")
+	c.Assert(e, ErrorMatches, `invalid storage option "snapshot", expected key=value`)
+	_, e = f.LoadStorageType("in-memory:snapshot=" + filepath.Join(dir, "s") + ",snapshot=" + filepath.Join(dir, "t"))
+	c.Assert(e, ErrorMatches, `the storage option "snapshot" is given more than once`)
+	_, e = f.LoadStorageType("in-memory:snapshot=" + filepath.Join(dir, "missing", "s"))
+	c.Assert(e, ErrorMatches, "the directory of the snapshot file doesn't exist")
+	_, e = f.LoadStorageType("in-memory:snapshot=" + filepath.Join(dir, "s") + ",interval=10ms")
+	c.Assert(e, ErrorMatches, `invalid snapshot interval "10ms", it has to be at least 1s`)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_isRestoredFromTheJournalAfterACrash(c *C) {
+	desc, file := snapshotDescriptor(c)
+	server, _, _ := createAdminTestServer(c, desc)
+	rama := createTestClient("rama@example.org", server)
+	ens, e := rama.Retrieve("sita@example.org")
+	c.Assert(e, IsNil)
+	c.Assert(ens, HasLen, 1)
+	a, _ := server.Admin(nil)
+	before, _ := a.Totals()
+	c.Assert(before.PrekeyMessages, Equals, 7)
+
+	_, e = os.Stat(file)
+	c.Assert(e, IsNil)
+	_, e = os.Stat(file + ".journal.1")
+	c.Assert(e, IsNil)
+
+	ss, a2 := restartedSnapshotStorage(c, desc)
+	after, e := a2.Totals()
+	c.Assert(e, IsNil)
+	c.Assert(after, DeepEquals, before)
+	nums, _ := ss.journals()
+	c.Assert(nums, DeepEquals, []int{2})
+	c.Assert(ss.close(), IsNil)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_writesTheLastSnapshotWhenClosed(c *C) {
+	desc, file := snapshotDescriptor(c)
+	server, _, _ := createAdminTestServer(c, desc)
+	a, _ := server.Admin(nil)
+	before, _ := a.Totals()
+
+	c.Assert(server.Close(), IsNil)
+	c.Assert(server.Close(), IsNil)
+	ss := server.storageImpl.(*snapshotStorage)
+	nums, _ := ss.journals()
+	c.Assert(nums, HasLen, 0)
+	c.Assert(ss.storeClientProfile("sita@example.org", createTestClient("sita@example.org", nil).clientProfile(time.Now().Add(time.Hour))), Equals, errStorageClosed)
+
+	data, _ := ioutil.ReadFile(file)
+	c.Assert(string(data), Matches, `(?s)\{"format":"otrng-prekey-server-export".*"type":"end","counts":\{"clientProfiles":2,"prekeyProfiles":2,"prekeyMessages":8\}\}`+"\n")
+
+	_, a2 := restartedSnapshotStorage(c, desc)
+	after, _ := a2.Totals()
+	c.Assert(after, DeepEquals, before)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_doesNothingWhenClosedWithoutBeingUsed(c *C) {
+	desc, file := snapshotDescriptor(c)
+	ss, _ := restartedSnapshotStorage(c, desc)
+	c.Assert(ss.close(), IsNil)
+	_, e := os.Stat(file)
+	c.Assert(os.IsNotExist(e), Equals, true)
+	c.Assert(ss.probe(), Equals, errStorageClosed)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_dropsWhatExpiredWhileStopped(c *C) {
+	desc, _ := snapshotDescriptor(c)
+	ss, a := restartedSnapshotStorage(c, desc)
+	sita := createTestClient("sita@example.org", nil)
+	id := identityOf("sita@example.org")
+	c.Assert(ss.importItem(&storedItem{id: id, cp: sita.clientProfile(time.Now().Add(time.Second))}), IsNil)
+	pm, _, _, _ := generatePrekeyMessage(sita, sita.Keys.InstanceTag)
+	c.Assert(ss.importItem(&storedItem{id: id, pm: pm}), IsNil)
+	t, _ := a.Totals()
+	c.Assert(t.ClientProfiles, Equals, 1)
+
+	time.Sleep(time.Second)
+	_, a2 := restartedSnapshotStorage(c, desc)
+	t, _ = a2.Totals()
+	c.Assert(t.ClientProfiles, Equals, 0)
+	c.Assert(t.PrekeyMessages, Equals, 1)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_replaysJournalsAlreadyInTheSnapshotWithoutDuplicates(c *C) {
+	desc, file := snapshotDescriptor(c)
+	server, _, _ := createAdminTestServer(c, desc)
+	rama := createTestClient("rama@example.org", server)
+	rama.Retrieve("sita@example.org")
+	a, _ := server.Admin(nil)
+	before, _ := a.Totals()
+
+	// the process stops after writing the snapshot, before removing the journal it includes
+	journal, _ := ioutil.ReadFile(file + ".journal.1")
+	ss := server.storageImpl.(*snapshotStorage)
+	c.Assert(ss.snapshot(false), IsNil)
+	c.Assert(ioutil.WriteFile(file+".journal.1", journal, 0600), IsNil)
+
+	_, a2 := restartedSnapshotStorage(c, desc)
+	after, _ := a2.Totals()
+	c.Assert(after, DeepEquals, before)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_ignoresAnIncompleteLastJournalLine(c *C) {
+	desc, file := snapshotDescriptor(c)
+	server, _, _ := createAdminTestServer(c, desc)
+	a, _ := server.Admin(nil)
+	before, _ := a.Totals()
+
+	f, _ := os.OpenFile(file+".journal.1", os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte(`{"type":"prekey-message","identity":"sita@exa`))
+	f.Close()
+
+	_, a2 := restartedSnapshotStorage(c, desc)
+	after, e := a2.Totals()
+	c.Assert(e, IsNil)
+	c.Assert(after, DeepEquals, before)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_refusesToWorkWithACorruptedJournal(c *C) {
+	desc, file := snapshotDescriptor(c)
+	createAdminTestServer(c, desc)
+
+	f, _ := os.OpenFile(file+".journal.1", os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte("{\"type\":\"prekey-message\",\"identity\":\"sita@exa\n"))
+	f.Close()
+
+	ss, _ := restartedSnapshotStorage(c, desc)
+	c.Assert(ss.probe(), ErrorMatches, "couldn't restore the in-memory storage: line .* of .*journal.1: invalid character .*")
+	c.Assert(ss.storeClientProfile("sita@example.org", createTestClient("sita@example.org", nil).clientProfile(time.Now().Add(time.Hour))), ErrorMatches, "couldn't restore.*")
+	c.Assert(ss.retrieveFor("sita@example.org"), IsNil)
+	_, e := os.Stat(file + ".journal.1")
+	c.Assert(e, IsNil)
+}
+
+func (s *GenericServerSuite) Test_snapshotStorage_takesSnapshotsPeriodically(c *C) {
+	_, file := snapshotDescriptor(c)
+	ss := createSnapshotStorage(file, 10*time.Millisecond)
+	defer ss.close()
+	c.Assert(ss.probe(), IsNil)
+
+	for i := 0; i < 100; i++ {
+		ss.changes.Lock()
+		num := ss.journalNum
+		ss.changes.Unlock()
+		if num > 2 {
+			nums, _ := ss.journals()
+			c.Assert(len(nums) <= 2, Equals, true)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("no snapshots were taken")
+}
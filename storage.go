@@ -1,6 +1,11 @@
 package prekeyserver
 
-import "github.com/otrv4/gotrx"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/otrv4/gotrx"
+)
 
 type storage interface {
 	storeClientProfile(string, *gotrx.ClientProfile) error
@@ -9,4 +14,87 @@ type storage interface {
 	numberStored(string, uint32) uint32
 	retrieveFor(string) []*prekeyEnsemble
 	cleanup()
+	// probe checks that entries can be written and read back
+	probe() error
+}
+
+// closableStorage is implemented by storages that have to do something before the server stops
+type closableStorage interface {
+	close() error
+}
+
+// statsStorage is implemented by storages that keep statistics
+type statsStorage interface {
+	stats() *StorageStats
+}
+
+// StorageStats are the statistics a storage keeps while the server is running
+type StorageStats struct {
+	// Rebalancing is true while a sharded storage is moving identities to their shards
+	Rebalancing bool
+	Shards      []*ShardStats `json:",omitempty"`
+	Cache       *CacheStats   `json:",omitempty"`
+}
+
+// ShardStats counts what one shard of a sharded storage has done
+type ShardStats struct {
+	Shard             string
+	Stores            uint64
+	Retrievals        uint64
+	Failures          uint64
+	MovedIn           uint64
+	MovedOut          uint64
+	Cleanups          uint64
+	LastCleanupMillis int64
+}
+
+// CacheStats counts how the cache of a cached storage has been used. Evictions are the entries dropped
+// to stay within MaxEntries, and invalidations the ones dropped since what they have was changed
+type CacheStats struct {
+	Entries       int
+	MaxEntries    int
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+// StorageStatsReporter is implemented by servers that can report the statistics of their storage
+type StorageStatsReporter interface {
+	// StorageStats returns nil if the storage keeps no statistics
+	StorageStats() *StorageStats
+}
+
+// StorageStats implements the StorageStatsReporter interface
+func (g *GenericServer) StorageStats() *StorageStats {
+	if ss, ok := g.storageImpl.(statsStorage); ok {
+		return ss.stats()
+	}
+	return nil
+}
+
+// parseStorageOptions parses the options of a storage descriptor, given as comma separated key=value pairs
+func parseStorageOptions(options string, known ...string) (map[string]string, error) {
+	result := map[string]string{}
+	if options == "" {
+		return result, nil
+	}
+	for _, o := range strings.Split(options, ",") {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid storage option %q, expected key=value", o)
+		}
+		isKnown := false
+		for _, k := range known {
+			isKnown = isKnown || k == kv[0]
+		}
+		if !isKnown {
+			return nil, fmt.Errorf("unknown storage option %q", kv[0])
+		}
+		if _, ok := result[kv[0]]; ok {
+			return nil, fmt.Errorf("the storage option %q is given more than once", kv[0])
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
 }